@@ -68,6 +68,10 @@ func (f *File) Stat() (fs.FileInfo, error) {
 }
 
 func (f *File) Read(p []byte) (int, error) {
+	// empty files have no handle
+	if f.r == nil {
+		return 0, io.EOF
+	}
 	return f.r.Read(p)
 }
 
@@ -124,13 +128,19 @@ func (f *File) ReadAt(p []byte, off int64) (int, error) {
 }
 
 func (f *File) Close() error {
+	if f.handle == nil {
+		return nil
+	}
 	return f.handle.Close()
 }
 
 type FS struct {
-	open  func() (io.ReadSeekCloser, error)
-	files []*Entry
-	index map[string]int
+	open func() (io.ReadSeekCloser, error)
+	// openEntry, if set, opens the content of entries, which are not in a tar, see
+	// NewFromEntries.
+	openEntry func(hdr *tar.Header) (io.ReadSeekCloser, error)
+	files     []*Entry
+	index     map[string]int
 }
 
 func (fsys *FS) Readlink(name string) (string, error) {
@@ -156,8 +166,16 @@ func (fsys *FS) Open(name string) (fs.File, error) {
 		return nil, fs.ErrNotExist
 	}
 
-	e := fsys.files[i]
+	f, err := fsys.OpenEntry(fsys.files[i])
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
 
+// OpenEntry opens the entry e of fsys, which may not be the one Open opens, e.g. if there
+// are more entries with its name.
+func (fsys *FS) OpenEntry(e *Entry) (*File, error) {
 	f := &File{
 		fsys:  fsys,
 		Entry: e,
@@ -167,7 +185,15 @@ func (fsys *FS) Open(name string) (fs.File, error) {
 		return f, nil
 	}
 
-	rc, err := fsys.OpenAt(e.Offset)
+	var (
+		rc  io.ReadSeekCloser
+		err error
+	)
+	if fsys.openEntry != nil {
+		rc, err = fsys.openEntry(&e.Header)
+	} else {
+		rc, err = fsys.OpenAt(e.Offset)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -250,12 +276,6 @@ func (cr *countReader) Read(p []byte) (int, error) {
 }
 
 func New(open func() (io.ReadSeekCloser, error)) (*FS, error) {
-	fsys := &FS{
-		open:  open,
-		files: []*Entry{},
-		index: map[string]int{},
-	}
-
 	// TODO: Consider caching this across builds.
 	r, err := open()
 	if err != nil {
@@ -263,7 +283,20 @@ func New(open func() (io.ReadSeekCloser, error)) (*FS, error) {
 	}
 	defer r.Close()
 
-	cr := &countReader{bufio.NewReaderSize(r, 1<<20), 0}
+	return Index(open, bufio.NewReaderSize(r, 1<<20), nil)
+}
+
+// Index is like New, but indexes the tar as it is read from r, which must be what open
+// returns, e.g. while r is also being written to the file that open opens. If visit is not
+// nil, it is called with every entry and its content, so the tar is read only once.
+func Index(open func() (io.ReadSeekCloser, error), r io.Reader, visit func(hdr *tar.Header, r io.Reader) error) (*FS, error) {
+	fsys := &FS{
+		open:  open,
+		files: []*Entry{},
+		index: map[string]int{},
+	}
+
+	cr := &countReader{r, 0}
 	tr := tar.NewReader(cr)
 	for {
 		hdr, err := tr.Next()
@@ -273,14 +306,40 @@ func New(open func() (io.ReadSeekCloser, error)) (*FS, error) {
 		if err != nil {
 			return nil, err
 		}
-		fsys.index[hdr.Name] = len(fsys.files)
-		fsys.files = append(fsys.files, &Entry{
-			Header: *hdr,
-			Offset: cr.n,
-			dir:    path.Dir(hdr.Name),
-			fi:     hdr.FileInfo(),
-		})
+		fsys.add(hdr, cr.n)
+		if visit != nil {
+			if err := visit(hdr, tr); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return fsys, nil
 }
+
+// NewFromEntries returns an FS of the entries with headers, whose content is not in a tar
+// but opened with open, e.g. from a file each. The entries have no offset.
+func NewFromEntries(headers []tar.Header, open func(hdr *tar.Header) (io.ReadSeekCloser, error)) *FS {
+	fsys := &FS{
+		open: func() (io.ReadSeekCloser, error) {
+			return nil, errors.New("no tar: the entries are opened one by one")
+		},
+		openEntry: open,
+		files:     make([]*Entry, 0, len(headers)),
+		index:     map[string]int{},
+	}
+	for i := range headers {
+		fsys.add(&headers[i], 0)
+	}
+	return fsys
+}
+
+func (fsys *FS) add(hdr *tar.Header, offset int64) {
+	fsys.index[hdr.Name] = len(fsys.files)
+	fsys.files = append(fsys.files, &Entry{
+		Header: *hdr,
+		Offset: offset,
+		dir:    path.Dir(hdr.Name),
+		fi:     hdr.FileInfo(),
+	})
+}
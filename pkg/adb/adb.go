@@ -0,0 +1,249 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package adb reads the ADB format that apk-tools v3 uses for indexes and packages.
+//
+// An ADB file is an 8 byte header, the "ADB." magic followed by a 4 byte schema, followed
+// by a sequence of blocks. The first block is the ADB block, a tree of values described
+// by the schema. It is followed by SIG blocks signing it and, in packages, by DATA blocks
+// holding the contents of files. The whole file may be compressed, in which case it
+// starts with a different magic, see NewReader.
+//
+// See https://gitlab.alpinelinux.org/alpine/apk-tools/-/blob/master/doc/apk-v3.5.scd
+package adb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// Magic is the magic of an uncompressed ADB file.
+	Magic = "ADB."
+
+	// magicDeflate starts an ADB file compressed with raw deflate.
+	magicDeflate = "ADBd"
+	// magicCompressed starts an ADB file compressed as described by the 2 bytes that
+	// follow it: the algorithm and the level.
+	magicCompressed = "ADBc"
+
+	// HeaderSize is the size of the file header: the magic and the schema.
+	HeaderSize = 8
+)
+
+// Schemas of ADB files.
+const (
+	SchemaIndex   = "indx"
+	SchemaPackage = "pckg"
+)
+
+// Compression algorithms of "ADBc" files, as numbered by apk-tools.
+const (
+	compressionNone    = 0
+	compressionDeflate = 1
+	compressionZstd    = 2
+)
+
+// BlockType is the type of a block.
+type BlockType uint32
+
+const (
+	// BlockADB holds the tree of values of the file.
+	BlockADB BlockType = 0
+	// BlockSig holds a signature of the ADB block.
+	BlockSig BlockType = 1
+	// BlockData holds the contents of a file of a package.
+	BlockData BlockType = 2
+	// blockExt marks a block whose size does not fit in 30 bits. Its real type follows.
+	blockExt BlockType = 3
+)
+
+const (
+	blockAlignment = 8
+	blockSizeMask  = 0x3fffffff
+)
+
+// IsADB returns true if b starts like an ADB file, compressed or not. It needs at least
+// the first 4 bytes of the file.
+func IsADB(b []byte) bool {
+	if len(b) < 4 {
+		return false
+	}
+	switch string(b[:4]) {
+	case Magic, magicDeflate, magicCompressed:
+		return true
+	}
+	return false
+}
+
+// Reader reads the blocks of an ADB file.
+type Reader struct {
+	r      io.Reader
+	header [HeaderSize]byte
+
+	// cur is the unread rest of the current block, and pad its padding.
+	cur *io.LimitedReader
+	pad int64
+}
+
+// NewReader reads the header of the ADB file in r, decompressing it if needed.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("reading ADB magic: %w", err)
+	}
+
+	var src io.Reader = br
+	switch string(magic) {
+	case Magic:
+	case magicDeflate:
+		if _, err := br.Discard(4); err != nil {
+			return nil, err
+		}
+		src = flate.NewReader(br)
+	case magicCompressed:
+		var spec [6]byte
+		if _, err := io.ReadFull(br, spec[:]); err != nil {
+			return nil, fmt.Errorf("reading ADB compression: %w", err)
+		}
+		switch alg := spec[4]; alg {
+		case compressionNone:
+		case compressionDeflate:
+			src = flate.NewReader(br)
+		case compressionZstd:
+			zr, err := zstd.NewReader(br)
+			if err != nil {
+				return nil, err
+			}
+			src = zr.IOReadCloser()
+		default:
+			return nil, fmt.Errorf("unsupported ADB compression %d", alg)
+		}
+	default:
+		return nil, fmt.Errorf("not an ADB file: magic %q", magic)
+	}
+
+	ar := &Reader{r: src}
+	if _, err := io.ReadFull(src, ar.header[:]); err != nil {
+		return nil, fmt.Errorf("reading ADB header: %w", err)
+	}
+	if string(ar.header[:4]) != Magic {
+		return nil, fmt.Errorf("not an ADB file: magic %q", ar.header[:4])
+	}
+	return ar, nil
+}
+
+// Header returns the 8 byte file header, which signatures cover.
+func (r *Reader) Header() []byte {
+	return r.header[:]
+}
+
+// Schema returns the schema of the file, e.g. SchemaIndex.
+func (r *Reader) Schema() string {
+	return string(r.header[4:])
+}
+
+// Next advances to the next block, skipping what is left of the current one. It returns
+// the type of the block and a reader for its payload, which is valid until the next call.
+// It returns io.EOF after the last block.
+func (r *Reader) Next() (BlockType, io.Reader, error) {
+	if r.cur != nil {
+		if _, err := io.CopyN(io.Discard, r.r, r.cur.N+r.pad); err != nil {
+			return 0, nil, fmt.Errorf("skipping ADB block: %w", unexpectedEOF(err))
+		}
+		r.cur = nil
+	}
+
+	var typeSize uint32
+	if err := binary.Read(r.r, binary.LittleEndian, &typeSize); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, nil, io.EOF
+		}
+		return 0, nil, fmt.Errorf("reading ADB block: %w", unexpectedEOF(err))
+	}
+	typ, size, hdrSize := BlockType(typeSize>>30), uint64(typeSize&blockSizeMask), uint64(4)
+	if typ == blockExt {
+		var ext struct {
+			Reserved uint32
+			Size     uint64
+		}
+		if err := binary.Read(r.r, binary.LittleEndian, &ext); err != nil {
+			return 0, nil, fmt.Errorf("reading ADB block: %w", unexpectedEOF(err))
+		}
+		typ, size, hdrSize = BlockType(size), ext.Size, 16
+	}
+	if size < hdrSize {
+		return 0, nil, fmt.Errorf("invalid ADB block size %d", size)
+	}
+
+	r.cur = &io.LimitedReader{R: r.r, N: int64(size - hdrSize)}
+	r.pad = int64((blockAlignment - size%blockAlignment) % blockAlignment)
+	return typ, r.cur, nil
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readADB reads the ADB block and the SIG blocks that follow it from r. It stops at the
+// first block of any other type, which it leaves for the caller to read from the
+// returned reader.
+func readADB(r *Reader, schema string) (db *DB, sigs [][]byte, next BlockType, nextBody io.Reader, err error) {
+	if got := r.Schema(); got != schema {
+		return nil, nil, 0, nil, fmt.Errorf("unexpected ADB schema %q, expected %q", got, schema)
+	}
+
+	typ, body, err := r.Next()
+	if err != nil {
+		return nil, nil, 0, nil, unexpectedEOF(err)
+	}
+	if typ != BlockADB {
+		return nil, nil, 0, nil, fmt.Errorf("unexpected ADB block type %d, expected the ADB block first", typ)
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, nil, 0, nil, fmt.Errorf("reading ADB block: %w", err)
+	}
+	if db, err = NewDB(b); err != nil {
+		return nil, nil, 0, nil, err
+	}
+
+	for {
+		typ, body, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return db, sigs, 0, nil, nil
+		}
+		if err != nil {
+			return nil, nil, 0, nil, err
+		}
+		if typ != BlockSig {
+			return db, sigs, typ, body, nil
+		}
+		sig, err := io.ReadAll(body)
+		if err != nil {
+			return nil, nil, 0, nil, fmt.Errorf("reading ADB signature: %w", err)
+		}
+		sigs = append(sigs, sig)
+	}
+}
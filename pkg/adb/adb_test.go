@@ -0,0 +1,244 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package adb
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+// testBuilder builds the payload of an ADB block.
+type testBuilder struct {
+	buf []byte
+}
+
+func newTestBuilder() *testBuilder {
+	return &testBuilder{buf: make([]byte, adbHeaderSize)}
+}
+
+func (b *testBuilder) blob(s string) Val {
+	off := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(len(s)))
+	b.buf = append(b.buf, s...)
+	return TypeBlob16 | Val(off)
+}
+
+func (b *testBuilder) int(n uint64) Val {
+	if n <= uint64(valueMask) {
+		return TypeInt | Val(n)
+	}
+	off := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint64(b.buf, n)
+	return TypeInt64 | Val(off)
+}
+
+func (b *testBuilder) object(typ Val, vals ...Val) Val {
+	for len(b.buf)%4 != 0 {
+		b.buf = append(b.buf, 0)
+	}
+	off := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(vals)+1))
+	for _, v := range vals {
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(v))
+	}
+	return typ | Val(off)
+}
+
+func (b *testBuilder) obj(vals ...Val) Val { return b.object(TypeObject, vals...) }
+func (b *testBuilder) arr(vals ...Val) Val { return b.object(TypeArray, vals...) }
+
+func (b *testBuilder) finish(root Val) []byte {
+	binary.LittleEndian.PutUint32(b.buf[4:], uint32(root))
+	return b.buf
+}
+
+func testBlock(typ BlockType, payload []byte) []byte {
+	size := 4 + len(payload)
+	out := binary.LittleEndian.AppendUint32(nil, uint32(typ)<<30|uint32(size))
+	out = append(out, payload...)
+	for len(out)%blockAlignment != 0 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+func testFile(schema string, blocks ...[]byte) []byte {
+	out := []byte(Magic + schema)
+	for _, b := range blocks {
+		out = append(out, b...)
+	}
+	return out
+}
+
+func testIndex() []byte {
+	b := newTestBuilder()
+	hello := b.obj(
+		b.blob("hello"), b.blob("1.0-r0"), b.blob("0123456789abcdef0123"), b.blob("says hello"),
+		b.blob("x86_64"), b.blob("MIT"), b.blob("hello"), b.blob("someone"), b.blob("https://example.com"),
+		Null, b.int(1700000000), b.int(1234), b.int(5678), Null,
+		b.arr(
+			b.obj(b.blob("so:libc.musl-x86_64.so.1")),
+			b.obj(b.blob("busybox"), b.blob("1.36"), b.int(MatchGreater|MatchEqual)),
+			b.obj(b.blob("evil"), Null, b.int(MatchConflict)),
+		),
+		b.arr(b.obj(b.blob("cmd:hello"), b.blob("1.0-r0"))),
+	)
+	world := b.obj(b.blob("world"), b.blob("2.0-r1"))
+	root := b.obj(b.blob("test index"), b.arr(hello, world))
+	return b.finish(root)
+}
+
+func TestReadIndex(t *testing.T) {
+	adbBlock := testIndex()
+	raw := testFile(SchemaIndex, testBlock(BlockADB, adbBlock), testBlock(BlockSig, []byte("signature")))
+
+	var deflated bytes.Buffer
+	fw, err := flate.NewWriter(&deflated, flate.BestCompression)
+	require.NoError(t, err)
+	_, err = fw.Write(raw)
+	require.NoError(t, err)
+	require.NoError(t, fw.Close())
+
+	var zstded bytes.Buffer
+	zw, err := zstd.NewWriter(&zstded)
+	require.NoError(t, err)
+	_, err = zw.Write(raw)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	for name, file := range map[string][]byte{
+		"uncompressed": raw,
+		"deflate":      append([]byte(magicDeflate), deflated.Bytes()...),
+		"adbc deflate": append([]byte(magicCompressed+"\x01\x09"), deflated.Bytes()...),
+		"adbc zstd":    append([]byte(magicCompressed+"\x02\x03"), zstded.Bytes()...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.True(t, IsADB(file))
+			idx, err := ReadIndex(bytes.NewReader(file))
+			require.NoError(t, err)
+
+			require.Equal(t, "test index", idx.Description)
+			require.Equal(t, [][]byte{[]byte("signature")}, idx.Signatures)
+			require.Equal(t, []byte(Magic+SchemaIndex), idx.Header)
+			require.Equal(t, adbBlock, idx.ADB)
+			require.Len(t, idx.Packages, 2)
+
+			hello := idx.Packages[0]
+			require.Equal(t, "hello", hello.Name)
+			require.Equal(t, "1.0-r0", hello.Version)
+			require.Equal(t, []byte("0123456789abcdef0123"), hello.UniqueID)
+			require.Equal(t, "x86_64", hello.Arch)
+			require.Equal(t, "MIT", hello.License)
+			require.Equal(t, uint64(1700000000), hello.BuildTime)
+			require.Equal(t, uint64(1234), hello.InstalledSize)
+			require.Equal(t, uint64(5678), hello.FileSize)
+			var deps []string
+			for _, d := range hello.Depends {
+				deps = append(deps, d.String())
+			}
+			require.Equal(t, []string{"so:libc.musl-x86_64.so.1", "busybox>=1.36", "!evil"}, deps)
+			require.Equal(t, "cmd:hello=1.0-r0", hello.Provides[0].String())
+
+			require.Equal(t, "world", idx.Packages[1].Name)
+			require.Empty(t, idx.Packages[1].Depends)
+		})
+	}
+
+	require.False(t, IsADB([]byte("\x1f\x8b\x08\x00")))
+	_, err = ReadIndex(bytes.NewReader(testFile(SchemaPackage, testBlock(BlockADB, adbBlock))))
+	require.ErrorContains(t, err, "schema")
+	_, err = ReadIndex(bytes.NewReader(raw[:len(raw)-20]))
+	require.Error(t, err)
+}
+
+func TestPackageReader(t *testing.T) {
+	b := newTestBuilder()
+	root := b.obj(
+		b.obj(b.blob("hello"), b.blob("1.0-r0")),
+		b.arr(
+			b.obj(b.blob(""), b.obj(b.int(0o755), b.blob("root"), b.blob("root"))),
+			b.obj(b.blob("usr/bin"), b.obj(b.int(0o755)), b.arr(
+				b.obj(b.blob("hello"), b.obj(b.int(0o755), b.blob("root"), b.blob("wheel")), b.int(6), b.int(1700000000)),
+				b.obj(b.blob("hi"), b.obj(b.int(0o777)), Null, Null, Null, b.blob("\x00\xa0hello")),
+				b.obj(b.blob("empty"), b.obj(b.int(0o644))),
+				b.obj(b.blob("readme"), b.obj(b.int(0o644)), b.int(5)),
+			)),
+		),
+		b.obj(Null, Null, b.blob("#!/bin/sh\necho installed\n")),
+		b.arr(b.blob("/usr/share/hello/*")),
+	)
+	adbBlock := b.finish(root)
+
+	data := func(pathIdx, fileIdx uint32, content string) []byte {
+		payload := binary.LittleEndian.AppendUint32(nil, pathIdx)
+		payload = binary.LittleEndian.AppendUint32(payload, fileIdx)
+		return testBlock(BlockData, append(payload, content...))
+	}
+	file := testFile(SchemaPackage,
+		testBlock(BlockADB, adbBlock),
+		testBlock(BlockSig, []byte("sig")),
+		data(2, 1, "hello\n"),
+		data(2, 4, "hi!!\n"),
+	)
+
+	pr, err := NewPackageReader(bytes.NewReader(file))
+	require.NoError(t, err)
+	pkg := pr.Package()
+	require.Equal(t, "hello", pkg.Info.Name)
+	require.Equal(t, []byte("#!/bin/sh\necho installed\n"), pkg.Scripts.PostInstall)
+	require.Equal(t, []string{"/usr/share/hello/*"}, pkg.Triggers)
+	require.Equal(t, [][]byte{[]byte("sig")}, pkg.Signatures)
+
+	type entry struct {
+		name, link, content string
+		typ                 byte
+		mode                int64
+		uname, gname        string
+	}
+	var got []entry
+	for {
+		hdr, err := pr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		content, err := io.ReadAll(pr)
+		require.NoError(t, err)
+		got = append(got, entry{hdr.Name, hdr.Linkname, string(content), hdr.Typeflag, hdr.Mode, hdr.Uname, hdr.Gname})
+	}
+	require.Equal(t, []entry{
+		{name: "usr/bin/", typ: tar.TypeDir, mode: 0o755},
+		{name: "usr/bin/hello", content: "hello\n", typ: tar.TypeReg, mode: 0o755, uname: "root", gname: "wheel"},
+		{name: "usr/bin/hi", link: "hello", typ: tar.TypeSymlink, mode: 0o777},
+		{name: "usr/bin/empty", typ: tar.TypeReg, mode: 0o644},
+		{name: "usr/bin/readme", content: "hi!!\n", typ: tar.TypeReg, mode: 0o644},
+	}, got)
+
+	// Data blocks must come in the order of the files.
+	file = testFile(SchemaPackage, testBlock(BlockADB, adbBlock), data(2, 4, "hi!!\n"))
+	pr, err = NewPackageReader(bytes.NewReader(file))
+	require.NoError(t, err)
+	_, err = pr.Next()
+	require.NoError(t, err)
+	_, err = pr.Next()
+	require.ErrorContains(t, err, "expected path 2 file 1")
+}
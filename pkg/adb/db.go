@@ -0,0 +1,200 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package adb
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Val is a value in an ADB block: a type in the top 4 bits, and either the value itself
+// or the offset of the value in the block in the rest.
+type Val uint32
+
+// Types of values.
+const (
+	TypeSpecial Val = 0x00000000
+	TypeInt     Val = 0x10000000
+	TypeInt32   Val = 0x20000000
+	TypeInt64   Val = 0x30000000
+	TypeBlob8   Val = 0x80000000
+	TypeBlob16  Val = 0x90000000
+	TypeBlob32  Val = 0xa0000000
+	TypeArray   Val = 0xd0000000
+	TypeObject  Val = 0xe0000000
+
+	typeMask  Val = 0xf0000000
+	valueMask Val = 0x0fffffff
+)
+
+// Null is the value of fields that are not set.
+const Null Val = 0
+
+// Type returns the type of v.
+func (v Val) Type() Val { return v & typeMask }
+
+func (v Val) value() uint32 { return uint32(v & valueMask) }
+
+// adbHeaderSize is the size of the header at the start of an ADB block: the compat and
+// format versions, 2 reserved bytes and the root value.
+const adbHeaderSize = 8
+
+// DB is the payload of an ADB block.
+type DB struct {
+	buf []byte
+}
+
+// NewDB returns the DB for the payload of an ADB block.
+func NewDB(b []byte) (*DB, error) {
+	if len(b) < adbHeaderSize {
+		return nil, fmt.Errorf("ADB block too short: %d bytes", len(b))
+	}
+	db := &DB{buf: b}
+	if root := db.Root(); root.Type() != TypeObject {
+		return nil, fmt.Errorf("ADB root is not an object: %#x", uint32(root))
+	}
+	return db, nil
+}
+
+// Bytes returns the raw payload of the block, which signatures cover.
+func (db *DB) Bytes() []byte {
+	return db.buf
+}
+
+// Root returns the root value, which is an object.
+func (db *DB) Root() Val {
+	return Val(binary.LittleEndian.Uint32(db.buf[4:8]))
+}
+
+// at returns n bytes at offset off, or nil if they are out of bounds.
+func (db *DB) at(off uint32, n uint64) []byte {
+	end := uint64(off) + n
+	if end > uint64(len(db.buf)) {
+		return nil
+	}
+	return db.buf[off:end]
+}
+
+// Int returns the value of an integer, or 0 if v is not one.
+func (db *DB) Int(v Val) uint64 {
+	switch v.Type() {
+	case TypeInt:
+		return uint64(v.value())
+	case TypeInt32:
+		if b := db.at(v.value(), 4); b != nil {
+			return uint64(binary.LittleEndian.Uint32(b))
+		}
+	case TypeInt64:
+		if b := db.at(v.value(), 8); b != nil {
+			return binary.LittleEndian.Uint64(b)
+		}
+	}
+	return 0
+}
+
+// Blob returns the bytes of a blob, or nil if v is not one.
+func (db *DB) Blob(v Val) []byte {
+	off := v.value()
+	var lenSize uint64
+	switch v.Type() {
+	case TypeBlob8:
+		lenSize = 1
+	case TypeBlob16:
+		lenSize = 2
+	case TypeBlob32:
+		lenSize = 4
+	default:
+		return nil
+	}
+	b := db.at(off, lenSize)
+	if b == nil {
+		return nil
+	}
+	var n uint64
+	switch lenSize {
+	case 1:
+		n = uint64(b[0])
+	case 2:
+		n = uint64(binary.LittleEndian.Uint16(b))
+	case 4:
+		n = uint64(binary.LittleEndian.Uint32(b))
+	}
+	return db.at(off+uint32(lenSize), n)
+}
+
+// String returns a blob as a string.
+func (db *DB) String(v Val) string {
+	return string(db.Blob(v))
+}
+
+// Object returns the fields of an object or the elements of an array. Field and element
+// numbers start at 1; slot 0 holds the number of slots. It returns an empty Object if v
+// is neither.
+func (db *DB) Object(v Val) Object {
+	if t := v.Type(); t != TypeObject && t != TypeArray {
+		return Object{db: db}
+	}
+	off := v.value()
+	b := db.at(off, 4)
+	if b == nil {
+		return Object{db: db}
+	}
+	n := uint64(binary.LittleEndian.Uint32(b))
+	vals := db.at(off, n*4)
+	if vals == nil {
+		return Object{db: db}
+	}
+	return Object{db: db, vals: vals}
+}
+
+// Object is an object or an array of an ADB block.
+type Object struct {
+	db   *DB
+	vals []byte
+}
+
+// Len returns the number of slots, including slot 0.
+func (o Object) Len() int {
+	return len(o.vals) / 4
+}
+
+// Get returns the value in slot i, or Null if there is none.
+func (o Object) Get(i int) Val {
+	if i < 1 || i >= o.Len() {
+		return Null
+	}
+	return Val(binary.LittleEndian.Uint32(o.vals[i*4:]))
+}
+
+// Int returns the integer in slot i.
+func (o Object) Int(i int) uint64 { return o.db.Int(o.Get(i)) }
+
+// Blob returns the blob in slot i.
+func (o Object) Blob(i int) []byte { return o.db.Blob(o.Get(i)) }
+
+// String returns the blob in slot i as a string.
+func (o Object) String(i int) string { return o.db.String(o.Get(i)) }
+
+// Object returns the object or array in slot i.
+func (o Object) Object(i int) Object { return o.db.Object(o.Get(i)) }
+
+// Elements returns the values of the elements of an array.
+func (o Object) Elements() []Val {
+	vals := make([]Val, 0, o.Len())
+	for i := 1; i < o.Len(); i++ {
+		vals = append(vals, o.Get(i))
+	}
+	return vals
+}
@@ -0,0 +1,231 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package adb
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Fields of the root object of an index.
+const (
+	indexDescription = 1
+	indexPackages    = 2
+)
+
+// Fields of a package info object.
+const (
+	pkgInfoName             = 1
+	pkgInfoVersion          = 2
+	pkgInfoUniqueID         = 3
+	pkgInfoDescription      = 4
+	pkgInfoArch             = 5
+	pkgInfoLicense          = 6
+	pkgInfoOrigin           = 7
+	pkgInfoMaintainer       = 8
+	pkgInfoURL              = 9
+	pkgInfoRepoCommit       = 10
+	pkgInfoBuildTime        = 11
+	pkgInfoInstalledSize    = 12
+	pkgInfoFileSize         = 13
+	pkgInfoProviderPriority = 14
+	pkgInfoDepends          = 15
+	pkgInfoProvides         = 16
+	pkgInfoReplaces         = 17
+	pkgInfoInstallIf        = 18
+	pkgInfoRecommends       = 19
+	pkgInfoLayer            = 20
+	pkgInfoTags             = 21
+)
+
+// Fields of a dependency object.
+const (
+	depName    = 1
+	depVersion = 2
+	depMatch   = 3
+)
+
+// Bits of the match field of a dependency, as defined by apk-tools.
+const (
+	MatchLess     = 1
+	MatchEqual    = 2
+	MatchGreater  = 4
+	MatchFuzzy    = 8
+	MatchConflict = 16
+)
+
+// Index is an apk-tools v3 APKINDEX.
+type Index struct {
+	Description string
+	Packages    []*PackageInfo
+	// Signatures are the payloads of the SIG blocks of the index.
+	Signatures [][]byte
+	// Header and ADB are the file header and the payload of the ADB block, which the
+	// signatures cover.
+	Header, ADB []byte
+}
+
+// PackageInfo is the metadata of a package, in an index or in the package itself.
+type PackageInfo struct {
+	Name             string
+	Version          string
+	UniqueID         []byte
+	Description      string
+	Arch             string
+	License          string
+	Origin           string
+	Maintainer       string
+	URL              string
+	RepoCommit       string
+	BuildTime        uint64
+	InstalledSize    uint64
+	FileSize         uint64
+	ProviderPriority uint64
+	Depends          []Dependency
+	Provides         []Dependency
+	Replaces         []Dependency
+	InstallIf        []Dependency
+	Recommends       []Dependency
+	Layer            uint64
+	Tags             []string
+}
+
+// Dependency is a dependency, provide, replace or install_if of a package.
+type Dependency struct {
+	Name    string
+	Version string
+	// Match is a combination of the Match bits. It is MatchEqual if a version is set
+	// and the file did not say otherwise.
+	Match uint64
+}
+
+// String returns the dependency in the text form of apk-tools, e.g. "!foo>=1.2".
+func (d Dependency) String() string {
+	var sb strings.Builder
+	if d.Match&MatchConflict != 0 {
+		sb.WriteByte('!')
+	}
+	sb.WriteString(d.Name)
+	if d.Version == "" {
+		return sb.String()
+	}
+	switch d.Match &^ MatchConflict {
+	case MatchLess:
+		sb.WriteString("<")
+	case MatchLess | MatchEqual:
+		sb.WriteString("<=")
+	case MatchGreater:
+		sb.WriteString(">")
+	case MatchGreater | MatchEqual:
+		sb.WriteString(">=")
+	case MatchFuzzy, MatchFuzzy | MatchEqual:
+		sb.WriteString("~")
+	case MatchLess | MatchGreater:
+		sb.WriteString("><")
+	default:
+		sb.WriteString("=")
+	}
+	sb.WriteString(d.Version)
+	return sb.String()
+}
+
+// ReadIndex reads an apk-tools v3 index. It does not verify its signatures; see
+// Index.Signatures.
+func ReadIndex(r io.Reader) (*Index, error) {
+	ar, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	db, sigs, typ, _, err := readADB(ar, SchemaIndex)
+	if err != nil {
+		return nil, err
+	}
+	if typ != 0 {
+		return nil, fmt.Errorf("unexpected block type %d in ADB index", typ)
+	}
+
+	root := db.Object(db.Root())
+	idx := &Index{
+		Description: root.String(indexDescription),
+		Signatures:  sigs,
+		Header:      ar.Header(),
+		ADB:         db.Bytes(),
+	}
+	for _, v := range root.Object(indexPackages).Elements() {
+		idx.Packages = append(idx.Packages, readPackageInfo(db.Object(v)))
+	}
+	return idx, nil
+}
+
+func readPackageInfo(o Object) *PackageInfo {
+	return &PackageInfo{
+		Name:             o.String(pkgInfoName),
+		Version:          o.String(pkgInfoVersion),
+		UniqueID:         o.Blob(pkgInfoUniqueID),
+		Description:      o.String(pkgInfoDescription),
+		Arch:             o.String(pkgInfoArch),
+		License:          o.String(pkgInfoLicense),
+		Origin:           o.String(pkgInfoOrigin),
+		Maintainer:       o.String(pkgInfoMaintainer),
+		URL:              o.String(pkgInfoURL),
+		RepoCommit:       hexOrString(o.Blob(pkgInfoRepoCommit)),
+		BuildTime:        o.Int(pkgInfoBuildTime),
+		InstalledSize:    o.Int(pkgInfoInstalledSize),
+		FileSize:         o.Int(pkgInfoFileSize),
+		ProviderPriority: o.Int(pkgInfoProviderPriority),
+		Depends:          readDependencies(o.Object(pkgInfoDepends)),
+		Provides:         readDependencies(o.Object(pkgInfoProvides)),
+		Replaces:         readDependencies(o.Object(pkgInfoReplaces)),
+		InstallIf:        readDependencies(o.Object(pkgInfoInstallIf)),
+		Recommends:       readDependencies(o.Object(pkgInfoRecommends)),
+		Layer:            o.Int(pkgInfoLayer),
+		Tags:             readStrings(o.Object(pkgInfoTags)),
+	}
+}
+
+func readDependencies(arr Object) []Dependency {
+	var deps []Dependency
+	for _, v := range arr.Elements() {
+		o := arr.db.Object(v)
+		d := Dependency{
+			Name:    o.String(depName),
+			Version: o.String(depVersion),
+			Match:   o.Int(depMatch),
+		}
+		if d.Version != "" && d.Match&^MatchConflict == 0 {
+			d.Match |= MatchEqual
+		}
+		deps = append(deps, d)
+	}
+	return deps
+}
+
+func readStrings(arr Object) []string {
+	var ss []string
+	for _, v := range arr.Elements() {
+		ss = append(ss, arr.db.String(v))
+	}
+	return ss
+}
+
+// hexOrString returns the repo commit, which apk-tools stores as the 20 raw bytes of the
+// git hash, as hex. Anything else is returned as is.
+func hexOrString(b []byte) string {
+	if len(b) == 20 {
+		return fmt.Sprintf("%x", b)
+	}
+	return string(b)
+}
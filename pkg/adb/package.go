@@ -0,0 +1,330 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package adb
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"time"
+)
+
+// Fields of the root object of a package.
+const (
+	pkgPkgInfo          = 1
+	pkgPaths            = 2
+	pkgScripts          = 3
+	pkgTriggers         = 4
+	pkgReplacesPriority = 5
+)
+
+// Fields of a directory object.
+const (
+	dirName  = 1
+	dirACL   = 2
+	dirFiles = 3
+)
+
+// Fields of a file object.
+const (
+	fileName   = 1
+	fileACL    = 2
+	fileSize   = 3
+	fileMTime  = 4
+	fileHashes = 5
+	fileTarget = 6
+)
+
+// Fields of an ACL object.
+const (
+	aclMode  = 1
+	aclUser  = 2
+	aclGroup = 3
+)
+
+// Fields of a scripts object.
+const (
+	scriptTrigger = iota + 1
+	scriptPreInstall
+	scriptPostInstall
+	scriptPreDeinstall
+	scriptPostDeinstall
+	scriptPreUpgrade
+	scriptPostUpgrade
+)
+
+// Package is the metadata of an apk-tools v3 package.
+type Package struct {
+	Info             *PackageInfo
+	Dirs             []Dir
+	Scripts          Scripts
+	Triggers         []string
+	ReplacesPriority uint64
+	// Signatures are the payloads of the SIG blocks of the package.
+	Signatures [][]byte
+	// Header and ADB are the file header and the payload of the ADB block, which the
+	// signatures cover.
+	Header, ADB []byte
+}
+
+// Dir is a directory of a package and the files in it.
+type Dir struct {
+	Name  string
+	ACL   ACL
+	Files []File
+}
+
+// File is a file of a package.
+type File struct {
+	Name   string
+	ACL    ACL
+	Size   uint64
+	MTime  uint64
+	Hashes []byte
+	// Target is set for special files: the file mode as 2 little endian bytes, followed
+	// by the link target for symlinks and hardlinks, or the device number for devices.
+	Target []byte
+}
+
+// ACL is the ownership and mode of a file or directory.
+type ACL struct {
+	Mode  uint64
+	User  string
+	Group string
+}
+
+// Scripts are the scripts of a package.
+type Scripts struct {
+	Trigger       []byte
+	PreInstall    []byte
+	PostInstall   []byte
+	PreDeinstall  []byte
+	PostDeinstall []byte
+	PreUpgrade    []byte
+	PostUpgrade   []byte
+}
+
+// PackageReader reads an apk-tools v3 package: its metadata, then its files in the manner
+// of a tar.Reader.
+type PackageReader struct {
+	pkg *Package
+	r   *Reader
+
+	// next is the type and body of the next unread block.
+	next     BlockType
+	nextBody io.Reader
+
+	// dir and file are the indexes of the current entry; file is -1 for the directory.
+	dir, file int
+	body      io.Reader
+}
+
+// NewPackageReader reads the metadata of the apk-tools v3 package in r. It does not verify
+// its signatures; see Package.Signatures.
+func NewPackageReader(r io.Reader) (*PackageReader, error) {
+	ar, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	db, sigs, next, nextBody, err := readADB(ar, SchemaPackage)
+	if err != nil {
+		return nil, err
+	}
+
+	root := db.Object(db.Root())
+	pkg := &Package{
+		Info:             readPackageInfo(root.Object(pkgPkgInfo)),
+		Triggers:         readStrings(root.Object(pkgTriggers)),
+		ReplacesPriority: root.Int(pkgReplacesPriority),
+		Signatures:       sigs,
+		Header:           ar.Header(),
+		ADB:              db.Bytes(),
+	}
+	scripts := root.Object(pkgScripts)
+	pkg.Scripts = Scripts{
+		Trigger:       scripts.Blob(scriptTrigger),
+		PreInstall:    scripts.Blob(scriptPreInstall),
+		PostInstall:   scripts.Blob(scriptPostInstall),
+		PreDeinstall:  scripts.Blob(scriptPreDeinstall),
+		PostDeinstall: scripts.Blob(scriptPostDeinstall),
+		PreUpgrade:    scripts.Blob(scriptPreUpgrade),
+		PostUpgrade:   scripts.Blob(scriptPostUpgrade),
+	}
+	for _, dv := range root.Object(pkgPaths).Elements() {
+		do := db.Object(dv)
+		dir := Dir{Name: do.String(dirName), ACL: readACL(do.Object(dirACL))}
+		for _, fv := range do.Object(dirFiles).Elements() {
+			fo := db.Object(fv)
+			dir.Files = append(dir.Files, File{
+				Name:   fo.String(fileName),
+				ACL:    readACL(fo.Object(fileACL)),
+				Size:   fo.Int(fileSize),
+				MTime:  fo.Int(fileMTime),
+				Hashes: fo.Blob(fileHashes),
+				Target: fo.Blob(fileTarget),
+			})
+		}
+		pkg.Dirs = append(pkg.Dirs, dir)
+	}
+
+	return &PackageReader{pkg: pkg, r: ar, next: next, nextBody: nextBody, file: -2}, nil
+}
+
+func readACL(o Object) ACL {
+	return ACL{Mode: o.Int(aclMode), User: o.String(aclUser), Group: o.String(aclGroup)}
+}
+
+// Package returns the metadata of the package.
+func (pr *PackageReader) Package() *Package {
+	return pr.pkg
+}
+
+// Next advances to the next directory or file of the package, in the order of the
+// metadata, and returns its header. The root directory, which has an empty name, is
+// skipped. The contents of regular files can then be read from the PackageReader. It
+// returns io.EOF after the last file.
+func (pr *PackageReader) Next() (*tar.Header, error) {
+	pr.body = nil
+	for {
+		if pr.dir >= len(pr.pkg.Dirs) {
+			return nil, io.EOF
+		}
+		dir := pr.pkg.Dirs[pr.dir]
+		pr.file++
+		if pr.file >= len(dir.Files) {
+			pr.dir, pr.file = pr.dir+1, -2
+			continue
+		}
+		if pr.file == -1 {
+			if dir.Name == "" {
+				continue
+			}
+			return &tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     dir.Name + "/",
+				Mode:     int64(dir.ACL.Mode) & 0o7777,
+				Uname:    dir.ACL.User,
+				Gname:    dir.ACL.Group,
+			}, nil
+		}
+		return pr.fileHeader(dir, dir.Files[pr.file])
+	}
+}
+
+// S_IF* bits of the mode in the target of special files.
+const (
+	modeTypeMask = 0o170000
+	modeFIFO     = 0o010000
+	modeChar     = 0o020000
+	modeBlock    = 0o060000
+	modeRegular  = 0o100000
+	modeSymlink  = 0o120000
+)
+
+func (pr *PackageReader) fileHeader(dir Dir, f File) (*tar.Header, error) {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Join(dir.Name, f.Name),
+		Mode:     int64(f.ACL.Mode) & 0o7777,
+		Uname:    f.ACL.User,
+		Gname:    f.ACL.Group,
+		Size:     int64(f.Size),
+		ModTime:  time.Unix(int64(f.MTime), 0).UTC(),
+	}
+
+	if len(f.Target) != 0 {
+		if len(f.Target) < 2 {
+			return nil, fmt.Errorf("invalid target for %s", hdr.Name)
+		}
+		mode, rest := binary.LittleEndian.Uint16(f.Target), f.Target[2:]
+		hdr.Size = 0
+		switch mode & modeTypeMask {
+		case modeSymlink:
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, string(rest)
+		case modeRegular:
+			// A hardlink to another file of the package.
+			hdr.Typeflag, hdr.Linkname = tar.TypeLink, string(rest)
+		case modeFIFO:
+			hdr.Typeflag = tar.TypeFifo
+		case modeChar, modeBlock:
+			if len(rest) != 8 {
+				return nil, fmt.Errorf("invalid device for %s", hdr.Name)
+			}
+			hdr.Typeflag = tar.TypeChar
+			if mode&modeTypeMask == modeBlock {
+				hdr.Typeflag = tar.TypeBlock
+			}
+			dev := binary.LittleEndian.Uint64(rest)
+			hdr.Devmajor, hdr.Devminor = int64(dev>>8&0xfff), int64(dev&0xff|dev>>12&0xfff00)
+		default:
+			return nil, fmt.Errorf("unsupported file type %#o for %s", mode&modeTypeMask, hdr.Name)
+		}
+		return hdr, nil
+	}
+
+	if f.Size == 0 {
+		return hdr, nil
+	}
+	body, err := pr.dataBlock(pr.dir+1, pr.file+1)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", hdr.Name, err)
+	}
+	pr.body = io.LimitReader(body, int64(f.Size))
+	return hdr, nil
+}
+
+// dataBlock returns the body of the next DATA block, which must be for the given path and
+// file, which count from 1 like the slots of the arrays they index.
+func (pr *PackageReader) dataBlock(pathIdx, fileIdx int) (io.Reader, error) {
+	for {
+		typ, body := pr.next, pr.nextBody
+		if body == nil {
+			var err error
+			typ, body, err = pr.r.Next()
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+		}
+		pr.nextBody = nil
+		if typ != BlockData {
+			// Blocks of types we don't know about can be skipped.
+			continue
+		}
+
+		var hdr struct{ PathIdx, FileIdx uint32 }
+		if err := binary.Read(body, binary.LittleEndian, &hdr); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if int(hdr.PathIdx) != pathIdx || int(hdr.FileIdx) != fileIdx {
+			return nil, fmt.Errorf("data block for path %d file %d, expected path %d file %d", hdr.PathIdx, hdr.FileIdx, pathIdx, fileIdx)
+		}
+		return body, nil
+	}
+}
+
+// Read reads from the current file, like tar.Reader.Read.
+func (pr *PackageReader) Read(b []byte) (int, error) {
+	if pr.body == nil {
+		return 0, io.EOF
+	}
+	n, err := pr.body.Read(b)
+	if errors.Is(err, io.EOF) && n == 0 {
+		pr.body = nil
+	}
+	return n, err
+}
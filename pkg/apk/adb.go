@@ -0,0 +1,86 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/chainguard-dev/go-apk/pkg/adb"
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+// verifyADBSignatures succeeds if any of the signatures of an apk-tools v3 file verifies
+// with keys, and returns the name of the key that verified it and its algorithm.
+func verifyADBSignatures(header, db []byte, sigs [][]byte, keys map[string][]byte) (string, sign.Algorithm, error) {
+	if len(sigs) == 0 {
+		return "", "", errors.New("no signatures found")
+	}
+	if keys == nil {
+		return "", "", fmt.Errorf("no keys provided to verify signature")
+	}
+	var errs []error
+	for _, sig := range sigs {
+		keyName, alg, err := sign.ADBVerifyingKey(header, db, sig, keys)
+		if err == nil {
+			return keyName, alg, nil
+		}
+		errs = append(errs, err)
+	}
+	return "", "", errors.Join(errs...)
+}
+
+// indexFromADB converts an apk-tools v3 index to an APKIndex.
+func indexFromADB(idx *adb.Index) *APKIndex {
+	out := &APKIndex{Description: idx.Description}
+	for _, info := range idx.Packages {
+		out.Packages = append(out.Packages, packageFromADB(info))
+	}
+	return out
+}
+
+// packageFromADB converts the metadata of an apk-tools v3 package to a Package.
+func packageFromADB(info *adb.PackageInfo) *Package {
+	return &Package{
+		Name:             info.Name,
+		Version:          info.Version,
+		Arch:             info.Arch,
+		Description:      info.Description,
+		License:          info.License,
+		Origin:           info.Origin,
+		Maintainer:       info.Maintainer,
+		URL:              info.URL,
+		Checksum:         info.UniqueID,
+		Dependencies:     adbDependencies(info.Depends),
+		Provides:         adbDependencies(info.Provides),
+		InstallIf:        adbDependencies(info.InstallIf),
+		Replaces:         adbDependencies(info.Replaces),
+		Size:             info.FileSize,
+		InstalledSize:    info.InstalledSize,
+		ProviderPriority: info.ProviderPriority,
+		BuildTime:        time.Unix(int64(info.BuildTime), 0).UTC(),
+		BuildDate:        int64(info.BuildTime),
+		RepoCommit:       info.RepoCommit,
+	}
+}
+
+func adbDependencies(deps []adb.Dependency) []string {
+	var out []string
+	for _, d := range deps {
+		out = append(out, d.String())
+	}
+	return out
+}
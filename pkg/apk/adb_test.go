@@ -0,0 +1,136 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chainguard-dev/go-apk/pkg/adb"
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+// testADBIndex returns the payload of the ADB block of an apk-tools v3 index with a single
+// package, hello-1.0-r0, which depends on busybox>=1.36.
+func testADBIndex() []byte {
+	buf := make([]byte, 8)
+	blob := func(s string) uint32 {
+		off := len(buf)
+		buf = append(buf, byte(len(s)))
+		buf = append(buf, s...)
+		return uint32(adb.TypeBlob8) | uint32(off)
+	}
+	object := func(typ adb.Val, vals ...uint32) uint32 {
+		for len(buf)%4 != 0 {
+			buf = append(buf, 0)
+		}
+		off := len(buf)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(vals)+1))
+		for _, v := range vals {
+			buf = binary.LittleEndian.AppendUint32(buf, v)
+		}
+		return uint32(typ) | uint32(off)
+	}
+
+	busybox := object(adb.TypeObject, blob("busybox"), blob("1.36"), uint32(adb.TypeInt)|adb.MatchGreater|adb.MatchEqual)
+	hello := object(adb.TypeObject, blob("hello"), blob("1.0-r0"), blob("0123456789abcdef0123"), blob("says hello"), blob("noarch"),
+		0, 0, 0, 0, 0, 0, 0, 0, 0, object(adb.TypeArray, busybox))
+	root := object(adb.TypeObject, blob("v3 index"), object(adb.TypeArray, hello))
+	binary.LittleEndian.PutUint32(buf[4:], root)
+	return buf
+}
+
+func testADBBlock(typ adb.BlockType, payload []byte) []byte {
+	out := binary.LittleEndian.AppendUint32(nil, uint32(typ)<<30|uint32(4+len(payload)))
+	out = append(out, payload...)
+	for len(out)%8 != 0 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+func TestADBIndex(t *testing.T) {
+	ctx := context.Background()
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	require.NoError(t, err)
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	id, err := sign.ADBKeyID(pubPEM)
+	require.NoError(t, err)
+
+	header := []byte(adb.Magic + adb.SchemaIndex)
+	db := testADBIndex()
+	sigHdr := append([]byte{0, 4}, id...)
+	digest := sha512.Sum512(db)
+	msg := append(append(append([]byte{}, header...), sigHdr...), digest[:]...)
+	sig := append(sigHdr, ed25519.Sign(key, msg)...)
+
+	write := func(t *testing.T, db []byte) string {
+		repo := t.TempDir()
+		file := append(append(header, testADBBlock(adb.BlockADB, db)...), testADBBlock(adb.BlockSig, sig)...)
+		require.NoError(t, os.MkdirAll(filepath.Join(repo, "x86_64"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(repo, "x86_64", indexFilename), file, 0o644))
+		return repo
+	}
+	keys := map[string][]byte{"test.rsa.pub": pubPEM}
+
+	t.Run("signed", func(t *testing.T) {
+		globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+		repo := write(t, db)
+
+		indexes, err := GetRepositoryIndexes(ctx, []string{repo}, keys, "x86_64")
+		require.NoError(t, err)
+		require.Len(t, indexes, 1)
+		pkgs := indexes[0].Packages()
+		require.Len(t, pkgs, 1)
+		require.Equal(t, "hello", pkgs[0].Name)
+		require.Equal(t, "1.0-r0", pkgs[0].Version)
+		require.Equal(t, []string{"busybox>=1.36"}, pkgs[0].Dependencies)
+		require.Equal(t, repo+"/x86_64/hello-1.0-r0.apk", pkgs[0].URL())
+
+		f, err := os.Open(filepath.Join(repo, "x86_64", indexFilename))
+		require.NoError(t, err)
+		idx, err := IndexFromArchive(f)
+		require.NoError(t, err)
+		require.Equal(t, "v3 index", idx.Description)
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+		tampered := append([]byte{}, db...)
+		tampered[len(tampered)-1] ^= 0xff
+		repo := write(t, tampered)
+
+		_, err := GetRepositoryIndexes(ctx, []string{repo}, keys, "x86_64")
+		require.ErrorContains(t, err, "verifying repository index")
+
+		globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+		_, err = GetRepositoryIndexes(ctx, []string{repo}, keys, "x86_64", WithIgnoreSignatures(true))
+		require.NoError(t, err)
+	})
+}
@@ -15,6 +15,8 @@ import (
 	"time"
 
 	"github.com/MakeNowJust/heredoc/v2"
+
+	"github.com/chainguard-dev/go-apk/pkg/adb"
 )
 
 const apkIndexFilename = "APKINDEX"
@@ -62,7 +64,7 @@ var apkIndexTemplate = template.Must(template.New(apkIndexFilename).Funcs(
 		D:{{join .Dependencies}}
 		{{- end}}
 		{{- if .InstallIf}}
-		i:{{.InstallIf}}
+		i:{{join .InstallIf}}
 		{{- end}}
 		{{- if .Provides}}
 		p:{{join .Provides}}
@@ -70,13 +72,28 @@ var apkIndexTemplate = template.Must(template.New(apkIndexFilename).Funcs(
 		{{- if .ProviderPriority}}
 		k:{{.ProviderPriority}}
 		{{- end}}
+		{{- if .Replaces}}
+		r:{{join .Replaces}}
+		{{- end}}
+		{{- if .ReplacesPriority}}
+		q:{{.ReplacesPriority}}
+		{{- end}}
 
 	`)))
 
 type APKIndex struct { //nolint:revive
 	Signature   []byte
 	Description string
-	Packages    []*Package
+	// Timestamp is when the index was built: the modification time of its DESCRIPTION, or
+	// zero if it is not known.
+	Timestamp time.Time
+	// Verification is how the signature of the index was verified when it was fetched, or
+	// zero if the index was not fetched from a repository.
+	Verification SignatureVerification
+	// Digest is the sha256 of the index as it was fetched, or nil if the index was not
+	// fetched from a repository as a single archive.
+	Digest   []byte
+	Packages []*Package
 }
 
 // ParsePackageIndex parses a plain (uncompressed) APKINDEX file. It returns an
@@ -130,6 +147,8 @@ func ParsePackageIndex(apkIndexUnpacked io.Reader) ([]*Package, error) {
 			pkg.Dependencies = strings.Split(val, " ")
 		case "p":
 			pkg.Provides = strings.Split(val, " ")
+		case "r":
+			pkg.Replaces = strings.Split(val, " ")
 		case "c":
 			pkg.RepoCommit = val
 		case "t":
@@ -159,6 +178,12 @@ func ParsePackageIndex(apkIndexUnpacked io.Reader) ([]*Package, error) {
 				return nil, fmt.Errorf("cannot parse provider priority field %s: %w", val, err)
 			}
 			pkg.ProviderPriority = priority
+		case "q":
+			priority, err := strconv.ParseUint(val, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse replaces priority field %s: %w", val, err)
+			}
+			pkg.ReplacesPriority = priority
 		case "C":
 			// Handle SHA1 checksums:
 			if strings.HasPrefix(val, "Q1") {
@@ -176,8 +201,19 @@ func ParsePackageIndex(apkIndexUnpacked io.Reader) ([]*Package, error) {
 	return packages, nil
 }
 
+// IndexFromArchive parses an APKINDEX.tar.gz, or an apk-tools v3 APKINDEX in the ADB
+// format, which is detected by its magic. Signatures are not verified.
 func IndexFromArchive(archive io.ReadCloser) (*APKIndex, error) {
-	gzipReader, err := gzip.NewReader(archive)
+	br := bufio.NewReader(archive)
+	if magic, _ := br.Peek(4); adb.IsADB(magic) {
+		idx, err := adb.ReadIndex(br)
+		if err != nil {
+			return nil, err
+		}
+		return indexFromADB(idx), nil
+	}
+
+	gzipReader, err := gzip.NewReader(br)
 	if err != nil {
 		return nil, err
 	}
@@ -202,12 +238,16 @@ func IndexFromArchive(archive io.ReadCloser) (*APKIndex, error) {
 			if err != nil {
 				return nil, err
 			}
+			if apkindex.Timestamp.IsZero() {
+				apkindex.Timestamp = hdr.ModTime
+			}
 		case descriptionFilename:
 			description, err := io.ReadAll(tarReader)
 			if err != nil {
 				return nil, err
 			}
 			apkindex.Description = string(description)
+			apkindex.Timestamp = hdr.ModTime
 		default:
 			if strings.HasPrefix(hdr.Name, ".SIGN.") {
 				var err error
@@ -252,7 +292,7 @@ func ArchiveFromIndex(apkindex *APKIndex) (archive io.Reader, err error) {
 		{apkIndexFilename, apkindexContents.Bytes()},
 		{descriptionFilename, []byte(apkindex.Description)},
 	} {
-		var info os.FileInfo = &tarballItemFileInfo{item.filename, int64(len(item.contents))}
+		var info os.FileInfo = &tarballItemFileInfo{item.filename, int64(len(item.contents)), apkindex.Timestamp}
 		header, err := tar.FileInfoHeader(info, item.filename)
 		if err != nil {
 			return nil, fmt.Errorf("creating tar header for %s: %w", item.filename, err)
@@ -273,14 +313,15 @@ func ArchiveFromIndex(apkindex *APKIndex) (archive io.Reader, err error) {
 // This type implements os.FileInfo, allowing us to construct
 // a tar header without needing to run os.Stat on a file
 type tarballItemFileInfo struct {
-	name string
-	size int64
+	name    string
+	size    int64
+	modTime time.Time
 }
 
 func (info *tarballItemFileInfo) Name() string       { return info.name }
 func (info *tarballItemFileInfo) Size() int64        { return info.size }
 func (info *tarballItemFileInfo) Mode() os.FileMode  { return 0644 }
-func (info *tarballItemFileInfo) ModTime() time.Time { return time.Time{} }
+func (info *tarballItemFileInfo) ModTime() time.Time { return info.modTime }
 func (info *tarballItemFileInfo) IsDir() bool        { return false }
 func (info *tarballItemFileInfo) Sys() interface{}   { return nil }
 
@@ -8,6 +8,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/MakeNowJust/heredoc/v2"
 	"github.com/stretchr/testify/assert"
@@ -210,3 +211,35 @@ func TestArchiveFromIndex(t *testing.T) {
 	require.Truef(t, foundApkIndex, "Could not locate file %s in archive", apkIndexFilename)
 	require.Truef(t, foundDescription, "Could not locate file %s in archive", descriptionFilename)
 }
+
+func TestIndexMetadataRoundTrip(t *testing.T) {
+	pkg := &Package{
+		Name:             "hello",
+		Version:          "1.0-r0",
+		Arch:             "x86_64",
+		Description:      "says hello",
+		License:          "Apache-2.0",
+		Origin:           "hello-src",
+		Maintainer:       "Jane Doe <jane@example.com>",
+		URL:              "https://example.com/hello",
+		Checksum:         []byte{0xde, 0xad, 0xbe, 0xef},
+		Dependencies:     []string{"so:libc.so.6", "busybox"},
+		Provides:         []string{"cmd:hello=1.0-r0"},
+		InstallIf:        []string{"hello-base", "docs"},
+		Size:             1234,
+		InstalledSize:    5678,
+		ProviderPriority: 10,
+		BuildTime:        time.Unix(1700000000, 0).UTC(),
+		BuildDate:        1700000000,
+		RepoCommit:       "abc123",
+		Replaces:         []string{"hello-old"},
+		ReplacesPriority: 5,
+	}
+	built := time.Unix(1700001000, 0)
+	archive, err := ArchiveFromIndex(&APKIndex{Description: "test", Timestamp: built, Packages: []*Package{pkg}})
+	require.NoError(t, err)
+	index, err := IndexFromArchive(io.NopCloser(archive))
+	require.NoError(t, err)
+	require.Equal(t, []*Package{pkg}, index.Packages)
+	require.True(t, built.Equal(index.Timestamp), index.Timestamp)
+}
@@ -13,19 +13,87 @@
 // limitations under the License.
 package apk
 
+import "strings"
+
+// ArchToAPK returns the apk architecture for in, which may already be an apk architecture,
+// a GOARCH, or an OCI platform such as "linux/arm/v7" or "arm64/v8". Unknown architectures
+// are returned unchanged.
 func ArchToAPK(in string) string {
-	switch in {
-	case "i386", "386":
+	in = strings.TrimPrefix(in, "linux/")
+	arch, variant, _ := strings.Cut(in, "/")
+	switch arch {
+	case "i386", "386", "i686":
 		return "x86"
 	case "amd64":
 		return "x86_64"
 	case "arm64":
 		return "aarch64"
-	case "arm/v6":
-		return "armhf"
-	case "arm/v7":
+	case "arm":
+		if variant == "v6" {
+			return "armhf"
+		}
+		// OCI defaults to v7 when arm has no variant.
 		return "armv7"
 	default:
 		return in
 	}
 }
+
+// ArchToOCI returns the OCI platform architecture, and variant if any, for the apk
+// architecture in, e.g. "arm64" for "aarch64" and "arm/v7" for "armv7". It is the inverse
+// of ArchToAPK. Unknown architectures are returned unchanged.
+func ArchToOCI(in string) string {
+	switch arch := ArchToAPK(in); arch {
+	case "x86":
+		return "386"
+	case "x86_64":
+		return "amd64"
+	case "aarch64":
+		return "arm64"
+	case "armhf":
+		return "arm/v6"
+	case "armv7":
+		return "arm/v7"
+	default:
+		return arch
+	}
+}
+
+// NoArch and AllArch mark packages that are not specific to an architecture, such as
+// data-only or script packages. Such packages are published in the directory of every
+// architecture of a repository, and are valid for any target architecture.
+const (
+	NoArch  = "noarch"
+	AllArch = "all"
+)
+
+// IsNoArch returns true if arch marks a package that is valid for any architecture.
+func IsNoArch(arch string) bool {
+	return arch == NoArch || arch == AllArch
+}
+
+// ValidForArch returns true if the package can be installed on arch: it is built for
+// arch, it is a noarch package, or it does not declare an architecture.
+func (p *Package) ValidForArch(arch string) bool {
+	return p.Arch == "" || IsNoArch(p.Arch) || ArchToAPK(p.Arch) == ArchToAPK(arch)
+}
+
+// filterIndexForArch returns idx without the packages that are not valid for arch. It
+// returns idx itself if there are none.
+func filterIndexForArch(idx *APKIndex, arch string) *APKIndex {
+	for i, pkg := range idx.Packages {
+		if pkg.ValidForArch(arch) {
+			continue
+		}
+		filtered := *idx
+		filtered.Packages = make([]*Package, i, len(idx.Packages))
+		copy(filtered.Packages, idx.Packages[:i])
+		for _, pkg := range idx.Packages[i+1:] {
+			if pkg.ValidForArch(arch) {
+				filtered.Packages = append(filtered.Packages, pkg)
+			}
+		}
+		return &filtered
+	}
+	return idx
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchToAPK(t *testing.T) {
+	for in, want := range map[string]string{
+		"x86_64":       "x86_64",
+		"amd64":        "x86_64",
+		"linux/amd64":  "x86_64",
+		"386":          "x86",
+		"i386":         "x86",
+		"arm64":        "aarch64",
+		"arm64/v8":     "aarch64",
+		"linux/arm64":  "aarch64",
+		"aarch64":      "aarch64",
+		"arm":          "armv7",
+		"arm/v7":       "armv7",
+		"linux/arm/v7": "armv7",
+		"arm/v6":       "armhf",
+		"armv7":        "armv7",
+		"armhf":        "armhf",
+		// soft float, not the hard float ABI of armhf
+		"armel":         "armel",
+		"ppc64le":       "ppc64le",
+		"s390x":         "s390x",
+		"linux/riscv64": "riscv64",
+	} {
+		require.Equal(t, want, ArchToAPK(in), in)
+	}
+}
+
+func TestArchToOCI(t *testing.T) {
+	for in, want := range map[string]string{
+		"x86_64":  "amd64",
+		"amd64":   "amd64",
+		"x86":     "386",
+		"aarch64": "arm64",
+		"armv7":   "arm/v7",
+		"armhf":   "arm/v6",
+		"ppc64le": "ppc64le",
+		"s390x":   "s390x",
+	} {
+		require.Equal(t, want, ArchToOCI(in), in)
+	}
+
+	for _, arch := range []string{"x86", "x86_64", "aarch64", "armv7", "armhf", "ppc64le"} {
+		require.Equal(t, arch, ArchToAPK(ArchToOCI(arch)), arch)
+	}
+}
+
+func TestIndexURLNormalizesArch(t *testing.T) {
+	require.Equal(t, "https://example.com/main/aarch64/APKINDEX.tar.gz", IndexURL("https://example.com/main", "linux/arm64"))
+}
+
+func TestNoArch(t *testing.T) {
+	for _, tt := range []struct {
+		pkgArch string
+		arch    string
+		want    bool
+	}{
+		{"x86_64", "x86_64", true},
+		{"x86_64", "amd64", true},
+		{"aarch64", "x86_64", false},
+		{"noarch", "x86_64", true},
+		{"all", "aarch64", true},
+		{"", "aarch64", true},
+	} {
+		pkg := &Package{Arch: tt.pkgArch}
+		require.Equal(t, tt.want, pkg.ValidForArch(tt.arch), "%s on %s", tt.pkgArch, tt.arch)
+	}
+
+	ctx := context.Background()
+	repo := t.TempDir()
+	index := &APKIndex{Packages: []*Package{
+		{Name: "tool", Version: "1.0-r0", Arch: "x86_64", Dependencies: []string{"data"}},
+		{Name: "tool", Version: "2.0-r0", Arch: "aarch64"},
+		{Name: "data", Version: "1.0-r0", Arch: "noarch"},
+		{Name: "scripts", Version: "1.0-r0", Arch: "all"},
+	}}
+	archive, err := ArchiveFromIndex(index)
+	require.NoError(t, err)
+	b, err := io.ReadAll(archive)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(repo, "x86_64"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "x86_64", indexFilename), b, 0o644))
+
+	indexes, err := GetRepositoryIndexes(ctx, []string{repo}, nil, "amd64", WithIgnoreSignatures(true))
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+
+	var names []string
+	for _, pkg := range indexes[0].Packages() {
+		names = append(names, pkg.Name+"-"+pkg.Version)
+	}
+	require.Equal(t, []string{"tool-1.0-r0", "data-1.0-r0", "scripts-1.0-r0"}, names)
+
+	pkgs, _, err := NewPkgResolver(ctx, indexes).GetPackagesWithDependencies(ctx, []string{"tool", "scripts"})
+	require.NoError(t, err)
+	urls := map[string]string{}
+	for _, pkg := range pkgs {
+		urls[pkg.Name] = pkg.URL()
+	}
+	require.Equal(t, map[string]string{
+		"tool":    repo + "/x86_64/tool-1.0-r0.apk",
+		"data":    repo + "/x86_64/data-1.0-r0.apk",
+		"scripts": repo + "/x86_64/scripts-1.0-r0.apk",
+	}, urls)
+}
@@ -0,0 +1,222 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // apk-tools uses sha1 for file checksums
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+)
+
+// AuditChange is a way in which a file on disk differs from the installed database.
+type AuditChange string
+
+const (
+	// AuditChecksum means the content of a regular file does not match its checksum.
+	AuditChecksum AuditChange = "checksum"
+	// AuditSymlink means the target of a symlink does not match its checksum.
+	AuditSymlink AuditChange = "symlink"
+	// AuditPermissions means the permission bits differ.
+	AuditPermissions AuditChange = "permissions"
+	// AuditOwnership means the uid or gid differ.
+	AuditOwnership AuditChange = "ownership"
+)
+
+// AuditEntry describes a file that is recorded in the installed database.
+type AuditEntry struct {
+	// Path is the path of the file, relative to the root of the filesystem.
+	Path string
+	// Package is the name of the package that owns the file.
+	Package string
+	// Changes lists how the file was modified; it is empty for missing files.
+	Changes []AuditChange
+}
+
+// AuditReport is the result of Audit.
+type AuditReport struct {
+	// Modified are files that exist but differ from the installed database.
+	Modified []AuditEntry
+	// Missing are files that are in the installed database but not on disk.
+	Missing []AuditEntry
+	// Extra are regular files and symlinks on disk that no package owns, in the directories
+	// that packages own.
+	Extra []string
+}
+
+// Clean returns true if the report found no modified, missing or extra files.
+func (r *AuditReport) Clean() bool {
+	return len(r.Modified) == 0 && len(r.Missing) == 0 && len(r.Extra) == 0
+}
+
+// auditSkipDirs are not owned by packages but by apk itself, or are where virtual
+// filesystems are mounted, whose files are not on disk, even though a package like
+// alpine-baselayout owns the directories.
+var auditSkipDirs = []string{"etc/apk", "lib/apk", "dev", "proc", "run", "sys"}
+
+// Audit compares the files in the filesystem against the installed database. It checks
+// checksums, permissions, ownership and symlink targets of every file owned by a package,
+// and looks for files that no package owns in the directories that packages own, like
+// apk-tools does, so that the rest of a filesystem, e.g. home directories or other mounts, is
+// not walked. Ownership is only checked when the filesystem
+// reports it, which the filesystems in pkg/fs do.
+func (a *APK) Audit(ctx context.Context) (*AuditReport, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Audit")
+	defer span.End()
+
+	db, err := a.InstalledDB()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &AuditReport{}
+	known := map[string]struct{}{}
+	// dirs are the directories that packages own, or have files in.
+	dirs := map[string]struct{}{}
+	for _, pkg := range db.Packages() {
+		for _, hdr := range pkg.Files {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			path := cleanInstalledPath(hdr.Name)
+			known[path] = struct{}{}
+			if hdr.Typeflag == tar.TypeDir {
+				dirs[path] = struct{}{}
+			}
+			for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+				dirs[dir] = struct{}{}
+			}
+
+			changes, err := a.auditFile(path, hdr)
+			if errors.Is(err, fs.ErrNotExist) {
+				report.Missing = append(report.Missing, AuditEntry{Path: path, Package: pkg.Name})
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("auditing %s: %w", path, err)
+			}
+			if len(changes) != 0 {
+				report.Modified = append(report.Modified, AuditEntry{Path: path, Package: pkg.Name, Changes: changes})
+			}
+		}
+	}
+
+	if err := fs.WalkDir(a.fs, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == "." {
+				return nil
+			}
+			for _, skip := range auditSkipDirs {
+				if path == skip {
+					return fs.SkipDir
+				}
+			}
+			if _, ok := dirs[path]; !ok {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() && d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		if _, ok := known[path]; !ok {
+			report.Extra = append(report.Extra, path)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("walking filesystem: %w", err)
+	}
+	sort.Strings(report.Extra)
+
+	return report, nil
+}
+
+// auditFile returns how the file at path differs from hdr, its entry in the installed database.
+func (a *APK) auditFile(path string, hdr *tar.Header) ([]AuditChange, error) {
+	fi, err := a.fs.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []AuditChange
+	var want []byte
+	if checksum := hdr.PAXRecords[paxRecordsChecksumKey]; strings.HasPrefix(checksum, "Q1") {
+		if want, err = base64.StdEncoding.DecodeString(checksum[2:]); err != nil {
+			return nil, fmt.Errorf("decoding checksum %q: %w", checksum, err)
+		}
+	}
+
+	switch {
+	case fi.Mode()&fs.ModeSymlink != 0:
+		// apk-tools records the checksum of a symlink's target; the permissions of a
+		// symlink are meaningless.
+		target, err := a.fs.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		if got := sha1.Sum([]byte(target)); want != nil && !bytes.Equal(want, got[:]) { //nolint:gosec
+			changes = append(changes, AuditSymlink)
+		}
+	case fi.Mode().IsRegular():
+		if want != nil {
+			got, err := a.sha1File(path)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(want, got) {
+				changes = append(changes, AuditChecksum)
+			}
+		}
+		fallthrough
+	default:
+		if int64(fi.Mode().Perm()) != hdr.Mode&0o777 {
+			changes = append(changes, AuditPermissions)
+		}
+	}
+
+	if sys, ok := fi.Sys().(*tar.Header); ok && (sys.Uid != hdr.Uid || sys.Gid != hdr.Gid) {
+		changes = append(changes, AuditOwnership)
+	}
+
+	return changes, nil
+}
+
+func (a *APK) sha1File(path string) ([]byte, error) {
+	f, err := a.fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha1.New() //nolint:gosec
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha1" //nolint:gosec
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestAudit(t *testing.T) {
+	ctx := context.Background()
+
+	sum := func(s string) map[string]string {
+		h := sha1.Sum([]byte(s)) //nolint:gosec
+		return map[string]string{paxRecordsChecksumKey: hex.EncodeToString(h[:])}
+	}
+
+	setup := func(t *testing.T) *APK {
+		src := apkfs.NewMemFS()
+		require.NoError(t, src.MkdirAll("lib/apk/db", 0o755))
+		require.NoError(t, src.MkdirAll("usr/bin", 0o755))
+		require.NoError(t, src.WriteFile("usr/bin/foo", []byte("foo"), 0o755))
+		require.NoError(t, src.WriteFile("usr/bin/bar", []byte("bar"), 0o644))
+		require.NoError(t, src.Symlink("foo", "usr/bin/baz"))
+
+		a, err := New(WithFS(src))
+		require.NoError(t, err)
+		require.NoError(t, a.addInstalledPackage(&Package{Name: "foo", Version: "1.0-r0"}, []tar.Header{
+			{Name: "usr", Typeflag: tar.TypeDir, Mode: 0o755},
+			{Name: "usr/bin", Typeflag: tar.TypeDir, Mode: 0o755},
+			{Name: "usr/bin/foo", Typeflag: tar.TypeReg, Mode: 0o755, PAXRecords: sum("foo")},
+			{Name: "usr/bin/bar", Typeflag: tar.TypeReg, Mode: 0o644, PAXRecords: sum("bar")},
+			{Name: "usr/bin/baz", Typeflag: tar.TypeSymlink, Mode: 0o777, PAXRecords: sum("foo")},
+		}))
+		return a
+	}
+
+	t.Run("clean", func(t *testing.T) {
+		a := setup(t)
+		report, err := a.Audit(ctx)
+		require.NoError(t, err)
+		require.True(t, report.Clean(), "%+v", report)
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		a := setup(t)
+		require.NoError(t, a.fs.WriteFile("usr/bin/foo", []byte("evil"), 0o755))
+		require.NoError(t, a.fs.Chmod("usr/bin/foo", 0o700))
+		require.NoError(t, a.fs.Chown("usr/bin/foo", 1000, 1000))
+		require.NoError(t, a.fs.Remove("usr/bin/bar"))
+		require.NoError(t, a.fs.Remove("usr/bin/baz"))
+		require.NoError(t, a.fs.Symlink("/tmp/evil", "usr/bin/baz"))
+		require.NoError(t, a.fs.WriteFile("usr/bin/extra", []byte("extra"), 0o755))
+
+		report, err := a.Audit(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []AuditEntry{
+			{Path: "usr/bin/baz", Package: "foo", Changes: []AuditChange{AuditSymlink}},
+			{Path: "usr/bin/foo", Package: "foo", Changes: []AuditChange{AuditChecksum, AuditPermissions, AuditOwnership}},
+		}, report.Modified)
+		require.Equal(t, []AuditEntry{{Path: "usr/bin/bar", Package: "foo"}}, report.Missing)
+		require.Equal(t, []string{"usr/bin/extra"}, report.Extra)
+	})
+
+	t.Run("walk", func(t *testing.T) {
+		a := setup(t)
+		require.NoError(t, a.addInstalledPackage(&Package{Name: "alpine-baselayout", Version: "1.0-r0"}, []tar.Header{
+			{Name: "proc", Typeflag: tar.TypeDir, Mode: 0o555},
+		}))
+		// virtual filesystems, even in directories that packages own
+		require.NoError(t, a.fs.MkdirAll("proc/1", 0o555))
+		require.NoError(t, a.fs.WriteFile("proc/1/status", []byte("status"), 0o444))
+		// directories that no package owns
+		require.NoError(t, a.fs.MkdirAll("home/user", 0o755))
+		require.NoError(t, a.fs.WriteFile("home/user/notes", []byte("notes"), 0o644))
+		require.NoError(t, a.fs.WriteFile("stray", []byte("stray"), 0o644))
+
+		report, err := a.Audit(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []string{"stray"}, report.Extra)
+	})
+}
@@ -0,0 +1,243 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TokenFunc returns a bearer token to use for requests to the given host.
+// It is called for every request, so implementations that mint short-lived
+// tokens should do their own caching. Returning an empty token means no
+// token is available for the host.
+type TokenFunc func(ctx context.Context, host string) (string, error)
+
+type basicCredentials struct {
+	username string
+	password string
+}
+
+// auth holds all of the credentials configured on an APK. The same credentials
+// are applied to index, key and package fetches, as they all go through the
+// same *http.Client.
+type auth struct {
+	basic     map[string]basicCredentials
+	bearer    map[string]string
+	tokenFunc TokenFunc
+	netrc     []netrcMachine
+}
+
+func (a *auth) empty() bool {
+	return a == nil || (len(a.basic) == 0 && len(a.bearer) == 0 && a.tokenFunc == nil && len(a.netrc) == 0)
+}
+
+// client returns an http.Client that adds credentials to requests before sending them with wrapped.
+func (a *auth) client(wrapped *http.Client) *http.Client {
+	if a.empty() || wrapped == nil {
+		return wrapped
+	}
+	return &http.Client{
+		Transport: &authTransport{
+			wrapped: wrapped,
+			auth:    a,
+		},
+	}
+}
+
+type authTransport struct {
+	wrapped *http.Client
+	auth    *auth
+}
+
+func (t *authTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	// Explicit credentials, e.g. from user info in the repository URL, always win.
+	if request.URL == nil || request.Header.Get("Authorization") != "" {
+		return t.wrapped.Do(request)
+	}
+
+	header, err := t.auth.authorization(request.Context(), request.URL.Host, request.URL.Hostname())
+	if err != nil {
+		return nil, fmt.Errorf("getting credentials for %s: %w", request.URL.Host, err)
+	}
+	if header == "" {
+		return t.wrapped.Do(request)
+	}
+
+	// A RoundTripper must not modify the request it was given.
+	req := request.Clone(request.Context())
+	req.Header.Set("Authorization", header)
+
+	return t.wrapped.Do(req)
+}
+
+// authorization returns the value of the Authorization header to use for host, or an empty
+// string if there are no credentials for it. Credentials are looked up by host:port first,
+// then by hostname alone. In order of precedence: basic auth, static bearer tokens, the
+// token callback, then netrc.
+func (a *auth) authorization(ctx context.Context, hosts ...string) (string, error) {
+	for _, host := range hosts {
+		if creds, ok := a.basic[host]; ok {
+			req := http.Request{Header: http.Header{}}
+			req.SetBasicAuth(creds.username, creds.password)
+			return req.Header.Get("Authorization"), nil
+		}
+	}
+	for _, host := range hosts {
+		if token, ok := a.bearer[host]; ok {
+			return "Bearer " + token, nil
+		}
+	}
+	if a.tokenFunc != nil {
+		token, err := a.tokenFunc(ctx, hosts[len(hosts)-1])
+		if err != nil {
+			return "", err
+		}
+		if token != "" {
+			return "Bearer " + token, nil
+		}
+	}
+	for _, host := range hosts {
+		if m, ok := findNetrcMachine(a.netrc, host); ok {
+			req := http.Request{Header: http.Header{}}
+			req.SetBasicAuth(m.login, m.password)
+			return req.Header.Get("Authorization"), nil
+		}
+	}
+	return "", nil
+}
+
+// netrcMachine is a single entry of a netrc file. An empty name is the default entry.
+type netrcMachine struct {
+	name     string
+	login    string
+	password string
+}
+
+// findNetrcMachine returns the entry for host, falling back to the default entry if present.
+func findNetrcMachine(machines []netrcMachine, host string) (netrcMachine, bool) {
+	var (
+		def    netrcMachine
+		hasDef bool
+	)
+	for _, m := range machines {
+		if m.name == host {
+			return m, true
+		}
+		if m.name == "" && !hasDef {
+			def, hasDef = m, true
+		}
+	}
+	return def, hasDef
+}
+
+// parseNetrc parses the contents of a netrc file as described in
+// https://www.gnu.org/software/inetutils/manual/html_node/The-_002enetrc-file.html
+// Macro definitions are skipped.
+func parseNetrc(r io.Reader) ([]netrcMachine, error) {
+	var (
+		machines []netrcMachine
+		current  *netrcMachine
+		inMacro  bool
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inMacro {
+			// macro definitions end with an empty line
+			if strings.TrimSpace(line) == "" {
+				inMacro = false
+			}
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			switch fields[i] {
+			case "machine":
+				if i+1 >= len(fields) {
+					return nil, errors.New("netrc: machine without a name")
+				}
+				i++
+				machines = append(machines, netrcMachine{name: fields[i]})
+				current = &machines[len(machines)-1]
+			case "default":
+				machines = append(machines, netrcMachine{})
+				current = &machines[len(machines)-1]
+			case "login", "password", "account":
+				if current == nil {
+					return nil, fmt.Errorf("netrc: %s outside of a machine entry", fields[i])
+				}
+				if i+1 >= len(fields) {
+					return nil, fmt.Errorf("netrc: %s without a value", fields[i])
+				}
+				switch fields[i] {
+				case "login":
+					current.login = fields[i+1]
+				case "password":
+					current.password = fields[i+1]
+				}
+				i++
+			case "macdef":
+				inMacro = true
+				i = len(fields)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return machines, nil
+}
+
+// loadNetrc reads the netrc file at path. If path is empty, $NETRC is used, then ~/.netrc.
+// A missing file is only an error if path was given explicitly.
+func loadNetrc(path string) ([]netrcMachine, error) {
+	explicit := path != ""
+	if !explicit {
+		path = os.Getenv("NETRC")
+	}
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if !explicit && errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("opening netrc file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	machines, err := parseNetrc(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing netrc file %s: %w", path, err)
+	}
+	return machines, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testAuthTransport struct {
+	got []string
+}
+
+func (t *testAuthTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	t.got = append(t.got, request.Header.Get("Authorization"))
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func TestParseNetrc(t *testing.T) {
+	machines, err := parseNetrc(strings.NewReader(`
+# comment
+machine packages.example.com login alice password s3cret
+macdef init
+cd /pub
+
+machine other.example.com
+  login bob
+  password hunter2
+default login anon password guest
+`))
+	require.NoError(t, err)
+	require.Len(t, machines, 3)
+
+	m, ok := findNetrcMachine(machines, "other.example.com")
+	require.True(t, ok)
+	require.Equal(t, "bob", m.login)
+	require.Equal(t, "hunter2", m.password)
+
+	m, ok = findNetrcMachine(machines, "unknown.example.com")
+	require.True(t, ok)
+	require.Equal(t, "anon", m.login)
+
+	_, err = parseNetrc(strings.NewReader("login alice"))
+	require.Error(t, err)
+}
+
+func TestAuth(t *testing.T) {
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	require.NoError(t, os.WriteFile(netrc, []byte("machine netrc.example.com login carol password pw\n"), 0o600))
+
+	basic := &http.Request{Header: http.Header{}}
+	basic.SetBasicAuth("alice", "s3cret")
+	fromNetrc := &http.Request{Header: http.Header{}}
+	fromNetrc.SetBasicAuth("carol", "pw")
+
+	a, err := New(
+		WithBasicAuth("basic.example.com", "alice", "s3cret"),
+		WithBearerToken("bearer.example.com:8443", "static"),
+		WithTokenFunc(func(_ context.Context, host string) (string, error) {
+			if host == "token.example.com" {
+				return "minted", nil
+			}
+			return "", nil
+		}),
+		WithNetrc(netrc),
+	)
+	require.NoError(t, err)
+
+	transport := &testAuthTransport{}
+	a.SetClient(&http.Client{Transport: transport})
+
+	for _, u := range []string{
+		"https://basic.example.com/x86_64/APKINDEX.tar.gz",
+		"https://bearer.example.com:8443/x86_64/APKINDEX.tar.gz",
+		"https://bearer.example.com/x86_64/APKINDEX.tar.gz",
+		"https://token.example.com/keys/key.rsa.pub",
+		"https://netrc.example.com/x86_64/foo-1.0-r0.apk",
+		"https://unknown.example.com/x86_64/foo-1.0-r0.apk",
+	} {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		require.NoError(t, err)
+		res, err := a.client.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+	}
+
+	require.Equal(t, []string{
+		basic.Header.Get("Authorization"),
+		"Bearer static",
+		"",
+		"Bearer minted",
+		fromNetrc.Header.Get("Authorization"),
+		"",
+	}, transport.got)
+
+	t.Run("explicit credentials win", func(t *testing.T) {
+		transport.got = nil
+		req, err := http.NewRequest(http.MethodGet, "https://basic.example.com/x86_64/APKINDEX.tar.gz", nil)
+		require.NoError(t, err)
+		req.SetBasicAuth("user", "from-url")
+		res, err := a.client.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, []string{req.Header.Get("Authorization")}, transport.got)
+	})
+
+	t.Run("missing explicit netrc", func(t *testing.T) {
+		_, err := New(WithNetrc(filepath.Join(t.TempDir(), "missing")))
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,116 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The resolution benchmarks run against snapshots of real indexes, vendored in testdata, so
+// that their results are comparable across changes, e.g. with benchstat:
+//
+//	go test ./pkg/apk -run '^$' -bench 'Index|Resolver|Dependencies' -count 10 > old.txt
+//
+// A snapshot of the Wolfi index is left out on purpose: it keeps every version of every
+// package, which makes it much larger than these to vendor. To benchmark against it, add
+// it to testdata and to benchIndexes locally.
+var benchIndexes = []struct {
+	name, path string
+}{
+	{"alpine-3.16", "testdata/alpine-316/APKINDEX.tar.gz"},
+	{"alpine-3.17", "testdata/alpine-317/APKINDEX.tar.gz"},
+}
+
+// benchWorlds are representative worlds to resolve, from a minimal image to a toolchain.
+var benchWorlds = []struct {
+	name  string
+	world []string
+}{
+	{"base", []string{"alpine-base"}},
+	{"server", []string{"alpine-baselayout", "busybox", "nginx", "curl", "openssh"}},
+	{"toolchain", []string{"build-base", "git", "perl", "python3", "nodejs"}},
+}
+
+// benchLoadIndex reads the index at path.
+func benchLoadIndex(b *testing.B, path string) *APKIndex {
+	b.Helper()
+	f, err := os.Open(path)
+	require.NoError(b, err)
+	defer f.Close()
+	index, err := IndexFromArchive(f)
+	require.NoError(b, err)
+	return index
+}
+
+// benchNamedIndexes returns the index at path, as the resolver gets it.
+func benchNamedIndexes(b *testing.B, path string) []NamedIndex {
+	b.Helper()
+	repo := Repository{URI: "https://dl-cdn.alpinelinux.org/alpine/main"}
+	return testNamedRepositoryFromIndexes([]*RepositoryWithIndex{repo.WithIndex(benchLoadIndex(b, path))})
+}
+
+func BenchmarkIndexFromArchive(b *testing.B) {
+	for _, idx := range benchIndexes {
+		b.Run(idx.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				benchLoadIndex(b, idx.path)
+			}
+		})
+	}
+}
+
+func BenchmarkNewPkgResolver(b *testing.B) {
+	ctx := context.Background()
+	for _, idx := range benchIndexes {
+		b.Run(idx.name, func(b *testing.B) {
+			indexes := benchNamedIndexes(b, idx.path)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				NewPkgResolver(ctx, indexes)
+			}
+		})
+	}
+}
+
+// BenchmarkGetPackagesWithDependencies resolves each world with a new resolver, as an
+// install does, but only times the resolution, see BenchmarkNewPkgResolver.
+func BenchmarkGetPackagesWithDependencies(b *testing.B) {
+	ctx := context.Background()
+	for _, idx := range benchIndexes {
+		indexes := benchNamedIndexes(b, idx.path)
+		for _, w := range benchWorlds {
+			b.Run(idx.name+"/"+w.name, func(b *testing.B) {
+				b.ReportAllocs()
+				var packages int
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					resolver := NewPkgResolver(ctx, indexes)
+					b.StartTimer()
+
+					pkgs, _, err := resolver.GetPackagesWithDependencies(ctx, w.world)
+					require.NoError(b, err)
+					packages = len(pkgs)
+				}
+				b.ReportMetric(float64(packages), "packages")
+			})
+		}
+	}
+}
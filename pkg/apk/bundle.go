@@ -0,0 +1,251 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+)
+
+// A cache bundle is a tar of the files of a cache, by their path in the cache, followed by
+// a manifest of their sizes and hashes. The manifest is last so that the bundle is written
+// in one pass, and imported files are only put in place once all of them are verified.
+const (
+	cacheBundleManifest = "manifest.json"
+	cacheBundleVersion  = 1
+)
+
+type cacheBundleManifestFile struct {
+	Version int               `json:"version"`
+	Files   []cacheBundleFile `json:"files"`
+}
+
+type cacheBundleFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Export writes the indexes, keys and packages in the cache to w as a single tar, so that
+// a cache can be seeded from another machine, e.g. in an air-gapped environment, see
+// Import.
+func (c *Cache) Export(ctx context.Context, w io.Writer) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Export")
+	defer span.End()
+
+	tw := tar.NewWriter(w)
+	manifest := cacheBundleManifestFile{Version: cacheBundleVersion}
+	if err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || isCacheLockFile(path) || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(c.dir, path)
+		if err != nil {
+			return err
+		}
+		file, err := exportCacheFile(tw, path, filepath.ToSlash(rel))
+		if errors.Is(err, fs.ErrNotExist) {
+			// evicted meanwhile
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("exporting %s: %w", path, err)
+		}
+		manifest.Files = append(manifest.Files, file)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("walking cache %s: %w", c.dir, err)
+	}
+
+	b, err := json.Marshal(&manifest)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     cacheBundleManifest,
+		Typeflag: tar.TypeReg,
+		Mode:     0o644,
+		Size:     int64(len(b)),
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// exportCacheFile writes the file at path to tw, named name. Files in the cache are only
+// replaced by renames, so the open file does not change while it is written.
+func exportCacheFile(tw *tar.Writer, path, name string) (cacheBundleFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return cacheBundleFile{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return cacheBundleFile{}, err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0o644,
+		Size:     fi.Size(),
+		ModTime:  fi.ModTime(),
+	}); err != nil {
+		return cacheBundleFile{}, err
+	}
+	h := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(tw, h), f, fi.Size()); err != nil {
+		return cacheBundleFile{}, err
+	}
+	return cacheBundleFile{Path: name, Size: fi.Size(), SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// Import adds the files of a bundle written by Export to the cache, replacing the files
+// it already has at the same paths. Every file must match the manifest of the bundle; if
+// any does not, nothing is imported.
+func (c *Cache) Import(ctx context.Context, r io.Reader) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Import")
+	defer span.End()
+
+	type imported struct {
+		file cacheBundleFile
+		hdr  *tar.Header
+		tmp  string
+	}
+	var (
+		files    []imported
+		manifest *cacheBundleManifestFile
+	)
+	defer func() {
+		for _, f := range files {
+			if f.tmp != "" {
+				os.Remove(f.tmp)
+			}
+		}
+	}()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading cache bundle: %w", err)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if manifest != nil {
+			return fmt.Errorf("unexpected %s after the manifest of the cache bundle", hdr.Name)
+		}
+		if hdr.Name == cacheBundleManifest {
+			manifest = &cacheBundleManifestFile{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return fmt.Errorf("reading manifest of cache bundle: %w", err)
+			}
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if !filepath.IsLocal(hdr.Name) || isCacheLockFile(hdr.Name) {
+			return fmt.Errorf("invalid path in cache bundle: %s", hdr.Name)
+		}
+		tmp, file, err := c.importCacheFile(tr, hdr)
+		files = append(files, imported{file: file, hdr: hdr, tmp: tmp})
+		if err != nil {
+			return fmt.Errorf("importing %s: %w", hdr.Name, err)
+		}
+	}
+
+	if manifest == nil {
+		return fmt.Errorf("cache bundle has no manifest")
+	}
+	if manifest.Version != cacheBundleVersion {
+		return fmt.Errorf("unsupported cache bundle version %d", manifest.Version)
+	}
+	want := make(map[string]cacheBundleFile, len(manifest.Files))
+	for _, f := range manifest.Files {
+		want[f.Path] = f
+	}
+	if len(want) != len(files) {
+		return fmt.Errorf("cache bundle has %d files, its manifest lists %d", len(files), len(want))
+	}
+	for _, f := range files {
+		if w, ok := want[f.file.Path]; !ok || w != f.file {
+			return fmt.Errorf("%s in cache bundle does not match its manifest", f.file.Path)
+		}
+	}
+
+	for i, f := range files {
+		dst := filepath.Join(c.dir, filepath.FromSlash(f.file.Path))
+		if err := os.Rename(f.tmp, dst); err != nil {
+			return fmt.Errorf("unable to populate cache: %w", err)
+		}
+		files[i].tmp = ""
+		// Keep when it was last used, for GC and the index TTL.
+		_ = os.Chtimes(dst, f.hdr.ModTime, f.hdr.ModTime)
+	}
+	return nil
+}
+
+// importCacheFile writes the current file of tr to a temporary file next to where it goes
+// in the cache, and returns it.
+func (c *Cache) importCacheFile(tr *tar.Reader, hdr *tar.Header) (string, cacheBundleFile, error) {
+	file := cacheBundleFile{Path: hdr.Name}
+	dir := filepath.Dir(filepath.Join(c.dir, filepath.FromSlash(hdr.Name)))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", file, fmt.Errorf("unable to create cache directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, "*.tmp")
+	if err != nil {
+		return "", file, fmt.Errorf("unable to create a temporary cache file: %w", err)
+	}
+	defer tmp.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), tr)
+	if err != nil {
+		return tmp.Name(), file, err
+	}
+	file.Size = n
+	file.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return tmp.Name(), file, tmp.Close()
+}
@@ -0,0 +1,108 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+func TestCacheBundle(t *testing.T) {
+	ctx := context.Background()
+
+	f, err := os.Open("testdata/hello-0.1.0-r0.apk")
+	require.NoError(t, err)
+	exp, err := expandapk.ExpandApk(ctx, f, "")
+	require.NoError(t, err)
+	f.Close()
+	checksum := exp.ControlHash
+	exp.Close()
+
+	repo := Repository{URI: "https://example.com/bundle/x86_64"}
+	index := repo.WithIndex(&APKIndex{Packages: []*Package{{
+		Name:     "hello",
+		Version:  "0.1.0-r0",
+		Checksum: checksum,
+	}}})
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{index})
+
+	a, err := New(WithCache(t.TempDir(), false))
+	require.NoError(t, err)
+	a.SetClient(&http.Client{Transport: &testLocalTransport{root: "testdata", basenameOnly: true}})
+	pkgs, err := a.Cache().Warm(ctx, indexes, []string{"hello"})
+	require.NoError(t, err)
+
+	var bundle bytes.Buffer
+	require.NoError(t, a.Cache().Export(ctx, &bundle))
+
+	// The imported cache is enough to fetch the package without network.
+	cacheDir := t.TempDir()
+	offline, err := New(WithCache(cacheDir, false), WithOffline(true))
+	require.NoError(t, err)
+	require.Error(t, offline.checkOfflinePackages(ctx, []InstallablePackage{pkgs[0]}))
+	require.NoError(t, offline.Cache().Import(ctx, bytes.NewReader(bundle.Bytes())))
+	require.NoError(t, offline.checkOfflinePackages(ctx, []InstallablePackage{pkgs[0]}))
+	_, err = expandPackage(ctx, offline, pkgs[0])
+	require.NoError(t, err)
+	corrupt, err := offline.Cache().Verify(ctx, false)
+	require.NoError(t, err)
+	require.Empty(t, corrupt)
+}
+
+func TestCacheBundleInvalid(t *testing.T) {
+	ctx := context.Background()
+
+	bundle := func(name string, data []byte, manifest string) []byte {
+		var b bytes.Buffer
+		tw := tar.NewWriter(&b)
+		for _, f := range []struct {
+			name string
+			data []byte
+		}{{name, data}, {cacheBundleManifest, []byte(manifest)}} {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(f.data))}))
+			_, err := tw.Write(f.data)
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		return b.Bytes()
+	}
+
+	for name, b := range map[string][]byte{
+		"wrong hash": bundle("a/b", []byte("b"), `{"version":1,"files":[{"path":"a/b","size":1,"sha256":"00"}]}`),
+		"not listed": bundle("a/b", []byte("b"), `{"version":1,"files":[]}`),
+		"outside":    bundle("../b", []byte("b"), `{"version":1,"files":[]}`),
+		"version":    bundle("a/b", []byte("b"), `{"version":2,"files":[{"path":"a/b","size":1,"sha256":"3e23e8160039594a33894f6564e1b1348bbd7a0088d42c4acb73eeaed59c009d"}]}`),
+	} {
+		t.Run(name, func(t *testing.T) {
+			cacheDir := t.TempDir()
+			a, err := New(WithCache(cacheDir, false))
+			require.NoError(t, err)
+			require.Error(t, a.Cache().Import(ctx, bytes.NewReader(b)))
+			entries, err := os.ReadDir(filepath.Join(cacheDir, "a"))
+			if err == nil {
+				require.Empty(t, entries, "nothing is imported")
+			}
+		})
+	}
+}
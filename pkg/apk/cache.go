@@ -15,14 +15,23 @@
 package apk
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
 )
 
 // This is terrible but simpler than plumbing around a cache for now.
@@ -54,6 +63,22 @@ func (e *etagCache) get(t *cacheTransport, request *http.Request, cacheFile stri
 	// Do all the expensive things inside the once.
 	once, _ := e.etags.LoadOrStore(url, &sync.Once{})
 	once.(*sync.Once).Do(func() {
+		// If we have fetched this before, revalidate our copy with a conditional request
+		// instead of a HEAD followed by a GET.
+		if v, ok := readCacheValidators(cacheFile); ok && !t.cache.forceRefresh {
+			// Within the TTL, don't even ask.
+			if ttl := t.cache.indexTTL; ttl > 0 && time.Since(v.validated) < ttl {
+				cached := v.cachedFile(cacheFile)
+				t.cache.hit(cached)
+				e.resps.Store(url, etagResp{cacheFile: cached})
+				return
+			}
+			if resp, ok := t.revalidate(request, cacheFile, v); ok {
+				e.resps.Store(url, resp)
+				return
+			}
+		}
+
 		resp, rerr := t.wrapped.Head(url)
 		if resp != nil {
 			// We don't expect any body from a HEAD so just always close it to appease the linter.
@@ -67,7 +92,7 @@ func (e *etagCache) get(t *cacheTransport, request *http.Request, cacheFile stri
 			return
 		}
 
-		initialEtag, ok := etagFromResponse(resp)
+		initialEtag, _, ok := etagFromResponse(resp)
 		if !ok {
 			return
 		}
@@ -75,7 +100,18 @@ func (e *etagCache) get(t *cacheTransport, request *http.Request, cacheFile stri
 		// We simulate content-based addressing with the etag values using an .etag
 		// file extension.
 		etagFile := cacheFileFromEtag(cacheFile, initialEtag)
-		if _, err := os.Stat(etagFile); err == nil {
+
+		// Serialize with other processes populating the same entry.
+		unlock, err := lockCacheEntry(request.Context(), filepath.Dir(etagFile))
+		if err != nil {
+			e.resps.Store(url, etagResp{err: err})
+			return
+		}
+		defer unlock()
+
+		if _, err := os.Stat(etagFile); err == nil && !t.cache.forceRefresh {
+			t.cache.hit(etagFile)
+			touchCacheValidators(cacheFile)
 			e.resps.Store(url, etagResp{
 				cacheFile: etagFile,
 			})
@@ -83,16 +119,30 @@ func (e *etagCache) get(t *cacheTransport, request *http.Request, cacheFile stri
 		}
 
 		// Only download the index once.
-		etagFile, err := t.retrieveAndSaveFile(request, func(r *http.Response) (string, error) {
+		t.cache.miss(request.Context())
+		var (
+			lastModified string
+			weak         bool
+		)
+		etagFile, err = t.retrieveAndSaveFile(request, func(r *http.Response) (string, error) {
+			lastModified = r.Header.Get("Last-Modified")
+
 			// On the etag path, use the etag from the actual response to
 			// compute the final file name.
-			finalEtag, ok := etagFromResponse(r)
+			var (
+				finalEtag string
+				ok        bool
+			)
+			finalEtag, weak, ok = etagFromResponse(r)
 			if !ok {
 				return "", fmt.Errorf("GET response did not contain an etag, but HEAD returned %q", initialEtag)
 			}
 
 			return cacheFileFromEtag(cacheFile, finalEtag), nil
 		})
+		if err == nil && etagFile != "" {
+			writeCacheValidators(cacheFile, etagFile, lastModified, weak)
+		}
 		e.resps.Store(url, etagResp{
 			err:       err,
 			cacheFile: etagFile,
@@ -129,21 +179,433 @@ func (e *etagCache) get(t *cacheTransport, request *http.Request, cacheFile stri
 	}, nil
 }
 
-// cache
-type cache struct {
+// cacheValidators are the validators of the last response a cache file was populated
+// from, which are sent back to the server to revalidate the cached copy.
+type cacheValidators struct {
+	ETag         string `json:"etag"`
+	LastModified string `json:"lastModified,omitempty"`
+	// Weak is whether ETag is a weak validator, W/"etag".
+	Weak bool `json:"weak,omitempty"`
+	// File is the base name of the cached copy.
+	File string `json:"file"`
+
+	// validated is when the server last confirmed the cached copy is current.
+	validated time.Time
+}
+
+// cacheValidatorsFile returns the file the validators of cacheFile are persisted in.
+func cacheValidatorsFile(cacheFile string) string {
+	return cacheFile + ".validators"
+}
+
+// readCacheValidators returns the persisted validators of cacheFile, if the copy they
+// refer to is still in the cache.
+func readCacheValidators(cacheFile string) (*cacheValidators, bool) {
+	p := cacheValidatorsFile(cacheFile)
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, false
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, false
+	}
+	v := &cacheValidators{validated: fi.ModTime()}
+	if err := json.Unmarshal(b, v); err != nil || v.ETag == "" || v.File == "" {
+		return nil, false
+	}
+	if _, err := os.Stat(v.cachedFile(cacheFile)); err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+func (v *cacheValidators) cachedFile(cacheFile string) string {
+	return filepath.Join(filepath.Dir(cacheFileFromEtag(cacheFile, v.ETag)), v.File)
+}
+
+// writeCacheValidators persists the validators of the response etagFile was populated
+// from. It is best effort: without them we fall back to a HEAD request.
+func writeCacheValidators(cacheFile, etagFile, lastModified string, weak bool) {
+	etag := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(etagFile), ".tar.gz"), ".etag")
+	b, err := json.Marshal(&cacheValidators{ETag: etag, LastModified: lastModified, Weak: weak, File: filepath.Base(etagFile)})
+	if err != nil {
+		return
+	}
+	p := cacheValidatorsFile(cacheFile)
+	tmp, err := os.CreateTemp(filepath.Dir(p), "*.tmp")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+// touchCacheValidators records that the cached copy of cacheFile was just revalidated.
+func touchCacheValidators(cacheFile string) {
+	now := time.Now()
+	_ = os.Chtimes(cacheValidatorsFile(cacheFile), now, now)
+}
+
+// revalidate sends a conditional request for the cached copy described by v. It returns
+// false if the server did not answer in a way we can cache, in which case the caller
+// falls back to fetching the file as if it had never been cached.
+func (t *cacheTransport) revalidate(request *http.Request, cacheFile string, v *cacheValidators) (etagResp, bool) {
+	if t.wrapped == nil {
+		return etagResp{}, false
+	}
+	cached := v.cachedFile(cacheFile)
+
+	req := request.Clone(request.Context())
+	req.Header.Set("If-None-Match", formatETag(v.ETag, v.Weak))
+	if v.LastModified != "" {
+		req.Header.Set("If-Modified-Since", v.LastModified)
+	}
+	resp, err := t.wrapped.Do(req)
+	if err != nil {
+		return etagResp{}, false
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		resp.Body.Close()
+		unlock, err := lockCacheEntry(request.Context(), filepath.Dir(cached))
+		if err != nil {
+			return etagResp{err: err}, true
+		}
+		defer unlock()
+		if _, err := os.Stat(cached); err != nil {
+			// Evicted since we looked.
+			return etagResp{}, false
+		}
+		t.cache.hit(cached)
+		touchCacheValidators(cacheFile)
+		return etagResp{cacheFile: cached}, true
+	case http.StatusOK:
+		etag, weak, ok := etagFromResponse(resp)
+		if !ok {
+			resp.Body.Close()
+			return etagResp{}, false
+		}
+		etagFile := cacheFileFromEtag(cacheFile, etag)
+		unlock, err := lockCacheEntry(request.Context(), filepath.Dir(etagFile))
+		if err != nil {
+			resp.Body.Close()
+			return etagResp{err: err}, true
+		}
+		defer unlock()
+
+		t.cache.miss(request.Context())
+		etagFile, err = t.saveResponse(resp, func(*http.Response) (string, error) { return etagFile, nil })
+		if err != nil {
+			return etagResp{err: err}, true
+		}
+		writeCacheValidators(cacheFile, etagFile, resp.Header.Get("Last-Modified"), weak)
+		return etagResp{cacheFile: etagFile}, true
+	default:
+		resp.Body.Close()
+		return etagResp{}, false
+	}
+}
+
+// Cache is the on-disk cache for downloaded apk files and APKINDEX files, configured with
+// WithCache. Its size can be bounded with WithCacheMaxSize and WithCacheMaxAge.
+type Cache struct {
 	dir     string
 	offline bool
+
+	// maxSize is the maximum total size of the cache in bytes, 0 for unlimited.
+	maxSize int64
+	// maxAge is the maximum time since an entry was last used, 0 for unlimited.
+	maxAge time.Duration
+
+	// indexTTL is how long indexes and keys are served without revalidating them.
+	indexTTL time.Duration
+	// forceRefresh ignores cached indexes and keys.
+	forceRefresh bool
+	// layout is how packages are stored, see WithCacheLayout.
+	layout CacheLayout
+
+	// gcMu serializes GC runs.
+	gcMu  sync.Mutex
+	stats cacheStats
+
+	// apk is the APK the cache was configured on, which Warm fetches with.
+	apk *APK
+}
+
+// CacheStats are counters for the cache since the APK was created.
+type CacheStats struct {
+	// Hits is the number of requests and packages served from the cache.
+	Hits int64
+	// Misses is the number of requests and packages that were not in the cache.
+	Misses int64
+	// BytesDownloaded is the number of bytes written to the cache from the network.
+	BytesDownloaded int64
+	// Evictions is the number of files removed by GC.
+	Evictions int64
+	// BytesEvicted is the number of bytes removed by GC.
+	BytesEvicted int64
+}
+
+type cacheStats struct {
+	hits, misses, bytesDownloaded, evictions, bytesEvicted atomic.Int64
+}
+
+// Cache returns the cache configured with WithCache, or nil if there is none.
+func (a *APK) Cache() *Cache {
+	return a.cache
+}
+
+// Dir returns the directory of the cache.
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// Stats returns the counters of the cache.
+func (c *Cache) Stats() CacheStats {
+	return CacheStats{
+		Hits:            c.stats.hits.Load(),
+		Misses:          c.stats.misses.Load(),
+		BytesDownloaded: c.stats.bytesDownloaded.Load(),
+		Evictions:       c.stats.evictions.Load(),
+		BytesEvicted:    c.stats.bytesEvicted.Load(),
+	}
+}
+
+// hit records a cache hit and marks the files as recently used, for LRU eviction.
+func (c *Cache) hit(files ...string) {
+	c.stats.hits.Add(1)
+	if c.apk != nil {
+		c.apk.metrics.cacheLookup(context.Background(), true)
+	}
+	now := time.Now()
+	for _, f := range files {
+		// Best effort; a read-only cache still works, it just evicts by write time.
+		_ = os.Chtimes(f, now, now)
+	}
+}
+
+func (c *Cache) miss(ctx context.Context) {
+	c.stats.misses.Add(1)
+	if c.apk != nil {
+		c.apk.metrics.cacheLookup(ctx, false)
+	}
+}
+
+// GC removes entries that have not been used for longer than the maximum age, then the
+// least recently used entries until the cache fits in the maximum size. It is a no-op if
+// neither limit is set. GC runs automatically after InstallPackages.
+//
+// Files in the file store that manifests of exploded packages refer to, see
+// CacheLayoutExploded, are not evicted on their own, but with the last of those manifests.
+func (c *Cache) GC(ctx context.Context) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "GC")
+	defer span.End()
+
+	if c.maxSize <= 0 && c.maxAge <= 0 {
+		return nil
+	}
+
+	c.gcMu.Lock()
+	defer c.gcMu.Unlock()
+
+	type file struct {
+		path    string
+		size    int64
+		lastUse time.Time
+	}
+	var (
+		files []file
+		total int64
+	)
+	if err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || isCacheLockFile(path) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, file{path: path, size: fi.Size(), lastUse: fi.ModTime()})
+		total += fi.Size()
+		return nil
+	}); err != nil {
+		return fmt.Errorf("walking cache %s: %w", c.dir, err)
+	}
+
+	// refs counts the manifests referring to each file of the file store, and trees lists
+	// the files each manifest refers to.
+	refs := map[string]int{}
+	trees := map[string][]string{}
+	sizes := map[string]int64{}
+	// packageDirs are the entries of packages, whose sections are evicted together.
+	packageDirs := map[string]bool{}
+	for _, f := range files {
+		sizes[f.path] = f.size
+		if strings.HasSuffix(f.path, ".ctl.tar.gz") {
+			packageDirs[filepath.Dir(f.path)] = true
+		}
+		if !strings.HasSuffix(f.path, treeSuffix) {
+			continue
+		}
+		treeFiles, err := c.treeFiles(f.path)
+		if err != nil {
+			// An unreadable manifest is not used, see loadTree, and pins nothing.
+			continue
+		}
+		trees[f.path] = treeFiles
+		for _, tf := range treeFiles {
+			refs[tf]++
+		}
+	}
+
+	// Files are evicted by entry: the sections of a package, the manifest of its files and
+	// its decompressed data go together, as do an index and the validators it is
+	// revalidated with, so that no partial entry is left behind. Temporary files, which are
+	// downloads in progress unless they are too old to be, are entries of their own.
+	type entry struct {
+		dir     string
+		files   []string
+		size    int64
+		lastUse time.Time
+		tmp     bool
+	}
+	var entries []*entry
+	byKey := map[string]*entry{}
+	for _, f := range files {
+		if refs[f.path] != 0 {
+			continue
+		}
+		key, dir := f.path, filepath.Dir(f.path)
+		tmp := strings.HasSuffix(f.path, ".tmp")
+		switch {
+		case tmp:
+		case packageDirs[dir]:
+			key = dir
+		case strings.HasSuffix(f.path, usedSuffix):
+			// the last use of a file of the file store, see Cache.used
+			key = strings.TrimSuffix(f.path, usedSuffix)
+		case strings.HasSuffix(f.path, ".validators"):
+			if v, ok := readCacheValidators(strings.TrimSuffix(f.path, ".validators")); ok {
+				key = v.cachedFile(strings.TrimSuffix(f.path, ".validators"))
+			}
+		}
+		e, ok := byKey[key]
+		if !ok {
+			e = &entry{dir: dir, tmp: tmp}
+			byKey[key] = e
+			entries = append(entries, e)
+		}
+		if key == f.path {
+			// the cached copy of an index, which its validators may have been added to
+			e.dir = dir
+		}
+		e.files = append(e.files, f.path)
+		e.size += f.size
+		if f.lastUse.After(e.lastUse) {
+			e.lastUse = f.lastUse
+		}
+	}
+
+	// Oldest first.
+	sort.Slice(entries, func(i, j int) bool { return entries[i].lastUse.Before(entries[j].lastUse) })
+
+	// Entries that another process is populating are skipped, see lockCacheEntry.
+	// unlocks maps entry directories to the func releasing their lock, or nil if busy.
+	unlocks := map[string]func(){}
+	defer func() {
+		for _, unlock := range unlocks {
+			if unlock != nil {
+				unlock()
+			}
+		}
+	}()
+
+	cutoff := time.Now().Add(-c.maxAge)
+	for _, e := range entries {
+		expired := c.maxAge > 0 && e.lastUse.Before(cutoff)
+		tooBig := c.maxSize > 0 && total > c.maxSize
+		if !expired && !tooBig {
+			break
+		}
+		if e.tmp && !expired {
+			continue
+		}
+		unlock, seen := unlocks[e.dir]
+		if !seen {
+			var (
+				ok  bool
+				err error
+			)
+			unlock, ok, err = tryLockCacheEntry(e.dir)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				unlock = nil
+			}
+			unlocks[e.dir] = unlock
+		}
+		if unlock == nil {
+			continue
+		}
+
+		for _, path := range e.files {
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("evicting %s: %w", path, err)
+			}
+			total -= sizes[path]
+			c.stats.evictions.Add(1)
+			c.stats.bytesEvicted.Add(sizes[path])
+
+			for _, f := range trees[path] {
+				if refs[f]--; refs[f] > 0 {
+					continue
+				}
+				if err := os.Remove(f); err != nil {
+					if errors.Is(err, fs.ErrNotExist) {
+						continue
+					}
+					return fmt.Errorf("evicting %s: %w", f, err)
+				}
+				total -= sizes[f]
+				c.stats.evictions.Add(1)
+				c.stats.bytesEvicted.Add(sizes[f])
+			}
+		}
+	}
+
+	return nil
 }
 
 // client return an http.Client that knows how to read from and write to the cache
 // key is in the implementation of https://pkg.go.dev/net/http#RoundTripper
-func (c cache) client(wrapped *http.Client, etagRequired bool) *http.Client {
+func (c *Cache) client(wrapped *http.Client, etagRequired bool) *http.Client {
 	return &http.Client{
 		Transport: &cacheTransport{
 			wrapped:      wrapped,
 			root:         c.dir,
 			offline:      c.offline,
 			etagRequired: etagRequired,
+			cache:        c,
 		},
 	}
 }
@@ -153,6 +615,7 @@ type cacheTransport struct {
 	root         string
 	offline      bool
 	etagRequired bool
+	cache        *Cache
 }
 
 func (t *cacheTransport) RoundTrip(request *http.Request) (*http.Response, error) {
@@ -173,10 +636,12 @@ func (t *cacheTransport) RoundTrip(request *http.Request) (*http.Response, error
 		f, err := os.Open(cacheFile)
 		if err != nil {
 			if t.offline {
-				return nil, fmt.Errorf("failed to read %q in offline cache: %w", cacheFile, err)
+				return nil, &OfflineError{Missing: []string{request.URL.Redacted()}}
 			}
+			t.cache.miss(request.Context())
 			return t.wrapped.Do(request)
 		}
+		t.cache.hit(cacheFile)
 
 		return &http.Response{
 			StatusCode: http.StatusOK,
@@ -186,13 +651,19 @@ func (t *cacheTransport) RoundTrip(request *http.Request) (*http.Response, error
 
 	if t.offline {
 		cacheDir := cacheDirFromFile(cacheFile)
-		des, err := os.ReadDir(cacheDir)
-		if err != nil {
+		all, err := os.ReadDir(cacheDir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
 			return nil, fmt.Errorf("listing %q for offline cache: %w", cacheDir, err)
 		}
+		des := make([]fs.DirEntry, 0, len(all))
+		for _, de := range all {
+			if name := de.Name(); !strings.HasSuffix(name, ".validators") && !strings.HasSuffix(name, ".tmp") {
+				des = append(des, de)
+			}
+		}
 
 		if len(des) == 0 {
-			return nil, fmt.Errorf("no offline cached entries for %s", cacheDir)
+			return nil, &OfflineError{Missing: []string{request.URL.Redacted()}}
 		}
 
 		newest, err := des[0].Info()
@@ -215,6 +686,7 @@ func (t *cacheTransport) RoundTrip(request *http.Request) (*http.Response, error
 		if err != nil {
 			return nil, err
 		}
+		t.cache.hit(f.Name())
 
 		return &http.Response{
 			StatusCode:    http.StatusOK,
@@ -247,14 +719,33 @@ func cacheFileFromEtag(cacheFile, etag string) string {
 	return filepath.Join(cacheDir, etag+ext)
 }
 
-func etagFromResponse(resp *http.Response) (string, bool) {
+// etagFromResponse returns the opaque tag of the ETag of resp, without its quotes, and
+// whether it is weak, so that the strong and weak forms of a tag, as servers that compress
+// on the fly send, name the same cached copy.
+func etagFromResponse(resp *http.Response) (string, bool, bool) {
 	remoteEtag, ok := resp.Header[http.CanonicalHeaderKey("etag")]
 	if !ok || len(remoteEtag) == 0 || remoteEtag[0] == "" {
-		return "", false
+		return "", false, false
 	}
-	// When we get etags, they appear to be quoted.
-	etag := strings.Trim(remoteEtag[0], `"`)
-	return etag, etag != ""
+	etag, weak := parseETag(remoteEtag[0])
+	return etag, weak, etag != ""
+}
+
+// parseETag returns the opaque tag of etag, "tag" or W/"tag" for a weak one, and whether
+// it is weak.
+func parseETag(etag string) (string, bool) {
+	etag = strings.TrimSpace(etag)
+	weak := strings.HasPrefix(etag, "W/")
+	etag = strings.TrimPrefix(etag, "W/")
+	return strings.Trim(etag, `"`), weak
+}
+
+// formatETag returns the entity tag of the opaque tag etag, as parseETag parsed it.
+func formatETag(etag string, weak bool) string {
+	if weak {
+		return `W/"` + etag + `"`
+	}
+	return `"` + etag + `"`
 }
 
 type cachePlacer func(*http.Response) (string, error)
@@ -267,7 +758,11 @@ func (t *cacheTransport) retrieveAndSaveFile(request *http.Request, cp cachePlac
 	if err != nil || resp.StatusCode != 200 {
 		return "", err
 	}
+	return t.saveResponse(resp, cp)
+}
 
+// saveResponse streams the body of resp into the cache, at the file cp returns.
+func (t *cacheTransport) saveResponse(resp *http.Response, cp cachePlacer) (string, error) {
 	// Determine the file we will caching stuff in based on the URL/response
 	cacheFile, err := cp(resp)
 	if err != nil {
@@ -287,9 +782,11 @@ func (t *cacheTransport) retrieveAndSaveFile(request *http.Request, cp cachePlac
 	if err := func() error {
 		defer tmp.Close()
 		defer resp.Body.Close()
-		if _, err := io.Copy(tmp, resp.Body); err != nil {
+		n, err := io.Copy(tmp, resp.Body)
+		if err != nil {
 			return fmt.Errorf("unable to write to cache file: %w", err)
 		}
+		t.cache.stats.bytesDownloaded.Add(n)
 		return nil
 	}(); err != nil {
 		return "", err
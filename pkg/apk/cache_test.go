@@ -0,0 +1,267 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheGC(t *testing.T) {
+	ctx := context.Background()
+
+	// setup creates files a, b, c and d of 100 bytes each, last used 4, 3, 2 and 1 hours ago.
+	setup := func(t *testing.T, options ...Option) *Cache {
+		dir := t.TempDir()
+		a, err := New(append([]Option{WithCache(dir, false)}, options...)...)
+		require.NoError(t, err)
+		for i, name := range []string{"a", "b", "c", "d"} {
+			p := filepath.Join(dir, "repo", "x86_64", name)
+			require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+			require.NoError(t, os.WriteFile(p, make([]byte, 100), 0o644))
+			used := time.Now().Add(-time.Duration(4-i) * time.Hour)
+			require.NoError(t, os.Chtimes(p, used, used))
+		}
+		return a.Cache()
+	}
+	remaining := func(t *testing.T, c *Cache) []string {
+		des, err := os.ReadDir(filepath.Join(c.Dir(), "repo", "x86_64"))
+		require.NoError(t, err)
+		var names []string
+		for _, de := range des {
+			names = append(names, de.Name())
+		}
+		return names
+	}
+
+	t.Run("unlimited", func(t *testing.T) {
+		c := setup(t)
+		require.NoError(t, c.GC(ctx))
+		require.Equal(t, []string{"a", "b", "c", "d"}, remaining(t, c))
+	})
+
+	t.Run("max size", func(t *testing.T) {
+		c := setup(t, WithCacheMaxSize(250))
+		// Using a makes it the most recently used entry.
+		c.hit(filepath.Join(c.Dir(), "repo", "x86_64", "a"))
+		require.NoError(t, c.GC(ctx))
+		require.Equal(t, []string{"a", "d"}, remaining(t, c))
+
+		stats := c.Stats()
+		require.Equal(t, int64(1), stats.Hits)
+		require.Equal(t, int64(2), stats.Evictions)
+		require.Equal(t, int64(200), stats.BytesEvicted)
+	})
+
+	t.Run("max age", func(t *testing.T) {
+		c := setup(t, WithCacheMaxAge(150*time.Minute))
+		require.NoError(t, c.GC(ctx))
+		require.Equal(t, []string{"c", "d"}, remaining(t, c))
+	})
+
+	t.Run("entries", func(t *testing.T) {
+		dir := t.TempDir()
+		a, err := New(WithCache(dir, false), WithCacheMaxAge(150*time.Minute))
+		require.NoError(t, err)
+		write := func(name string, age time.Duration, content string) string {
+			p := filepath.Join(dir, name)
+			require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+			require.NoError(t, os.WriteFile(p, []byte(content), 0o644))
+			used := time.Now().Add(-age)
+			require.NoError(t, os.Chtimes(p, used, used))
+			return p
+		}
+
+		// The sections of a package go together, kept by the most recently used one.
+		used := []string{
+			write("packages/sha1/aa/aaaa/aaaa.ctl.tar.gz", 4*time.Hour, ""),
+			write("packages/sha1/aa/aaaa/bbbb.dat.tar.gz", time.Hour, ""),
+		}
+		unused := []string{
+			write("packages/sha1/cc/cccc/cccc.ctl.tar.gz", 4*time.Hour, ""),
+			write("packages/sha1/cc/cccc/cccc.sig.tar.gz", 4*time.Hour, ""),
+			write("packages/sha1/cc/cccc/dddd.dat.tar.gz", 3*time.Hour, ""),
+		}
+		// So do an index and its validators, which are touched when it is revalidated.
+		used = append(used,
+			write("repo/x86_64/APKINDEX/etag.tar.gz", 4*time.Hour, ""),
+			write("repo/x86_64/APKINDEX.tar.gz.validators", time.Hour, `{"etag":"etag","file":"etag.tar.gz"}`),
+		)
+
+		require.NoError(t, a.Cache().GC(ctx))
+		for _, p := range used {
+			require.FileExists(t, p)
+		}
+		for _, p := range unused {
+			require.NoFileExists(t, p)
+		}
+		require.Equal(t, int64(3), a.Cache().Stats().Evictions)
+	})
+
+	t.Run("requires cache", func(t *testing.T) {
+		_, err := New(WithCacheMaxSize(1))
+		require.ErrorContains(t, err, "require a cache")
+	})
+}
+
+// testConditionalTransport serves testdata with a fixed etag and answers conditional
+// requests for it with 304 Not Modified. It records the requests it sees.
+type testConditionalTransport struct {
+	etag string
+	// weak sends the etag as a weak validator, which If-None-Match is compared weakly to.
+	weak bool
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func (t *testConditionalTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.requests = append(t.requests, request.Method+" "+request.Header.Get("If-None-Match"))
+	t.mu.Unlock()
+
+	header := http.Header{}
+	header.Set("ETag", formatETag(t.etag, t.weak))
+	header.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+	if inm := request.Header.Get("If-None-Match"); inm != "" && strings.Trim(strings.TrimPrefix(inm, "W/"), `"`) == t.etag {
+		return &http.Response{StatusCode: http.StatusNotModified, Header: header, Body: http.NoBody}, nil
+	}
+	resp, err := (&testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true}).RoundTrip(request)
+	if err == nil {
+		resp.Header = header
+	}
+	return resp, err
+}
+
+// testFetchCachedIndex fetches the test index through the cache of a, as a fresh process would.
+func testFetchCachedIndex(t *testing.T, a *APK, transport http.RoundTripper) {
+	want, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, indexFilename))
+	require.NoError(t, err)
+
+	globalEtagCache = &etagCache{}
+	client := a.Cache().client(&http.Client{Transport: transport}, true)
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, IndexURL(testAlpineRepos, testArch), nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+}
+
+func TestConditionalIndexFetch(t *testing.T) {
+	indexURL := IndexURL(testAlpineRepos, testArch)
+
+	cacheDir := t.TempDir()
+	a, err := New(WithCache(cacheDir, false))
+	require.NoError(t, err)
+
+	fetch := func(t *testing.T, transport http.RoundTripper) {
+		testFetchCachedIndex(t, a, transport)
+	}
+
+	transport := &testConditionalTransport{etag: "v1"}
+	fetch(t, transport)
+	require.Equal(t, []string{"HEAD ", "GET "}, transport.requests, "cold cache")
+
+	u, err := url.Parse(indexURL)
+	require.NoError(t, err)
+	cacheFile, err := cachePathFromURL(cacheDir, *u)
+	require.NoError(t, err)
+	v, ok := readCacheValidators(cacheFile)
+	require.True(t, ok)
+	require.Equal(t, "v1", v.ETag)
+	require.Equal(t, "Mon, 02 Jan 2006 15:04:05 GMT", v.LastModified)
+
+	transport = &testConditionalTransport{etag: "v1"}
+	fetch(t, transport)
+	require.Equal(t, []string{`GET "v1"`}, transport.requests, "unchanged index is revalidated")
+
+	transport = &testConditionalTransport{etag: "v2"}
+	fetch(t, transport)
+	require.Equal(t, []string{`GET "v1"`}, transport.requests, "changed index is fetched by the conditional request")
+	v, ok = readCacheValidators(cacheFile)
+	require.True(t, ok)
+	require.Equal(t, "v2", v.ETag)
+	_, err = os.Stat(filepath.Join(cacheDirFromFile(cacheFile), "v2.tar.gz"))
+	require.NoError(t, err)
+
+	// Weak etags are stored by their opaque tag, and sent back as weak validators.
+	transport = &testConditionalTransport{etag: "v3", weak: true}
+	fetch(t, transport)
+	require.Equal(t, []string{`GET "v2"`}, transport.requests)
+	v, ok = readCacheValidators(cacheFile)
+	require.True(t, ok)
+	require.Equal(t, "v3", v.ETag)
+	require.True(t, v.Weak)
+	_, err = os.Stat(filepath.Join(cacheDirFromFile(cacheFile), "v3.tar.gz"))
+	require.NoError(t, err)
+
+	transport = &testConditionalTransport{etag: "v3", weak: true}
+	fetch(t, transport)
+	require.Equal(t, []string{`GET W/"v3"`}, transport.requests, "unchanged index with a weak etag is revalidated")
+
+	// A HEAD with the weak form of the etag of a cached copy is served from the cache.
+	require.NoError(t, os.Remove(cacheValidatorsFile(cacheFile)))
+	transport = &testConditionalTransport{etag: "v3", weak: true}
+	fetch(t, transport)
+	require.Equal(t, []string{"HEAD "}, transport.requests)
+}
+
+func TestIndexTTL(t *testing.T) {
+	_, err := New(WithIndexTTL(time.Hour))
+	require.ErrorContains(t, err, "requires a cache")
+	_, err = New(WithCache(t.TempDir(), true), WithForceRefresh(true))
+	require.ErrorContains(t, err, "offline")
+
+	cacheDir := t.TempDir()
+	a, err := New(WithCache(cacheDir, false))
+	require.NoError(t, err)
+	transport := &testConditionalTransport{etag: "v1"}
+	testFetchCachedIndex(t, a, transport)
+	require.Len(t, transport.requests, 2)
+
+	// Within the TTL the server is not asked at all.
+	a, err = New(WithCache(cacheDir, false), WithIndexTTL(time.Hour))
+	require.NoError(t, err)
+	transport = &testConditionalTransport{etag: "v1"}
+	testFetchCachedIndex(t, a, transport)
+	require.Empty(t, transport.requests)
+
+	// Once it expires, the index is revalidated, which restarts the TTL.
+	a, err = New(WithCache(cacheDir, false), WithIndexTTL(time.Nanosecond))
+	require.NoError(t, err)
+	transport = &testConditionalTransport{etag: "v1"}
+	testFetchCachedIndex(t, a, transport)
+	require.Equal(t, []string{`GET "v1"`}, transport.requests)
+
+	// A forced refresh ignores the cached copy, even within the TTL.
+	a, err = New(WithCache(cacheDir, false), WithIndexTTL(time.Hour), WithForceRefresh(true))
+	require.NoError(t, err)
+	transport = &testConditionalTransport{etag: "v1"}
+	testFetchCachedIndex(t, a, transport)
+	require.Equal(t, []string{"HEAD ", "GET "}, transport.requests)
+}
@@ -0,0 +1,258 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// CacheLinkMode is how InstallPackages materializes the files of packages from the cache,
+// see WithCacheLinks.
+type CacheLinkMode int
+
+const (
+	// CacheLinksNone writes the content of every file.
+	CacheLinksNone CacheLinkMode = iota
+	// CacheLinksReflink reflinks files from the cache, so that they share their data with it
+	// until either of them changes, on filesystems that can, e.g. btrfs and xfs.
+	CacheLinksReflink
+	// CacheLinksHardlink hardlinks files from the cache. The files share their inode with
+	// the cache and with every install of the same file, with the same mode and owner:
+	// changing one of them in place changes them all. Installs do not change the mode,
+	// owner or times of linked files, so their times are those of the copy in the cache,
+	// not clamped to the build time. Files with extended attributes are written instead,
+	// as are files of ID mapped roots and files owned by others than root when not running
+	// as root, which cannot be given their owner in the cache.
+	CacheLinksHardlink
+)
+
+// Files of packages are stored, for CacheLinksReflink and CacheLayoutExploded, by the
+// checksum of their content:
+//
+//	<root>/files/sha1/<2 hex digits>/<40 hex digits>
+//
+// For CacheLinksHardlink, the mode and owner, which hardlinks share, are part of the name:
+//
+//	<root>/files/sha1/<2 hex digits>/<40 hex digits>-<mode>-<uid>-<gid>
+//
+// The last use of a file, for eviction, is the mtime of an empty file next to it with
+// usedSuffix, as the mtime of the file is shared with its hardlinks.
+const fileStoreDir = "files/sha1"
+
+// usedSuffix is the suffix of the file recording the last use of a file in the file store.
+const usedSuffix = ".used"
+
+// storedFilePath returns the path of the regular file header, whose content has checksum,
+// in the file store of the cache, for hardlinks or not.
+func (c *Cache) storedFilePath(checksum []byte, header *tar.Header, hardlink bool) string {
+	hexsum := hex.EncodeToString(checksum)
+	name := hexsum
+	if hardlink {
+		name = fmt.Sprintf("%s-%04o-%d-%d", hexsum, header.Mode&0o7777, header.Uid, header.Gid)
+	}
+	return filepath.Join(c.dir, fileStoreDir, hexsum[:2], name)
+}
+
+// installFromCache installs the regular file header, with content r and checksum, as a link
+// to its copy in the file store of the cache, see WithCacheLinks, adding it to the store
+// first, or again if the copy no longer matches. It reports whether it installed the file;
+// if not, r was not read. When the filesystem cannot link from the cache, the copy in the
+// store is copied, and so are the files after it.
+func (a *APK) installFromCache(header *tar.Header, r io.Reader, checksum []byte) (bool, error) {
+	cfs, ok := a.fs.(apkfs.CloneFS)
+	if !ok || a.cache == nil || a.cacheLinks == CacheLinksNone || a.cacheLinksFailed.Load() {
+		return false, nil
+	}
+
+	hardlink := a.cacheLinks == CacheLinksHardlink
+	if hardlink && !a.canHardlinkFromCache(header) {
+		return false, nil
+	}
+	path := a.cache.storedFilePath(checksum, header, hardlink)
+	stored, err := a.cache.checkStoredFile(path, header, checksum, hardlink)
+	if err != nil {
+		return false, err
+	}
+	if !stored {
+		if _, err := a.cache.storeFile(header, r, checksum, hardlink); err != nil {
+			return false, err
+		}
+	}
+	a.cache.used(path)
+
+	if hardlink {
+		err = cfs.LinkFile(path, header.Name)
+	} else {
+		err = cfs.CloneFile(path, header.Name, header.FileInfo().Mode())
+	}
+	if err == nil {
+		if hardlink {
+			a.setCacheLinked(header.Name, true)
+		}
+		return true, nil
+	}
+
+	// e.g. the cache is on another filesystem, or this one cannot reflink
+	a.cacheLinksFailed.Store(true)
+	a.log(context.Background()).Warnf("copying files rather than linking them from the cache: %v", err)
+	f, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("opening %s in the cache: %w", header.Name, err)
+	}
+	defer f.Close()
+	return true, a.createFile(header, f)
+}
+
+// canHardlinkFromCache returns whether the regular file header can be a hardlink to the
+// cache, which shares its inode: not if it has extended attributes, or its owner is mapped
+// for the root, see WithIDMap, or cannot be set on the copy in the cache.
+func (a *APK) canHardlinkFromCache(header *tar.Header) bool {
+	for k := range header.PAXRecords {
+		if strings.HasPrefix(k, xattrTarPAXRecordsPrefix) {
+			return false
+		}
+	}
+	if a.idMapped {
+		return false
+	}
+	return (header.Uid == 0 && header.Gid == 0) || os.Geteuid() == 0
+}
+
+// setCacheLinked records whether the installed file name is a hardlink to the cache.
+func (a *APK) setCacheLinked(name string, linked bool) {
+	a.extractMu.Lock()
+	defer a.extractMu.Unlock()
+	if !linked {
+		delete(a.cacheLinked, name)
+		return
+	}
+	if a.cacheLinked == nil {
+		a.cacheLinked = map[string]bool{}
+	}
+	a.cacheLinked[name] = true
+}
+
+// isCacheLinked returns whether the installed file name is a hardlink to the cache.
+func (a *APK) isCacheLinked(name string) bool {
+	a.extractMu.Lock()
+	defer a.extractMu.Unlock()
+	return a.cacheLinked[name]
+}
+
+// checkStoredFile returns whether the file store has the regular file header at path, with
+// checksum and, for hardlinks, the mode of header. A copy that was changed, e.g. in place
+// through one of its hardlinks, does not match, and is replaced by storeFile.
+func (c *Cache) checkStoredFile(path string, header *tar.Header, checksum []byte, hardlink bool) (bool, error) {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("checking %s in the cache: %w", header.Name, err)
+	}
+	const modeBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+	if !fi.Mode().IsRegular() || fi.Size() != header.Size {
+		return false, nil
+	}
+	if hardlink && fi.Mode()&modeBits != header.FileInfo().Mode()&modeBits {
+		return false, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("checking %s in the cache: %w", header.Name, err)
+	}
+	defer f.Close()
+	h := sha1.New() //nolint:gosec // this is what apk tools is using
+	if _, err := io.Copy(h, f); err != nil {
+		return false, fmt.Errorf("checking %s in the cache: %w", header.Name, err)
+	}
+	return bytes.Equal(h.Sum(nil), checksum), nil
+}
+
+// used records the use of the file at path in the file store, for LRU eviction. It is best
+// effort, as in Cache.hit.
+func (c *Cache) used(path string) {
+	now := time.Now()
+	if err := os.Chtimes(path+usedSuffix, now, now); errors.Is(err, fs.ErrNotExist) {
+		if f, err := os.Create(path + usedSuffix); err == nil {
+			f.Close()
+		}
+	}
+}
+
+// storeFile adds the regular file header, with content r, to the file store of the cache,
+// checking it against checksum, or computing it if it is nil, and returns it. For hardlinks
+// it gets the mode of header, which they share.
+func (c *Cache) storeFile(header *tar.Header, r io.Reader, checksum []byte, hardlink bool) ([]byte, error) {
+	dir := filepath.Join(c.dir, fileStoreDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create cache directory: %w", err)
+	}
+	// Written to a temporary file and renamed, like downloads, so that installs sharing the
+	// cache never see a partial file.
+	tmp, err := os.CreateTemp(dir, "*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create a temporary cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha1.New() //nolint:gosec // this is what apk tools is using
+	if _, err := io.CopyN(io.MultiWriter(tmp, h), r, header.Size); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("unable to write %s to the cache: %w", header.Name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("unable to write %s to the cache: %w", header.Name, err)
+	}
+	got := h.Sum(nil)
+	if checksum != nil && !bytes.Equal(checksum, got) {
+		return nil, fmt.Errorf("checksum mismatch: %s header was %x, computed %x", header.Name, checksum, got)
+	}
+
+	perm := os.FileMode(0o644)
+	if hardlink {
+		perm = header.FileInfo().Mode()
+		if header.Uid != 0 || header.Gid != 0 {
+			if err := os.Chown(tmp.Name(), header.Uid, header.Gid); err != nil {
+				return nil, fmt.Errorf("unable to set the owner of %s in the cache: %w", header.Name, err)
+			}
+		}
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return nil, fmt.Errorf("unable to write %s to the cache: %w", header.Name, err)
+	}
+	path := c.storedFilePath(got, header, hardlink)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create cache directory: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, fmt.Errorf("unable to populate cache: %w", err)
+	}
+	return got, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestCacheLinks(t *testing.T) {
+	ctx := context.Background()
+	epoch := time.Unix(1700000000, 0)
+
+	pkg := fakePackage(t, &Package{Name: "hello", Version: "1.0-r0"}, []testDirEntry{
+		{"usr", 0o755, true, nil, nil},
+		{"usr/bin", 0o755, true, nil, nil},
+		{"usr/bin/hello", 0o755, false, []byte("hello"), nil},
+	}).(*testPackage)
+	// keyed by its checksum in the cache
+	pkg.checksum = "Q1" + pkg.checksum
+
+	for _, tt := range []struct {
+		name string
+		mode CacheLinkMode
+	}{
+		{"none", CacheLinksNone},
+		{"reflink", CacheLinksReflink},
+		{"hardlink", CacheLinksHardlink},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheDir := t.TempDir()
+			install := func() string {
+				root := t.TempDir()
+				a, err := New(WithFS(apkfs.DirFS(root)), WithCache(cacheDir, false), WithCacheLinks(tt.mode), WithIgnoreMknodErrors(true))
+				require.NoError(t, err)
+				require.NoError(t, a.InitDB(ctx))
+				require.NoError(t, a.InstallPackages(ctx, &epoch, []InstallablePackage{pkg}))
+
+				name := filepath.Join(root, "usr/bin/hello")
+				b, err := os.ReadFile(name)
+				require.NoError(t, err)
+				require.Equal(t, "hello", string(b))
+				fi, err := os.Stat(name)
+				require.NoError(t, err)
+				require.Equal(t, os.FileMode(0o755), fi.Mode().Perm())
+				return name
+			}
+			first := install()
+
+			files, _ := filepath.Glob(filepath.Join(cacheDir, fileStoreDir, "*", "*"))
+			var stored []string
+			for _, f := range files {
+				if !strings.HasSuffix(f, usedSuffix) {
+					stored = append(stored, f)
+				}
+			}
+			if tt.mode == CacheLinksNone {
+				require.Empty(t, files)
+				return
+			}
+			require.Len(t, stored, 1)
+			b, err := os.ReadFile(stored[0])
+			require.NoError(t, err)
+			require.Equal(t, "hello", string(b))
+
+			// reusing the copy in the cache records its use next to it, not in its mtime
+			old := time.Now().Add(-time.Hour).Truncate(time.Second)
+			require.NoError(t, os.Chtimes(stored[0], old, old))
+			second := install()
+			fi, err := os.Stat(stored[0])
+			require.NoError(t, err)
+			require.True(t, fi.ModTime().Equal(old), fi.ModTime())
+			fi, err = os.Stat(stored[0] + usedSuffix)
+			require.NoError(t, err)
+			require.True(t, fi.ModTime().After(old))
+
+			if tt.mode == CacheLinksHardlink {
+				// the links keep the times of the cache, rather than being clamped
+				fi1, err := os.Stat(first)
+				require.NoError(t, err)
+				fi2, err := os.Stat(second)
+				require.NoError(t, err)
+				require.True(t, os.SameFile(fi1, fi2))
+				require.True(t, fi2.ModTime().Equal(old), fi2.ModTime())
+
+				// a copy changed through a link is replaced, not linked again
+				require.NoError(t, os.WriteFile(second, []byte("HELLO"), 0o755))
+				third := install()
+				fi3, err := os.Stat(third)
+				require.NoError(t, err)
+				require.False(t, os.SameFile(fi2, fi3))
+				require.NoError(t, os.Chmod(third, 0o700))
+				fi4, err := os.Stat(install())
+				require.NoError(t, err)
+				require.False(t, os.SameFile(fi3, fi4))
+			} else {
+				require.NoError(t, os.WriteFile(stored[0], []byte("HELLO"), 0o644))
+				install()
+			}
+			b, err = os.ReadFile(stored[0])
+			require.NoError(t, err)
+			require.Equal(t, "hello", string(b))
+		})
+	}
+
+	_, err := New(WithCacheLinks(CacheLinksHardlink))
+	require.Error(t, err)
+	_, err = New(WithCacheLinks(CacheLinkMode(42)))
+	require.Error(t, err)
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+// verifyDownload checks a package that was just fetched and expanded against the checksums
+// that describe it: the control section hash against the checksum in the index, and the data
+// section hash against the datahash in .PKGINFO, if there are. Unlike verifyPackage, it
+// trusts the hashes of exp, which ExpandApk computed from what was fetched.
+func (a *APK) verifyDownload(pkg InstallablePackage, exp *expandapk.APKExpanded) error {
+	if err := verifyControlHash(pkg, exp); err != nil {
+		return err
+	}
+	wantData, err := a.wantDatahash(pkg, exp, false)
+	if err != nil {
+		return err
+	}
+	if wantData != nil && !bytes.Equal(wantData, exp.PackageHash) {
+		return &ChecksumMismatchError{Name: pkg.PackageName() + " data section", Want: wantData, Got: exp.PackageHash}
+	}
+	return nil
+}
+
+// verifyControlHash checks the control section hash of exp against the checksum of pkg in the
+// index, if there is one.
+func verifyControlHash(pkg InstallablePackage, exp *expandapk.APKExpanded) error {
+	want := pkg.ChecksumString()
+	if want == "Q1" || !strings.HasPrefix(want, "Q1") {
+		return nil
+	}
+	wantSum, err := base64.StdEncoding.DecodeString(want[2:])
+	if err != nil {
+		return fmt.Errorf("decoding checksum %q for %s: %w", want, pkg.PackageName(), err)
+	}
+	if !bytes.Equal(wantSum, exp.ControlHash) {
+		return &ChecksumMismatchError{Name: pkg.PackageName() + " control section", Want: wantSum, Got: exp.ControlHash}
+	}
+	return nil
+}
+
+// wantDatahash returns the datahash in the .PKGINFO of exp, decoded. If there is none, or it
+// is empty, it returns an error if required is true, and nil otherwise.
+func (a *APK) wantDatahash(pkg InstallablePackage, exp *expandapk.APKExpanded, required bool) ([]byte, error) {
+	cf, err := os.Open(exp.ControlFile)
+	if err != nil {
+		return nil, fmt.Errorf("opening control file %q: %w", exp.ControlFile, err)
+	}
+	defer cf.Close()
+
+	values, err := a.controlValue(cf, "datahash")
+	if err != nil {
+		return nil, fmt.Errorf("reading datahash from control of %s: %w", pkg.PackageName(), err)
+	}
+	switch {
+	case len(values) > 1:
+		return nil, fmt.Errorf("datahash for %s: saw %d datahash values", pkg.PackageName(), len(values))
+	case len(values) == 0 || values[0] == "":
+		if required {
+			return nil, fmt.Errorf("datahash for %s: none in control", pkg.PackageName())
+		}
+		return nil, nil
+	}
+	wantData, err := hex.DecodeString(values[0])
+	if err != nil {
+		return nil, fmt.Errorf("decoding datahash %q for %s: %w", values[0], pkg.PackageName(), err)
+	}
+	return wantData, nil
+}
+
+// verifyPackage checks the expanded package against the checksums that describe it:
+//
+//   - the control section hash against the checksum in the index, if there is one
+//   - the data section hash against the datahash in .PKGINFO
+//   - every regular file in the data section against the checksum in its PAX headers,
+//     which must be present
+//
+// It is used when strict checksums are enabled.
+func (a *APK) verifyPackage(ctx context.Context, pkg InstallablePackage, exp *expandapk.APKExpanded) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "verifyPackage", trace.WithAttributes(attribute.String("package", pkg.PackageName())))
+	defer span.End()
+
+	if err := verifyControlHash(pkg, exp); err != nil {
+		return err
+	}
+	wantData, err := a.wantDatahash(pkg, exp, true)
+	if err != nil {
+		return err
+	}
+
+	// We cannot trust exp.PackageHash here, because for cached packages it is derived from
+	// the datahash itself, so hash the data section again.
+	df, err := os.Open(exp.PackageFile)
+	if err != nil {
+		return fmt.Errorf("opening package file %q: %w", exp.PackageFile, err)
+	}
+	defer df.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, df); err != nil {
+		return fmt.Errorf("hashing package file %q: %w", exp.PackageFile, err)
+	}
+	if got := h.Sum(nil); !bytes.Equal(wantData, got) {
+		return &ChecksumMismatchError{Name: pkg.PackageName() + " data section", Want: wantData, Got: got}
+	}
+
+	data, err := exp.PackageData()
+	if err != nil {
+		return fmt.Errorf("opening package data for %s: %w", pkg.PackageName(), err)
+	}
+	defer data.Close()
+
+	if err := expandapk.VerifyChecksums(ctx, data, true); err != nil {
+		return fmt.Errorf("verifying files of %s: %w", pkg.PackageName(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+func TestVerifyPackage(t *testing.T) {
+	ctx := context.Background()
+	a, err := New(WithStrictChecksums(true))
+	require.NoError(t, err)
+
+	repo := &RepositoryWithIndex{Repository: &Repository{URI: "testdata"}}
+
+	expand := func(t *testing.T) *expandapk.APKExpanded {
+		f, err := os.Open("testdata/hello-0.1.0-r0.apk")
+		require.NoError(t, err)
+		defer f.Close()
+		exp, err := expandapk.ExpandApk(ctx, f, "")
+		require.NoError(t, err)
+		t.Cleanup(func() { exp.Close() })
+		return exp
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		exp := expand(t)
+		pkg := NewRepositoryPackage(&Package{Name: "hello", Version: "0.1.0-r0", Checksum: exp.ControlHash}, repo)
+		require.NoError(t, a.verifyPackage(ctx, pkg, exp))
+
+		// Packages without an index checksum only get their data verified.
+		require.NoError(t, a.verifyPackage(ctx, NewRepositoryPackage(&Package{Name: "hello"}, repo), exp))
+	})
+
+	t.Run("control mismatch", func(t *testing.T) {
+		exp := expand(t)
+		pkg := NewRepositoryPackage(&Package{Name: "hello", Version: "0.1.0-r0", Checksum: make([]byte, len(exp.ControlHash))}, repo)
+		err := a.verifyPackage(ctx, pkg, exp)
+		var mismatch *ChecksumMismatchError
+		require.True(t, errors.As(err, &mismatch), "expected ChecksumMismatchError, got %v", err)
+		require.Equal(t, exp.ControlHash, mismatch.Got)
+	})
+
+	t.Run("data mismatch", func(t *testing.T) {
+		exp := expand(t)
+		f, err := os.OpenFile(exp.PackageFile, os.O_APPEND|os.O_WRONLY, 0)
+		require.NoError(t, err)
+		_, err = f.Write([]byte("garbage"))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		pkg := NewRepositoryPackage(&Package{Name: "hello", Version: "0.1.0-r0", Checksum: exp.ControlHash}, repo)
+		err = a.verifyPackage(ctx, pkg, exp)
+		var mismatch *ChecksumMismatchError
+		require.True(t, errors.As(err, &mismatch), "expected ChecksumMismatchError, got %v", err)
+		require.Equal(t, "hello data section", mismatch.Name)
+	})
+}
+
+func TestFetchAndExpandVerifies(t *testing.T) {
+	ctx := context.Background()
+	repo := &RepositoryWithIndex{Repository: &Repository{URI: "https://example.com/main/x86_64"}}
+
+	f, err := os.Open("testdata/hello-0.1.0-r0.apk")
+	require.NoError(t, err)
+	exp, err := expandapk.ExpandApk(ctx, f, "")
+	f.Close()
+	require.NoError(t, err)
+	checksum := exp.ControlHash
+	exp.Close()
+
+	newAPK := func(t *testing.T, options ...Option) (*APK, *testCountingTransport) {
+		a, err := New(options...)
+		require.NoError(t, err)
+		transport := &testCountingTransport{wrapped: &testLocalTransport{root: "testdata", basenameOnly: true}}
+		a.SetClient(&http.Client{Transport: transport})
+		return a, transport
+	}
+
+	t.Run("stale cache", func(t *testing.T) {
+		cacheDir := t.TempDir()
+		a, transport := newAPK(t, WithCache(cacheDir, false))
+		pkg := NewRepositoryPackage(&Package{Name: "hello", Version: "0.1.0-r0", Checksum: checksum}, repo)
+
+		// another package in the place of hello in the cache
+		u, err := url.Parse(pkg.URL())
+		require.NoError(t, err)
+		cached, err := cachePathFromURL(cacheDir, *u)
+		require.NoError(t, err)
+		require.NoError(t, os.MkdirAll(filepath.Dir(cached), 0o755))
+		stale, err := os.ReadFile("testdata/hello-wolfi-2.12.1-r0.apk")
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(cached, stale, 0o644))
+
+		exp, err := expandPackage(ctx, a, pkg)
+		require.NoError(t, err)
+		require.Equal(t, checksum, exp.ControlHash)
+		require.Equal(t, int64(1), transport.requests.Load())
+		require.NoFileExists(t, cached)
+	})
+
+	t.Run("corrupted mirror", func(t *testing.T) {
+		a, transport := newAPK(t)
+		pkg := NewRepositoryPackage(&Package{Name: "hello", Version: "0.1.0-r0", Checksum: make([]byte, len(checksum))}, repo)
+
+		_, err := expandPackage(ctx, a, pkg)
+		var mismatch *ChecksumMismatchError
+		require.True(t, errors.As(err, &mismatch), "expected ChecksumMismatchError, got %v", err)
+		require.Equal(t, int64(maxPackageFetches), transport.requests.Load())
+	})
+
+	t.Run("local", func(t *testing.T) {
+		a, _ := newAPK(t)
+		local := &RepositoryWithIndex{Repository: &Repository{URI: "testdata"}}
+		pkg := NewRepositoryPackage(&Package{Name: "hello", Version: "0.1.0-r0", Checksum: make([]byte, len(checksum))}, local)
+		_, err := expandPackage(ctx, a, pkg)
+		require.Error(t, err)
+
+		pkg = NewRepositoryPackage(&Package{Name: "hello", Version: "0.1.0-r0", Checksum: checksum}, local)
+		exp, err := expandPackage(ctx, a, pkg)
+		require.NoError(t, err)
+		require.NoError(t, exp.Close())
+	})
+}
@@ -0,0 +1,135 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"cmp"
+	"fmt"
+	"strings"
+)
+
+// ProviderStrategy is how the resolver chooses between different packages that provide the
+// same name, such as cmd:sh or so:libc.musl-x86_64.so.1.
+type ProviderStrategy int
+
+const (
+	// ProviderStrategyDefault prefers the provider with the highest provider priority, then
+	// the highest version, like apk-tools.
+	ProviderStrategyDefault ProviderStrategy = iota
+	// ProviderStrategySmallestClosure prefers the provider that adds the fewest bytes, then
+	// the fewest packages, with its dependencies that are not installed yet, then falls back
+	// to ProviderStrategyDefault. It is meant for size-optimized images. The closures are an
+	// estimate: the smallest provider is counted for every dependency.
+	ProviderStrategySmallestClosure
+)
+
+func (s ProviderStrategy) String() string {
+	switch s {
+	case ProviderStrategyDefault:
+		return "default"
+	case ProviderStrategySmallestClosure:
+		return "smallest-closure"
+	default:
+		return fmt.Sprintf("ProviderStrategy(%d)", int(s))
+	}
+}
+
+// WithResolverProviderStrategy sets how the resolver chooses between different packages that
+// provide the same name. Default is ProviderStrategyDefault.
+func WithResolverProviderStrategy(strategy ProviderStrategy) ResolverOption {
+	return func(p *PkgResolver) {
+		p.providerStrategy = strategy
+	}
+}
+
+// closure is the size of a package with the dependencies it adds, see
+// ProviderStrategySmallestClosure.
+type closure struct {
+	size     uint64
+	packages int
+}
+
+// closureComparer returns a comparison of candidates by the closures they add to existing,
+// smallest first. The closures are memoized, so the comparison is only valid as long as
+// existing does not change, e.g. for one call of comparePackages.
+func (p *PkgResolver) closureComparer(existing map[string]*RepositoryPackage) func(a, b *repositoryPackage) int {
+	var provided map[string]bool
+	closures := map[*RepositoryPackage]closure{}
+	closureOf := func(pkg *RepositoryPackage) closure {
+		if c, ok := closures[pkg]; ok {
+			return c
+		}
+		if provided == nil {
+			provided = make(map[string]bool, len(existing))
+			for _, pkg := range existing {
+				provided[pkg.Name] = true
+				for _, provide := range pkg.Provides {
+					provided[p.resolvePackageNameVersionPin(provide).name] = true
+				}
+			}
+		}
+		c := p.closureOf(pkg, provided)
+		closures[pkg] = c
+		return c
+	}
+	return func(a, b *repositoryPackage) int {
+		ca, cb := closureOf(a.RepositoryPackage), closureOf(b.RepositoryPackage)
+		if c := cmp.Compare(ca.size, cb.size); c != 0 {
+			return c
+		}
+		return cmp.Compare(ca.packages, cb.packages)
+	}
+}
+
+// closureOf returns the closure of pkg: pkg and its dependencies, transitively, that are not
+// in provided, counting the smallest provider of every dependency.
+func (p *PkgResolver) closureOf(pkg *RepositoryPackage, provided map[string]bool) closure {
+	var c closure
+	seen := map[string]bool{}
+	add := func(pkg *RepositoryPackage) {
+		seen[pkg.Name] = true
+		for _, provide := range pkg.Provides {
+			seen[p.resolvePackageNameVersionPin(provide).name] = true
+		}
+		c.size += pkg.InstalledSize
+		c.packages++
+	}
+	add(pkg)
+	queue := []*RepositoryPackage{pkg}
+	for len(queue) != 0 {
+		next := queue[0]
+		queue = queue[1:]
+		for _, dep := range next.Dependencies {
+			if strings.HasPrefix(dep, "!") {
+				continue
+			}
+			if name := p.resolvePackageNameVersionPin(dep).name; provided[name] || seen[name] {
+				continue
+			}
+			var smallest *RepositoryPackage
+			for _, provider := range p.Providers(dep) {
+				if smallest == nil || provider.Package.InstalledSize < smallest.InstalledSize {
+					smallest = provider.Package
+				}
+			}
+			if smallest == nil {
+				continue
+			}
+			add(smallest)
+			queue = append(queue, smallest)
+		}
+	}
+	return c
+}
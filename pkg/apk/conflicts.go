@@ -0,0 +1,244 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+// FileConflictPolicy is what InstallPackages does about file conflicts, see WithFileConflicts.
+type FileConflictPolicy int
+
+const (
+	// FileConflictsIgnore does not look for conflicts before installing. A conflicting file
+	// fails the install when it is reached, after the packages before it were installed.
+	FileConflictsIgnore FileConflictPolicy = iota
+	// FileConflictsWarn logs every conflict before installing, then installs anyway: the
+	// package installed last owns the conflicting files.
+	FileConflictsWarn
+	// FileConflictsFail fails the install with a FileConflictError listing every conflict
+	// before anything is installed.
+	FileConflictsFail
+)
+
+// FileConflict is a file that more than one package installs with different contents,
+// where none of them replaces the others, with their replaces and replaces_priority, and
+// they do not share an origin.
+type FileConflict struct {
+	Path string
+	// Packages are the names of the packages that install the file, in install order. An
+	// already installed package comes first.
+	Packages []string
+}
+
+// FileConflictError is returned by InstallPackages with FileConflictsFail when the packages
+// to install have file conflicts, with each other or with installed packages.
+type FileConflictError struct {
+	Conflicts []FileConflict
+}
+
+func (f *FileConflictError) Error() string {
+	conflicts := make([]string, len(f.Conflicts))
+	for i, c := range f.Conflicts {
+		conflicts[i] = fmt.Sprintf("%s (%s)", c.Path, strings.Join(c.Packages, ", "))
+	}
+	return fmt.Sprintf("%d file conflict(s): %s", len(f.Conflicts), strings.Join(conflicts, "; "))
+}
+
+// fileOwner is the package that installs a file, and the checksum of its contents if known.
+type fileOwner struct {
+	pkg      *Package
+	checksum []byte
+}
+
+// fileChecksum returns the checksum of a file from its header or, if the header has none,
+// by reading it from fsys. It returns nil if the file cannot be read.
+func fileChecksum(fsys fs.FS, header *tar.Header) ([]byte, error) {
+	checksum, err := checksumFromHeader(header)
+	if err != nil || checksum != nil {
+		return checksum, err
+	}
+	f, err := fsys.Open(header.Name)
+	if err != nil {
+		return nil, nil
+	}
+	defer f.Close()
+	w := sha1.New() //nolint:gosec // this is what apk tools is using
+	if _, err := io.Copy(w, f); err != nil {
+		return nil, fmt.Errorf("unable to calculate sum of %s: %w", header.Name, err)
+	}
+	return w.Sum(nil), nil
+}
+
+// fileReplacement is what happens when a package installs a file over one owned by another
+// package with different contents, see replacesFile.
+type fileReplacement int
+
+const (
+	// replaceConflict means neither package replaces the other, so the file conflicts.
+	replaceConflict fileReplacement = iota
+	// replaceOverwrite means the new package takes over the file.
+	replaceOverwrite
+	// replaceKeep means the owner replaces the new package and keeps the file.
+	replaceKeep
+)
+
+// replacesFile returns what happens when pkg installs a file over one owned by owner with
+// different contents, like apk-tools: packages of the same name or origin overwrite each
+// other's files. Otherwise the package whose replaces match the other package gets the file
+// and, if both match, the one with the higher replaces_priority, or pkg on a tie.
+func replacesFile(owner, pkg *Package) fileReplacement {
+	if owner.Name == pkg.Name || (pkg.Origin != "" && owner.Origin == pkg.Origin) {
+		return replaceOverwrite
+	}
+	ownerPriority, pkgPriority := int64(-1), int64(-1)
+	if replacesPackage(owner.Replaces, pkg) {
+		ownerPriority = int64(owner.ReplacesPriority)
+	}
+	if replacesPackage(pkg.Replaces, owner) {
+		pkgPriority = int64(pkg.ReplacesPriority)
+	}
+	switch {
+	case ownerPriority > pkgPriority:
+		return replaceKeep
+	case pkgPriority >= 0:
+		return replaceOverwrite
+	default:
+		return replaceConflict
+	}
+}
+
+// replacesPackage returns whether one of the replaces constraints, e.g. "foo" or "foo<2.0",
+// matches pkg.
+func replacesPackage(replaces []string, pkg *Package) bool {
+	for _, r := range replaces {
+		constraint := resolvePackageNameVersionPin(r)
+		if constraint.name != pkg.Name {
+			continue
+		}
+		if constraint.dep == versionAny {
+			return true
+		}
+		required, err := parseVersion(constraint.version)
+		if err != nil {
+			continue
+		}
+		if actual, err := parseVersion(pkg.Version); err == nil && constraint.dep.Satisfies(actual, required) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFileConflicts looks for file conflicts between the packages to install, in order, and
+// the installed packages, and handles them according to the file conflict policy.
+func (a *APK) checkFileConflicts(ctx context.Context, allpkgs []InstallablePackage, expanded []*expandapk.APKExpanded) error {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return fmt.Errorf("reading installed packages: %w", err)
+	}
+
+	owners := map[string]fileOwner{}
+	for _, ip := range installed {
+		for _, f := range ip.Files {
+			if f.Typeflag == tar.TypeDir {
+				continue
+			}
+			checksum, err := fileChecksum(a.fs, f)
+			if err != nil {
+				return err
+			}
+			owners[cleanInstalledPath(f.Name)] = fileOwner{pkg: &ip.Package, checksum: checksum}
+		}
+	}
+
+	var conflicts []FileConflict
+	byPath := map[string]int{}
+	for i, exp := range expanded {
+		isInstalled, err := a.isInstalledPackage(allpkgs[i].PackageName())
+		if err != nil {
+			return fmt.Errorf("error checking if package %s is installed: %w", allpkgs[i], err)
+		}
+		if isInstalled {
+			continue
+		}
+		pkg, err := packageInfo(exp)
+		if err != nil {
+			return fmt.Errorf("failed to read .PKGINFO for %s: %w", allpkgs[i], err)
+		}
+
+		var startedDataSection bool
+		for _, file := range exp.TarFS.Entries() {
+			// see installAPKFiles
+			if !startedDataSection && file.Header.Name[0] == '.' && !strings.Contains(file.Header.Name, "/") {
+				continue
+			}
+			startedDataSection = true
+
+			if file.Header.Typeflag != tar.TypeReg {
+				continue
+			}
+			name := file.Header.Name
+			if a.usrMerge {
+				name = usrMergePath(name)
+			}
+			name = cleanInstalledPath(name)
+			checksum, err := fileChecksum(exp.TarFS, &file.Header)
+			if err != nil {
+				return err
+			}
+
+			owner, ok := owners[name]
+			switch {
+			case !ok, owner.pkg.Name == pkg.Name:
+			case checksum != nil && bytes.Equal(checksum, owner.checksum):
+				// identical files, the first one is kept
+				continue
+			case replacesFile(owner.pkg, pkg) == replaceKeep:
+				continue
+			case replacesFile(owner.pkg, pkg) == replaceConflict:
+				j, ok := byPath[name]
+				if !ok {
+					j = len(conflicts)
+					byPath[name] = j
+					conflicts = append(conflicts, FileConflict{Path: name, Packages: []string{owner.pkg.Name}})
+				}
+				conflicts[j].Packages = append(conflicts[j].Packages, pkg.Name)
+			}
+			owners[name] = fileOwner{pkg: pkg, checksum: checksum}
+		}
+	}
+
+	if len(conflicts) == 0 {
+		return nil
+	}
+	if a.fileConflicts == FileConflictsFail {
+		return &FileConflictError{Conflicts: conflicts}
+	}
+	log := a.log(ctx)
+	for _, c := range conflicts {
+		log.Warnf("file conflict: %s is installed by %s, the last one wins", c.Path, strings.Join(c.Packages, ", "))
+	}
+	return nil
+}
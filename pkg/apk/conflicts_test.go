@@ -0,0 +1,136 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileConflicts(t *testing.T) {
+	install := func(t *testing.T, policy FileConflictPolicy, replaces []string, firstReplaces ...string) (*APK, error) {
+		_, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		a, err := New(WithFS(src), WithFileConflicts(policy))
+		require.NoError(t, err)
+
+		first := fakePackage(t, &Package{Name: "first", Version: "1.0-r0", Replaces: firstReplaces, ReplacesPriority: 10}, []testDirEntry{
+			{"etc", 0o755, true, nil, nil},
+			{"etc/conf", 0o644, false, []byte("first"), nil},
+			{"etc/same", 0o644, false, []byte("same"), nil},
+		})
+		second := fakePackage(t, &Package{Name: "second", Version: "1.0-r0", Replaces: replaces}, []testDirEntry{
+			{"etc", 0o755, true, nil, nil},
+			{"etc/conf", 0o644, false, []byte("second"), nil},
+			{"etc/same", 0o644, false, []byte("same"), nil},
+		})
+		return a, a.InstallPackages(context.Background(), nil, []InstallablePackage{first, second})
+	}
+
+	t.Run("fail", func(t *testing.T) {
+		a, err := install(t, FileConflictsFail, nil)
+		var conflictErr *FileConflictError
+		require.True(t, errors.As(err, &conflictErr), "expected a FileConflictError, got %v", err)
+		require.Equal(t, []FileConflict{{Path: "etc/conf", Packages: []string{"first", "second"}}}, conflictErr.Conflicts)
+
+		// nothing was installed
+		_, err = a.fs.Stat("etc/conf")
+		require.Error(t, err)
+	})
+
+	t.Run("warn", func(t *testing.T) {
+		a, err := install(t, FileConflictsWarn, nil)
+		require.NoError(t, err)
+
+		b, err := a.fs.ReadFile("etc/conf")
+		require.NoError(t, err)
+		require.Equal(t, "second", string(b))
+		checkDuplicateIDBEntries(t, a)
+	})
+
+	t.Run("replaces", func(t *testing.T) {
+		a, err := install(t, FileConflictsFail, []string{"first"})
+		require.NoError(t, err)
+
+		b, err := a.fs.ReadFile("etc/conf")
+		require.NoError(t, err)
+		require.Equal(t, "second", string(b))
+	})
+
+	t.Run("replaced", func(t *testing.T) {
+		// the package installed first replaces the one installed after it, which has no
+		// origin nor replaces of its own
+		for _, policy := range []FileConflictPolicy{FileConflictsFail, FileConflictsIgnore} {
+			a, err := install(t, policy, nil, "second")
+			require.NoError(t, err)
+
+			b, err := a.fs.ReadFile("etc/conf")
+			require.NoError(t, err)
+			require.Equal(t, "first", string(b))
+		}
+	})
+
+	t.Run("replaces version", func(t *testing.T) {
+		_, err := install(t, FileConflictsFail, []string{"first>=2.0"})
+		var conflictErr *FileConflictError
+		require.True(t, errors.As(err, &conflictErr), "expected a FileConflictError, got %v", err)
+
+		a, err := install(t, FileConflictsFail, []string{"first<2.0"})
+		require.NoError(t, err)
+		b, err := a.fs.ReadFile("etc/conf")
+		require.NoError(t, err)
+		require.Equal(t, "second", string(b))
+	})
+
+	t.Run("replaces priority", func(t *testing.T) {
+		// both replace each other, and the first one has the higher priority
+		a, err := install(t, FileConflictsFail, []string{"first"}, "second")
+		require.NoError(t, err)
+
+		b, err := a.fs.ReadFile("etc/conf")
+		require.NoError(t, err)
+		require.Equal(t, "first", string(b))
+		db, err := a.InstalledDB()
+		require.NoError(t, err)
+		first, ok := db.Package("first")
+		require.True(t, ok)
+		require.Equal(t, uint64(10), first.ReplacesPriority)
+	})
+}
+
+func TestReplacesFile(t *testing.T) {
+	foo := &Package{Name: "foo", Version: "1.0-r0", Origin: "foo"}
+	for _, tt := range []struct {
+		name         string
+		owner, pkg   *Package
+		want         fileReplacement
+		wantReversed fileReplacement
+	}{
+		{"unrelated", foo, &Package{Name: "bar", Version: "1.0-r0", Origin: "bar"}, replaceConflict, replaceConflict},
+		{"same origin", foo, &Package{Name: "foo-extra", Version: "1.0-r0", Origin: "foo"}, replaceOverwrite, replaceOverwrite},
+		{"replaces", foo, &Package{Name: "bar", Version: "1.0-r0", Replaces: []string{"foo"}}, replaceOverwrite, replaceKeep},
+		{"replaces version", foo, &Package{Name: "bar", Version: "1.0-r0", Replaces: []string{"foo>1.0-r0"}}, replaceConflict, replaceConflict},
+		{"priority tie", &Package{Name: "foo", Version: "1.0-r0", Replaces: []string{"bar"}}, &Package{Name: "bar", Version: "1.0-r0", Replaces: []string{"foo"}}, replaceOverwrite, replaceOverwrite},
+		{"priority", &Package{Name: "foo", Version: "1.0-r0", Replaces: []string{"bar"}, ReplacesPriority: 1}, &Package{Name: "bar", Version: "1.0-r0", Replaces: []string{"foo"}}, replaceKeep, replaceOverwrite},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, replacesFile(tt.owner, tt.pkg))
+			require.Equal(t, tt.wantReversed, replacesFile(tt.pkg, tt.owner))
+		})
+	}
+}
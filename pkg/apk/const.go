@@ -20,18 +20,28 @@ const (
 	indexFilename            = "APKINDEX.tar.gz"
 	// we are using these for fs.FS so should omit the leading /
 	reposFilePath     = "etc/apk/repositories"
+	reposDirPath      = "etc/apk/repositories.d"
 	archFilePath      = "etc/apk/arch"
 	keysDirPath       = "etc/apk/keys"
+	keysDropInDirPath = "etc/apk/keys.d"
 	worldFilePath     = "etc/apk/world"
 	installedFilePath = "lib/apk/db/installed"
 	scriptsFilePath   = "lib/apk/db/scripts.tar"
 	scriptsTarPerms   = 0o644
 	triggersFilePath  = "lib/apk/db/triggers"
+	ownershipFilePath = "lib/apk/db/ownership"
+	omittedFilePath   = "lib/apk/db/omitted"
+	scriptsExecDir    = "lib/apk/exec"
 	// which PAX record we use in the tar header
 	paxRecordsChecksumKey = "APK-TOOLS.checksum.SHA1"
 
+	// the keys of DiscoverKeys, by repository
+	discoveredKeysDirPath = "etc/apk/keys.discovered"
+
 	// for fetching the alpine keys
 	alpineReleasesURL = "https://alpinelinux.org/releases.json"
+	// for fetching the wolfi signing key
+	wolfiSigningKeyURL = "https://packages.wolfi.dev/os/wolfi-signing.rsa.pub"
 
 	xattrTarPAXRecordsPrefix = "SCHILY.xattr."
 )
@@ -0,0 +1,162 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+// PackageArtifact is a fetched package, for a PackageVerifier.
+type PackageArtifact struct {
+	Package InstallablePackage
+	// Open opens the package file, exactly as it was fetched.
+	Open func() (io.ReadCloser, error)
+	// Fetch fetches a file at an https:// URL or a local path, e.g. a signature published
+	// alongside the package, with the client, credentials and cache of the APK.
+	Fetch func(ctx context.Context, u string) ([]byte, error)
+}
+
+// PackageVerifier gates the install of a package on more than its checksums and index
+// signature, e.g. on a cosign signature or attestation published for it, by returning an
+// error. See WithPackageVerifier.
+//
+// NewCosignVerifier verifies cosign signatures made with a key; verifiers for keyless
+// signatures or for signatures in an OCI registry can be written with the sigstore
+// libraries.
+type PackageVerifier func(ctx context.Context, artifact *PackageArtifact) error
+
+// CosignSignatureSuffix is appended to the URL of a package for the URL of its cosign
+// signature, as written by cosign sign-blob --output-signature.
+const CosignSignatureSuffix = ".sig"
+
+// NewCosignVerifier returns a PackageVerifier that requires the package to have a cosign
+// signature, made with cosign sign-blob and one of the private keys of publicKeys, published
+// alongside it at its URL with CosignSignatureSuffix. The public keys are PEM encoded, as
+// written by cosign generate-key-pair; ECDSA, RSA and ed25519 keys are supported.
+func NewCosignVerifier(publicKeys ...[]byte) (PackageVerifier, error) {
+	if len(publicKeys) == 0 {
+		return nil, errors.New("no cosign public keys")
+	}
+	keys := make([]crypto.PublicKey, 0, len(publicKeys))
+	for i, data := range publicKeys {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("cosign public key %d: no PEM block found", i)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cosign public key %d: %w", i, err)
+		}
+		keys = append(keys, key)
+	}
+	needsData := false
+	for _, key := range keys {
+		if _, ok := key.(ed25519.PublicKey); ok {
+			needsData = true
+		}
+	}
+
+	return func(ctx context.Context, artifact *PackageArtifact) error {
+		ctx, span := otel.Tracer("go-apk").Start(ctx, "verifyCosignSignature", trace.WithAttributes(attribute.String("package", artifact.Package.PackageName())))
+		defer span.End()
+
+		sigURL := artifact.Package.URL() + CosignSignatureSuffix
+		b, err := artifact.Fetch(ctx, sigURL)
+		if err != nil {
+			return fmt.Errorf("fetching cosign signature %s: %w", redactURL(sigURL), err)
+		}
+		signature, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b)))
+		if err != nil {
+			return fmt.Errorf("decoding cosign signature %s: %w", redactURL(sigURL), err)
+		}
+
+		rc, err := artifact.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		// Only ed25519 signs the package itself rather than its digest, so the package is
+		// read into memory only for those keys.
+		h := sha256.New()
+		var data bytes.Buffer
+		var w io.Writer = h
+		if needsData {
+			w = io.MultiWriter(h, &data)
+		}
+		if _, err := io.Copy(w, rc); err != nil {
+			return fmt.Errorf("reading package file: %w", err)
+		}
+		digest := h.Sum(nil)
+
+		for _, key := range keys {
+			if verifyCosignSignature(key, data.Bytes(), digest, signature) {
+				return nil
+			}
+		}
+		return fmt.Errorf("cosign signature %s is not verified by any of the %d keys", redactURL(sigURL), len(keys))
+	}, nil
+}
+
+// verifyCosignSignature returns whether signature is of data, whose sha256 is digest, by
+// key, as cosign signs blobs.
+func verifyCosignSignature(key crypto.PublicKey, data, digest, signature []byte) bool {
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, digest, signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, signature) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, data, signature)
+	default:
+		return false
+	}
+}
+
+// verifyPackageArtifact runs the verifiers set with WithPackageVerifier on pkg, as expanded
+// in exp.
+func (a *APK) verifyPackageArtifact(ctx context.Context, pkg InstallablePackage, exp *expandapk.APKExpanded) error {
+	if len(a.packageVerifiers) == 0 {
+		return nil
+	}
+	artifact := &PackageArtifact{
+		Package: pkg,
+		Open:    exp.APK,
+		Fetch:   a.fetchFile,
+	}
+	for _, verify := range a.packageVerifiers {
+		if err := verify(ctx, artifact); err != nil {
+			return fmt.Errorf("verifying %s: %w", pkg.PackageName(), err)
+		}
+	}
+	return nil
+}
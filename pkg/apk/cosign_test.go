@@ -0,0 +1,118 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCosignVerifier(t *testing.T) {
+	ctx := context.Background()
+
+	newKey := func() (*ecdsa.PrivateKey, []byte) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		require.NoError(t, err)
+		return key, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	}
+	key, pubKey := newKey()
+	otherKey, _ := newKey()
+
+	// signs the package file as cosign sign-blob does
+	sign := func(pkg InstallablePackage, key *ecdsa.PrivateKey) {
+		b, err := os.ReadFile(pkg.URL())
+		require.NoError(t, err)
+		digest := sha256.Sum256(b)
+		sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(pkg.URL()+CosignSignatureSuffix, []byte(base64.StdEncoding.EncodeToString(sig)+"\n"), 0o644))
+	}
+	install := func(pkg InstallablePackage) error {
+		verifier, err := NewCosignVerifier(pubKey)
+		require.NoError(t, err)
+		_, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		a, err := New(WithFS(src), WithPackageVerifier(verifier))
+		require.NoError(t, err)
+		return a.InstallPackages(ctx, nil, []InstallablePackage{pkg})
+	}
+	newPackage := func() InstallablePackage {
+		return fakePackage(t, &Package{Name: "hello", Version: "1.0-r0"}, []testDirEntry{
+			{"etc", 0o755, true, nil, nil},
+			{"etc/hello", 0o644, false, []byte("hello"), nil},
+		})
+	}
+
+	pkg := newPackage()
+	sign(pkg, key)
+	require.NoError(t, install(pkg))
+
+	pkg = newPackage()
+	sign(pkg, otherKey)
+	require.ErrorContains(t, install(pkg), "is not verified by any of the 1 keys")
+
+	pkg = newPackage()
+	require.ErrorContains(t, install(pkg), "fetching cosign signature")
+
+	_, err := NewCosignVerifier([]byte("not a key"))
+	require.Error(t, err)
+}
+
+// BenchmarkCosignVerifier verifies a large package, which with an ECDSA key is hashed as it
+// is read rather than read into memory, as B/op shows.
+func BenchmarkCosignVerifier(b *testing.B) {
+	ctx := context.Background()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(b, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(b, err)
+	verifier, err := NewCosignVerifier(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	require.NoError(b, err)
+
+	data := make([]byte, 64<<20)
+	digest := sha256.Sum256(data)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	require.NoError(b, err)
+	artifact := &PackageArtifact{
+		Package: &testPackage{file: "toolchain-1.0-r0.apk", pkg: &Package{Name: "toolchain"}},
+		Open: func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		},
+		Fetch: func(context.Context, string) ([]byte, error) {
+			return []byte(base64.StdEncoding.EncodeToString(sig)), nil
+		},
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, verifier(ctx, artifact))
+	}
+}
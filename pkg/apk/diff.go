@@ -0,0 +1,281 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"sort"
+
+	"go.opentelemetry.io/otel"
+)
+
+// ChangeKind is how a resolved package changes, see PackageChange.
+type ChangeKind string
+
+const (
+	ChangeAdded      ChangeKind = "added"
+	ChangeRemoved    ChangeKind = "removed"
+	ChangeUpgraded   ChangeKind = "upgraded"
+	ChangeDowngraded ChangeKind = "downgraded"
+	// ChangeRebuilt is the same version of a package with a different checksum.
+	ChangeRebuilt ChangeKind = "rebuilt"
+	// ChangeModified is an installed file with a different checksum, mode or owner, see
+	// FileChange.
+	ChangeModified ChangeKind = "modified"
+)
+
+// PackageChange is a change of a resolved package between two resolutions.
+type PackageChange struct {
+	Name string
+	Kind ChangeKind
+	// OldVersion is empty when the package is added.
+	OldVersion string
+	// NewVersion is empty when the package is removed.
+	NewVersion string
+}
+
+func (c PackageChange) String() string {
+	switch c.Kind {
+	case ChangeAdded:
+		return fmt.Sprintf("%s: added %s", c.Name, c.NewVersion)
+	case ChangeRemoved:
+		return fmt.Sprintf("%s: removed %s", c.Name, c.OldVersion)
+	default:
+		return fmt.Sprintf("%s: %s %s -> %s", c.Name, c.Kind, c.OldVersion, c.NewVersion)
+	}
+}
+
+// Diff resolves world, as in the world file, against oldIndexes and newIndexes, and
+// returns how the resolved packages change, see DiffPackages. No changes means that a
+// rebuild with newIndexes installs the same packages as one with oldIndexes.
+func Diff(ctx context.Context, oldIndexes, newIndexes []NamedIndex, world []string, options ...ResolverOption) ([]PackageChange, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Diff")
+	defer span.End()
+
+	oldPkgs, _, err := NewPkgResolver(ctx, oldIndexes, options...).GetPackagesWithDependencies(ctx, world)
+	if err != nil {
+		return nil, fmt.Errorf("resolving against the old indexes: %w", err)
+	}
+	newPkgs, _, err := NewPkgResolver(ctx, newIndexes, options...).GetPackagesWithDependencies(ctx, world)
+	if err != nil {
+		return nil, fmt.Errorf("resolving against the new indexes: %w", err)
+	}
+	return DiffPackages(oldPkgs, newPkgs), nil
+}
+
+// DiffPackages returns how the packages change from oldPkgs to newPkgs, which are the
+// results of resolving, sorted by name. Packages with the same version and checksum do
+// not change.
+func DiffPackages(oldPkgs, newPkgs []*RepositoryPackage) []PackageChange {
+	unwrap := func(pkgs []*RepositoryPackage) []*Package {
+		unwrapped := make([]*Package, 0, len(pkgs))
+		for _, pkg := range pkgs {
+			unwrapped = append(unwrapped, pkg.Package)
+		}
+		return unwrapped
+	}
+	return diffPackages(unwrap(oldPkgs), unwrap(newPkgs))
+}
+
+func diffPackages(oldPkgs, newPkgs []*Package) []PackageChange {
+	byName := func(pkgs []*Package) map[string]*Package {
+		m := make(map[string]*Package, len(pkgs))
+		for _, pkg := range pkgs {
+			m[pkg.Name] = pkg
+		}
+		return m
+	}
+	oldByName, newByName := byName(oldPkgs), byName(newPkgs)
+
+	var changes []PackageChange
+	for name, oldPkg := range oldByName {
+		newPkg, ok := newByName[name]
+		if !ok {
+			changes = append(changes, PackageChange{Name: name, Kind: ChangeRemoved, OldVersion: oldPkg.Version})
+			continue
+		}
+		change := PackageChange{Name: name, OldVersion: oldPkg.Version, NewVersion: newPkg.Version}
+		switch {
+		case oldPkg.Version == newPkg.Version:
+			if bytes.Equal(oldPkg.Checksum, newPkg.Checksum) {
+				continue
+			}
+			change.Kind = ChangeRebuilt
+		case newerVersion(newPkg.Version, oldPkg.Version):
+			change.Kind = ChangeUpgraded
+		default:
+			change.Kind = ChangeDowngraded
+		}
+		changes = append(changes, change)
+	}
+	for name, newPkg := range newByName {
+		if _, ok := oldByName[name]; !ok {
+			changes = append(changes, PackageChange{Name: name, Kind: ChangeAdded, NewVersion: newPkg.Version})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+// FileChange is a change of an installed file between two installed databases.
+type FileChange struct {
+	// Path is the path of the file, without a leading slash.
+	Path string
+	// Kind is ChangeAdded, ChangeRemoved or ChangeModified.
+	Kind ChangeKind
+	// Package is the package that owns the file, in the new database unless it is removed.
+	Package string
+	// OldChecksum and NewChecksum are the checksums in the installed databases, like
+	// "Q1<base64 sha1>". OldChecksum is empty when the file is added, NewChecksum when it
+	// is removed.
+	OldChecksum string
+	NewChecksum string
+	// OldTarget and NewTarget are the targets of the file if it is a symlink, when they are
+	// known, see DiffRoots.
+	OldTarget string
+	NewTarget string
+}
+
+func (c FileChange) String() string {
+	return fmt.Sprintf("%s: %s (%s)", c.Path, c.Kind, c.Package)
+}
+
+// InstalledDiff is how an installation changes between two installed databases, see
+// DiffInstalled.
+type InstalledDiff struct {
+	// Packages are the changed packages, sorted by name.
+	Packages []PackageChange
+	// Files are the changed files, sorted by path. Directories are not compared.
+	Files []FileChange
+}
+
+// DiffInstalled returns how the installed packages and their files change from oldDB to
+// newDB. A file is modified when its checksum, mode, uid or gid changes, so files of a
+// rebuilt or upgraded package that are the same do not change.
+func DiffInstalled(oldDB, newDB *InstalledDB) *InstalledDiff {
+	noTarget := func(string) string { return "" }
+	return diffInstalled(oldDB, newDB, noTarget, noTarget)
+}
+
+// diffInstalled is DiffInstalled, with the targets of the symlinks of the old and the new
+// installation, or empty for files that are not, compared too.
+func diffInstalled(oldDB, newDB *InstalledDB, oldTarget, newTarget func(path string) string) *InstalledDiff {
+	unwrap := func(db *InstalledDB) []*Package {
+		pkgs := make([]*Package, 0, len(db.packages))
+		for _, pkg := range db.packages {
+			pkgs = append(pkgs, &pkg.Package)
+		}
+		return pkgs
+	}
+	diff := &InstalledDiff{Packages: diffPackages(unwrap(oldDB), unwrap(newDB))}
+
+	oldFiles, newFiles := oldDB.files(), newDB.files()
+	for path, oldFile := range oldFiles {
+		newFile, ok := newFiles[path]
+		if !ok {
+			diff.Files = append(diff.Files, FileChange{
+				Path:        path,
+				Kind:        ChangeRemoved,
+				Package:     oldFile.pkg,
+				OldChecksum: oldFile.checksum(),
+				OldTarget:   oldTarget(path),
+			})
+			continue
+		}
+		// symlinks do not always have checksums of their targets
+		oldLink, newLink := oldTarget(path), newTarget(path)
+		if oldFile.checksum() == newFile.checksum() && oldFile.hdr.Mode == newFile.hdr.Mode &&
+			oldFile.hdr.Uid == newFile.hdr.Uid && oldFile.hdr.Gid == newFile.hdr.Gid && oldLink == newLink {
+			continue
+		}
+		diff.Files = append(diff.Files, FileChange{
+			Path:        path,
+			Kind:        ChangeModified,
+			Package:     newFile.pkg,
+			OldChecksum: oldFile.checksum(),
+			NewChecksum: newFile.checksum(),
+			OldTarget:   oldLink,
+			NewTarget:   newLink,
+		})
+	}
+	for path, newFile := range newFiles {
+		if _, ok := oldFiles[path]; !ok {
+			diff.Files = append(diff.Files, FileChange{
+				Path:        path,
+				Kind:        ChangeAdded,
+				Package:     newFile.pkg,
+				NewChecksum: newFile.checksum(),
+				NewTarget:   newTarget(path),
+			})
+		}
+	}
+	sort.Slice(diff.Files, func(i, j int) bool {
+		return diff.Files[i].Path < diff.Files[j].Path
+	})
+	return diff
+}
+
+// DiffRoots loads the installed databases of oldRoot and newRoot, which are the roots of
+// installations, and returns how they change, see DiffInstalled. If the roots can read
+// symlinks, with a Readlink or ReadLink method as of a FullFS, a symlink is also modified
+// when its target changes.
+func DiffRoots(oldRoot, newRoot fs.FS) (*InstalledDiff, error) {
+	oldDB, err := LoadInstalledDB(oldRoot)
+	if err != nil {
+		return nil, fmt.Errorf("loading the old installed database: %w", err)
+	}
+	newDB, err := LoadInstalledDB(newRoot)
+	if err != nil {
+		return nil, fmt.Errorf("loading the new installed database: %w", err)
+	}
+	return diffInstalled(oldDB, newDB, symlinkTargets(oldRoot), symlinkTargets(newRoot)), nil
+}
+
+// symlinkTargets returns a func that returns the target of the symlink at a path in root, or
+// an empty string if it is not a symlink, or root cannot read symlinks.
+func symlinkTargets(root fs.FS) func(path string) string {
+	var readlink func(string) (string, error)
+	switch r := root.(type) {
+	case interface{ Readlink(string) (string, error) }:
+		readlink = r.Readlink
+	case interface{ ReadLink(string) (string, error) }:
+		readlink = r.ReadLink
+	default:
+		return func(string) string { return "" }
+	}
+	return func(path string) string {
+		target, err := readlink(path)
+		if err != nil {
+			return ""
+		}
+		return target
+	}
+}
+
+// newerVersion returns whether version a is newer than b. Invalid versions are compared as
+// strings.
+func newerVersion(a, b string) bool {
+	av, aerr := parseVersion(a)
+	bv, berr := parseVersion(b)
+	if aerr != nil || berr != nil {
+		return a > b
+	}
+	return compareVersions(av, bv) == greater
+}
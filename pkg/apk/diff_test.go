@@ -0,0 +1,171 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+	oldRepo := Repository{URI: "old"}
+	oldIndex := oldRepo.WithIndex(&APKIndex{Packages: []*Package{
+		{Name: "app", Version: "1.0-r0", Dependencies: []string{"libfoo", "libbar", "libold"}},
+		{Name: "libfoo", Version: "1.0-r0"},
+		{Name: "libbar", Version: "2.0-r0", Checksum: []byte{1}},
+		{Name: "libold", Version: "1.0-r0"},
+	}})
+	newRepo := Repository{URI: "new"}
+	newIndex := newRepo.WithIndex(&APKIndex{Packages: []*Package{
+		{Name: "app", Version: "1.0-r0", Dependencies: []string{"libfoo", "libbar", "libnew"}},
+		{Name: "libfoo", Version: "1.1-r0"},
+		{Name: "libbar", Version: "2.0-r0", Checksum: []byte{2}},
+		{Name: "libnew", Version: "1.0-r0"},
+	}})
+
+	changes, err := Diff(ctx,
+		testNamedRepositoryFromIndexes([]*RepositoryWithIndex{oldIndex}),
+		testNamedRepositoryFromIndexes([]*RepositoryWithIndex{newIndex}),
+		[]string{"app"})
+	require.NoError(t, err)
+	require.Equal(t, []PackageChange{
+		{Name: "libbar", Kind: ChangeRebuilt, OldVersion: "2.0-r0", NewVersion: "2.0-r0"},
+		{Name: "libfoo", Kind: ChangeUpgraded, OldVersion: "1.0-r0", NewVersion: "1.1-r0"},
+		{Name: "libnew", Kind: ChangeAdded, NewVersion: "1.0-r0"},
+		{Name: "libold", Kind: ChangeRemoved, OldVersion: "1.0-r0"},
+	}, changes)
+
+	// the same indexes make no changes
+	changes, err = Diff(ctx,
+		testNamedRepositoryFromIndexes([]*RepositoryWithIndex{oldIndex}),
+		testNamedRepositoryFromIndexes([]*RepositoryWithIndex{oldIndex}),
+		[]string{"app"})
+	require.NoError(t, err)
+	require.Empty(t, changes)
+
+	require.Equal(t, []PackageChange{
+		{Name: "libfoo", Kind: ChangeDowngraded, OldVersion: "1.10-r0", NewVersion: "1.9-r0"},
+	}, DiffPackages(
+		[]*RepositoryPackage{NewRepositoryPackage(&Package{Name: "libfoo", Version: "1.10-r0"}, nil)},
+		[]*RepositoryPackage{NewRepositoryPackage(&Package{Name: "libfoo", Version: "1.9-r0"}, nil)},
+	))
+	require.Equal(t, "libfoo: upgraded 1.0-r0 -> 1.1-r0", PackageChange{Name: "libfoo", Kind: ChangeUpgraded, OldVersion: "1.0-r0", NewVersion: "1.1-r0"}.String())
+}
+
+func TestDiffInstalled(t *testing.T) {
+	oldRoot := fstest.MapFS{installedFilePath: &fstest.MapFile{Data: []byte(`P:app
+V:1.0-r0
+C:Q1AQ==
+F:usr/bin
+R:app
+Z:Q1app1
+R:app-helper
+Z:Q1helper
+
+P:libfoo
+V:1.0-r0
+C:Q1Ag==
+F:usr/lib
+R:libfoo.so
+Z:Q1foo
+R:libfoo-old.so
+Z:Q1old
+
+P:libold
+V:1.0-r0
+C:Q1Aw==
+F:usr/lib
+R:libold.so
+Z:Q1libold
+
+`)}}
+	newRoot := fstest.MapFS{installedFilePath: &fstest.MapFile{Data: []byte(`P:app
+V:1.0-r0
+C:Q1BA==
+F:usr/bin
+R:app
+Z:Q1app2
+R:app-helper
+a:0:0:755
+Z:Q1helper
+
+P:libfoo
+V:1.1-r0
+C:Q1BQ==
+F:usr/lib
+R:libfoo.so
+Z:Q1foo
+
+P:libnew
+V:1.0-r0
+C:Q1Bg==
+F:usr/lib
+R:libnew.so
+Z:Q1libnew
+
+`)}}
+
+	diff, err := DiffRoots(oldRoot, newRoot)
+	require.NoError(t, err)
+	require.Equal(t, []PackageChange{
+		{Name: "app", Kind: ChangeRebuilt, OldVersion: "1.0-r0", NewVersion: "1.0-r0"},
+		{Name: "libfoo", Kind: ChangeUpgraded, OldVersion: "1.0-r0", NewVersion: "1.1-r0"},
+		{Name: "libnew", Kind: ChangeAdded, NewVersion: "1.0-r0"},
+		{Name: "libold", Kind: ChangeRemoved, OldVersion: "1.0-r0"},
+	}, diff.Packages)
+	require.Equal(t, []FileChange{
+		{Path: "usr/bin/app", Kind: ChangeModified, Package: "app", OldChecksum: "Q1app1", NewChecksum: "Q1app2"},
+		{Path: "usr/bin/app-helper", Kind: ChangeModified, Package: "app", OldChecksum: "Q1helper", NewChecksum: "Q1helper"},
+		{Path: "usr/lib/libfoo-old.so", Kind: ChangeRemoved, Package: "libfoo", OldChecksum: "Q1old"},
+		{Path: "usr/lib/libnew.so", Kind: ChangeAdded, Package: "libnew", NewChecksum: "Q1libnew"},
+		{Path: "usr/lib/libold.so", Kind: ChangeRemoved, Package: "libold", OldChecksum: "Q1libold"},
+	}, diff.Files)
+
+	// the same root makes no changes
+	diff, err = DiffRoots(oldRoot, oldRoot)
+	require.NoError(t, err)
+	require.Empty(t, diff.Packages)
+	require.Empty(t, diff.Files)
+
+	_, err = DiffRoots(oldRoot, fstest.MapFS{})
+	require.Error(t, err)
+
+	t.Run("symlinks", func(t *testing.T) {
+		db := []byte("P:app\nV:1.0-r0\nC:Q1AQ==\nF:usr/lib\nR:libapp.so\na:0:0:777\n\n")
+		root := func(target string) apkfs.FullFS {
+			fsys := apkfs.NewMemFS()
+			require.NoError(t, fsys.MkdirAll("lib/apk/db", 0o755))
+			require.NoError(t, fsys.WriteFile(installedFilePath, db, 0o644))
+			require.NoError(t, fsys.MkdirAll("usr/lib", 0o755))
+			require.NoError(t, fsys.Symlink(target, "usr/lib/libapp.so"))
+			return fsys
+		}
+		diff, err := DiffRoots(root("libapp.so.1"), root("libapp.so.1"))
+		require.NoError(t, err)
+		require.Empty(t, diff.Files)
+
+		diff, err = DiffRoots(root("libapp.so.1"), root("libapp.so.2"))
+		require.NoError(t, err)
+		require.Equal(t, []FileChange{
+			{Path: "usr/lib/libapp.so", Kind: ChangeModified, Package: "app", OldTarget: "libapp.so.1", NewTarget: "libapp.so.2"},
+		}, diff.Files)
+	})
+}
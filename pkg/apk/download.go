@@ -0,0 +1,62 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"cmp"
+
+	"golang.org/x/exp/slices"
+)
+
+// DownloadOrder is the order in which InstallPackages starts downloading packages, see
+// WithDownloadOrder. Packages are installed in the order they are given either way, each as
+// soon as it and the packages before it are downloaded.
+type DownloadOrder int
+
+const (
+	// DownloadInstallOrder downloads packages in the order they are installed, so that
+	// installing starts as early as possible, overlapping with the downloads of the later
+	// packages: it optimizes for latency.
+	DownloadInstallOrder DownloadOrder = iota
+	// DownloadLargestFirst downloads the largest packages first, by their size in the index,
+	// so that the longest downloads do not start last and go on alone while the other
+	// connections are idle: it optimizes for bandwidth, and for the total time when a few
+	// packages are much larger than the others. Packages of unknown size, which are not
+	// from an index, are downloaded last, in install order.
+	DownloadLargestFirst
+)
+
+// downloadSchedule returns the indexes of allpkgs in the order to download them, see
+// WithDownloadOrder.
+func (a *APK) downloadSchedule(allpkgs []InstallablePackage) []int {
+	order := make([]int, len(allpkgs))
+	for i := range order {
+		order[i] = i
+	}
+	if a.downloadOrder != DownloadLargestFirst {
+		return order
+	}
+
+	size := func(i int) uint64 {
+		if rp, ok := allpkgs[i].(*RepositoryPackage); ok {
+			return rp.Size
+		}
+		return 0
+	}
+	slices.SortStableFunc(order, func(i, j int) int {
+		return cmp.Compare(size(j), size(i))
+	})
+	return order
+}
@@ -0,0 +1,44 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadOrder(t *testing.T) {
+	repo := &RepositoryWithIndex{Repository: &Repository{URI: "https://packages.example.com/os"}}
+	pkgs := []InstallablePackage{
+		NewRepositoryPackage(&Package{Name: "small", Version: "1.0-r0", Size: 10}, repo),
+		fakePackage(t, &Package{Name: "local", Version: "1.0-r0"}, nil),
+		NewRepositoryPackage(&Package{Name: "large", Version: "1.0-r0", Size: 1000}, repo),
+		NewRepositoryPackage(&Package{Name: "medium", Version: "1.0-r0", Size: 100}, repo),
+		NewRepositoryPackage(&Package{Name: "medium2", Version: "1.0-r0", Size: 100}, repo),
+	}
+
+	a, err := New()
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1, 2, 3, 4}, a.downloadSchedule(pkgs))
+
+	a, err = New(WithDownloadOrder(DownloadLargestFirst))
+	require.NoError(t, err)
+	// ties and packages of unknown size in install order
+	require.Equal(t, []int{2, 3, 4, 0, 1}, a.downloadSchedule(pkgs))
+
+	_, err = New(WithDownloadOrder(DownloadOrder(42)))
+	require.Error(t, err)
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"strings"
+)
+
+// DuplicatePolicy is what to do when more than one repository has the same version of a
+// package that is resolved, but with different checksums. That usually means that one of
+// them was tampered with, or rebuilt without a new release.
+type DuplicatePolicy int
+
+const (
+	// DuplicateIgnore chooses one of the packages by the tie break, see TieBreak, silently.
+	DuplicateIgnore DuplicatePolicy = iota
+	// DuplicateWarn chooses one of the packages by the tie break, and reports the duplicate.
+	DuplicateWarn
+	// DuplicatePreferPriority chooses the package in the repository with the highest
+	// priority, whatever the tie break, and reports the duplicate.
+	DuplicatePreferPriority
+	// DuplicateError fails resolving with a *DuplicatePackageError.
+	DuplicateError
+)
+
+func (d DuplicatePolicy) String() string {
+	switch d {
+	case DuplicateIgnore:
+		return "ignore"
+	case DuplicateWarn:
+		return "warn"
+	case DuplicatePreferPriority:
+		return "prefer-priority"
+	case DuplicateError:
+		return "error"
+	default:
+		return fmt.Sprintf("DuplicatePolicy(%d)", int(d))
+	}
+}
+
+// WithResolverDuplicates sets what to do when more than one repository has the same version
+// of a resolved package with different checksums, see Duplicates. Default is
+// DuplicateIgnore.
+func WithResolverDuplicates(policy DuplicatePolicy) ResolverOption {
+	return func(p *PkgResolver) {
+		p.duplicates = policy
+	}
+}
+
+// DuplicatePackage is a resolved package that other repositories have in the same version,
+// with different checksums.
+type DuplicatePackage struct {
+	Package *RepositoryPackage
+	Others  []*RepositoryPackage
+}
+
+func (d DuplicatePackage) String() string {
+	repos := make([]string, 0, len(d.Others))
+	for _, other := range d.Others {
+		repos = append(repos, other.Repository().URI)
+	}
+	return fmt.Sprintf("%s from %s differs from the same version in %s", d.Package.Filename(), d.Package.Repository().URI, strings.Join(repos, ", "))
+}
+
+// DuplicatePackageError is returned by GetPackagesWithDependencies, along with the resolved
+// packages, with DuplicateError when a resolved package has duplicates.
+type DuplicatePackageError struct {
+	Duplicates []DuplicatePackage
+}
+
+func (e *DuplicatePackageError) Error() string {
+	dups := make([]string, 0, len(e.Duplicates))
+	for _, d := range e.Duplicates {
+		dups = append(dups, d.String())
+	}
+	return fmt.Sprintf("%d package(s) with different checksums in more than one repository: %s", len(e.Duplicates), strings.Join(dups, "; "))
+}
+
+// Duplicates returns the packages of pkgs, the result of resolving, that other repositories
+// have in the same version with different checksums, in the order of pkgs. Packages without
+// a checksum are not compared.
+func (p *PkgResolver) Duplicates(pkgs []*RepositoryPackage) []DuplicatePackage {
+	var dups []DuplicatePackage
+	for _, pkg := range pkgs {
+		if len(pkg.Checksum) == 0 {
+			continue
+		}
+		var others []*RepositoryPackage
+		for _, other := range p.nameMap[pkg.Name] {
+			if p.isDuplicate(pkg, other.RepositoryPackage) {
+				others = append(others, other.RepositoryPackage)
+			}
+		}
+		if len(others) != 0 {
+			dups = append(dups, DuplicatePackage{Package: pkg, Others: others})
+		}
+	}
+	return dups
+}
+
+// isDuplicate returns whether a and b are different packages of the same name and version
+// with different checksums.
+func (p *PkgResolver) isDuplicate(a, b *RepositoryPackage) bool {
+	return a != b && a.Name == b.Name && a.Version == b.Version &&
+		len(a.Checksum) != 0 && len(b.Checksum) != 0 && !bytes.Equal(a.Checksum, b.Checksum)
+}
+
+// checkDuplicates returns a *DuplicatePackageError if pkgs have duplicates and the policy of
+// the resolver is DuplicateError.
+func (p *PkgResolver) checkDuplicates(pkgs []*RepositoryPackage) error {
+	if p.duplicates != DuplicateError {
+		return nil
+	}
+	if dups := p.Duplicates(pkgs); len(dups) != 0 {
+		return &DuplicatePackageError{Duplicates: dups}
+	}
+	return nil
+}
+
+// breakDuplicateTie compares duplicates a and b by the priorities of their repositories,
+// with DuplicatePreferPriority, see breakTie.
+func (p *PkgResolver) breakDuplicateTie(a, b *repositoryPackage) int {
+	if p.duplicates != DuplicatePreferPriority || !p.isDuplicate(a.RepositoryPackage, b.RepositoryPackage) {
+		return 0
+	}
+	return cmp.Compare(p.priorities[repositoryURI(b)], p.priorities[repositoryURI(a)])
+}
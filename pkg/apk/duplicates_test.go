@@ -0,0 +1,71 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDuplicates(t *testing.T) {
+	ctx := context.Background()
+	first := Repository{URI: "https://first.example.com"}
+	second := Repository{URI: "https://second.example.com"}
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{
+		first.WithIndex(&APKIndex{Packages: []*Package{
+			{Name: "app", Version: "1.0-r0", Checksum: []byte("app"), Dependencies: []string{"libfoo"}},
+			{Name: "libfoo", Version: "1.0-r0", Checksum: []byte("good")},
+		}}),
+		second.WithIndex(&APKIndex{Packages: []*Package{
+			{Name: "app", Version: "1.0-r0", Checksum: []byte("app")},
+			{Name: "libfoo", Version: "1.0-r0", Checksum: []byte("evil")},
+		}}),
+	})
+	priorities := map[string]int{"https://second.example.com": 10}
+
+	resolver := NewPkgResolver(ctx, indexes)
+	pkgs, _, err := resolver.GetPackagesWithDependencies(ctx, []string{"app"})
+	require.NoError(t, err)
+	require.Equal(t, "good", string(pkgs[0].Checksum))
+
+	dups := resolver.Duplicates(pkgs)
+	require.Len(t, dups, 1)
+	require.Equal(t, pkgs[0], dups[0].Package)
+	require.Len(t, dups[0].Others, 1)
+	require.Equal(t, "evil", string(dups[0].Others[0].Checksum))
+	require.Equal(t, "libfoo-1.0-r0.apk from https://first.example.com differs from the same version in https://second.example.com", dups[0].String())
+
+	resolver = NewPkgResolver(ctx, indexes, WithResolverDuplicates(DuplicateError))
+	pkgs, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"app"})
+	var dupErr *DuplicatePackageError
+	require.True(t, errors.As(err, &dupErr), "expected a DuplicatePackageError, got %v", err)
+	require.Len(t, dupErr.Duplicates, 1)
+	require.Len(t, pkgs, 2)
+
+	// the tie break prefers the first repository, the policy the one with the higher priority
+	resolver = NewPkgResolver(ctx, indexes, WithResolverRepositoryPriorities(priorities), WithResolverTieBreak(TieBreakRepositoryOrder))
+	pkgs, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"app"})
+	require.NoError(t, err)
+	require.Equal(t, "good", string(pkgs[0].Checksum))
+
+	resolver = NewPkgResolver(ctx, indexes, WithResolverRepositoryPriorities(priorities), WithResolverTieBreak(TieBreakRepositoryOrder), WithResolverDuplicates(DuplicatePreferPriority))
+	pkgs, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"app"})
+	require.NoError(t, err)
+	require.Equal(t, "evil", string(pkgs[0].Checksum))
+	require.Equal(t, "https://first.example.com", pkgs[1].Repository().URI)
+}
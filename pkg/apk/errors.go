@@ -17,6 +17,7 @@ package apk
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
 type FileExistsError struct {
@@ -32,3 +33,26 @@ func (f FileExistsError) Is(target error) bool {
 	var targetError FileExistsError
 	return errors.As(target, &targetError)
 }
+
+// ChecksumMismatchError is returned when content does not match the checksum that describes it.
+type ChecksumMismatchError struct {
+	// Name describes the content that was checked.
+	Name string
+	Want []byte
+	Got  []byte
+}
+
+func (c *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch for %s: expected %x, computed %x", c.Name, c.Want, c.Got)
+}
+
+// OfflineError is returned when offline mode is enabled and something that is needed is not
+// in the local cache.
+type OfflineError struct {
+	// Missing lists the URLs that would have to be fetched from the network.
+	Missing []string
+}
+
+func (o *OfflineError) Error() string {
+	return fmt.Sprintf("offline mode: %d item(s) not in the local cache: %s", len(o.Missing), strings.Join(o.Missing, ", "))
+}
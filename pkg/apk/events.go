@@ -0,0 +1,96 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import "context"
+
+// Event is something that happened while resolving or installing packages, see
+// WithEventHandler. It is one of *RepositoryFetched, *PackageResolved, *DuplicateFound,
+// *PackageDownloaded, *PackageExtracted, *ScriptSkipped and *TransactionCommitted.
+type Event interface {
+	event()
+}
+
+// EventHandler handles the events of an APK. It is called synchronously, and concurrently
+// for the packages that are downloaded at once, so it should return quickly.
+type EventHandler func(ctx context.Context, event Event)
+
+// RepositoryFetched is when the index of a repository was fetched, from the network or the
+// cache.
+type RepositoryFetched struct {
+	// Source is the URL of the index.
+	Source string
+	// Packages is how many packages the index has for the architecture.
+	Packages int
+}
+
+// PackageResolved is when resolving the world selected a package.
+type PackageResolved struct {
+	Package *RepositoryPackage
+}
+
+// DuplicateFound is when resolving the world selected a package that other repositories
+// have in the same version with different checksums, see WithDuplicatePolicy.
+type DuplicateFound struct {
+	Package *RepositoryPackage
+	Others  []*RepositoryPackage
+}
+
+// PackageDownloaded is when a package was fetched and expanded, from the network or the
+// cache.
+type PackageDownloaded struct {
+	// Package is the name of the package.
+	Package string
+	URL     string
+	// Size is the size in bytes of the .apk file.
+	Size int64
+}
+
+// PackageExtracted is when the files of a package were installed.
+type PackageExtracted struct {
+	Package *Package
+	// Files is how many files, directories and links were installed.
+	Files int
+}
+
+// ScriptSkipped is when a script of a package, or a trigger, was not run, as scripts are
+// not run without WithRunScripts.
+type ScriptSkipped struct {
+	Package string
+	// Script is the name of the script in the control section, like .post-install.
+	Script string
+}
+
+// TransactionCommitted is when installing packages finished and the installed database was
+// updated.
+type TransactionCommitted struct {
+	// Packages are the packages that were installed, in install order.
+	Packages []*Package
+}
+
+func (*RepositoryFetched) event()    {}
+func (*PackageResolved) event()      {}
+func (*DuplicateFound) event()       {}
+func (*PackageDownloaded) event()    {}
+func (*PackageExtracted) event()     {}
+func (*ScriptSkipped) event()        {}
+func (*TransactionCommitted) event() {}
+
+// emit sends event to the event handlers of the APK.
+func (a *APK) emit(ctx context.Context, event Event) {
+	for _, handler := range a.eventHandlers {
+		handler(ctx, event)
+	}
+}
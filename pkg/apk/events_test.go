@@ -0,0 +1,60 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithEventHandler(t *testing.T) {
+	ctx := context.Background()
+	_, src, err := testGetTestAPK()
+	require.NoError(t, err)
+
+	var (
+		mu     sync.Mutex
+		events []Event
+	)
+	a, err := New(WithFS(src), WithEventHandler(func(_ context.Context, event Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}))
+	require.NoError(t, err)
+
+	pkg := fakePackageWithScripts(t, &Package{Name: "hello", Version: "1.0-r0"}, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+		{"etc/hello", 0o644, false, []byte("hello"), nil},
+	}, map[string][]byte{".post-install": []byte("post")}, nil)
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{pkg}))
+
+	require.Len(t, events, 4)
+	downloaded, ok := events[0].(*PackageDownloaded)
+	require.True(t, ok, "%T", events[0])
+	require.Equal(t, "hello", downloaded.Package)
+	extracted, ok := events[1].(*PackageExtracted)
+	require.True(t, ok, "%T", events[1])
+	require.Equal(t, "hello", extracted.Package.Name)
+	require.Equal(t, 2, extracted.Files)
+	require.Equal(t, &ScriptSkipped{Package: "hello", Script: ".post-install"}, events[2])
+	committed, ok := events[3].(*TransactionCommitted)
+	require.True(t, ok, "%T", events[3])
+	require.Len(t, committed.Packages, 1)
+	require.Equal(t, "hello", committed.Packages[0].Name)
+}
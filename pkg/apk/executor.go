@@ -14,8 +14,88 @@
 
 package apk
 
+import (
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
 // Executor provider of interface to execute commands, if used.
 // Will be used primarily to execute scripts.
 type Executor interface {
 	Execute(name string, arg ...string) error
 }
+
+// scriptEnv is the environment that executors run commands with.
+var scriptEnv = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
+
+// ProotExecutor returns an Executor that runs commands in root, the directory on disk of the
+// filesystem set by WithFS, with proot, which emulates chroot and root privileges without
+// needing either, e.g. for rootless builds. The proot binary must be in PATH.
+func ProotExecutor(root string) Executor {
+	return &prootExecutor{root: root}
+}
+
+type prootExecutor struct {
+	root string
+}
+
+func (e *prootExecutor) Execute(name string, arg ...string) error {
+	proot, err := exec.LookPath("proot")
+	if err != nil {
+		return fmt.Errorf("finding proot: %w", err)
+	}
+	// -0 makes the command see itself as root, -r and -w chroot it and change to /
+	cmd := exec.Command(proot, append([]string{"-0", "-r", e.root, "-w", "/", name}, arg...)...)
+	cmd.Env = scriptEnv
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, out)
+	}
+	return nil
+}
+
+// RecordedCommand is a command that a RecordingExecutor did not run.
+type RecordedCommand struct {
+	Name string
+	Args []string
+	// Script is the content of the file that Name is, if it could be read.
+	Script []byte
+}
+
+// RecordingExecutor is an Executor that runs nothing, but records the commands it would
+// run, e.g. to review the scripts of packages installed with WithRunScripts.
+type RecordingExecutor struct {
+	fsys fs.FS
+
+	mu       sync.Mutex
+	commands []RecordedCommand
+}
+
+// NewRecordingExecutor returns a RecordingExecutor that reads the scripts that it records
+// from fsys, normally the filesystem set by WithFS, or that does not if fsys is nil.
+func NewRecordingExecutor(fsys fs.FS) *RecordingExecutor {
+	return &RecordingExecutor{fsys: fsys}
+}
+
+func (e *RecordingExecutor) Execute(name string, arg ...string) error {
+	command := RecordedCommand{Name: name, Args: append([]string(nil), arg...)}
+	if e.fsys != nil {
+		if script, err := fs.ReadFile(e.fsys, strings.TrimPrefix(name, "/")); err == nil {
+			command.Script = script
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.commands = append(e.commands, command)
+	return nil
+}
+
+// Commands returns the commands that were recorded, in order.
+func (e *RecordingExecutor) Commands() []RecordedCommand {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]RecordedCommand(nil), e.commands...)
+}
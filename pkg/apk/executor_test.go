@@ -0,0 +1,63 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordingExecutor(t *testing.T) {
+	_, src, err := testGetTestAPK()
+	require.NoError(t, err)
+	e := NewRecordingExecutor(src)
+	a, err := New(WithFS(src), WithRunScripts(true), WithExecutor(e))
+	require.NoError(t, err)
+
+	pkg := fakePackageWithScripts(t, &Package{Name: "hello", Version: "1.0-r0"}, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+	}, map[string][]byte{
+		".pre-install":  []byte("exit 1"),
+		".post-install": []byte("post"),
+	}, nil)
+	require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{pkg}))
+
+	require.Equal(t, []RecordedCommand{
+		{Name: "/lib/apk/exec/hello-1.0-r0.pre-install", Args: []string{"1.0-r0"}, Script: []byte("exit 1")},
+		{Name: "/lib/apk/exec/hello-1.0-r0.post-install", Args: []string{"1.0-r0"}, Script: []byte("post")},
+	}, e.Commands())
+	_, err = src.Stat("lib/apk/exec/hello-1.0-r0.pre-install")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestProotExecutor(t *testing.T) {
+	if _, err := exec.LookPath("proot"); err != nil {
+		t.Skip("proot is not installed")
+	}
+	sh, err := exec.LookPath("sh")
+	require.NoError(t, err)
+
+	// the root is the host, with the script in it
+	dir := t.TempDir()
+	script := filepath.Join(dir, "script")
+	require.NoError(t, os.WriteFile(script, []byte("#!"+sh+"\n[ \"$(id -u)\" = 0 ] && [ \"$1\" = arg ]\n"), 0o755))
+	require.NoError(t, ProotExecutor("/").Execute(script, "arg"))
+	require.Error(t, ProotExecutor("/").Execute(script, "other"))
+}
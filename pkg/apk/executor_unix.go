@@ -0,0 +1,44 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package apk
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// ChrootExecutor returns an Executor that runs commands chrooted into root, the directory
+// on disk of the filesystem set by WithFS. Changing root requires CAP_SYS_CHROOT.
+func ChrootExecutor(root string) Executor {
+	return &chrootExecutor{root: root}
+}
+
+type chrootExecutor struct {
+	root string
+}
+
+func (e *chrootExecutor) Execute(name string, arg ...string) error {
+	cmd := exec.Command(name, arg...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: e.root}
+	cmd.Dir = "/"
+	cmd.Env = scriptEnv
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/chainguard-dev/go-apk/internal/tarfs"
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+// CacheLayout is how the cache configured with WithCache stores packages, see
+// WithCacheLayout.
+type CacheLayout int
+
+const (
+	// CacheLayoutTar stores the sections of the .apk of packages, and their data section
+	// decompressed into a tar, which installs read and index.
+	CacheLayoutTar CacheLayout = iota
+	// CacheLayoutExploded stores the sections of the .apk of packages, and their files
+	// extracted into the file store of the cache by their checksums, with a manifest of
+	// their headers, which installs read: packages are neither decompressed nor indexed
+	// again, and files in more than one package are stored once.
+	CacheLayoutExploded
+)
+
+// The manifest of an exploded package is stored in its entry, next to its data section,
+// as a JSON array of the headers of its data section:
+//
+//	<entry>/<64 hex digits>.tree.json
+const treeSuffix = ".tree.json"
+
+// explode extracts the package data of exp, cached in cacheDir, into the file store of the
+// cache and writes its manifest, then removes its tar, see CacheLayoutExploded. exp serves
+// the files from the file store from then on.
+func (c *Cache) explode(exp *expandapk.APKExpanded, cacheDir string) error {
+	data, err := exp.PackageData()
+	if err != nil {
+		return fmt.Errorf("opening package data %q: %w", exp.PackageFile, err)
+	}
+	defer data.Close()
+
+	headers := []tar.Header{}
+	tr := tar.NewReader(data)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading package data %q: %w", exp.PackageFile, err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			checksum, err := checksumFromHeader(hdr)
+			if err != nil {
+				return err
+			}
+			stored := false
+			if checksum != nil {
+				_, err := os.Stat(c.storedFilePath(checksum, hdr, false))
+				stored = err == nil
+			}
+			if !stored {
+				if checksum, err = c.storeFile(hdr, tr, checksum, false); err != nil {
+					return err
+				}
+			}
+			// Files without a checksum get one, to find them in the file store.
+			records := make(map[string]string, len(hdr.PAXRecords)+1)
+			for k, v := range hdr.PAXRecords {
+				records[k] = v
+			}
+			records[paxRecordsChecksumKey] = hex.EncodeToString(checksum)
+			hdr.PAXRecords = records
+		}
+		headers = append(headers, *hdr)
+	}
+
+	b, err := json.Marshal(headers)
+	if err != nil {
+		return fmt.Errorf("encoding manifest of %q: %w", exp.PackageFile, err)
+	}
+	tree := filepath.Join(cacheDir, hex.EncodeToString(exp.PackageHash)+treeSuffix)
+	tmp, err := os.CreateTemp(cacheDir, "*.tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create a temporary cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write manifest %s: %w", tree, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write manifest %s: %w", tree, err)
+	}
+	if err := os.Rename(tmp.Name(), tree); err != nil {
+		return fmt.Errorf("unable to populate cache: %w", err)
+	}
+
+	if err := os.Remove(exp.TarFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("removing %s: %w", exp.TarFile, err)
+	}
+	c.useTree(exp, tree, headers)
+	return nil
+}
+
+// loadTree makes exp serve its files from the file store of the cache, by the manifest
+// tree, if the manifest and all of the files are there.
+func (c *Cache) loadTree(exp *expandapk.APKExpanded, tree string) error {
+	b, err := os.ReadFile(tree)
+	if err != nil {
+		return err
+	}
+	var headers []tar.Header
+	if err := json.Unmarshal(b, &headers); err != nil {
+		return fmt.Errorf("decoding manifest %s: %w", tree, err)
+	}
+	for i := range headers {
+		hdr := &headers[i]
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		checksum, err := checksumFromHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if checksum == nil {
+			return fmt.Errorf("manifest %s: %s has no checksum", tree, hdr.Name)
+		}
+		if _, err := os.Stat(c.storedFilePath(checksum, hdr, false)); err != nil {
+			return err
+		}
+	}
+	c.useTree(exp, tree, headers)
+	return nil
+}
+
+func (c *Cache) useTree(exp *expandapk.APKExpanded, tree string, headers []tar.Header) {
+	exp.TreeFile = tree
+	exp.TarFS = tarfs.NewFromEntries(headers, func(hdr *tar.Header) (io.ReadSeekCloser, error) {
+		checksum, err := checksumFromHeader(hdr)
+		if err != nil {
+			return nil, err
+		}
+		if checksum == nil {
+			return nil, fmt.Errorf("%s has no checksum", hdr.Name)
+		}
+		return os.Open(c.storedFilePath(checksum, hdr, false))
+	})
+}
+
+// treeFiles returns the files in the file store of the cache that the manifest tree
+// refers to.
+func (c *Cache) treeFiles(tree string) ([]string, error) {
+	b, err := os.ReadFile(tree)
+	if err != nil {
+		return nil, err
+	}
+	var headers []tar.Header
+	if err := json.Unmarshal(b, &headers); err != nil {
+		return nil, fmt.Errorf("decoding manifest %s: %w", tree, err)
+	}
+	var files []string
+	for i := range headers {
+		hdr := &headers[i]
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if checksum, err := checksumFromHeader(hdr); err == nil && checksum != nil {
+			files = append(files, c.storedFilePath(checksum, hdr, false))
+		}
+	}
+	return files, nil
+}
+
+// treeEntries reads the entries of a package exploded in the cache, and their content, see
+// CacheLayoutExploded, like a tar.Reader reads them from its tar.
+type treeEntries struct {
+	fsys    *tarfs.FS
+	entries []*tarfs.Entry
+	cur     *tarfs.File
+}
+
+func newTreeEntries(fsys *tarfs.FS) *treeEntries {
+	return &treeEntries{fsys: fsys, entries: fsys.Entries()}
+}
+
+// Next opens the next entry.
+func (t *treeEntries) Next() (*tar.Header, error) {
+	if err := t.Close(); err != nil {
+		return nil, err
+	}
+	if len(t.entries) == 0 {
+		return nil, io.EOF
+	}
+	e := t.entries[0]
+	t.entries = t.entries[1:]
+	hdr := e.Header
+	// the header is the caller's to change, as with a tar.Reader
+	if hdr.PAXRecords != nil {
+		records := make(map[string]string, len(hdr.PAXRecords))
+		for k, v := range hdr.PAXRecords {
+			records[k] = v
+		}
+		hdr.PAXRecords = records
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		f, err := t.fsys.OpenEntry(e)
+		if err != nil {
+			return nil, fmt.Errorf("opening %s: %w", hdr.Name, err)
+		}
+		t.cur = f
+	}
+	return &hdr, nil
+}
+
+// Read reads the content of the current entry.
+func (t *treeEntries) Read(p []byte) (int, error) {
+	if t.cur == nil {
+		return 0, io.EOF
+	}
+	return t.cur.Read(p)
+}
+
+// Close closes the current entry.
+func (t *treeEntries) Close() error {
+	if t.cur == nil {
+		return nil
+	}
+	err := t.cur.Close()
+	t.cur = nil
+	return err
+}
@@ -0,0 +1,145 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestCacheLayoutExploded(t *testing.T) {
+	ctx := context.Background()
+
+	f, err := os.Open("testdata/hello-0.1.0-r0.apk")
+	require.NoError(t, err)
+	exp, err := expandapk.ExpandApk(ctx, f, "")
+	require.NoError(t, err)
+	f.Close()
+	checksum := exp.ControlHash
+	exp.Close()
+
+	repo := &RepositoryWithIndex{Repository: &Repository{URI: "https://dl-cdn.alpinelinux.org/alpine/v3.16/main/x86_64"}}
+	pkg := NewRepositoryPackage(&Package{Name: "hello", Version: "0.1.0-r0", Checksum: checksum}, repo)
+
+	// load expands pkg through the cache in cacheDir, downloading it if it is not there.
+	load := func(t *testing.T, cacheDir string, options ...Option) (*APK, *expandapk.APKExpanded) {
+		a, err := New(append([]Option{WithFS(apkfs.NewMemFS()), WithCache(cacheDir, false)}, options...)...)
+		require.NoError(t, err)
+		a.SetClient(&http.Client{Transport: &testLocalTransport{root: "testdata", basenameOnly: true}})
+		exp, err := expandPackage(ctx, a, pkg)
+		require.NoError(t, err)
+		b, err := fs.ReadFile(exp.TarFS, "hello")
+		require.NoError(t, err)
+		require.Contains(t, string(b), "hello")
+		return a, exp
+	}
+	glob := func(t *testing.T, cacheDir, pattern string) []string {
+		matches, err := filepath.Glob(filepath.Join(cacheDir, pattern))
+		require.NoError(t, err)
+		return matches
+	}
+	const entry = "packages/*/*/*/"
+
+	t.Run("expand", func(t *testing.T) {
+		cacheDir := t.TempDir()
+		_, exp := load(t, cacheDir, WithCacheLayout(CacheLayoutExploded))
+		require.NotEmpty(t, exp.TreeFile)
+
+		require.Len(t, glob(t, cacheDir, entry+"*"+treeSuffix), 1)
+		require.Empty(t, glob(t, cacheDir, entry+"*.dat.tar"))
+		require.Len(t, glob(t, cacheDir, fileStoreDir+"/*/*"), 1)
+
+		// Loading the package again reads the tree, not the data section.
+		require.NoError(t, os.WriteFile(exp.PackageFile, []byte("not gzip"), 0o644))
+		_, exp = load(t, cacheDir, WithCacheLayout(CacheLayoutExploded))
+		require.NotEmpty(t, exp.TreeFile)
+	})
+
+	t.Run("install", func(t *testing.T) {
+		a, _ := load(t, t.TempDir(), WithCacheLayout(CacheLayoutExploded))
+		require.NoError(t, a.InitDB(ctx))
+		require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{pkg}))
+
+		b, err := fs.ReadFile(a.fs, "hello")
+		require.NoError(t, err)
+		require.Contains(t, string(b), "hello")
+		fi, err := a.fs.Stat("hello")
+		require.NoError(t, err)
+		require.Equal(t, fs.FileMode(0o755), fi.Mode().Perm())
+	})
+
+	t.Run("from tar layout", func(t *testing.T) {
+		cacheDir := t.TempDir()
+		_, exp := load(t, cacheDir)
+		require.Empty(t, exp.TreeFile)
+		require.Empty(t, glob(t, cacheDir, entry+"*"+treeSuffix))
+		require.Len(t, glob(t, cacheDir, entry+"*.dat.tar"), 1)
+
+		_, exp = load(t, cacheDir, WithCacheLayout(CacheLayoutExploded))
+		require.NotEmpty(t, exp.TreeFile)
+		require.Len(t, glob(t, cacheDir, entry+"*"+treeSuffix), 1)
+		require.Empty(t, glob(t, cacheDir, entry+"*.dat.tar"))
+	})
+
+	t.Run("gc", func(t *testing.T) {
+		cacheDir := t.TempDir()
+		_, exp := load(t, cacheDir, WithCacheLayout(CacheLayoutExploded))
+		stored := glob(t, cacheDir, fileStoreDir+"/*/*")
+		require.Len(t, stored, 1)
+
+		// The stored file is older than the tree referring to it, which keeps it.
+		old := time.Now().Add(-2 * time.Hour)
+		require.NoError(t, os.Chtimes(stored[0], old, old))
+		a, err := New(WithCache(cacheDir, false), WithCacheMaxAge(time.Hour))
+		require.NoError(t, err)
+		require.NoError(t, a.Cache().GC(ctx))
+		require.FileExists(t, exp.TreeFile)
+		require.FileExists(t, stored[0])
+
+		// Evicting the package evicts its tree with its sections, and the files only the
+		// tree refers to.
+		sections := glob(t, filepath.Dir(exp.TreeFile), "*.*")
+		require.Len(t, sections, 3)
+		older := time.Now().Add(-3 * time.Hour)
+		for _, f := range sections {
+			require.NoError(t, os.Chtimes(f, older, older))
+		}
+		require.NoError(t, a.Cache().GC(ctx))
+		for _, f := range sections {
+			require.NoFileExists(t, f)
+		}
+		require.NoFileExists(t, stored[0])
+		require.Equal(t, int64(4), a.Cache().Stats().Evictions)
+
+		// Without its files, the package is exploded again.
+		_, exp = load(t, cacheDir, WithCacheLayout(CacheLayoutExploded))
+		require.FileExists(t, exp.TreeFile)
+	})
+
+	_, err = New(WithCacheLayout(CacheLayoutExploded))
+	require.ErrorContains(t, err, "requires a cache")
+	_, err = New(WithCacheLayout(CacheLayout(42)))
+	require.Error(t, err)
+}
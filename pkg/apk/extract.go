@@ -0,0 +1,74 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sync"
+)
+
+// ExtractTarget receives the files of packages as they are extracted, see
+// WithExtractTarget. The default target is the filesystem of the APK; StreamFS writes them
+// to a tar, and ExtractRecorder only records them.
+type ExtractTarget interface {
+	// WriteEntry writes the entry hdr of pkg, with its content r, which is empty but for
+	// regular files. Entries come in the order of the package, after the path filter and
+	// the transforms, with their paths relative to the root. It reports whether the entry
+	// was written, which it need not be, e.g. if an earlier package wrote the same file or
+	// replaces pkg; only written entries other than regular files are recorded in the
+	// installed database. It may change hdr, e.g. to add the checksum of the content.
+	WriteEntry(hdr *tar.Header, r io.Reader, pkg *Package) (bool, error)
+}
+
+// ExtractedFile is an entry of a package, as recorded by ExtractRecorder.
+type ExtractedFile struct {
+	Package string
+	Header  tar.Header
+	// SHA256 is the hex encoded sha256 of the content of regular files.
+	SHA256 string
+}
+
+// ExtractRecorder is an ExtractTarget that writes nothing and records the entries of the
+// packages, e.g. for a dry run of an install.
+type ExtractRecorder struct {
+	mu    sync.Mutex
+	files []ExtractedFile
+}
+
+// WriteEntry records hdr, and the sha256 of r for regular files.
+func (e *ExtractRecorder) WriteEntry(hdr *tar.Header, r io.Reader, pkg *Package) (bool, error) {
+	file := ExtractedFile{Package: pkg.Name, Header: *hdr}
+	if hdr.Typeflag == tar.TypeReg {
+		h := sha256.New()
+		if _, err := io.Copy(h, r); err != nil {
+			return false, err
+		}
+		file.SHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.files = append(e.files, file)
+	return true, nil
+}
+
+// Files returns the entries recorded so far, in the order they were extracted.
+func (e *ExtractRecorder) Files() []ExtractedFile {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]ExtractedFile(nil), e.files...)
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractTarget(t *testing.T) {
+	ctx := context.Background()
+
+	newPackage := func() InstallablePackage {
+		return fakePackage(t, &Package{Name: "hello", Version: "1.0-r0"}, []testDirEntry{
+			{"etc", 0o755, true, nil, nil},
+			{"etc/hello", 0o644, false, []byte("hello"), nil},
+		})
+	}
+
+	t.Run("recorder", func(t *testing.T) {
+		_, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		recorder := &ExtractRecorder{}
+		a, err := New(WithFS(src), WithExtractTarget(recorder))
+		require.NoError(t, err)
+		require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{newPackage()}))
+
+		digest := sha256.Sum256([]byte("hello"))
+		files := recorder.Files()
+		require.Len(t, files, 2)
+		require.Equal(t, "etc", files[0].Header.Name)
+		require.Equal(t, "etc/hello", files[1].Header.Name)
+		require.Equal(t, "hello", files[1].Package)
+		require.Equal(t, hex.EncodeToString(digest[:]), files[1].SHA256)
+
+		// nothing was written but the database
+		_, err = src.Stat("etc/hello")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+		db, err := a.InstalledDB()
+		require.NoError(t, err)
+		owner, ok := db.Owner("etc/hello")
+		require.True(t, ok)
+		require.Equal(t, "hello", owner.Name)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		_, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		s := NewStreamFS(&buf)
+		a, err := New(WithFS(src), WithExtractTarget(s))
+		require.NoError(t, err)
+		require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{newPackage()}))
+		require.NoError(t, s.Close())
+
+		entries := map[string]string{}
+		tr := tar.NewReader(&buf)
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			b, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			entries[hdr.Name] = string(b)
+		}
+		require.Equal(t, map[string]string{"etc": "", "etc/hello": "hello"}, entries)
+	})
+
+	_, err := New(WithExtractTarget(nil))
+	require.Error(t, err)
+}
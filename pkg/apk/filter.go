@@ -0,0 +1,123 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sync"
+)
+
+// PackageFilter decides whether a filtered index keeps a package, see FilterIndex.
+type PackageFilter func(pkg *RepositoryPackage) bool
+
+// FilterNames keeps the packages whose names match any of globs, as in path.Match.
+func FilterNames(globs ...string) PackageFilter {
+	return func(pkg *RepositoryPackage) bool {
+		return matchAny(globs, pkg.Name)
+	}
+}
+
+// FilterOrigins keeps the packages whose origins match any of globs, as in path.Match.
+func FilterOrigins(globs ...string) PackageFilter {
+	return func(pkg *RepositoryPackage) bool {
+		return matchAny(globs, pkg.Origin)
+	}
+}
+
+// FilterLicenses keeps the packages whose license expressions only have licenses in
+// licenses, ignoring case. Packages without a license are not kept.
+func FilterLicenses(licenses ...string) PackageFilter {
+	return func(pkg *RepositoryPackage) bool {
+		ids := licenseIDs(pkg.License)
+		if len(ids) == 0 {
+			return false
+		}
+		for _, id := range ids {
+			if !containsFold(licenses, id) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// FilterMaxVersions keeps the packages that are not newer than their version in versions,
+// by name. Packages that are not in versions are kept.
+func FilterMaxVersions(versions map[string]string) PackageFilter {
+	return func(pkg *RepositoryPackage) bool {
+		maxVersion, ok := versions[pkg.Name]
+		return !ok || !newerVersion(pkg.Version, maxVersion)
+	}
+}
+
+func matchAny(globs []string, s string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filteredIndex is the NamedIndex of FilterIndex.
+type filteredIndex struct {
+	NamedIndex
+	filters []PackageFilter
+
+	once sync.Once
+	pkgs []*RepositoryPackage
+}
+
+// FilterIndex returns index with only the packages that every filter keeps, e.g. to resolve
+// from a curated subset of a repository. The packages are filtered once, when first needed.
+func FilterIndex(index NamedIndex, filters ...PackageFilter) NamedIndex {
+	return &filteredIndex{NamedIndex: index, filters: filters}
+}
+
+func (f *filteredIndex) Packages() []*RepositoryPackage {
+	f.once.Do(func() {
+	pkgs:
+		for _, pkg := range f.NamedIndex.Packages() {
+			for _, keep := range f.filters {
+				if !keep(pkg) {
+					continue pkgs
+				}
+			}
+			f.pkgs = append(f.pkgs, pkg)
+		}
+	})
+	return f.pkgs
+}
+
+func (f *filteredIndex) Count() int {
+	return len(f.Packages())
+}
+
+// WriteIndex writes the packages of index to w as an unsigned APKINDEX.tar.gz with
+// description, e.g. the packages of a FilterIndex for a mirror. Sign it with signature.SignIndex.
+func WriteIndex(w io.Writer, index NamedIndex, description string) error {
+	apkindex := &APKIndex{Description: description}
+	for _, pkg := range index.Packages() {
+		apkindex.Packages = append(apkindex.Packages, pkg.Package)
+	}
+	archive, err := ArchiveFromIndex(apkindex)
+	if err != nil {
+		return fmt.Errorf("writing index %s: %w", index.Source(), err)
+	}
+	_, err = io.Copy(w, archive)
+	return err
+}
@@ -0,0 +1,58 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterIndex(t *testing.T) {
+	repo := Repository{URI: "https://example.com/main/x86_64"}
+	index := NewNamedRepositoryWithIndex("", repo.WithIndex(&APKIndex{Packages: []*Package{
+		{Name: "openssl", Version: "3.1.4-r0", Origin: "openssl", License: "Apache-2.0"},
+		{Name: "openssl", Version: "3.2.0-r0", Origin: "openssl", License: "Apache-2.0"},
+		{Name: "libcrypto3", Version: "3.1.4-r0", Origin: "openssl", License: "Apache-2.0"},
+		{Name: "readline", Version: "8.2-r0", Origin: "readline", License: "GPL-3.0-or-later"},
+		{Name: "busybox", Version: "1.36-r0", Origin: "busybox", License: "GPL-2.0-only AND bzip2-1.0.6"},
+		{Name: "nolicense", Version: "1-r0", Origin: "nolicense"},
+	}}))
+
+	filtered := FilterIndex(index,
+		FilterOrigins("openssl", "readline", "busybox"),
+		FilterLicenses("apache-2.0", "GPL-2.0-only", "bzip2-1.0.6"),
+		FilterMaxVersions(map[string]string{"openssl": "3.1.99"}),
+	)
+	var got []string
+	for _, pkg := range filtered.Packages() {
+		got = append(got, pkg.Filename())
+	}
+	require.Equal(t, []string{"openssl-3.1.4-r0.apk", "libcrypto3-3.1.4-r0.apk", "busybox-1.36-r0.apk"}, got)
+	require.Equal(t, 3, filtered.Count())
+	require.Equal(t, index.Source(), filtered.Source())
+
+	require.Len(t, FilterIndex(index, FilterNames("lib*", "readline")).Packages(), 2)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteIndex(&buf, filtered, "curated"))
+	written, err := IndexFromArchive(io.NopCloser(&buf))
+	require.NoError(t, err)
+	require.Equal(t, "curated", written.Description)
+	require.Len(t, written.Packages, 3)
+	require.Equal(t, "busybox", written.Packages[2].Name)
+}
@@ -0,0 +1,320 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+)
+
+// Fix reinstalls the named installed packages, like "apk fix": their files are removed and
+// extracted again, which restores missing and modified files, and their entries in the
+// installed database are replaced. With no names, the packages with modified or missing
+// files in Audit are fixed.
+//
+// The installed versions are fetched from the repositories, so they must still be there.
+// They are all fetched before anything is removed, and if reinstalling them fails, the
+// files that were removed and the installed database are put back as they were.
+func (a *APK) Fix(ctx context.Context, names ...string) error {
+	ctx = a.logContext(ctx)
+	log := a.log(ctx)
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Fix")
+	defer span.End()
+
+	db, err := a.InstalledDB()
+	if err != nil {
+		return err
+	}
+
+	if len(names) == 0 {
+		report, err := a.Audit(ctx)
+		if err != nil {
+			return fmt.Errorf("auditing: %w", err)
+		}
+		broken := map[string]bool{}
+		for _, entry := range append(report.Modified, report.Missing...) {
+			broken[entry.Package] = true
+		}
+		for name := range broken {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	if len(names) == 0 {
+		log.Debug("no packages to fix")
+		return nil
+	}
+
+	indexes, err := a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
+	if err != nil {
+		return fmt.Errorf("error getting repository indexes: %w", err)
+	}
+
+	fixed := make(map[string]*InstalledPackage, len(names))
+	pkgs := make([]InstallablePackage, 0, len(names))
+	for _, name := range names {
+		installed, ok := db.Package(name)
+		if !ok {
+			return fmt.Errorf("package %s is not installed", name)
+		}
+		pkg := findInstalledVersion(indexes, &installed.Package)
+		if pkg == nil {
+			return fmt.Errorf("package %s-%s is not in the repositories", installed.Name, installed.Version)
+		}
+		// Fetch it now, so that a failure leaves the installation untouched.
+		if _, err := a.expandPackage(ctx, pkg); err != nil {
+			return fmt.Errorf("expanding %s: %w", pkg, err)
+		}
+		fixed[name] = installed
+		pkgs = append(pkgs, pkg)
+	}
+
+	// Track the files of the other installed packages, for the file conflict checks on
+	// extraction.
+	for _, installed := range db.Packages() {
+		if _, ok := fixed[installed.Name]; ok {
+			continue
+		}
+		for _, hdr := range installed.Files {
+			if _, ok := a.installedFiles[hdr.Name]; !ok && hdr.Typeflag != tar.TypeDir {
+				a.installedFiles[hdr.Name] = &installed.Package
+			}
+		}
+	}
+
+	// Keep the state and the files that are removed, to put them back if reinstalling fails.
+	snapshot, err := a.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	var removed []removedFile
+	rollback := func(err error) error {
+		if rerr := a.rollbackFix(ctx, snapshot, removed); rerr != nil {
+			return fmt.Errorf("%w, and rolling back failed: %v", err, rerr)
+		}
+		return err
+	}
+	for _, installed := range fixed {
+		for _, hdr := range installed.Files {
+			if hdr.Typeflag == tar.TypeDir {
+				continue
+			}
+			path := cleanInstalledPath(hdr.Name)
+			info, err := a.fs.Lstat(path)
+			if errors.Is(err, fs.ErrNotExist) {
+				delete(a.installedFiles, hdr.Name)
+				continue
+			}
+			if err != nil {
+				return rollback(fmt.Errorf("reading %s: %w", path, err))
+			}
+			entry, err := a.captureEntry(path, info)
+			if err != nil {
+				return rollback(fmt.Errorf("reading %s: %w", path, err))
+			}
+			if err := a.fs.Remove(path); err != nil {
+				return rollback(fmt.Errorf("removing %s: %w", path, err))
+			}
+			removed = append(removed, removedFile{entry: entry, uid: hdr.Uid, gid: hdr.Gid})
+			delete(a.installedFiles, hdr.Name)
+		}
+	}
+	if err := a.removeInstalledPackages(fixed); err != nil {
+		return rollback(err)
+	}
+
+	log.Infof("fixing %d packages: %s", len(names), strings.Join(names, " "))
+	if err := a.InstallPackages(ctx, nil, pkgs); err != nil {
+		return rollback(err)
+	}
+	return nil
+}
+
+// removedFile is a file that Fix removed, with its owner in the installed database.
+type removedFile struct {
+	entry    snapshotEntry
+	uid, gid int
+}
+
+// rollbackFix puts back the files that Fix removed, over what the failed reinstall left
+// of them, and the state of snapshot.
+func (a *APK) rollbackFix(ctx context.Context, snapshot *Snapshot, removed []removedFile) error {
+	for _, f := range removed {
+		if err := a.fs.Remove(f.entry.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("removing %s: %w", f.entry.path, err)
+		}
+		if err := a.restoreEntry(f.entry); err != nil {
+			return fmt.Errorf("restoring %s: %w", f.entry.path, err)
+		}
+		if f.entry.mode&fs.ModeSymlink != 0 {
+			continue
+		}
+		if err := a.chown(&tar.Header{Name: f.entry.path, Uid: f.uid, Gid: f.gid}); err != nil {
+			return err
+		}
+	}
+	return a.Restore(ctx, snapshot)
+}
+
+// findInstalledVersion returns the package in indexes with the name and version of pkg,
+// preferring one with the same checksum, or nil.
+func findInstalledVersion(indexes []NamedIndex, pkg *Package) *RepositoryPackage {
+	var found *RepositoryPackage
+	for _, index := range indexes {
+		for _, rp := range index.Packages() {
+			if rp.Name != pkg.Name || rp.Version != pkg.Version {
+				continue
+			}
+			if bytes.Equal(rp.Checksum, pkg.Checksum) {
+				return rp
+			}
+			if found == nil {
+				found = rp
+			}
+		}
+	}
+	return found
+}
+
+// removeInstalledPackages removes pkgs, by name, from the installed file, the triggers
+// file, the omitted file and scripts.tar. It does not remove their files.
+func (a *APK) removeInstalledPackages(pkgs map[string]*InstalledPackage) error {
+	installed, err := a.fs.ReadFile(installedFilePath)
+	if err != nil {
+		return fmt.Errorf("could not read installed file at %s: %w", installedFilePath, err)
+	}
+	var out bytes.Buffer
+	for _, stanza := range strings.Split(string(installed), "\n\n") {
+		stanza = strings.Trim(stanza, "\n")
+		if stanza == "" {
+			continue
+		}
+		var name string
+		for _, line := range strings.Split(stanza, "\n") {
+			if v, ok := strings.CutPrefix(line, "P:"); ok {
+				name = v
+				break
+			}
+		}
+		if _, ok := pkgs[name]; ok {
+			continue
+		}
+		out.WriteString(stanza + "\n\n")
+	}
+	if err := a.fs.WriteFile(installedFilePath, out.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("could not write installed file at %s: %w", installedFilePath, err)
+	}
+
+	checksums := make(map[string]bool, len(pkgs))
+	prefixes := make([]string, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		checksum := base64.StdEncoding.EncodeToString(pkg.Checksum)
+		checksums[checksum] = true
+		checksums["Q1"+checksum] = true
+		prefixes = append(prefixes, fmt.Sprintf("%s-%s.Q1%s", pkg.Name, pkg.Version, checksum))
+	}
+
+	for _, p := range []string{triggersFilePath, omittedFilePath} {
+		if err := a.removeChecksumLines(p, checksums); err != nil {
+			return err
+		}
+	}
+
+	scripts, err := a.fs.ReadFile(scriptsFilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read scripts file at %s: %w", scriptsFilePath, err)
+	}
+	out.Reset()
+	tr := tar.NewReader(bytes.NewReader(scripts))
+	tw := tar.NewWriter(&out)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading scripts file at %s: %w", scriptsFilePath, err)
+		}
+		if hasScriptPrefix(hdr.Name, prefixes) {
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("unable to write scripts header for %s: %w", hdr.Name, err)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return fmt.Errorf("unable to write content for %s: %w", hdr.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := a.fs.WriteFile(scriptsFilePath, out.Bytes(), scriptsTarPerms); err != nil {
+		return fmt.Errorf("could not write scripts file at %s: %w", scriptsFilePath, err)
+	}
+	return nil
+}
+
+// hasScriptPrefix returns whether name is a script in scripts.tar of one of the packages
+// with prefixes, see loadScripts.
+func hasScriptPrefix(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if script, ok := strings.CutPrefix(name, prefix); ok && strings.HasPrefix(script, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// removeChecksumLines removes the lines of the file at p, whose lines start with the
+// checksum of a package, e.g. the triggers file, that start with one of checksums.
+func (a *APK) removeChecksumLines(p string, checksums map[string]bool) error {
+	b, err := a.fs.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", p, err)
+	}
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		checksum, _, _ := strings.Cut(scanner.Text(), " ")
+		if checksums[checksum] {
+			continue
+		}
+		out.WriteString(scanner.Text() + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading %s: %w", p, err)
+	}
+	if err := a.fs.WriteFile(p, out.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("could not write %s: %w", p, err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestFix(t *testing.T) {
+	ctx := context.Background()
+
+	fake := fakePackage(t, &Package{Name: "hello", Version: "0.1.0-r0", Arch: "x86_64"}, []testDirEntry{
+		{"usr", 0o755, true, nil, nil},
+		{"usr/bin", 0o755, true, nil, nil},
+		{"usr/bin/hello", 0o755, false, []byte("hello"), nil},
+	}).(*testPackage)
+	checksum, err := base64.StdEncoding.DecodeString(fake.checksum)
+	require.NoError(t, err)
+
+	// a local repository with the package
+	repo := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(repo, "x86_64"), 0o755))
+	archive, err := ArchiveFromIndex(&APKIndex{Packages: []*Package{
+		{Name: "hello", Version: "0.1.0-r0", Arch: "x86_64", Checksum: checksum},
+	}})
+	require.NoError(t, err)
+	b, err := io.ReadAll(archive)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "x86_64", indexFilename), b, 0o644))
+	b, err = os.ReadFile(fake.file)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "x86_64", "hello-0.1.0-r0.apk"), b, 0o644))
+
+	src := &failingFS{FullFS: apkfs.NewMemFS()}
+	a, err := New(WithFS(src), WithArch("x86_64"), WithIgnoreMknodErrors(true))
+	require.NoError(t, err)
+	a.ignoreSignatures = true
+	require.NoError(t, a.InitDB(ctx))
+	require.NoError(t, a.SetRepositories(ctx, []string{repo}))
+	require.NoError(t, a.SetWorld(ctx, []string{"hello"}))
+	require.NoError(t, a.FixateWorld(ctx, nil))
+
+	db, err := a.InstalledDB()
+	require.NoError(t, err)
+	hello, ok := db.Package("hello")
+	require.True(t, ok)
+	require.NotEmpty(t, hello.Files)
+	file := "usr/bin/hello"
+	contents, err := src.ReadFile(file)
+	require.NoError(t, err)
+
+	// nothing to fix
+	require.NoError(t, a.Fix(ctx))
+
+	require.NoError(t, src.WriteFile(file, []byte("modified"), 0o644))
+	report, err := a.Audit(ctx)
+	require.NoError(t, err)
+	require.Len(t, report.Modified, 1)
+
+	require.NoError(t, a.Fix(ctx))
+	b, err = src.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, contents, b)
+	report, err = a.Audit(ctx)
+	require.NoError(t, err)
+	require.Empty(t, report.Modified)
+	require.Empty(t, report.Missing)
+	db, err = a.InstalledDB()
+	require.NoError(t, err)
+	require.Len(t, db.Packages(), 1)
+
+	// missing files are restored too, by name
+	require.NoError(t, src.Remove(file))
+	require.NoError(t, a.Fix(ctx, "hello"))
+	b, err = src.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, contents, b)
+
+	require.Error(t, a.Fix(ctx, "notinstalled"))
+
+	// a failed reinstall puts back the files and the installed database as they were
+	require.NoError(t, src.WriteFile(file, []byte("modified"), 0o644))
+	src.fail = file
+	require.Error(t, a.Fix(ctx, "hello"))
+	src.fail = ""
+	b, err = src.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, []byte("modified"), b)
+	db, err = a.InstalledDB()
+	require.NoError(t, err)
+	_, ok = db.Package("hello")
+	require.True(t, ok)
+	report, err = a.Audit(ctx)
+	require.NoError(t, err)
+	require.Len(t, report.Modified, 1)
+}
+
+// failingFS fails to create the file fail, if it is set.
+type failingFS struct {
+	apkfs.FullFS
+	fail string
+}
+
+func (f *failingFS) OpenFile(name string, flag int, perm fs.FileMode) (apkfs.File, error) {
+	if f.fail != "" && name == f.fail && flag&os.O_CREATE != 0 {
+		return nil, fmt.Errorf("creating %s: %w", name, fs.ErrPermission)
+	}
+	return f.FullFS.OpenFile(name, flag, perm)
+}
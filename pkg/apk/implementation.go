@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
@@ -31,11 +32,11 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/chainguard-dev/clog"
 	"github.com/chainguard-dev/go-apk/pkg/expandapk"
-	"gopkg.in/ini.v1"
+	"github.com/chainguard-dev/go-apk/pkg/pkginfo"
 
 	"go.lsp.dev/uri"
 	"go.opentelemetry.io/otel"
@@ -47,8 +48,6 @@ import (
 
 	"github.com/chainguard-dev/go-apk/internal/tarfs"
 	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
-	"github.com/hashicorp/go-hclog"
-	retryablehttp "github.com/hashicorp/go-retryablehttp"
 )
 
 // This is terrible but simpler than plumbing around a cache for now.
@@ -63,8 +62,82 @@ type APK struct {
 	executor          Executor
 	ignoreMknodErrors bool
 	client            *http.Client
-	cache             *cache
+	cache             *Cache
 	ignoreSignatures  bool
+	auth              *auth
+	strictChecksums   bool
+	verifySignatures  bool
+	offline           bool
+	indexParallelism  int
+	runScripts        bool
+	usrMerge          bool
+	fileConflicts     FileConflictPolicy
+	ignoreChownErrors bool
+	ignoreXattrErrors bool
+	copyHardlinks     bool
+	buildTime         *time.Time
+	policy            Policy
+	secDB             *SecDB
+	secFixes          SecFixesMode
+	tieBreak          TieBreak
+	repoPriorities    map[string]int
+	excludes          []string
+	holds             []string
+	preventDowngrade  bool
+	solveTimeout      time.Duration
+	noInstallIf       bool
+	sizeBudget        uint64
+	providerStrategy  ProviderStrategy
+	providerChooser   ProviderChooser
+	preferProviders   map[string]string
+	duplicates        DuplicatePolicy
+	maxIndexAge       time.Duration
+	staleIndexes      StaleIndexMode
+	unsignedRepos     func(repoURL string) bool
+	keyDiscovery      bool
+	packageVerifiers  []PackageVerifier
+	provenance        bool
+	requestMiddleware []RequestMiddleware
+	schemeHandlers    map[string]SchemeHandler
+	versionCache      *VersionCache
+	httpConfig        httpConfig
+	metrics           *metrics
+	eventHandlers     []EventHandler
+	logger            *slog.Logger
+	idMapped          bool
+	uidMap            idMap
+	gidMap            idMap
+	// owners are recorded by chownMapped until they are written to the ownership file
+	owners        map[string]owner
+	extractTarget ExtractTarget
+	cacheLinks    CacheLinkMode
+	// cacheLinksFailed is set when a file could not be linked from the cache, so that the
+	// files after it are copied without trying
+	cacheLinksFailed atomic.Bool
+	// cacheLinked are the installed files that are hardlinks to the cache, whose mode,
+	// owner and times are shared with it
+	cacheLinked    map[string]bool
+	pathFilter     *pathFilter
+	fileTransforms []FileTransform
+	// maxConcurrentExtractions is how many packages are extracted at once, see
+	// WithMaxConcurrentExtractions
+	maxConcurrentExtractions int
+	// downloadOrder is the order in which packages are downloaded, see WithDownloadOrder
+	downloadOrder DownloadOrder
+
+	// extractMu guards what extracting packages records, which they may do concurrently:
+	// installedFiles, owners, cacheLinked and omitted, the files of the packages being
+	// installed that pathFilter or fileTransforms skipped
+	extractMu sync.Mutex
+	omitted   map[*Package][]string
+
+	scriptResultsMu sync.Mutex
+	scriptResults   []ScriptResult
+	firedTriggers   []Trigger
+
+	// the provenance of the last install, see WithProvenance
+	provenanceMu   sync.Mutex
+	lastProvenance *Provenance
 
 	// filename to owning package, last write wins
 	installedFiles map[string]*Package
@@ -77,19 +150,147 @@ func New(options ...Option) (*APK, error) {
 			return nil, err
 		}
 	}
-	rhttp := retryablehttp.NewClient()
-	rhttp.Logger = hclog.Default()
+	metrics, err := newMetrics(opt.meterProvider)
+	if err != nil {
+		return nil, fmt.Errorf("creating metrics: %w", err)
+	}
+	httpConfig := httpConfig{
+		retryPolicy: opt.retryPolicy,
+		hostTLS:     opt.hostTLS,
+		rateLimiter: newRateLimiter(opt.rateLimitBytes, opt.rateLimitRequests),
+		proxies:     opt.proxies,
+		metrics:     metrics,
+		logger:      opt.logger,
+	}
+	userAgent := DefaultUserAgent()
+	if opt.userAgent != "" {
+		userAgent = opt.userAgent + " " + userAgent
+	}
+	schemeHandlers := defaultSchemeHandlers()
+	for scheme, handler := range opt.schemeHandlers {
+		if handler == nil {
+			delete(schemeHandlers, scheme)
+			continue
+		}
+		schemeHandlers[scheme] = handler
+	}
+	middleware := append([]RequestMiddleware{userAgentMiddleware(userAgent)}, opt.requestMiddleware...)
+	// the scheme handlers come last, so that other middleware sees the URLs as they were given
+	middleware = append(middleware, schemeMiddleware(schemeHandlers))
+	client := middlewareClient(opt.auth.client(httpConfig.client()), middleware)
+
+	if opt.cacheMaxSize != 0 || opt.cacheMaxAge != 0 {
+		if opt.cache == nil {
+			return nil, fmt.Errorf("cache limits require a cache, see WithCache")
+		}
+		opt.cache.maxSize = opt.cacheMaxSize
+		opt.cache.maxAge = opt.cacheMaxAge
+	}
+
+	if opt.cacheLinks != CacheLinksNone && opt.cache == nil {
+		return nil, fmt.Errorf("cache links require a cache, see WithCache")
+	}
+	if opt.cacheLayout != CacheLayoutTar {
+		if opt.cache == nil {
+			return nil, fmt.Errorf("cache layout requires a cache, see WithCache")
+		}
+		opt.cache.layout = opt.cacheLayout
+	}
 
-	return &APK{
-		client:            rhttp.StandardClient(),
-		fs:                opt.fs,
-		arch:              opt.arch,
-		executor:          opt.executor,
-		ignoreMknodErrors: opt.ignoreMknodErrors,
-		version:           opt.version,
-		cache:             opt.cache,
-		installedFiles:    map[string]*Package{},
-	}, nil
+	if opt.indexTTL != 0 {
+		if opt.cache == nil {
+			return nil, fmt.Errorf("index TTL requires a cache, see WithCache")
+		}
+		opt.cache.indexTTL = opt.indexTTL
+	}
+	if opt.cache != nil {
+		opt.cache.forceRefresh = opt.forceRefresh
+	}
+
+	offline := opt.offline || (opt.cache != nil && opt.cache.offline)
+	if offline {
+		if opt.cache == nil {
+			return nil, fmt.Errorf("offline mode requires a cache, see WithCache")
+		}
+		if opt.forceRefresh {
+			return nil, fmt.Errorf("cannot force a refresh in offline mode")
+		}
+		opt.cache.offline = true
+		client = offlineClient()
+	}
+
+	if opt.runScripts && opt.executor == nil {
+		return nil, fmt.Errorf("running scripts requires an executor, see WithExecutor")
+	}
+
+	versionCache := opt.versionCache
+	if versionCache == nil {
+		versionCache = NewVersionCache()
+	}
+
+	a := &APK{
+		client:                   client,
+		offline:                  offline,
+		auth:                     opt.auth,
+		strictChecksums:          opt.strictChecksums,
+		verifySignatures:         opt.verifySignatures,
+		indexParallelism:         opt.indexParallelism,
+		runScripts:               opt.runScripts,
+		usrMerge:                 opt.usrMerge,
+		fileConflicts:            opt.fileConflicts,
+		ignoreChownErrors:        opt.ignoreChownErrors,
+		ignoreXattrErrors:        opt.ignoreXattrErrors,
+		copyHardlinks:            opt.copyHardlinks,
+		buildTime:                opt.buildTime,
+		policy:                   opt.policy,
+		secDB:                    opt.secDB,
+		secFixes:                 opt.secFixes,
+		tieBreak:                 opt.tieBreak,
+		repoPriorities:           opt.repoPriorities,
+		excludes:                 opt.excludes,
+		holds:                    opt.holds,
+		preventDowngrade:         opt.preventDowngrade,
+		solveTimeout:             opt.solveTimeout,
+		noInstallIf:              opt.noInstallIf,
+		sizeBudget:               opt.sizeBudget,
+		providerStrategy:         opt.providerStrategy,
+		providerChooser:          opt.providerChooser,
+		preferProviders:          opt.preferProviders,
+		duplicates:               opt.duplicates,
+		maxIndexAge:              opt.maxIndexAge,
+		staleIndexes:             opt.staleIndexes,
+		unsignedRepos:            opt.unsignedRepos,
+		keyDiscovery:             opt.keyDiscovery,
+		packageVerifiers:         opt.packageVerifiers,
+		provenance:               opt.provenance,
+		requestMiddleware:        middleware,
+		schemeHandlers:           schemeHandlers,
+		versionCache:             versionCache,
+		httpConfig:               httpConfig,
+		metrics:                  metrics,
+		eventHandlers:            opt.eventHandlers,
+		logger:                   opt.logger,
+		idMapped:                 opt.idMapped,
+		uidMap:                   opt.uidMap,
+		gidMap:                   opt.gidMap,
+		pathFilter:               opt.pathFilter,
+		fileTransforms:           opt.fileTransforms,
+		extractTarget:            opt.extractTarget,
+		cacheLinks:               opt.cacheLinks,
+		maxConcurrentExtractions: opt.maxConcurrentExtractions,
+		downloadOrder:            opt.downloadOrder,
+		fs:                       opt.fs,
+		arch:                     opt.arch,
+		executor:                 opt.executor,
+		ignoreMknodErrors:        opt.ignoreMknodErrors,
+		version:                  opt.version,
+		cache:                    opt.cache,
+		installedFiles:           map[string]*Package{},
+	}
+	if a.cache != nil {
+		a.cache.apk = a
+	}
+	return a, nil
 }
 
 type directory struct {
@@ -161,13 +362,25 @@ var initDeviceFiles = []deviceFile{
 // In general, you can leave this unset, and it will use the default http.Client.
 // It is useful for fine-grained control, for proxying, or for setting alternate
 // paths.
+//
+// Any credentials configured with WithBasicAuth, WithBearerToken, WithTokenFunc or
+// WithNetrc, and any middleware added with WithRequestMiddleware, are applied on top of the
+// given client.
+//
+// In offline mode the client is never used, and this is a no-op.
 func (a *APK) SetClient(client *http.Client) {
-	a.client = client
+	if a.offline {
+		return
+	}
+	a.client = middlewareClient(a.auth.client(client), a.requestMiddleware)
 }
 
 // ListInitFiles list the files that are installed during the InitDB phase.
 func (a *APK) ListInitFiles() []tar.Header {
 	headers := make([]tar.Header, 0, 20)
+	if a.usrMerge {
+		headers = append(headers, usrMergeInitFiles()...)
+	}
 
 	// additionalFiles are files we need but can only be resolved in the context of
 	// this func, e.g. we need the architecture
@@ -211,6 +424,13 @@ func (a *APK) ListInitFiles() []tar.Header {
 		Uid:      0,
 		Gid:      0,
 	})
+	if a.usrMerge {
+		for i := range headers {
+			if headers[i].Typeflag != tar.TypeSymlink {
+				headers[i].Name = usrMergePath(headers[i].Name)
+			}
+		}
+	}
 	return headers
 }
 
@@ -220,7 +440,7 @@ func (a *APK) ListInitFiles() []tar.Header {
 // unless those files will be included in the installed database, in which case they can
 // be retrieved via GetInstalled().
 func (a *APK) InitDB(ctx context.Context, alpineVersions ...string) error {
-	log := clog.FromContext(ctx)
+	log := a.log(ctx)
 	/*
 		equivalent of: "apk add --initdb --arch arch --root root"
 	*/
@@ -235,6 +455,11 @@ func (a *APK) InitDB(ctx context.Context, alpineVersions ...string) error {
 		{"/etc/apk/arch", 0o644, []byte(a.arch + "\n")},
 	}
 
+	if a.usrMerge {
+		if err := a.initUsrMerge(); err != nil {
+			return err
+		}
+	}
 	for _, e := range baseDirectories {
 		stat, err := a.fs.Stat(e.path)
 		switch {
@@ -302,6 +527,23 @@ func (a *APK) InitDB(ctx context.Context, alpineVersions ...string) error {
 		}
 	}
 
+	if a.buildTime != nil {
+		paths := make([]string, 0, len(baseDirectories)+len(initDirectories)+len(initFiles)+2)
+		for _, e := range baseDirectories {
+			paths = append(paths, e.path)
+		}
+		for _, e := range initDirectories {
+			paths = append(paths, e.path)
+		}
+		for _, e := range append(initFiles, additionalFiles...) {
+			paths = append(paths, e.path)
+		}
+		paths = append(paths, scriptsFilePath)
+		if err := a.setMtimes(*a.buildTime, paths...); err != nil {
+			return err
+		}
+	}
+
 	log.Debug("finished initializing apk database")
 	return nil
 }
@@ -310,7 +552,7 @@ func (a *APK) InitDB(ctx context.Context, alpineVersions ...string) error {
 // directory by trying some common locations. These can be overridden
 // by passing one or more directories as arguments.
 func (a *APK) loadSystemKeyring(ctx context.Context, locations ...string) ([]string, error) {
-	log := clog.FromContext(ctx)
+	log := a.log(ctx)
 	var ring []string
 	if len(locations) == 0 {
 		locations = []string{
@@ -349,7 +591,7 @@ func (a *APK) loadSystemKeyring(ctx context.Context, locations ...string) ([]str
 
 // Installs the specified keys into the APK keyring inside the build context.
 func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string) error {
-	log := clog.FromContext(ctx)
+	log := a.log(ctx)
 	log.Debug("initializing apk keyring")
 
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "InitKeyring")
@@ -371,61 +613,9 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 		eg.Go(func() error {
 			log.Debugf("installing key %v", element)
 
-			var asURL *url.URL
-			var err error
-			if strings.HasPrefix(element, "https://") {
-				asURL, err = url.Parse(element)
-			} else {
-				// Attempt to parse non-https elements into URI's so they are translated into
-				// file:// URLs allowing them to parse into a url.URL{}
-				asURL, err = url.Parse(string(uri.New(element)))
-			}
+			data, err := a.fetchFile(ctx, element)
 			if err != nil {
-				return fmt.Errorf("failed to parse key as URI: %w", err)
-			}
-
-			var data []byte
-			switch asURL.Scheme {
-			case "file": //nolint:goconst
-				data, err = os.ReadFile(element)
-				if err != nil {
-					return fmt.Errorf("failed to read apk key: %w", err)
-				}
-			case "https": //nolint:goconst
-				client := a.client
-				if client == nil {
-					client = retryablehttp.NewClient().StandardClient()
-				}
-				if a.cache != nil {
-					client = a.cache.client(client, true)
-				}
-				req, err := http.NewRequestWithContext(ctx, http.MethodGet, asURL.String(), nil)
-				if err != nil {
-					return err
-				}
-				// if the URL contains HTTP Basic Auth credentials, add them to the request
-				if asURL.User != nil {
-					user := asURL.User.Username()
-					pass, _ := asURL.User.Password()
-					req.SetBasicAuth(user, pass)
-				}
-
-				resp, err := client.Do(req)
-				if err != nil {
-					return fmt.Errorf("failed to fetch apk key: %w", err)
-				}
-				defer resp.Body.Close()
-
-				if resp.StatusCode < 200 || resp.StatusCode > 299 {
-					return fmt.Errorf("failed to fetch apk key: http response indicated error code: %d", resp.StatusCode)
-				}
-
-				data, err = io.ReadAll(resp.Body)
-				if err != nil {
-					return fmt.Errorf("failed to read apk key response: %w", err)
-				}
-			default:
-				return fmt.Errorf("scheme %s not supported", asURL.Scheme)
+				return err
 			}
 
 			// #nosec G306 -- apk keyring must be publicly readable
@@ -441,9 +631,74 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 	return eg.Wait()
 }
 
+// fetchFile reads the file at element, e.g. a key, which may be a local path, an https://
+// URL or a URL of a scheme with a handler, see WithSchemeHandler.
+func (a *APK) fetchFile(ctx context.Context, element string) ([]byte, error) {
+	var asURL *url.URL
+	var err error
+	remote := a.isRemote(element)
+	if remote {
+		asURL, err = url.Parse(element)
+	} else {
+		// Attempt to parse non-https elements into URI's so they are translated into
+		// file:// URLs allowing them to parse into a url.URL{}
+		asURL, err = url.Parse(string(uri.New(element)))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s as URI: %w", element, err)
+	}
+
+	var data []byte
+	switch {
+	case asURL.Scheme == "file": //nolint:goconst
+		data, err = os.ReadFile(element)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", element, err)
+		}
+	case remote:
+		client := a.client
+		if client == nil {
+			client = a.httpConfig.client()
+		}
+		if a.cache != nil {
+			client = a.cache.client(client, true)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, asURL.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		// if the URL contains HTTP Basic Auth credentials, add them to the request
+		if asURL.User != nil {
+			user := asURL.User.Username()
+			pass, _ := asURL.User.Password()
+			req.SetBasicAuth(user, pass)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch %s: %w", asURL.Redacted(), err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, fmt.Errorf("failed to fetch %s: http response indicated error code: %d", asURL.Redacted(), resp.StatusCode)
+		}
+
+		data, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response for %s: %w", asURL.Redacted(), err)
+		}
+	default:
+		return nil, fmt.Errorf("scheme %s not supported", asURL.Scheme)
+	}
+
+	return data, nil
+}
+
 // ResolveWorld determine the target state for the requested dependencies in /etc/apk/world. Does not install anything.
 func (a *APK) ResolveWorld(ctx context.Context) (toInstall []*RepositoryPackage, conflicts []string, err error) {
-	log := clog.FromContext(ctx)
+	ctx = a.logContext(ctx)
+	log := a.log(ctx)
 	log.Debug("determining desired apk world")
 
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "ResolveWorld")
@@ -463,17 +718,96 @@ func (a *APK) ResolveWorld(ctx context.Context) (toInstall []*RepositoryPackage,
 	if err != nil {
 		return toInstall, conflicts, fmt.Errorf("error getting world packages: %w", err)
 	}
-	resolver := NewPkgResolver(ctx, indexes)
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return toInstall, conflicts, fmt.Errorf("error getting installed packages: %w", err)
+	}
+	if err := a.checkIndexAge(ctx, indexes); err != nil {
+		return toInstall, conflicts, err
+	}
+	resolverOptions, err := a.resolverOptions(indexes)
+	if err != nil {
+		return toInstall, conflicts, err
+	}
+	resolverOptions = append(resolverOptions, WithResolverInstalled(installed, a.preventDowngrade))
+	resolver := NewPkgResolver(ctx, indexes, resolverOptions...)
+	start := time.Now()
 	toInstall, conflicts, err = resolver.GetPackagesWithDependencies(ctx, directPkgs)
+	a.metrics.solved(ctx, time.Since(start), err)
 	if err != nil {
 		return
 	}
+	for _, pkg := range toInstall {
+		a.emit(ctx, &PackageResolved{Package: pkg})
+	}
+	a.warnSecFixes(ctx, indexes, toInstall)
+	if a.duplicates == DuplicateWarn || a.duplicates == DuplicatePreferPriority {
+		for _, dup := range resolver.Duplicates(toInstall) {
+			log.Warnf("duplicate package: %s", dup)
+			a.emit(ctx, &DuplicateFound{Package: dup.Package, Others: dup.Others})
+		}
+	}
+	for _, change := range resolver.Downgrades(toInstall) {
+		log.Warnf("downgrading %s from %s to %s", change.Name, change.OldVersion, change.NewVersion)
+	}
 	log.Debugf("got %d packages to install:\n%s", len(toInstall), strings.Join(packageRefs(toInstall), "\n"))
 	return
 }
 
+// ResolveForArchs resolves packages, and all of their dependencies, for each of archs,
+// using the repositories and keys of the root. The result maps each arch to the packages
+// to install for it. Does not install anything; the packages can be fetched with
+// Cache.Warm or installed by an APK for the matching arch.
+//
+// This lets a multi-platform build resolve everything with a single APK, and share the
+// fetched indexes across architectures through the cache.
+func (a *APK) ResolveForArchs(ctx context.Context, archs []string, packages []string) (map[string][]*RepositoryPackage, error) {
+	ctx = a.logContext(ctx)
+	log := a.log(ctx)
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "ResolveForArchs")
+	defer span.End()
+
+	var (
+		mu     sync.Mutex
+		result = make(map[string][]*RepositoryPackage, len(archs))
+	)
+	g, gctx := errgroup.WithContext(ctx)
+	for _, arch := range archs {
+		arch := arch
+		g.Go(func() error {
+			indexes, err := a.getRepositoryIndexesForArch(gctx, arch, a.ignoreSignatures)
+			if err != nil {
+				return fmt.Errorf("error getting repository indexes for %s: %w", arch, err)
+			}
+			if err := a.checkIndexAge(gctx, indexes); err != nil {
+				return err
+			}
+			resolverOptions, err := a.resolverOptions(indexes)
+			if err != nil {
+				return err
+			}
+			resolver := NewPkgResolver(gctx, indexes, resolverOptions...)
+			toInstall, _, err := resolver.GetPackagesWithDependencies(gctx, packages)
+			if err != nil {
+				return fmt.Errorf("resolving packages for %s: %w", arch, err)
+			}
+			a.warnSecFixes(gctx, indexes, toInstall)
+			log.Debugf("got %d packages to install for %s:\n%s", len(toInstall), arch, strings.Join(packageRefs(toInstall), "\n"))
+
+			mu.Lock()
+			defer mu.Unlock()
+			result[arch] = toInstall
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
 func (a *APK) ResolveAndCalculateWorld(ctx context.Context) ([]*APKResolved, error) {
-	log := clog.FromContext(ctx)
+	log := a.log(ctx)
 	log.Debug("resolving and calculating 'world' (packages to install)")
 
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "CalculateWorld")
@@ -531,12 +865,12 @@ func (a *APK) ResolveAndCalculateWorld(ctx context.Context) ([]*APKResolved, err
 
 // FixateWorld force apk's resolver to re-resolve the requested dependencies in /etc/apk/world.
 func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error {
-	log := clog.FromContext(ctx)
+	log := a.log(ctx)
 	/*
 		equivalent of: "apk fix --arch arch --root root"
 		with possible options for --no-scripts, --no-cache, --update-cache
 
-		current default is: cache=false, updateCache=true, executeScripts=false
+		current default is: cache=false, updateCache=true, executeScripts=false, see WithRunScripts
 	*/
 	log.Debug("synchronizing with desired apk world")
 
@@ -549,6 +883,9 @@ func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error
 	if err != nil {
 		return fmt.Errorf("error getting package dependencies: %w", err)
 	}
+	if err := a.checkDowngrades(allpkgs); err != nil {
+		return err
+	}
 
 	// 3. For each name on the list:
 	//     a. Check if it is installed, if so, skip
@@ -576,6 +913,17 @@ func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error
 }
 
 func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, allpkgs []InstallablePackage) error {
+	if sourceDateEpoch == nil {
+		sourceDateEpoch = a.buildTime
+	}
+	started := time.Now()
+
+	if a.offline {
+		if err := a.checkOfflinePackages(ctx, allpkgs); err != nil {
+			return err
+		}
+	}
+
 	// TODO: Consider making this configurable option.
 	jobs := runtime.GOMAXPROCS(0)
 
@@ -583,6 +931,8 @@ func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, a
 	g.SetLimit(jobs + 1)
 
 	expanded := make([]*expandapk.APKExpanded, len(allpkgs))
+	// the sha256 of the package files, for the provenance
+	digests := make([]string, len(allpkgs))
 
 	// Track what files were installed by which packages so we can deduplicate in idb.
 	allFiles := make([][]tar.Header, len(allpkgs))
@@ -596,10 +946,31 @@ func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, a
 
 	// Kick off a goroutine that sequentially installs packages as they become ready.
 	//
-	// We could probably do better than this by mirroring the dependency graph or even
-	// just computing non-overlapping packages based on the installed files, but we'll
-	// keep this simple for now by assuming we must install in the given order exactly.
+	// We could probably do better than this by mirroring the dependency graph, but we'll
+	// keep this simple for now by assuming we must install in the given order exactly,
+	// but for extracting the packages that do not overlap concurrently once they are all
+	// ready, see WithMaxConcurrentExtractions.
 	g.Go(func() error {
+		if a.fileConflicts != FileConflictsIgnore || a.extractsConcurrently() {
+			// Packages are checked against each other, and extracted concurrently if they
+			// are independent of each other, so wait for all of them.
+			for _, ch := range done {
+				select {
+				case <-gctx.Done():
+					return gctx.Err()
+				case <-ch:
+				}
+			}
+		}
+		if a.fileConflicts != FileConflictsIgnore {
+			if err := a.checkFileConflicts(gctx, allpkgs, expanded); err != nil {
+				return err
+			}
+		}
+		if a.extractsConcurrently() {
+			return a.installConcurrently(gctx, allpkgs, expanded, infos, allFiles, sourceDateEpoch)
+		}
+
 		for i, ch := range done {
 			select {
 			case <-gctx.Done():
@@ -608,20 +979,13 @@ func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, a
 				exp := expanded[i]
 				pkg := allpkgs[i]
 
-				isInstalled, err := a.isInstalledPackage(pkg.PackageName())
+				pkgInfo, err := a.installablePackageInfo(pkg, exp)
 				if err != nil {
-					return fmt.Errorf("error checking if package %s is installed: %w", pkg, err)
+					return err
 				}
-
-				if isInstalled {
+				if pkgInfo == nil {
 					continue
 				}
-
-				// The data in .PKGINFO is more complete than what is in APKINDEX.
-				pkgInfo, err := packageInfo(exp)
-				if err != nil {
-					return fmt.Errorf("failed to read .PKGINFO for %s: %w", pkg, err)
-				}
 				infos[i] = pkgInfo
 
 				installedFiles, err := a.installPackage(gctx, pkgInfo, exp, sourceDateEpoch)
@@ -636,10 +1000,21 @@ func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, a
 		return nil
 	})
 
-	// Meanwhile, concurrently fetch and expand all our APKs.
+	var keysFor func(InstallablePackage) map[string][]byte
+	if a.verifySignatures {
+		keyring, err := a.Keyring()
+		if err != nil {
+			return fmt.Errorf("loading keyring: %w", err)
+		}
+		if keysFor, err = a.packageKeys(keyring.Keys()); err != nil {
+			return err
+		}
+	}
+
+	// Meanwhile, concurrently fetch and expand all our APKs, in the order of WithDownloadOrder.
 	// We signal they are ready to be installed by closing done[i].
-	for i, pkg := range allpkgs {
-		i, pkg := i, pkg
+	for _, i := range a.downloadSchedule(allpkgs) {
+		i, pkg := i, allpkgs[i]
 
 		g.Go(func() error {
 			exp, err := a.expandPackage(gctx, pkg)
@@ -647,6 +1022,28 @@ func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, a
 				return fmt.Errorf("expanding %s: %w", pkg, err)
 			}
 
+			if a.strictChecksums {
+				if err := a.verifyPackage(gctx, pkg, exp); err != nil {
+					return fmt.Errorf("verifying %s: %w", pkg, err)
+				}
+			}
+
+			if a.verifySignatures {
+				if err := verifyPackageSignature(gctx, pkg, exp, keysFor(pkg)); err != nil {
+					return err
+				}
+			}
+
+			if err := a.verifyPackageArtifact(gctx, pkg, exp); err != nil {
+				return err
+			}
+
+			if a.provenance {
+				if digests[i], err = packageDigest(exp); err != nil {
+					return fmt.Errorf("hashing %s: %w", pkg, err)
+				}
+			}
+
 			expanded[i] = exp
 			close(done[i])
 
@@ -658,6 +1055,12 @@ func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, a
 		return fmt.Errorf("installing packages: %w", err)
 	}
 
+	if a.cache != nil {
+		if err := a.cache.GC(ctx); err != nil {
+			a.log(ctx).Warnf("cache GC failed: %v", err)
+		}
+	}
+
 	// update the installed file
 	for i, files := range allFiles {
 		pkg := infos[i]
@@ -686,6 +1089,39 @@ func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, a
 		}
 	}
 
+	if err := a.writeOwnership(); err != nil {
+		return err
+	}
+
+	if err := a.fireTriggers(ctx, allFiles); err != nil {
+		return fmt.Errorf("firing triggers: %w", err)
+	}
+
+	if sourceDateEpoch != nil {
+		if err := a.clampMtimes(allFiles, *sourceDateEpoch); err != nil {
+			return fmt.Errorf("clamping mtimes: %w", err)
+		}
+	}
+
+	committed := &TransactionCommitted{}
+	for _, pkg := range infos {
+		if pkg != nil {
+			committed.Packages = append(committed.Packages, pkg)
+		}
+	}
+	a.emit(ctx, committed)
+
+	if a.provenance {
+		finished := time.Now()
+		if sourceDateEpoch != nil {
+			started, finished = *sourceDateEpoch, *sourceDateEpoch
+		}
+		if err := a.recordProvenance(ctx, allpkgs, infos, digests, started, finished); err != nil {
+			return fmt.Errorf("recording provenance: %w", err)
+		}
+	}
+
+	a.metrics.installed(ctx, len(allpkgs))
 	return nil
 }
 
@@ -703,43 +1139,14 @@ func (a *APK) fetchAlpineKeys(ctx context.Context, alpineVersions []string) erro
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "fetchAlpineKeys")
 	defer span.End()
 
-	u := alpineReleasesURL
 	client := a.client
 	if client == nil {
-		client = retryablehttp.NewClient().StandardClient()
+		client = a.httpConfig.client()
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	urls, err := a.alpineKeyURLs(ctx, alpineVersions)
 	if err != nil {
 		return err
 	}
-	res, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to fetch alpine releases: %w", err)
-	}
-	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("unable to get alpine releases at %s: %v", u, res.Status)
-	}
-	b, err := io.ReadAll(res.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read alpine releases: %w", err)
-	}
-	var releases Releases
-	if err := json.Unmarshal(b, &releases); err != nil {
-		return fmt.Errorf("failed to unmarshal alpine releases: %w", err)
-	}
-	var urls []string
-	// now just need to get the keys for the desired architecture and releases
-	for _, version := range alpineVersions {
-		branch := releases.GetReleaseBranch(version)
-		if branch == nil {
-			continue
-		}
-		urls = append(urls, branch.KeysFor(a.arch, time.Now())...)
-	}
-	if len(urls) == 0 {
-		return &NoKeysFoundError{arch: a.arch, releases: alpineVersions}
-	}
 	// get the keys for each URL and save them to a file with that name
 	for _, u := range urls {
 		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
@@ -769,6 +1176,48 @@ func (a *APK) fetchAlpineKeys(ctx context.Context, alpineVersions []string) erro
 	return nil
 }
 
+// alpineKeyURLs returns the URLs of the current alpine-keys for the architecture and releases.
+func (a *APK) alpineKeyURLs(ctx context.Context, alpineVersions []string) ([]string, error) {
+	u := alpineReleasesURL
+	client := a.client
+	if client == nil {
+		client = a.httpConfig.client()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch alpine releases: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to get alpine releases at %s: %v", u, res.Status)
+	}
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alpine releases: %w", err)
+	}
+	var releases Releases
+	if err := json.Unmarshal(b, &releases); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal alpine releases: %w", err)
+	}
+	var urls []string
+	// now just need to get the keys for the desired architecture and releases
+	for _, version := range alpineVersions {
+		branch := releases.GetReleaseBranch(version)
+		if branch == nil {
+			continue
+		}
+		urls = append(urls, branch.KeysFor(a.arch, time.Now())...)
+	}
+	if len(urls) == 0 {
+		return nil, &NoKeysFoundError{arch: a.arch, releases: alpineVersions}
+	}
+	return urls, nil
+}
+
 func (a *APK) cachePackage(ctx context.Context, pkg InstallablePackage, exp *expandapk.APKExpanded, cacheDir string) (*expandapk.APKExpanded, error) {
 	_, span := otel.Tracer("go-apk").Start(ctx, "cachePackage", trace.WithAttributes(attribute.String("package", pkg.PackageName())))
 	defer span.End()
@@ -809,6 +1258,12 @@ func (a *APK) cachePackage(ctx context.Context, pkg InstallablePackage, exp *exp
 	}
 	exp.TarFile = tarDst
 
+	if a.cache.layout == CacheLayoutExploded {
+		if err := a.cache.explode(exp, cacheDir); err != nil {
+			return nil, fmt.Errorf("exploding %s: %w", pkg.PackageName(), err)
+		}
+	}
+
 	return exp, nil
 }
 
@@ -878,6 +1333,16 @@ func (a *APK) cachedPackage(ctx context.Context, pkg InstallablePackage, cacheDi
 	}
 
 	exp.TarFile = strings.TrimSuffix(exp.PackageFile, ".gz")
+	if a.cache.layout == CacheLayoutExploded {
+		if err := a.cache.loadTree(&exp, filepath.Join(cacheDir, datahash+treeSuffix)); err == nil {
+			return &exp, nil
+		}
+		// e.g. cached with CacheLayoutTar, or the files were evicted from the file store
+		if err := a.cache.explode(&exp, cacheDir); err != nil {
+			return nil, fmt.Errorf("exploding %s: %w", pkg.PackageName(), err)
+		}
+		return &exp, nil
+	}
 	exp.TarFS, err = tarfs.New(exp.PackageData)
 	if err != nil {
 		return nil, err
@@ -901,6 +1366,18 @@ type apkCache struct {
 
 func (c *apkCache) get(ctx context.Context, a *APK, pkg InstallablePackage) (*expandapk.APKExpanded, error) {
 	u := pkg.URL()
+
+	// Forget results whose files have since been evicted from the cache by GC, or that are
+	// cached in another layout than a uses.
+	if v, ok := c.resps.Load(u); ok {
+		result := v.(apkResult)
+		exploded := a.cache.layout == CacheLayoutExploded
+		if result.exp != nil && (!expandedExists(result.exp) || (result.exp.TreeFile != "") != exploded) {
+			c.resps.Delete(u)
+			c.onces.Delete(u)
+		}
+	}
+
 	// Do all the expensive things inside the once.
 	once, _ := c.onces.LoadOrStore(u, &sync.Once{})
 	once.(*sync.Once).Do(func() {
@@ -913,74 +1390,153 @@ func (c *apkCache) get(ctx context.Context, a *APK, pkg InstallablePackage) (*ex
 
 	v, ok := c.resps.Load(u)
 	if !ok {
-		panic(fmt.Errorf("did not see apk %q after writing it", u))
+		// Another goroutine forgot the result after we saw it; try again.
+		return c.get(ctx, a, pkg)
 	}
 
 	result := v.(apkResult)
 	return result.exp, result.err
 }
 
+// expandedExists returns whether the files backing exp still exist.
+func expandedExists(exp *expandapk.APKExpanded) bool {
+	for _, f := range []string{exp.ControlFile, exp.PackageFile, exp.TreeFile} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
 func (a *APK) expandPackage(ctx context.Context, pkg InstallablePackage) (*expandapk.APKExpanded, error) {
+	var (
+		exp *expandapk.APKExpanded
+		err error
+	)
 	if a.cache == nil {
 		// If we don't have a cache configured, don't use the global cache.
 		// Calling APKExpanded.Close() will clean up a tempdir.
 		// This is fine when we have a cache because we move all the backing files into the cache.
 		// This is not fine when we don't have a cache because the tempdir contains all our state.
-		return expandPackage(ctx, a, pkg)
+		exp, err = expandPackage(ctx, a, pkg)
+	} else {
+		exp, err = globalApkCache.get(ctx, a, pkg)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return globalApkCache.get(ctx, a, pkg)
+	a.emit(ctx, &PackageDownloaded{Package: pkg.PackageName(), URL: pkg.URL(), Size: exp.Size})
+	return exp, nil
 }
 
 func expandPackage(ctx context.Context, a *APK, pkg InstallablePackage) (*expandapk.APKExpanded, error) {
-	log := clog.FromContext(ctx)
+	log := a.log(ctx)
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "expandPackage", trace.WithAttributes(attribute.String("package", pkg.PackageName())))
 	defer span.End()
 
 	cacheDir := ""
 	if a.cache != nil {
 		var err error
-		cacheDir, err = cacheDirForPackage(a.cache.dir, pkg)
+		cacheDir, err = a.cache.packageCacheDir(pkg)
 		if err != nil {
 			return nil, err
 		}
 
+		// Other processes may be populating the same entry; wait for them so we can use
+		// their result instead of downloading it again.
+		unlock, err := lockCacheEntry(ctx, cacheDir)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+
 		exp, err := a.cachedPackage(ctx, pkg, cacheDir)
 		if err == nil {
 			log.Debugf("cache hit (%s)", pkg.PackageName())
+			a.cache.hit(exp.ControlFile, exp.SignatureFile, exp.PackageFile, exp.TreeFile)
 			return exp, nil
 		}
 
 		log.Debugf("cache miss (%s): %v", pkg.PackageName(), err)
+		a.cache.miss(ctx)
 
 		if err := os.MkdirAll(cacheDir, 0o755); err != nil {
 			return nil, fmt.Errorf("unable to create cache directory %q: %w", cacheDir, err)
 		}
 	}
 
-	rc, err := a.FetchPackage(ctx, pkg)
+	exp, err := a.fetchAndExpand(ctx, pkg, cacheDir)
 	if err != nil {
-		return nil, fmt.Errorf("fetching package %q: %w", pkg.PackageName(), err)
-	}
-	defer rc.Close()
-
-	exp, err := expandapk.ExpandApk(ctx, rc, cacheDir)
-	if err != nil {
-		return nil, fmt.Errorf("expanding %s: %w", pkg.PackageName(), err)
+		return nil, err
 	}
 
 	// If we don't have a cache, we're done.
 	if a.cache == nil {
 		return exp, nil
 	}
+	a.cache.stats.bytesDownloaded.Add(exp.Size)
 
 	return a.cachePackage(ctx, pkg, exp, cacheDir)
 }
 
+// maxPackageFetches is how many times a package that is corrupted is fetched, see
+// fetchAndExpand.
+const maxPackageFetches = 2
+
+// fetchAndExpand fetches pkg, expands it into cacheDir and verifies it against its checksums,
+// see verifyDownload, before it is cached or installed. A remote package that cannot be
+// expanded or does not match may be a corrupted or stale copy, in the cache or on a mirror:
+// it is evicted from the cache and fetched again.
+func (a *APK) fetchAndExpand(ctx context.Context, pkg InstallablePackage, cacheDir string) (*expandapk.APKExpanded, error) {
+	log := a.log(ctx)
+	remote := a.isRemote(pkg.URL())
+	for attempt := 1; ; attempt++ {
+		rc, err := a.FetchPackage(ctx, pkg)
+		if err != nil {
+			return nil, fmt.Errorf("fetching package %q: %w", pkg.PackageName(), err)
+		}
+		exp, err := expandapk.ExpandApk(ctx, rc, cacheDir)
+		rc.Close()
+		if err != nil {
+			err = fmt.Errorf("expanding %s: %w", pkg.PackageName(), err)
+		} else if err = a.verifyDownload(pkg, exp); err != nil {
+			exp.Close()
+			err = fmt.Errorf("verifying %s: %w", pkg.PackageName(), err)
+		} else {
+			return exp, nil
+		}
+
+		if !remote || attempt == maxPackageFetches || errors.Is(err, expandapk.ErrADBPackage) || ctx.Err() != nil {
+			return nil, err
+		}
+		log.Warnf("fetching %s again: %v", pkg.PackageName(), err)
+		a.evictPackage(pkg)
+	}
+}
+
+// evictPackage removes the package file of pkg from the cache, if it is there.
+func (a *APK) evictPackage(pkg InstallablePackage) {
+	if a.cache == nil {
+		return
+	}
+	u, err := packageAsURL(pkg)
+	if err != nil {
+		return
+	}
+	if cacheFile, err := cachePathFromURL(a.cache.dir, *u); err == nil {
+		_ = os.Remove(cacheFile)
+	}
+}
+
 func packageAsURI(pkg InstallablePackage) (uri.URI, error) {
 	u := pkg.URL()
 
-	if strings.HasPrefix(u, "https://") {
+	// https:// and the URLs of the schemes with handlers, see WithSchemeHandler
+	if strings.Contains(u, "://") {
 		return uri.Parse(u)
 	}
 
@@ -997,7 +1553,8 @@ func packageAsURL(pkg InstallablePackage) (*url.URL, error) {
 }
 
 func (a *APK) FetchPackage(ctx context.Context, pkg InstallablePackage) (io.ReadCloser, error) {
-	log := clog.FromContext(ctx)
+	ctx = a.logContext(ctx)
+	log := a.log(ctx)
 	log.Debugf("fetching %s", pkg)
 
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "fetchPackage", trace.WithAttributes(attribute.String("package", pkg.PackageName())))
@@ -1013,17 +1570,17 @@ func (a *APK) FetchPackage(ctx context.Context, pkg InstallablePackage) (io.Read
 		return nil, fmt.Errorf("failed to parse package as URL: %w", err)
 	}
 
-	switch asURL.Scheme {
-	case "file":
+	switch {
+	case asURL.Scheme == "file":
 		f, err := os.Open(u)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read repository package apk %s: %w", u, err)
 		}
 		return f, nil
-	case "https":
+	case a.isRemote(u):
 		client := a.client
 		if client == nil {
-			client = retryablehttp.NewClient().StandardClient()
+			client = a.httpConfig.client()
 		}
 		if a.cache != nil {
 			client = a.cache.client(client, false)
@@ -1053,6 +1610,29 @@ type WriteHeaderer interface {
 	WriteHeader(hdr tar.Header, tfs fs.FS, pkg *Package) (bool, error)
 }
 
+// installablePackageInfo returns the package to install for pkg, expanded in exp, from its
+// .PKGINFO, or nil if it is already installed.
+func (a *APK) installablePackageInfo(pkg InstallablePackage, exp *expandapk.APKExpanded) (*Package, error) {
+	isInstalled, err := a.isInstalledPackage(pkg.PackageName())
+	if err != nil {
+		return nil, fmt.Errorf("error checking if package %s is installed: %w", pkg, err)
+	}
+
+	if isInstalled {
+		return nil, nil
+	}
+
+	// The data in .PKGINFO is more complete than what is in APKINDEX.
+	pkgInfo, err := packageInfo(exp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .PKGINFO for %s: %w", pkg, err)
+	}
+	if rp, ok := pkg.(*RepositoryPackage); ok {
+		mergeProvenance(pkgInfo, rp.Package)
+	}
+	return pkgInfo, nil
+}
+
 func packageInfo(exp *expandapk.APKExpanded) (*Package, error) {
 	f, err := exp.ControlFS.Open(".PKGINFO")
 	if err != nil {
@@ -1060,26 +1640,17 @@ func packageInfo(exp *expandapk.APKExpanded) (*Package, error) {
 	}
 	defer f.Close()
 
-	cfg, err := ini.ShadowLoad(f)
+	info, err := pkginfo.Parse(f)
 	if err != nil {
-		return nil, fmt.Errorf("ini.ShadowLoad(): %w", err)
-	}
-
-	pkg := new(Package)
-	if err = cfg.MapTo(pkg); err != nil {
-		return nil, fmt.Errorf("cfg.MapTo(): %w", err)
+		return nil, fmt.Errorf("parsing .PKGINFO in %s: %w", exp.ControlFile, err)
 	}
-	pkg.BuildTime = time.Unix(pkg.BuildDate, 0).UTC()
-	pkg.InstalledSize = pkg.Size
-	pkg.Size = uint64(exp.Size)
-	pkg.Checksum = exp.ControlHash
 
-	return pkg, nil
+	return packageFromPkgInfo(info, exp), nil
 }
 
 // installPackage installs a single package and updates installed db.
 func (a *APK) installPackage(ctx context.Context, pkg *Package, expanded *expandapk.APKExpanded, sourceDateEpoch *time.Time) ([]tar.Header, error) {
-	log := clog.FromContext(ctx)
+	log := a.log(ctx)
 	log.Infof("installing %s (%s)", pkg.Name, pkg.Version)
 
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "installPackage", trace.WithAttributes(attribute.String("package", pkg.Name)))
@@ -1087,16 +1658,42 @@ func (a *APK) installPackage(ctx context.Context, pkg *Package, expanded *expand
 
 	defer expanded.Close()
 
+	if err := a.runScript(ctx, pkg, expanded, scriptPreInstall); err != nil {
+		return nil, err
+	}
+
+	installedFiles, err := a.extractPackage(ctx, pkg, expanded)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.completePackage(ctx, pkg, expanded, installedFiles, sourceDateEpoch); err != nil {
+		return nil, err
+	}
+	return installedFiles, nil
+}
+
+// extractPackage writes the files of pkg, from expanded, and returns them. Packages whose
+// files are disjoint may be extracted concurrently, see installConcurrently.
+func (a *APK) extractPackage(ctx context.Context, pkg *Package, expanded *expandapk.APKExpanded) ([]tar.Header, error) {
 	var (
 		err            error
 		installedFiles []tar.Header
 	)
 
-	if wh, ok := a.fs.(WriteHeaderer); ok {
+	if wh, ok := a.fs.(WriteHeaderer); ok && a.extractTarget == nil {
 		installedFiles, err = a.lazilyInstallAPKFiles(ctx, wh, expanded.TarFS, pkg)
 		if err != nil {
 			return nil, fmt.Errorf("unable to install files for pkg %s: %w", pkg.Name, err)
 		}
+	} else if expanded.TreeFile != "" {
+		// exploded in the cache, see CacheLayoutExploded
+		entries := newTreeEntries(expanded.TarFS)
+		defer entries.Close()
+		installedFiles, err = a.installAPKEntries(ctx, entries, pkg)
+		if err != nil {
+			return nil, fmt.Errorf("unable to install files for pkg %s: %w", pkg.Name, err)
+		}
 	} else {
 		packageData, err := expanded.PackageData()
 		if err != nil {
@@ -1110,26 +1707,43 @@ func (a *APK) installPackage(ctx context.Context, pkg *Package, expanded *expand
 		}
 	}
 
+	return installedFiles, nil
+}
+
+// completePackage records the extracted pkg, whose files are installedFiles, in the
+// omitted file, scripts.tar and the triggers, then runs its post-install script. Packages
+// are completed in order, even if they were extracted concurrently.
+func (a *APK) completePackage(ctx context.Context, pkg *Package, expanded *expandapk.APKExpanded, installedFiles []tar.Header, sourceDateEpoch *time.Time) error {
+	a.emit(ctx, &PackageExtracted{Package: pkg, Files: len(installedFiles)})
+
+	if err := a.writeOmitted(pkg, a.takeOmitted(pkg)); err != nil {
+		return fmt.Errorf("unable to update omitted files for pkg %s: %w", pkg.Name, err)
+	}
+
 	// update the scripts.tar
 	controlData, err := os.Open(expanded.ControlFile)
 	if err != nil {
-		return nil, fmt.Errorf("opening control file %q: %w", expanded.ControlFile, err)
+		return fmt.Errorf("opening control file %q: %w", expanded.ControlFile, err)
 	}
 	defer controlData.Close()
 
 	if err := a.updateScriptsTar(pkg, controlData, sourceDateEpoch); err != nil {
-		return nil, fmt.Errorf("unable to update scripts.tar for pkg %s: %w", pkg.Name, err)
+		return fmt.Errorf("unable to update scripts.tar for pkg %s: %w", pkg.Name, err)
 	}
 
 	// update the triggers
 	if _, err := controlData.Seek(0, 0); err != nil {
-		return nil, fmt.Errorf("unable to seek to start of control data for pkg %s: %w", pkg.Name, err)
+		return fmt.Errorf("unable to seek to start of control data for pkg %s: %w", pkg.Name, err)
 	}
 	if err := a.updateTriggers(pkg, controlData); err != nil {
-		return nil, fmt.Errorf("unable to update triggers for pkg %s: %w", pkg.Name, err)
+		return fmt.Errorf("unable to update triggers for pkg %s: %w", pkg.Name, err)
 	}
 
-	return installedFiles, nil
+	if err := a.runScript(ctx, pkg, expanded, scriptPostInstall); err != nil {
+		a.log(ctx).Warnf("%v", err)
+	}
+
+	return nil
 }
 
 func (a *APK) datahash(controlTarGz io.Reader) (string, error) {
@@ -27,6 +27,7 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -337,8 +338,9 @@ func TestFetchPackage(t *testing.T) {
 		err := os.MkdirAll(repoDir, 0o755)
 		require.NoError(t, err, "unable to mkdir cache")
 
-		cacheApkFile := filepath.Join(repoDir, testPkgFilename)
-		cacheApkDir := strings.TrimSuffix(cacheApkFile, ".apk")
+		// packages with a checksum are stored by it, not by their URL
+		cacheApkDir, ok := packageStoreDirForPackage(tmpDir, pkg)
+		require.True(t, ok, "package has no checksum")
 
 		a.SetClient(&http.Client{
 			Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
@@ -462,3 +464,49 @@ func TestFetchPackage(t *testing.T) {
 		require.Equal(t, apk1, apk2, "apk files do not match")
 	})
 }
+
+// testArchTransport serves the index of each arch from its own directory.
+type testArchTransport map[string]string
+
+func (t testArchTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	arch := filepath.Base(filepath.Dir(request.URL.Path))
+	return (&testLocalTransport{root: t[arch], basenameOnly: true}).RoundTrip(request)
+}
+
+func TestResolveForArchs(t *testing.T) {
+	ctx := context.Background()
+	globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+
+	src := apkfs.NewMemFS()
+	require.NoError(t, src.MkdirAll(keysDirPath, 0o755))
+	for k, v := range testKeys {
+		require.NoError(t, src.WriteFile(filepath.Join(keysDirPath, k), []byte(v), 0o644))
+	}
+	require.NoError(t, src.WriteFile(archFilePath, []byte("x86_64\n"), 0o644))
+	require.NoError(t, src.WriteFile(reposFilePath, []byte(testAlpineRepos), 0o644))
+
+	a, err := New(WithFS(src))
+	require.NoError(t, err)
+	a.SetClient(&http.Client{Transport: testArchTransport{
+		"x86_64":  testPrimaryPkgDir,
+		"aarch64": testAlternatePkgDir,
+	}})
+
+	sets, err := a.ResolveForArchs(ctx, []string{"x86_64", "aarch64"}, []string{"alpine-baselayout"})
+	require.NoError(t, err)
+	require.Len(t, sets, 2)
+	for arch, version := range map[string]string{"x86_64": "3.2.0-r23", "aarch64": "3.4.0-r0"} {
+		var found bool
+		for _, pkg := range sets[arch] {
+			if pkg.Name == "alpine-baselayout" {
+				found = true
+				require.Equal(t, version, pkg.Version, arch)
+				require.Contains(t, pkg.URL(), "/"+arch+"/", arch)
+			}
+		}
+		require.True(t, found, arch)
+	}
+
+	_, err = a.ResolveForArchs(ctx, []string{"x86_64", "riscv64"}, []string{"alpine-baselayout"})
+	require.ErrorContains(t, err, "riscv64")
+}
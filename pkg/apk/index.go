@@ -18,6 +18,7 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
@@ -25,22 +26,22 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"regexp"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/klauspost/compress/gzip"
 
+	"github.com/chainguard-dev/go-apk/pkg/adb"
 	sign "github.com/chainguard-dev/go-apk/pkg/signature"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/go-retryablehttp"
 	"go.lsp.dev/uri"
 	"go.opentelemetry.io/otel"
+	"golang.org/x/exp/maps"
+	"golang.org/x/sync/errgroup"
 )
 
-var signatureFileRegex = regexp.MustCompile(`^\.SIGN\.RSA\.(.*\.rsa\.pub)$`)
-
 // This is terrible but simpler than plumbing around a cache for now.
 // We just hold the parsed index in memory rather than re-parsing it every time,
 // which requires gunzipping, which is (somewhat) expensive.
@@ -53,53 +54,85 @@ type indexResult struct {
 	err error
 }
 
+// indexEntry is a remote index, fetched once.
+type indexEntry struct {
+	once sync.Once
+	indexResult
+}
+
+// An index is cached by its URL and how it was verified, see indexCacheKey, so that one that
+// was fetched without verifying its signature, or with other keys, is not used unverified.
 type indexCache struct {
-	// For remote indexes.
+	// For remote indexes, cache key -> *indexEntry.
 	onces sync.Map
 
-	// For local indexes.
+	// For local indexes, cache key -> modtime.
 	sync.Mutex
 	modtimes map[string]time.Time
 
-	// repoBase -> indexResult
+	// For local indexes, cache key -> indexResult.
 	indexes sync.Map
 }
 
+// indexCacheKey returns the key of the index at u in the indexCache, fetched with keys and
+// opts: its URL, with whether its signature is verified and, if it is, the digest of keys.
+func indexCacheKey(u string, keys map[string][]byte, opts *indexOpts) string {
+	if opts.ignoreSignatures {
+		return u + " unverified"
+	}
+	names := maps.Keys(keys)
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00%d\x00", name, len(keys[name]))
+		h.Write(keys[name])
+	}
+	return fmt.Sprintf("%s keys=%x", u, h.Sum(nil))
+}
+
 func (i *indexCache) get(ctx context.Context, u string, keys map[string][]byte, arch string, opts *indexOpts) (*APKIndex, error) {
-	if strings.HasPrefix(u, "https://") {
+	key := indexCacheKey(u, keys, opts)
+	if isRemote(u, opts.schemes) {
 		// We don't want remote indexes to change while we're running.
-		once, _ := i.onces.LoadOrStore(u, &sync.Once{})
-		once.(*sync.Once).Do(func() {
-			idx, err := getRepositoryIndex(ctx, u, keys, arch, opts)
-			i.indexes.Store(u, indexResult{
-				idx: idx,
-				err: err,
-			})
+		v, _ := i.onces.LoadOrStore(key, &indexEntry{})
+		e := v.(*indexEntry)
+		e.once.Do(func() {
+			e.idx, e.err = getRepositoryIndex(ctx, u, keys, arch, opts)
 		})
-	} else {
-		i.Lock()
-		defer i.Unlock()
-
-		// We do expect local indexes to change, so we check modtimes.
-		stat, err := os.Stat(u)
-		if err != nil {
-			return nil, nil
+		if errors.Is(e.err, context.Canceled) || errors.Is(e.err, context.DeadlineExceeded) {
+			// The fetch was cancelled rather than failed, e.g. as another repository of the
+			// caller that started it failed: forget it, so that the index is fetched again,
+			// now for callers whose context is still live.
+			i.onces.CompareAndDelete(key, e)
+			if ctx.Err() == nil {
+				return i.get(ctx, u, keys, arch, opts)
+			}
 		}
+		return e.idx, e.err
+	}
 
-		mod := stat.ModTime()
-		before, ok := i.modtimes[u]
-		if !ok || mod.After(before) {
-			// If this is the first time or it has changed since the last time...
-			idx, err := getRepositoryIndex(ctx, u, keys, arch, opts)
-			i.indexes.Store(u, indexResult{
-				idx: idx,
-				err: err,
-			})
-			i.modtimes[u] = mod
-		}
+	i.Lock()
+	defer i.Unlock()
+
+	// We do expect local indexes to change, so we check modtimes.
+	stat, err := os.Stat(u)
+	if err != nil {
+		return nil, nil
+	}
+
+	mod := stat.ModTime()
+	before, ok := i.modtimes[key]
+	if !ok || mod.After(before) {
+		// If this is the first time or it has changed since the last time...
+		idx, err := getRepositoryIndex(ctx, u, keys, arch, opts)
+		i.indexes.Store(key, indexResult{
+			idx: idx,
+			err: err,
+		})
+		i.modtimes[key] = mod
 	}
 
-	v, ok := i.indexes.Load(u)
+	v, ok := i.indexes.Load(key)
 	if !ok {
 		panic(fmt.Errorf("did not see index %q after writing it", u))
 	}
@@ -108,13 +141,29 @@ func (i *indexCache) get(ctx context.Context, u string, keys map[string][]byte,
 	return result.idx, result.err
 }
 
+// SignatureVerification is how the signature of an index was verified when it was fetched,
+// see SignedIndex, for audits to tell which key verified which index.
+type SignatureVerification struct {
+	// KeyName is the name of the key that verified the index. It may not be the key that
+	// the signature names, when another key verified it.
+	KeyName string
+	// Algorithm is the algorithm of the signature.
+	Algorithm sign.Algorithm
+	// VerifiedAt is when the signature was verified.
+	VerifiedAt time.Time
+	// Skipped is true when the signature was not verified, as signatures were ignored.
+	Skipped bool
+}
+
 // IndexURL full URL to the index file for the given repo and arch
+// The arch is normalized with ArchToAPK.
 func IndexURL(repo, arch string) string {
-	return fmt.Sprintf("%s/%s/%s", repo, arch, indexFilename)
+	return fmt.Sprintf("%s/%s/%s", repo, ArchToAPK(arch), indexFilename)
 }
 
 // GetRepositoryIndexes returns the indexes for the named repositories, keys and archs.
-// The signatures for each index are verified unless ignoreSignatures is set to true.
+// The signatures for each index are verified unless ignoreSignatures is set to true, or the
+// repository is matched by WithIgnoreSignaturesFor.
 // The key-value pairs in the map for `keys` are the name of the key and the contents of the key.
 // The name is just indicative. If it finds a match, it will use it. Else, it will try all keys.
 func GetRepositoryIndexes(ctx context.Context, repos []string, keys map[string][]byte, arch string, options ...IndexOption) (indexes []NamedIndex, err error) {
@@ -125,52 +174,144 @@ func GetRepositoryIndexes(ctx context.Context, repos []string, keys map[string][
 	for _, opt := range options {
 		opt(opts)
 	}
+	arch = ArchToAPK(arch)
 
-	for _, repo := range repos {
-		// does it start with a pin?
-		var (
-			repoName string
-			repoURL  = repo
-		)
-		if strings.HasPrefix(repo, "@") {
-			// it's a pinned repository, get the name
-			parts := strings.Fields(repo)
-			if len(parts) < 2 {
-				return nil, fmt.Errorf("invalid repository line: %q", repo)
-			}
-			repoName = parts[0][1:]
-			repoURL = parts[1]
-		}
-
-		u := IndexURL(repoURL, arch)
-		repoBase := fmt.Sprintf("%s/%s", repoURL, arch)
+	parallelism := opts.parallelism
+	if parallelism <= 0 {
+		parallelism = defaultIndexParallelism
+	}
 
-		index, err := globalIndexCache.get(ctx, u, keys, arch, opts)
-		if err != nil {
+	// a tagged repository only provides packages pinned to its tag
+	repoNames, repoURLs := make([]string, len(repos)), make([]string, len(repos))
+	for i, repo := range repos {
+		if repoNames[i], repoURLs[i], err = ParseRepositoryLine(repo); err != nil {
 			return nil, err
 		}
+	}
 
-		// Can happen for fs.ErrNotExist in file scheme, we just ignore it.
-		if index == nil {
-			continue
+	// Fetch and verify the indexes concurrently, but keep them in the order of repos.
+	results := make([]NamedIndex, len(repos))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(parallelism)
+	for i := range repos {
+		i, repoName, repoURL := i, repoNames[i], repoURLs[i]
+
+		repoOpts := opts
+		if !opts.ignoreSignatures && opts.unsigned != nil && opts.unsigned(repoURL) {
+			unsigned := *opts
+			unsigned.ignoreSignatures = true
+			repoOpts = &unsigned
 		}
 
-		repoRef := Repository{URI: repoBase}
-		indexes = append(indexes, NewNamedRepositoryWithIndex(repoName, repoRef.WithIndex(index)))
+		g.Go(func() error {
+			u := IndexURL(repoURL, arch)
+			repoBase := fmt.Sprintf("%s/%s", repoURL, arch)
+
+			start := time.Now()
+			var (
+				index *APKIndex
+				err   error
+			)
+			if len(opts.shardNames) != 0 {
+				if index, err = getShardedIndex(gctx, repoBase, keys, arch, repoOpts); err != nil {
+					return err
+				}
+			}
+			if index == nil {
+				if index, err = globalIndexCache.get(gctx, u, keys, arch, repoOpts); err != nil {
+					return err
+				}
+			}
+			opts.metrics.indexFetched(gctx, repoBase, time.Since(start))
+
+			// Can happen for fs.ErrNotExist in file scheme, we just ignore it.
+			if index == nil {
+				return nil
+			}
+
+			// Packages for other architectures can't be installed, but noarch ones can;
+			// they are served from the directory of every arch, like the rest.
+			repoRef := Repository{URI: repoBase}
+			results[i] = NewNamedRepositoryWithIndex(repoName, repoRef.WithIndex(filterIndexForArch(index, arch)))
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	for _, index := range results {
+		if index != nil {
+			indexes = append(indexes, index)
+		}
 	}
 	return indexes, nil
 }
 
 func getRepositoryIndex(ctx context.Context, u string, keys map[string][]byte, arch string, opts *indexOpts) (*APKIndex, error) {
+	b, err := readRepositoryFile(ctx, u, opts)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if isRemote(u, opts.schemes) {
+			return nil, fmt.Errorf("repository index not found for architecture %s at %s", arch, u)
+		}
+		return nil, nil
+	}
+	digest := sha256.Sum256(b)
+
+	// apk-tools v3 indexes carry their signatures in SIG blocks rather than a tar entry
+	if adb.IsADB(b) {
+		idx, err := adb.ReadIndex(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read repository index at %s: %w", u, err)
+		}
+		verification := SignatureVerification{Skipped: true}
+		if !opts.ignoreSignatures {
+			keyName, alg, err := verifyADBSignatures(idx.Header, idx.ADB, idx.Signatures, keys)
+			if err != nil {
+				return nil, fmt.Errorf("verifying repository index at %s: %w", u, err)
+			}
+			verification = SignatureVerification{KeyName: keyName, Algorithm: alg, VerifiedAt: time.Now()}
+		}
+		index := indexFromADB(idx)
+		index.Verification = verification
+		index.Digest = digest[:]
+		return index, nil
+	}
+
+	// validate the signature
+	verification := SignatureVerification{Skipped: true}
+	if !opts.ignoreSignatures {
+		if verification, err = verifyIndexSignature(b, keys); err != nil {
+			return nil, err
+		}
+	}
+	// with a valid signature, convert it to an ApkIndex
+	index, err := IndexFromArchive(io.NopCloser(bytes.NewReader(b)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read convert repository index bytes to index struct at %s: %w", u, err)
+	}
+	index.Verification = verification
+	index.Digest = digest[:]
+
+	return index, err
+}
+
+// readRepositoryFile reads u, a file in a repository at an https:// URL, a URL of one of the
+// remote schemes of opts, or a local path. The error wraps fs.ErrNotExist when there is no
+// such file.
+func readRepositoryFile(ctx context.Context, u string, opts *indexOpts) ([]byte, error) {
 	// Normalize the repo as a URI, so that local paths
 	// are translated into file:// URLs, allowing them to be parsed
 	// into a url.URL{}.
 	var (
-		b     []byte
 		asURL *url.URL
 		err   error
 	)
-	if strings.HasPrefix(u, "https://") {
+	remote := isRemote(u, opts.schemes)
+	if remote {
 		asURL, err = url.Parse(u)
 	} else {
 		// Attempt to parse non-https elements into URI's so they are translated into
@@ -181,16 +322,14 @@ func getRepositoryIndex(ctx context.Context, u string, keys map[string][]byte, a
 		return nil, fmt.Errorf("failed to parse repo as URI: %w", err)
 	}
 
-	switch asURL.Scheme {
-	case "file":
-		b, err = os.ReadFile(u)
+	switch {
+	case asURL.Scheme == "file":
+		b, err := os.ReadFile(u)
 		if err != nil {
-			if !errors.Is(err, fs.ErrNotExist) {
-				return nil, fmt.Errorf("failed to read repository %s: %w", u, err)
-			}
-			return nil, nil
+			return nil, fmt.Errorf("failed to read repository %s: %w", u, err)
 		}
-	case "https":
+		return b, nil
+	case remote:
 		client := opts.httpClient
 		if client == nil {
 			rhttp := retryablehttp.NewClient()
@@ -212,104 +351,39 @@ func getRepositoryIndex(ctx context.Context, u string, keys map[string][]byte, a
 		rrt := newRangeRetryTransport(ctx, client)
 		res, err := rrt.RoundTrip(req)
 		if err != nil {
-			return nil, fmt.Errorf("unable to get repository index at %s: %w", u, err)
+			return nil, fmt.Errorf("unable to get %s: %w", u, err)
 		}
+		defer res.Body.Close()
 		switch res.StatusCode {
 		case http.StatusOK:
 			// this is fine
 		case http.StatusNotFound:
-			return nil, fmt.Errorf("repository index not found for architecture %s at %s", arch, u)
+			return nil, fmt.Errorf("%s: %w", u, fs.ErrNotExist)
 		default:
-			return nil, fmt.Errorf("unexpected status code %d when getting repository index for architecture %s at %s", res.StatusCode, arch, u)
+			return nil, fmt.Errorf("unexpected status code %d when getting %s", res.StatusCode, u)
 		}
-		defer res.Body.Close()
 		buf := bytes.NewBuffer(nil)
 		if _, err := io.Copy(buf, res.Body); err != nil {
-			return nil, fmt.Errorf("unable to read repository index at %s: %w", u, err)
+			return nil, fmt.Errorf("unable to read %s: %w", u, err)
 		}
-		b = buf.Bytes()
+		return buf.Bytes(), nil
 	default:
 		return nil, fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
 	}
-
-	// validate the signature
-	if !opts.ignoreSignatures {
-		buf := bytes.NewReader(b)
-		gzipReader, err := gzip.NewReader(buf)
-		if err != nil {
-			return nil, fmt.Errorf("unable to create gzip reader for repository index: %w", err)
-		}
-		// set multistream to false, so we can read each part separately;
-		// the first part is the signature, the second is the index, which should be
-		// verified.
-		gzipReader.Multistream(false)
-		defer gzipReader.Close()
-
-		tarReader := tar.NewReader(gzipReader)
-
-		// read the signature
-		signatureFile, err := tarReader.Next()
-		if err != nil {
-			return nil, fmt.Errorf("failed to read signature from repository index: %w", err)
-		}
-		matches := signatureFileRegex.FindStringSubmatch(signatureFile.Name)
-		if len(matches) != 2 {
-			return nil, fmt.Errorf("failed to find key name in signature file name: %s", signatureFile.Name)
-		}
-		signature, err := io.ReadAll(tarReader)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read signature from repository index: %w", err)
-		}
-		// with multistream false, we should read the next one
-		if _, err := tarReader.Next(); err != nil && !errors.Is(err, io.EOF) {
-			return nil, fmt.Errorf("unexpected error reading from tgz: %w", err)
-		}
-		// we now have the signature bytes and name, get the contents of the rest;
-		// this should be everything else in the raw gzip file as is.
-		allBytes := len(b)
-		unreadBytes := buf.Len()
-		readBytes := allBytes - unreadBytes
-		indexData := b[readBytes:]
-
-		indexDigest, err := sign.HashData(indexData)
-		if err != nil {
-			return nil, err
-		}
-		// now we can check the signature
-		if keys == nil {
-			return nil, fmt.Errorf("no keys provided to verify signature")
-		}
-		var verified bool
-		keyData, ok := keys[matches[1]]
-		if ok {
-			if err := sign.RSAVerifySHA1Digest(indexDigest, signature, keyData); err != nil {
-				verified = false
-			}
-		}
-		if !verified {
-			for _, keyData := range keys {
-				if err := sign.RSAVerifySHA1Digest(indexDigest, signature, keyData); err == nil {
-					verified = true
-					break
-				}
-			}
-		}
-		if !verified {
-			return nil, fmt.Errorf("no key found to verify signature for keyfile %s; tried all other keys as well", matches[1])
-		}
-	}
-	// with a valid signature, convert it to an ApkIndex
-	index, err := IndexFromArchive(io.NopCloser(bytes.NewReader(b)))
-	if err != nil {
-		return nil, fmt.Errorf("unable to read convert repository index bytes to index struct at %s: %w", u, err)
-	}
-
-	return index, err
 }
 
+// defaultIndexParallelism is how many indexes are fetched at once unless set with
+// WithParallelism. Fetching indexes is bound by the network, not the CPU.
+const defaultIndexParallelism = 8
+
 type indexOpts struct {
 	ignoreSignatures bool
+	unsigned         func(repoURL string) bool // see WithIgnoreSignaturesFor
 	httpClient       *http.Client
+	parallelism      int
+	shardNames       []string
+	metrics          *metrics
+	schemes          []string
 }
 type IndexOption func(*indexOpts)
 
@@ -319,8 +393,97 @@ func WithIgnoreSignatures(ignoreSignatures bool) IndexOption {
 	}
 }
 
+// WithIgnoreSignaturesFor ignores the signatures of the indexes of the repositories whose
+// URLs, without the tag, match, e.g. a local development repository, and keeps verifying
+// the others.
+func WithIgnoreSignaturesFor(match func(repoURL string) bool) IndexOption {
+	return func(o *indexOpts) {
+		o.unsigned = match
+	}
+}
+
 func WithHTTPClient(c *http.Client) IndexOption {
 	return func(o *indexOpts) {
 		o.httpClient = c
 	}
 }
+
+// WithParallelism sets how many repository indexes are fetched and verified at once.
+func WithParallelism(n int) IndexOption {
+	return func(o *indexOpts) {
+		o.parallelism = n
+	}
+}
+
+// WithRemoteSchemes fetches repositories at URLs of schemes, besides https, with the HTTP
+// client, e.g. "gs" and "s3": the client must rewrite their requests, as the APK does with
+// the handlers set with WithSchemeHandler.
+func WithRemoteSchemes(schemes ...string) IndexOption {
+	return func(o *indexOpts) {
+		o.schemes = schemes
+	}
+}
+
+// withIndexMetrics records the metrics of the index fetches in m.
+func withIndexMetrics(m *metrics) IndexOption {
+	return func(o *indexOpts) {
+		o.metrics = m
+	}
+}
+
+// verifyIndexSignature verifies the signature of b, a signed APKINDEX.tar.gz or another
+// archive signed like it, with keys.
+func verifyIndexSignature(b []byte, keys map[string][]byte) (SignatureVerification, error) {
+	alg, keyName, signature, indexData, err := splitIndexSignature(b)
+	if err != nil {
+		return SignatureVerification{}, err
+	}
+
+	// now we can check the signature
+	if keys == nil {
+		return SignatureVerification{}, fmt.Errorf("no keys provided to verify signature")
+	}
+	verifiedBy, err := sign.VerifyingKey(alg, keyName, indexData, signature, keys)
+	if err != nil {
+		return SignatureVerification{}, err
+	}
+	return SignatureVerification{KeyName: verifiedBy, Algorithm: alg, VerifiedAt: time.Now()}, nil
+}
+
+// splitIndexSignature splits b, a signed APKINDEX.tar.gz, into the algorithm, key name and
+// bytes of its signature, and the signed data.
+func splitIndexSignature(b []byte) (alg sign.Algorithm, keyName string, signature, data []byte, err error) {
+	buf := bytes.NewReader(b)
+	gzipReader, err := gzip.NewReader(buf)
+	if err != nil {
+		return "", "", nil, nil, fmt.Errorf("unable to create gzip reader for repository index: %w", err)
+	}
+	// set multistream to false, so we can read each part separately;
+	// the first part is the signature, the second is the index, which should be
+	// verified.
+	gzipReader.Multistream(false)
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+
+	// read the signature
+	signatureFile, err := tarReader.Next()
+	if err != nil {
+		return "", "", nil, nil, fmt.Errorf("failed to read signature from repository index: %w", err)
+	}
+	alg, keyName, ok := sign.ParseSignatureName(signatureFile.Name)
+	if !ok {
+		return "", "", nil, nil, fmt.Errorf("failed to find key name in signature file name: %s", signatureFile.Name)
+	}
+	signature, err = io.ReadAll(tarReader)
+	if err != nil {
+		return "", "", nil, nil, fmt.Errorf("failed to read signature from repository index: %w", err)
+	}
+	// with multistream false, we should read the next one
+	if _, err := tarReader.Next(); err != nil && !errors.Is(err, io.EOF) {
+		return "", "", nil, nil, fmt.Errorf("unexpected error reading from tgz: %w", err)
+	}
+	// we now have the signature bytes and name, get the contents of the rest;
+	// this should be everything else in the raw gzip file as is.
+	return alg, keyName, signature, b[len(b)-buf.Len():], nil
+}
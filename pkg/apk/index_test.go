@@ -0,0 +1,173 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+// testInFlightTransport serves testdata and records the most requests it had in flight.
+type testInFlightTransport struct {
+	wrapped  http.RoundTripper
+	inFlight atomic.Int64
+	max      atomic.Int64
+}
+
+func (t *testInFlightTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	n := t.inFlight.Add(1)
+	defer t.inFlight.Add(-1)
+	for {
+		m := t.max.Load()
+		if n <= m || t.max.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return t.wrapped.RoundTrip(request)
+}
+
+func TestGetRepositoryIndexesConcurrently(t *testing.T) {
+	ctx := context.Background()
+
+	var repos []string
+	for i := 0; i < 6; i++ {
+		repos = append(repos, fmt.Sprintf("https://repo%d.example.com/alpine/main", i))
+	}
+	repos = append(repos, "@tagged https://tagged.example.com/alpine/main")
+
+	for _, parallelism := range []int{1, 3} {
+		t.Run(fmt.Sprint(parallelism), func(t *testing.T) {
+			globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+			transport := &testInFlightTransport{wrapped: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true}}
+
+			indexes, err := GetRepositoryIndexes(ctx, repos, nil, testArch,
+				WithIgnoreSignatures(true),
+				WithHTTPClient(&http.Client{Transport: transport}),
+				WithParallelism(parallelism))
+			require.NoError(t, err)
+
+			require.Len(t, indexes, len(repos))
+			for i, index := range indexes[:6] {
+				require.Equal(t, fmt.Sprintf("https://repo%d.example.com/alpine/main/%s/%s", i, testArch, indexFilename), index.Source())
+				require.Empty(t, index.Name())
+			}
+			require.Equal(t, "tagged", indexes[6].Name())
+			require.Equal(t, int64(parallelism), transport.max.Load())
+		})
+	}
+}
+
+// testFailingRepoTransport fails requests to bad.example.com, and serves testdata to the
+// other hosts after a delay, unless the request is cancelled first.
+type testFailingRepoTransport struct {
+	wrapped http.RoundTripper
+}
+
+func (t *testFailingRepoTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.URL.Host == "bad.example.com" {
+		return &http.Response{StatusCode: http.StatusForbidden, Body: http.NoBody, Request: request}, nil
+	}
+	select {
+	case <-request.Context().Done():
+		return nil, request.Context().Err()
+	case <-time.After(200 * time.Millisecond):
+	}
+	return t.wrapped.RoundTrip(request)
+}
+
+func TestGetRepositoryIndexesFailure(t *testing.T) {
+	ctx := context.Background()
+	globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+	options := []IndexOption{
+		WithIgnoreSignatures(true),
+		WithHTTPClient(&http.Client{Transport: &testFailingRepoTransport{wrapped: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true}}}),
+	}
+
+	// The failure of bad cancels the fetch of good, which is not kept.
+	_, err := GetRepositoryIndexes(ctx, []string{"https://good.example.com/alpine/main", "https://bad.example.com/alpine/main"}, nil, testArch, options...)
+	require.ErrorContains(t, err, "403")
+	indexes, err := GetRepositoryIndexes(ctx, []string{"https://good.example.com/alpine/main"}, nil, testArch, options...)
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+
+	// An invalid repository fetches nothing.
+	_, err = GetRepositoryIndexes(ctx, []string{"https://other.example.com/alpine/main", "@"}, nil, testArch, options...)
+	require.Error(t, err)
+	_, fetched := globalIndexCache.onces.Load(indexCacheKey(IndexURL("https://other.example.com/alpine/main", testArch), nil, &indexOpts{ignoreSignatures: true}))
+	require.False(t, fetched)
+}
+
+func TestIndexSignature(t *testing.T) {
+	ctx := context.Background()
+	globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+
+	tmp := t.TempDir()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	signingKey := filepath.Join(tmp, "test.rsa")
+	require.NoError(t, os.WriteFile(signingKey, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600))
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	pubKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	repo := filepath.Join(tmp, "repo")
+	require.NoError(t, os.MkdirAll(filepath.Join(repo, testArch), 0o755))
+	archive, err := ArchiveFromIndex(&APKIndex{Packages: []*Package{{Name: "hello", Version: "1.0-r0", Arch: testArch}}})
+	require.NoError(t, err)
+	b, err := io.ReadAll(archive)
+	require.NoError(t, err)
+	indexFile := filepath.Join(repo, testArch, indexFilename)
+	require.NoError(t, os.WriteFile(indexFile, b, 0o644))
+	require.NoError(t, sign.SignIndex(ctx, signingKey, indexFile))
+
+	// the key is not named as in the signature, but verifies it
+	before := time.Now()
+	indexes, err := GetRepositoryIndexes(ctx, []string{repo}, map[string][]byte{"other.rsa.pub": pubKey}, testArch)
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+	verification := indexSignature(indexes[0])
+	require.Equal(t, "other.rsa.pub", verification.KeyName)
+	require.NotEmpty(t, verification.Algorithm)
+	require.False(t, verification.VerifiedAt.Before(before))
+	require.False(t, verification.Skipped)
+
+	globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+	indexes, err = GetRepositoryIndexes(ctx, []string{repo}, nil, testArch, WithIgnoreSignatures(true))
+	require.NoError(t, err)
+	require.Equal(t, SignatureVerification{Skipped: true}, indexSignature(indexes[0]))
+
+	// the cached index that was not verified is not used for other keys
+	_, err = GetRepositoryIndexes(ctx, []string{repo}, map[string][]byte{"wrong.rsa.pub": []byte("not a key")}, testArch)
+	require.Error(t, err)
+	indexes, err = GetRepositoryIndexes(ctx, []string{repo}, map[string][]byte{"test.rsa.pub": pubKey}, testArch)
+	require.NoError(t, err)
+	require.Equal(t, "test.rsa.pub", indexSignature(indexes[0]).KeyName)
+}
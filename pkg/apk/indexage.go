@@ -0,0 +1,89 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// StaleIndexMode is what resolving does about indexes that are older than the maximum age
+// set with WithMaxIndexAge.
+type StaleIndexMode int
+
+const (
+	// StaleIndexIgnore does not look at the age of indexes.
+	StaleIndexIgnore StaleIndexMode = iota
+	// StaleIndexWarn logs every index that is too old.
+	StaleIndexWarn
+	// StaleIndexFail fails resolving with a *StaleIndexError when any index is too old.
+	StaleIndexFail
+)
+
+// StaleIndex is an index that is older than the maximum age, see StaleIndexError.
+type StaleIndex struct {
+	Source    string
+	Timestamp time.Time
+}
+
+// StaleIndexError is returned by resolving with StaleIndexFail when indexes are older than
+// the maximum age, e.g. because a mirror stopped syncing.
+type StaleIndexError struct {
+	MaxAge  time.Duration
+	Indexes []StaleIndex
+}
+
+func (e *StaleIndexError) Error() string {
+	stale := make([]string, 0, len(e.Indexes))
+	for _, index := range e.Indexes {
+		stale = append(stale, fmt.Sprintf("%s (built %s)", index.Source, index.Timestamp.UTC().Format(time.RFC3339)))
+	}
+	return fmt.Sprintf("%d index(es) older than %s: %s", len(e.Indexes), e.MaxAge, strings.Join(stale, ", "))
+}
+
+// staleIndexes returns the indexes that were built more than maxAge before now. Indexes
+// whose timestamp is not known are not.
+func staleIndexes(indexes []NamedIndex, maxAge time.Duration, now time.Time) []StaleIndex {
+	var stale []StaleIndex
+	for _, index := range indexes {
+		ts := indexTimestamp(index)
+		if ts.IsZero() || now.Sub(ts) <= maxAge {
+			continue
+		}
+		stale = append(stale, StaleIndex{Source: index.Source(), Timestamp: ts})
+	}
+	return stale
+}
+
+// checkIndexAge checks the age of indexes, before resolving against them, as set with
+// WithMaxIndexAge.
+func (a *APK) checkIndexAge(ctx context.Context, indexes []NamedIndex) error {
+	if a.staleIndexes == StaleIndexIgnore {
+		return nil
+	}
+	stale := staleIndexes(indexes, a.maxIndexAge, time.Now())
+	if len(stale) == 0 {
+		return nil
+	}
+	if a.staleIndexes == StaleIndexFail {
+		return &StaleIndexError{MaxAge: a.maxIndexAge, Indexes: stale}
+	}
+	for _, index := range stale {
+		a.log(ctx).Warnf("index %s was built %s, more than %s ago", index.Source, index.Timestamp.UTC().Format(time.RFC3339), a.maxIndexAge)
+	}
+	return nil
+}
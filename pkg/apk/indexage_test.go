@@ -0,0 +1,75 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestMaxIndexAge(t *testing.T) {
+	ctx := context.Background()
+	globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+
+	built := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	repo := filepath.Join(t.TempDir(), "repo")
+	require.NoError(t, os.MkdirAll(filepath.Join(repo, "x86_64"), 0o755))
+	archive, err := ArchiveFromIndex(&APKIndex{Timestamp: built, Packages: []*Package{{Name: "hello", Version: "1.0-r0", Arch: "x86_64"}}})
+	require.NoError(t, err)
+	b, err := io.ReadAll(archive)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "x86_64", indexFilename), b, 0o644))
+
+	newAPK := func(options ...Option) *APK {
+		a, err := New(append([]Option{WithFS(apkfs.NewMemFS()), WithArch("x86_64")}, options...)...)
+		require.NoError(t, err)
+		require.NoError(t, a.InitDB(ctx))
+		a.ignoreSignatures = true
+		require.NoError(t, a.SetRepositories(ctx, []string{repo}))
+		require.NoError(t, a.SetWorld(ctx, []string{"hello"}))
+		return a
+	}
+
+	indexes, err := newAPK().GetRepositoryIndexes(ctx, true)
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+	require.True(t, built.Equal(indexTimestamp(indexes[0])), indexTimestamp(indexes[0]))
+
+	// fresh enough
+	_, _, err = newAPK(WithMaxIndexAge(72*time.Hour, StaleIndexFail)).ResolveWorld(ctx)
+	require.NoError(t, err)
+
+	_, _, err = newAPK(WithMaxIndexAge(24*time.Hour, StaleIndexWarn)).ResolveWorld(ctx)
+	require.NoError(t, err)
+
+	_, _, err = newAPK(WithMaxIndexAge(24*time.Hour, StaleIndexFail)).ResolveWorld(ctx)
+	var staleErr *StaleIndexError
+	require.True(t, errors.As(err, &staleErr), "expected a StaleIndexError, got %v", err)
+	require.Equal(t, 24*time.Hour, staleErr.MaxAge)
+	require.Len(t, staleErr.Indexes, 1)
+	require.True(t, built.Equal(staleErr.Indexes[0].Timestamp))
+
+	_, err = New(WithMaxIndexAge(0, StaleIndexFail))
+	require.Error(t, err)
+}
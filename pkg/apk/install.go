@@ -24,16 +24,18 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"strings"
 
 	"go.opentelemetry.io/otel"
 
 	"github.com/chainguard-dev/go-apk/internal/tarfs"
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
 )
 
 // writeOneFile writes one file from the APK given the tar header and tar reader.
-func (a *APK) writeOneFile(header *tar.Header, r io.Reader, allowOverwrite bool) error {
+func (a *APK) writeOneFile(header *tar.Header, r io.Reader, checksum []byte, allowOverwrite bool) error {
 	// check if the file exists; allow override if the origin i
 	if _, err := a.fs.Stat(header.Name); err == nil {
 		if !allowOverwrite {
@@ -54,6 +56,15 @@ func (a *APK) writeOneFile(header *tar.Header, r io.Reader, allowOverwrite bool)
 			return fmt.Errorf("unable to remove existing file %s: %w", header.Name, err)
 		}
 	}
+	a.setCacheLinked(header.Name, false)
+	if installed, err := a.installFromCache(header, r, checksum); err != nil || installed {
+		return err
+	}
+	return a.createFile(header, r)
+}
+
+// createFile creates the regular file header with content r.
+func (a *APK) createFile(header *tar.Header, r io.Reader) error {
 	f, err := a.fs.OpenFile(header.Name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, header.FileInfo().Mode())
 	if err != nil {
 		return fmt.Errorf("error creating file %s: %w", header.Name, err)
@@ -68,24 +79,19 @@ func (a *APK) writeOneFile(header *tar.Header, r io.Reader, allowOverwrite bool)
 }
 
 // installRegularFile handles the various error modes of writing a regular file
-func (a *APK) installRegularFile(header *tar.Header, tr *tar.Reader, tmpDir string, pkg *Package) (bool, error) {
+func (a *APK) installRegularFile(header *tar.Header, content io.Reader, tmpDir string, pkg *Package) (bool, error) {
 	checksum, err := checksumFromHeader(header)
 	if err != nil {
 		return false, err
 	}
 
-	replaceMap := map[string]struct{}{}
-	for _, r := range pkg.Replaces {
-		replaceMap[r] = struct{}{}
-	}
-
-	var r io.Reader = tr
+	r := content
 
 	if checksum == nil {
 		// There was no checksum header, which is unexpected, but we can just recalculate it.
 
 		w := sha1.New() //nolint:gosec // this is what apk tools is using
-		tee := io.TeeReader(tr, w)
+		tee := io.TeeReader(content, w)
 
 		// we need to calculate the checksum of the file, and then pass it to the writeOneFile,
 		// so we save it to a tempdir and then remove it
@@ -109,10 +115,10 @@ func (a *APK) installRegularFile(header *tar.Header, tr *tar.Reader, tmpDir stri
 		r = f
 	}
 
-	if err := a.writeOneFile(header, r, false); err != nil {
+	if err := a.writeOneFile(header, r, checksum, false); err != nil {
 		// If the error is something other than the file exists, return the error.
 		var fileExistsError FileExistsError
-		if !errors.As(err, &fileExistsError) || pkg.Origin == "" {
+		if !errors.As(err, &fileExistsError) {
 			return false, err
 		}
 
@@ -123,28 +129,25 @@ func (a *APK) installRegularFile(header *tar.Header, tr *tar.Reader, tmpDir stri
 		}
 
 		// If the files are not identical, then we can overwrite the file in two situations:
-		// 1. One of the packages replaces the other.
+		// 1. The package replaces the other one, see replacesFile.
 		// 2. The packages are in the same origin.
-
-		// If the existing file's package replaces the package we want to install, we don't need to write this file.
-		pk, ok := a.installedFiles[header.Name]
+		pk, ok := a.fileOwner(header.Name)
 		if !ok {
 			return false, fmt.Errorf("found existing file we did not install (this should never happen): %s", header.Name)
 		}
 
-		for _, rep := range pk.Replaces {
-			if pkg.Name == rep {
-				return false, nil
+		switch replacesFile(pk, pkg) {
+		case replaceKeep:
+			// the existing file's package replaces the package we want to install
+			return false, nil
+		case replaceConflict:
+			// With FileConflictsWarn, the conflict was already reported and the last one wins.
+			if a.fileConflicts != FileConflictsWarn {
+				return false, fmt.Errorf("unable to install file over existing one, different contents: %s", header.Name)
 			}
 		}
 
-		// Otherwise, we can only overwrite the file if it's in the same origin or if it replaces the existing package.
-		_, isReplaced := replaceMap[pk.Name]
-		if pk.Origin != pkg.Origin && !isReplaced {
-			return false, fmt.Errorf("unable to install file over existing one, different contents: %s", header.Name)
-		}
-
-		if err := a.writeOneFile(header, r, true); err != nil {
+		if err := a.writeOneFile(header, r, checksum, true); err != nil {
 			return false, err
 		}
 	}
@@ -158,23 +161,92 @@ func (a *APK) installRegularFile(header *tar.Header, tr *tar.Reader, tmpDir stri
 	// apk installed db uses this format
 	header.PAXRecords[paxRecordsChecksumKey] = fmt.Sprintf("Q1%s", base64.StdEncoding.EncodeToString(checksum))
 
-	// xattrs
-	for k, v := range header.PAXRecords {
-		if !strings.HasPrefix(k, xattrTarPAXRecordsPrefix) {
-			continue
+	// A hardlink to the cache already has its owner, and no xattrs, see installFromCache.
+	if a.isCacheLinked(header.Name) {
+		return true, nil
+	}
+	if err := a.chown(header); err != nil {
+		return false, err
+	}
+	if err := a.setXattrs(header); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// fsTarget is the ExtractTarget of the filesystem of the APK.
+type fsTarget struct {
+	a *APK
+	// tmpDir is where files without checksums are spooled to compute them
+	tmpDir string
+}
+
+// WriteEntry writes the entry header of pkg to the filesystem, resolving conflicts with the
+// files already there, see installRegularFile.
+func (t *fsTarget) WriteEntry(header *tar.Header, r io.Reader, pkg *Package) (bool, error) {
+	a := t.a
+	switch header.Typeflag {
+	case tar.TypeDir:
+		// special case, if the target already exists, and it is a symlink to a directory, we can accept it as is
+		// otherwise, we need to create the directory.
+		if fi, err := a.fs.Stat(header.Name); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			if target, err := a.fs.Readlink(header.Name); err == nil {
+				if fi, err = a.fs.Stat(target); err == nil && fi.IsDir() {
+					// "break" rather than "return", so that the directory is recorded
+					break
+				}
+			}
 		}
-		attrName := strings.TrimPrefix(k, xattrTarPAXRecordsPrefix)
-		if err := a.fs.SetXattr(header.Name, attrName, []byte(v)); err != nil {
-			return false, fmt.Errorf("error setting xattr %s on %s: %w", attrName, header.Name, err)
+		if err := a.fs.MkdirAll(header.Name, header.FileInfo().Mode().Perm()); err != nil {
+			return false, fmt.Errorf("error creating directory %s: %w", header.Name, err)
+		}
+		if err := a.chown(header); err != nil {
+			return false, err
+		}
+		if err := a.setXattrs(header); err != nil {
+			return false, err
+		}
+
+	case tar.TypeReg:
+		return a.installRegularFile(header, r, t.tmpDir, pkg)
+
+	case tar.TypeSymlink:
+		// some underlying filesystems and some memfs that we use in tests do not support symlinks.
+		// attempt it, and if it fails, just copy it.
+		// if it already exists, pointing to the same target, we can ignore it
+		if target, err := a.fs.Readlink(header.Name); err == nil && target == header.Linkname {
+			return false, nil
+		}
+		if err := a.fs.Symlink(header.Linkname, header.Name); err != nil {
+			return false, fmt.Errorf("unable to install symlink from %s -> %s: %w", header.Name, header.Linkname, err)
 		}
+	case tar.TypeLink:
+		if err := a.link(header); err != nil {
+			return false, err
+		}
+	default:
+		return false, fmt.Errorf("unsupported file type %s %v", header.Name, header.Typeflag)
 	}
 	return true, nil
 }
 
-// installAPKFiles install the files from the APK and return the list of installed files
-// and their permissions. Returns a tar.Header because it is a convenient existing
-// struct that has all of the fields we need.
+// installAPKFiles install the files from the APK, to the extract target if there is one or
+// else to the filesystem, and return the list of installed files and their permissions.
+// Returns a tar.Header because it is a convenient existing struct that has all of the
+// fields we need.
 func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) ([]tar.Header, error) {
+	return a.installAPKEntries(ctx, tar.NewReader(in), pkg)
+}
+
+// tarEntries are the entries of a package, and their content, read like a tar.Reader reads
+// them, e.g. by treeEntries.
+type tarEntries interface {
+	Next() (*tar.Header, error)
+	io.Reader
+}
+
+// installAPKEntries is installAPKFiles of the entries of a package in tr.
+func (a *APK) installAPKEntries(ctx context.Context, tr tarEntries, pkg *Package) ([]tar.Header, error) {
 	_, span := otel.Tracer("go-apk").Start(ctx, "installAPKFiles")
 	defer span.End()
 
@@ -184,6 +256,10 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) (
 		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
 	}
 	defer os.RemoveAll(tmpDir)
+	target := a.extractTarget
+	if target == nil {
+		target = &fsTarget{a: a, tmpDir: tmpDir}
+	}
 
 	// per https://git.alpinelinux.org/apk-tools/tree/src/extract_v2.c?id=337734941831dae9a6aa441e38611c43a5fd72c0#n120
 	//  * APKv1.0 compatibility - first non-hidden file is
@@ -191,7 +267,6 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) (
 	//  * This does not make any sense if the file has v2.0
 	//  * style .PKGINFO
 	var startedDataSection bool
-	tr := tar.NewReader(in)
 	for {
 		header, err := tr.Next()
 		if errors.Is(err, io.EOF) {
@@ -208,66 +283,182 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) (
 		// whatever it is now, it is in the data section
 		startedDataSection = true
 
-		switch header.Typeflag {
-		case tar.TypeDir:
-			// special case, if the target already exists, and it is a symlink to a directory, we can accept it as is
-			// otherwise, we need to create the directory.
-			if fi, err := a.fs.Stat(header.Name); err == nil && fi.Mode()&os.ModeSymlink != 0 {
-				if target, err := a.fs.Readlink(header.Name); err == nil {
-					if fi, err = a.fs.Stat(target); err == nil && fi.IsDir() {
-						// "break" rather than "continue", so that any handling outside of this switch statement is processed
-						break
-					}
-				}
-			}
-			if err := a.fs.MkdirAll(header.Name, header.FileInfo().Mode().Perm()); err != nil {
-				return nil, fmt.Errorf("error creating directory %s: %w", header.Name, err)
-			}
-			// xattrs
-			for k, v := range header.PAXRecords {
-				if !strings.HasPrefix(k, xattrTarPAXRecordsPrefix) {
-					continue
-				}
-				attrName := strings.TrimPrefix(k, xattrTarPAXRecordsPrefix)
-				if err := a.fs.SetXattr(header.Name, attrName, []byte(v)); err != nil {
-					return nil, fmt.Errorf("error setting xattr %s on %s: %w", attrName, header.Name, err)
-				}
-			}
+		if a.usrMerge {
+			usrMergeHeader(header)
+		}
 
-		case tar.TypeReg:
-			installed, err := a.installRegularFile(header, tr, tmpDir, pkg)
-			if err != nil {
-				return nil, err
-			}
+		if !a.pathFilter.installs(header) {
+			a.omit(pkg, header.Name)
+			continue
+		}
 
-			if installed {
-				a.installedFiles[header.Name] = pkg
-			}
+		var r io.Reader = tr
+		transformed, content, skip, err := a.transformFile(header, tr)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			a.omit(pkg, header.Name)
+			continue
+		}
+		if header = transformed; content != nil {
+			r = content
+		}
 
-		case tar.TypeSymlink:
-			// some underlying filesystems and some memfs that we use in tests do not support symlinks.
-			// attempt it, and if it fails, just copy it.
-			// if it already exists, pointing to the same target, we can ignore it
-			if target, err := a.fs.Readlink(header.Name); err == nil && target == header.Linkname {
-				continue
-			}
-			if err := a.fs.Symlink(header.Linkname, header.Name); err != nil {
-				return nil, fmt.Errorf("unable to install symlink from %s -> %s: %w", header.Name, header.Linkname, err)
-			}
-		case tar.TypeLink:
-			if err := a.fs.Link(header.Linkname, header.Name); err != nil {
-				return nil, err
-			}
-		default:
-			return nil, fmt.Errorf("unsupported file type %s %v", header.Name, header.Typeflag)
+		installed, err := target.WriteEntry(header, r, pkg)
+		if err != nil {
+			return nil, err
+		}
+		if installed && header.Typeflag == tar.TypeReg {
+			a.setFileOwner(header.Name, pkg)
+		}
+		if !installed && header.Typeflag != tar.TypeReg {
+			// e.g. a symlink that is already there
+			continue
 		}
 
 		files = append(files, *header)
 	}
 
+	if a.usrMerge {
+		files = usrMergeParents(files)
+	}
+
 	return files, nil
 }
 
+// omit records that the file name of pkg was not installed, see writeOmitted.
+func (a *APK) omit(pkg *Package, name string) {
+	a.extractMu.Lock()
+	defer a.extractMu.Unlock()
+	if a.omitted == nil {
+		a.omitted = map[*Package][]string{}
+	}
+	a.omitted[pkg] = append(a.omitted[pkg], name)
+}
+
+// takeOmitted returns the files of pkg that were not installed, and forgets them.
+func (a *APK) takeOmitted(pkg *Package) []string {
+	a.extractMu.Lock()
+	defer a.extractMu.Unlock()
+	omitted := a.omitted[pkg]
+	delete(a.omitted, pkg)
+	return omitted
+}
+
+// fileOwner returns the package that installed the regular file name, if any.
+func (a *APK) fileOwner(name string) (*Package, bool) {
+	a.extractMu.Lock()
+	defer a.extractMu.Unlock()
+	pkg, ok := a.installedFiles[name]
+	return pkg, ok
+}
+
+// setFileOwner records that pkg installed the regular file name.
+func (a *APK) setFileOwner(name string, pkg *Package) {
+	a.extractMu.Lock()
+	defer a.extractMu.Unlock()
+	a.installedFiles[name] = pkg
+}
+
+// supports reports whether a.fs supports feature, see apkfs.FeatureFS.
+func (a *APK) supports(feature apkfs.Feature) bool {
+	if ffs, ok := a.fs.(apkfs.FeatureFS); ok {
+		return ffs.Supports(feature)
+	}
+	return true
+}
+
+// chown sets the owner of an installed file to the one in its header, if it is not root, or
+// by the id maps, see WithIDMap.
+func (a *APK) chown(header *tar.Header) error {
+	if a.idMapped {
+		return a.chownMapped(header)
+	}
+	if header.Uid == 0 && header.Gid == 0 {
+		return nil
+	}
+	if !a.supports(apkfs.FeatureOwnership) {
+		if a.ignoreChownErrors {
+			return nil
+		}
+		return fmt.Errorf("unable to set owner %d:%d of %s: not supported by the filesystem", header.Uid, header.Gid, header.Name)
+	}
+	if err := a.fs.Chown(header.Name, header.Uid, header.Gid); err != nil && !a.ignoreChownErrors {
+		return fmt.Errorf("error setting owner %d:%d of %s: %w", header.Uid, header.Gid, header.Name, err)
+	}
+	return nil
+}
+
+// setXattrs sets the extended attributes of an installed file from the PAX records in its header.
+func (a *APK) setXattrs(header *tar.Header) error {
+	for k, v := range header.PAXRecords {
+		if !strings.HasPrefix(k, xattrTarPAXRecordsPrefix) {
+			continue
+		}
+		attrName := strings.TrimPrefix(k, xattrTarPAXRecordsPrefix)
+		if !a.supports(apkfs.FeatureXattrs) {
+			if a.ignoreXattrErrors {
+				return nil
+			}
+			return fmt.Errorf("unable to set xattr %s on %s: not supported by the filesystem", attrName, header.Name)
+		}
+		if err := a.fs.SetXattr(header.Name, attrName, []byte(v)); err != nil && !a.ignoreXattrErrors {
+			return fmt.Errorf("error setting xattr %s on %s: %w", attrName, header.Name, err)
+		}
+	}
+	return nil
+}
+
+// link installs a hardlink, or a copy of the file it links to if the filesystem cannot
+// create it and copying is allowed.
+func (a *APK) link(header *tar.Header) error {
+	if a.supports(apkfs.FeatureHardlinks) {
+		err := a.fs.Link(header.Linkname, header.Name)
+		if err == nil || !a.copyHardlinks {
+			return err
+		}
+	} else if !a.copyHardlinks {
+		return fmt.Errorf("unable to install hardlink from %s -> %s: not supported by the filesystem", header.Name, header.Linkname)
+	}
+
+	src, err := a.fs.Open(header.Linkname)
+	if err != nil {
+		return fmt.Errorf("unable to open hardlink target %s: %w", header.Linkname, err)
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to stat hardlink target %s: %w", header.Linkname, err)
+	}
+	dst, err := a.fs.OpenFile(header.Name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fi.Mode())
+	if err != nil {
+		return fmt.Errorf("error creating file %s: %w", header.Name, err)
+	}
+	defer dst.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		return fmt.Errorf("unable to copy %s to %s: %w", header.Linkname, header.Name, err)
+	}
+
+	// a hardlink shares the owner and the xattrs of the file it links to, so the copy gets them too
+	if err := a.chown(header); err != nil {
+		return err
+	}
+	xattrs, err := a.fs.ListXattrs(header.Linkname)
+	if err != nil && !a.ignoreXattrErrors {
+		return fmt.Errorf("unable to list xattrs of hardlink target %s: %w", header.Linkname, err)
+	}
+	copied := *header
+	copied.PAXRecords = make(map[string]string, len(xattrs)+len(header.PAXRecords))
+	for k, v := range xattrs {
+		copied.PAXRecords[xattrTarPAXRecordsPrefix+k] = string(v)
+	}
+	for k, v := range header.PAXRecords {
+		copied.PAXRecords[k] = v
+	}
+	return a.setXattrs(&copied)
+}
+
 func checksumFromHeader(header *tar.Header) ([]byte, error) {
 	pax := header.PAXRecords
 	if pax == nil {
@@ -310,6 +501,16 @@ func (a *APK) lazilyInstallAPKFiles(ctx context.Context, wh WriteHeaderer, tf *t
 
 	var files []tar.Header
 
+	var tfs fs.FS = tf
+	merged := &usrMergeFS{FS: tf, names: map[string]string{}}
+	if a.usrMerge {
+		tfs = merged
+	}
+	transformed := &transformFS{FS: tfs, names: map[string]string{}, content: map[string]transformedFile{}}
+	if len(a.fileTransforms) != 0 {
+		tfs = transformed
+	}
+
 	var startedDataSection bool
 	for _, file := range tf.Entries() {
 		// per https://git.alpinelinux.org/apk-tools/tree/src/extract_v2.c?id=337734941831dae9a6aa441e38611c43a5fd72c0#n120
@@ -323,16 +524,39 @@ func (a *APK) lazilyInstallAPKFiles(ctx context.Context, wh WriteHeaderer, tf *t
 		// whatever it is now, it is in the data section
 		startedDataSection = true
 
-		installed, err := wh.WriteHeader(file.Header, tf, pkg)
+		header := file.Header
+		if a.usrMerge && usrMergeHeader(&header) {
+			merged.names[header.Name] = file.Header.Name
+		}
+
+		if !a.pathFilter.installs(&header) {
+			a.omit(pkg, header.Name)
+			continue
+		}
+
+		header, skip, err := a.transformLazily(transformed, header)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			a.omit(pkg, header.Name)
+			continue
+		}
+
+		installed, err := wh.WriteHeader(header, tfs, pkg)
 		if err != nil {
 			return nil, err
 		}
 
-		if installed && file.Header.Typeflag == tar.TypeReg {
-			a.installedFiles[file.Header.Name] = pkg
+		if installed && header.Typeflag == tar.TypeReg {
+			a.setFileOwner(header.Name, pkg)
 		}
 
-		files = append(files, file.Header)
+		files = append(files, header)
+	}
+
+	if a.usrMerge {
+		files = usrMergeParents(files)
 	}
 
 	return files, nil
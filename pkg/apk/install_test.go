@@ -26,10 +26,13 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"strings"
 	"testing"
 	"text/template"
 
 	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
 )
 
 type testDirEntry struct {
@@ -150,6 +153,100 @@ func TestInstallAPKFiles(t *testing.T) {
 		}
 	})
 
+	fidelityTar := func(t *testing.T) io.Reader {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range []*tar.Header{
+			{Name: "usr", Typeflag: tar.TypeDir, Mode: 0o755},
+			{Name: "usr/bin", Typeflag: tar.TypeDir, Mode: 0o755, Uid: 100, Gid: 101},
+			{Name: "usr/bin/ping", Typeflag: tar.TypeReg, Mode: 0o755, Size: 4, Uid: 100, Gid: 101, Format: tar.FormatPAX, PAXRecords: map[string]string{
+				xattrTarPAXRecordsPrefix + "security.capability": "\x01\x00\x00\x02",
+			}},
+			{Name: "usr/bin/ping6", Typeflag: tar.TypeLink, Linkname: "usr/bin/ping", Uid: 100, Gid: 101},
+		} {
+			require.NoError(t, tw.WriteHeader(hdr))
+			if hdr.Size > 0 {
+				_, err := tw.Write([]byte("ping"))
+				require.NoError(t, err)
+			}
+		}
+		require.NoError(t, tw.Close())
+		return &buf
+	}
+
+	t.Run("ownership, capabilities and hardlinks", func(t *testing.T) {
+		apk, src, err := testGetTestAPK()
+		require.NoError(t, err)
+
+		_, err = apk.installAPKFiles(context.Background(), fidelityTar(t), &Package{})
+		require.NoError(t, err)
+
+		fi, err := src.Stat("usr/bin")
+		require.NoError(t, err)
+		hdr, ok := fi.Sys().(*tar.Header)
+		require.True(t, ok)
+		require.Equal(t, 100, hdr.Uid)
+		require.Equal(t, 101, hdr.Gid)
+
+		capability, err := src.GetXattr("usr/bin/ping", "security.capability")
+		require.NoError(t, err)
+		require.Equal(t, []byte("\x01\x00\x00\x02"), capability)
+
+		b, err := src.ReadFile("usr/bin/ping6")
+		require.NoError(t, err)
+		require.Equal(t, "ping", string(b))
+	})
+
+	t.Run("unsupported features", func(t *testing.T) {
+		for _, tt := range []struct {
+			name    string
+			feature apkfs.Feature
+			option  Option
+		}{
+			{"ownership", apkfs.FeatureOwnership, WithIgnoreChownErrors(true)},
+			{"xattrs", apkfs.FeatureXattrs, WithIgnoreXattrErrors(true)},
+			{"hardlinks", apkfs.FeatureHardlinks, WithCopyHardlinks(true)},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				_, src, err := testGetTestAPK()
+				require.NoError(t, err)
+				limited := &limitedFS{FullFS: src, unsupported: tt.feature}
+
+				apk, err := New(WithFS(limited))
+				require.NoError(t, err)
+				_, err = apk.installAPKFiles(context.Background(), fidelityTar(t), &Package{})
+				require.ErrorContains(t, err, "not supported by the filesystem")
+
+				_, src, err = testGetTestAPK()
+				require.NoError(t, err)
+				limited = &limitedFS{FullFS: src, unsupported: tt.feature}
+
+				apk, err = New(WithFS(limited), tt.option)
+				require.NoError(t, err)
+				_, err = apk.installAPKFiles(context.Background(), fidelityTar(t), &Package{})
+				require.NoError(t, err)
+
+				b, err := src.ReadFile("usr/bin/ping6")
+				require.NoError(t, err)
+				require.Equal(t, "ping", string(b))
+
+				if tt.feature == apkfs.FeatureHardlinks {
+					// the copy keeps the owner and the xattrs of the file it links to
+					fi, err := src.Stat("usr/bin/ping6")
+					require.NoError(t, err)
+					hdr, ok := fi.Sys().(*tar.Header)
+					require.True(t, ok)
+					require.Equal(t, 100, hdr.Uid)
+					require.Equal(t, 101, hdr.Gid)
+
+					capability, err := src.GetXattr("usr/bin/ping6", "security.capability")
+					require.NoError(t, err)
+					require.Equal(t, []byte("\x01\x00\x00\x02"), capability)
+				}
+			})
+		}
+	})
+
 	t.Run("overlapping files", func(t *testing.T) {
 		t.Run("different origin and content", func(t *testing.T) {
 			apk, src, err := testGetTestAPK()
@@ -331,6 +428,16 @@ func checkDuplicateIDBEntries(t *testing.T, apk *APK) {
 	}
 }
 
+// limitedFS is a filesystem that does not support one apkfs.Feature.
+type limitedFS struct {
+	apkfs.FullFS
+	unsupported apkfs.Feature
+}
+
+func (l *limitedFS) Supports(feature apkfs.Feature) bool {
+	return feature != l.unsupported
+}
+
 type testPackage struct {
 	file     string
 	pkg      *Package
@@ -351,6 +458,13 @@ func (t *testPackage) ChecksumString() string {
 
 func fakePackage(t *testing.T, pkg *Package, entries []testDirEntry) InstallablePackage {
 	t.Helper()
+	return fakePackageWithScripts(t, pkg, entries, nil, nil)
+}
+
+// fakePackageWithScripts is fakePackage with scripts, by name, in the control section, and
+// the globs the package triggers on in its .PKGINFO.
+func fakePackageWithScripts(t *testing.T, pkg *Package, entries []testDirEntry, scripts map[string][]byte, triggers []string) InstallablePackage {
+	t.Helper()
 
 	dir := t.TempDir()
 	f, err := os.CreateTemp(dir, pkg.Name)
@@ -371,6 +485,9 @@ func fakePackage(t *testing.T, pkg *Package, entries []testDirEntry) Installable
 	if err := template.Must(tmpl.Parse(controlTemplate)).Execute(&b, pkg); err != nil {
 		t.Fatal(err)
 	}
+	if len(triggers) != 0 {
+		fmt.Fprintf(&b, "triggers = %s\n", strings.Join(triggers, " "))
+	}
 
 	if err := tw.WriteHeader(&tar.Header{
 		Name:     ".PKGINFO",
@@ -384,6 +501,20 @@ func fakePackage(t *testing.T, pkg *Package, entries []testDirEntry) Installable
 		t.Fatal(err)
 	}
 
+	for name, script := range scripts {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0o755,
+			Size:     int64(len(script)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(script); err != nil {
+			t.Fatal(err)
+		}
+	}
+
 	if err := tw.Flush(); err != nil {
 		t.Fatal(err)
 	}
@@ -497,5 +628,8 @@ replaces = {{ $dep }}
 {{- if .ProviderPriority }}
 provider_priority = {{ .Dependencies.ProviderPriority }}
 {{- end }}
+{{- if .ReplacesPriority }}
+replaces_priority = {{ .ReplacesPriority }}
+{{- end }}
 datahash = {{.DataHash}}
 `
@@ -35,6 +35,9 @@ import (
 type InstalledPackage struct {
 	Package
 	Files []*tar.Header
+	// Omitted are the paths of the files of the package that were not installed, see
+	// WithPathFilter and WithFileTransform. Only InstalledDB loads them.
+	Omitted []string
 }
 
 // getInstalledPackages get list of installed packages
@@ -314,6 +317,12 @@ func parseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 				return nil, fmt.Errorf("cannot parse provider priority field %s: %w", val, err)
 			}
 			pkg.ProviderPriority = priority
+		case "q":
+			priority, err := strconv.ParseUint(val, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse replaces priority field %s: %w", val, err)
+			}
+			pkg.ReplacesPriority = priority
 		case "C":
 			// Handle SHA1 checksums:
 			if strings.HasPrefix(val, "Q1") {
@@ -369,6 +378,12 @@ func parseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 			lastFile.Uid = uid
 			lastFile.Gid = gid
 			lastFile.Mode = perms
+		case "Z":
+			// file checksum, kept in the same PAX record the package tar uses
+			if lastFile == nil {
+				return nil, fmt.Errorf("cannot parse line %d: no file specified when setting checksum", linenr)
+			}
+			lastFile.PAXRecords = map[string]string{paxRecordsChecksumKey: val}
 		}
 
 		linenr++
@@ -0,0 +1,238 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// InstalledDB is a read-only, indexed view of the installed database in lib/apk/db:
+// the installed packages, the files they own, their triggers and their scripts.
+type InstalledDB struct {
+	packages []*InstalledPackage
+	byName   map[string]*InstalledPackage
+	// byPath maps cleaned file paths, without a leading slash, to the package that
+	// owns them. Last write wins, as it does on install.
+	byPath   map[string]*InstalledPackage
+	triggers map[string][]string
+	scripts  map[string]map[string][]byte
+}
+
+// InstalledDB loads the installed database from the APK's filesystem.
+func (a *APK) InstalledDB() (*InstalledDB, error) {
+	return LoadInstalledDB(a.fs)
+}
+
+// LoadInstalledDB loads the installed database from fsys, which is the root of an
+// installation. A missing triggers file, scripts.tar or omitted file is treated as empty.
+func LoadInstalledDB(fsys fs.FS) (*InstalledDB, error) {
+	f, err := fsys.Open(installedFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open installed file at %s: %w", installedFilePath, err)
+	}
+	defer f.Close()
+	packages, err := parseInstalled(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing installed file: %w", err)
+	}
+
+	db := &InstalledDB{
+		packages: packages,
+		byName:   make(map[string]*InstalledPackage, len(packages)),
+		byPath:   map[string]*InstalledPackage{},
+		triggers: map[string][]string{},
+		scripts:  map[string]map[string][]byte{},
+	}
+	byChecksum := make(map[string]*InstalledPackage, len(packages))
+	for _, pkg := range packages {
+		db.byName[pkg.Name] = pkg
+		byChecksum[base64.StdEncoding.EncodeToString(pkg.Checksum)] = pkg
+		for _, f := range pkg.Files {
+			if f.Typeflag == tar.TypeDir {
+				continue
+			}
+			db.byPath[cleanInstalledPath(f.Name)] = pkg
+		}
+	}
+
+	if err := db.loadTriggers(fsys, byChecksum); err != nil {
+		return nil, err
+	}
+	if err := db.loadScripts(fsys); err != nil {
+		return nil, err
+	}
+	if err := db.loadOmitted(fsys, byChecksum); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// loadTriggers reads the triggers file, which has one "<checksum> <paths...>" line per
+// package with triggers.
+func (db *InstalledDB) loadTriggers(fsys fs.FS, byChecksum map[string]*InstalledPackage) error {
+	f, err := fsys.Open(triggersFilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not open triggers file at %s: %w", triggersFilePath, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		checksum, value, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		pkg, ok := byChecksum[checksum]
+		if !ok {
+			// apk-tools writes the checksum with its Q1 prefix.
+			if pkg, ok = byChecksum[strings.TrimPrefix(checksum, "Q1")]; !ok {
+				continue
+			}
+		}
+		db.triggers[pkg.Name] = append(db.triggers[pkg.Name], strings.Fields(value)...)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading triggers file at %s: %w", triggersFilePath, err)
+	}
+	return nil
+}
+
+// loadScripts reads scripts.tar, whose entries are named
+// "<name>-<version>.Q1<base64 checksum><script>", e.g. "foo-1.0-r0.Q1abc=.post-install".
+func (db *InstalledDB) loadScripts(fsys fs.FS) error {
+	f, err := fsys.Open(scriptsFilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not open scripts file at %s: %w", scriptsFilePath, err)
+	}
+	defer f.Close()
+
+	prefixes := make(map[string]*InstalledPackage, len(db.packages))
+	for _, pkg := range db.packages {
+		prefixes[fmt.Sprintf("%s-%s.Q1%s", pkg.Name, pkg.Version, base64.StdEncoding.EncodeToString(pkg.Checksum))] = pkg
+	}
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading scripts file at %s: %w", scriptsFilePath, err)
+		}
+
+		for prefix, pkg := range prefixes {
+			script, ok := strings.CutPrefix(hdr.Name, prefix)
+			if !ok || !strings.HasPrefix(script, ".") {
+				continue
+			}
+			b, err := io.ReadAll(tr)
+			if err != nil {
+				return fmt.Errorf("reading script %s: %w", hdr.Name, err)
+			}
+			if db.scripts[pkg.Name] == nil {
+				db.scripts[pkg.Name] = map[string][]byte{}
+			}
+			db.scripts[pkg.Name][script] = b
+			break
+		}
+	}
+	return nil
+}
+
+// Packages returns the installed packages, in the order they appear in the database.
+func (db *InstalledDB) Packages() []*InstalledPackage {
+	return db.packages
+}
+
+// Package returns the installed package with the given name.
+func (db *InstalledDB) Package(name string) (*InstalledPackage, bool) {
+	pkg, ok := db.byName[name]
+	return pkg, ok
+}
+
+// Owner returns the package that owns the file at path, e.g. "/usr/bin/foo".
+// Directories are shared between packages and have no single owner.
+func (db *InstalledDB) Owner(path string) (*InstalledPackage, bool) {
+	pkg, ok := db.byPath[cleanInstalledPath(path)]
+	return pkg, ok
+}
+
+// Triggers returns the paths the named package triggers on.
+func (db *InstalledDB) Triggers(name string) []string {
+	return db.triggers[name]
+}
+
+// Scripts returns the scripts of the named package, keyed by script name,
+// e.g. ".post-install".
+func (db *InstalledDB) Scripts(name string) map[string][]byte {
+	return db.scripts[name]
+}
+
+// Query returns the installed packages for which match returns true.
+func (db *InstalledDB) Query(match func(*InstalledPackage) bool) []*InstalledPackage {
+	var pkgs []*InstalledPackage
+	for _, pkg := range db.packages {
+		if match(pkg) {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs
+}
+
+// installedFile is a file in the installed database and the name of the package that
+// owns it.
+type installedFile struct {
+	hdr *tar.Header
+	pkg string
+}
+
+func (f installedFile) checksum() string {
+	return f.hdr.PAXRecords[paxRecordsChecksumKey]
+}
+
+// files returns the files, but not directories, of the installed packages by cleaned
+// path. Last write wins, as for Owner.
+func (db *InstalledDB) files() map[string]installedFile {
+	files := make(map[string]installedFile, len(db.byPath))
+	for _, pkg := range db.packages {
+		for _, f := range pkg.Files {
+			if f.Typeflag == tar.TypeDir {
+				continue
+			}
+			files[cleanInstalledPath(f.Name)] = installedFile{hdr: f, pkg: pkg.Name}
+		}
+	}
+	return files
+}
+
+func cleanInstalledPath(path string) string {
+	return strings.TrimPrefix(filepath.Clean("/"+path), "/")
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstalledDB(t *testing.T) {
+	a, _, err := testGetTestAPK()
+	require.NoError(t, err)
+
+	db, err := a.InstalledDB()
+	require.NoError(t, err)
+
+	require.Len(t, db.Packages(), len(testInstalledPackages))
+
+	pkg, ok := db.Package("busybox")
+	require.True(t, ok)
+	require.Equal(t, "1.35.0-r17", pkg.Version)
+	_, ok = db.Package("notreal123")
+	require.False(t, ok)
+
+	for _, path := range []string{"/bin/busybox", "bin/busybox", "/bin/../bin/busybox"} {
+		owner, ok := db.Owner(path)
+		require.True(t, ok, path)
+		require.Equal(t, "busybox", owner.Name, path)
+	}
+	_, ok = db.Owner("/bin")
+	require.False(t, ok, "directories have no single owner")
+
+	for _, f := range pkg.Files {
+		if f.Name == "bin/busybox" {
+			require.Equal(t, "Q1z9q8GKcLmzboM90vMuZaj47yeOU=", f.PAXRecords[paxRecordsChecksumKey])
+		}
+	}
+
+	require.Equal(t, []string{"/bin", "/usr/bin", "/sbin", "/usr/sbin", "/lib/modules/*"}, db.Triggers("busybox"))
+	require.Empty(t, db.Triggers("musl"))
+
+	scripts := db.Scripts("busybox")
+	require.Contains(t, scripts, ".post-install")
+	require.Contains(t, scripts, ".trigger")
+
+	musl := db.Query(func(p *InstalledPackage) bool { return strings.HasPrefix(p.Name, "musl") })
+	require.Len(t, musl, 2)
+}
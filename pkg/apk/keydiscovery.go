@@ -0,0 +1,227 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+
+	"github.com/chainguard-dev/go-apk/pkg/adb"
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+// wellKnownKeysPath is where a host may publish the keys of its repositories, by name, for
+// DiscoverKeys.
+const wellKnownKeysPath = "/.well-known/apk/keys/"
+
+// DiscoverKeys installs the keys of the https repositories of the root that are signed by a
+// key that is not installed, reducing the bootstrap of a new repository to adding it. The
+// key named in the signature of the index of such a repository is fetched from the
+// repository URL, e.g. https://packages.wolfi.dev/os/wolfi-signing.rsa.pub, or else from
+// /.well-known/apk/keys/ on its host, and installed if it verifies the index. It is installed
+// for the repository only, in /etc/apk/keys.discovered/<sha256 of the repository URL>/, and
+// verifies its index and packages but not those of other repositories.
+//
+// Keys are pinned per repository on first use: once a repository has a key, no other key is
+// discovered for it and its key is never replaced by what it serves, so a repository that
+// later switches keys fails to verify instead. Repositories whose signatures are ignored,
+// and apk-tools v3 indexes, whose signatures do not name their keys, are skipped.
+//
+// It returns the keys it installed. The error is for a repository whose key could not be
+// discovered, along with the keys installed for the others.
+func (a *APK) DiscoverKeys(ctx context.Context) ([]Key, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "DiscoverKeys")
+	defer span.End()
+
+	if a.offline {
+		return nil, errors.New("cannot discover keys offline")
+	}
+	arch, err := a.rootArch()
+	if err != nil {
+		return nil, err
+	}
+	lists, err := a.repositoryLists()
+	if err != nil {
+		return nil, err
+	}
+	return a.discoverKeys(ctx, lists, arch)
+}
+
+// discoverKeys installs the keys of the https repositories of lists for arch, see
+// DiscoverKeys.
+func (a *APK) discoverKeys(ctx context.Context, lists []repositoryList, arch string) ([]Key, error) {
+	keys, hintedKeys, err := a.repositoryKeys(lists)
+	if err != nil {
+		return nil, err
+	}
+	unsigned := a.unsignedRepositories(lists)
+	client := a.client
+	if client == nil {
+		client = a.httpConfig.client()
+	}
+	opts := &indexOpts{httpClient: client, schemes: a.remoteSchemes()}
+
+	var (
+		installed []Key
+		errs      []error
+	)
+	for _, list := range lists {
+		listKeys, ok := hintedKeys[list.name]
+		if !ok {
+			listKeys = keys
+		}
+		for _, repo := range list.repos {
+			if repo.Disabled || !a.isRemote(repo.URL) || unsigned(repo.URL) {
+				continue
+			}
+			repoArch := arch
+			if repo.Arch != "" {
+				repoArch = repo.Arch
+			}
+			key, err := a.discoverKey(ctx, repo.URL, repoArch, listKeys, opts)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("repository %s: %w", redactURL(repo.URL), err))
+				continue
+			}
+			if key == nil {
+				continue
+			}
+			installed = append(installed, *key)
+		}
+	}
+	return installed, errors.Join(errs...)
+}
+
+// discoverKey returns the key it installed for the repository at repoURL, or nil if the
+// index of the repository for arch needs none: it is missing, it is an apk-tools v3 index
+// or its signature is verified by one of keys or by the key pinned for the repository.
+func (a *APK) discoverKey(ctx context.Context, repoURL, arch string, keys map[string][]byte, opts *indexOpts) (*Key, error) {
+	pinned, err := a.discoveredKeys(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	keys = mergeKeys(keys, pinned)
+
+	b, err := readRepositoryFile(ctx, IndexURL(repoURL, arch), opts)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if adb.IsADB(b) {
+		return nil, nil
+	}
+	alg, keyName, signature, data, err := splitIndexSignature(b)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := keys[keyName]; ok {
+		return nil, nil
+	}
+	if _, err := sign.VerifyingKey(alg, keyName, data, signature, keys); err == nil {
+		return nil, nil
+	}
+	if len(pinned) != 0 {
+		return nil, fmt.Errorf("the index is signed with key %s, not with the key pinned for the repository, refusing to discover another", keyName)
+	}
+	if keyName == "" || strings.ContainsAny(keyName, "/\\") || keyName == "." || keyName == ".." {
+		return nil, fmt.Errorf("invalid key name %q in the index signature", keyName)
+	}
+
+	candidates, err := keyDiscoveryURLs(repoURL, keyName)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, u := range candidates {
+		keyData, err := a.fetchFile(ctx, u)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", redactURL(u), err))
+			continue
+		}
+		if err := sign.Verify(alg, data, signature, keyData); err != nil {
+			errs = append(errs, fmt.Errorf("key at %s does not verify the index: %w", redactURL(u), err))
+			continue
+		}
+		keyring := a.NewKeyring()
+		if err := keyring.AddKeyBytes(keyName, keyData); err != nil {
+			return nil, err
+		}
+		dir := discoveredKeysDir(repoURL)
+		if err := a.fs.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to make keys dir: %w", err)
+		}
+		// #nosec G306 -- keys must be publicly readable
+		if err := a.fs.WriteFile(filepath.Join(dir, keyName), keyData, 0o644); err != nil {
+			return nil, fmt.Errorf("failed to write key %s: %w", keyName, err)
+		}
+		a.log(ctx).Infof("installed key %s discovered at %s for %s", keyName, redactURL(u), redactURL(repoURL))
+		key := keyring.List()[0]
+		return &key, nil
+	}
+	return nil, fmt.Errorf("could not discover key %s: %w", keyName, errors.Join(errs...))
+}
+
+// discoveredKeysDir returns the directory of the keys discovered for the repository at
+// repoURL, named by the sha256 of its URL without its password.
+func discoveredKeysDir(repoURL string) string {
+	sum := sha256.Sum256([]byte(redactURL(repoURL)))
+	return filepath.Join(discoveredKeysDirPath, hex.EncodeToString(sum[:]))
+}
+
+// discoveredKeys returns the keys discovered for the repository at repoURL, see DiscoverKeys.
+func (a *APK) discoveredKeys(repoURL string) (map[string][]byte, error) {
+	keys, err := a.readKeys(discoveredKeysDir(repoURL))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return keys, err
+}
+
+// keyDiscoveryURLs returns where the key named keyName of the repository at repoURL may be
+// published: next to the repository, then at the well-known path of its host.
+func keyDiscoveryURLs(repoURL, keyName string) ([]string, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository URL: %w", err)
+	}
+	next := *u
+	next.Path = path.Join(u.Path, keyName)
+	next.RawPath = ""
+	wellKnown := *u
+	wellKnown.Path = wellKnownKeysPath + keyName
+	wellKnown.RawPath = ""
+	return []string{next.String(), wellKnown.String()}, nil
+}
+
+// redactURL returns u without its password, or u as is if it is not a valid URL.
+func redactURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	return parsed.Redacted()
+}
@@ -0,0 +1,147 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+func TestDiscoverKeys(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+
+	// signedIndex returns an index signed by a new key named name, and the public key
+	signedIndex := func(name string) ([]byte, []byte) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		signingKey := filepath.Join(tmp, name)
+		require.NoError(t, os.WriteFile(signingKey, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600))
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		require.NoError(t, err)
+
+		archive, err := ArchiveFromIndex(&APKIndex{Packages: []*Package{{Name: name, Version: "1.0-r0", Arch: testArch}}})
+		require.NoError(t, err)
+		b, err := io.ReadAll(archive)
+		require.NoError(t, err)
+		indexFile := filepath.Join(tmp, name+".tar.gz")
+		require.NoError(t, os.WriteFile(indexFile, b, 0o644))
+		require.NoError(t, sign.SignIndex(ctx, signingKey, indexFile))
+		b, err = os.ReadFile(indexFile)
+		require.NoError(t, err)
+		return b, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	}
+	mainIndex, mainKey := signedIndex("main.rsa")
+	extraIndex, extraKey := signedIndex("extra.rsa")
+	otherIndex, otherKey := signedIndex("other.rsa")
+
+	files := map[string][]byte{
+		"/os/" + testArch + "/" + indexFilename:    mainIndex,
+		"/os/main.rsa.pub":                         mainKey,
+		"/extra/" + testArch + "/" + indexFilename: extraIndex,
+		"/.well-known/apk/keys/extra.rsa.pub":      extraKey,
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(b)
+	}))
+	defer srv.Close()
+
+	newAPK := func(options ...Option) (*APK, apkfs.FullFS) {
+		src := apkfs.NewMemFS()
+		a, err := New(append([]Option{WithFS(src), WithArch(testArch)}, options...)...)
+		require.NoError(t, err)
+		require.NoError(t, a.InitDB(ctx))
+		a.SetClient(srv.Client())
+		require.NoError(t, a.SetRepositories(ctx, []string{srv.URL + "/os", srv.URL + "/extra"}))
+		return a, src
+	}
+
+	a, src := newAPK()
+	keys, err := a.DiscoverKeys(ctx)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	require.Equal(t, "main.rsa.pub", keys[0].Name)
+	require.Equal(t, "extra.rsa.pub", keys[1].Name)
+	installed, err := src.ReadFile(filepath.Join(discoveredKeysDir(srv.URL+"/os"), "main.rsa.pub"))
+	require.NoError(t, err)
+	require.Equal(t, mainKey, installed)
+	// only for the repository
+	_, err = src.ReadFile(filepath.Join(keysDirPath, "main.rsa.pub"))
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = src.ReadFile(filepath.Join(discoveredKeysDir(srv.URL+"/extra"), "main.rsa.pub"))
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+	indexes, err := a.GetRepositoryIndexes(ctx, false)
+	require.NoError(t, err)
+	require.Len(t, indexes, 2)
+
+	// the installed keys are pinned, even if the repository serves another one
+	files["/os/main.rsa.pub"] = otherKey
+	keys, err = a.DiscoverKeys(ctx)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+	installed, err = src.ReadFile(filepath.Join(discoveredKeysDir(srv.URL+"/os"), "main.rsa.pub"))
+	require.NoError(t, err)
+	require.Equal(t, mainKey, installed)
+
+	// and no other key is discovered for the repository once it has one
+	files["/os/"+testArch+"/"+indexFilename] = otherIndex
+	files["/os/other.rsa.pub"] = otherKey
+	_, err = a.DiscoverKeys(ctx)
+	require.ErrorContains(t, err, "pinned")
+	_, err = src.ReadFile(filepath.Join(discoveredKeysDir(srv.URL+"/os"), "other.rsa.pub"))
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+	_, err = a.GetRepositoryIndexes(ctx, false)
+	require.Error(t, err)
+	files["/os/"+testArch+"/"+indexFilename] = mainIndex
+	delete(files, "/os/other.rsa.pub")
+
+	// a key that does not verify the index is not installed
+	a, src = newAPK()
+	_, err = a.DiscoverKeys(ctx)
+	require.ErrorContains(t, err, "could not discover key main.rsa.pub")
+	_, err = src.ReadFile(filepath.Join(discoveredKeysDir(srv.URL+"/os"), "main.rsa.pub"))
+	require.Error(t, err)
+	files["/os/main.rsa.pub"] = mainKey
+
+	// discovered before fetching the indexes
+	globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+	a, _ = newAPK(WithKeyDiscovery(true))
+	indexes, err = a.GetRepositoryIndexes(ctx, false)
+	require.NoError(t, err)
+	require.Len(t, indexes, 2)
+}
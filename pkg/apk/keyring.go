@@ -0,0 +1,233 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"golang.org/x/sync/errgroup"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// Key is a single public key in a Keyring.
+type Key struct {
+	// Name is the filename of the key, e.g. alpine-devel@lists.alpinelinux.org-4a6a0840.rsa.pub
+	Name string
+	// Fingerprint is the hex-encoded sha256 of the DER encoded public key.
+	Fingerprint string
+	// Data is the PEM encoded public key.
+	Data []byte
+}
+
+// Keyring is a set of public keys used to verify repository indexes and packages,
+// keyed by the filename they are installed as in /etc/apk/keys.
+// It is safe for concurrent use.
+type Keyring struct {
+	apk *APK
+
+	mu   sync.Mutex
+	keys map[string]Key
+}
+
+// NewKeyring returns an empty Keyring that fetches remote keys with the client,
+// cache and credentials of a.
+func (a *APK) NewKeyring() *Keyring {
+	return &Keyring{
+		apk:  a,
+		keys: map[string]Key{},
+	}
+}
+
+// Keyring returns a Keyring with all of the keys currently installed in /etc/apk/keys.
+func (a *APK) Keyring() (*Keyring, error) {
+	k := a.NewKeyring()
+	dir, err := a.fs.ReadDir(keysDirPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return k, nil
+		}
+		return nil, fmt.Errorf("could not read keys directory in %s at %s: %w", a.fs, keysDirPath, err)
+	}
+	for _, d := range dir {
+		if d.IsDir() {
+			continue
+		}
+		fullPath := filepath.Join(keysDirPath, d.Name())
+		b, err := a.fs.ReadFile(fullPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read key file at %s: %w", fullPath, err)
+		}
+		if err := k.AddKeyBytes(d.Name(), b); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// KeyFingerprint returns the hex-encoded sha256 of the DER encoded public key in the PEM data.
+func KeyFingerprint(data []byte) (string, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", errors.New("no PEM block found")
+	}
+	if _, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return "", fmt.Errorf("parse PKIX public key: %w", err)
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AddKeyBytes adds the PEM encoded public key to the keyring under name,
+// replacing any key with the same name.
+func (k *Keyring) AddKeyBytes(name string, data []byte) error {
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("invalid key name %q", name)
+	}
+	fingerprint, err := KeyFingerprint(data)
+	if err != nil {
+		return fmt.Errorf("invalid key %s: %w", name, err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[name] = Key{
+		Name:        name,
+		Fingerprint: fingerprint,
+		Data:        data,
+	}
+	return nil
+}
+
+// AddKeyFromURL fetches the key at u, which may be a local path or an https:// URL,
+// and adds it to the keyring under its unescaped base name.
+func (k *Keyring) AddKeyFromURL(ctx context.Context, u string) error {
+	data, err := k.apk.fetchFile(ctx, u)
+	if err != nil {
+		return err
+	}
+	name, err := url.PathUnescape(filepath.Base(u))
+	if err != nil {
+		return fmt.Errorf("failed to unescape key filename %s: %w", u, err)
+	}
+	return k.AddKeyBytes(name, data)
+}
+
+// AddKeysFromURLs concurrently calls AddKeyFromURL for each of urls.
+func (k *Keyring) AddKeysFromURLs(ctx context.Context, urls ...string) error {
+	var eg errgroup.Group
+	for _, u := range urls {
+		u := u
+		eg.Go(func() error {
+			return k.AddKeyFromURL(ctx, u)
+		})
+	}
+	return eg.Wait()
+}
+
+// AddAlpineKeys adds the official alpine-keys for the APK's architecture and the given
+// release branches, e.g. "v3.19", as published in https://alpinelinux.org/releases.json.
+// This is an alternative to installing the alpine-keys package.
+func (k *Keyring) AddAlpineKeys(ctx context.Context, alpineVersions ...string) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "AddAlpineKeys")
+	defer span.End()
+
+	urls, err := k.apk.alpineKeyURLs(ctx, alpineVersions)
+	if err != nil {
+		return err
+	}
+	return k.AddKeysFromURLs(ctx, urls...)
+}
+
+// AddWolfiKeys adds the official wolfi signing key.
+// This is an alternative to installing the wolfi-keys package.
+func (k *Keyring) AddWolfiKeys(ctx context.Context) error {
+	return k.AddKeyFromURL(ctx, wolfiSigningKeyURL)
+}
+
+// Remove removes the key with the given name or fingerprint. It returns false if
+// no such key was in the keyring.
+func (k *Keyring) Remove(nameOrFingerprint string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.keys[nameOrFingerprint]; ok {
+		delete(k.keys, nameOrFingerprint)
+		return true
+	}
+	var removed bool
+	for name, key := range k.keys {
+		if key.Fingerprint == nameOrFingerprint {
+			delete(k.keys, name)
+			removed = true
+		}
+	}
+	return removed
+}
+
+// List returns all of the keys in the keyring, sorted by name.
+func (k *Keyring) List() []Key {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	keys := make([]Key, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name < keys[j].Name
+	})
+	return keys
+}
+
+// Keys returns the keys in the form expected by GetRepositoryIndexes.
+func (k *Keyring) Keys() map[string][]byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	keys := make(map[string][]byte, len(k.keys))
+	for name, key := range k.keys {
+		keys[name] = key.Data
+	}
+	return keys
+}
+
+// Install writes every key in the keyring to /etc/apk/keys in fsys. Keys that are
+// already installed but not in the keyring are left alone.
+func (k *Keyring) Install(fsys apkfs.FullFS) error {
+	if err := fsys.MkdirAll(keysDirPath, 0o755); err != nil {
+		return fmt.Errorf("failed to make keys dir: %w", err)
+	}
+	for _, key := range k.List() {
+		// #nosec G306 -- apk keyring must be publicly readable
+		if err := fsys.WriteFile(filepath.Join(keysDirPath, key.Name), key.Data, 0o644); err != nil {
+			return fmt.Errorf("failed to write apk key %s: %w", key.Name, err)
+		}
+	}
+	return nil
+}
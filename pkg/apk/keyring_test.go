@@ -0,0 +1,67 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestKeyring(t *testing.T) {
+	ctx := context.Background()
+	src := apkfs.NewMemFS()
+	a, err := New(WithFS(src), WithIgnoreMknodErrors(ignoreMknodErrors))
+	require.NoError(t, err)
+	a.SetClient(&http.Client{
+		Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+	})
+
+	k := a.NewKeyring()
+	require.Error(t, k.AddKeyBytes("bad.rsa.pub", []byte("not a key")))
+	require.Error(t, k.AddKeyBytes("../escape.rsa.pub", []byte(testDemoKey)))
+
+	require.NoError(t, k.AddKeyBytes("demo.rsa.pub", []byte(testDemoKey)))
+	require.NoError(t, k.AddKeyFromURL(ctx, "https://alpinelinux.org/keys/alpine-devel%40lists.alpinelinux.org-4a6a0840.rsa.pub"))
+
+	keys := k.List()
+	require.Len(t, keys, 2)
+	require.Equal(t, "alpine-devel@lists.alpinelinux.org-4a6a0840.rsa.pub", keys[0].Name)
+	require.Equal(t, "demo.rsa.pub", keys[1].Name)
+
+	fingerprint, err := KeyFingerprint([]byte(testDemoKey))
+	require.NoError(t, err)
+	require.Equal(t, fingerprint, keys[1].Fingerprint)
+	require.Len(t, fingerprint, 64)
+
+	require.NoError(t, k.Install(src))
+	installed, err := a.Keyring()
+	require.NoError(t, err)
+	require.Equal(t, k.List(), installed.List())
+
+	require.True(t, installed.Remove(fingerprint))
+	require.False(t, installed.Remove("demo.rsa.pub"))
+	require.True(t, installed.Remove("alpine-devel@lists.alpinelinux.org-4a6a0840.rsa.pub"))
+	require.Empty(t, installed.Keys())
+
+	// Removing from the keyring does not uninstall.
+	_, err = src.Stat(filepath.Join(keysDirPath, "demo.rsa.pub"))
+	require.NoError(t, err)
+}
@@ -0,0 +1,166 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	// LayerMediaType is the media type of a Layer.
+	LayerMediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
+	// AnnotationPackages is the annotation of a Layer that lists the packages installed in
+	// it, in install order, as space separated name=version pairs.
+	AnnotationPackages = "dev.chainguard.go-apk.packages"
+)
+
+// Layer is an OCI image layer built by InstallLayer, kept in a temporary file until Close.
+//
+// Its methods match those of a go-containerregistry v1.Layer, with plain types, so that
+// it is easily wrapped as one, e.g. with tarball.LayerFromOpener(layer.Compressed).
+type Layer struct {
+	info        LayerInfo
+	annotations map[string]string
+	path        string
+}
+
+// Digest returns the digest of the compressed layer, as sha256:<hex>.
+func (l *Layer) Digest() string {
+	return l.info.Digest
+}
+
+// DiffID returns the digest of the uncompressed layer, as sha256:<hex>.
+func (l *Layer) DiffID() string {
+	return l.info.DiffID
+}
+
+// Size returns the size of the compressed layer in bytes.
+func (l *Layer) Size() int64 {
+	return l.info.Size
+}
+
+// MediaType returns LayerMediaType.
+func (l *Layer) MediaType() string {
+	return LayerMediaType
+}
+
+// Annotations returns the annotations of the layer, see AnnotationPackages.
+func (l *Layer) Annotations() map[string]string {
+	annotations := make(map[string]string, len(l.annotations))
+	for k, v := range l.annotations {
+		annotations[k] = v
+	}
+	return annotations
+}
+
+// Compressed returns the gzipped tar of the layer.
+func (l *Layer) Compressed() (io.ReadCloser, error) {
+	return os.Open(l.path)
+}
+
+// Uncompressed returns the tar of the layer.
+func (l *Layer) Uncompressed() (io.ReadCloser, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipReadCloser{Reader: zr, f: f}, nil
+}
+
+// Close removes the temporary file of the layer.
+func (l *Layer) Close() error {
+	return os.Remove(l.path)
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// InstallLayer installs pkgs, in order, into an empty root, see InitDB and InstallPackages,
+// and returns the root as a Layer, which the caller must Close. The options are those of
+// New; WithFS is not allowed, the root is a StreamFS.
+func InstallLayer(ctx context.Context, sourceDateEpoch *time.Time, pkgs []InstallablePackage, options ...Option) (layer *Layer, err error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "InstallLayer")
+	defer span.End()
+
+	var opt opts
+	for _, o := range options {
+		if err := o(&opt); err != nil {
+			return nil, err
+		}
+	}
+	if opt.fs != nil {
+		return nil, fmt.Errorf("InstallLayer does not take WithFS")
+	}
+
+	f, err := os.CreateTemp("", "apk-layer-*.tar.gz")
+	if err != nil {
+		return nil, fmt.Errorf("creating layer file: %w", err)
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+
+	s := NewLayerStreamFS(f)
+	a, err := New(append(options, WithFS(s))...)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.InitDB(ctx); err != nil {
+		return nil, err
+	}
+	if err := a.InstallPackages(ctx, sourceDateEpoch, pkgs); err != nil {
+		return nil, err
+	}
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Close(); err != nil {
+		return nil, fmt.Errorf("writing layer: %w", err)
+	}
+
+	names := make([]string, len(installed))
+	for i, pkg := range installed {
+		names[i] = pkg.Name + "=" + pkg.Version
+	}
+	return &Layer{
+		info:        s.Layer(),
+		annotations: map[string]string{AnnotationPackages: strings.Join(names, " ")},
+		path:        f.Name(),
+	}, nil
+}
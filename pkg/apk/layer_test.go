@@ -0,0 +1,77 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestInstallLayer(t *testing.T) {
+	pkgs := []InstallablePackage{
+		fakePackage(t, &Package{Name: "first", Version: "1.0-r0"}, []testDirEntry{
+			{"etc", 0o755, true, nil, nil},
+			{"etc/a", 0o644, false, []byte("a"), nil},
+		}),
+		fakePackage(t, &Package{Name: "second", Version: "2.0-r1"}, nil),
+	}
+
+	layer, err := InstallLayer(context.Background(), nil, pkgs, WithIgnoreMknodErrors(true))
+	require.NoError(t, err)
+	defer layer.Close()
+
+	require.Equal(t, LayerMediaType, layer.MediaType())
+	require.Equal(t, map[string]string{AnnotationPackages: "first=1.0-r0 second=2.0-r1"}, layer.Annotations())
+
+	compressed, err := layer.Compressed()
+	require.NoError(t, err)
+	defer compressed.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, compressed)
+	require.NoError(t, err)
+	require.Equal(t, "sha256:"+hex.EncodeToString(h.Sum(nil)), layer.Digest())
+	require.Equal(t, n, layer.Size())
+
+	uncompressed, err := layer.Uncompressed()
+	require.NoError(t, err)
+	defer uncompressed.Close()
+	h.Reset()
+	var found bool
+	tr := tar.NewReader(io.TeeReader(uncompressed, h))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		found = found || hdr.Name == "etc/a"
+	}
+	_, err = io.Copy(h, uncompressed)
+	require.NoError(t, err)
+	require.True(t, found, "etc/a not in layer")
+	require.Equal(t, "sha256:"+hex.EncodeToString(h.Sum(nil)), layer.DiffID())
+
+	_, err = InstallLayer(context.Background(), nil, pkgs, WithFS(apkfs.NewMemFS()))
+	require.Error(t, err)
+}
@@ -0,0 +1,82 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Cache entries are directories: the expanded files of one package, or the etag-addressed
+// copies of one APKINDEX. Processes sharing a cache directory serialize populating an entry
+// and evicting from it with an exclusive flock on a sibling "<entry>.lock" file. Readers do
+// not lock; they rely on files only ever being created by atomic renames.
+const lockSuffix = ".lock"
+
+// lockPollInterval is how often a blocked lockCacheEntry retries.
+var lockPollInterval = 20 * time.Millisecond
+
+func cacheEntryLockPath(entryDir string) string {
+	return filepath.Clean(entryDir) + lockSuffix
+}
+
+// lockCacheEntry takes the lock for the cache entry in entryDir, waiting until it is
+// available or ctx is done. The returned func releases it.
+func lockCacheEntry(ctx context.Context, entryDir string) (func(), error) {
+	for {
+		unlock, ok, err := tryLockCacheEntry(entryDir)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return unlock, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for cache lock %s: %w", cacheEntryLockPath(entryDir), ctx.Err())
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// tryLockCacheEntry is like lockCacheEntry, but returns false instead of waiting.
+func tryLockCacheEntry(entryDir string) (func(), bool, error) {
+	path := cacheEntryLockPath(entryDir)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, false, fmt.Errorf("creating cache lock directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, false, fmt.Errorf("opening cache lock %s: %w", path, err)
+	}
+	ok, err := tryFlock(f)
+	if err != nil || !ok {
+		f.Close()
+		if err != nil {
+			return nil, false, fmt.Errorf("locking %s: %w", path, err)
+		}
+		return nil, false, nil
+	}
+	// Closing the file releases the lock.
+	return func() { f.Close() }, true, nil
+}
+
+func isCacheLockFile(path string) bool {
+	return strings.HasSuffix(path, lockSuffix)
+}
@@ -0,0 +1,25 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !unix
+
+package apk
+
+import "os"
+
+// tryFlock always succeeds without flock(2). Cache writes are still atomic renames, so
+// concurrent writers at worst duplicate work.
+func tryFlock(*os.File) (bool, error) {
+	return true, nil
+}
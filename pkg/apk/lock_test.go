@@ -0,0 +1,122 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+type testCountingTransport struct {
+	wrapped  http.RoundTripper
+	requests atomic.Int64
+}
+
+func (t *testCountingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	t.requests.Add(1)
+	// Give concurrent writers a chance to race.
+	time.Sleep(10 * time.Millisecond)
+	return t.wrapped.RoundTrip(request)
+}
+
+func TestCacheEntryLock(t *testing.T) {
+	ctx := context.Background()
+	entry := filepath.Join(t.TempDir(), "repo", "x86_64", "hello-0.1.0-r0")
+
+	unlock, ok, err := tryLockCacheEntry(entry)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	_, ok, err = tryLockCacheEntry(entry)
+	require.NoError(t, err)
+	require.False(t, ok, "lock should be held")
+
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = lockCacheEntry(cctx, entry)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	unlock()
+	unlock, err = lockCacheEntry(ctx, entry)
+	require.NoError(t, err)
+	unlock()
+}
+
+func TestConcurrentCacheWriters(t *testing.T) {
+	ctx := context.Background()
+
+	f, err := os.Open("testdata/hello-0.1.0-r0.apk")
+	require.NoError(t, err)
+	exp, err := expandapk.ExpandApk(ctx, f, "")
+	require.NoError(t, err)
+	f.Close()
+	checksum := exp.ControlHash
+	exp.Close()
+
+	cacheDir := t.TempDir()
+	transport := &testCountingTransport{wrapped: &testLocalTransport{root: "testdata", basenameOnly: true}}
+	repo := &RepositoryWithIndex{Repository: &Repository{URI: "https://example.com/repo/x86_64"}}
+	pkg := NewRepositoryPackage(&Package{Name: "hello", Version: "0.1.0-r0", Checksum: checksum}, repo)
+
+	// Each writer has its own APK and bypasses the in-process dedupe, like separate
+	// processes sharing the cache directory would.
+	const writers = 8
+	var (
+		g     errgroup.Group
+		mu    sync.Mutex
+		files = map[string]bool{}
+	)
+	for i := 0; i < writers; i++ {
+		g.Go(func() error {
+			a, err := New(WithCache(cacheDir, false))
+			if err != nil {
+				return err
+			}
+			a.SetClient(&http.Client{Transport: transport})
+			exp, err := expandPackage(ctx, a, pkg)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			files[exp.ControlFile+" "+exp.PackageFile] = true
+			return nil
+		})
+	}
+	require.NoError(t, g.Wait())
+
+	require.Equal(t, int64(1), transport.requests.Load(), "package should be downloaded once")
+	require.Len(t, files, 1, "all writers should see the same cache entry")
+
+	// No temporary files are left behind.
+	entry, ok := packageStoreDirForPackage(cacheDir, pkg)
+	require.True(t, ok)
+	des, err := os.ReadDir(entry)
+	require.NoError(t, err)
+	for _, de := range des {
+		require.NotEqual(t, ".tmp", filepath.Ext(de.Name()), de.Name())
+	}
+}
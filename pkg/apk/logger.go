@@ -0,0 +1,60 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// logContext returns ctx with the logger of the APK, see WithLogger, so that what is called
+// with it logs there too. Without one, it returns ctx, whose logger is used.
+func (a *APK) logContext(ctx context.Context) context.Context {
+	if a.logger == nil {
+		return ctx
+	}
+	return clog.WithLogger(ctx, clog.NewLoggerWithContext(ctx, a.logger))
+}
+
+// log returns the logger of the APK, see WithLogger, or else the logger of ctx.
+func (a *APK) log(ctx context.Context) *clog.Logger {
+	if a.logger == nil {
+		return clog.FromContext(ctx)
+	}
+	return clog.NewLoggerWithContext(ctx, a.logger)
+}
+
+// leveledLogger logs what retryablehttp logs to a slog.Logger.
+type leveledLogger struct {
+	logger *slog.Logger
+}
+
+func (l leveledLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.logger.Error(msg, keysAndValues...)
+}
+
+func (l leveledLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.logger.Info(msg, keysAndValues...)
+}
+
+func (l leveledLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.logger.Debug(msg, keysAndValues...)
+}
+
+func (l leveledLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.logger.Warn(msg, keysAndValues...)
+}
@@ -0,0 +1,128 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MergeStrategy is what MergeIndexes does with the same version of a package in several
+// indexes.
+type MergeStrategy int
+
+const (
+	// MergePreferFirst keeps the package of the first index that has it.
+	MergePreferFirst MergeStrategy = iota
+	// MergePreferNewest keeps the package that was built last, e.g. a rebuild with the same
+	// version; the first one when they were built at the same time.
+	MergePreferNewest
+	// MergeErrorOnConflict fails when the packages are not the same, by checksum, and
+	// keeps the first one when they are.
+	MergeErrorOnConflict
+)
+
+func (s MergeStrategy) String() string {
+	switch s {
+	case MergePreferFirst:
+		return "prefer-first"
+	case MergePreferNewest:
+		return "prefer-newest"
+	case MergeErrorOnConflict:
+		return "error-on-conflict"
+	default:
+		return fmt.Sprintf("MergeStrategy(%d)", int(s))
+	}
+}
+
+// mergedIndex is the NamedIndex of MergeIndexes.
+type mergedIndex struct {
+	name      string
+	source    string
+	pkgs      []*RepositoryPackage
+	timestamp time.Time
+}
+
+func (m *mergedIndex) Name() string                   { return m.name }
+func (m *mergedIndex) Source() string                 { return m.source }
+func (m *mergedIndex) Count() int                     { return len(m.pkgs) }
+func (m *mergedIndex) Packages() []*RepositoryPackage { return m.pkgs }
+func (m *mergedIndex) Timestamp() time.Time           { return m.timestamp }
+
+// MergeIndexes merges indexes into a single index, with every version of every package in
+// them once, in the order of the indexes. What is kept of a version of a package that more
+// than one index has depends on strategy. The packages keep their repositories, so they are
+// fetched from where they were. The name of the merged index is the names of the tagged
+// indexes, once each, and its source the sources of indexes, both separated by commas, so
+// that merging untagged indexes gives an untagged index. Its timestamp is the oldest of
+// theirs. It is neither a SignedIndex, as the indexes may have been verified differently,
+// nor a DigestedIndex, as its packages are from several indexes.
+func MergeIndexes(indexes []NamedIndex, strategy MergeStrategy) (NamedIndex, error) {
+	switch strategy {
+	case MergePreferFirst, MergePreferNewest, MergeErrorOnConflict:
+	default:
+		return nil, fmt.Errorf("invalid merge strategy %d", strategy)
+	}
+
+	var (
+		merged  = &mergedIndex{}
+		at      = map[string]int{} // by name-version, where in merged.pkgs
+		names   []string
+		sources = make([]string, 0, len(indexes))
+	)
+	for _, index := range indexes {
+		if name := index.Name(); name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+		sources = append(sources, index.Source())
+		if ts := indexTimestamp(index); !ts.IsZero() && (merged.timestamp.IsZero() || ts.Before(merged.timestamp)) {
+			merged.timestamp = ts
+		}
+		for _, pkg := range index.Packages() {
+			key := pkg.Name + "-" + pkg.Version
+			i, dup := at[key]
+			if !dup {
+				at[key] = len(merged.pkgs)
+				merged.pkgs = append(merged.pkgs, pkg)
+				continue
+			}
+			kept := merged.pkgs[i]
+			switch strategy {
+			case MergePreferNewest:
+				if pkg.BuildTime.After(kept.BuildTime) {
+					merged.pkgs[i] = pkg
+				}
+			case MergeErrorOnConflict:
+				if !bytes.Equal(pkg.Checksum, kept.Checksum) {
+					return nil, fmt.Errorf("%s in %s and %s differ", pkg.Filename(), indexSource(kept), index.Source())
+				}
+			}
+		}
+	}
+	merged.name = strings.Join(names, ",")
+	merged.source = strings.Join(sources, ",")
+	return merged, nil
+}
+
+// indexSource returns the index URI of the repository of pkg, if any.
+func indexSource(pkg *RepositoryPackage) string {
+	if repo := pkg.Repository(); repo != nil && repo.Repository != nil {
+		return repo.IndexURI()
+	}
+	return ""
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeIndexes(t *testing.T) {
+	older, newer := time.Unix(1000, 0), time.Unix(2000, 0)
+	mainRepo := Repository{URI: "https://example.com/main"}
+	extra := Repository{URI: "https://example.com/extra"}
+	indexes := []NamedIndex{
+		NewNamedRepositoryWithIndex("", mainRepo.WithIndex(&APKIndex{Packages: []*Package{
+			{Name: "foo", Version: "1.0-r0", Checksum: []byte{1}, BuildTime: older},
+			{Name: "bar", Version: "1.0-r0", Checksum: []byte{2}},
+		}})),
+		NewNamedRepositoryWithIndex("", extra.WithIndex(&APKIndex{Packages: []*Package{
+			{Name: "foo", Version: "1.0-r0", Checksum: []byte{3}, BuildTime: newer},
+			{Name: "foo", Version: "1.1-r0", Checksum: []byte{4}},
+			{Name: "bar", Version: "1.0-r0", Checksum: []byte{2}},
+		}})),
+	}
+
+	urls := func(index NamedIndex) (got []string) {
+		for _, pkg := range index.Packages() {
+			got = append(got, pkg.URL())
+		}
+		return got
+	}
+
+	merged, err := MergeIndexes(indexes, MergePreferFirst)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"https://example.com/main/foo-1.0-r0.apk",
+		"https://example.com/main/bar-1.0-r0.apk",
+		"https://example.com/extra/foo-1.1-r0.apk",
+	}, urls(merged))
+	require.Equal(t, 3, merged.Count())
+	require.Equal(t, indexes[0].Source()+","+indexes[1].Source(), merged.Source())
+	require.Empty(t, merged.Name())
+
+	tagged := []NamedIndex{
+		NewNamedRepositoryWithIndex("edge", mainRepo.WithIndex(&APKIndex{})),
+		indexes[0],
+		NewNamedRepositoryWithIndex("testing", extra.WithIndex(&APKIndex{})),
+		NewNamedRepositoryWithIndex("edge", extra.WithIndex(&APKIndex{})),
+	}
+	merged, err = MergeIndexes(tagged, MergePreferFirst)
+	require.NoError(t, err)
+	require.Equal(t, "edge,testing", merged.Name())
+
+	merged, err = MergeIndexes(indexes, MergePreferNewest)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"https://example.com/extra/foo-1.0-r0.apk",
+		"https://example.com/main/bar-1.0-r0.apk",
+		"https://example.com/extra/foo-1.1-r0.apk",
+	}, urls(merged))
+
+	_, err = MergeIndexes(indexes, MergeErrorOnConflict)
+	require.ErrorContains(t, err, "foo-1.0-r0.apk")
+	_, err = MergeIndexes(indexes[1:], MergeErrorOnConflict)
+	require.NoError(t, err)
+
+	_, err = MergeIndexes(indexes, MergeStrategy(42))
+	require.Error(t, err)
+}
@@ -0,0 +1,153 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const meterName = "github.com/chainguard-dev/go-apk"
+
+// metrics are the OpenTelemetry instruments of an APK, see WithMeterProvider. A nil
+// *metrics records nothing.
+type metrics struct {
+	indexFetchDuration metric.Float64Histogram
+	cacheLookups       metric.Int64Counter
+	bytesDownloaded    metric.Int64Counter
+	packagesInstalled  metric.Int64Counter
+	solveDuration      metric.Float64Histogram
+}
+
+func newMetrics(provider metric.MeterProvider) (*metrics, error) {
+	if provider == nil {
+		provider = otel.GetMeterProvider()
+	}
+	meter := provider.Meter(meterName)
+
+	var (
+		m   metrics
+		err error
+	)
+	if m.indexFetchDuration, err = meter.Float64Histogram("go_apk.index.fetch.duration",
+		metric.WithDescription("How long getting the index of a repository took, from the network or the cache."),
+		metric.WithUnit("s")); err != nil {
+		return nil, err
+	}
+	if m.cacheLookups, err = meter.Int64Counter("go_apk.cache.lookups",
+		metric.WithDescription("Lookups of indexes, keys and packages in the cache, by result: hit or miss."),
+		metric.WithUnit("{lookup}")); err != nil {
+		return nil, err
+	}
+	if m.bytesDownloaded, err = meter.Int64Counter("go_apk.download.size",
+		metric.WithDescription("Bytes of indexes, keys and packages downloaded from the network, by host."),
+		metric.WithUnit("By")); err != nil {
+		return nil, err
+	}
+	if m.packagesInstalled, err = meter.Int64Counter("go_apk.packages.installed",
+		metric.WithDescription("Packages installed."),
+		metric.WithUnit("{package}")); err != nil {
+		return nil, err
+	}
+	if m.solveDuration, err = meter.Float64Histogram("go_apk.solve.duration",
+		metric.WithDescription("How long resolving the world took, by result: ok or error."),
+		metric.WithUnit("s")); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (m *metrics) indexFetched(ctx context.Context, repository string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.indexFetchDuration.Record(ctx, d.Seconds(), metric.WithAttributes(attribute.String("repository", repository)))
+}
+
+func (m *metrics) cacheLookup(ctx context.Context, hit bool) {
+	if m == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheLookups.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result)))
+}
+
+func (m *metrics) installed(ctx context.Context, n int) {
+	if m == nil {
+		return
+	}
+	m.packagesInstalled.Add(ctx, int64(n))
+}
+
+func (m *metrics) solved(ctx context.Context, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.solveDuration.Record(ctx, d.Seconds(), metric.WithAttributes(attribute.String("result", result)))
+}
+
+// transport returns wrapped, counting the bytes of the bodies of its responses.
+func (m *metrics) transport(wrapped http.RoundTripper) http.RoundTripper {
+	if m == nil {
+		return wrapped
+	}
+	return &metricsTransport{wrapped: wrapped, metrics: m}
+}
+
+type metricsTransport struct {
+	wrapped http.RoundTripper
+	metrics *metrics
+}
+
+func (t *metricsTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	res, err := t.wrapped.RoundTrip(request)
+	if err != nil || request.URL == nil {
+		return res, err
+	}
+	res.Body = &countingBody{
+		ReadCloser: res.Body,
+		count: func(n int) {
+			t.metrics.bytesDownloaded.Add(request.Context(), int64(n), metric.WithAttributes(attribute.String("host", request.URL.Host)))
+		},
+	}
+	return res, nil
+}
+
+// countingBody is a response body that counts what is read from it.
+type countingBody struct {
+	io.ReadCloser
+	count func(n int)
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.count(n)
+	}
+	return n, err
+}
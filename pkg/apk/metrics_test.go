@@ -0,0 +1,122 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// testMeterProvider sums what is added to its counters and counts what is recorded in its
+// histograms, by instrument name.
+type testMeterProvider struct {
+	noop.MeterProvider
+	mu      sync.Mutex
+	values  map[string]float64
+	records map[string]int
+}
+
+func newTestMeterProvider() *testMeterProvider {
+	return &testMeterProvider{values: map[string]float64{}, records: map[string]int{}}
+}
+
+func (p *testMeterProvider) Meter(string, ...metric.MeterOption) metric.Meter {
+	return &testMeter{provider: p}
+}
+
+func (p *testMeterProvider) value(name string) float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.values[name]
+}
+
+type testMeter struct {
+	noop.Meter
+	provider *testMeterProvider
+}
+
+func (m *testMeter) Int64Counter(name string, _ ...metric.Int64CounterOption) (metric.Int64Counter, error) {
+	return &testCounter{name: name, provider: m.provider}, nil
+}
+
+func (m *testMeter) Float64Histogram(name string, _ ...metric.Float64HistogramOption) (metric.Float64Histogram, error) {
+	return &testHistogram{name: name, provider: m.provider}, nil
+}
+
+type testCounter struct {
+	noop.Int64Counter
+	name     string
+	provider *testMeterProvider
+}
+
+func (c *testCounter) Add(_ context.Context, incr int64, _ ...metric.AddOption) {
+	c.provider.mu.Lock()
+	defer c.provider.mu.Unlock()
+	c.provider.values[c.name] += float64(incr)
+}
+
+type testHistogram struct {
+	noop.Float64Histogram
+	name     string
+	provider *testMeterProvider
+}
+
+func (h *testHistogram) Record(_ context.Context, _ float64, _ ...metric.RecordOption) {
+	h.provider.mu.Lock()
+	defer h.provider.mu.Unlock()
+	h.provider.records[h.name]++
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestMeterProvider()
+	a, err := New(WithFS(apkfs.NewMemFS()), WithIgnoreMknodErrors(true), WithBuildTime(time.Unix(0, 0)), WithMeterProvider(provider))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+
+	pkgs := []InstallablePackage{
+		fakePackage(t, &Package{Name: "first", Version: "1.0-r0"}, nil),
+		fakePackage(t, &Package{Name: "second", Version: "1.0-r0"}, nil),
+	}
+	require.NoError(t, a.InstallPackages(ctx, nil, pkgs))
+	require.Equal(t, float64(2), provider.value("go_apk.packages.installed"))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "0123456789")
+	}))
+	defer srv.Close()
+	res, err := a.client.Get(srv.URL)
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, res.Body)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, float64(10), provider.value("go_apk.download.size"))
+
+	// without an APK, nothing is recorded
+	var m *metrics
+	m.installed(ctx, 1)
+	m.solved(ctx, time.Second, nil)
+}
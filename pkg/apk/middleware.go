@@ -0,0 +1,58 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// RequestMiddleware changes an outbound request before it is sent, e.g. to add a header
+// with a trace ID or to sign its URL. It is given a copy of the request, which it may
+// modify. An error fails the request.
+type RequestMiddleware func(*http.Request) error
+
+// middlewareClient returns a client that applies middleware, in order, to the requests sent
+// with wrapped.
+func middlewareClient(wrapped *http.Client, middleware []RequestMiddleware) *http.Client {
+	if len(middleware) == 0 || wrapped == nil {
+		return wrapped
+	}
+	return &http.Client{
+		Transport: &middlewareTransport{
+			wrapped:    wrapped,
+			middleware: middleware,
+		},
+	}
+}
+
+type middlewareTransport struct {
+	wrapped    *http.Client
+	middleware []RequestMiddleware
+}
+
+func (t *middlewareTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it was given.
+	req := request.Clone(request.Context())
+	for _, m := range t.middleware {
+		if err := m(req); err != nil {
+			if request.Body != nil {
+				request.Body.Close()
+			}
+			return nil, fmt.Errorf("request middleware for %s: %w", req.URL.Redacted(), err)
+		}
+	}
+	return t.wrapped.Do(req)
+}
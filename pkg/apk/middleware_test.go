@@ -0,0 +1,105 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestMiddleware(t *testing.T) {
+	ctx := context.Background()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("signature") != "trace-1" {
+			http.Error(w, "unsigned", http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(r.Header.Get("X-Trace-Id") + " " + r.Header.Get("Authorization")))
+	}))
+	defer srv.Close()
+
+	a, err := New(
+		WithBearerToken(srv.Listener.Addr().String(), "token"),
+		WithRequestMiddleware(func(req *http.Request) error {
+			req.Header.Set("X-Trace-Id", "trace-1")
+			return nil
+		}),
+		// sees what the middleware before it did
+		WithRequestMiddleware(func(req *http.Request) error {
+			if req.URL.Path == "/forbidden" {
+				return errors.New("forbidden path")
+			}
+			q := req.URL.Query()
+			q.Set("signature", req.Header.Get("X-Trace-Id"))
+			req.URL.RawQuery = q.Encode()
+			return nil
+		}),
+	)
+	require.NoError(t, err)
+	a.SetClient(srv.Client())
+
+	b, err := a.fetchFile(ctx, srv.URL+"/key.rsa.pub")
+	require.NoError(t, err)
+	require.Equal(t, "trace-1 Bearer token", string(b))
+
+	_, err = a.fetchFile(ctx, srv.URL+"/forbidden")
+	require.ErrorContains(t, err, "forbidden path")
+
+	_, err = New(WithRequestMiddleware(nil))
+	require.Error(t, err)
+}
+
+func TestUserAgent(t *testing.T) {
+	ctx := context.Background()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("User-Agent")))
+	}))
+	defer srv.Close()
+
+	a, err := New()
+	require.NoError(t, err)
+	a.SetClient(srv.Client())
+	b, err := a.fetchFile(ctx, srv.URL+"/key.rsa.pub")
+	require.NoError(t, err)
+	require.Equal(t, "go-apk/devel", string(b))
+	require.Equal(t, "go-apk/devel", DefaultUserAgent())
+
+	a, err = New(WithUserAgent("builder/1.2"))
+	require.NoError(t, err)
+	a.SetClient(srv.Client())
+	b, err = a.fetchFile(ctx, srv.URL+"/key.rsa.pub")
+	require.NoError(t, err)
+	require.Equal(t, "builder/1.2 go-apk/devel", string(b))
+
+	a, err = New(WithUserAgent("builder/1.2"), WithRequestMiddleware(func(req *http.Request) error {
+		req.Header.Set("User-Agent", "custom")
+		return nil
+	}))
+	require.NoError(t, err)
+	a.SetClient(srv.Client())
+	b, err = a.fetchFile(ctx, srv.URL+"/key.rsa.pub")
+	require.NoError(t, err)
+	require.Equal(t, "custom", string(b))
+
+	_, err = New(WithUserAgent(" "))
+	require.Error(t, err)
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// offlineTransport fails every request. It backs the client of an offline APK, so that
+// anything that is not served from the cache is an error rather than a network request.
+type offlineTransport struct{}
+
+func (offlineTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	return nil, &OfflineError{Missing: []string{request.URL.Redacted()}}
+}
+
+func offlineClient() *http.Client {
+	return &http.Client{Transport: offlineTransport{}}
+}
+
+// checkOfflinePackages returns an OfflineError listing every remote package that is in
+// neither the expanded package cache nor the raw package cache.
+func (a *APK) checkOfflinePackages(ctx context.Context, pkgs []InstallablePackage) error {
+	var missing []string
+	for _, pkg := range pkgs {
+		u, err := packageAsURL(pkg)
+		if err != nil {
+			return err
+		}
+		if !a.isRemote(pkg.URL()) {
+			continue
+		}
+
+		cacheDir, err := a.cache.packageCacheDir(pkg)
+		if err != nil {
+			return err
+		}
+		if _, err := a.cachedPackage(ctx, pkg, cacheDir); err == nil {
+			continue
+		}
+		rawDir, err := cacheDirForPackage(a.cache.dir, pkg)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(rawDir + ".apk"); err == nil {
+			continue
+		}
+		missing = append(missing, u.Redacted())
+	}
+	if len(missing) != 0 {
+		return &OfflineError{Missing: missing}
+	}
+	return nil
+}
+
+// checkOfflineIndexes returns an OfflineError listing every remote repository index that
+// has no cached copy.
+func (a *APK) checkOfflineIndexes(repos []string, arch string) error {
+	var missing []string
+	for _, repo := range repos {
+		_, repoURL, err := ParseRepositoryLine(repo)
+		if err != nil {
+			return err
+		}
+		u, err := url.Parse(IndexURL(repoURL, arch))
+		if err != nil || !a.isRemote(u.String()) {
+			continue
+		}
+
+		cacheFile, err := cachePathFromURL(a.cache.dir, *u)
+		if err != nil {
+			return err
+		}
+		if des, err := os.ReadDir(cacheDirFromFile(cacheFile)); err == nil && len(des) != 0 {
+			continue
+		}
+		missing = append(missing, u.Redacted())
+	}
+	if len(missing) != 0 {
+		return &OfflineError{Missing: missing}
+	}
+	return nil
+}
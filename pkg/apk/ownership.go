@@ -0,0 +1,224 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// IDMapping maps a range of user or group ids of packages to ids on the filesystem, like a
+// line of /proc/self/uid_map in a user namespace: the Size ids from ContainerID are the ids
+// from HostID on the filesystem.
+type IDMapping struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// idMap maps ids by IDMappings.
+type idMap []IDMapping
+
+// toHost returns the id on the filesystem of id, and whether it is mapped.
+func (m idMap) toHost(id int) (int, bool) {
+	for _, mapping := range m {
+		if id >= mapping.ContainerID && id < mapping.ContainerID+mapping.Size {
+			return mapping.HostID + id - mapping.ContainerID, true
+		}
+	}
+	return 0, false
+}
+
+func (m idMap) validate() error {
+	for _, mapping := range m {
+		if mapping.ContainerID < 0 || mapping.HostID < 0 || mapping.Size <= 0 {
+			return fmt.Errorf("invalid id mapping %d %d %d", mapping.ContainerID, mapping.HostID, mapping.Size)
+		}
+	}
+	return nil
+}
+
+// owner is the owner of a file.
+type owner struct {
+	uid, gid int
+}
+
+// chownMapped sets the owner of an installed file to the one in its header, by the id maps,
+// see WithIDMap, and records it in the ownership file. Files whose owner is not mapped keep
+// the owner that they were created with, normally the current user.
+func (a *APK) chownMapped(header *tar.Header) error {
+	a.extractMu.Lock()
+	if a.owners == nil {
+		a.owners = map[string]owner{}
+	}
+	a.owners[strings.TrimSuffix(header.Name, "/")] = owner{uid: header.Uid, gid: header.Gid}
+	a.extractMu.Unlock()
+
+	uid, uidMapped := a.uidMap.toHost(header.Uid)
+	gid, gidMapped := a.gidMap.toHost(header.Gid)
+	if !uidMapped || !gidMapped || !a.supports(apkfs.FeatureOwnership) {
+		return nil
+	}
+	if err := a.fs.Chown(header.Name, uid, gid); err != nil && !a.ignoreChownErrors {
+		return fmt.Errorf("error setting owner %d:%d (%d:%d on disk) of %s: %w", header.Uid, header.Gid, uid, gid, header.Name, err)
+	}
+	return nil
+}
+
+// readOwnership reads the ownership file, which has a line of uid:gid and path for each
+// file that is not owned by root.
+func (a *APK) readOwnership() (map[string]owner, error) {
+	owners := map[string]owner{}
+	b, err := a.fs.ReadFile(ownershipFilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return owners, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", ownershipFilePath, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		ids, name, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			return nil, fmt.Errorf("invalid line in %s: %q", ownershipFilePath, scanner.Text())
+		}
+		uid, gid, ok := strings.Cut(ids, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid line in %s: %q", ownershipFilePath, scanner.Text())
+		}
+		var o owner
+		if o.uid, err = strconv.Atoi(uid); err != nil {
+			return nil, fmt.Errorf("invalid uid in %s: %q", ownershipFilePath, scanner.Text())
+		}
+		if o.gid, err = strconv.Atoi(gid); err != nil {
+			return nil, fmt.Errorf("invalid gid in %s: %q", ownershipFilePath, scanner.Text())
+		}
+		owners[name] = o
+	}
+	return owners, scanner.Err()
+}
+
+// writeOwnership adds the owners recorded by chownMapped to the ownership file.
+func (a *APK) writeOwnership() error {
+	if len(a.owners) == 0 {
+		return nil
+	}
+	owners, err := a.readOwnership()
+	if err != nil {
+		return err
+	}
+	for name, o := range a.owners {
+		if o == (owner{}) {
+			delete(owners, name)
+		} else {
+			owners[name] = o
+		}
+	}
+	a.owners = nil
+
+	names := make([]string, 0, len(owners))
+	for name := range owners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&b, "%d:%d %s\n", owners[name].uid, owners[name].gid, name)
+	}
+	if err := a.fs.WriteFile(ownershipFilePath, b.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("writing %s: %w", ownershipFilePath, err)
+	}
+	return nil
+}
+
+// WriteTar writes the filesystem as a tar to w. With WithIDMap, files are owned by the owners
+// that packages set for them, rather than by those on disk, and the ownership file that
+// records them is left out.
+func (a *APK) WriteTar(ctx context.Context, w io.Writer) error {
+	_, span := otel.Tracer("go-apk").Start(ctx, "WriteTar")
+	defer span.End()
+
+	var owners map[string]owner
+	if a.idMapped {
+		var err error
+		if owners, err = a.readOwnership(); err != nil {
+			return err
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	if err := fs.WalkDir(a.fs, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "." || (a.idMapped && name == ownershipFilePath) {
+			return nil
+		}
+		info, err := a.fs.Lstat(name)
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = a.fs.Readlink(name); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return fmt.Errorf("creating tar header for %s: %w", name, err)
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if a.idMapped {
+			o := owners[name]
+			header.Uid, header.Gid = o.uid, o.gid
+			header.Uname, header.Gname = "", ""
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := a.fs.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.Copy(tw, f); err != nil {
+			return fmt.Errorf("writing %s to tar: %w", name, err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return tw.Close()
+}
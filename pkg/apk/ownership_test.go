@@ -0,0 +1,96 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithIDMap(t *testing.T) {
+	ctx := context.Background()
+	_, src, err := testGetTestAPK()
+	require.NoError(t, err)
+	a, err := New(WithFS(src), WithIDMap(
+		[]IDMapping{{ContainerID: 1000, HostID: 2000, Size: 10}},
+		[]IDMapping{{ContainerID: 1000, HostID: 3000, Size: 10}},
+	))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, header := range []*tar.Header{
+		{Name: "srv", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "srv/mapped", Typeflag: tar.TypeReg, Mode: 0o644, Uid: 1001, Gid: 1002, Size: 1},
+		{Name: "srv/unmapped", Typeflag: tar.TypeReg, Mode: 0o644, Uid: 70, Gid: 70, Size: 1},
+	} {
+		require.NoError(t, tw.WriteHeader(header))
+		if header.Size != 0 {
+			_, err := tw.Write([]byte("x"))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+
+	headers, err := a.installAPKFiles(ctx, &buf, &Package{Name: "srv"})
+	require.NoError(t, err)
+	require.NoError(t, a.writeOwnership())
+
+	// the installed database has the owners of the package
+	for _, header := range headers {
+		if header.Name == "srv/unmapped" {
+			require.Equal(t, 70, header.Uid)
+		}
+	}
+	// the filesystem has the mapped ones, where they are mapped
+	fi, err := src.Stat("srv/mapped")
+	require.NoError(t, err)
+	require.Equal(t, 2001, fi.Sys().(*tar.Header).Uid)
+	require.Equal(t, 3002, fi.Sys().(*tar.Header).Gid)
+	fi, err = src.Stat("srv/unmapped")
+	require.NoError(t, err)
+	require.Equal(t, 0, fi.Sys().(*tar.Header).Uid)
+
+	ownership, err := src.ReadFile(ownershipFilePath)
+	require.NoError(t, err)
+	require.Equal(t, "1001:1002 srv/mapped\n70:70 srv/unmapped\n", string(ownership))
+
+	// and the tar has the ones the package set
+	var out bytes.Buffer
+	require.NoError(t, a.WriteTar(ctx, &out))
+	owners := map[string][2]int{}
+	tr := tar.NewReader(&out)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		owners[header.Name] = [2]int{header.Uid, header.Gid}
+	}
+	require.Equal(t, [2]int{0, 0}, owners["srv/"])
+	require.Equal(t, [2]int{1001, 1002}, owners["srv/mapped"])
+	require.Equal(t, [2]int{70, 70}, owners["srv/unmapped"])
+	require.NotContains(t, owners, ownershipFilePath)
+
+	_, err = New(WithIDMap([]IDMapping{{ContainerID: 0, HostID: 1000, Size: 0}}, nil))
+	require.Error(t, err)
+}
@@ -16,6 +16,7 @@ package apk
 
 import (
 	"archive/tar"
+	"bufio"
 	"context"
 	"encoding/base64"
 	"fmt"
@@ -23,8 +24,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/chainguard-dev/go-apk/pkg/adb"
 	"github.com/chainguard-dev/go-apk/pkg/expandapk"
-	"gopkg.in/ini.v1"
+	"github.com/chainguard-dev/go-apk/pkg/pkginfo"
 )
 
 // PackageToInstalled takes a Package and returns it as the string representation of lines in a /lib/apk/db/installed file.
@@ -42,8 +44,13 @@ func PackageToInstalled(pkg *Package) (out []string) {
 	if len(pkg.Replaces) != 0 {
 		out = append(out, fmt.Sprintf("r:%s", strings.Join(pkg.Replaces, " ")))
 	}
+	if pkg.ReplacesPriority != 0 {
+		out = append(out, fmt.Sprintf("q:%d", pkg.ReplacesPriority))
+	}
 	out = append(out, fmt.Sprintf("c:%s", pkg.RepoCommit))
-	out = append(out, fmt.Sprintf("i:%s", pkg.InstallIf))
+	if len(pkg.InstallIf) != 0 {
+		out = append(out, fmt.Sprintf("i:%s", strings.Join(pkg.InstallIf, " ")))
+	}
 	out = append(out, fmt.Sprintf("t:%d", pkg.BuildTime.Unix()))
 	out = append(out, fmt.Sprintf("S:%d", pkg.Size))
 	out = append(out, fmt.Sprintf("I:%d", pkg.InstalledSize))
@@ -84,6 +91,7 @@ type Package struct {
 	BuildDate        int64    `ini:"builddate"`
 	RepoCommit       string   `ini:"commit"`
 	Replaces         []string `ini:"replaces,,allowshadow"`
+	ReplacesPriority uint64   `ini:"replaces_priority"`
 	DataHash         string   `ini:"datahash"`
 }
 
@@ -103,9 +111,36 @@ func (p *Package) ChecksumString() string {
 	return "Q1" + base64.StdEncoding.EncodeToString(p.Checksum)
 }
 
-// ParsePackage parses a .apk file and returns a Package struct
+// mergeProvenance fills in where pkg, as read from its .PKGINFO, came from with what the
+// APKINDEX entry idx has, as older packages have no commit or maintainer in .PKGINFO.
+func mergeProvenance(pkg, idx *Package) {
+	if idx == nil {
+		return
+	}
+	if pkg.RepoCommit == "" {
+		pkg.RepoCommit = idx.RepoCommit
+	}
+	if pkg.Maintainer == "" {
+		pkg.Maintainer = idx.Maintainer
+	}
+	if pkg.Origin == "" {
+		pkg.Origin = idx.Origin
+	}
+}
+
+// ParsePackage parses a .apk file and returns a Package struct. apk-tools v3 packages are
+// detected by their magic and supported too.
 func ParsePackage(ctx context.Context, apkPackage io.Reader) (*Package, error) {
-	expanded, err := expandapk.ExpandApk(ctx, apkPackage, "")
+	br := bufio.NewReader(apkPackage)
+	if magic, _ := br.Peek(4); adb.IsADB(magic) {
+		pr, err := adb.NewPackageReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("reading apk-tools v3 package: %w", err)
+		}
+		return packageFromADB(pr.Package().Info), nil
+	}
+
+	expanded, err := expandapk.ExpandApk(ctx, br, "")
 	if err != nil {
 		return nil, fmt.Errorf("expandApk(): %v", err)
 	}
@@ -121,19 +156,36 @@ func ParsePackage(ctx context.Context, apkPackage io.Reader) (*Package, error) {
 		return nil, fmt.Errorf("tarRead.Next(): %v", err)
 	}
 
-	cfg, err := ini.ShadowLoad(tarRead)
+	info, err := pkginfo.Parse(tarRead)
 	if err != nil {
-		return nil, fmt.Errorf("ini.ShadowLoad(): %w", err)
+		return nil, fmt.Errorf("parsing .PKGINFO: %w", err)
 	}
 
-	pkg := new(Package)
-	if err = cfg.MapTo(pkg); err != nil {
-		return nil, fmt.Errorf("cfg.MapTo(): %w", err)
-	}
-	pkg.BuildTime = time.Unix(pkg.BuildDate, 0).UTC()
-	pkg.InstalledSize = pkg.Size
-	pkg.Size = uint64(expanded.Size)
-	pkg.Checksum = expanded.ControlHash
+	return packageFromPkgInfo(info, expanded), nil
+}
 
-	return pkg, nil
+// packageFromPkgInfo returns the Package described by the .PKGINFO of the expanded apk.
+func packageFromPkgInfo(info *pkginfo.PkgInfo, exp *expandapk.APKExpanded) *Package {
+	return &Package{
+		Name:             info.Name,
+		Version:          info.Version,
+		Arch:             info.Arch,
+		Description:      info.Description,
+		License:          info.License,
+		Origin:           info.Origin,
+		Maintainer:       info.Maintainer,
+		URL:              info.URL,
+		Checksum:         exp.ControlHash,
+		Dependencies:     info.Depends,
+		Provides:         info.Provides,
+		Size:             uint64(exp.Size),
+		InstalledSize:    info.Size,
+		ProviderPriority: info.ProviderPriority,
+		BuildTime:        time.Unix(info.BuildDate, 0).UTC(),
+		BuildDate:        info.BuildDate,
+		RepoCommit:       info.Commit,
+		Replaces:         info.Replaces,
+		ReplacesPriority: info.ReplacesPriority,
+		DataHash:         info.DataHash,
+	}
 }
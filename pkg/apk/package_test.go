@@ -83,3 +83,21 @@ func TestParsePackage(t *testing.T) {
 		})
 	}
 }
+
+func TestMergeProvenance(t *testing.T) {
+	idx := &Package{Name: "hello", Origin: "hello-src", Maintainer: "Jane Doe <jane@example.com>", RepoCommit: "abc123"}
+
+	pkg := &Package{Name: "hello"}
+	mergeProvenance(pkg, idx)
+	want := &Package{Name: "hello", Origin: "hello-src", Maintainer: "Jane Doe <jane@example.com>", RepoCommit: "abc123"}
+	if d := cmp.Diff(want, pkg); d != "" {
+		t.Errorf("mergeProvenance() mismatch (-want  got):\n%s", d)
+	}
+
+	// what .PKGINFO has wins
+	pkg = &Package{Name: "hello", RepoCommit: "def456"}
+	mergeProvenance(pkg, idx)
+	if pkg.RepoCommit != "def456" {
+		t.Errorf("mergeProvenance() commit = %q, want def456", pkg.RepoCommit)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+// extractsConcurrently reports whether InstallPackages extracts independent packages
+// concurrently, see WithMaxConcurrentExtractions. Extract targets and lazily installing
+// filesystems see the files in the order of the packages, and transforms may rename files,
+// so that the packages they overlap in cannot be told in advance.
+func (a *APK) extractsConcurrently() bool {
+	if a.maxConcurrentExtractions <= 1 || a.extractTarget != nil || len(a.fileTransforms) != 0 {
+		return false
+	}
+	_, lazy := a.fs.(WriteHeaderer)
+	return !lazy
+}
+
+// installConcurrently installs allpkgs, expanded in expanded, like InstallPackages does one
+// at a time, but for extracting the consecutive packages that are independent of the others
+// concurrently, see independentPackages. It fills in infos and allFiles.
+func (a *APK) installConcurrently(ctx context.Context, allpkgs []InstallablePackage, expanded []*expandapk.APKExpanded, infos []*Package, allFiles [][]tar.Header, sourceDateEpoch *time.Time) error {
+	for i, pkg := range allpkgs {
+		pkgInfo, err := a.installablePackageInfo(pkg, expanded[i])
+		if err != nil {
+			return err
+		}
+		infos[i] = pkgInfo
+	}
+
+	independent, err := a.independentPackages(expanded, infos)
+	if err != nil {
+		return err
+	}
+
+	var batch []int
+	for i, pkgInfo := range infos {
+		if pkgInfo == nil {
+			continue
+		}
+		if independent[i] {
+			batch = append(batch, i)
+			continue
+		}
+		// Everything before a package that is not independent is installed before it.
+		if err := a.extractBatch(ctx, batch, allpkgs, expanded, infos, allFiles, sourceDateEpoch); err != nil {
+			return err
+		}
+		batch = batch[:0]
+
+		installedFiles, err := a.installPackage(ctx, pkgInfo, expanded[i], sourceDateEpoch)
+		if err != nil {
+			return fmt.Errorf("installing %s: %w", allpkgs[i], err)
+		}
+		allFiles[i] = installedFiles
+	}
+	return a.extractBatch(ctx, batch, allpkgs, expanded, infos, allFiles, sourceDateEpoch)
+}
+
+// extractBatch installs the packages at the indexes in batch, which are independent of each
+// other, extracting them concurrently then completing them in order.
+func (a *APK) extractBatch(ctx context.Context, batch []int, allpkgs []InstallablePackage, expanded []*expandapk.APKExpanded, infos []*Package, allFiles [][]tar.Header, sourceDateEpoch *time.Time) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "extractBatch")
+	defer span.End()
+
+	for _, i := range batch {
+		defer expanded[i].Close()
+	}
+
+	log := a.log(ctx)
+	for _, i := range batch {
+		pkg := infos[i]
+		log.Infof("installing %s (%s)", pkg.Name, pkg.Version)
+		// Independent packages run no scripts, but this reports the ones skipped.
+		if err := a.runScript(ctx, pkg, expanded[i], scriptPreInstall); err != nil {
+			return err
+		}
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(a.maxConcurrentExtractions)
+	for _, i := range batch {
+		i := i
+		g.Go(func() error {
+			installedFiles, err := a.extractPackage(gctx, infos[i], expanded[i])
+			if err != nil {
+				return fmt.Errorf("installing %s: %w", allpkgs[i], err)
+			}
+			allFiles[i] = installedFiles
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	for _, i := range batch {
+		if err := a.completePackage(ctx, infos[i], expanded[i], allFiles[i], sourceDateEpoch); err != nil {
+			return fmt.Errorf("installing %s: %w", allpkgs[i], err)
+		}
+	}
+	return nil
+}
+
+// independentPackages reports, for each package to install, expanded in expanded, whether
+// it is independent of the others, so that it can be extracted concurrently with them: none
+// of its paths, nor the directories they are in, is anything but a directory in another
+// package, the directories it shares have the same mode, owner and xattrs in the packages
+// that have them, its hardlinks are to its own files, and it runs no scripts. Packages that
+// are not to be installed, whose infos are nil, are not independent.
+func (a *APK) independentPackages(expanded []*expandapk.APKExpanded, infos []*Package) ([]bool, error) {
+	independent := make([]bool, len(infos))
+
+	// claims are the packages with each path, files the paths that are not directories in at
+	// least one of them, and dirs the metadata of the directories, which the packages that
+	// have them set in turn, so that their order matters if it differs, see mixed.
+	claims := map[string][]int{}
+	files := map[string]bool{}
+	dirs := map[string]dirMetadata{}
+	mixed := map[string]bool{}
+	clean := func(name string) string {
+		if a.usrMerge {
+			name = usrMergePath(name)
+		}
+		return cleanInstalledPath(name)
+	}
+	claim := func(i int, name string, dir bool) {
+		name = clean(name)
+		if !dir {
+			files[name] = true
+		}
+		for ; name != "." && name != ""; name = path.Dir(name) {
+			if pkgs := claims[name]; len(pkgs) == 0 || pkgs[len(pkgs)-1] != i {
+				claims[name] = append(pkgs, i)
+			}
+		}
+	}
+
+	for i, exp := range expanded {
+		if infos[i] == nil {
+			continue
+		}
+		independent[i] = true
+
+		if a.runScripts {
+			for _, script := range []string{scriptPreInstall, scriptPostInstall} {
+				if _, err := fs.Stat(exp.ControlFS, script); err == nil {
+					independent[i] = false
+				} else if !errors.Is(err, fs.ErrNotExist) {
+					return nil, fmt.Errorf("reading %s script of %s: %w", script, infos[i].Name, err)
+				}
+			}
+		}
+
+		var startedDataSection bool
+		for _, file := range exp.TarFS.Entries() {
+			// see installAPKFiles
+			if !startedDataSection && file.Header.Name[0] == '.' && !strings.Contains(file.Header.Name, "/") {
+				continue
+			}
+			startedDataSection = true
+
+			claim(i, file.Header.Name, file.Header.Typeflag == tar.TypeDir)
+			if file.Header.Typeflag == tar.TypeDir {
+				name, meta := clean(file.Header.Name), newDirMetadata(&file.Header)
+				if prev, ok := dirs[name]; !ok {
+					dirs[name] = meta
+				} else if prev != meta {
+					mixed[name] = true
+				}
+			}
+			if file.Header.Typeflag == tar.TypeLink {
+				claim(i, file.Header.Linkname, false)
+			}
+		}
+	}
+
+	for name, pkgs := range claims {
+		if len(pkgs) > 1 && (files[name] || mixed[name]) {
+			for _, i := range pkgs {
+				independent[i] = false
+			}
+		}
+	}
+	return independent, nil
+}
+
+// dirMetadata is what installing a directory sets on it, see installAPKFiles.
+type dirMetadata struct {
+	mode     fs.FileMode
+	uid, gid int
+	xattrs   string
+}
+
+// newDirMetadata returns the metadata of the directory of header.
+func newDirMetadata(header *tar.Header) dirMetadata {
+	xattrs := map[string]string{}
+	for k, v := range header.PAXRecords {
+		if strings.HasPrefix(k, xattrTarPAXRecordsPrefix) {
+			xattrs[k] = v
+		}
+	}
+	// maps are printed sorted by key
+	return dirMetadata{
+		mode:   header.FileInfo().Mode(),
+		uid:    header.Uid,
+		gid:    header.Gid,
+		xattrs: fmt.Sprint(xattrs),
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+func TestConcurrentExtractions(t *testing.T) {
+	ctx := context.Background()
+
+	usrBin := []testDirEntry{
+		{"usr", 0o755, true, nil, nil},
+		{"usr/bin", 0o755, true, nil, nil},
+	}
+	pkgA := fakePackage(t, &Package{Name: "a", Version: "1.0-r0"}, append(usrBin, testDirEntry{"usr/bin/a", 0o755, false, []byte("a"), nil}))
+	pkgB := fakePackage(t, &Package{Name: "b", Version: "1.0-r0"}, append(usrBin, testDirEntry{"usr/bin/b", 0o755, false, []byte("b"), nil}))
+	// the same file as a, from the same origin
+	pkgC := fakePackage(t, &Package{Name: "c", Version: "1.0-r0", Origin: "a"}, append(usrBin, testDirEntry{"usr/bin/a", 0o755, false, []byte("a"), nil}))
+
+	t.Run("independent", func(t *testing.T) {
+		// d has a file where e has a directory
+		pkgD := fakePackage(t, &Package{Name: "d", Version: "1.0-r0"}, []testDirEntry{
+			{"opt", 0o755, true, nil, nil},
+			{"opt/d", 0o644, false, []byte("d"), nil},
+		})
+		pkgE := fakePackage(t, &Package{Name: "e", Version: "1.0-r0"}, []testDirEntry{
+			{"opt/d/e", 0o644, false, []byte("e"), nil},
+		})
+		pkgF := fakePackageWithScripts(t, &Package{Name: "f", Version: "1.0-r0"}, []testDirEntry{
+			{"opt/f", 0o644, false, []byte("f"), nil},
+		}, map[string][]byte{".post-install": []byte("post")}, nil)
+
+		_, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		a, err := New(WithFS(src), WithMaxConcurrentExtractions(4))
+		require.NoError(t, err)
+		require.True(t, a.extractsConcurrently())
+
+		pkgs := []InstallablePackage{pkgA, pkgB, pkgC, pkgD, pkgE, pkgF}
+		expanded := make([]*expandapk.APKExpanded, len(pkgs))
+		infos := make([]*Package, len(pkgs))
+		for i, pkg := range pkgs {
+			expanded[i], err = a.expandPackage(ctx, pkg)
+			require.NoError(t, err)
+			defer expanded[i].Close()
+			infos[i], err = packageInfo(expanded[i])
+			require.NoError(t, err)
+		}
+
+		independent, err := a.independentPackages(expanded, infos)
+		require.NoError(t, err)
+		require.Equal(t, []bool{false, true, false, false, false, true}, independent)
+
+		// Scripts are only run in order.
+		a.runScripts = true
+		independent, err = a.independentPackages(expanded, infos)
+		require.NoError(t, err)
+		require.Equal(t, []bool{false, true, false, false, false, false}, independent)
+
+		// Packages that are not installed are left out.
+		infos[0] = nil
+		a.runScripts = false
+		independent, err = a.independentPackages(expanded, infos)
+		require.NoError(t, err)
+		require.Equal(t, []bool{false, true, true, false, false, true}, independent)
+	})
+
+	t.Run("directory metadata", func(t *testing.T) {
+		// g and h have srv with different modes, and i as g has it
+		pkgG := fakePackage(t, &Package{Name: "g", Version: "1.0-r0"}, []testDirEntry{
+			{"srv", 0o755, true, nil, nil},
+			{"srv/g", 0o644, false, []byte("g"), nil},
+		})
+		pkgH := fakePackage(t, &Package{Name: "h", Version: "1.0-r0"}, []testDirEntry{
+			{"srv", 0o700, true, nil, nil},
+			{"srv/h", 0o644, false, []byte("h"), nil},
+		})
+		pkgI := fakePackage(t, &Package{Name: "i", Version: "1.0-r0"}, []testDirEntry{
+			{"srv", 0o755, true, nil, nil},
+			{"srv/i", 0o644, false, []byte("i"), nil},
+		})
+		// j and k have var the same way, l and m with different xattrs
+		pkgJ := fakePackage(t, &Package{Name: "j", Version: "1.0-r0"}, []testDirEntry{
+			{"var", 0o755, true, nil, nil},
+			{"var/j", 0o644, false, []byte("j"), nil},
+		})
+		pkgK := fakePackage(t, &Package{Name: "k", Version: "1.0-r0"}, []testDirEntry{
+			{"var", 0o755, true, nil, nil},
+			{"var/k", 0o644, false, []byte("k"), nil},
+		})
+		pkgL := fakePackage(t, &Package{Name: "l", Version: "1.0-r0"}, []testDirEntry{
+			{"run", 0o755, true, nil, map[string][]byte{"user.l": []byte("l")}},
+			{"run/l", 0o644, false, []byte("l"), nil},
+		})
+		pkgM := fakePackage(t, &Package{Name: "m", Version: "1.0-r0"}, []testDirEntry{
+			{"run", 0o755, true, nil, nil},
+			{"run/m", 0o644, false, []byte("m"), nil},
+		})
+
+		_, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		a, err := New(WithFS(src), WithMaxConcurrentExtractions(4))
+		require.NoError(t, err)
+
+		pkgs := []InstallablePackage{pkgG, pkgH, pkgI, pkgJ, pkgK, pkgL, pkgM}
+		expanded := make([]*expandapk.APKExpanded, len(pkgs))
+		infos := make([]*Package, len(pkgs))
+		for i, pkg := range pkgs {
+			expanded[i], err = a.expandPackage(ctx, pkg)
+			require.NoError(t, err)
+			defer expanded[i].Close()
+			infos[i], err = packageInfo(expanded[i])
+			require.NoError(t, err)
+		}
+
+		independent, err := a.independentPackages(expanded, infos)
+		require.NoError(t, err)
+		require.Equal(t, []bool{false, false, false, true, true, false, false}, independent)
+	})
+
+	t.Run("install", func(t *testing.T) {
+		_, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		a, err := New(WithFS(src), WithMaxConcurrentExtractions(4))
+		require.NoError(t, err)
+		require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{pkgA, pkgB, pkgC}))
+
+		for name, content := range map[string]string{"usr/bin/a": "a", "usr/bin/b": "b"} {
+			b, err := src.ReadFile(name)
+			require.NoError(t, err)
+			require.Equal(t, content, string(b))
+		}
+		installed, err := a.GetInstalled()
+		require.NoError(t, err)
+		var names []string
+		for _, pkg := range installed {
+			names = append(names, pkg.Name)
+		}
+		// after the packages of the test root, in order
+		require.Equal(t, []string{"a", "b", "c"}, names[len(names)-3:])
+		owner, ok := a.fileOwner("usr/bin/b")
+		require.True(t, ok)
+		require.Equal(t, "b", owner.Name)
+	})
+
+	t.Run("extract target", func(t *testing.T) {
+		a, err := New(WithExtractTarget(&ExtractRecorder{}), WithMaxConcurrentExtractions(4))
+		require.NoError(t, err)
+		require.False(t, a.extractsConcurrently())
+	})
+
+	_, err := New(WithMaxConcurrentExtractions(0))
+	require.Error(t, err)
+}
@@ -0,0 +1,168 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+// pathFilter selects the files of packages that are installed, see WithPathFilter.
+type pathFilter struct {
+	include []string
+	exclude []string
+}
+
+// newPathFilter returns the filter of include and exclude, with their globs cleaned, or an
+// error if one of them is malformed.
+func newPathFilter(include, exclude []string) (*pathFilter, error) {
+	clean := func(globs []string) ([]string, error) {
+		cleaned := make([]string, 0, len(globs))
+		for _, glob := range globs {
+			glob = strings.Trim(path.Clean("/"+glob), "/")
+			if glob == "" {
+				return nil, errors.New("empty path glob")
+			}
+			if _, err := path.Match(glob, ""); err != nil {
+				return nil, fmt.Errorf("invalid path glob %q: %w", glob, err)
+			}
+			cleaned = append(cleaned, glob)
+		}
+		return cleaned, nil
+	}
+	f := &pathFilter{}
+	var err error
+	if f.include, err = clean(include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = clean(exclude); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// installs reports whether the entry of a package with header is installed.
+func (f *pathFilter) installs(header *tar.Header) bool {
+	if f == nil {
+		return true
+	}
+	name := cleanInstalledPath(header.Name)
+	for _, glob := range f.exclude {
+		if matchPathOrParent(glob, name) {
+			return false
+		}
+	}
+	if header.Typeflag == tar.TypeLink && !f.installs(&tar.Header{Name: header.Linkname}) {
+		// the file it links to is not installed
+		return false
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, glob := range f.include {
+		if matchPathOrParent(glob, name) {
+			return true
+		}
+		// the directories that lead to included files are installed too
+		if header.Typeflag == tar.TypeDir && matchPathPrefix(glob, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPathOrParent reports whether glob matches name or one of its parent directories.
+func matchPathOrParent(glob, name string) bool {
+	for name != "." && name != "/" && name != "" {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+		name = path.Dir(name)
+	}
+	return false
+}
+
+// matchPathPrefix reports whether dir is a directory that paths matched by glob are in.
+func matchPathPrefix(glob, dir string) bool {
+	globParts, dirParts := strings.Split(glob, "/"), strings.Split(dir, "/")
+	if len(dirParts) >= len(globParts) {
+		return false
+	}
+	for i, part := range dirParts {
+		if ok, _ := path.Match(globParts[i], part); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// writeOmitted adds the files of pkg that the path filter did not install to the omitted
+// file, which has a line of the package checksum and path for each of them.
+func (a *APK) writeOmitted(pkg *Package, omitted []string) error {
+	if len(omitted) == 0 {
+		return nil
+	}
+	f, err := a.fs.OpenFile(omittedFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to open omitted file %s: %w", omittedFilePath, err)
+	}
+	defer f.Close()
+
+	var b bytes.Buffer
+	checksum := base64.StdEncoding.EncodeToString(pkg.Checksum)
+	for _, name := range omitted {
+		fmt.Fprintf(&b, "%s %s\n", checksum, cleanInstalledPath(name))
+	}
+	if _, err := f.Write(b.Bytes()); err != nil {
+		return fmt.Errorf("unable to write omitted file %s: %w", omittedFilePath, err)
+	}
+	return nil
+}
+
+// loadOmitted reads the omitted file into the packages it records files of, see
+// InstalledPackage.Omitted.
+func (db *InstalledDB) loadOmitted(fsys fs.FS, byChecksum map[string]*InstalledPackage) error {
+	f, err := fsys.Open(omittedFilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not open omitted file at %s: %w", omittedFilePath, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		checksum, name, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		if pkg, ok := byChecksum[checksum]; ok {
+			pkg.Omitted = append(pkg.Omitted, name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading omitted file at %s: %w", omittedFilePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathFilter(t *testing.T) {
+	ctx := context.Background()
+
+	pkg := fakePackage(t, &Package{Name: "hello", Version: "1.0-r0"}, []testDirEntry{
+		{"usr", 0o755, true, nil, nil},
+		{"usr/bin", 0o755, true, nil, nil},
+		{"usr/bin/hello", 0o755, false, []byte("hello"), nil},
+		{"usr/share", 0o755, true, nil, nil},
+		{"usr/share/man", 0o755, true, nil, nil},
+		{"usr/share/man/man1", 0o755, true, nil, nil},
+		{"usr/share/man/man1/hello.1", 0o644, false, []byte("manual"), nil},
+		{"usr/share/hello", 0o755, true, nil, nil},
+		{"usr/share/hello/data", 0o644, false, []byte("data"), nil},
+		{"usr/share/hello/data.mo", 0o644, false, []byte("locale"), nil},
+	})
+
+	_, src, err := testGetTestAPK()
+	require.NoError(t, err)
+	a, err := New(WithFS(src), WithPathFilter(nil, []string{"/usr/share/man", "usr/share/*/*.mo"}))
+	require.NoError(t, err)
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{pkg}))
+
+	for _, name := range []string{"usr/bin/hello", "usr/share/hello/data"} {
+		_, err := src.Stat(name)
+		require.NoError(t, err, name)
+	}
+	for _, name := range []string{"usr/share/man", "usr/share/hello/data.mo"} {
+		_, err := src.Stat(name)
+		require.ErrorIs(t, err, fs.ErrNotExist, name)
+	}
+
+	db, err := a.InstalledDB()
+	require.NoError(t, err)
+	installed, ok := db.Package("hello")
+	require.True(t, ok)
+	require.Equal(t, []string{
+		"usr/share/man",
+		"usr/share/man/man1",
+		"usr/share/man/man1/hello.1",
+		"usr/share/hello/data.mo",
+	}, installed.Omitted)
+	_, ok = db.Owner("usr/share/man/man1/hello.1")
+	require.False(t, ok)
+
+	_, err = New(WithPathFilter([]string{"usr/["}, nil))
+	require.Error(t, err)
+}
+
+func TestPathFilterInclude(t *testing.T) {
+	f, err := newPathFilter([]string{"usr/bin/*", "etc/hello"}, []string{"usr/bin/debug-*"})
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		header   tar.Header
+		installs bool
+	}{
+		{tar.Header{Name: "usr", Typeflag: tar.TypeDir}, true},
+		{tar.Header{Name: "usr/bin/", Typeflag: tar.TypeDir}, true},
+		{tar.Header{Name: "usr/bin/hello", Typeflag: tar.TypeReg}, true},
+		{tar.Header{Name: "usr/bin/debug-hello", Typeflag: tar.TypeReg}, false},
+		{tar.Header{Name: "usr/share", Typeflag: tar.TypeDir}, false},
+		{tar.Header{Name: "usr/share/hello", Typeflag: tar.TypeReg}, false},
+		{tar.Header{Name: "etc/hello/hello.conf", Typeflag: tar.TypeReg}, true},
+		{tar.Header{Name: "usr/bin/hi", Typeflag: tar.TypeLink, Linkname: "usr/bin/hello"}, true},
+		{tar.Header{Name: "usr/bin/hi", Typeflag: tar.TypeLink, Linkname: "usr/bin/debug-hello"}, false},
+	} {
+		require.Equal(t, tt.installs, f.installs(&tt.header), tt.header.Name)
+	}
+}
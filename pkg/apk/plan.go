@@ -0,0 +1,64 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// PlanWorld resolves the world, see ResolveWorld, and returns how the installed packages
+// would change, sorted by name: the packages to add, upgrade or downgrade, and the
+// installed packages that the world no longer needs. Does not install anything.
+func (a *APK) PlanWorld(ctx context.Context) ([]PackageChange, error) {
+	toInstall, _, err := a.ResolveWorld(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return a.installedChanges(toInstall)
+}
+
+// installedChanges returns how the installed packages change to pkgs, see DiffPackages.
+func (a *APK) installedChanges(pkgs []*RepositoryPackage) ([]PackageChange, error) {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("error getting installed packages: %w", err)
+	}
+	current := make([]*RepositoryPackage, len(installed))
+	for i, pkg := range installed {
+		current[i] = NewRepositoryPackage(&pkg.Package, nil)
+	}
+	return DiffPackages(current, pkgs), nil
+}
+
+// checkDowngrades fails if pkgs downgrade installed packages, as installing does not replace
+// installed packages: the installed versions would be kept.
+func (a *APK) checkDowngrades(pkgs []*RepositoryPackage) error {
+	changes, err := a.installedChanges(pkgs)
+	if err != nil {
+		return err
+	}
+	var downgrades []string
+	for _, change := range changes {
+		if change.Kind == ChangeDowngraded {
+			downgrades = append(downgrades, change.String())
+		}
+	}
+	if len(downgrades) != 0 {
+		return fmt.Errorf("cannot downgrade installed packages in place, install into a new root instead:\n%s", strings.Join(downgrades, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Policy decides which packages the resolver may select. Packages that it does not allow
+// are never resolved, as if they were not in the indexes, and when nothing else satisfies
+// a constraint the resolution error wraps their *PolicyViolation, see errors.As.
+type Policy interface {
+	// Evaluate returns why pkg is not allowed, or nil if it is. It is called concurrently
+	// for the packages of different indexes.
+	Evaluate(pkg *RepositoryPackage) *PolicyViolation
+}
+
+// PolicyRule is the kind of rule a package violates.
+type PolicyRule string
+
+const (
+	PolicyRuleName       PolicyRule = "name"
+	PolicyRuleLicense    PolicyRule = "license"
+	PolicyRuleRepository PolicyRule = "repository"
+	PolicyRuleVersion    PolicyRule = "version"
+	PolicyRuleSecurity   PolicyRule = "security"
+	PolicyRuleExcluded   PolicyRule = "excluded"
+	PolicyRuleHeld       PolicyRule = "held"
+	PolicyRuleDowngrade  PolicyRule = "downgrade"
+	PolicyRuleArch       PolicyRule = "arch"
+)
+
+// PolicyViolation is why a Policy does not allow a package.
+type PolicyViolation struct {
+	Package *RepositoryPackage
+	Rule    PolicyRule
+	Reason  string
+}
+
+func (v *PolicyViolation) Error() string {
+	return fmt.Sprintf("%s is not allowed by policy: %s", v.Package.Filename(), v.Reason)
+}
+
+// PolicyRules is a Policy of block and allow lists. A package is allowed when it breaks
+// none of the rules that are set.
+type PolicyRules struct {
+	// BlockedPackages are globs, as in path.Match, of the names of packages that are not
+	// allowed.
+	BlockedPackages []string
+	// BlockedLicenses are licenses that are not allowed. A package is blocked when any
+	// license in its license expression is, whatever the operators.
+	BlockedLicenses []string
+	// AllowedLicenses, if set, are the only licenses that are allowed. A package is allowed
+	// when every license in its license expression is; packages without a license are not.
+	AllowedLicenses []string
+	// BlockedRepositories are globs, as in path.Match, of the URIs of repositories whose
+	// packages are not allowed.
+	BlockedRepositories []string
+	// MinimumVersions maps package names to the lowest version of them that is allowed,
+	// e.g. "openssl": "3" for "no openssl<3".
+	MinimumVersions map[string]string
+}
+
+// Evaluate implements Policy.
+func (r *PolicyRules) Evaluate(pkg *RepositoryPackage) *PolicyViolation {
+	violation := func(rule PolicyRule, format string, args ...any) *PolicyViolation {
+		return &PolicyViolation{Package: pkg, Rule: rule, Reason: fmt.Sprintf(format, args...)}
+	}
+
+	for _, glob := range r.BlockedPackages {
+		if ok, _ := path.Match(glob, pkg.Name); ok {
+			return violation(PolicyRuleName, "package %s is blocked by %q", pkg.Name, glob)
+		}
+	}
+
+	licenses := licenseIDs(pkg.License)
+	for _, license := range licenses {
+		if containsFold(r.BlockedLicenses, license) {
+			return violation(PolicyRuleLicense, "license %s is blocked", license)
+		}
+	}
+	if len(r.AllowedLicenses) != 0 {
+		if len(licenses) == 0 {
+			return violation(PolicyRuleLicense, "package has no license")
+		}
+		for _, license := range licenses {
+			if !containsFold(r.AllowedLicenses, license) {
+				return violation(PolicyRuleLicense, "license %s is not allowed", license)
+			}
+		}
+	}
+
+	if repo := pkg.Repository(); repo != nil && repo.Repository != nil {
+		for _, glob := range r.BlockedRepositories {
+			if ok, _ := path.Match(glob, repo.URI); ok {
+				return violation(PolicyRuleRepository, "repository %s is blocked by %q", repo.URI, glob)
+			}
+		}
+	}
+
+	if minimum, ok := r.MinimumVersions[pkg.Name]; ok {
+		minVersion, err := parseVersion(minimum)
+		if err != nil {
+			return violation(PolicyRuleVersion, "invalid minimum version %q: %v", minimum, err)
+		}
+		actual, err := parseVersion(pkg.Version)
+		if err != nil {
+			return violation(PolicyRuleVersion, "invalid version %q: %v", pkg.Version, err)
+		}
+		if compareVersions(actual, minVersion) == less {
+			return violation(PolicyRuleVersion, "version %s is lower than %s", pkg.Version, minimum)
+		}
+	}
+
+	return nil
+}
+
+// licenseIDs returns the licenses in an SPDX license expression, without its operators
+// and exceptions.
+func licenseIDs(expression string) []string {
+	var (
+		ids       []string
+		exception bool
+	)
+	for _, f := range strings.FieldsFunc(expression, func(r rune) bool {
+		return r == ' ' || r == '(' || r == ')'
+	}) {
+		switch strings.ToUpper(f) {
+		case "AND", "OR":
+			continue
+		case "WITH":
+			exception = true
+			continue
+		}
+		if exception {
+			exception = false
+			continue
+		}
+		ids = append(ids, f)
+	}
+	return ids
+}
+
+func containsFold(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithResolverPolicy adds a policy that the packages the resolver selects must follow.
+func WithResolverPolicy(policy Policy) ResolverOption {
+	return func(p *PkgResolver) {
+		p.policies = append(p.policies, policy)
+	}
+}
+
+// evaluatePolicies returns the first violation of the policies of the resolver by pkg.
+func (p *PkgResolver) evaluatePolicies(pkg *RepositoryPackage) *PolicyViolation {
+	for _, policy := range p.policies {
+		if v := policy.Evaluate(pkg); v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+// excludePolicy is the Policy of WithResolverExcludes.
+type excludePolicy []string
+
+func (e excludePolicy) Evaluate(pkg *RepositoryPackage) *PolicyViolation {
+	for _, glob := range e {
+		if ok, _ := path.Match(glob, pkg.Name); ok {
+			return &PolicyViolation{Package: pkg, Rule: PolicyRuleExcluded, Reason: fmt.Sprintf("excluded by %q", glob)}
+		}
+	}
+	return nil
+}
+
+// WithResolverExcludes excludes packages whose names match any of globs, as in path.Match,
+// from ever being selected. Resolving something that only an excluded package satisfies
+// fails with an error that wraps the *PolicyViolation naming the exclusion.
+func WithResolverExcludes(globs ...string) ResolverOption {
+	return WithResolverPolicy(excludePolicy(globs))
+}
+
+// holdPolicy is the Policy of WithResolverHolds.
+type holdPolicy map[string]string
+
+func (h holdPolicy) Evaluate(pkg *RepositoryPackage) *PolicyViolation {
+	if version, ok := h[pkg.Name]; ok && pkg.Version != version {
+		return &PolicyViolation{Package: pkg, Rule: PolicyRuleHeld, Reason: fmt.Sprintf("%s is held at %s", pkg.Name, version)}
+	}
+	return nil
+}
+
+// WithResolverHolds holds packages, by name, at a version: no other version of them is
+// selected.
+func WithResolverHolds(versions map[string]string) ResolverOption {
+	return WithResolverPolicy(holdPolicy(versions))
+}
+
+// downgradePolicy does not allow versions older than the installed ones, see
+// WithResolverInstalled.
+type downgradePolicy map[string]string
+
+func (d downgradePolicy) Evaluate(pkg *RepositoryPackage) *PolicyViolation {
+	if version, ok := d[pkg.Name]; ok && newerVersion(version, pkg.Version) {
+		return &PolicyViolation{Package: pkg, Rule: PolicyRuleDowngrade, Reason: fmt.Sprintf("would downgrade installed %s from %s", pkg.Name, version)}
+	}
+	return nil
+}
+
+// WithResolverInstalled tells the resolver what is installed. With preventDowngrade, no
+// version older than the installed version of a package is selected, and resolving fails
+// with a *PolicyViolation when nothing else satisfies a constraint. Either way, Downgrades
+// reports the downgrades of a resolution.
+func WithResolverInstalled(installed []*InstalledPackage, preventDowngrade bool) ResolverOption {
+	return func(p *PkgResolver) {
+		p.installed = make(map[string]string, len(installed))
+		for _, pkg := range installed {
+			p.installed[pkg.Name] = pkg.Version
+		}
+		if preventDowngrade {
+			p.policies = append(p.policies, downgradePolicy(p.installed))
+		}
+	}
+}
+
+// Downgrades returns the packages of pkgs, the result of resolving, that are older than
+// their installed versions, see WithResolverInstalled, as ChangeDowngraded changes sorted by
+// name.
+func (p *PkgResolver) Downgrades(pkgs []*RepositoryPackage) []PackageChange {
+	var changes []PackageChange
+	for _, pkg := range pkgs {
+		if version, ok := p.installed[pkg.Name]; ok && newerVersion(version, pkg.Version) {
+			changes = append(changes, PackageChange{Name: pkg.Name, Kind: ChangeDowngraded, OldVersion: version, NewVersion: pkg.Version})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+// archPolicy does not allow packages for other architectures, see WithResolverArch.
+type archPolicy string
+
+func (a archPolicy) Evaluate(pkg *RepositoryPackage) *PolicyViolation {
+	if pkg.Arch != "" && pkg.Arch != "noarch" && pkg.Arch != string(a) {
+		return &PolicyViolation{Package: pkg, Rule: PolicyRuleArch, Reason: fmt.Sprintf("%s is for %s, not %s", pkg.Name, pkg.Arch, a)}
+	}
+	return nil
+}
+
+// WithResolverArch does not allow packages for other architectures than arch, e.g. when
+// the indexes of several architectures are resolved together. Packages without an
+// architecture, or for noarch, are allowed. Resolving something that only packages for
+// other architectures satisfy fails with ReasonArchMismatch, see ReasonOf.
+func WithResolverArch(arch string) ResolverOption {
+	return WithResolverPolicy(archPolicy(arch))
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyRules(t *testing.T) {
+	repo := &RepositoryWithIndex{Repository: &Repository{URI: "https://example.com/testing/x86_64"}}
+	pkg := func(name, version, license string) *RepositoryPackage {
+		return NewRepositoryPackage(&Package{Name: name, Version: version, License: license}, repo)
+	}
+
+	for _, c := range []struct {
+		name  string
+		rules PolicyRules
+		pkg   *RepositoryPackage
+		rule  PolicyRule
+	}{
+		{"no rules", PolicyRules{}, pkg("foo", "1.0-r0", "MIT"), ""},
+		{"blocked name", PolicyRules{BlockedPackages: []string{"foo-*"}}, pkg("foo-dev", "1.0-r0", "MIT"), PolicyRuleName},
+		{"other name", PolicyRules{BlockedPackages: []string{"foo-*"}}, pkg("foo", "1.0-r0", "MIT"), ""},
+		{"blocked license", PolicyRules{BlockedLicenses: []string{"gpl-3.0-only"}}, pkg("foo", "1.0-r0", "MIT OR GPL-3.0-only"), PolicyRuleLicense},
+		{"allowed licenses", PolicyRules{AllowedLicenses: []string{"MIT", "Apache-2.0"}}, pkg("foo", "1.0-r0", "(MIT AND Apache-2.0)"), ""},
+		{"license exception", PolicyRules{AllowedLicenses: []string{"GPL-2.0-only"}}, pkg("foo", "1.0-r0", "GPL-2.0-only WITH Classpath-exception-2.0"), ""},
+		{"not allowed license", PolicyRules{AllowedLicenses: []string{"MIT"}}, pkg("foo", "1.0-r0", "MIT AND BSD-3-Clause"), PolicyRuleLicense},
+		{"no license", PolicyRules{AllowedLicenses: []string{"MIT"}}, pkg("foo", "1.0-r0", ""), PolicyRuleLicense},
+		{"blocked repository", PolicyRules{BlockedRepositories: []string{"https://example.com/testing/*"}}, pkg("foo", "1.0-r0", "MIT"), PolicyRuleRepository},
+		{"minimum version", PolicyRules{MinimumVersions: map[string]string{"openssl": "3"}}, pkg("openssl", "1.1.1w-r0", "OpenSSL"), PolicyRuleVersion},
+		{"above minimum version", PolicyRules{MinimumVersions: map[string]string{"openssl": "3"}}, pkg("openssl", "3.1.4-r0", "OpenSSL"), ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			v := c.rules.Evaluate(c.pkg)
+			if c.rule == "" {
+				require.Nil(t, v)
+				return
+			}
+			require.NotNil(t, v)
+			require.Equal(t, c.rule, v.Rule)
+			require.Equal(t, c.pkg, v.Package)
+		})
+	}
+}
+
+func TestResolverPolicy(t *testing.T) {
+	ctx := context.Background()
+	repo := Repository{URI: "main"}
+	index := repo.WithIndex(&APKIndex{Packages: []*Package{
+		{Name: "app", Version: "1.0-r0", Dependencies: []string{"openssl"}},
+		{Name: "openssl", Version: "1.1.1w-r0"},
+		{Name: "openssl", Version: "3.1.4-r0"},
+		{Name: "curl", Version: "8.4.0-r0", Dependencies: []string{"openssl<3"}},
+	}})
+	policy := &PolicyRules{MinimumVersions: map[string]string{"openssl": "3"}}
+	resolver := NewPkgResolver(ctx, testNamedRepositoryFromIndexes([]*RepositoryWithIndex{index}), WithResolverPolicy(policy))
+
+	// the allowed version is selected
+	pkgs, _, err := resolver.GetPackagesWithDependencies(ctx, []string{"app"})
+	require.NoError(t, err)
+	require.Len(t, pkgs, 2)
+	require.Equal(t, "openssl-3.1.4-r0.apk", pkgs[0].Filename())
+
+	// nothing else satisfies the dependency, the violation is reported
+	_, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"curl"})
+	var violation *PolicyViolation
+	require.True(t, errors.As(err, &violation), "error %v is not a policy violation", err)
+	require.Equal(t, PolicyRuleVersion, violation.Rule)
+	require.Equal(t, "openssl-1.1.1w-r0.apk", violation.Package.Filename())
+
+	_, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"openssl<3"})
+	require.True(t, errors.As(err, &violation), "error %v is not a policy violation", err)
+}
+
+func TestResolverExcludesAndHolds(t *testing.T) {
+	ctx := context.Background()
+	repo := Repository{URI: "main"}
+	index := repo.WithIndex(&APKIndex{Packages: []*Package{
+		{Name: "app", Version: "1.0-r0", Dependencies: []string{"libfoo"}},
+		{Name: "libfoo", Version: "1.0-r0"},
+		{Name: "libfoo", Version: "2.0-r0"},
+	}})
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{index})
+
+	resolver := NewPkgResolver(ctx, indexes, WithResolverHolds(map[string]string{"libfoo": "1.0-r0"}))
+	pkgs, _, err := resolver.GetPackagesWithDependencies(ctx, []string{"app"})
+	require.NoError(t, err)
+	require.Equal(t, "libfoo-1.0-r0.apk", pkgs[0].Filename())
+
+	resolver = NewPkgResolver(ctx, indexes, WithResolverExcludes("libfoo*"))
+	_, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"app"})
+	var depErr *DepError
+	require.True(t, errors.As(err, &depErr), "error %v is not a DepError", err)
+	require.Equal(t, "app", depErr.Package.Name)
+	var violation *PolicyViolation
+	require.True(t, errors.As(err, &violation), "error %v is not a policy violation", err)
+	require.Equal(t, PolicyRuleExcluded, violation.Rule)
+	require.ErrorContains(t, err, `excluded by "libfoo*"`)
+}
+
+func TestResolverDowngrades(t *testing.T) {
+	ctx := context.Background()
+	repo := Repository{URI: "main"}
+	index := repo.WithIndex(&APKIndex{Packages: []*Package{
+		{Name: "app", Version: "1.0-r0", Dependencies: []string{"libfoo"}},
+		{Name: "libfoo", Version: "1.0-r0"},
+	}})
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{index})
+	installed := []*InstalledPackage{{Package: Package{Name: "libfoo", Version: "2.0-r0"}}}
+
+	resolver := NewPkgResolver(ctx, indexes, WithResolverInstalled(installed, true))
+	_, _, err := resolver.GetPackagesWithDependencies(ctx, []string{"app"})
+	var violation *PolicyViolation
+	require.True(t, errors.As(err, &violation), "error %v is not a policy violation", err)
+	require.Equal(t, PolicyRuleDowngrade, violation.Rule)
+
+	resolver = NewPkgResolver(ctx, indexes, WithResolverInstalled(installed, false))
+	pkgs, _, err := resolver.GetPackagesWithDependencies(ctx, []string{"app"})
+	require.NoError(t, err)
+	require.Equal(t, []PackageChange{
+		{Name: "libfoo", Kind: ChangeDowngraded, OldVersion: "2.0-r0", NewVersion: "1.0-r0"},
+	}, resolver.Downgrades(pkgs))
+}
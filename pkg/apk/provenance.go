@@ -0,0 +1,307 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/otel"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+const (
+	// provenanceFilePath is where WriteProvenance writes the provenance in the root.
+	provenanceFilePath = "lib/apk/db/provenance.intoto.json"
+
+	provenanceStatementType = "https://in-toto.io/Statement/v1"
+	provenancePredicateType = "https://slsa.dev/provenance/v1"
+	provenanceBuildType     = "https://github.com/chainguard-dev/go-apk/install@v1"
+	provenanceBuilderID     = "https://github.com/chainguard-dev/go-apk"
+)
+
+// ProvenanceResource is an input or the output of an install, as an in-toto resource
+// descriptor.
+type ProvenanceResource struct {
+	Name        string            `json:"name,omitempty"`
+	URI         string            `json:"uri,omitempty"`
+	Digest      map[string]string `json:"digest,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Provenance is what went into an install and what came out of it, see WithProvenance.
+type Provenance struct {
+	// World is the world of the root when the install finished.
+	World []string
+	// Indexes are the indexes that the installed packages are from, by URL, with their sha256
+	// and the key that verified their signature.
+	Indexes []ProvenanceResource
+	// Packages are the packages that were installed, in install order, by purl, with their
+	// URL and the sha256 of the package files.
+	Packages []ProvenanceResource
+	// Keys are the keys installed in the root, by name, with their fingerprints.
+	Keys []ProvenanceResource
+	// Tree is the root after the install, with the sha256 of its file tree, see TreeDigest.
+	Tree ProvenanceResource
+	// StartedOn and FinishedOn are when the install started and finished, or both the build
+	// time if it is set, see WithBuildTime, so that the provenance is reproducible.
+	StartedOn  time.Time
+	FinishedOn time.Time
+}
+
+type provenanceStatement struct {
+	Type          string               `json:"_type"`
+	Subject       []ProvenanceResource `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     provenancePredicate  `json:"predicate"`
+}
+
+type provenancePredicate struct {
+	BuildDefinition provenanceBuildDefinition `json:"buildDefinition"`
+	RunDetails      provenanceRunDetails      `json:"runDetails"`
+}
+
+type provenanceBuildDefinition struct {
+	BuildType            string               `json:"buildType"`
+	ExternalParameters   map[string]any       `json:"externalParameters"`
+	ResolvedDependencies []ProvenanceResource `json:"resolvedDependencies"`
+}
+
+type provenanceRunDetails struct {
+	Builder  provenanceBuilder  `json:"builder"`
+	Metadata provenanceMetadata `json:"metadata"`
+}
+
+type provenanceBuilder struct {
+	ID string `json:"id"`
+}
+
+type provenanceMetadata struct {
+	StartedOn  string `json:"startedOn"`
+	FinishedOn string `json:"finishedOn"`
+}
+
+// Statement returns the provenance as an in-toto v1 statement of SLSA v1 provenance, whose
+// subject is the tree and whose resolved dependencies are the indexes, packages and keys.
+func (p *Provenance) Statement() ([]byte, error) {
+	world := p.World
+	if world == nil {
+		world = []string{}
+	}
+	deps := make([]ProvenanceResource, 0, len(p.Indexes)+len(p.Packages)+len(p.Keys))
+	deps = append(deps, p.Indexes...)
+	deps = append(deps, p.Packages...)
+	deps = append(deps, p.Keys...)
+	statement := provenanceStatement{
+		Type:          provenanceStatementType,
+		Subject:       []ProvenanceResource{p.Tree},
+		PredicateType: provenancePredicateType,
+		Predicate: provenancePredicate{
+			BuildDefinition: provenanceBuildDefinition{
+				BuildType:            provenanceBuildType,
+				ExternalParameters:   map[string]any{"world": world},
+				ResolvedDependencies: deps,
+			},
+			RunDetails: provenanceRunDetails{
+				Builder: provenanceBuilder{ID: provenanceBuilderID},
+				Metadata: provenanceMetadata{
+					StartedOn:  p.StartedOn.UTC().Format(time.RFC3339),
+					FinishedOn: p.FinishedOn.UTC().Format(time.RFC3339),
+				},
+			},
+		},
+	}
+	b, err := json.MarshalIndent(statement, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// Provenance returns the provenance of the last install of the APK, or nil if it has not
+// installed packages with WithProvenance.
+func (a *APK) Provenance() *Provenance {
+	a.provenanceMu.Lock()
+	defer a.provenanceMu.Unlock()
+	return a.lastProvenance
+}
+
+// WriteProvenance writes the in-toto statement of the provenance of the last install, see
+// Provenance.Statement, to /lib/apk/db/provenance.intoto.json in the root, so that the
+// image carries it. The file is not part of the tree digest.
+func (a *APK) WriteProvenance() error {
+	p := a.Provenance()
+	if p == nil {
+		return errors.New("no provenance was recorded: install packages with WithProvenance")
+	}
+	b, err := p.Statement()
+	if err != nil {
+		return fmt.Errorf("encoding provenance: %w", err)
+	}
+	if err := a.fs.MkdirAll(filepath.Dir(provenanceFilePath), 0o755); err != nil {
+		return fmt.Errorf("failed to make provenance directory: %w", err)
+	}
+	// #nosec G306 -- provenance is meant to be read by anyone
+	if err := a.fs.WriteFile(provenanceFilePath, b, 0o644); err != nil {
+		return fmt.Errorf("failed to write provenance: %w", err)
+	}
+	return nil
+}
+
+// indexProvenance returns the provenance of the index of repo, as it was fetched.
+func indexProvenance(repo *RepositoryWithIndex) ProvenanceResource {
+	resource := ProvenanceResource{URI: redactURL(repo.IndexURI())}
+	if digest := repo.Digest(); digest != nil {
+		resource.Digest = map[string]string{"sha256": hex.EncodeToString(digest)}
+	}
+	if sig := repo.Signature(); sig.KeyName != "" {
+		resource.Annotations = map[string]string{"verifiedBy": sig.KeyName}
+	}
+	return resource
+}
+
+// packageDigest returns the sha256 of the package file of exp.
+func packageDigest(exp *expandapk.APKExpanded) (string, error) {
+	rc, err := exp.APK()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// recordProvenance records the provenance of an install of pkgs, with infos the packages
+// that were installed and digests the sha256 of their package files.
+func (a *APK) recordProvenance(ctx context.Context, pkgs []InstallablePackage, infos []*Package, digests []string, started, finished time.Time) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "recordProvenance")
+	defer span.End()
+
+	p := &Provenance{StartedOn: started, FinishedOn: finished}
+	world, err := a.GetWorld()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error getting world packages: %w", err)
+	}
+	p.World = world
+
+	distro, err := a.Distro()
+	if err != nil {
+		return err
+	}
+	indexes := map[string]ProvenanceResource{}
+	for i, info := range infos {
+		if info == nil {
+			continue
+		}
+		p.Packages = append(p.Packages, ProvenanceResource{
+			Name:   info.PURL(distro),
+			URI:    redactURL(pkgs[i].URL()),
+			Digest: map[string]string{"sha256": digests[i]},
+		})
+		// only the indexes of the packages, not every index that was fetched
+		if rp, ok := pkgs[i].(interface{ Repository() *RepositoryWithIndex }); ok {
+			if repo := rp.Repository(); repo != nil && repo.index != nil {
+				resource := indexProvenance(repo)
+				indexes[resource.URI] = resource
+			}
+		}
+	}
+	for _, index := range indexes {
+		p.Indexes = append(p.Indexes, index)
+	}
+	sort.Slice(p.Indexes, func(i, j int) bool {
+		return p.Indexes[i].URI < p.Indexes[j].URI
+	})
+
+	keyring, err := a.Keyring()
+	if err != nil {
+		return fmt.Errorf("loading keyring: %w", err)
+	}
+	for _, key := range keyring.List() {
+		p.Keys = append(p.Keys, ProvenanceResource{Name: key.Name, Digest: map[string]string{"sha256": key.Fingerprint}})
+	}
+
+	tree, err := a.TreeDigest(ctx)
+	if err != nil {
+		return err
+	}
+	p.Tree = ProvenanceResource{Name: "rootfs", Digest: map[string]string{"sha256": tree}}
+
+	a.provenanceMu.Lock()
+	defer a.provenanceMu.Unlock()
+	a.lastProvenance = p
+	return nil
+}
+
+// TreeDigest returns the hex encoded sha256 of the file tree of the root: of the path, type,
+// permissions and content or link target of every file, directory and special file, in
+// lexical order. Ownership, times and extended attributes are not part of it, nor is the
+// provenance written by WriteProvenance.
+func (a *APK) TreeDigest(ctx context.Context) (string, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "TreeDigest")
+	defer span.End()
+
+	h := sha256.New()
+	err := fs.WalkDir(a.fs, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == provenanceFilePath {
+			return nil
+		}
+		fi, err := a.fs.Lstat(path)
+		if err != nil {
+			return err
+		}
+		mode := fi.Mode()
+		var content string
+		switch {
+		case mode.IsRegular():
+			f, err := a.fs.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			fh := sha256.New()
+			if _, err := io.Copy(fh, f); err != nil {
+				return err
+			}
+			content = hex.EncodeToString(fh.Sum(nil))
+		case mode&fs.ModeSymlink != 0:
+			if content, err = a.fs.Readlink(path); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(h, "%q %s %o %s\n", path, mode.Type(), mode.Perm(), content)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("walking filesystem: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestProvenance(t *testing.T) {
+	ctx := context.Background()
+	globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+
+	pkg := fakePackage(t, &Package{Name: "hello", Version: "1.0-r0"}, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+		{"etc/hello", 0o644, false, []byte("hello"), nil},
+	}).(*testPackage)
+	checksum, err := base64.StdEncoding.DecodeString(pkg.checksum)
+	require.NoError(t, err)
+
+	// a repository with the package, and one whose index is fetched but not used
+	repo, unused := t.TempDir(), t.TempDir()
+	writeIndex := func(dir string, pkgs ...*Package) []byte {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, testArch), 0o755))
+		archive, err := ArchiveFromIndex(&APKIndex{Packages: pkgs})
+		require.NoError(t, err)
+		index, err := io.ReadAll(archive)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, testArch, indexFilename), index, 0o644))
+		return index
+	}
+	index := writeIndex(repo, &Package{Name: "hello", Version: "1.0-r0", Arch: testArch, Checksum: checksum})
+	writeIndex(unused, &Package{Name: "other", Version: "1.0-r0", Arch: testArch})
+	b, err := os.ReadFile(pkg.URL())
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(repo, testArch, "hello-1.0-r0.apk"), b, 0o644))
+
+	buildTime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	src := apkfs.NewMemFS()
+	a, err := New(WithFS(src), WithArch(testArch), WithProvenance(true), WithBuildTime(buildTime))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+	require.Nil(t, a.Provenance())
+	require.Error(t, a.WriteProvenance())
+	a.ignoreSignatures = true
+	require.NoError(t, a.SetRepositories(ctx, []string{repo, unused}))
+	require.NoError(t, a.SetWorld(ctx, []string{"hello"}))
+	indexes, err := a.GetRepositoryIndexes(ctx, true)
+	require.NoError(t, err)
+	indexSum := sha256.Sum256(index)
+	require.Equal(t, indexSum[:], indexDigest(indexes[0]))
+
+	require.NoError(t, a.FixateWorld(ctx, nil))
+
+	p := a.Provenance()
+	require.NotNil(t, p)
+	require.Equal(t, []string{"hello"}, p.World)
+	require.Equal(t, []ProvenanceResource{{
+		URI:    filepath.Join(repo, testArch, indexFilename),
+		Digest: map[string]string{"sha256": hex.EncodeToString(indexSum[:])},
+	}}, p.Indexes)
+	pkgDigest := sha256.Sum256(b)
+	require.Len(t, p.Packages, 1)
+	require.Equal(t, "pkg:apk/hello@1.0-r0", p.Packages[0].Name)
+	require.Equal(t, hex.EncodeToString(pkgDigest[:]), p.Packages[0].Digest["sha256"])
+	require.Equal(t, buildTime, p.StartedOn)
+	require.Equal(t, buildTime, p.FinishedOn)
+
+	tree, err := a.TreeDigest(ctx)
+	require.NoError(t, err)
+	require.Equal(t, tree, p.Tree.Digest["sha256"])
+
+	// written into the root, without changing its digest
+	require.NoError(t, a.WriteProvenance())
+	written, err := a.TreeDigest(ctx)
+	require.NoError(t, err)
+	require.Equal(t, tree, written)
+	statement, err := src.ReadFile(provenanceFilePath)
+	require.NoError(t, err)
+	var decoded map[string]any
+	require.NoError(t, json.Unmarshal(statement, &decoded))
+	require.Equal(t, provenanceStatementType, decoded["_type"])
+	require.Equal(t, provenancePredicateType, decoded["predicateType"])
+
+	// the tree digest changes with the content of the root
+	require.NoError(t, src.WriteFile("etc/hello", []byte("changed"), 0o644))
+	changed, err := a.TreeDigest(ctx)
+	require.NoError(t, err)
+	require.NotEqual(t, tree, changed)
+}
@@ -0,0 +1,158 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"cmp"
+
+	"golang.org/x/exp/slices"
+)
+
+// Provider is a package that provides a name, such as so:libssl.so.3 or cmd:python3, or
+// is named it.
+type Provider struct {
+	Package *RepositoryPackage
+	// Version is the version of the name that the package provides, which is the version of
+	// the package when it is named it or provides it without a version.
+	Version string
+	// Priority is the provider priority of the package.
+	Priority uint64
+	// Pin is the tag of the repository of the package, if it is tagged.
+	Pin string
+}
+
+// Providers returns every package in the indexes that provides the name in constraint, like
+// "apk search -e". When constraint has a version, such as "so:libssl.so.3>=3", only the
+// providers of a matching version are returned. Providers are sorted by priority, then by
+// version, highest first, then by name and package version. Nothing is disqualified:
+// packages that a policy does not allow are returned too.
+func (p *PkgResolver) Providers(constraint string) []Provider {
+	parsed := p.resolvePackageNameVersionPin(constraint)
+	var required packageVersion
+	if parsed.dep != versionAny {
+		var err error
+		if required, err = p.parseVersion(parsed.version); err != nil {
+			return nil
+		}
+	}
+
+	var providers []Provider
+	for _, pkg := range p.nameMap[parsed.name] {
+		version := p.getDepVersionForName(pkg, parsed.name)
+		if parsed.dep != versionAny {
+			actual, err := p.parseVersion(version)
+			if err != nil || !parsed.dep.Satisfies(actual, required) {
+				continue
+			}
+		}
+		providers = append(providers, Provider{
+			Package:  pkg.RepositoryPackage,
+			Version:  version,
+			Priority: pkg.ProviderPriority,
+			Pin:      pkg.pinnedName,
+		})
+	}
+	slices.SortStableFunc(providers, func(a, b Provider) int {
+		if c := cmp.Compare(b.Priority, a.Priority); c != 0 {
+			return c
+		}
+		if c := versionOrder(b.Version, a.Version); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.Package.Name, b.Package.Name); c != 0 {
+			return c
+		}
+		return versionOrder(b.Package.Version, a.Package.Version)
+	})
+	return providers
+}
+
+// versionOrder compares versions a and b like cmp.Compare, see newerVersion.
+func versionOrder(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case newerVersion(a, b):
+		return 1
+	case newerVersion(b, a):
+		return -1
+	default:
+		return 0
+	}
+}
+
+// WithResolverPreferProvider sets the package to prefer for names that more than one
+// package provides, such as "so:libcrypto.so.3" to "openssl", so that which one is chosen
+// does not depend on versions or on the order of the indexes when their priorities are
+// equal. A preferred provider is chosen over one with a higher provider priority or
+// version, but not over one that already is installed, and only if it satisfies the
+// constraint. Calling it again adds to the preferred providers.
+func WithResolverPreferProvider(providers map[string]string) ResolverOption {
+	return func(p *PkgResolver) {
+		if p.preferProviders == nil {
+			p.preferProviders = make(map[string]string, len(providers))
+		}
+		for name, pkg := range providers {
+			p.preferProviders[name] = pkg
+		}
+	}
+}
+
+// ProviderChooser chooses the package to install for constraint, a dependency or a requested
+// package such as "cmd:sh" or "so:libz.so.1", among candidates that all satisfy it, sorted
+// by the preference of the resolver, best first. It returns nil, or a package that is not
+// one of the candidates, to leave the choice to the resolver.
+type ProviderChooser func(constraint string, candidates []*RepositoryPackage) *RepositoryPackage
+
+// WithResolverProviderChooser sets chooser to choose between the candidates for a constraint
+// whenever there are more than one, e.g. to always choose busybox over coreutils. It is only
+// called with candidates that are allowed: disqualified packages are not offered. Default is
+// to choose the first candidate.
+func WithResolverProviderChooser(chooser ProviderChooser) ResolverOption {
+	return func(p *PkgResolver) {
+		p.providerChooser = chooser
+	}
+}
+
+// chooseProvider returns the index of the package that the ProviderChooser of the resolver
+// chooses for constraint among pkgs, sorted by preference, or -1 if it does not choose any.
+func (p *PkgResolver) chooseProvider(constraint string, pkgs []*repositoryPackage) int {
+	if p.providerChooser == nil || len(pkgs) < 2 {
+		return -1
+	}
+	candidates := make([]*RepositoryPackage, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		candidates = append(candidates, pkg.RepositoryPackage)
+	}
+	chosen := p.providerChooser(constraint, candidates)
+	if chosen == nil {
+		return -1
+	}
+	return slices.Index(candidates, chosen)
+}
+
+// choosePackage returns the best package for constraint among pkgs, like bestPackage, unless
+// the ProviderChooser of the resolver chooses another.
+func (p *PkgResolver) choosePackage(constraint string, pkgs []*repositoryPackage, compare *RepositoryPackage, name string, existing map[string]*RepositoryPackage, existingOrigins map[string]bool, pin string) *repositoryPackage {
+	if p.providerChooser == nil || len(pkgs) < 2 {
+		return p.bestPackage(pkgs, compare, name, existing, existingOrigins, pin)
+	}
+	sorted := slices.Clone(pkgs)
+	p.sortPackages(sorted, compare, name, existing, existingOrigins, pin)
+	if chosen := p.chooseProvider(constraint, sorted); chosen >= 0 {
+		return sorted[chosen]
+	}
+	return sorted[0]
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// proxyRule is the proxy of the URLs under a prefix, see WithProxy.
+type proxyRule struct {
+	prefix string
+	// nil to connect directly
+	proxy *url.URL
+}
+
+// matches returns whether u is under the prefix of r: the prefix itself, or a path below it.
+func (r proxyRule) matches(u string) bool {
+	if !strings.HasPrefix(u, r.prefix) {
+		return false
+	}
+	return len(u) == len(r.prefix) || strings.HasSuffix(r.prefix, "/") || u[len(r.prefix)] == '/'
+}
+
+// parseProxy parses the URL of a proxy for WithProxy, or returns nil if it is empty.
+func parseProxy(proxy string) (*url.URL, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", proxy, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxy %q: scheme must be http, https or socks5", u.Redacted())
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q: no host", u.Redacted())
+	}
+	return u, nil
+}
+
+// proxyFunc returns the Proxy of an http.Transport that sends requests through the proxy of
+// the longest prefix of rules that their URLs are under, and the others through the proxy of
+// the environment, see http.ProxyFromEnvironment.
+func proxyFunc(rules []proxyRule) func(*http.Request) (*url.URL, error) {
+	if len(rules) == 0 {
+		return http.ProxyFromEnvironment
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		// credentials in the URL of the request are not part of its repository
+		u := *req.URL
+		u.User = nil
+		s := u.String()
+
+		var best *proxyRule
+		for i, rule := range rules {
+			if rule.matches(s) && (best == nil || len(rule.prefix) > len(best.prefix)) {
+				best = &rules[i]
+			}
+		}
+		if best == nil {
+			return http.ProxyFromEnvironment(req)
+		}
+		return best.proxy, nil
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"strings"
+)
+
+// Distro is the distribution that packages are from, by the ID and the VERSION_ID of its
+// os-release file, e.g. alpine and 3.18.4.
+type Distro struct {
+	ID        string
+	VersionID string
+}
+
+// qualifier returns the distro qualifier of a purl, e.g. alpine-3.18.4.
+func (d Distro) qualifier() string {
+	if d.ID == "" || d.VersionID == "" {
+		return d.ID
+	}
+	return d.ID + "-" + d.VersionID
+}
+
+// PURL returns the package URL of the package from distro, as in
+// pkg:apk/alpine/name@version?arch=...&distro=alpine-3.18.4, see
+// https://github.com/package-url/purl-spec. What is not known is left out, the namespace
+// and the distro if distro is empty, and the arch if the package has none.
+func (p *Package) PURL(distro Distro) string {
+	q := url.Values{}
+	if p.Arch != "" {
+		q.Set("arch", p.Arch)
+	}
+	if d := distro.qualifier(); d != "" {
+		q.Set("distro", d)
+	}
+	purl := "pkg:apk/"
+	if distro.ID != "" {
+		purl += url.PathEscape(strings.ToLower(distro.ID)) + "/"
+	}
+	purl += url.PathEscape(p.Name) + "@" + url.PathEscape(p.Version)
+	if len(q) != 0 {
+		purl += "?" + q.Encode()
+	}
+	return purl
+}
+
+// osReleasePaths are where the os-release file is looked up, in order, see os-release(5).
+var osReleasePaths = []string{"etc/os-release", "usr/lib/os-release"}
+
+// Distro returns the distribution of the filesystem, from its os-release file, or an empty
+// Distro if it has none, e.g. before the package that provides it is installed.
+func (a *APK) Distro() (Distro, error) {
+	for _, path := range osReleasePaths {
+		b, err := a.fs.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return Distro{}, fmt.Errorf("reading %s: %w", path, err)
+		}
+		return parseOSRelease(b), nil
+	}
+	return Distro{}, nil
+}
+
+// parseOSRelease returns the distribution of an os-release file.
+func parseOSRelease(b []byte) Distro {
+	var d Distro
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(value, `"'`)
+		switch key {
+		case "ID":
+			d.ID = value
+		case "VERSION_ID":
+			d.VersionID = value
+		}
+	}
+	return d
+}
+
+// PackageRef identifies a package for vulnerability scanners, which match on the purl,
+// version and origin.
+type PackageRef struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Arch    string `json:"arch,omitempty"`
+	Origin  string `json:"origin,omitempty"`
+	PURL    string `json:"purl"`
+	// Checksum is the checksum of the control section, as in the installed database.
+	Checksum string `json:"checksum,omitempty"`
+	// SHA1 is the same checksum, hex encoded.
+	SHA1 string `json:"sha1,omitempty"`
+	// Commit is the commit of the source repository the package was built from.
+	Commit     string `json:"commit,omitempty"`
+	Maintainer string `json:"maintainer,omitempty"`
+	// Repository is the repository the package was resolved from, empty when installed.
+	Repository string `json:"repository,omitempty"`
+}
+
+func newPackageRef(pkg *Package, distro Distro) PackageRef {
+	ref := PackageRef{
+		Name:       pkg.Name,
+		Version:    pkg.Version,
+		Arch:       pkg.Arch,
+		Origin:     pkg.Origin,
+		PURL:       pkg.PURL(distro),
+		Commit:     pkg.RepoCommit,
+		Maintainer: pkg.Maintainer,
+	}
+	if len(pkg.Checksum) != 0 {
+		ref.Checksum = pkg.ChecksumString()
+		ref.SHA1 = hex.EncodeToString(pkg.Checksum)
+	}
+	return ref
+}
+
+// PackageRefs returns the refs of pkgs from distro, such as the result of resolving the world.
+func PackageRefs(distro Distro, pkgs []*RepositoryPackage) []PackageRef {
+	refs := make([]PackageRef, len(pkgs))
+	for i, pkg := range pkgs {
+		refs[i] = newPackageRef(pkg.Package, distro)
+		if repo := pkg.Repository(); repo != nil && repo.Repository != nil {
+			refs[i].Repository = repo.URI
+		}
+	}
+	return refs
+}
+
+// InstalledPackageRefs returns the refs of the installed packages, in install order.
+func (a *APK) InstalledPackageRefs() ([]PackageRef, error) {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("reading installed packages: %w", err)
+	}
+	distro, err := a.Distro()
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]PackageRef, len(installed))
+	for i, pkg := range installed {
+		refs[i] = newPackageRef(&pkg.Package, distro)
+	}
+	return refs, nil
+}
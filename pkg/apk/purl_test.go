@@ -0,0 +1,90 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestPURL(t *testing.T) {
+	wolfi := Distro{ID: "wolfi", VersionID: "20230201"}
+	require.Equal(t, "pkg:apk/wolfi/busybox@1.36.1-r5?arch=x86_64&distro=wolfi-20230201", (&Package{Name: "busybox", Version: "1.36.1-r5", Arch: "x86_64", Origin: "busybox"}).PURL(wolfi))
+	require.Equal(t, "pkg:apk/alpine/libcrypto3@3.1.4-r0?arch=aarch64&distro=alpine", (&Package{Name: "libcrypto3", Version: "3.1.4-r0", Arch: "aarch64", Origin: "openssl"}).PURL(Distro{ID: "alpine"}))
+	require.Equal(t, "pkg:apk/libstdc++@13.2.0-r0", (&Package{Name: "libstdc++", Version: "13.2.0-r0"}).PURL(Distro{}))
+}
+
+func TestDistro(t *testing.T) {
+	a, err := New(WithFS(apkfs.NewMemFS()))
+	require.NoError(t, err)
+	d, err := a.Distro()
+	require.NoError(t, err)
+	require.Equal(t, Distro{}, d)
+
+	require.NoError(t, a.fs.MkdirAll("usr/lib", 0o755))
+	require.NoError(t, a.fs.WriteFile("usr/lib/os-release", []byte("ID=alpine\nVERSION_ID=3.18.4\n"), 0o644))
+	d, err = a.Distro()
+	require.NoError(t, err)
+	require.Equal(t, Distro{ID: "alpine", VersionID: "3.18.4"}, d)
+
+	// etc/os-release takes precedence
+	require.NoError(t, a.fs.MkdirAll("etc", 0o755))
+	require.NoError(t, a.fs.WriteFile("etc/os-release", []byte("NAME=\"Wolfi\"\nID=wolfi\nVERSION_ID=\"20230201\"\nPRETTY_NAME=\"Wolfi\"\n"), 0o644))
+	d, err = a.Distro()
+	require.NoError(t, err)
+	require.Equal(t, Distro{ID: "wolfi", VersionID: "20230201"}, d)
+}
+
+func TestPackageRefs(t *testing.T) {
+	repo := &RepositoryWithIndex{Repository: &Repository{URI: "https://example.com/main/x86_64"}}
+	pkg := &Package{
+		Name:       "libcrypto3",
+		Version:    "3.1.4-r0",
+		Arch:       "x86_64",
+		Origin:     "openssl",
+		RepoCommit: "abc123",
+		Maintainer: "Jane Doe <jane@example.com>",
+		Checksum:   []byte{0xde, 0xad, 0xbe, 0xef},
+	}
+	require.Equal(t, []PackageRef{{
+		Name:       "libcrypto3",
+		Version:    "3.1.4-r0",
+		Arch:       "x86_64",
+		Origin:     "openssl",
+		PURL:       "pkg:apk/wolfi/libcrypto3@3.1.4-r0?arch=x86_64&distro=wolfi",
+		Checksum:   "Q13q2+7w==",
+		SHA1:       "deadbeef",
+		Commit:     "abc123",
+		Maintainer: "Jane Doe <jane@example.com>",
+		Repository: "https://example.com/main/x86_64",
+	}}, PackageRefs(Distro{ID: "wolfi"}, []*RepositoryPackage{NewRepositoryPackage(pkg, repo)}))
+
+	a, err := New(WithFS(apkfs.NewMemFS()), WithIgnoreMknodErrors(true))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(context.Background()))
+	require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{
+		fakePackage(t, &Package{Name: "hello", Version: "1.0-r0", Arch: "x86_64", Origin: "hello-src"}, nil),
+	}))
+	refs, err := a.InstalledPackageRefs()
+	require.NoError(t, err)
+	require.Len(t, refs, 1)
+	require.Equal(t, "pkg:apk/hello@1.0-r0?arch=x86_64", refs[0].PURL)
+	require.Equal(t, "hello-src", refs[0].Origin)
+	require.Empty(t, refs[0].Repository)
+}
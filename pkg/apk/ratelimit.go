@@ -0,0 +1,157 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a token bucket rate limiter. Taking more tokens than there are goes into
+// debt, which later takers wait out, so that large takes are not starved by small ones.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+// reserve takes n tokens and returns how long to wait before using them.
+func (b *tokenBucket) reserve(now time.Time, n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// wait takes n tokens, waiting until they are available or ctx is done.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	delay := b.reserve(time.Now(), float64(n))
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimiter limits the bandwidth of all downloads together and the request rate of each
+// host, see WithRateLimit.
+type rateLimiter struct {
+	bytes *tokenBucket
+
+	requestsPerSecond float64
+	mu                sync.Mutex
+	hosts             map[string]*tokenBucket
+}
+
+func newRateLimiter(bytesPerSecond int64, requestsPerSecond float64) *rateLimiter {
+	if bytesPerSecond == 0 && requestsPerSecond == 0 {
+		return nil
+	}
+	l := &rateLimiter{requestsPerSecond: requestsPerSecond, hosts: map[string]*tokenBucket{}}
+	if bytesPerSecond != 0 {
+		// allow bursts of a tenth of a second, so reads are spread over the second
+		l.bytes = newTokenBucket(float64(bytesPerSecond), max(float64(bytesPerSecond)/10, 1))
+	}
+	return l
+}
+
+func (l *rateLimiter) host(host string) *tokenBucket {
+	if l.requestsPerSecond == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.hosts[host]
+	if !ok {
+		b = newTokenBucket(l.requestsPerSecond, max(l.requestsPerSecond, 1))
+		l.hosts[host] = b
+	}
+	return b
+}
+
+// transport returns wrapped, limited by l. A nil l does not limit.
+func (l *rateLimiter) transport(wrapped http.RoundTripper) http.RoundTripper {
+	if l == nil {
+		return wrapped
+	}
+	return &rateLimitTransport{wrapped: wrapped, limiter: l}
+}
+
+type rateLimitTransport struct {
+	wrapped http.RoundTripper
+	limiter *rateLimiter
+}
+
+func (t *rateLimitTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.URL != nil {
+		if b := t.limiter.host(request.URL.Host); b != nil {
+			if err := b.wait(request.Context(), 1); err != nil {
+				return nil, err
+			}
+		}
+	}
+	res, err := t.wrapped.RoundTrip(request)
+	if err != nil || t.limiter.bytes == nil {
+		return res, err
+	}
+	res.Body = &rateLimitedBody{ReadCloser: res.Body, ctx: request.Context(), bucket: t.limiter.bytes}
+	return res, nil
+}
+
+// rateLimitedBody is a response body that is read no faster than its bucket allows.
+type rateLimitedBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	bucket *tokenBucket
+}
+
+func (r *rateLimitedBody) Read(p []byte) (int, error) {
+	// read no more than a burst at once, so the wait after it is short
+	if burst := int(r.bucket.burst); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := r.bucket.wait(r.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
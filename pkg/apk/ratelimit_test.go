@@ -0,0 +1,64 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Unix(0, 0)
+	b := newTokenBucket(10, 2)
+	require.Equal(t, time.Duration(0), b.reserve(start, 2))
+	require.Equal(t, 100*time.Millisecond, b.reserve(start, 1))
+	// the debt is paid by then, so the next token takes another tenth of a second
+	require.Equal(t, 100*time.Millisecond, b.reserve(start.Add(100*time.Millisecond), 1))
+	// it never holds more than a burst
+	require.Equal(t, time.Duration(0), b.reserve(start.Add(time.Hour), 2))
+	require.Equal(t, 100*time.Millisecond, b.reserve(start.Add(time.Hour), 1))
+}
+
+func TestWithRateLimit(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 300)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(body)
+	}))
+	defer srv.Close()
+
+	a, err := New(WithRateLimit(1000, 0))
+	require.NoError(t, err)
+	start := time.Now()
+	res, err := a.client.Get(srv.URL)
+	require.NoError(t, err)
+	got, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, body, got)
+	// the first 100 bytes are a burst, the other 200 take a fifth of a second
+	require.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	_, err = New(WithRateLimit(-1, 0))
+	require.Error(t, err)
+	_, err = New(WithRateLimit(0, -1))
+	require.Error(t, err)
+	require.Nil(t, newRateLimiter(0, 0))
+}
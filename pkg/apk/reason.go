@@ -0,0 +1,133 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reason is why resolving failed, or why a package was disqualified, for programs to branch
+// on instead of matching error messages, see ReasonOf.
+type Reason int
+
+const (
+	// ReasonUnknown is for failures that have no reason code, e.g. canceled resolving.
+	ReasonUnknown Reason = iota
+	// ReasonNotFound is when no package is named or provides what is needed.
+	ReasonNotFound
+	// ReasonVersionUnsatisfied is when packages provide what is needed, but not in a version
+	// that satisfies the constraint.
+	ReasonVersionUnsatisfied
+	// ReasonConflictsWith is when a package conflicts with another one that is selected, or
+	// with a !name constraint.
+	ReasonConflictsWith
+	// ReasonExcludedByPolicy is when a Policy does not allow a package, e.g. an exclude or a
+	// hold.
+	ReasonExcludedByPolicy
+	// ReasonArchMismatch is when a package is not for the architecture of the resolver, see
+	// WithResolverArch.
+	ReasonArchMismatch
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonUnknown:
+		return "unknown"
+	case ReasonNotFound:
+		return "not-found"
+	case ReasonVersionUnsatisfied:
+		return "version-unsatisfied"
+	case ReasonConflictsWith:
+		return "conflicts-with"
+	case ReasonExcludedByPolicy:
+		return "excluded-by-policy"
+	case ReasonArchMismatch:
+		return "arch-mismatch"
+	default:
+		return fmt.Sprintf("Reason(%d)", int(r))
+	}
+}
+
+// ReasonOf returns the reason of err, an error of resolving, from the first error it wraps
+// that has one. When several packages were disqualified, it is the reason of the first.
+func ReasonOf(err error) Reason {
+	var dqErr *DisqualifiedError
+	if errors.As(err, &dqErr) {
+		return dqErr.Reason
+	}
+	var violation *PolicyViolation
+	if errors.As(err, &violation) {
+		return violation.reason()
+	}
+	var notFound *NotFoundError
+	if errors.As(err, &notFound) {
+		return ReasonNotFound
+	}
+	var unsatisfied *UnsatisfiedError
+	if errors.As(err, &unsatisfied) {
+		return ReasonVersionUnsatisfied
+	}
+	return ReasonUnknown
+}
+
+func (v *PolicyViolation) reason() Reason {
+	if v.Rule == PolicyRuleArch {
+		return ReasonArchMismatch
+	}
+	return ReasonExcludedByPolicy
+}
+
+// NotFoundError is returned when no package is named or provides a constraint.
+type NotFoundError struct {
+	Constraint string
+	// Dependent is the package that depends on the constraint, or nil if it was requested.
+	Dependent *RepositoryPackage
+}
+
+func (e *NotFoundError) Error() string {
+	if e.Dependent != nil {
+		return fmt.Sprintf("could not find package either named %s or that provides %s for %s", e.Constraint, e.Constraint, e.Dependent.Name)
+	}
+	return fmt.Sprintf("could not find package that provides %s in indexes", e.Constraint)
+}
+
+// UnsatisfiedError is returned when packages provide the name of a constraint, but none of
+// them satisfies it and none was disqualified.
+type UnsatisfiedError struct {
+	Constraint string
+}
+
+func (e *UnsatisfiedError) Error() string {
+	return fmt.Sprintf("could not find package %q in indexes", e.Constraint)
+}
+
+// setReason records that packages disqualified because of reason are for code, see
+// reasonFor.
+func (p *PkgResolver) setReason(reason string, code Reason) {
+	p.reasonsMu.Lock()
+	defer p.reasonsMu.Unlock()
+	if p.reasons == nil {
+		p.reasons = map[string]Reason{}
+	}
+	p.reasons[reason] = code
+}
+
+// reasonFor returns the code of reason, the reason a package was disqualified for.
+func (p *PkgResolver) reasonFor(reason string) Reason {
+	p.reasonsMu.Lock()
+	defer p.reasonsMu.Unlock()
+	return p.reasons[reason]
+}
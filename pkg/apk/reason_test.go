@@ -0,0 +1,72 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReasonOf(t *testing.T) {
+	ctx := context.Background()
+	repo := Repository{URI: "main"}
+	index := repo.WithIndex(&APKIndex{Packages: []*Package{
+		{Name: "app", Version: "1.0-r0", Arch: "x86_64", Dependencies: []string{"libfoo"}},
+		{Name: "libfoo", Version: "1.0-r0", Arch: "x86_64"},
+		{Name: "tool", Version: "1.0-r0", Arch: "x86_64", Dependencies: []string{"!libfoo"}},
+		{Name: "broken", Version: "1.0-r0", Arch: "x86_64", Dependencies: []string{"libmissing"}},
+		{Name: "other", Version: "1.0-r0", Arch: "aarch64"},
+		{Name: "data", Version: "1.0-r0", Arch: "noarch"},
+	}})
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{index})
+
+	for _, tt := range []struct {
+		name     string
+		options  []ResolverOption
+		packages []string
+		reason   Reason
+	}{
+		{"not found", nil, []string{"missing"}, ReasonNotFound},
+		{"dependency not found", nil, []string{"broken"}, ReasonNotFound},
+		{"version", nil, []string{"app", "libfoo>=2"}, ReasonVersionUnsatisfied},
+		{"conflict", nil, []string{"tool", "app"}, ReasonConflictsWith},
+		{"policy", []ResolverOption{WithResolverExcludes("libfoo")}, []string{"app"}, ReasonExcludedByPolicy},
+		{"arch", []ResolverOption{WithResolverArch("x86_64")}, []string{"other"}, ReasonArchMismatch},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := NewPkgResolver(ctx, indexes, tt.options...)
+			_, _, err := resolver.GetPackagesWithDependencies(ctx, tt.packages)
+			require.Error(t, err)
+			require.Equal(t, tt.reason, ReasonOf(err), "%v", err)
+		})
+	}
+
+	resolver := NewPkgResolver(ctx, indexes, WithResolverArch("x86_64"))
+	pkgs, _, err := resolver.GetPackagesWithDependencies(ctx, []string{"app", "data"})
+	require.NoError(t, err)
+	require.Len(t, pkgs, 3)
+
+	_, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"tool", "app"})
+	var dqErr *DisqualifiedError
+	require.True(t, errors.As(err, &dqErr))
+	require.Equal(t, "app", dqErr.Package.Name)
+	require.Equal(t, ReasonConflictsWith, dqErr.Reason)
+	require.Equal(t, "conflicts-with", dqErr.Reason.String())
+
+	require.Equal(t, ReasonUnknown, ReasonOf(context.Canceled))
+}
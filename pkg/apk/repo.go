@@ -15,19 +15,21 @@
 package apk
 
 import (
-	"bufio"
 	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/chainguard-dev/clog"
-	"github.com/hashicorp/go-hclog"
-	"github.com/hashicorp/go-retryablehttp"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 )
@@ -42,6 +44,53 @@ type NamedIndex interface {
 	Count() int
 }
 
+// TimestampedIndex is implemented by the NamedIndexes that know when they were built, such as
+// those of GetRepositoryIndexes.
+type TimestampedIndex interface {
+	// Timestamp is when the index was built, or zero if it is not known.
+	Timestamp() time.Time
+}
+
+// indexTimestamp returns when index was built, or zero if it is not a TimestampedIndex.
+func indexTimestamp(index NamedIndex) time.Time {
+	if ts, ok := index.(TimestampedIndex); ok {
+		return ts.Timestamp()
+	}
+	return time.Time{}
+}
+
+// SignedIndex is implemented by the NamedIndexes that know how their signatures were verified,
+// such as those of GetRepositoryIndexes.
+type SignedIndex interface {
+	// Signature is how the signature of the index was verified when it was fetched, or zero
+	// if that is not known.
+	Signature() SignatureVerification
+}
+
+// indexSignature returns how the signature of index was verified, or zero if it is not a
+// SignedIndex.
+func indexSignature(index NamedIndex) SignatureVerification {
+	if signed, ok := index.(SignedIndex); ok {
+		return signed.Signature()
+	}
+	return SignatureVerification{}
+}
+
+// DigestedIndex is implemented by the NamedIndexes that know the digest of the index they were
+// read from, such as those of GetRepositoryIndexes.
+type DigestedIndex interface {
+	// Digest is the sha256 of the index as it was fetched, or nil if that is not known.
+	Digest() []byte
+}
+
+// indexDigest returns the sha256 of index, or nil if it is not a DigestedIndex.
+func indexDigest(index NamedIndex) []byte {
+	if digested, ok := index.(DigestedIndex); ok {
+		return digested.Digest()
+	}
+	return nil
+}
+
 func indexNames(indexes []NamedIndex) []string {
 	names := make([]string, len(indexes))
 	for i, idx := range indexes {
@@ -79,6 +128,27 @@ func (n *namedRepositoryWithIndex) Packages() []*RepositoryPackage {
 	}
 	return n.repo.Packages()
 }
+func (n *namedRepositoryWithIndex) Timestamp() time.Time {
+	if n.repo == nil {
+		return time.Time{}
+	}
+	return n.repo.Timestamp()
+}
+
+func (n *namedRepositoryWithIndex) Signature() SignatureVerification {
+	if n.repo == nil {
+		return SignatureVerification{}
+	}
+	return n.repo.Signature()
+}
+
+func (n *namedRepositoryWithIndex) Digest() []byte {
+	if n.repo == nil {
+		return nil
+	}
+	return n.repo.Digest()
+}
+
 func (n *namedRepositoryWithIndex) Source() string {
 	if n.repo == nil || n.repo.IndexURI() == "" {
 		return ""
@@ -92,23 +162,35 @@ func (n *namedRepositoryWithIndex) Source() string {
 type repositoryPackage struct {
 	*RepositoryPackage
 	pinnedName string
+	order      int // position of the index of the package in the resolver
 }
 
 // SetRepositories sets the contents of /etc/apk/repositories file.
+// Each entry is either a repository URL or a tagged repository, "@tag url", see TaggedRepository.
+// Use SetRepositoryConfigs to set repositories with other settings.
 // The base directory of /etc/apk must already exist, i.e. this only works on an initialized APK database.
+// The drop-in lists in /etc/apk/repositories.d are left alone, see GetRepositories.
 func (a *APK) SetRepositories(ctx context.Context, repos []string) error {
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "SetRepositories")
 	defer span.End()
 
-	log := clog.FromContext(ctx)
+	log := a.log(ctx)
 	log.Debug("setting apk repositories")
 
 	if len(repos) == 0 {
 		return fmt.Errorf("must provide at least one repository")
 	}
+	for _, repo := range repos {
+		if _, _, err := ParseRepositoryLine(repo); err != nil {
+			return err
+		}
+	}
 
-	data := strings.Join(repos, "\n") + "\n"
+	return a.writeRepositories(strings.Join(repos, "\n") + "\n")
+}
 
+// writeRepositories writes data to /etc/apk/repositories.
+func (a *APK) writeRepositories(data string) error {
 	// #nosec G306 -- apk repositories must be publicly readable
 	if err := a.fs.WriteFile(filepath.Join("etc", "apk", "repositories"),
 		[]byte(data), 0o644); err != nil {
@@ -118,18 +200,136 @@ func (a *APK) SetRepositories(ctx context.Context, repos []string) error {
 	return nil
 }
 
+// GetRepositories returns the repositories of the root: those in /etc/apk/repositories,
+// then those in each /etc/apk/repositories.d/*.list drop-in, in the order of their names.
+// A repository that is listed more than once is only returned the first time.
+//
+// The keys in /etc/apk/keys and /etc/apk/keys.d verify every repository. The keys in
+// /etc/apk/keys.d/<name>/ are hints for the repositories of <name>.list, and only verify
+// those.
 func (a *APK) GetRepositories() (repos []string, err error) {
-	// get the repository URLs
-	reposFile, err := a.fs.Open(reposFilePath)
+	lists, err := a.repositoryLists()
 	if err != nil {
+		return nil, err
+	}
+	for _, list := range lists {
+		for _, repo := range list.repos {
+			if !repo.Disabled {
+				repos = append(repos, repo.Line())
+			}
+		}
+	}
+	return repos, nil
+}
+
+// repositoryList is the repositories of /etc/apk/repositories, or of a drop-in list.
+type repositoryList struct {
+	// name is the name of the drop-in without .list, empty for /etc/apk/repositories.
+	name  string
+	repos []RepositoryConfig
+}
+
+// repositoryLists returns the repository lists of the root, in the order of
+// GetRepositories, without duplicates. /etc/apk/repositories must exist unless there are
+// drop-ins.
+func (a *APK) repositoryLists() ([]repositoryList, error) {
+	var paths []string
+	des, err := a.fs.ReadDir(reposDirPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("could not read repositories directory at %s: %w", reposDirPath, err)
+	}
+	for _, de := range des {
+		if !de.IsDir() && strings.HasSuffix(de.Name(), ".list") {
+			paths = append(paths, filepath.Join(reposDirPath, de.Name()))
+		}
+	}
+	sort.Strings(paths)
+
+	seen := map[string]bool{}
+	readList := func(path string) ([]RepositoryConfig, error) {
+		f, err := a.fs.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		parsed, err := parseRepositories(f, true)
+		if err != nil {
+			return nil, err
+		}
+		repos := parsed[:0]
+		for _, repo := range parsed {
+			key := fmt.Sprintf("%t %s", repo.Disabled, repo.Line())
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			repos = append(repos, repo)
+		}
+		return repos, nil
+	}
+
+	var lists []repositoryList
+	repos, err := readList(reposFilePath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist) && len(paths) != 0:
+	case err != nil:
 		return nil, fmt.Errorf("could not open repositories file in %s at %s: %w", a.fs, reposFilePath, err)
+	default:
+		lists = append(lists, repositoryList{repos: repos})
+	}
+	for _, path := range paths {
+		repos, err := readList(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read repositories file at %s: %w", path, err)
+		}
+		lists = append(lists, repositoryList{name: strings.TrimSuffix(filepath.Base(path), ".list"), repos: repos})
+	}
+	return lists, nil
+}
+
+// readKeys returns the keys in dir by file name. Subdirectories are skipped.
+func (a *APK) readKeys(dir string) (map[string][]byte, error) {
+	des, err := a.fs.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read keys directory at %s: %w", dir, err)
+	}
+	keys := make(map[string][]byte, len(des))
+	for _, d := range des {
+		if d.IsDir() {
+			continue
+		}
+		fullPath := filepath.Join(dir, d.Name())
+		b, err := a.fs.ReadFile(fullPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read key file at %s: %w", fullPath, err)
+		}
+		keys[d.Name()] = b
+	}
+	return keys, nil
+}
+
+// dropInKeys returns the keys in /etc/apk/keys.d, without those of its subdirectories, which
+// hold the key hints of the drop-in repository lists.
+func (a *APK) dropInKeys() (map[string][]byte, error) {
+	// Most roots have no keys.d, so check for it before readKeys wraps the error.
+	if _, err := a.fs.Stat(keysDropInDirPath); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return a.readKeys(keysDropInDirPath)
+}
+
+// mergeKeys returns the keys of base and extra. Keys of base win over keys with the same
+// name in extra. Neither map is modified.
+func mergeKeys(base, extra map[string][]byte) map[string][]byte {
+	merged := make(map[string][]byte, len(base)+len(extra))
+	for name, key := range extra {
+		merged[name] = key
 	}
-	defer reposFile.Close()
-	scanner := bufio.NewScanner(reposFile)
-	for scanner.Scan() {
-		repos = append(repos, scanner.Text())
+	for name, key := range base {
+		merged[name] = key
 	}
-	return
+	return merged
 }
 
 // GetRepositoryIndexes returns the indexes for the repositories in the specified root.
@@ -138,52 +338,283 @@ func (a *APK) GetRepositoryIndexes(ctx context.Context, ignoreSignatures bool) (
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "GetRepositoryIndexes")
 	defer span.End()
 
-	// get the repository URLs
-	repos, err := a.GetRepositories()
+	arch, err := a.rootArch()
 	if err != nil {
 		return nil, err
 	}
+	return a.getRepositoryIndexesForArch(ctx, arch, ignoreSignatures)
+}
 
+// rootArch returns the arch of the root, from /etc/apk/arch.
+func (a *APK) rootArch() (string, error) {
 	archFile, err := a.fs.Open(archFilePath)
 	if err != nil {
-		return nil, fmt.Errorf("could not open arch file in %s at %s: %w", a.fs, archFile, err)
+		return "", fmt.Errorf("could not open arch file in %s at %s: %w", a.fs, archFilePath, err)
 	}
 	defer archFile.Close()
 
 	archB, err := io.ReadAll(archFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read arch file: %w", err)
+		return "", fmt.Errorf("failed to read arch file: %w", err)
 	}
 	// trim the newline
-	arch := strings.TrimSuffix(string(archB), "\n")
+	return ArchToAPK(strings.TrimSpace(string(archB))), nil
+}
 
-	// create the list of keys
-	keys := make(map[string][]byte)
-	dir, err := a.fs.ReadDir(keysDirPath)
+// repositoryKeys returns the keys of the root: those that verify every repository, and
+// those that verify the repositories of each drop-in list by its name, with the former.
+// Lists without key hints are not in the latter.
+func (a *APK) repositoryKeys(lists []repositoryList) (map[string][]byte, map[string]map[string][]byte, error) {
+	keys, err := a.readKeys(keysDirPath)
 	if err != nil {
-		return nil, fmt.Errorf("could not read keys directory in %s at %s: %w", a.fs, keysDirPath, err)
+		return nil, nil, err
 	}
-	for _, d := range dir {
-		if d.IsDir() {
+	dropInKeys, err := a.dropInKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	keys = mergeKeys(keys, dropInKeys)
+
+	listKeys := map[string]map[string][]byte{}
+	for _, list := range lists {
+		if list.name == "" {
 			continue
 		}
-		fullPath := filepath.Join(keysDirPath, d.Name())
-		b, err := a.fs.ReadFile(fullPath)
-		if err != nil {
-			return nil, fmt.Errorf("could not read key file at %s: %w", fullPath, err)
+		hints, err := a.readKeys(filepath.Join(keysDropInDirPath, list.name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, err
+		}
+		if len(hints) != 0 {
+			listKeys[list.name] = mergeKeys(keys, hints)
+		}
+	}
+	return keys, listKeys, nil
+}
+
+// packageKeys returns the keys that may verify the signature of a package: keys, with those in
+// /etc/apk/keys.d, and for a package of a repository of a drop-in list with key hints, the
+// hints in /etc/apk/keys.d/<name>/ too, and the keys discovered for its repository, as for
+// its index.
+func (a *APK) packageKeys(keys map[string][]byte) (func(pkg InstallablePackage) map[string][]byte, error) {
+	dropInKeys, err := a.dropInKeys()
+	if err != nil {
+		return nil, err
+	}
+	keys = mergeKeys(keys, dropInKeys)
+
+	lists, err := a.repositoryLists()
+	if errors.Is(err, fs.ErrNotExist) {
+		// packages from no repositories of the root
+		return func(InstallablePackage) map[string][]byte { return keys }, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the keys of the repositories with key hints or discovered keys, by URL
+	repoKeys := map[string]map[string][]byte{}
+	for _, list := range lists {
+		listKeys, hinted := keys, false
+		if list.name != "" {
+			hints, err := a.readKeys(filepath.Join(keysDropInDirPath, list.name))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+			if len(hints) != 0 {
+				listKeys, hinted = mergeKeys(keys, hints), true
+			}
+		}
+		for _, repo := range list.repos {
+			discovered, err := a.discoveredKeys(repo.URL)
+			if err != nil {
+				return nil, err
+			}
+			if !hinted && len(discovered) == 0 {
+				continue
+			}
+			for _, u := range append([]string{repo.URL}, repo.Mirrors...) {
+				if _, ok := repoKeys[u]; !ok {
+					repoKeys[u] = mergeKeys(listKeys, discovered)
+				}
+			}
+		}
+	}
+	return func(pkg InstallablePackage) map[string][]byte {
+		// The URL of a package is that of its repository, then its arch and file name.
+		u := pkg.URL()
+		for i := 0; i < 2; i++ {
+			if j := strings.LastIndex(u, "/"); j >= 0 {
+				u = u[:j]
+			}
+		}
+		if listKeys, ok := repoKeys[u]; ok {
+			return listKeys
+		}
+		return keys
+	}, nil
+}
+
+// keysFor returns the keys of keys that may verify repo, see RepositoryConfig.Keys.
+func keysFor(repo RepositoryConfig, keys map[string][]byte) map[string][]byte {
+	if len(repo.Keys) == 0 {
+		return keys
+	}
+	named := make(map[string][]byte, len(repo.Keys))
+	for _, name := range repo.Keys {
+		if key, ok := keys[name]; ok {
+			named[name] = key
+		}
+	}
+	return named
+}
+
+// getRepositoryIndexesForArch returns the indexes for the repositories in the specified
+// root, for arch rather than the arch of the root.
+func (a *APK) getRepositoryIndexesForArch(ctx context.Context, arch string, ignoreSignatures bool) ([]NamedIndex, error) {
+	// get the repository URLs
+	lists, err := a.repositoryLists()
+	if err != nil {
+		return nil, err
+	}
+
+	if a.keyDiscovery && !ignoreSignatures && !a.offline {
+		if _, err := a.discoverKeys(ctx, lists, arch); err != nil {
+			a.log(ctx).Warnf("failed to discover repository keys: %v", err)
 		}
-		keys[d.Name()] = b
 	}
+
+	// create the list of keys
+	keys, hintedKeys, err := a.repositoryKeys(lists)
+	if err != nil {
+		return nil, err
+	}
+
 	httpClient := a.client
 	if httpClient == nil {
-		rhttp := retryablehttp.NewClient()
-		rhttp.Logger = hclog.Default()
-		httpClient = rhttp.StandardClient()
+		httpClient = a.httpConfig.client()
 	}
 	if a.cache != nil {
 		httpClient = a.cache.client(httpClient, true)
 	}
-	return GetRepositoryIndexes(ctx, repos, keys, arch, WithIgnoreSignatures(ignoreSignatures), WithHTTPClient(httpClient))
+	unsigned := a.unsignedRepositories(lists)
+	fetch := func(repos []string, keys map[string][]byte, arch string) ([]NamedIndex, error) {
+		if len(repos) == 0 {
+			return nil, nil
+		}
+		if a.offline {
+			if err := a.checkOfflineIndexes(repos, arch); err != nil {
+				return nil, err
+			}
+		}
+		return GetRepositoryIndexes(ctx, repos, keys, arch, WithIgnoreSignatures(ignoreSignatures), WithIgnoreSignaturesFor(unsigned), WithHTTPClient(httpClient), WithParallelism(a.indexParallelism), WithRemoteSchemes(a.remoteSchemes()...), withIndexMetrics(a.metrics))
+	}
+
+	// Consecutive plain repositories of lists without key hints are fetched at once, keeping
+	// the order of the repositories.
+	var (
+		indexes []NamedIndex
+		pending []string
+	)
+	flush := func(keys map[string][]byte) error {
+		fetched, err := fetch(pending, keys, arch)
+		if err != nil {
+			return err
+		}
+		indexes = append(indexes, fetched...)
+		pending = nil
+		return nil
+	}
+	for _, list := range lists {
+		listKeys, hinted := hintedKeys[list.name]
+		if hinted {
+			if err := flush(keys); err != nil {
+				return nil, err
+			}
+		} else {
+			listKeys = keys
+		}
+		for _, repo := range list.repos {
+			if repo.Disabled {
+				continue
+			}
+			discovered, err := a.discoveredKeys(repo.URL)
+			if err != nil {
+				return nil, err
+			}
+			if !repo.hasFetchSettings() && len(discovered) == 0 {
+				pending = append(pending, repo.Line())
+				continue
+			}
+			if err := flush(listKeys); err != nil {
+				return nil, err
+			}
+			fetched, err := a.fetchConfiguredRepository(ctx, repo, mergeKeys(listKeys, discovered), arch, fetch)
+			if err != nil {
+				return nil, err
+			}
+			indexes = append(indexes, fetched...)
+		}
+		if hinted {
+			if err := flush(listKeys); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := flush(keys); err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		a.emit(ctx, &RepositoryFetched{Source: index.Source(), Packages: index.Count()})
+	}
+	return indexes, nil
+}
+
+// unsignedRepositories returns whether the signatures of the index of the repository at a
+// URL are ignored: if it is an Unsigned repository, or one of its mirrors, of lists, or it
+// matches WithUnsignedRepositories.
+func (a *APK) unsignedRepositories(lists []repositoryList) func(repoURL string) bool {
+	configured := map[string]bool{}
+	for _, list := range lists {
+		for _, repo := range list.repos {
+			if !repo.Unsigned {
+				continue
+			}
+			configured[repo.URL] = true
+			for _, mirror := range repo.Mirrors {
+				configured[mirror] = true
+			}
+		}
+	}
+	return func(repoURL string) bool {
+		return configured[repoURL] || (a.unsignedRepos != nil && a.unsignedRepos(repoURL))
+	}
+}
+
+// fetchConfiguredRepository fetches the index of repo, with only the keys it names and for
+// its arch, from its URL or else from the first of its mirrors that has it.
+func (a *APK) fetchConfiguredRepository(ctx context.Context, repo RepositoryConfig, keys map[string][]byte, arch string, fetch func([]string, map[string][]byte, string) ([]NamedIndex, error)) ([]NamedIndex, error) {
+	keys = keysFor(repo, keys)
+	if repo.Arch != "" {
+		arch = repo.Arch
+	}
+
+	var errs []error
+	for _, u := range append([]string{repo.URL}, repo.Mirrors...) {
+		indexes, err := fetch([]string{TaggedRepository(repo.Tag, u)}, keys, arch)
+		switch {
+		case err == nil && len(indexes) != 0:
+			return indexes, nil
+		case err == nil:
+			// a local repository without an index for arch
+			continue
+		case ctx.Err() != nil:
+			return nil, err
+		}
+		if len(repo.Mirrors) != 0 {
+			a.log(ctx).Warnf("fetching index of %s: %v", u, err)
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
 }
 
 // PkgResolver resolves packages from a list of indexes.
@@ -195,18 +626,205 @@ func (a *APK) GetRepositoryIndexes(ctx context.Context, ignoreSignatures bool) (
 // indexes. If you need to look only in a certain set, you should create a new
 // PkgResolver with only those indexes.
 // If the indexes change, you should generate a new pkgResolver.
+// A PkgResolver is safe for concurrent use once created, as long as concurrent calls do
+// not share a disqualified map.
 type PkgResolver struct {
 	indexes      []NamedIndex
 	nameMap      map[string][]*repositoryPackage
 	installIfMap map[string][]*repositoryPackage // contains any package that should be installed if the named package is installed
+	noInstallIf  bool                            // see WithResolverInstallIf
+	tags         map[string]bool                 // tags of the tagged repositories, see TaggedRepository
+	tieBreak     TieBreak
+	priorities   map[string]int // repository priorities by URI, see TieBreakRepositoryPriority
+	policies     []Policy
+	installed    map[string]string                       // installed versions by name, see WithResolverInstalled
+	violations   map[*RepositoryPackage]*PolicyViolation // packages the policies do not allow
+	dependents   map[string][]*repositoryPackage         // packages by the names they depend on, see dependentsOf
+	solveTimeout time.Duration
+	sizeBudget   uint64 // see WithResolverSizeBudget
+
+	providerStrategy ProviderStrategy
+	providerChooser  ProviderChooser
+	preferProviders  map[string]string // see WithResolverPreferProvider
+	duplicates       DuplicatePolicy
+	reasons          map[string]Reason // codes of the reasons packages are disqualified for, see reasonFor
+	reasonsMu        sync.Mutex
+
+	versions       *VersionCache
+	dependentsOnce sync.Once
+}
 
-	parsedVersions map[string]packageVersion
-	depForVersion  map[string]parsedConstraint
+// ResolverOption configures a PkgResolver, see NewPkgResolver.
+type ResolverOption func(*PkgResolver)
+
+// WithResolverSolveTimeout limits how long GetPackagesWithDependencies may take to resolve,
+// after which it fails with a *SolveCanceledError. Default is no limit.
+func WithResolverSolveTimeout(timeout time.Duration) ResolverOption {
+	return func(p *PkgResolver) {
+		p.solveTimeout = timeout
+	}
+}
+
+// WithResolverInstallIf sets whether packages are added by the install_if rules of the
+// indexes when all the packages they name are installed. Default is true.
+func WithResolverInstallIf(enabled bool) ResolverOption {
+	return func(p *PkgResolver) {
+		p.noInstallIf = !enabled
+	}
+}
+
+// resolverOptions returns the options of the resolvers of the APK for indexes.
+func (a *APK) resolverOptions(indexes []NamedIndex) ([]ResolverOption, error) {
+	var options []ResolverOption
+	priorities, err := a.configuredPriorities(indexes)
+	if err != nil {
+		return nil, err
+	}
+	tieBreak := a.tieBreak
+	if len(priorities) != 0 && tieBreak == TieBreakRepositoryOrder {
+		tieBreak = TieBreakRepositoryPriority
+	}
+	for uri, priority := range a.repoPriorities {
+		priorities[uri] = priority
+	}
+	if len(priorities) != 0 {
+		options = append(options, WithResolverRepositoryPriorities(priorities))
+	}
+	options = append(options, WithResolverTieBreak(tieBreak))
+	if a.solveTimeout > 0 {
+		options = append(options, WithResolverSolveTimeout(a.solveTimeout))
+	}
+	if a.noInstallIf {
+		options = append(options, WithResolverInstallIf(false))
+	}
+	if a.sizeBudget > 0 {
+		options = append(options, WithResolverSizeBudget(a.sizeBudget))
+	}
+	if a.providerStrategy != ProviderStrategyDefault {
+		options = append(options, WithResolverProviderStrategy(a.providerStrategy))
+	}
+	if a.providerChooser != nil {
+		options = append(options, WithResolverProviderChooser(a.providerChooser))
+	}
+	if a.duplicates != DuplicateIgnore {
+		options = append(options, WithResolverDuplicates(a.duplicates))
+	}
+	if len(a.preferProviders) != 0 {
+		options = append(options, WithResolverPreferProvider(a.preferProviders))
+	}
+	options = append(options, WithResolverVersionCache(a.versionCache))
+	if a.policy != nil {
+		options = append(options, WithResolverPolicy(a.policy))
+	}
+	if a.secDB != nil && a.secFixes == SecFixesFail {
+		options = append(options, WithResolverPolicy(NewSecFixesPolicy(a.secDB, indexes)))
+	}
+	if len(a.excludes) != 0 {
+		options = append(options, WithResolverExcludes(a.excludes...))
+	}
+	if len(a.holds) != 0 {
+		installed, err := a.GetInstalled()
+		if err != nil {
+			return nil, fmt.Errorf("reading installed packages to hold: %w", err)
+		}
+		versions := map[string]string{}
+		for _, pkg := range installed {
+			if slices.Contains(a.holds, pkg.Name) {
+				versions[pkg.Name] = pkg.Version
+			}
+		}
+		options = append(options, WithResolverHolds(versions))
+	}
+	return options, nil
+}
+
+// configuredPriorities returns the priorities set in the repository configs of the root,
+// see RepositoryConfig, by the URI of the repository of each of indexes.
+func (a *APK) configuredPriorities(indexes []NamedIndex) (map[string]int, error) {
+	priorities := map[string]int{}
+	repos, err := a.RepositoryConfigs()
+	if errors.Is(err, fs.ErrNotExist) {
+		return priorities, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	byURL := map[string]int{}
+	for _, repo := range repos {
+		if repo.Disabled || repo.Priority == 0 {
+			continue
+		}
+		for _, u := range append([]string{repo.URL}, repo.Mirrors...) {
+			byURL[u] = repo.Priority
+		}
+	}
+	if len(byURL) == 0 {
+		return priorities, nil
+	}
+	for _, index := range indexes {
+		// the URI of a fetched repository is its URL and arch
+		uri := strings.TrimSuffix(index.Source(), "/"+indexFilename)
+		if i := strings.LastIndex(uri, "/"); i > 0 {
+			if priority, ok := byURL[uri[:i]]; ok {
+				priorities[uri] = priority
+			}
+		}
+	}
+	return priorities, nil
+}
+
+// indexMaps are the maps of the packages of a single index, see ingestIndex.
+type indexMaps struct {
+	names      map[string][]*repositoryPackage // by name
+	provides   map[string][]*repositoryPackage // by what they provide
+	installIf  map[string][]*repositoryPackage
+	violations map[*RepositoryPackage]*PolicyViolation
+}
+
+// ingestIndex maps the packages of the index at position order. It does not touch p other
+// than to evaluate the policies, so that indexes can be ingested concurrently.
+func (p *PkgResolver) ingestIndex(order int, index NamedIndex) *indexMaps {
+	m := &indexMaps{
+		names:     make(map[string][]*repositoryPackage, index.Count()),
+		provides:  map[string][]*repositoryPackage{},
+		installIf: map[string][]*repositoryPackage{},
+	}
+	if len(p.policies) != 0 {
+		m.violations = map[*RepositoryPackage]*PolicyViolation{}
+	}
+	for _, pkg := range index.Packages() {
+		if len(p.policies) != 0 {
+			if v := p.evaluatePolicies(pkg); v != nil {
+				m.violations[pkg] = v
+			}
+		}
+		rp := &repositoryPackage{
+			RepositoryPackage: pkg,
+			pinnedName:        index.Name(),
+			order:             order,
+		}
+		m.names[pkg.Name] = append(m.names[pkg.Name], rp)
+		for _, provide := range pkg.Provides {
+			name := p.resolvePackageNameVersionPin(provide).name
+			m.provides[name] = append(m.provides[name], rp)
+		}
+		for _, dep := range pkg.InstallIf {
+			// by name, the versions are checked when it triggers
+			dep = p.resolvePackageNameVersionPin(dep).name
+			m.installIf[dep] = append(m.installIf[dep], &repositoryPackage{
+				RepositoryPackage: pkg,
+				pinnedName:        index.Name(),
+				order:             order,
+			})
+		}
+	}
+	return m
 }
 
 // NewPkgResolver creates a new pkgResolver from a list of indexes.
-// The indexes are anything that implements NamedIndex.
-func NewPkgResolver(_ context.Context, indexes []NamedIndex) *PkgResolver {
+// The indexes are anything that implements NamedIndex. They are ingested concurrently,
+// so the policies of the resolver must be safe to evaluate concurrently.
+func NewPkgResolver(_ context.Context, indexes []NamedIndex, options ...ResolverOption) *PkgResolver {
 	numPackages := 0
 	for _, index := range indexes {
 		numPackages += index.Count()
@@ -217,40 +835,48 @@ func NewPkgResolver(_ context.Context, indexes []NamedIndex) *PkgResolver {
 		installIfMap = map[string][]*repositoryPackage{}
 	)
 	p := &PkgResolver{
-		indexes:        indexes,
-		parsedVersions: map[string]packageVersion{},
-		depForVersion:  map[string]parsedConstraint{},
+		indexes:  indexes,
+		versions: NewVersionCache(),
+		tags:     map[string]bool{},
+	}
+	for _, o := range options {
+		o(p)
+	}
+	if len(p.policies) != 0 {
+		p.violations = map[*RepositoryPackage]*PolicyViolation{}
 	}
 
-	// create a map of every package by name and version to its RepositoryPackage
-	for _, index := range indexes {
-		for _, pkg := range index.Packages() {
-			pkgNameMap[pkg.Name] = append(pkgNameMap[pkg.Name], &repositoryPackage{
-				RepositoryPackage: pkg,
-				pinnedName:        index.Name(),
-			})
-			for _, dep := range pkg.InstallIf {
-				if _, ok := installIfMap[dep]; !ok {
-					installIfMap[dep] = []*repositoryPackage{}
-				}
-				installIfMap[dep] = append(installIfMap[dep], &repositoryPackage{
-					RepositoryPackage: pkg,
-					pinnedName:        index.Name(),
-				})
-			}
+	// map the packages of every index concurrently
+	ingested := make([]*indexMaps, len(indexes))
+	var wg sync.WaitGroup
+	for order, index := range indexes {
+		if index.Name() != "" {
+			p.tags[index.Name()] = true
 		}
+		wg.Add(1)
+		go func(order int, index NamedIndex) {
+			defer wg.Done()
+			ingested[order] = p.ingestIndex(order, index)
+		}(order, index)
 	}
-	// create a map of every provided file to its package
-	allPkgs := make([][]*repositoryPackage, 0, len(pkgNameMap))
-	for _, pkgVersions := range pkgNameMap {
-		allPkgs = append(allPkgs, pkgVersions)
+	wg.Wait()
+
+	// then merge them in index order: every package by name, then every package by what it
+	// provides, so that packages come before the packages that provide them
+	for _, m := range ingested {
+		for name, pkgs := range m.names {
+			pkgNameMap[name] = append(pkgNameMap[name], pkgs...)
+		}
+		for dep, pkgs := range m.installIf {
+			installIfMap[dep] = append(installIfMap[dep], pkgs...)
+		}
+		for pkg, v := range m.violations {
+			p.violations[pkg] = v
+		}
 	}
-	for _, pkgVersions := range allPkgs {
-		for _, pkg := range pkgVersions {
-			for _, provide := range pkg.Provides {
-				name := p.resolvePackageNameVersionPin(provide).name
-				pkgNameMap[name] = append(pkgNameMap[name], pkg)
-			}
+	for _, m := range ingested {
+		for name, pkgs := range m.provides {
+			pkgNameMap[name] = append(pkgNameMap[name], pkgs...)
 		}
 	}
 	p.nameMap = pkgNameMap
@@ -258,6 +884,92 @@ func NewPkgResolver(_ context.Context, indexes []NamedIndex) *PkgResolver {
 	return p
 }
 
+// UpdateIndex replaces the index of the resolver whose source is source with index, e.g.
+// after refreshing one repository, patching the resolver instead of creating it again.
+// Policies evaluate the packages of the new index, but policies made from the old indexes,
+// such as NewSecFixesPolicy, are not made again. UpdateIndex must not be called concurrently
+// with anything else on the resolver.
+func (p *PkgResolver) UpdateIndex(source string, index NamedIndex) error {
+	order := slices.IndexFunc(p.indexes, func(idx NamedIndex) bool {
+		return idx.Source() == source
+	})
+	if order < 0 {
+		return fmt.Errorf("no index %s in resolver", source)
+	}
+
+	// drop everything of the old index
+	removed := map[*RepositoryPackage]bool{}
+	drop := func(m map[string][]*repositoryPackage) {
+		for key, pkgs := range m {
+			if !slices.ContainsFunc(pkgs, func(pkg *repositoryPackage) bool { return pkg.order == order }) {
+				continue
+			}
+			kept := make([]*repositoryPackage, 0, len(pkgs))
+			for _, pkg := range pkgs {
+				if pkg.order == order {
+					removed[pkg.RepositoryPackage] = true
+					continue
+				}
+				kept = append(kept, pkg)
+			}
+			if len(kept) == 0 {
+				delete(m, key)
+				continue
+			}
+			m[key] = kept
+		}
+	}
+	drop(p.nameMap)
+	drop(p.installIfMap)
+	for pkg := range removed {
+		delete(p.violations, pkg)
+	}
+
+	// and add the new one where it would have been, see NewPkgResolver
+	m := p.ingestIndex(order, index)
+	for name, pkgs := range m.names {
+		at := slices.IndexFunc(p.nameMap[name], func(pkg *repositoryPackage) bool {
+			return pkg.Name != name || pkg.order > order
+		})
+		p.nameMap[name] = insertPackages(p.nameMap[name], at, pkgs)
+	}
+	for name, pkgs := range m.provides {
+		at := slices.IndexFunc(p.nameMap[name], func(pkg *repositoryPackage) bool {
+			return pkg.Name != name && pkg.order > order
+		})
+		p.nameMap[name] = insertPackages(p.nameMap[name], at, pkgs)
+	}
+	for dep, pkgs := range m.installIf {
+		at := slices.IndexFunc(p.installIfMap[dep], func(pkg *repositoryPackage) bool {
+			return pkg.order > order
+		})
+		p.installIfMap[dep] = insertPackages(p.installIfMap[dep], at, pkgs)
+	}
+	for pkg, v := range m.violations {
+		p.violations[pkg] = v
+	}
+
+	p.indexes = slices.Clone(p.indexes)
+	p.indexes[order] = index
+	p.tags = map[string]bool{}
+	for _, idx := range p.indexes {
+		if idx.Name() != "" {
+			p.tags[idx.Name()] = true
+		}
+	}
+	p.dependents = nil
+	p.dependentsOnce = sync.Once{}
+	return nil
+}
+
+// insertPackages inserts pkgs into list at i, or at the end if i is negative.
+func insertPackages(list []*repositoryPackage, i int, pkgs []*repositoryPackage) []*repositoryPackage {
+	if i < 0 {
+		return append(list, pkgs...)
+	}
+	return slices.Insert(list, i, pkgs...)
+}
+
 // We select the next package based on the smallest number of candidate packages.
 func (p *PkgResolver) nextPackage(packages []string, dq map[*RepositoryPackage]string) (string, error) {
 	next := ""
@@ -270,7 +982,7 @@ func (p *PkgResolver) nextPackage(packages []string, dq map[*RepositoryPackage]s
 			return "", &ConstraintError{pkgName, err}
 		}
 		if len(pkgs) == 0 {
-			return "", fmt.Errorf("could not find package %s", pkgName)
+			return "", &NotFoundError{Constraint: pkgName}
 		}
 
 		if next == "" {
@@ -304,7 +1016,7 @@ func (p *PkgResolver) disqualifyProviders(constraint string, dq map[*RepositoryP
 			continue
 		}
 
-		p.disqualify(dq, conflict.RepositoryPackage, "excluded by !"+constraint)
+		p.disqualify(dq, conflict.RepositoryPackage, ReasonConflictsWith, "excluded by !"+constraint)
 	}
 }
 
@@ -327,15 +1039,104 @@ func (p *PkgResolver) disqualifyConflicts(pkg *RepositoryPackage, dq map[*Reposi
 				continue
 			}
 
-			p.disqualify(dq, conflict.RepositoryPackage, pkg.Filename()+" already provides "+name)
+			p.disqualify(dq, conflict.RepositoryPackage, ReasonConflictsWith, pkg.Filename()+" already provides "+name)
 		}
 	}
 }
 
-func (p *PkgResolver) disqualify(dq map[*RepositoryPackage]string, pkg *RepositoryPackage, reason string) {
+// disqualify disqualifies pkg for reason, whose code is code, and then ripples up: anything
+// that depends on something that nothing can satisfy anymore is disqualified too, with a
+// reason that chains to the reason of pkg, so that errors name the root cause.
+func (p *PkgResolver) disqualify(dq map[*RepositoryPackage]string, pkg *RepositoryPackage, code Reason, reason string) {
 	dq[pkg] = reason
+	p.setReason(reason, code)
+
+	queue := []*RepositoryPackage{pkg}
+	for len(queue) != 0 {
+		cur := queue[0]
+		queue = queue[1:]
+
+		names := []string{cur.Name}
+		for _, prov := range cur.Provides {
+			names = append(names, p.resolvePackageNameVersionPin(prov).name)
+		}
+		for _, name := range names {
+			for _, dependent := range p.dependentsOf(name) {
+				if _, dqed := dq[dependent.RepositoryPackage]; dqed {
+					continue
+				}
+				if _, violates := p.violations[dependent.RepositoryPackage]; violates {
+					continue
+				}
+				for _, dep := range dependent.Dependencies {
+					if strings.HasPrefix(dep, "!") {
+						continue
+					}
+					constraint := p.resolvePackageNameVersionPin(dep)
+					if constraint.name != name || p.getDepVersionForName(dependent, name) != "" || p.satisfiable(constraint, dq) {
+						continue
+					}
+					dq[dependent.RepositoryPackage] = fmt.Sprintf("it depends on %q, which nothing satisfies since %s was disqualified because %s", dep, cur.Filename(), dq[cur])
+					p.setReason(dq[dependent.RepositoryPackage], code)
+					queue = append(queue, dependent.RepositoryPackage)
+					break
+				}
+			}
+		}
+	}
+}
 
-	// TODO: Ripple up and disqualify anything that is no longer solveable.
+// dependentsOf returns the packages that depend on name.
+func (p *PkgResolver) dependentsOf(name string) []*repositoryPackage {
+	p.dependentsOnce.Do(func() {
+		p.dependents = map[string][]*repositoryPackage{}
+		for pkgName, pkgs := range p.nameMap {
+			for _, pkg := range pkgs {
+				// packages are in nameMap under what they provide as well, only count them once
+				if pkg.Name != pkgName {
+					continue
+				}
+				for _, dep := range pkg.Dependencies {
+					if strings.HasPrefix(dep, "!") {
+						continue
+					}
+					depName := p.resolvePackageNameVersionPin(dep).name
+					p.dependents[depName] = append(p.dependents[depName], pkg)
+				}
+			}
+		}
+	})
+	return p.dependents[name]
+}
+
+// satisfiable reports whether any package that is not disqualified satisfies constraint,
+// whatever the repository it is in.
+func (p *PkgResolver) satisfiable(constraint parsedConstraint, dq map[*RepositoryPackage]string) bool {
+	var required packageVersion
+	if constraint.dep != versionAny {
+		var err error
+		if required, err = p.parseVersion(constraint.version); err != nil {
+			// can't tell, leave it to resolving to report
+			return true
+		}
+	}
+	for _, pkg := range p.nameMap[constraint.name] {
+		if _, dqed := dq[pkg.RepositoryPackage]; dqed {
+			continue
+		}
+		if _, violates := p.violations[pkg.RepositoryPackage]; violates {
+			continue
+		}
+		if constraint.dep == versionAny {
+			return true
+		}
+		for _, version := range []string{pkg.Version, p.getDepVersionForName(pkg, constraint.name)} {
+			if actual, err := p.parseVersion(version); err == nil && constraint.dep.Satisfies(actual, required) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // constrain looks through a list of constraints and disqualifies anything that would
@@ -368,12 +1169,12 @@ func (p *PkgResolver) constrain(constraints []string, dq map[*RepositoryPackage]
 				actualVersion, err := p.parseVersion(provider.Version)
 				// skip invalid ones
 				if err != nil {
-					p.disqualify(dq, provider.RepositoryPackage, fmt.Sprintf("parsing version %q failed: %v", provider.Version, err))
+					p.disqualify(dq, provider.RepositoryPackage, ReasonVersionUnsatisfied, fmt.Sprintf("parsing version %q failed: %v", provider.Version, err))
 					continue
 				}
 
-				if !parsed.dep.satisfies(actualVersion, requiredVersion) {
-					p.disqualify(dq, provider.RepositoryPackage, fmt.Sprintf("%q does not satisfy %q", provider.Version, constraint))
+				if !parsed.dep.Satisfies(actualVersion, requiredVersion) {
+					p.disqualify(dq, provider.RepositoryPackage, ReasonVersionUnsatisfied, fmt.Sprintf("%q does not satisfy %q", provider.Version, constraint))
 				}
 			} else {
 				for _, provides := range provider.Provides {
@@ -384,11 +1185,11 @@ func (p *PkgResolver) constrain(constraints []string, dq map[*RepositoryPackage]
 					actualVersion, err := p.parseVersion(pp.version)
 					// skip invalid ones
 					if err != nil {
-						dq[provider.RepositoryPackage] = fmt.Sprintf("parsing %q: %v", pp.version, err)
+						p.disqualify(dq, provider.RepositoryPackage, ReasonVersionUnsatisfied, fmt.Sprintf("parsing %q: %v", pp.version, err))
 						continue
 					}
-					if !parsed.dep.satisfies(actualVersion, requiredVersion) {
-						dq[provider.RepositoryPackage] = fmt.Sprintf("%q provides %q which does not satisfy %q", provider.Filename(), provides, constraint)
+					if !parsed.dep.Satisfies(actualVersion, requiredVersion) {
+						p.disqualify(dq, provider.RepositoryPackage, ReasonVersionUnsatisfied, fmt.Sprintf("%q provides %q which does not satisfy %q", provider.Filename(), provides, constraint))
 					}
 				}
 			}
@@ -401,9 +1202,24 @@ func (p *PkgResolver) constrain(constraints []string, dq map[*RepositoryPackage]
 // GetPackagesWithDependencies get all of the dependencies for the given packages based on the
 // indexes. Does not filter for installed already or not.
 func (p *PkgResolver) GetPackagesWithDependencies(ctx context.Context, packages []string) (toInstall []*RepositoryPackage, conflicts []string, err error) {
-	_, span := otel.Tracer("go-apk").Start(ctx, "GetPackageWithDependencies")
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "GetPackageWithDependencies")
 	defer span.End()
 
+	// record how ties were broken, to explain the result
+	span.SetAttributes(attribute.String("tie-break", p.tieBreak.String()))
+	clog.FromContext(ctx).Debugf("breaking ties between repositories by %s", p.tieBreak)
+
+	if p.solveTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.solveTimeout)
+		defer cancel()
+	}
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = newSolveCanceledError(toInstall, err)
+		}
+	}()
+
 	// Tracks all the packages we have disqualified and the reason we disqualified them.
 	dq := map[*RepositoryPackage]string{}
 
@@ -416,18 +1232,21 @@ func (p *PkgResolver) GetPackagesWithDependencies(ctx context.Context, packages
 	)
 
 	if err := p.constrain(constraints, dq); err != nil {
-		return nil, nil, fmt.Errorf("constraining initial packages: %w", err)
+		return nil, nil, p.newResolveError(nil, dependenciesMap, constraints, dq, fmt.Errorf("constraining initial packages: %w", err))
 	}
 
 	for len(constraints) != 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, p.newResolveError(nil, dependenciesMap, constraints, dq, err)
+		}
 		next, err := p.nextPackage(constraints, dq)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, p.newResolveError(nil, dependenciesMap, constraints, dq, err)
 		}
 
 		pkg, err := p.resolvePackage(next, dq)
 		if err != nil {
-			return nil, nil, &ConstraintError{next, err}
+			return nil, nil, p.newResolveError(nil, dependenciesMap, constraints, dq, &ConstraintError{next, err})
 		}
 
 		// do not add it to toInstall, as we want to have it in the correct order with dependencies
@@ -442,10 +1261,10 @@ func (p *PkgResolver) GetPackagesWithDependencies(ctx context.Context, packages
 	}
 
 	// now get the dependencies for each package
-	for _, pkgName := range packages {
-		pkg, deps, confs, err := p.GetPackageWithDependencies(pkgName, dependenciesMap, dq)
+	for i, pkgName := range packages {
+		pkg, deps, confs, err := p.getPackageWithDependencies(ctx, pkgName, dependenciesMap, dq)
 		if err != nil {
-			return toInstall, nil, &ConstraintError{pkgName, err}
+			return toInstall, nil, p.newResolveError(toInstall, dependenciesMap, packages[i:], dq, &ConstraintError{pkgName, err})
 		}
 		for _, dep := range deps {
 			if _, ok := installTracked[dep.Name]; !ok {
@@ -468,6 +1287,12 @@ func (p *PkgResolver) GetPackagesWithDependencies(ctx context.Context, packages
 
 	conflicts = uniqify(conflicts)
 
+	if err := p.checkDuplicates(toInstall); err != nil {
+		return toInstall, conflicts, err
+	}
+	if err := p.checkSizeBudget(packages, toInstall); err != nil {
+		return toInstall, conflicts, err
+	}
 	return toInstall, conflicts, nil
 }
 
@@ -477,6 +1302,10 @@ func (p *PkgResolver) GetPackagesWithDependencies(ctx context.Context, packages
 // options may depend on whether or not one already is installed.
 // Must not modify the existing map directly.
 func (p *PkgResolver) GetPackageWithDependencies(pkgName string, existing map[string]*RepositoryPackage, dq map[*RepositoryPackage]string) (*RepositoryPackage, []*RepositoryPackage, []string, error) {
+	return p.getPackageWithDependencies(context.Background(), pkgName, existing, dq)
+}
+
+func (p *PkgResolver) getPackageWithDependencies(ctx context.Context, pkgName string, existing map[string]*RepositoryPackage, dq map[*RepositoryPackage]string) (*RepositoryPackage, []*RepositoryPackage, []string, error) {
 	parents := make(map[string]bool)
 	localExisting := make(map[string]*RepositoryPackage, len(existing))
 	existingOrigins := map[string]bool{}
@@ -493,7 +1322,7 @@ func (p *PkgResolver) GetPackageWithDependencies(pkgName string, existing map[st
 	}
 
 	pin := p.resolvePackageNameVersionPin(pkgName).pin
-	deps, conflicts, err := p.getPackageDependencies(pkg, pin, true, parents, localExisting, existingOrigins, dq)
+	deps, conflicts, err := p.getPackageDependencies(ctx, pkg, pin, true, parents, localExisting, existingOrigins, dq)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -506,45 +1335,58 @@ func (p *PkgResolver) GetPackageWithDependencies(pkgName string, existing map[st
 			added[dep.Name] = dep
 		}
 	}
+	if p.noInstallIf {
+		return pkg, dependencies, conflicts, nil
+	}
 	// are there any installIf dependencies?
-	for dep, depPkg := range added {
-		depPkgList, ok := p.installIfMap[dep]
-		if !ok {
-			depPkgList, ok = p.installIfMap[fmt.Sprintf("%s=%s", dep, depPkg.Version)]
-		}
-		if !ok {
-			continue
-		}
+	for dep := range added {
 		// this package "dep" can trigger an installIf. It might not be enough, so check it
-		for _, installIfPkg := range depPkgList {
-			var matchCount int
-			for _, subDep := range installIfPkg.InstallIf {
-				// two possibilities: package name, or name=version
-				constraint := p.resolvePackageNameVersionPin(subDep)
-				name, version := constraint.name, constraint.version
-				// precise match of whatever it is, take it and continue
-				if _, ok := added[subDep]; ok {
-					matchCount++
-					continue
-				}
-				// didn't get a precise match, so check if the name and version match
-				if addedPkg, ok := added[name]; ok && addedPkg.Version == version {
-					matchCount++
-					continue
-				}
+		for _, installIfPkg := range p.installIfMap[dep] {
+			if _, violates := p.violations[installIfPkg.RepositoryPackage]; violates {
+				continue
 			}
-			if matchCount == len(installIfPkg.InstallIf) {
-				// all dependencies are met, so add it
-				if _, ok := added[installIfPkg.Name]; !ok {
-					dependencies = append(dependencies, installIfPkg.RepositoryPackage)
-					added[installIfPkg.Name] = installIfPkg.RepositoryPackage
-				}
+			if _, ok := added[installIfPkg.Name]; ok || !p.installIfSatisfied(installIfPkg, added) {
+				continue
 			}
+			// all dependencies are met, so add it
+			dependencies = append(dependencies, installIfPkg.RepositoryPackage)
+			added[installIfPkg.Name] = installIfPkg.RepositoryPackage
 		}
 	}
 	return pkg, dependencies, conflicts, nil
 }
 
+// installIfSatisfied returns whether every install_if constraint of pkg, with its version
+// operator, is satisfied by the packages in added, by name. A negated constraint is
+// satisfied if the package is not added.
+func (p *PkgResolver) installIfSatisfied(pkg *repositoryPackage, added map[string]*RepositoryPackage) bool {
+	for _, dep := range pkg.InstallIf {
+		constraint := p.resolvePackageNameVersionPin(dep)
+		if name, negated := strings.CutPrefix(constraint.name, "!"); negated {
+			if _, ok := added[name]; ok {
+				return false
+			}
+			continue
+		}
+		addedPkg, ok := added[constraint.name]
+		if !ok {
+			return false
+		}
+		if constraint.dep == versionAny {
+			continue
+		}
+		required, err := p.parseVersion(constraint.version)
+		if err != nil {
+			return false
+		}
+		actual, err := p.parseVersion(addedPkg.Version)
+		if err != nil || !constraint.dep.Satisfies(actual, required) {
+			return false
+		}
+	}
+	return true
+}
+
 // ResolvePackage given a single package name and optional version constraints, resolve to a list of packages
 // that satisfy the constraint. The list will be sorted by version number, with the highest version first
 // and decreasing from there. In general, the first one in the list is the best match. This function
@@ -552,18 +1394,25 @@ func (p *PkgResolver) GetPackageWithDependencies(pkgName string, existing map[st
 func (p *PkgResolver) ResolvePackage(pkgName string, dq map[*RepositoryPackage]string) ([]*RepositoryPackage, error) {
 	constraint := p.resolvePackageNameVersionPin(pkgName)
 	name, version, compare, pin := constraint.name, constraint.version, constraint.dep, constraint.pin
+	if pin != "" && !p.tags[pin] {
+		return nil, fmt.Errorf("no repository is tagged @%s for %s", pin, pkgName)
+	}
 	pkgsWithVersions, ok := p.nameMap[name]
 	if !ok {
-		return nil, fmt.Errorf("could not find package that provides %s in indexes", pkgName)
+		return nil, &NotFoundError{Constraint: pkgName}
 	}
 
 	// pkgsWithVersions contains a map of all versions of the package
 	// get the one that most matches what was requested
-	packages := p.filterPackages(pkgsWithVersions, dq, withVersion(version, compare), withPreferPin(pin))
+	packages := p.filterPackages(pkgsWithVersions, dq, withVersion(version, compare), withPreferPin(pin), withRequirePin(pin))
 	if len(packages) == 0 {
-		return nil, maybedqerror(pkgName, pkgsWithVersions, dq)
+		return nil, p.maybedqerror(pkgName, pkgsWithVersions, dq)
 	}
 	p.sortPackages(packages, nil, name, nil, nil, pin)
+	if chosen := p.chooseProvider(pkgName, packages); chosen > 0 {
+		// the chosen package is the best match
+		packages = slices.Insert(slices.Delete(packages, chosen, chosen+1), 0, packages[chosen])
+	}
 	pkgs := make([]*RepositoryPackage, 0, len(packages))
 	for _, pkg := range packages {
 		if _, dqed := dq[pkg.RepositoryPackage]; dqed {
@@ -579,18 +1428,21 @@ func (p *PkgResolver) resolvePackage(pkgName string, dq map[*RepositoryPackage]s
 	constraint := p.resolvePackageNameVersionPin(pkgName)
 	name, version, compare, pin := constraint.name, constraint.version, constraint.dep, constraint.pin
 
+	if pin != "" && !p.tags[pin] {
+		return nil, fmt.Errorf("no repository is tagged @%s for %s", pin, pkgName)
+	}
 	pkgsWithVersions, ok := p.nameMap[name]
 	if !ok {
-		return nil, fmt.Errorf("could not find package, alias or a package that provides %s in indexes", pkgName)
+		return nil, &NotFoundError{Constraint: pkgName}
 	}
 
 	// pkgsWithVersions contains a map of all versions of the package
 	// get the one that most matches what was requested
-	packages := p.filterPackages(pkgsWithVersions, dq, withVersion(version, compare), withPreferPin(pin))
+	packages := p.filterPackages(pkgsWithVersions, dq, withVersion(version, compare), withPreferPin(pin), withRequirePin(pin))
 	if len(packages) == 0 {
-		return nil, maybedqerror(pkgName, pkgsWithVersions, dq)
+		return nil, p.maybedqerror(pkgName, pkgsWithVersions, dq)
 	}
-	return p.bestPackage(packages, nil, name, nil, nil, pin).RepositoryPackage, nil
+	return p.choosePackage(pkgName, packages, nil, name, nil, nil, pin).RepositoryPackage, nil
 }
 
 // getPackageDependencies get all of the dependencies for a single package based on the
@@ -621,7 +1473,10 @@ func (p *PkgResolver) resolvePackage(pkgName string, dq map[*RepositoryPackage]s
 // It might change the order of install.
 // In other words, this _should_ be a DAG (acyclical), but because the packages
 // are just listing dependencies in text, it might be cyclical. We need to be careful of that.
-func (p *PkgResolver) getPackageDependencies(pkg *RepositoryPackage, allowPin string, allowSelfFulfill bool, parents map[string]bool, existing map[string]*RepositoryPackage, existingOrigins map[string]bool, dq map[*RepositoryPackage]string) (dependencies []*RepositoryPackage, conflicts []string, err error) {
+func (p *PkgResolver) getPackageDependencies(ctx context.Context, pkg *RepositoryPackage, allowPin string, allowSelfFulfill bool, parents map[string]bool, existing map[string]*RepositoryPackage, existingOrigins map[string]bool, dq map[*RepositoryPackage]string) (dependencies []*RepositoryPackage, conflicts []string, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, &DepError{pkg, err}
+	}
 	// check if the package we are checking is one of our parents, avoid cyclical graphs
 	if _, ok := parents[pkg.Name]; ok {
 		return nil, nil, nil
@@ -641,6 +1496,9 @@ func (p *PkgResolver) getPackageDependencies(pkg *RepositoryPackage, allowPin st
 	}
 
 	for len(constraints) != 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, &DepError{pkg, err}
+		}
 		options := map[string][]*repositoryPackage{}
 
 		// each dependency has only one of two possibilities:
@@ -675,7 +1533,7 @@ func (p *PkgResolver) getPackageDependencies(pkg *RepositoryPackage, allowPin st
 				}
 				// we accept invalid versions for ourself, but do not try to use it to fulfill
 				if err1 == nil && err2 == nil {
-					if compare.satisfies(actualVersion, requiredVersion) {
+					if compare.Satisfies(actualVersion, requiredVersion) {
 						// we provide it, so skip looking elsewhere
 						continue
 					}
@@ -685,7 +1543,7 @@ func (p *PkgResolver) getPackageDependencies(pkg *RepositoryPackage, allowPin st
 			// first see if it is a name of a package
 			depPkgWithVersions, ok := p.nameMap[name]
 			if !ok {
-				return nil, nil, fmt.Errorf("could not find package either named %s or that provides %s for %s", dep, dep, pkg.Name)
+				return nil, nil, &NotFoundError{Constraint: dep, Dependent: pkg}
 			}
 			// pkgsWithVersions contains a map of all versions of the package
 			// get the one that most matches what was requested
@@ -696,7 +1554,7 @@ func (p *PkgResolver) getPackageDependencies(pkg *RepositoryPackage, allowPin st
 				withInstalledPackage(existing[name]),
 			)
 			if len(pkgs) == 0 {
-				return nil, nil, &DepError{pkg, maybedqerror(dep, depPkgWithVersions, dq)}
+				return nil, nil, &DepError{pkg, p.maybedqerror(dep, depPkgWithVersions, dq)}
 			}
 			options[dep] = pkgs
 		}
@@ -726,7 +1584,7 @@ func (p *PkgResolver) getPackageDependencies(pkg *RepositoryPackage, allowPin st
 			return s == lowest
 		})
 
-		best := p.bestPackage(pkgs, nil, name, existing, existingOrigins, "")
+		best := p.choosePackage(lowest, pkgs, nil, name, existing, existingOrigins, "")
 		if best == nil {
 			return nil, nil, fmt.Errorf("could not find package for %q", name)
 		}
@@ -742,7 +1600,7 @@ func (p *PkgResolver) getPackageDependencies(pkg *RepositoryPackage, allowPin st
 			childParents[k] = true
 		}
 		childParents[pkg.Name] = true
-		subDeps, confs, err := p.getPackageDependencies(depPkg, allowPin, true, childParents, existing, existingOrigins, dq)
+		subDeps, confs, err := p.getPackageDependencies(ctx, depPkg, allowPin, true, childParents, existing, existingOrigins, dq)
 		if err != nil {
 			return nil, nil, &DepError{pkg, err}
 		}
@@ -759,30 +1617,11 @@ func (p *PkgResolver) getPackageDependencies(pkg *RepositoryPackage, allowPin st
 }
 
 func (p *PkgResolver) parseVersion(version string) (packageVersion, error) {
-	pkg, ok := p.parsedVersions[version]
-	if ok {
-		return pkg, nil
-	}
-
-	parsed, err := parseVersion(version)
-	if err != nil {
-		return parsed, err
-	}
-
-	p.parsedVersions[version] = parsed
-	return parsed, nil
+	return p.versions.parseVersion(version)
 }
 
 func (p *PkgResolver) resolvePackageNameVersionPin(pkgName string) parsedConstraint {
-	cached, ok := p.depForVersion[pkgName]
-	if ok {
-		return cached
-	}
-
-	pin := resolvePackageNameVersionPin(pkgName)
-
-	p.depForVersion[pkgName] = pin
-	return pin
+	return p.versions.resolvePackageNameVersionPin(pkgName)
 }
 
 // sortPackages sorts a slice of packages in descending order of preference, based on
@@ -799,6 +1638,10 @@ func (p *PkgResolver) sortPackages(pkgs []*repositoryPackage, compare *Repositor
 }
 
 func (p *PkgResolver) comparePackages(compare *RepositoryPackage, name string, existing map[string]*RepositoryPackage, existingOrigins map[string]bool, pin string) func(a, b *repositoryPackage) int { //nolint:gocyclo
+	var byClosure func(a, b *repositoryPackage) int
+	if p.providerStrategy == ProviderStrategySmallestClosure {
+		byClosure = p.closureComparer(existing)
+	}
 	return func(a, b *repositoryPackage) int {
 		// determine versions
 		iVersionStr := p.getDepVersionForName(a, name)
@@ -850,6 +1693,16 @@ func (p *PkgResolver) comparePackages(compare *RepositoryPackage, name string, e
 			return 1
 		}
 
+		// the preferred provider of the name, see WithResolverPreferProvider
+		if preferred, ok := p.preferProviders[name]; ok {
+			if a.Name == preferred && b.Name != preferred {
+				return -1
+			}
+			if a.Name != preferred && b.Name == preferred {
+				return 1
+			}
+		}
+
 		if a.pinnedName == pin && b.pinnedName != pin {
 			return -1
 		}
@@ -857,6 +1710,13 @@ func (p *PkgResolver) comparePackages(compare *RepositoryPackage, name string, e
 			return 1
 		}
 
+		// different providers of the name, see ProviderStrategySmallestClosure
+		if byClosure != nil && a.Name != b.Name {
+			if c := byClosure(a, b); c != 0 {
+				return c
+			}
+		}
+
 		// check provider priority
 		if a.ProviderPriority != b.ProviderPriority {
 			if a.ProviderPriority > b.ProviderPriority {
@@ -898,7 +1758,11 @@ func (p *PkgResolver) comparePackages(compare *RepositoryPackage, name string, e
 			}
 		}
 		// if versions are equal, compare names
-		return cmp.Compare(a.Name, b.Name)
+		if c := cmp.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		// the same package in more than one repository
+		return p.breakTie(a, b)
 	}
 }
 
@@ -961,8 +1825,106 @@ func (e *DepError) Error() string {
 	return fmt.Sprintf("resolving %q deps:\n%s", e.Package.Filename(), e.Wrapped.Error())
 }
 
+// SolveCanceledError is returned when resolving is canceled, or takes longer than
+// WithResolverSolveTimeout allows. It has how far resolving got.
+type SolveCanceledError struct {
+	// Trace is the chain of packages whose dependencies were being solved, the requested
+	// package first.
+	Trace []string
+	// Resolved are the packages resolved so far, in install order, empty but not nil if
+	// none were.
+	Resolved []*RepositoryPackage
+	Wrapped  error
+}
+
+func newSolveCanceledError(resolved []*RepositoryPackage, err error) *SolveCanceledError {
+	e := &SolveCanceledError{Resolved: append([]*RepositoryPackage{}, resolved...), Wrapped: err}
+	for {
+		var depErr *DepError
+		if !errors.As(err, &depErr) {
+			break
+		}
+		// DepErrors of the same package wrap each other when its dependencies fail
+		if len(e.Trace) == 0 || e.Trace[len(e.Trace)-1] != depErr.Package.Filename() {
+			e.Trace = append(e.Trace, depErr.Package.Filename())
+		}
+		err = depErr.Wrapped
+	}
+	return e
+}
+
+func (e *SolveCanceledError) Unwrap() error {
+	return e.Wrapped
+}
+
+func (e *SolveCanceledError) Error() string {
+	var cause error = e.Wrapped
+	for {
+		next := errors.Unwrap(cause)
+		if next == nil {
+			break
+		}
+		cause = next
+	}
+	if len(e.Trace) == 0 {
+		return fmt.Sprintf("resolving stopped after %d packages: %v", len(e.Resolved), cause)
+	}
+	return fmt.Sprintf("resolving stopped after %d packages, while solving %s: %v", len(e.Resolved), strings.Join(e.Trace, " -> "), cause)
+}
+
+// ResolveError is returned when GetPackagesWithDependencies fails, with the state of the
+// resolver when it did, so that callers can explain the failure or fall back on their own.
+// It wraps the error that made resolving fail.
+type ResolveError struct {
+	// Resolved are the packages resolved so far: the requested packages whose dependencies
+	// were solved, with their dependencies, in install order, then the packages chosen for
+	// the other requested packages, if any were. It is empty but not nil if none were.
+	Resolved []*RepositoryPackage
+	// Unsolved are the constraints that were left to solve, including the one that failed.
+	Unsolved []string
+	// Disqualified are the packages that were ruled out, with why, including the packages
+	// that a policy does not allow.
+	Disqualified map[*RepositoryPackage]string
+	Wrapped      error
+}
+
+func (p *PkgResolver) newResolveError(toInstall []*RepositoryPackage, chosen map[string]*RepositoryPackage, unsolved []string, dq map[*RepositoryPackage]string, err error) *ResolveError {
+	e := &ResolveError{
+		Resolved:     append([]*RepositoryPackage{}, toInstall...),
+		Unsolved:     slices.Clone(unsolved),
+		Disqualified: make(map[*RepositoryPackage]string, len(dq)+len(p.violations)),
+		Wrapped:      err,
+	}
+	for _, pkg := range chosen {
+		if !slices.Contains(e.Resolved, pkg) {
+			e.Resolved = append(e.Resolved, pkg)
+		}
+	}
+	slices.SortStableFunc(e.Resolved[len(toInstall):], func(a, b *RepositoryPackage) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	for pkg, violation := range p.violations {
+		e.Disqualified[pkg] = violation.Error()
+	}
+	for pkg, reason := range dq {
+		e.Disqualified[pkg] = reason
+	}
+	return e
+}
+
+func (e *ResolveError) Unwrap() error {
+	return e.Wrapped
+}
+
+func (e *ResolveError) Error() string {
+	return e.Wrapped.Error()
+}
+
 type DisqualifiedError struct {
 	Package *RepositoryPackage
+	// Reason is why the package was disqualified. For a package that was disqualified
+	// because something it depends on was, it is the reason of the root cause.
+	Reason  Reason
 	Wrapped error
 }
 
@@ -974,12 +1936,16 @@ func (e *DisqualifiedError) Unwrap() error {
 	return e.Wrapped
 }
 
-func maybedqerror(pkgName string, pkgs []*repositoryPackage, dq map[*RepositoryPackage]string) error {
+func (p *PkgResolver) maybedqerror(pkgName string, pkgs []*repositoryPackage, dq map[*RepositoryPackage]string) error {
 	errs := make([]error, 0, len(pkgs))
 	for _, pkg := range pkgs {
+		if v, ok := p.violations[pkg.RepositoryPackage]; ok {
+			errs = append(errs, &DisqualifiedError{Package: pkg.RepositoryPackage, Reason: v.reason(), Wrapped: v})
+			continue
+		}
 		reason, ok := dq[pkg.RepositoryPackage]
 		if ok {
-			errs = append(errs, &DisqualifiedError{pkg.RepositoryPackage, errors.New(reason)})
+			errs = append(errs, &DisqualifiedError{Package: pkg.RepositoryPackage, Reason: p.reasonFor(reason), Wrapped: errors.New(reason)})
 		}
 	}
 
@@ -987,5 +1953,5 @@ func maybedqerror(pkgName string, pkgs []*repositoryPackage, dq map[*RepositoryP
 		return errors.Join(errs...)
 	}
 
-	return fmt.Errorf("could not find package %q in indexes", pkgName)
+	return &UnsatisfiedError{Constraint: pkgName}
 }
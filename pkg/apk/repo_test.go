@@ -16,7 +16,13 @@ package apk
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"net/http"
 	"net/url"
@@ -26,12 +32,14 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"golang.org/x/exp/maps"
 	"golang.org/x/sync/errgroup"
 
 	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
 )
 
 var (
@@ -536,7 +544,7 @@ func TestGetPackageDependencies(t *testing.T) {
 		}
 		for _, tt := range tests {
 			t.Run(tt.name, func(t *testing.T) {
-				deps, _, err := resolver.getPackageDependencies(pkg6[0], "", tt.allow, nil, nil, nil, map[*RepositoryPackage]string{})
+				deps, _, err := resolver.getPackageDependencies(context.Background(), pkg6[0], "", tt.allow, nil, nil, nil, map[*RepositoryPackage]string{})
 				require.NoErrorf(t, err, "unable to get dependencies")
 
 				actual := make([]string, 0, len(deps))
@@ -638,6 +646,51 @@ func TestResolvePackage(t *testing.T) {
 	})
 }
 
+func TestTaggedRepositories(t *testing.T) {
+	ctx := context.Background()
+	main := &RepositoryWithIndex{Repository: &Repository{URI: "main"}, index: &APKIndex{Packages: []*Package{
+		{Name: "foo", Version: "1.0.0"},
+		{Name: "bar", Version: "1.0.0"},
+		{Name: "dep", Version: "1.0.0"},
+	}}}
+	tagged := &RepositoryWithIndex{Repository: &Repository{URI: "testing"}, index: &APKIndex{Packages: []*Package{
+		{Name: "foo", Version: "2.0.0", Dependencies: []string{"dep"}},
+		{Name: "baz", Version: "2.0.0"},
+	}}}
+	resolver := NewPkgResolver(ctx, []NamedIndex{
+		NewNamedRepositoryWithIndex("", main),
+		NewNamedRepositoryWithIndex("testing", tagged),
+	})
+	dq := map[*RepositoryPackage]string{}
+
+	// Untagged requests never see the tagged repository.
+	pkgs, err := resolver.ResolvePackage("foo", dq)
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+	require.Equal(t, "1.0.0", pkgs[0].Version)
+	_, err = resolver.ResolvePackage("baz", dq)
+	require.Error(t, err)
+
+	// Tagged requests only resolve from the tagged repository, but their dependencies
+	// may come from untagged ones.
+	pkgs, err = resolver.ResolvePackage("foo@testing", dq)
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+	require.Equal(t, "2.0.0", pkgs[0].Version)
+	_, err = resolver.ResolvePackage("bar@testing", dq)
+	require.Error(t, err)
+	_, err = resolver.ResolvePackage("foo@unknown", dq)
+	require.ErrorContains(t, err, "no repository is tagged @unknown")
+
+	toInstall, _, err := resolver.GetPackagesWithDependencies(ctx, []string{"foo@testing"})
+	require.NoError(t, err)
+	var names []string
+	for _, pkg := range toInstall {
+		names = append(names, pkg.Name+"-"+pkg.Version+"@"+pkg.Repository().URI)
+	}
+	require.ElementsMatch(t, []string{"dep-1.0.0@main", "foo-2.0.0@testing"}, names)
+}
+
 // Make sure that all versions exist
 func TestVersionHierarchy(t *testing.T) {
 	repo := Repository{}
@@ -904,3 +957,480 @@ func makeResolver(provs, deps map[string][]string) *PkgResolver {
 	})
 	return NewPkgResolver(context.Background(), testNamedRepositoryFromIndexes([]*RepositoryWithIndex{repoWithIndex}))
 }
+
+func TestTieBreak(t *testing.T) {
+	ctx := context.Background()
+	var indexes []NamedIndex
+	for _, uri := range []string{"https://b.example.com", "https://c.example.com", "https://a.example.com"} {
+		repo := &RepositoryWithIndex{Repository: &Repository{URI: uri}, index: &APKIndex{Packages: []*Package{
+			{Name: "foo", Version: "1.0.0"},
+		}}}
+		indexes = append(indexes, NewNamedRepositoryWithIndex("", repo))
+	}
+	for _, tt := range []struct {
+		name    string
+		options []ResolverOption
+		want    string
+	}{
+		{"default", nil, "https://b.example.com"},
+		{"repository order", []ResolverOption{WithResolverTieBreak(TieBreakRepositoryOrder)}, "https://b.example.com"},
+		{"alphabetical", []ResolverOption{WithResolverTieBreak(TieBreakAlphabetical)}, "https://a.example.com"},
+		{"priority", []ResolverOption{WithResolverRepositoryPriorities(map[string]int{"https://c.example.com": 10})}, "https://c.example.com"},
+		{"equal priorities", []ResolverOption{WithResolverRepositoryPriorities(map[string]int{"https://c.example.com": 10, "https://a.example.com": 10})}, "https://c.example.com"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := NewPkgResolver(ctx, indexes, tt.options...)
+			pkgs, _, err := resolver.GetPackagesWithDependencies(ctx, []string{"foo"})
+			require.NoError(t, err)
+			require.Len(t, pkgs, 1)
+			require.Equal(t, tt.want, pkgs[0].Repository().URI)
+
+			all, err := resolver.ResolvePackage("foo", map[*RepositoryPackage]string{})
+			require.NoError(t, err)
+			require.Equal(t, tt.want, all[0].Repository().URI)
+		})
+	}
+}
+
+func TestProviders(t *testing.T) {
+	repo := Repository{URI: "main"}
+	index := repo.WithIndex(&APKIndex{Packages: []*Package{
+		{Name: "libssl3", Version: "3.1.4-r0", Provides: []string{"so:libssl.so.3=3"}},
+		{Name: "libssl3", Version: "3.0.12-r0", Provides: []string{"so:libssl.so.3=3"}},
+		{Name: "libressl", Version: "3.8.2-r0", Provides: []string{"so:libssl.so.3=2"}, ProviderPriority: 10},
+		{Name: "python-3.12", Version: "3.12.0-r0", Provides: []string{"cmd:python3"}},
+	}})
+	resolver := NewPkgResolver(context.Background(), testNamedRepositoryFromIndexes([]*RepositoryWithIndex{index}))
+
+	var got []string
+	for _, p := range resolver.Providers("so:libssl.so.3") {
+		got = append(got, fmt.Sprintf("%s %s %d", p.Package.Filename(), p.Version, p.Priority))
+	}
+	require.Equal(t, []string{
+		"libressl-3.8.2-r0.apk 2 10",
+		"libssl3-3.1.4-r0.apk 3 0",
+		"libssl3-3.0.12-r0.apk 3 0",
+	}, got)
+
+	providers := resolver.Providers("so:libssl.so.3>2")
+	require.Len(t, providers, 2)
+	require.Equal(t, "libssl3", providers[0].Package.Name)
+
+	providers = resolver.Providers("cmd:python3")
+	require.Len(t, providers, 1)
+	require.Equal(t, "3.12.0-r0", providers[0].Version)
+
+	require.Empty(t, resolver.Providers("cmd:missing"))
+}
+
+func TestProviderChooser(t *testing.T) {
+	ctx := context.Background()
+	repo := Repository{URI: "main"}
+	index := repo.WithIndex(&APKIndex{Packages: []*Package{
+		{Name: "app", Version: "1.0-r0", Dependencies: []string{"cmd:ls"}},
+		{Name: "coreutils", Version: "9.4-r0", Provides: []string{"cmd:ls=9.4-r0"}, ProviderPriority: 100},
+		{Name: "busybox", Version: "1.36.1-r0", Provides: []string{"cmd:ls=1.36.1-r0"}, ProviderPriority: 50},
+		{Name: "busybox", Version: "1.36.0-r0", Provides: []string{"cmd:ls=1.36.0-r0"}, ProviderPriority: 50},
+	}})
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{index})
+
+	pkgs, _, err := NewPkgResolver(ctx, indexes).GetPackagesWithDependencies(ctx, []string{"app"})
+	require.NoError(t, err)
+	require.Equal(t, "coreutils", pkgs[0].Name)
+
+	var calls []string
+	chooser := func(constraint string, candidates []*RepositoryPackage) *RepositoryPackage {
+		var names []string
+		for _, c := range candidates {
+			names = append(names, c.Filename())
+		}
+		calls = append(calls, constraint+": "+strings.Join(names, " "))
+		for _, c := range candidates {
+			if c.Name == "busybox" {
+				return c
+			}
+		}
+		return nil
+	}
+	resolver := NewPkgResolver(ctx, indexes, WithResolverProviderChooser(chooser))
+	pkgs, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"app"})
+	require.NoError(t, err)
+	require.Equal(t, "busybox-1.36.1-r0.apk", pkgs[0].Filename())
+	require.Equal(t, []string{"cmd:ls: coreutils-9.4-r0.apk busybox-1.36.1-r0.apk busybox-1.36.0-r0.apk"}, calls)
+
+	resolved, err := resolver.ResolvePackage("cmd:ls", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"busybox", "coreutils", "busybox"}, []string{resolved[0].Name, resolved[1].Name, resolved[2].Name})
+
+	// leaving the choice to the resolver
+	resolver = NewPkgResolver(ctx, indexes, WithResolverProviderChooser(func(string, []*RepositoryPackage) *RepositoryPackage {
+		return &RepositoryPackage{Package: &Package{Name: "other"}}
+	}))
+	pkg, err := resolver.resolvePackage("cmd:ls", nil)
+	require.NoError(t, err)
+	require.Equal(t, "coreutils", pkg.Name)
+}
+
+func TestPreferProvider(t *testing.T) {
+	ctx := context.Background()
+	repo := Repository{URI: "main"}
+	index := repo.WithIndex(&APKIndex{Packages: []*Package{
+		{Name: "app", Version: "1.0-r0", Dependencies: []string{"so:libcrypto.so.3"}},
+		{Name: "libressl", Version: "3.8.2-r0", Provides: []string{"so:libcrypto.so.3=3"}},
+		{Name: "openssl", Version: "3.1.4-r0", Provides: []string{"so:libcrypto.so.3=3"}},
+		{Name: "boringssl", Version: "1.0-r0", Provides: []string{"so:libcrypto.so.3=3"}, ProviderPriority: 10},
+	}})
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{index})
+
+	pkgs, _, err := NewPkgResolver(ctx, indexes).GetPackagesWithDependencies(ctx, []string{"app"})
+	require.NoError(t, err)
+	require.Equal(t, "boringssl", pkgs[0].Name)
+
+	resolver := NewPkgResolver(ctx, indexes, WithResolverPreferProvider(map[string]string{"so:libcrypto.so.3": "openssl"}))
+	pkgs, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"app"})
+	require.NoError(t, err)
+	require.Equal(t, "openssl", pkgs[0].Name)
+
+	// a provider that is installed anyway is kept
+	pkgs, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"libressl", "app"})
+	require.NoError(t, err)
+	require.Len(t, pkgs, 2)
+
+	// a preferred provider that does not provide the name is ignored
+	resolver = NewPkgResolver(ctx, indexes, WithResolverPreferProvider(map[string]string{"so:libcrypto.so.3": "missing"}))
+	pkgs, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"app"})
+	require.NoError(t, err)
+	require.Equal(t, "boringssl", pkgs[0].Name)
+}
+
+func TestResolveError(t *testing.T) {
+	ctx := context.Background()
+	repo := Repository{URI: "main"}
+	index := repo.WithIndex(&APKIndex{Packages: []*Package{
+		{Name: "tool", Version: "1.0-r0", Dependencies: []string{"libc", "!libfoo"}},
+		{Name: "libc", Version: "1.0-r0"},
+		{Name: "app", Version: "1.0-r0", Dependencies: []string{"libfoo"}},
+		{Name: "libfoo", Version: "1.0-r0"},
+		{Name: "other", Version: "1.0-r0"},
+	}})
+	resolver := NewPkgResolver(ctx, testNamedRepositoryFromIndexes([]*RepositoryWithIndex{index}))
+
+	_, _, err := resolver.GetPackagesWithDependencies(ctx, []string{"tool", "app", "other"})
+	var resolveErr *ResolveError
+	require.True(t, errors.As(err, &resolveErr), "expected a ResolveError, got %v", err)
+	var constraintErr *ConstraintError
+	require.True(t, errors.As(err, &constraintErr))
+	require.Equal(t, "app", constraintErr.Constraint)
+	require.Equal(t, err.Error(), resolveErr.Wrapped.Error())
+
+	var resolved []string
+	for _, pkg := range resolveErr.Resolved {
+		resolved = append(resolved, pkg.Name)
+	}
+	require.Equal(t, []string{"libc", "tool", "app", "other"}, resolved)
+	require.Equal(t, []string{"app", "other"}, resolveErr.Unsolved)
+	reasons := map[string]string{}
+	for pkg, reason := range resolveErr.Disqualified {
+		reasons[pkg.Name] = reason
+	}
+	require.Equal(t, map[string]string{
+		"libfoo": "excluded by !libfoo",
+		"app":    `it depends on "libfoo", which nothing satisfies since libfoo-1.0-r0.apk was disqualified because excluded by !libfoo`,
+	}, reasons)
+
+	_, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"other", "missing"})
+	require.True(t, errors.As(err, &resolveErr), "expected a ResolveError, got %v", err)
+	require.NotNil(t, resolveErr.Resolved)
+	require.Empty(t, resolveErr.Resolved)
+	require.Equal(t, []string{"other", "missing"}, resolveErr.Unsolved)
+}
+
+func TestDisqualifyCascade(t *testing.T) {
+	providers := map[string][]string{
+		"libfoo=1.0-r0": nil,
+	}
+	dependers := map[string][]string{
+		"app=1.0-r0": {"mid"},
+		"mid=1.0-r0": {"libfoo"},
+	}
+
+	// the only libfoo is disqualified, so mid and app are too, and the error names the root cause
+	resolver := makeResolver(providers, dependers)
+	_, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"app", "libfoo>=2"})
+	require.Error(t, err)
+	var dqErr *DisqualifiedError
+	require.ErrorAs(t, err, &dqErr)
+	require.Equal(t, "app", dqErr.Package.Name)
+	require.ErrorContains(t, err, `it depends on "mid", which nothing satisfies since mid-1.0-r0.apk was disqualified because it depends on "libfoo"`)
+	require.ErrorContains(t, err, `libfoo-1.0-r0.apk was disqualified because "1.0-r0" does not satisfy "libfoo>=2"`)
+
+	// with another libfoo to fall back on, nothing is disqualified but the old one
+	providers["libfoo=2.0-r0"] = nil
+	resolver = makeResolver(providers, dependers)
+	pkgs, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"app", "libfoo>=2"})
+	require.NoError(t, err)
+	require.Len(t, pkgs, 3)
+}
+
+// stoppingContext is canceled once Err has been called n times.
+type stoppingContext struct {
+	context.Context
+	n int
+}
+
+func (c *stoppingContext) Err() error {
+	if c.n == 0 {
+		return context.Canceled
+	}
+	c.n--
+	return nil
+}
+
+func TestSolveCanceled(t *testing.T) {
+	dependers := map[string][]string{
+		"app=1.0-r0":  {"mid"},
+		"mid=1.0-r0":  {"leaf"},
+		"leaf=1.0-r0": nil,
+	}
+	resolver := makeResolver(nil, dependers)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := resolver.GetPackagesWithDependencies(ctx, []string{"app"})
+	var canceled *SolveCanceledError
+	require.ErrorAs(t, err, &canceled)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Empty(t, canceled.Trace)
+	require.NotNil(t, canceled.Resolved)
+	require.Empty(t, canceled.Resolved)
+
+	// canceled when about to solve the dependencies of mid
+	_, _, err = resolver.GetPackagesWithDependencies(&stoppingContext{Context: context.Background(), n: 3}, []string{"app"})
+	require.ErrorAs(t, err, &canceled)
+	require.Equal(t, []string{"app-1.0-r0.apk", "mid-1.0-r0.apk"}, canceled.Trace)
+	require.EqualError(t, err, "resolving stopped after 0 packages, while solving app-1.0-r0.apk -> mid-1.0-r0.apk: context canceled")
+
+	resolver = makeResolver(nil, dependers)
+	WithResolverSolveTimeout(time.Nanosecond)(resolver)
+	_, _, err = resolver.GetPackagesWithDependencies(context.Background(), []string{"app"})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestNewPkgResolverMergesIndexes(t *testing.T) {
+	first := Repository{URI: "first"}
+	second := Repository{URI: "second"}
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{
+		first.WithIndex(&APKIndex{Packages: []*Package{
+			{Name: "foo-compat", Version: "1.0-r0", Provides: []string{"foo=1.0-r0"}},
+			{Name: "foo", Version: "1.0-r0"},
+		}}),
+		second.WithIndex(&APKIndex{Packages: []*Package{
+			{Name: "foo", Version: "2.0-r0"},
+			{Name: "foo-docs", Version: "2.0-r0", InstallIf: []string{"foo"}},
+		}}),
+	})
+	resolver := NewPkgResolver(context.Background(), indexes, WithResolverExcludes("foo-docs"))
+
+	var got []string
+	for _, pkg := range resolver.nameMap["foo"] {
+		got = append(got, fmt.Sprintf("%s %d", pkg.Filename(), pkg.order))
+	}
+	// packages named foo in index order, then what provides foo
+	require.Equal(t, []string{"foo-1.0-r0.apk 0", "foo-2.0-r0.apk 1", "foo-compat-1.0-r0.apk 0"}, got)
+	require.Len(t, resolver.installIfMap["foo"], 1)
+	require.Len(t, resolver.violations, 1)
+}
+
+func TestPkgResolverInstallIf(t *testing.T) {
+	repo := Repository{URI: "repo"}
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{
+		repo.WithIndex(&APKIndex{Packages: []*Package{
+			{Name: "foo", Version: "2.0-r0"},
+			{Name: "bar", Version: "1.0-r0"},
+			{Name: "app", Version: "1.0-r0", Dependencies: []string{"foo", "bar"}},
+			{Name: "foo-docs", Version: "2.0-r0", InstallIf: []string{"foo"}},
+			{Name: "foo-new", Version: "2.0-r0", InstallIf: []string{"foo>=2", "bar"}},
+			{Name: "foo-old", Version: "1.0-r0", InstallIf: []string{"foo<2", "bar"}},
+			{Name: "foo-exact", Version: "2.0-r0", InstallIf: []string{"foo=2.0-r0"}},
+			{Name: "foo-nobaz", Version: "2.0-r0", InstallIf: []string{"foo", "!baz"}},
+			{Name: "foo-baz", Version: "2.0-r0", InstallIf: []string{"foo", "baz"}},
+		}}),
+	})
+
+	for _, tt := range []struct {
+		name    string
+		options []ResolverOption
+		want    []string
+	}{
+		{"operators", nil, []string{"app", "bar", "foo", "foo-docs", "foo-exact", "foo-new", "foo-nobaz"}},
+		{"disabled", []ResolverOption{WithResolverInstallIf(false)}, []string{"app", "bar", "foo"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := NewPkgResolver(context.Background(), indexes, tt.options...)
+			pkgs, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"app"})
+			require.NoError(t, err)
+			var got []string
+			for _, pkg := range pkgs {
+				got = append(got, pkg.Name)
+			}
+			sort.Strings(got)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPkgResolverConcurrent(t *testing.T) {
+	_, index := testGetPackagesAndIndex()
+	resolver := NewPkgResolver(context.Background(), testNamedRepositoryFromIndexes(index))
+
+	names := []string{"package1", "package2", "package3", "package9", "locked-dep"}
+	want := map[string][]*RepositoryPackage{}
+	for _, name := range names {
+		_, deps, _, err := resolver.GetPackageWithDependencies(name, nil, map[*RepositoryPackage]string{})
+		require.NoError(t, err)
+		want[name] = deps
+	}
+
+	// run with -race to check that resolving shares nothing unsafely
+	var g errgroup.Group
+	for i := 0; i < 4; i++ {
+		for _, name := range names {
+			name := name
+			g.Go(func() error {
+				_, deps, _, err := resolver.GetPackageWithDependencies(name, nil, map[*RepositoryPackage]string{})
+				if err != nil {
+					return err
+				}
+				if !reflect.DeepEqual(want[name], deps) {
+					return fmt.Errorf("%s: got %v, want %v", name, deps, want[name])
+				}
+				return nil
+			})
+		}
+		g.Go(func() error {
+			// disqualifies, which walks the dependents of packages
+			_, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"package9", "package5>=2"})
+			return err
+		})
+	}
+	require.NoError(t, g.Wait())
+}
+
+func TestUpdateIndex(t *testing.T) {
+	first := Repository{URI: "first"}
+	second := Repository{URI: "second"}
+	firstIndex := first.WithIndex(&APKIndex{Packages: []*Package{
+		{Name: "foo", Version: "1.0-r0"},
+		{Name: "foo-compat", Version: "1.0-r0", Provides: []string{"foo=1.0-r0"}},
+	}})
+	oldIndex := second.WithIndex(&APKIndex{Packages: []*Package{
+		{Name: "foo", Version: "2.0-r0"},
+		{Name: "old", Version: "1.0-r0", InstallIf: []string{"foo"}},
+	}})
+	newIndex := second.WithIndex(&APKIndex{Packages: []*Package{
+		{Name: "foo", Version: "2.1-r0"},
+		{Name: "foo-shim", Version: "2.1-r0", Provides: []string{"foo=2.1-r0"}},
+	}})
+	source := NewNamedRepositoryWithIndex("", oldIndex).Source()
+
+	resolver := NewPkgResolver(context.Background(), testNamedRepositoryFromIndexes([]*RepositoryWithIndex{firstIndex, oldIndex}))
+	require.NoError(t, resolver.UpdateIndex(source, NewNamedRepositoryWithIndex("", newIndex)))
+	require.Error(t, resolver.UpdateIndex("missing", NewNamedRepositoryWithIndex("", newIndex)))
+
+	// the same as a resolver of the new indexes
+	fresh := NewPkgResolver(context.Background(), testNamedRepositoryFromIndexes([]*RepositoryWithIndex{firstIndex, newIndex}))
+	filenames := func(pkgs []*repositoryPackage) (names []string) {
+		for _, pkg := range pkgs {
+			names = append(names, fmt.Sprintf("%s %d", pkg.Filename(), pkg.order))
+		}
+		return names
+	}
+	require.Len(t, resolver.nameMap, len(fresh.nameMap))
+	for name, pkgs := range fresh.nameMap {
+		require.Equal(t, filenames(pkgs), filenames(resolver.nameMap[name]), name)
+	}
+	require.Empty(t, resolver.installIfMap)
+	require.NotContains(t, resolver.nameMap, "old")
+
+	pkgs, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"foo"})
+	require.NoError(t, err)
+	require.Equal(t, "2.1-r0", pkgs[0].Version)
+}
+
+func TestRepositoryDropIns(t *testing.T) {
+	ctx := context.Background()
+
+	// a signing key, and two local repositories signed with it
+	tmp := t.TempDir()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	signingKey := filepath.Join(tmp, "test.rsa")
+	require.NoError(t, os.WriteFile(signingKey, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600))
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	pubKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	repo := func(name string) string {
+		dir := filepath.Join(tmp, name)
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "x86_64"), 0o755))
+		archive, err := ArchiveFromIndex(&APKIndex{Packages: []*Package{{Name: name, Version: "1.0-r0", Arch: "x86_64"}}})
+		require.NoError(t, err)
+		b, err := io.ReadAll(archive)
+		require.NoError(t, err)
+		indexFile := filepath.Join(dir, "x86_64", indexFilename)
+		require.NoError(t, os.WriteFile(indexFile, b, 0o644))
+		require.NoError(t, sign.SignIndex(ctx, signingKey, indexFile))
+		return dir
+	}
+	main, extra, other := repo("main"), repo("extra"), repo("other")
+
+	src := apkfs.NewMemFS()
+	a, err := New(WithFS(src), WithArch("x86_64"))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+	require.NoError(t, a.SetRepositories(ctx, []string{main}))
+	require.NoError(t, src.MkdirAll(reposDirPath, 0o755))
+	require.NoError(t, src.WriteFile(filepath.Join(reposDirPath, "b.list"), []byte("# other\n"+other+"\n"), 0o644))
+	require.NoError(t, src.WriteFile(filepath.Join(reposDirPath, "a.list"), []byte(extra+"\n"+main+"\n"), 0o644))
+	require.NoError(t, src.WriteFile(filepath.Join(reposDirPath, "ignored"), []byte("https://example.com\n"), 0o644))
+
+	repos, err := a.GetRepositories()
+	require.NoError(t, err)
+	require.Equal(t, []string{main, extra, other}, repos)
+
+	// The key of b.list only verifies its repositories.
+	globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+	require.NoError(t, src.MkdirAll(filepath.Join(keysDropInDirPath, "b"), 0o755))
+	require.NoError(t, src.WriteFile(filepath.Join(keysDropInDirPath, "b", "test.rsa.pub"), pubKey, 0o644))
+	_, err = a.GetRepositoryIndexes(ctx, false)
+	require.Error(t, err)
+	require.NoError(t, src.WriteFile(filepath.Join(reposDirPath, "a.list"), nil, 0o644))
+	require.NoError(t, src.WriteFile(reposFilePath, nil, 0o644))
+	globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+	indexes, err := a.GetRepositoryIndexes(ctx, false)
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+	require.Equal(t, "other", indexes[0].Packages()[0].Name)
+
+	// Keys in keys.d verify every repository.
+	globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+	require.NoError(t, src.WriteFile(filepath.Join(keysDropInDirPath, "test.rsa.pub"), pubKey, 0o644))
+	require.NoError(t, src.WriteFile(filepath.Join(reposDirPath, "a.list"), []byte(extra+"\n"+main+"\n"), 0o644))
+	indexes, err = a.GetRepositoryIndexes(ctx, false)
+	require.NoError(t, err)
+	var names []string
+	for _, index := range indexes {
+		names = append(names, index.Packages()[0].Name)
+	}
+	require.Equal(t, []string{"extra", "main", "other"}, names)
+
+	// So do they for packages, while the key hints only verify those of their list.
+	require.NoError(t, src.WriteFile(filepath.Join(keysDropInDirPath, "b", "hint.rsa.pub"), pubKey, 0o644))
+	keysFor, err := a.packageKeys(nil)
+	require.NoError(t, err)
+	pkg := func(repo string) InstallablePackage {
+		return NewRepositoryPackage(&Package{Name: "pkg", Version: "1.0-r0"}, (&Repository{URI: repo + "/x86_64"}).WithIndex(&APKIndex{}))
+	}
+	require.Equal(t, []string{"test.rsa.pub"}, maps.Keys(keysFor(pkg(main))))
+	require.ElementsMatch(t, []string{"hint.rsa.pub", "test.rsa.pub"}, maps.Keys(keysFor(pkg(other))))
+}
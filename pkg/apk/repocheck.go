@@ -0,0 +1,229 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"golang.org/x/sync/errgroup"
+)
+
+// RepositoryCheck is the result of checking a repository with CheckRepositories.
+type RepositoryCheck struct {
+	// Repository is the line of the repository, as returned by GetRepositories.
+	Repository string
+	// IndexURL is the URL of the index of the repository that was reached, or of the first
+	// one tried if none was, without credentials.
+	IndexURL string
+	// Keys are the names of the keys that may verify the index.
+	Keys []string
+	// Problems are what would make fetching the index fail. It is empty if the repository
+	// is usable.
+	Problems []string
+}
+
+// OK returns true if the check found no problems with the repository.
+func (c RepositoryCheck) OK() bool {
+	return len(c.Problems) == 0
+}
+
+// CheckRepositories checks the repositories of the root before they are used, so that a
+// misconfiguration is reported up front rather than partway into a long build: the URLs
+// of every repository must be valid, its index must be reachable, with a HEAD request for
+// remote ones, from its URL or one of its mirrors, and there must be keys to verify it.
+// Offline, the index must be in the cache instead.
+//
+// It returns a check for every enabled repository, in the order of GetRepositories. The
+// error is only for failing to run the checks, e.g. if there are no repositories.
+func (a *APK) CheckRepositories(ctx context.Context) ([]RepositoryCheck, error) {
+	ctx = a.logContext(ctx)
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "CheckRepositories")
+	defer span.End()
+
+	arch, err := a.rootArch()
+	if err != nil {
+		return nil, err
+	}
+	lists, err := a.repositoryLists()
+	if err != nil {
+		return nil, err
+	}
+	keys, hintedKeys, err := a.repositoryKeys(lists)
+	if err != nil {
+		return nil, err
+	}
+	unsigned := a.unsignedRepositories(lists)
+
+	client := a.client
+	if client == nil {
+		client = a.httpConfig.client()
+	}
+	parallelism := a.indexParallelism
+	if parallelism <= 0 {
+		parallelism = defaultIndexParallelism
+	}
+
+	var checks []*RepositoryCheck
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(parallelism)
+	for _, list := range lists {
+		listKeys, ok := hintedKeys[list.name]
+		if !ok {
+			listKeys = keys
+		}
+		for _, repo := range list.repos {
+			if repo.Disabled {
+				continue
+			}
+			repo := repo
+			check := &RepositoryCheck{Repository: repo.Line()}
+			checks = append(checks, check)
+
+			discovered, err := a.discoveredKeys(repo.URL)
+			if err != nil {
+				return nil, err
+			}
+			repoKeys := mergeKeys(listKeys, discovered)
+
+			for _, name := range repo.Keys {
+				if _, ok := repoKeys[name]; !ok {
+					check.Problems = append(check.Problems, fmt.Sprintf("key %s is not installed", name))
+				}
+			}
+			for name := range keysFor(repo, repoKeys) {
+				check.Keys = append(check.Keys, name)
+			}
+			sort.Strings(check.Keys)
+			if len(check.Keys) == 0 && !a.ignoreSignatures && !unsigned(repo.URL) {
+				check.Problems = append(check.Problems, "no keys to verify the index")
+			}
+
+			repoArch := arch
+			if repo.Arch != "" {
+				repoArch = repo.Arch
+			}
+			g.Go(func() error {
+				a.checkRepositoryIndex(gctx, client, repo, repoArch, check)
+				return nil
+			})
+		}
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	results := make([]RepositoryCheck, 0, len(checks))
+	for _, check := range checks {
+		if !check.OK() {
+			a.log(ctx).Warnf("repository %s: %s", check.Repository, strings.Join(check.Problems, "; "))
+		}
+		results = append(results, *check)
+	}
+	return results, nil
+}
+
+// checkRepositoryIndex checks that the index of repo for arch can be reached from its URL
+// or one of its mirrors, and records what it found in check.
+func (a *APK) checkRepositoryIndex(ctx context.Context, client *http.Client, repo RepositoryConfig, arch string, check *RepositoryCheck) {
+	var problems []string
+	for i, repoURL := range append([]string{repo.URL}, repo.Mirrors...) {
+		indexURL, err := repositoryIndexURL(repoURL, arch, a.remoteSchemes())
+		if err == nil {
+			err = a.probeIndex(ctx, client, repoURL, arch)
+		}
+		if i == 0 || err == nil {
+			check.IndexURL = indexURL
+		}
+		if err == nil {
+			return
+		}
+		problems = append(problems, err.Error())
+	}
+	check.Problems = append(check.Problems, problems...)
+}
+
+// repositoryIndexURL returns the URL of the index of the repository at repoURL for arch,
+// without credentials, or an error if repoURL is not a valid repository URL: https, of one
+// of schemes, or an absolute path.
+func repositoryIndexURL(repoURL, arch string, schemes []string) (string, error) {
+	indexURL := IndexURL(repoURL, arch)
+	if strings.HasPrefix(repoURL, "/") {
+		return indexURL, nil
+	}
+	u, err := url.Parse(indexURL)
+	if err != nil {
+		return repoURL, fmt.Errorf("invalid repository URL: %w", err)
+	}
+	switch {
+	case !isRemote(u.String(), schemes):
+		return u.Redacted(), fmt.Errorf("unsupported repository URL %s: must be https or an absolute path", u.Redacted())
+	case u.Host == "":
+		return u.Redacted(), fmt.Errorf("invalid repository URL %s: no host", u.Redacted())
+	}
+	return u.Redacted(), nil
+}
+
+// probeIndex checks that the index of the repository at repoURL for arch exists, without
+// fetching it.
+func (a *APK) probeIndex(ctx context.Context, client *http.Client, repoURL, arch string) error {
+	indexURL := IndexURL(repoURL, arch)
+	if strings.HasPrefix(repoURL, "/") {
+		if _, err := os.Stat(indexURL); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("index not found for architecture %s at %s", arch, indexURL)
+			}
+			return err
+		}
+		return nil
+	}
+	if a.offline {
+		return a.checkOfflineIndexes([]string{repoURL}, arch)
+	}
+
+	u, err := url.Parse(indexURL)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		req.SetBasicAuth(u.User.Username(), pass)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to reach %s: %w", u.Redacted(), err)
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("index not found for architecture %s at %s", arch, u.Redacted())
+	default:
+		return fmt.Errorf("unexpected status code %d for %s", res.StatusCode, u.Redacted())
+	}
+}
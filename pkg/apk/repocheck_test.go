@@ -0,0 +1,78 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestCheckRepositories(t *testing.T) {
+	ctx := context.Background()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || r.URL.Path != "/main/x86_64/APKINDEX.tar.gz" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	local := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(local, "x86_64"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(local, "x86_64", indexFilename), nil, 0o644))
+
+	src := apkfs.NewMemFS()
+	a, err := New(WithFS(src), WithArch("x86_64"))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+	a.SetClient(srv.Client())
+	require.NoError(t, src.WriteFile(filepath.Join(keysDirPath, "test.rsa.pub"), []byte("key"), 0o644))
+	require.NoError(t, a.SetRepositoryConfigs(ctx, []RepositoryConfig{
+		{URL: srv.URL + "/main"},
+		{URL: srv.URL + "/gone", Mirrors: []string{local}},
+		{URL: srv.URL + "/missing"},
+		{URL: "http://example.com/insecure"},
+		{URL: local, Keys: []string{"other.rsa.pub"}},
+	}))
+
+	checks, err := a.CheckRepositories(ctx)
+	require.NoError(t, err)
+	require.Len(t, checks, 5)
+
+	require.True(t, checks[0].OK(), checks[0].Problems)
+	require.Equal(t, srv.URL+"/main/x86_64/APKINDEX.tar.gz", checks[0].IndexURL)
+	require.Equal(t, []string{"test.rsa.pub"}, checks[0].Keys)
+
+	// reached from the mirror
+	require.True(t, checks[1].OK(), checks[1].Problems)
+	require.Equal(t, filepath.Join(local, "x86_64", indexFilename), checks[1].IndexURL)
+
+	require.False(t, checks[2].OK())
+	require.Contains(t, checks[2].Problems[0], "index not found for architecture x86_64")
+
+	require.False(t, checks[3].OK())
+	require.Contains(t, checks[3].Problems[0], "unsupported repository URL")
+
+	require.Equal(t, []string{"key other.rsa.pub is not installed", "no keys to verify the index"}, checks[4].Problems)
+	require.Empty(t, checks[4].Keys)
+}
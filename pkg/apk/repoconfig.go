@@ -0,0 +1,262 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+)
+
+// repositorySettingsPrefix starts the comment line with the settings of the repository on
+// the next line. apk-tools skips it like any other comment.
+const repositorySettingsPrefix = "#go-apk:"
+
+// RepositoryConfig is a repository of /etc/apk/repositories with its settings, see
+// ParseRepositories and FormatRepositories.
+type RepositoryConfig struct {
+	// URL is the base URL of the repository, without the arch.
+	URL string
+	// Tag pins the repository, see TaggedRepository. Empty for untagged repositories.
+	Tag string
+	// Disabled repositories are kept in the file, commented out, but not used.
+	Disabled bool
+	// Priority breaks ties between the same package in several repositories, see
+	// TieBreakRepositoryPriority. Default is 0.
+	Priority int
+	// Arch fetches the repository for this arch rather than the arch of the root.
+	Arch string
+	// Keys are the names of the keys, in /etc/apk/keys and /etc/apk/keys.d, that may sign
+	// the index of the repository. Empty allows every key.
+	Keys []string
+	// Mirrors are the URLs of copies of the repository, tried in order when its index
+	// cannot be fetched from URL.
+	Mirrors []string
+	// Unsigned repositories, e.g. local development ones, are used without verifying the
+	// signatures of their indexes, from URL or a mirror.
+	Unsigned bool
+}
+
+// Line returns the line of the repository in /etc/apk/repositories, without its settings.
+func (r RepositoryConfig) Line() string {
+	return TaggedRepository(r.Tag, r.URL)
+}
+
+// hasFetchSettings returns whether the index of the repository is fetched differently from
+// a plain repository line.
+func (r RepositoryConfig) hasFetchSettings() bool {
+	return r.Arch != "" || len(r.Keys) != 0 || len(r.Mirrors) != 0
+}
+
+// settings returns the settings line of the repository, or "" if it has none.
+func (r RepositoryConfig) settings() (string, error) {
+	if strings.ContainsAny(r.Arch, ", \t") {
+		return "", fmt.Errorf("invalid arch of repository %s: %q", r.URL, r.Arch)
+	}
+	var fields []string
+	if r.Disabled {
+		fields = append(fields, "disabled")
+	}
+	if r.Priority != 0 {
+		fields = append(fields, fmt.Sprintf("priority=%d", r.Priority))
+	}
+	if r.Arch != "" {
+		fields = append(fields, "arch="+r.Arch)
+	}
+	if r.Unsigned {
+		fields = append(fields, "unsigned")
+	}
+	for _, setting := range []struct {
+		name   string
+		values []string
+	}{{"keys", r.Keys}, {"mirrors", r.Mirrors}} {
+		if len(setting.values) == 0 {
+			continue
+		}
+		for _, v := range setting.values {
+			if v == "" || strings.ContainsAny(v, ", \t") {
+				return "", fmt.Errorf("invalid %s of repository %s: %q", setting.name, r.URL, v)
+			}
+		}
+		fields = append(fields, setting.name+"="+strings.Join(setting.values, ","))
+	}
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return repositorySettingsPrefix + " " + strings.Join(fields, " "), nil
+}
+
+// FormatRepositories writes repos to w in the format of /etc/apk/repositories. The settings
+// of a repository, other than its tag, are on a comment line before it, e.g.
+//
+//	#go-apk: priority=10 keys=packager.rsa.pub mirrors=https://mirror.example.com/main
+//	@main https://packages.example.com/main
+//
+// and disabled repositories are commented out, so apk-tools reads the same repositories.
+func FormatRepositories(w io.Writer, repos []RepositoryConfig) error {
+	for _, repo := range repos {
+		if _, _, err := ParseRepositoryLine(repo.Line()); err != nil {
+			return err
+		}
+		settings, err := repo.settings()
+		if err != nil {
+			return err
+		}
+		line := repo.Line()
+		if repo.Disabled {
+			line = "#" + line
+		}
+		if settings != "" {
+			line = settings + "\n" + line
+		}
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseRepositories reads the repositories in r, in the format of /etc/apk/repositories
+// written by FormatRepositories. Plain repository lines, as written by apk-tools, are
+// repositories without settings. Other comments and blank lines are skipped, so they are
+// not kept by a round trip.
+func ParseRepositories(r io.Reader) ([]RepositoryConfig, error) {
+	return parseRepositories(r, false)
+}
+
+// parseRepositories is ParseRepositories. With lenient, plain lines that are not valid
+// repository lines are kept as they are, as the URL of a repository without a tag, like
+// GetRepositories always returned them; fetching their indexes fails.
+func parseRepositories(r io.Reader, lenient bool) ([]RepositoryConfig, error) {
+	var (
+		repos   []RepositoryConfig
+		pending *RepositoryConfig
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if settings, ok := strings.CutPrefix(line, repositorySettingsPrefix); ok {
+			if pending != nil {
+				return nil, fmt.Errorf("repository settings %q are not followed by a repository", line)
+			}
+			repo, err := parseRepositorySettings(settings)
+			if err != nil {
+				return nil, err
+			}
+			pending = &repo
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		repo := RepositoryConfig{}
+		if pending != nil {
+			repo = *pending
+		}
+		if strings.HasPrefix(line, "#") {
+			// a disabled repository, or a comment
+			if pending == nil || !repo.Disabled {
+				continue
+			}
+			line = strings.TrimSpace(strings.TrimPrefix(line, "#"))
+		} else if repo.Disabled {
+			return nil, fmt.Errorf("disabled repository %q is not commented out", line)
+		}
+		tag, uri, err := ParseRepositoryLine(line)
+		if err != nil && lenient && pending == nil {
+			tag, uri, err = "", line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		repo.Tag, repo.URL = tag, uri
+		repos = append(repos, repo)
+		pending = nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if pending != nil {
+		return nil, fmt.Errorf("repository settings are not followed by a repository")
+	}
+	return repos, nil
+}
+
+// parseRepositorySettings parses the fields of a settings line, after its prefix.
+func parseRepositorySettings(settings string) (RepositoryConfig, error) {
+	var repo RepositoryConfig
+	for _, field := range strings.Fields(settings) {
+		name, value, _ := strings.Cut(field, "=")
+		switch name {
+		case "disabled":
+			repo.Disabled = true
+		case "unsigned":
+			repo.Unsigned = true
+		case "priority":
+			priority, err := strconv.Atoi(value)
+			if err != nil {
+				return repo, fmt.Errorf("invalid repository priority %q: %w", value, err)
+			}
+			repo.Priority = priority
+		case "arch":
+			repo.Arch = value
+		case "keys":
+			repo.Keys = strings.Split(value, ",")
+		case "mirrors":
+			repo.Mirrors = strings.Split(value, ",")
+		default:
+			return repo, fmt.Errorf("unknown repository setting %q", field)
+		}
+	}
+	return repo, nil
+}
+
+// RepositoryConfigs returns the repositories of the root with their settings, including
+// the disabled ones, in the order of GetRepositories.
+func (a *APK) RepositoryConfigs() ([]RepositoryConfig, error) {
+	lists, err := a.repositoryLists()
+	if err != nil {
+		return nil, err
+	}
+	var repos []RepositoryConfig
+	for _, list := range lists {
+		repos = append(repos, list.repos...)
+	}
+	return repos, nil
+}
+
+// SetRepositoryConfigs sets the contents of /etc/apk/repositories to repos, with their
+// settings, see FormatRepositories. Like SetRepositories, the base directory of /etc/apk
+// must already exist, and the drop-in lists are left alone.
+func (a *APK) SetRepositoryConfigs(ctx context.Context, repos []RepositoryConfig) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "SetRepositoryConfigs")
+	defer span.End()
+
+	a.log(ctx).Debug("setting apk repositories")
+
+	if len(repos) == 0 {
+		return fmt.Errorf("must provide at least one repository")
+	}
+	var b strings.Builder
+	if err := FormatRepositories(&b, repos); err != nil {
+		return err
+	}
+	return a.writeRepositories(b.String())
+}
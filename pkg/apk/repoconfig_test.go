@@ -0,0 +1,182 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestRepositoryConfigFormat(t *testing.T) {
+	repos := []RepositoryConfig{
+		{URL: "https://packages.example.com/main"},
+		{URL: "https://packages.example.com/testing", Tag: "testing", Priority: -5, Arch: "aarch64"},
+		{URL: "https://packages.example.com/extra", Disabled: true},
+		{URL: "https://packages.example.com/dev", Unsigned: true},
+		{URL: "https://packages.example.com/signed", Keys: []string{"a.rsa.pub", "b.rsa.pub"}, Mirrors: []string{"https://mirror.example.com/signed"}},
+	}
+	var b strings.Builder
+	require.NoError(t, FormatRepositories(&b, repos))
+	require.Equal(t, `https://packages.example.com/main
+#go-apk: priority=-5 arch=aarch64
+@testing https://packages.example.com/testing
+#go-apk: disabled
+#https://packages.example.com/extra
+#go-apk: unsigned
+https://packages.example.com/dev
+#go-apk: keys=a.rsa.pub,b.rsa.pub mirrors=https://mirror.example.com/signed
+https://packages.example.com/signed
+`, b.String())
+
+	parsed, err := ParseRepositories(strings.NewReader(b.String()))
+	require.NoError(t, err)
+	require.Equal(t, repos, parsed)
+
+	require.Error(t, FormatRepositories(io.Discard, []RepositoryConfig{{URL: "https://a", Mirrors: []string{"https://b https://c"}}}))
+	require.Error(t, FormatRepositories(io.Discard, []RepositoryConfig{{URL: ""}}))
+}
+
+func TestParseRepositories(t *testing.T) {
+	// as written by apk-tools, or by hand
+	repos, err := ParseRepositories(strings.NewReader(`# the main repository
+https://packages.example.com/main
+
+#https://packages.example.com/old
+  @testing https://packages.example.com/testing
+`))
+	require.NoError(t, err)
+	require.Equal(t, []RepositoryConfig{
+		{URL: "https://packages.example.com/main"},
+		{URL: "https://packages.example.com/testing", Tag: "testing"},
+	}, repos)
+
+	for _, invalid := range []string{
+		"#go-apk: priority=high\nhttps://a\n",
+		"#go-apk: pinned\nhttps://a\n",
+		"#go-apk: priority=1\n",
+		"#go-apk: priority=1\n#go-apk: arch=x86_64\nhttps://a\n",
+		"#go-apk: disabled\nhttps://a\n",
+		"https://a https://b\n",
+	} {
+		_, err := ParseRepositories(strings.NewReader(invalid))
+		require.Error(t, err, invalid)
+	}
+
+	// the lists of the root keep the lines that are not valid repositories
+	repos, err = parseRepositories(strings.NewReader("https://a https://b\n@ https://c\n"), true)
+	require.NoError(t, err)
+	require.Equal(t, []RepositoryConfig{{URL: "https://a https://b"}, {URL: "@ https://c"}}, repos)
+	_, err = parseRepositories(strings.NewReader("#go-apk: priority=1\nhttps://a https://b\n"), true)
+	require.Error(t, err)
+}
+
+func TestRepositoryConfigs(t *testing.T) {
+	ctx := context.Background()
+	globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+
+	tmp := t.TempDir()
+	mirror := filepath.Join(tmp, "mirror")
+	require.NoError(t, os.MkdirAll(filepath.Join(mirror, "x86_64"), 0o755))
+	archive, err := ArchiveFromIndex(&APKIndex{Packages: []*Package{{Name: "hello", Version: "1.0-r0", Arch: "x86_64"}}})
+	require.NoError(t, err)
+	b, err := io.ReadAll(archive)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(mirror, "x86_64", indexFilename), b, 0o644))
+
+	src := apkfs.NewMemFS()
+	a, err := New(WithFS(src), WithArch("x86_64"))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+	repos := []RepositoryConfig{
+		{URL: filepath.Join(tmp, "gone"), Priority: 10, Mirrors: []string{mirror}},
+		{URL: filepath.Join(tmp, "disabled"), Disabled: true},
+	}
+	require.NoError(t, a.SetRepositoryConfigs(ctx, repos))
+
+	got, err := a.RepositoryConfigs()
+	require.NoError(t, err)
+	require.Equal(t, repos, got)
+	lines, err := a.GetRepositories()
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(tmp, "gone")}, lines)
+
+	// the index is fetched from the mirror, and the priority of the repository applies to it
+	indexes, err := a.GetRepositoryIndexes(ctx, true)
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+	require.Equal(t, "hello", indexes[0].Packages()[0].Name)
+	priorities, err := a.configuredPriorities(indexes)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{mirror + "/x86_64": 10}, priorities)
+}
+
+func TestUnsignedRepositories(t *testing.T) {
+	ctx := context.Background()
+
+	tmp := t.TempDir()
+	repo := func(name string) string {
+		dir := filepath.Join(tmp, name)
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "x86_64"), 0o755))
+		archive, err := ArchiveFromIndex(&APKIndex{Packages: []*Package{{Name: name, Version: "1.0-r0", Arch: "x86_64"}}})
+		require.NoError(t, err)
+		b, err := io.ReadAll(archive)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "x86_64", indexFilename), b, 0o644))
+		return dir
+	}
+	dev, other := repo("dev"), repo("other")
+
+	newAPK := func(repos []RepositoryConfig, options ...Option) *APK {
+		src := apkfs.NewMemFS()
+		a, err := New(append([]Option{WithFS(src), WithArch("x86_64")}, options...)...)
+		require.NoError(t, err)
+		require.NoError(t, a.InitDB(ctx))
+		require.NoError(t, src.WriteFile(filepath.Join(keysDirPath, "test.rsa.pub"), []byte("key"), 0o644))
+		require.NoError(t, a.SetRepositoryConfigs(ctx, repos))
+		return a
+	}
+
+	// the signature of dev is ignored, other is still verified
+	globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+	a := newAPK([]RepositoryConfig{{URL: dev, Unsigned: true}})
+	indexes, err := a.GetRepositoryIndexes(ctx, false)
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+	require.True(t, indexSignature(indexes[0]).Skipped)
+	checks, err := a.CheckRepositories(ctx)
+	require.NoError(t, err)
+	require.True(t, checks[0].OK(), checks[0].Problems)
+
+	globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+	_, err = newAPK([]RepositoryConfig{{URL: dev, Unsigned: true}, {URL: other}}).GetRepositoryIndexes(ctx, false)
+	require.Error(t, err)
+
+	globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+	a = newAPK([]RepositoryConfig{{URL: dev}, {URL: other}}, WithUnsignedRepositories(func(repoURL string) bool {
+		return strings.HasPrefix(repoURL, tmp)
+	}))
+	indexes, err = a.GetRepositoryIndexes(ctx, false)
+	require.NoError(t, err)
+	require.Len(t, indexes, 2)
+}
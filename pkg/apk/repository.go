@@ -3,12 +3,38 @@ package apk
 import (
 	"fmt"
 	"strings"
+	"time"
 )
 
 type Repository struct {
 	URI string
 }
 
+// TaggedRepository returns the line for /etc/apk/repositories that declares the repository
+// at uri with the given tag, e.g. "@testing https://...". Packages in a tagged repository
+// are only installed when requested with the tag, e.g. "foo@testing".
+// An empty tag returns uri unchanged.
+func TaggedRepository(tag, uri string) string {
+	if tag == "" {
+		return uri
+	}
+	return fmt.Sprintf("@%s %s", tag, uri)
+}
+
+// ParseRepositoryLine parses a line of /etc/apk/repositories into its tag, which is empty
+// for untagged repositories, and its uri.
+func ParseRepositoryLine(line string) (tag, uri string, err error) {
+	parts := strings.Fields(line)
+	switch {
+	case len(parts) == 1 && !strings.HasPrefix(parts[0], "@"):
+		return "", parts[0], nil
+	case len(parts) == 2 && strings.HasPrefix(parts[0], "@") && len(parts[0]) > 1:
+		return parts[0][1:], parts[1], nil
+	default:
+		return "", "", fmt.Errorf("invalid repository line: %q", line)
+	}
+}
+
 // NewRepositoryFromComponents creates a new Repository with the uri constructed
 // from the individual components
 func NewRepositoryFromComponents(baseURI, release, repo, arch string) Repository {
@@ -60,6 +86,22 @@ func (r *RepositoryWithIndex) Count() int {
 	return len(r.index.Packages)
 }
 
+// Timestamp returns when the index of the repository was built, or zero if it is not known.
+func (r *RepositoryWithIndex) Timestamp() time.Time {
+	return r.index.Timestamp
+}
+
+// Signature returns how the signature of the index of the repository was verified.
+func (r *RepositoryWithIndex) Signature() SignatureVerification {
+	return r.index.Verification
+}
+
+// Digest returns the sha256 of the index of the repository as it was fetched, or nil if
+// that is not known.
+func (r *RepositoryWithIndex) Digest() []byte {
+	return r.index.Digest
+}
+
 // RepoAbbr returns a short name of this repository consiting of the repo name
 // and the architecture.
 func (r *RepositoryWithIndex) RepoAbbr() string {
@@ -32,3 +32,28 @@ func TestRepositoryPackageReturnsCorrectUrl(t *testing.T) {
 
 	assert.Equal(t, "https://dl-cdn.alpinelinux.org/alpine/edge/main/x86_64/test-package-1.2.3-r0.apk", pkg.URL())
 }
+
+func TestParseRepositoryLine(t *testing.T) {
+	for _, tt := range []struct {
+		line    string
+		tag     string
+		uri     string
+		wantErr bool
+	}{
+		{line: "https://dl-cdn.alpinelinux.org/alpine/edge/main", uri: "https://dl-cdn.alpinelinux.org/alpine/edge/main"},
+		{line: "@testing https://dl-cdn.alpinelinux.org/alpine/edge/testing", tag: "testing", uri: "https://dl-cdn.alpinelinux.org/alpine/edge/testing"},
+		{line: "@testing", wantErr: true},
+		{line: "@ https://dl-cdn.alpinelinux.org/alpine/edge/testing", wantErr: true},
+		{line: "https://a https://b", wantErr: true},
+	} {
+		tag, uri, err := ParseRepositoryLine(tt.line)
+		if tt.wantErr {
+			assert.Error(t, err, tt.line)
+			continue
+		}
+		assert.NoError(t, err, tt.line)
+		assert.Equal(t, tt.tag, tag, tt.line)
+		assert.Equal(t, tt.uri, uri, tt.line)
+		assert.Equal(t, tt.line, TaggedRepository(tag, uri))
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// dbPaths are the parts of the apk database that installs change.
+var dbPaths = []string{
+	"etc/apk",
+	worldFilePath,
+	"lib/apk/db",
+	installedFilePath,
+	scriptsFilePath,
+	triggersFilePath,
+	omittedFilePath,
+}
+
+// setMtimes sets the mtime of paths to mtime, skipping those that do not exist. It does
+// nothing if the filesystem cannot change mtimes, see apkfs.ChtimesFS.
+func (a *APK) setMtimes(mtime time.Time, paths ...string) error {
+	cfs, ok := a.fs.(apkfs.ChtimesFS)
+	if !ok {
+		return nil
+	}
+	for _, p := range paths {
+		if err := cfs.Chtimes(p, mtime, mtime); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("unable to set mtime of %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// clampMtimes sets the mtime of the installed files to the one in their header, or to
+// buildTime if it is later or unset, and the mtime of the apk database to buildTime.
+// Symlinks and hardlinks are skipped, setting times would change what they point to, and so
+// are hardlinks to the cache, see CacheLinksHardlink.
+func (a *APK) clampMtimes(files [][]tar.Header, buildTime time.Time) error {
+	for _, hdrs := range files {
+		for _, hdr := range hdrs {
+			if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink || a.isCacheLinked(hdr.Name) {
+				continue
+			}
+			mtime := hdr.ModTime
+			if mtime.IsZero() || mtime.After(buildTime) {
+				mtime = buildTime
+			}
+			if err := a.setMtimes(mtime, hdr.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return a.setMtimes(buildTime, dbPaths...)
+}
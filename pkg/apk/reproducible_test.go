@@ -0,0 +1,91 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestBuildTime(t *testing.T) {
+	buildTime := time.Unix(1700000000, 0).UTC()
+
+	install := func(t *testing.T, options ...Option) (*APK, apkfs.FullFS) {
+		src := apkfs.NewMemFS()
+		a, err := New(append([]Option{WithFS(src), WithIgnoreMknodErrors(true)}, options...)...)
+		require.NoError(t, err)
+		require.NoError(t, a.InitDB(context.Background()))
+		require.NoError(t, a.SetWorld(context.Background(), []string{"b", "a", "b"}))
+
+		pkg := fakePackage(t, &Package{Name: "a", Version: "1.0-r0"}, []testDirEntry{
+			{"etc", 0o755, true, nil, nil},
+			{"etc/a", 0o644, false, []byte("a"), nil},
+		})
+		require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{pkg}))
+		return a, src
+	}
+
+	check := func(t *testing.T, src apkfs.FullFS) {
+		for _, p := range []string{"etc/apk/arch", worldFilePath, installedFilePath, scriptsFilePath} {
+			fi, err := src.Stat(p)
+			require.NoError(t, err)
+			require.True(t, fi.ModTime().Equal(buildTime), "mtime of %s is %s", p, fi.ModTime())
+		}
+		// the files of the package keep their earlier mtimes, of the epoch
+		for _, p := range []string{"etc", "etc/a"} {
+			fi, err := src.Stat(p)
+			require.NoError(t, err)
+			require.True(t, fi.ModTime().Equal(time.Unix(0, 0)), "mtime of %s is %s", p, fi.ModTime())
+		}
+	}
+
+	t.Run("option", func(t *testing.T) {
+		a, src := install(t, WithBuildTime(buildTime))
+		check(t, src)
+
+		world, err := a.GetWorld()
+		require.NoError(t, err)
+		require.Equal(t, []string{"a", "b"}, world)
+	})
+
+	t.Run("environment", func(t *testing.T) {
+		t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+		_, src := install(t, WithSourceDateEpoch())
+		check(t, src)
+	})
+
+	t.Run("invalid environment", func(t *testing.T) {
+		t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+		_, err := New(WithSourceDateEpoch())
+		require.Error(t, err)
+	})
+
+	t.Run("reproducible database", func(t *testing.T) {
+		_, first := install(t, WithBuildTime(buildTime))
+		_, second := install(t, WithBuildTime(buildTime))
+		for _, p := range []string{worldFilePath, installedFilePath, scriptsFilePath, triggersFilePath} {
+			b1, err := first.ReadFile(p)
+			require.NoError(t, err)
+			b2, err := second.ReadFile(p)
+			require.NoError(t, err)
+			require.Equal(t, b1, b2, "%s differs", p)
+		}
+	})
+}
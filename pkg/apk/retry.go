@@ -0,0 +1,112 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"golang.org/x/exp/slices"
+)
+
+// RetryPolicy is how failed HTTP requests for indexes, keys and packages are retried, see
+// WithRetryPolicy. The zero value of a field keeps the default of retryablehttp.
+type RetryPolicy struct {
+	// MaxRetries is how many times a request is retried after the first attempt: 0 for
+	// never, and nil for the default of retryablehttp.
+	MaxRetries *int
+	// MinBackoff and MaxBackoff bound the wait before a retry. It doubles with every attempt,
+	// from MinBackoff up to MaxBackoff, and is jittered between MinBackoff and that, so that
+	// clients do not retry in lockstep. A Retry-After of a 429 or 503 response is honored.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// RetryStatusCodes are the response status codes that are retried. Default is 429 and
+	// the 5xx codes other than 501.
+	RetryStatusCodes []int
+	// RetryError decides whether a request that failed without a response, with err, is
+	// retried. Default is to retry all but TLS certificate and redirect errors.
+	RetryError func(err error) bool
+	// Timeout limits each attempt, including reading the response body. Default is no limit.
+	Timeout time.Duration
+}
+
+func (p *RetryPolicy) validate() error {
+	if p.MaxRetries != nil && *p.MaxRetries < 0 {
+		return fmt.Errorf("invalid max retries %d", *p.MaxRetries)
+	}
+	if p.MinBackoff < 0 || p.MaxBackoff < 0 || (p.MaxBackoff != 0 && p.MinBackoff > p.MaxBackoff) {
+		return fmt.Errorf("invalid backoff %s to %s", p.MinBackoff, p.MaxBackoff)
+	}
+	if p.Timeout < 0 {
+		return fmt.Errorf("invalid request timeout %s", p.Timeout)
+	}
+	return nil
+}
+
+// Client returns an HTTP client that retries requests by the policy, e.g. for
+// GetRepositoryIndexes with WithHTTPClient.
+func (p RetryPolicy) Client() *http.Client {
+	return httpConfig{retryPolicy: &p}.client()
+}
+
+func (p *RetryPolicy) apply(c *retryablehttp.Client) {
+	if p.MaxRetries != nil {
+		c.RetryMax = *p.MaxRetries
+	}
+	if p.MinBackoff != 0 {
+		c.RetryWaitMin = p.MinBackoff
+	}
+	if p.MaxBackoff != 0 {
+		c.RetryWaitMax = p.MaxBackoff
+	}
+	if c.RetryWaitMin > c.RetryWaitMax {
+		c.RetryWaitMax = c.RetryWaitMin
+	}
+	if p.Timeout != 0 {
+		c.HTTPClient.Timeout = p.Timeout
+	}
+	c.Backoff = jitterBackoff
+	c.CheckRetry = p.checkRetry
+}
+
+func (p *RetryPolicy) checkRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	switch {
+	case err != nil && p.RetryError != nil:
+		return p.RetryError(err), nil
+	case err == nil && len(p.RetryStatusCodes) != 0:
+		return slices.Contains(p.RetryStatusCodes, resp.StatusCode), nil
+	}
+	return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+}
+
+// jitterBackoff is the exponential backoff of retryablehttp, honoring Retry-After, with the
+// wait jittered between minWait and what it would be.
+func jitterBackoff(minWait, maxWait time.Duration, attempt int, resp *http.Response) time.Duration {
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) && resp.Header.Get("Retry-After") != "" {
+		return retryablehttp.DefaultBackoff(minWait, maxWait, attempt, resp)
+	}
+	wait := retryablehttp.DefaultBackoff(minWait, maxWait, attempt, nil)
+	if wait <= minWait {
+		return wait
+	}
+	return minWait + time.Duration(rand.Int63n(int64(wait-minWait)+1)) //nolint:gosec // jitter needs no crypto
+}
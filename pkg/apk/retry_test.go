@@ -0,0 +1,118 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	// the server fails with status the first failures times, then succeeds
+	serve := func(t *testing.T, status int, failures int64) (*httptest.Server, *atomic.Int64) {
+		var requests atomic.Int64
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			if requests.Add(1) <= failures {
+				w.WriteHeader(status)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		t.Cleanup(srv.Close)
+		return srv, &requests
+	}
+	retries := func(n int) *int { return &n }
+	policy := RetryPolicy{MaxRetries: retries(3), MinBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+	t.Run("default status codes", func(t *testing.T) {
+		srv, requests := serve(t, http.StatusServiceUnavailable, 2)
+		res, err := policy.Client().Get(srv.URL)
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, int64(3), requests.Load())
+	})
+
+	t.Run("status codes", func(t *testing.T) {
+		p := policy
+		p.RetryStatusCodes = []int{http.StatusTeapot}
+
+		srv, requests := serve(t, http.StatusTeapot, 1)
+		res, err := p.Client().Get(srv.URL)
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, int64(2), requests.Load())
+
+		srv, requests = serve(t, http.StatusInternalServerError, 1)
+		res, err = p.Client().Get(srv.URL)
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusInternalServerError, res.StatusCode)
+		require.Equal(t, int64(1), requests.Load())
+	})
+
+	t.Run("no retries", func(t *testing.T) {
+		p := policy
+		p.MaxRetries = retries(0)
+		srv, requests := serve(t, http.StatusServiceUnavailable, 1)
+		res, err := p.Client().Get(srv.URL)
+		require.Error(t, err)
+		if res != nil {
+			res.Body.Close()
+		}
+		require.Equal(t, int64(1), requests.Load())
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		var seen atomic.Int64
+		p := policy
+		p.RetryError = func(error) bool {
+			return seen.Add(1) < 2
+		}
+		srv, _ := serve(t, http.StatusOK, 0)
+		srv.Close()
+		_, err := p.Client().Get(srv.URL)
+		require.Error(t, err)
+		require.Equal(t, int64(2), seen.Load())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, p := range []RetryPolicy{
+			{MaxRetries: retries(-1)},
+			{MinBackoff: time.Second, MaxBackoff: time.Millisecond},
+			{Timeout: -time.Second},
+		} {
+			_, err := New(WithRetryPolicy(p))
+			require.Error(t, err)
+		}
+	})
+}
+
+func TestJitterBackoff(t *testing.T) {
+	for attempt := 0; attempt < 5; attempt++ {
+		wait := jitterBackoff(time.Millisecond, 10*time.Millisecond, attempt, nil)
+		require.GreaterOrEqual(t, wait, time.Millisecond)
+		require.LessOrEqual(t, wait, 10*time.Millisecond)
+	}
+
+	res := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"3"}}}
+	require.Equal(t, 3*time.Second, jitterBackoff(time.Millisecond, 10*time.Millisecond, 0, res))
+}
@@ -0,0 +1,438 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+)
+
+// SBOMFormat is the format of an SBOM, see APK.SBOM.
+type SBOMFormat string
+
+const (
+	// SBOMFormatSPDX is SPDX 2.3 JSON.
+	SBOMFormatSPDX SBOMFormat = "spdx-json"
+	// SBOMFormatCycloneDX is CycloneDX 1.5 JSON.
+	SBOMFormatCycloneDX SBOMFormat = "cyclonedx-json"
+)
+
+const sbomTool = "go-apk"
+
+// sbomPackage is a package in an SBOM, and where it was downloaded from, if known.
+type sbomPackage struct {
+	*Package
+	downloadURL string
+}
+
+// SBOM returns an SBOM of the installed packages, in install order. Its creation time is the
+// one set by WithBuildTime, if any.
+func (a *APK) SBOM(ctx context.Context, format SBOMFormat) ([]byte, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "SBOM")
+	defer span.End()
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("reading installed packages: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	distro, err := a.Distro()
+	if err != nil {
+		return nil, err
+	}
+	pkgs := make([]sbomPackage, len(installed))
+	for i, pkg := range installed {
+		pkgs[i] = sbomPackage{Package: &pkg.Package}
+	}
+	created := time.Now()
+	if a.buildTime != nil {
+		created = *a.buildTime
+	}
+	return sbom(format, created, distro, pkgs)
+}
+
+// WriteSBOM writes an SBOM of pkgs from distro, such as the result of resolving the world, to
+// w. The download location of each package is its URL in its repository.
+func WriteSBOM(w io.Writer, format SBOMFormat, created time.Time, distro Distro, pkgs []*RepositoryPackage) error {
+	sp := make([]sbomPackage, len(pkgs))
+	for i, pkg := range pkgs {
+		sp[i] = sbomPackage{Package: pkg.Package, downloadURL: pkg.URL()}
+	}
+	b, err := sbom(format, created, distro, sp)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func sbom(format SBOMFormat, created time.Time, distro Distro, pkgs []sbomPackage) ([]byte, error) {
+	var doc any
+	switch format {
+	case SBOMFormatSPDX:
+		doc = spdxDocument(created, distro, pkgs)
+	case SBOMFormatCycloneDX:
+		doc = cyclonedxDocument(created, distro, pkgs)
+	default:
+		return nil, fmt.Errorf("unsupported SBOM format %q", format)
+	}
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+type spdxDoc struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo"`
+	DownloadLocation string            `json:"downloadLocation"`
+	Supplier         string            `json:"supplier,omitempty"`
+	Homepage         string            `json:"homepage,omitempty"`
+	SourceInfo       string            `json:"sourceInfo,omitempty"`
+	Description      string            `json:"description,omitempty"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	LicenseComments  string            `json:"licenseComments,omitempty"`
+	CopyrightText    string            `json:"copyrightText"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	Checksums        []spdxChecksum    `json:"checksums,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// spdxIDInvalid matches what is not allowed in an SPDX identifier.
+var spdxIDInvalid = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+
+// spdxLicenseID matches a license or exception identifier in an SPDX license expression,
+// including LicenseRef- ones, optionally from another document, and the + of "or later".
+var spdxLicenseID = regexp.MustCompile(`^(DocumentRef-[a-zA-Z0-9.-]+:)?[a-zA-Z0-9.-]+\+?$`)
+
+// isSPDXExpression returns whether license is a syntactically valid SPDX license expression,
+// such as "MIT", "GPL-2.0-or-later WITH Classpath-exception-2.0" or "(MIT OR Apache-2.0) AND
+// BSD-3-Clause". Alpine packages often have licenses that are not, such as "GPL-2.0 LGPL" or
+// "custom:foo". Whether the identifiers are on the SPDX license list is not checked.
+func isSPDXExpression(license string) bool {
+	tokens := strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(license))
+	// upper and lower case operators are both valid, but not mixed case
+	isOp := func(token, op string) bool {
+		return token == op || token == strings.ToLower(op)
+	}
+	isID := func(token string) bool {
+		return spdxLicenseID.MatchString(token) && !isOp(token, "AND") && !isOp(token, "OR") && !isOp(token, "WITH")
+	}
+
+	// a recursive descent parser of
+	//   expr = and *("OR" and)
+	//   and  = with *("AND" with)
+	//   with = term ["WITH" id]
+	//   term = id / "(" expr ")"
+	pos := 0
+	var expr func() bool
+	term := func() bool {
+		if pos >= len(tokens) {
+			return false
+		}
+		if tokens[pos] == "(" {
+			pos++
+			if !expr() || pos >= len(tokens) || tokens[pos] != ")" {
+				return false
+			}
+			pos++
+			return true
+		}
+		if !isID(tokens[pos]) {
+			return false
+		}
+		pos++
+		return true
+	}
+	with := func() bool {
+		if !term() {
+			return false
+		}
+		if pos < len(tokens) && isOp(tokens[pos], "WITH") {
+			pos++
+			if pos >= len(tokens) || !isID(tokens[pos]) {
+				return false
+			}
+			pos++
+		}
+		return true
+	}
+	and := func() bool {
+		if !with() {
+			return false
+		}
+		for pos < len(tokens) && isOp(tokens[pos], "AND") {
+			pos++
+			if !with() {
+				return false
+			}
+		}
+		return true
+	}
+	expr = func() bool {
+		if !and() {
+			return false
+		}
+		for pos < len(tokens) && isOp(tokens[pos], "OR") {
+			pos++
+			if !and() {
+				return false
+			}
+		}
+		return true
+	}
+	return expr() && pos == len(tokens)
+}
+
+func spdxDocument(created time.Time, distro Distro, pkgs []sbomPackage) *spdxDoc {
+	const noAssertion = "NOASSERTION"
+
+	doc := &spdxDoc{
+		SPDXVersion: "SPDX-2.3",
+		DataLicense: "CC0-1.0",
+		SPDXID:      "SPDXRef-DOCUMENT",
+		Name:        "apk-packages",
+		CreationInfo: spdxCreationInfo{
+			Created:  created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: " + sbomTool},
+		},
+		Packages:      []spdxPackage{},
+		Relationships: []spdxRelationship{},
+	}
+
+	// the namespace must be unique to the contents, derive it from them
+	h := sha256.New()
+	for _, pkg := range pkgs {
+		fmt.Fprintf(h, "%s %s %s %s\n", pkg.Name, pkg.Version, pkg.Arch, pkg.ChecksumString())
+
+		// the same name can be in a document more than once, in other versions or for other
+		// architectures, e.g. from several repositories
+		id := "SPDXRef-Package-" + spdxIDInvalid.ReplaceAllString(pkg.Name+"-"+pkg.Version, "-")
+		if pkg.Arch != "" {
+			id += "-" + spdxIDInvalid.ReplaceAllString(pkg.Arch, "-")
+		}
+		p := spdxPackage{
+			Name:             pkg.Name,
+			SPDXID:           id,
+			VersionInfo:      pkg.Version,
+			DownloadLocation: noAssertion,
+			Homepage:         pkg.URL,
+			Description:      pkg.Description,
+			LicenseConcluded: noAssertion,
+			LicenseDeclared:  noAssertion,
+			CopyrightText:    noAssertion,
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  pkg.PURL(distro),
+			}},
+		}
+		if pkg.downloadURL != "" {
+			p.DownloadLocation = pkg.downloadURL
+		}
+		if isSPDXExpression(pkg.License) {
+			p.LicenseDeclared = pkg.License
+		} else if pkg.License != "" {
+			p.LicenseComments = "declared license: " + pkg.License
+		}
+		if pkg.Origin != "" {
+			p.SourceInfo = "built from origin " + pkg.Origin
+			if pkg.RepoCommit != "" {
+				p.SourceInfo += " at commit " + pkg.RepoCommit
+			}
+		}
+		if pkg.Maintainer != "" {
+			p.Supplier = spdxSupplier(pkg.Maintainer)
+		}
+		if len(pkg.Checksum) != 0 {
+			p.Checksums = []spdxChecksum{{Algorithm: "SHA1", ChecksumValue: hex.EncodeToString(pkg.Checksum)}}
+		}
+		doc.Packages = append(doc.Packages, p)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID:      doc.SPDXID,
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: id,
+		})
+	}
+	doc.DocumentNamespace = "https://spdx.org/spdxdocs/" + sbomTool + "-" + hex.EncodeToString(h.Sum(nil))
+	return doc
+}
+
+// spdxSupplier returns the SPDX supplier of a package maintained by maintainer, which is
+// usually "Name <email>".
+func spdxSupplier(maintainer string) string {
+	name, email, ok := strings.Cut(maintainer, "<")
+	if !ok {
+		return "Person: " + maintainer
+	}
+	return fmt.Sprintf("Person: %s (%s)", strings.TrimSpace(name), strings.TrimSuffix(strings.TrimSpace(email), ">"))
+}
+
+type cyclonedxDoc struct {
+	BOMFormat   string               `json:"bomFormat"`
+	SpecVersion string               `json:"specVersion"`
+	Version     int                  `json:"version"`
+	Metadata    cyclonedxMetadata    `json:"metadata"`
+	Components  []cyclonedxComponent `json:"components"`
+}
+
+type cyclonedxMetadata struct {
+	Timestamp string         `json:"timestamp"`
+	Tools     cyclonedxTools `json:"tools"`
+}
+
+type cyclonedxTools struct {
+	Components []cyclonedxComponent `json:"components"`
+}
+
+type cyclonedxComponent struct {
+	BOMRef             string              `json:"bom-ref,omitempty"`
+	Type               string              `json:"type"`
+	Name               string              `json:"name"`
+	Author             string              `json:"author,omitempty"`
+	Version            string              `json:"version,omitempty"`
+	Description        string              `json:"description,omitempty"`
+	Licenses           []cyclonedxLicense  `json:"licenses,omitempty"`
+	Hashes             []cyclonedxHash     `json:"hashes,omitempty"`
+	PURL               string              `json:"purl,omitempty"`
+	ExternalReferences []cyclonedxExtRef   `json:"externalReferences,omitempty"`
+	Properties         []cyclonedxProperty `json:"properties,omitempty"`
+}
+
+// cyclonedxLicense is either an SPDX license expression, or a license by name.
+type cyclonedxLicense struct {
+	Expression string                 `json:"expression,omitempty"`
+	License    *cyclonedxNamedLicense `json:"license,omitempty"`
+}
+
+type cyclonedxNamedLicense struct {
+	Name string `json:"name"`
+}
+
+type cyclonedxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cyclonedxExtRef struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type cyclonedxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func cyclonedxDocument(created time.Time, distro Distro, pkgs []sbomPackage) *cyclonedxDoc {
+	doc := &cyclonedxDoc{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.5",
+		Version:     1,
+		Metadata: cyclonedxMetadata{
+			Timestamp: created.UTC().Format(time.RFC3339),
+			Tools:     cyclonedxTools{Components: []cyclonedxComponent{{Type: "application", Name: sbomTool}}},
+		},
+		Components: []cyclonedxComponent{},
+	}
+	for _, pkg := range pkgs {
+		purl := pkg.PURL(distro)
+		c := cyclonedxComponent{
+			BOMRef:      purl,
+			Type:        "library",
+			Name:        pkg.Name,
+			Author:      pkg.Maintainer,
+			Version:     pkg.Version,
+			Description: pkg.Description,
+			PURL:        purl,
+		}
+		if isSPDXExpression(pkg.License) {
+			c.Licenses = []cyclonedxLicense{{Expression: pkg.License}}
+		} else if pkg.License != "" {
+			c.Licenses = []cyclonedxLicense{{License: &cyclonedxNamedLicense{Name: pkg.License}}}
+		}
+		if len(pkg.Checksum) != 0 {
+			c.Hashes = []cyclonedxHash{{Alg: "SHA-1", Content: hex.EncodeToString(pkg.Checksum)}}
+		}
+		if pkg.downloadURL != "" {
+			c.ExternalReferences = append(c.ExternalReferences, cyclonedxExtRef{Type: "distribution", URL: pkg.downloadURL})
+		}
+		if pkg.URL != "" {
+			c.ExternalReferences = append(c.ExternalReferences, cyclonedxExtRef{Type: "website", URL: pkg.URL})
+		}
+		if pkg.Origin != "" {
+			c.Properties = append(c.Properties, cyclonedxProperty{Name: "apk:origin", Value: pkg.Origin})
+		}
+		if pkg.RepoCommit != "" {
+			c.Properties = append(c.Properties, cyclonedxProperty{Name: "apk:commit", Value: pkg.RepoCommit})
+		}
+		if pkg.Size != 0 {
+			c.Properties = append(c.Properties, cyclonedxProperty{Name: "apk:size", Value: strconv.FormatUint(pkg.Size, 10)})
+		}
+		if pkg.InstalledSize != 0 {
+			c.Properties = append(c.Properties, cyclonedxProperty{Name: "apk:installed-size", Value: strconv.FormatUint(pkg.InstalledSize, 10)})
+		}
+		doc.Components = append(doc.Components, c)
+	}
+	return doc
+}
@@ -0,0 +1,199 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestWriteSBOM(t *testing.T) {
+	repo := &RepositoryWithIndex{Repository: &Repository{URI: "https://example.com/main/x86_64"}}
+	pkgs := []*RepositoryPackage{
+		NewRepositoryPackage(&Package{
+			Name:          "libcrypto3",
+			Version:       "3.1.4-r0",
+			Arch:          "x86_64",
+			Origin:        "openssl",
+			License:       "Apache-2.0",
+			Maintainer:    "Jane Doe <jane@example.com>",
+			URL:           "https://www.openssl.org/",
+			RepoCommit:    "abc123",
+			Size:          1234,
+			InstalledSize: 5678,
+			Checksum:      []byte{0xde, 0xad, 0xbe, 0xef},
+		}, repo),
+	}
+	created := time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)
+	wolfi := Distro{ID: "wolfi", VersionID: "20230201"}
+
+	t.Run("spdx", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, WriteSBOM(&buf, SBOMFormatSPDX, created, wolfi, pkgs))
+
+		var doc spdxDoc
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &doc))
+		require.Equal(t, "SPDX-2.3", doc.SPDXVersion)
+		require.Equal(t, "2023-11-14T22:13:20Z", doc.CreationInfo.Created)
+		require.Equal(t, []spdxPackage{{
+			Name:             "libcrypto3",
+			SPDXID:           "SPDXRef-Package-libcrypto3-3.1.4-r0-x86-64",
+			VersionInfo:      "3.1.4-r0",
+			DownloadLocation: "https://example.com/main/x86_64/libcrypto3-3.1.4-r0.apk",
+			Supplier:         "Person: Jane Doe (jane@example.com)",
+			Homepage:         "https://www.openssl.org/",
+			SourceInfo:       "built from origin openssl at commit abc123",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "Apache-2.0",
+			CopyrightText:    "NOASSERTION",
+			Checksums:        []spdxChecksum{{Algorithm: "SHA1", ChecksumValue: "deadbeef"}},
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  "pkg:apk/wolfi/libcrypto3@3.1.4-r0?arch=x86_64&distro=wolfi-20230201",
+			}},
+		}}, doc.Packages)
+		require.Equal(t, []spdxRelationship{{
+			SPDXElementID:      "SPDXRef-DOCUMENT",
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: "SPDXRef-Package-libcrypto3-3.1.4-r0-x86-64",
+		}}, doc.Relationships)
+
+		// the same packages give the same document
+		var again bytes.Buffer
+		require.NoError(t, WriteSBOM(&again, SBOMFormatSPDX, created, wolfi, pkgs))
+		require.Equal(t, buf.String(), again.String())
+	})
+
+	t.Run("cyclonedx", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, WriteSBOM(&buf, SBOMFormatCycloneDX, created, wolfi, pkgs))
+
+		var doc cyclonedxDoc
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &doc))
+		require.Equal(t, "CycloneDX", doc.BOMFormat)
+		require.Equal(t, []cyclonedxComponent{{
+			BOMRef:   "pkg:apk/wolfi/libcrypto3@3.1.4-r0?arch=x86_64&distro=wolfi-20230201",
+			Type:     "library",
+			Name:     "libcrypto3",
+			Author:   "Jane Doe <jane@example.com>",
+			Version:  "3.1.4-r0",
+			Licenses: []cyclonedxLicense{{Expression: "Apache-2.0"}},
+			Hashes:   []cyclonedxHash{{Alg: "SHA-1", Content: "deadbeef"}},
+			PURL:     "pkg:apk/wolfi/libcrypto3@3.1.4-r0?arch=x86_64&distro=wolfi-20230201",
+			ExternalReferences: []cyclonedxExtRef{
+				{Type: "distribution", URL: "https://example.com/main/x86_64/libcrypto3-3.1.4-r0.apk"},
+				{Type: "website", URL: "https://www.openssl.org/"},
+			},
+			Properties: []cyclonedxProperty{
+				{Name: "apk:origin", Value: "openssl"},
+				{Name: "apk:commit", Value: "abc123"},
+				{Name: "apk:size", Value: "1234"},
+				{Name: "apk:installed-size", Value: "5678"},
+			},
+		}}, doc.Components)
+	})
+
+	t.Run("same name", func(t *testing.T) {
+		aarch64 := *pkgs[0].Package
+		aarch64.Arch = "aarch64"
+		older := *pkgs[0].Package
+		older.Version = "3.1.3-r0"
+		var buf bytes.Buffer
+		require.NoError(t, WriteSBOM(&buf, SBOMFormatSPDX, created, wolfi, []*RepositoryPackage{
+			pkgs[0],
+			NewRepositoryPackage(&aarch64, repo),
+			NewRepositoryPackage(&older, repo),
+		}))
+
+		var doc spdxDoc
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &doc))
+		ids := map[string]bool{}
+		for _, p := range doc.Packages {
+			ids[p.SPDXID] = true
+		}
+		require.Len(t, ids, 3)
+	})
+
+	t.Run("licenses", func(t *testing.T) {
+		for _, tt := range []struct {
+			license  string
+			declared string
+			cdx      cyclonedxLicense
+		}{
+			{"MIT", "MIT", cyclonedxLicense{Expression: "MIT"}},
+			{"GPL-2.0-or-later WITH Linux-syscall-note", "GPL-2.0-or-later WITH Linux-syscall-note", cyclonedxLicense{Expression: "GPL-2.0-or-later WITH Linux-syscall-note"}},
+			{"(MIT OR Apache-2.0) AND BSD-3-Clause", "(MIT OR Apache-2.0) AND BSD-3-Clause", cyclonedxLicense{Expression: "(MIT OR Apache-2.0) AND BSD-3-Clause"}},
+			{"GPL-2.0+ and LicenseRef-custom", "GPL-2.0+ and LicenseRef-custom", cyclonedxLicense{Expression: "GPL-2.0+ and LicenseRef-custom"}},
+			{"GPL-2.0 LGPL", "NOASSERTION", cyclonedxLicense{License: &cyclonedxNamedLicense{Name: "GPL-2.0 LGPL"}}},
+			{"custom:foo", "NOASSERTION", cyclonedxLicense{License: &cyclonedxNamedLicense{Name: "custom:foo"}}},
+			{"MIT OR", "NOASSERTION", cyclonedxLicense{License: &cyclonedxNamedLicense{Name: "MIT OR"}}},
+			{"(MIT", "NOASSERTION", cyclonedxLicense{License: &cyclonedxNamedLicense{Name: "(MIT"}}},
+		} {
+			t.Run(tt.license, func(t *testing.T) {
+				pkg := *pkgs[0].Package
+				pkg.License = tt.license
+				rp := []*RepositoryPackage{NewRepositoryPackage(&pkg, repo)}
+
+				var buf bytes.Buffer
+				require.NoError(t, WriteSBOM(&buf, SBOMFormatSPDX, created, wolfi, rp))
+				var spdx spdxDoc
+				require.NoError(t, json.Unmarshal(buf.Bytes(), &spdx))
+				require.Equal(t, tt.declared, spdx.Packages[0].LicenseDeclared)
+				if tt.declared == "NOASSERTION" {
+					require.Contains(t, spdx.Packages[0].LicenseComments, tt.license)
+				}
+
+				buf.Reset()
+				require.NoError(t, WriteSBOM(&buf, SBOMFormatCycloneDX, created, wolfi, rp))
+				var cdx cyclonedxDoc
+				require.NoError(t, json.Unmarshal(buf.Bytes(), &cdx))
+				require.Equal(t, []cyclonedxLicense{tt.cdx}, cdx.Components[0].Licenses)
+			})
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		require.Error(t, WriteSBOM(&bytes.Buffer{}, "swid", created, wolfi, pkgs))
+	})
+}
+
+func TestSBOM(t *testing.T) {
+	a, err := New(WithFS(apkfs.NewMemFS()), WithIgnoreMknodErrors(true), WithBuildTime(time.Unix(0, 0)))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(context.Background()))
+	pkg := fakePackage(t, &Package{Name: "hello", Version: "1.0-r0"}, nil)
+	require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{pkg}))
+
+	b, err := a.SBOM(context.Background(), SBOMFormatCycloneDX)
+	require.NoError(t, err)
+	var doc cyclonedxDoc
+	require.NoError(t, json.Unmarshal(b, &doc))
+	require.Equal(t, "1970-01-01T00:00:00Z", doc.Metadata.Timestamp)
+	require.Len(t, doc.Components, 1)
+	require.Equal(t, "hello", doc.Components[0].Name)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = a.SBOM(ctx, SBOMFormatSPDX)
+	require.ErrorIs(t, err, context.Canceled)
+}
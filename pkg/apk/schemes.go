@@ -0,0 +1,285 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
+)
+
+// SchemeHandler makes a URL scheme other than https usable for repositories and keys, e.g.
+// gs://bucket/os: it rewrites a request to a URL of the scheme into an https request, with
+// credentials. It is given a copy of the request, which it modifies. See WithSchemeHandler.
+type SchemeHandler func(req *http.Request) error
+
+// defaultSchemeHandlers are the handlers of an APK unless replaced with WithSchemeHandler.
+func defaultSchemeHandlers() map[string]SchemeHandler {
+	return map[string]SchemeHandler{
+		"gs": GCSSchemeHandler(nil),
+		"s3": S3SchemeHandler(nil),
+	}
+}
+
+// schemeMiddleware rewrites requests to the URLs of the schemes of handlers.
+func schemeMiddleware(handlers map[string]SchemeHandler) RequestMiddleware {
+	return func(req *http.Request) error {
+		handler, ok := handlers[req.URL.Scheme]
+		if !ok {
+			return nil
+		}
+		scheme := req.URL.Scheme
+		if err := handler(req); err != nil {
+			return fmt.Errorf("%s URL: %w", scheme, err)
+		}
+		if req.URL.Scheme != "https" {
+			return fmt.Errorf("%s URL was rewritten to %s, not https", scheme, req.URL.Redacted())
+		}
+		req.Host = ""
+		return nil
+	}
+}
+
+// isRemote returns whether u is fetched over the network: an https URL, or a URL of one of
+// schemes.
+func isRemote(u string, schemes []string) bool {
+	if strings.HasPrefix(u, "https://") {
+		return true
+	}
+	for _, scheme := range schemes {
+		if strings.HasPrefix(u, scheme+"://") {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteSchemes returns the schemes other than https that the APK fetches, see
+// WithSchemeHandler.
+func (a *APK) remoteSchemes() []string {
+	schemes := make([]string, 0, len(a.schemeHandlers))
+	for scheme := range a.schemeHandlers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// isRemote returns whether u is fetched over the network by the APK.
+func (a *APK) isRemote(u string) bool {
+	return isRemote(u, a.remoteSchemes())
+}
+
+// GCSSchemeHandler returns a SchemeHandler for gs://bucket/object URLs of Google Cloud
+// Storage, which fetches them from https://storage.googleapis.com/bucket/object with a bearer
+// token from token, called with the host storage.googleapis.com. With a nil token, the
+// ambient credentials of the service account of the machine are used, from the metadata
+// server of Google Cloud, if there is one, or else none, for public buckets.
+func GCSSchemeHandler(token TokenFunc) SchemeHandler {
+	if token == nil {
+		token = (&gcsMetadataToken{}).token
+	}
+	return func(req *http.Request) error {
+		if req.URL.Host == "" {
+			return errors.New("no bucket")
+		}
+		u := &url.URL{
+			Scheme: "https",
+			Host:   "storage.googleapis.com",
+			Path:   "/" + req.URL.Host + req.URL.Path,
+		}
+		req.URL = u
+		if req.Header.Get("Authorization") != "" {
+			return nil
+		}
+		t, err := token(req.Context(), u.Host)
+		if err != nil {
+			return fmt.Errorf("getting token for %s: %w", u.Host, err)
+		}
+		if t != "" {
+			req.Header.Set("Authorization", "Bearer "+t)
+		}
+		return nil
+	}
+}
+
+// metadataRetryInterval is how long the scheme handlers go without ambient credentials after
+// a metadata server could not be reached, before trying it again.
+const metadataRetryInterval = time.Minute
+
+// gcsMetadataToken is the access token of the service account of the machine, from the
+// metadata server of Google Cloud.
+type gcsMetadataToken struct {
+	mu     sync.Mutex
+	value  string
+	expiry time.Time
+	// unavailableUntil is when to try the metadata server again, after it could not be
+	// reached.
+	unavailableUntil time.Time
+}
+
+// token returns the access token, or an empty string if there is no metadata server.
+func (t *gcsMetadataToken) token(ctx context.Context, _ string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Now().Before(t.unavailableUntil) {
+		return "", nil
+	}
+	if t.value != "" && time.Now().Add(time.Minute).Before(t.expiry) {
+		return t.value, nil
+	}
+
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// not on Google Cloud, or the metadata server is down for now
+		t.unavailableUntil = time.Now().Add(metadataRetryInterval)
+		return "", nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %d from the metadata server", res.StatusCode)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decoding token from the metadata server: %w", err)
+	}
+	t.value = body.AccessToken
+	t.expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	return t.value, nil
+}
+
+// S3SchemeHandler returns a SchemeHandler for s3://bucket/key URLs of Amazon S3, which
+// fetches them from https://bucket.s3.region.amazonaws.com/key, or from
+// https://s3.region.amazonaws.com/bucket/key for bucket names with dots, which the TLS
+// certificates of the virtual-hosted endpoints do not cover. Requests are signed with AWS
+// Signature Version 4 with the credentials of cfg, in its region, us-east-1 if it has none.
+// With a nil cfg, the default configuration of the AWS SDK is loaded on first use, with the
+// credentials of its default chain: the environment, the shared config and credentials
+// files, web identity, and the container and EC2 instance metadata endpoints. Without
+// credentials, requests are not signed, for public buckets.
+func S3SchemeHandler(cfg *aws.Config) SchemeHandler {
+	c := &s3Config{cfg: cfg}
+	return func(req *http.Request) error {
+		if req.URL.Host == "" {
+			return errors.New("no bucket")
+		}
+		creds, region, err := c.credentials(req.Context())
+		if err != nil {
+			return fmt.Errorf("getting credentials: %w", err)
+		}
+		bucket := req.URL.Host
+		if strings.Contains(bucket, ".") {
+			req.URL = &url.URL{
+				Scheme: "https",
+				Host:   fmt.Sprintf("s3.%s.amazonaws.com", region),
+				Path:   "/" + bucket + req.URL.Path,
+			}
+		} else {
+			req.URL = &url.URL{
+				Scheme: "https",
+				Host:   fmt.Sprintf("%s.s3.%s.amazonaws.com", bucket, region),
+				Path:   req.URL.Path,
+			}
+		}
+		req.Host = ""
+		if !creds.HasKeys() || req.Header.Get("Authorization") != "" {
+			return nil
+		}
+		return signS3Request(req.Context(), req, creds, region, time.Now())
+	}
+}
+
+// s3Config is the AWS configuration of an S3SchemeHandler.
+type s3Config struct {
+	mu  sync.Mutex
+	cfg *aws.Config
+	// anonymousUntil is when to try the EC2 instance metadata endpoint again, after it had
+	// no credentials.
+	anonymousUntil time.Time
+}
+
+// credentials returns the credentials and the region of requests, loading the default
+// configuration if there is none. The credentials are empty if the default chain finds none.
+func (c *s3Config) credentials(ctx context.Context) (aws.Credentials, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cfg == nil {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return aws.Credentials{}, "", fmt.Errorf("loading AWS configuration: %w", err)
+		}
+		c.cfg = &cfg
+	}
+	region := c.cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	if c.cfg.Credentials == nil || time.Now().Before(c.anonymousUntil) {
+		return aws.Credentials{}, region, nil
+	}
+
+	creds, err := c.cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		// The instance metadata endpoint is the last resort of the default chain: the
+		// other sources are not configured, and this is not an EC2 instance with a role.
+		if aws.IsCredentialsProvider(c.cfg.Credentials, (*ec2rolecreds.Provider)(nil)) {
+			c.anonymousUntil = time.Now().Add(metadataRetryInterval)
+			return aws.Credentials{}, region, nil
+		}
+		return aws.Credentials{}, "", err
+	}
+	return creds, region, nil
+}
+
+// emptySHA256 is the hex encoded sha256 of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// signS3Request signs req, which has no body, with AWS Signature Version 4 for S3 in region
+// at now.
+func signS3Request(ctx context.Context, req *http.Request, creds aws.Credentials, region string, now time.Time) error {
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	signer := v4.NewSigner(func(o *v4.SignerOptions) {
+		// S3 paths are escaped once, not twice as for the other services.
+		o.DisableURIPathEscaping = true
+	})
+	return signer.SignHTTP(ctx, creds, req, emptySHA256, "s3", region, now)
+}
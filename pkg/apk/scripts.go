@@ -0,0 +1,105 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+const (
+	scriptPreInstall  = ".pre-install"
+	scriptPostInstall = ".post-install"
+)
+
+// ScriptResult is the outcome of running a script of a package, see WithRunScripts.
+type ScriptResult struct {
+	Package string
+	Version string
+	// Script is the name of the script in the control section, like .post-install.
+	Script string
+	// Err is nil if the script succeeded.
+	Err error
+}
+
+// ScriptResults returns the results of the scripts run so far, in the order they ran.
+func (a *APK) ScriptResults() []ScriptResult {
+	a.scriptResultsMu.Lock()
+	defer a.scriptResultsMu.Unlock()
+	return append([]ScriptResult(nil), a.scriptResults...)
+}
+
+// runScript runs the script of pkg with the given name, if scripts are to be run and pkg
+// has it. Like apk-tools, the script is written to lib/apk/exec in the root, run with the
+// package version as argument, and removed.
+func (a *APK) runScript(ctx context.Context, pkg *Package, exp *expandapk.APKExpanded, name string) error {
+	script, err := fs.ReadFile(exp.ControlFS, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading %s script of %s: %w", name, pkg.Name, err)
+	}
+	if !a.runScripts {
+		a.emit(ctx, &ScriptSkipped{Package: pkg.Name, Script: name})
+		return nil
+	}
+
+	return a.execScript(ctx, pkg.Name, pkg.Version, name, script, pkg.Version)
+}
+
+// execScript writes script to lib/apk/exec in the root, runs it with args, removes it,
+// and records the result.
+func (a *APK) execScript(ctx context.Context, pkgName, version, name string, script []byte, args ...string) error {
+	_, span := otel.Tracer("go-apk").Start(ctx, "execScript", trace.WithAttributes(
+		attribute.String("package", pkgName),
+		attribute.String("script", name),
+	))
+	defer span.End()
+
+	if err := a.fs.MkdirAll(scriptsExecDir, 0o755); err != nil {
+		return fmt.Errorf("creating %s: %w", scriptsExecDir, err)
+	}
+	scriptPath := path.Join(scriptsExecDir, pkgName+"-"+version+name)
+	if err := a.fs.WriteFile(scriptPath, script, 0o755); err != nil {
+		return fmt.Errorf("writing %s script of %s: %w", name, pkgName, err)
+	}
+	defer a.fs.Remove(scriptPath) //nolint:errcheck
+
+	err := a.executor.Execute("/"+scriptPath, args...)
+	if err != nil {
+		err = fmt.Errorf("running %s script of %s: %w", name, pkgName, err)
+	}
+
+	a.scriptResultsMu.Lock()
+	a.scriptResults = append(a.scriptResults, ScriptResult{
+		Package: pkgName,
+		Version: version,
+		Script:  name,
+		Err:     err,
+	})
+	a.scriptResultsMu.Unlock()
+
+	return err
+}
@@ -0,0 +1,116 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// testExecutor records the scripts it runs, with their content, and fails those whose
+// content contains "fail".
+type testExecutor struct {
+	fs   apkfs.FullFS
+	runs []string
+}
+
+func (e *testExecutor) Execute(name string, arg ...string) error {
+	script, err := e.fs.ReadFile(strings.TrimPrefix(name, "/"))
+	if err != nil {
+		return err
+	}
+	e.runs = append(e.runs, name+" "+strings.Join(arg, " ")+": "+string(script))
+	if strings.Contains(string(script), "fail") {
+		return errors.New("exit status 1")
+	}
+	return nil
+}
+
+func TestRunScripts(t *testing.T) {
+	_, err := New(WithRunScripts(true))
+	require.ErrorContains(t, err, "WithExecutor")
+
+	testInstall := func(t *testing.T, scripts map[string][]byte) (*APK, *testExecutor, error) {
+		_, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		e := &testExecutor{fs: src}
+		a, err := New(WithFS(src), WithRunScripts(true), WithExecutor(e))
+		require.NoError(t, err)
+
+		pkg := fakePackageWithScripts(t, &Package{Name: "hello", Version: "1.0-r0"}, []testDirEntry{
+			{"etc", 0o755, true, nil, nil},
+			{"etc/hello", 0o644, false, []byte("hello"), nil},
+		}, scripts, nil)
+		err = a.InstallPackages(context.Background(), nil, []InstallablePackage{pkg})
+		return a, e, err
+	}
+
+	t.Run("success", func(t *testing.T) {
+		a, e, err := testInstall(t, map[string][]byte{
+			".pre-install":  []byte("pre"),
+			".post-install": []byte("post"),
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{
+			"/lib/apk/exec/hello-1.0-r0.pre-install 1.0-r0: pre",
+			"/lib/apk/exec/hello-1.0-r0.post-install 1.0-r0: post",
+		}, e.runs)
+		require.Equal(t, []ScriptResult{
+			{Package: "hello", Version: "1.0-r0", Script: ".pre-install"},
+			{Package: "hello", Version: "1.0-r0", Script: ".post-install"},
+		}, a.ScriptResults())
+
+		// The scripts are removed once run.
+		entries, err := e.fs.ReadDir(scriptsExecDir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+
+	t.Run("pre-install fails the install", func(t *testing.T) {
+		a, e, err := testInstall(t, map[string][]byte{".pre-install": []byte("fail")})
+		require.ErrorContains(t, err, "running .pre-install script of hello")
+		_, statErr := e.fs.Stat("etc/hello")
+		require.Error(t, statErr)
+		require.Len(t, a.ScriptResults(), 1)
+		require.Error(t, a.ScriptResults()[0].Err)
+	})
+
+	t.Run("post-install failure is recorded", func(t *testing.T) {
+		a, e, err := testInstall(t, map[string][]byte{".post-install": []byte("fail")})
+		require.NoError(t, err)
+		_, err = e.fs.Stat("etc/hello")
+		require.NoError(t, err)
+		require.Len(t, a.ScriptResults(), 1)
+		require.Error(t, a.ScriptResults()[0].Err)
+	})
+
+	t.Run("not run by default", func(t *testing.T) {
+		_, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		e := &testExecutor{fs: src}
+		a, err := New(WithFS(src), WithExecutor(e))
+		require.NoError(t, err)
+		pkg := fakePackageWithScripts(t, &Package{Name: "hello", Version: "1.0-r0"}, nil, map[string][]byte{".post-install": []byte("post")}, nil)
+		require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{pkg}))
+		require.Empty(t, e.runs)
+		require.Empty(t, a.ScriptResults())
+	})
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"cmp"
+	"path"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// SearchMatch is what a search query matched, from the best match to the worst.
+type SearchMatch int
+
+const (
+	// SearchMatchExact is a package named the query.
+	SearchMatchExact SearchMatch = iota
+	// SearchMatchName is a package whose name matches the query.
+	SearchMatchName
+	// SearchMatchProvides is a package that provides something that matches the query.
+	SearchMatchProvides
+	// SearchMatchDescription is a package whose description contains the query.
+	SearchMatchDescription
+)
+
+// SearchOptions are the options of PkgResolver.Search.
+type SearchOptions struct {
+	// Description also matches packages whose description contains the query, ignoring
+	// case, like "apk search -d".
+	Description bool
+	// Provides also matches packages that provide something that matches the query, such as
+	// "cmd:*python*".
+	Provides bool
+	// Origin, if set, is a glob, as in path.Match, that the origins of packages must match.
+	Origin string
+	// AllVersions returns every version of the packages that match, not only the newest,
+	// like "apk search -a".
+	AllVersions bool
+}
+
+// SearchResult is a package that matched a search.
+type SearchResult struct {
+	Package *RepositoryPackage
+	Match   SearchMatch
+	// Matched is the provided name, for SearchMatchProvides.
+	Matched string
+}
+
+// Search searches the packages in the indexes, like "apk search". The query is a glob, as in
+// path.Match; without any glob characters it matches names that contain it. Results are
+// ranked by how they matched, see SearchMatch, then sorted by name, then by version, newest
+// first. An invalid glob matches nothing.
+func (p *PkgResolver) Search(query string, opts SearchOptions) []SearchResult {
+	pattern := query
+	if !strings.ContainsAny(query, `*?[\`) {
+		pattern = "*" + query + "*"
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil
+	}
+	description := strings.ToLower(query)
+
+	var results []SearchResult
+	for name, pkgs := range p.nameMap {
+		for _, pkg := range pkgs {
+			// packages are in nameMap under what they provide as well, only look at them once
+			if pkg.Name != name {
+				continue
+			}
+			if opts.Origin != "" {
+				if ok, _ := path.Match(opts.Origin, pkg.Origin); !ok {
+					continue
+				}
+			}
+			if result, ok := p.searchMatch(pkg.RepositoryPackage, query, pattern, description, opts); ok {
+				results = append(results, result)
+			}
+		}
+	}
+
+	slices.SortStableFunc(results, func(a, b SearchResult) int {
+		if c := cmp.Compare(a.Match, b.Match); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.Package.Name, b.Package.Name); c != 0 {
+			return c
+		}
+		if c := versionOrder(b.Package.Version, a.Package.Version); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Package.URL(), b.Package.URL())
+	})
+	if opts.AllVersions {
+		return results
+	}
+	// only the newest of each package, which sorts first
+	seen := map[string]bool{}
+	return slices.DeleteFunc(results, func(r SearchResult) bool {
+		if seen[r.Package.Name] {
+			return true
+		}
+		seen[r.Package.Name] = true
+		return false
+	})
+}
+
+func (p *PkgResolver) searchMatch(pkg *RepositoryPackage, query, pattern, description string, opts SearchOptions) (SearchResult, bool) {
+	if pkg.Name == query {
+		return SearchResult{Package: pkg, Match: SearchMatchExact}, true
+	}
+	if ok, _ := path.Match(pattern, pkg.Name); ok {
+		return SearchResult{Package: pkg, Match: SearchMatchName}, true
+	}
+	if opts.Provides {
+		for _, prov := range pkg.Provides {
+			name := p.resolvePackageNameVersionPin(prov).name
+			if ok, _ := path.Match(pattern, name); ok {
+				return SearchResult{Package: pkg, Match: SearchMatchProvides, Matched: name}, true
+			}
+		}
+	}
+	if opts.Description && strings.Contains(strings.ToLower(pkg.Description), description) {
+		return SearchResult{Package: pkg, Match: SearchMatchDescription}, true
+	}
+	return SearchResult{}, false
+}
@@ -0,0 +1,71 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearch(t *testing.T) {
+	repo := Repository{URI: "main"}
+	index := repo.WithIndex(&APKIndex{Packages: []*Package{
+		{Name: "python3", Version: "3.12.0-r0", Origin: "python3", Description: "A high-level scripting language", Provides: []string{"cmd:python3"}},
+		{Name: "python3", Version: "3.11.6-r0", Origin: "python3", Description: "A high-level scripting language"},
+		{Name: "py3-pip", Version: "23.3-r0", Origin: "py3-pip", Description: "Tool for installing Python packages"},
+		{Name: "python3-dev", Version: "3.12.0-r0", Origin: "python3", Description: "Python headers"},
+		{Name: "pyenv", Version: "2.3-r0", Origin: "pyenv", Description: "Simple Python version management", Provides: []string{"cmd:python"}},
+	}})
+	resolver := NewPkgResolver(context.Background(), testNamedRepositoryFromIndexes([]*RepositoryWithIndex{index}))
+
+	search := func(query string, opts SearchOptions) (got []string) {
+		for _, r := range resolver.Search(query, opts) {
+			got = append(got, fmt.Sprintf("%s %d", r.Package.Filename(), r.Match))
+		}
+		return got
+	}
+
+	require.Equal(t, []string{
+		"python3-3.12.0-r0.apk 0",
+		"python3-dev-3.12.0-r0.apk 1",
+	}, search("python3", SearchOptions{}))
+
+	require.Equal(t, []string{
+		"python3-3.12.0-r0.apk 0",
+		"python3-3.11.6-r0.apk 0",
+		"python3-dev-3.12.0-r0.apk 1",
+	}, search("python3", SearchOptions{AllVersions: true}))
+
+	require.Equal(t, []string{
+		"py3-pip-23.3-r0.apk 1",
+	}, search("py*", SearchOptions{Origin: "py3-*"}))
+
+	require.Equal(t, []string{
+		"pyenv-2.3-r0.apk 2",
+		"python3-3.12.0-r0.apk 2",
+	}, search("cmd:python*", SearchOptions{Provides: true}))
+
+	require.Equal(t, []string{
+		"python3-3.12.0-r0.apk 1",
+		"python3-dev-3.12.0-r0.apk 1",
+		"py3-pip-23.3-r0.apk 3",
+		"pyenv-2.3-r0.apk 3",
+	}, search("python", SearchOptions{Description: true}))
+
+	require.Empty(t, search("[", SearchOptions{}))
+}
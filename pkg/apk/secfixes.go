@@ -0,0 +1,276 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"go.lsp.dev/uri"
+	"go.opentelemetry.io/otel"
+)
+
+// SecFixesMode is what resolving does about packages with vulnerabilities that a newer
+// version in the repositories fixes, see WithSecFixes.
+type SecFixesMode int
+
+const (
+	// SecFixesIgnore does not look at fixed vulnerabilities.
+	SecFixesIgnore SecFixesMode = iota
+	// SecFixesWarn logs every resolved package with a vulnerability that is fixed in a newer
+	// version in the repositories.
+	SecFixesWarn
+	// SecFixesFail does not resolve versions of packages with a vulnerability that is fixed
+	// in a newer version in the repositories, see NewSecFixesPolicy.
+	SecFixesFail
+)
+
+// SecDB is a security fixes database, as published for Alpine at
+// https://secdb.alpinelinux.org and for Wolfi: the versions of each package that fix
+// vulnerabilities, from the secfixes of the package builds.
+type SecDB struct {
+	// Fixes maps the names of packages, which are the origins of the packages in the
+	// repositories, to versions, to the vulnerabilities fixed in them. Version "0" lists
+	// the vulnerabilities that never affected the package.
+	Fixes map[string]map[string][]string
+}
+
+type secDBFile struct {
+	Packages []struct {
+		Pkg struct {
+			Name     string              `json:"name"`
+			Secfixes map[string][]string `json:"secfixes"`
+		} `json:"pkg"`
+	} `json:"packages"`
+}
+
+// ParseSecDB parses a security fixes database in the JSON format of secdb.alpinelinux.org.
+func ParseSecDB(r io.Reader) (*SecDB, error) {
+	var f secDBFile
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, fmt.Errorf("parsing secdb: %w", err)
+	}
+	db := &SecDB{Fixes: map[string]map[string][]string{}}
+	for _, p := range f.Packages {
+		db.add(p.Pkg.Name, p.Pkg.Secfixes)
+	}
+	return db, nil
+}
+
+func (db *SecDB) add(name string, secfixes map[string][]string) {
+	if db.Fixes == nil {
+		db.Fixes = map[string]map[string][]string{}
+	}
+	fixes, ok := db.Fixes[name]
+	if !ok {
+		fixes = map[string][]string{}
+		db.Fixes[name] = fixes
+	}
+	for version, vulns := range secfixes {
+		fixes[version] = uniqify(append(fixes[version], vulns...))
+	}
+}
+
+// Unfixed returns the vulnerabilities that affect the version of pkg, mapped to the lowest
+// version that fixes them. A vulnerability affects a version when every version that lists
+// it as fixed is newer.
+func (db *SecDB) Unfixed(pkg *Package) map[string]string {
+	name := pkg.Origin
+	if name == "" {
+		name = pkg.Name
+	}
+	fixes, ok := db.Fixes[name]
+	if !ok {
+		return nil
+	}
+	actual, err := parseVersion(pkg.Version)
+	if err != nil {
+		return nil
+	}
+
+	fixedIn := map[string]packageVersion{}
+	unfixed := map[string]string{}
+	fixed := map[string]bool{}
+	for version, vulns := range fixes {
+		if version == "0" {
+			continue
+		}
+		v, err := parseVersion(version)
+		if err != nil {
+			continue
+		}
+		for _, vuln := range vulns {
+			if compareVersions(actual, v) != less {
+				fixed[vuln] = true
+				continue
+			}
+			if lowest, ok := fixedIn[vuln]; !ok || compareVersions(v, lowest) == less {
+				fixedIn[vuln] = v
+				unfixed[vuln] = version
+			}
+		}
+	}
+	for vuln := range fixed {
+		delete(unfixed, vuln)
+	}
+	return unfixed
+}
+
+// FetchSecDB fetches the security fixes databases at sources, which are https:// URLs, or
+// local paths or file:// URLs, and returns them merged.
+func (a *APK) FetchSecDB(ctx context.Context, sources ...string) (*SecDB, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "FetchSecDB")
+	defer span.End()
+
+	db := &SecDB{Fixes: map[string]map[string][]string{}}
+	for _, source := range sources {
+		r, err := a.openSecDB(ctx, source)
+		if err != nil {
+			return nil, err
+		}
+		f, err := ParseSecDB(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		for name, fixes := range f.Fixes {
+			db.add(name, fixes)
+		}
+	}
+	return db, nil
+}
+
+func (a *APK) openSecDB(ctx context.Context, source string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(source, "https://") {
+		asURL, err := url.Parse(string(uri.New(source)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse secdb %s as URI: %w", source, err)
+		}
+		if asURL.Scheme != "file" {
+			return nil, fmt.Errorf("secdb scheme %s not supported", asURL.Scheme)
+		}
+		if asURL.Host != "" && asURL.Host != "localhost" {
+			return nil, fmt.Errorf("secdb %s is on another host %s", source, asURL.Host)
+		}
+		// local paths are file:// URLs now, with the path made absolute and unescaped
+		f, err := os.Open(asURL.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secdb: %w", err)
+		}
+		return f, nil
+	}
+
+	client := a.client
+	if client == nil {
+		client = a.httpConfig.client()
+	}
+	if a.cache != nil {
+		client = a.cache.client(client, true)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get secdb at %s: %w", source, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("unable to get secdb at %s: %v", source, res.Status)
+	}
+	return res.Body, nil
+}
+
+// secFixesPolicy is the Policy returned by NewSecFixesPolicy.
+type secFixesPolicy struct {
+	db *SecDB
+	// the newest version of each package in the indexes
+	newest map[string]packageVersion
+}
+
+// NewSecFixesPolicy returns a Policy that does not allow versions of packages with a
+// vulnerability in db that is fixed in a version of the package that is in indexes.
+// Vulnerabilities that no version in indexes fixes do not count, as there is nothing
+// better to resolve.
+func NewSecFixesPolicy(db *SecDB, indexes []NamedIndex) Policy {
+	s := &secFixesPolicy{db: db, newest: map[string]packageVersion{}}
+	for _, index := range indexes {
+		for _, pkg := range index.Packages() {
+			v, err := parseVersion(pkg.Version)
+			if err != nil {
+				continue
+			}
+			if newest, ok := s.newest[pkg.Name]; !ok || compareVersions(v, newest) == greater {
+				s.newest[pkg.Name] = v
+			}
+		}
+	}
+	return s
+}
+
+// fixable returns the vulnerabilities of pkg that a version in the indexes fixes, sorted,
+// as "<vulnerability> (fixed in <version>)".
+func (s *secFixesPolicy) fixable(pkg *Package) []string {
+	newest, ok := s.newest[pkg.Name]
+	if !ok {
+		return nil
+	}
+	var out []string
+	for vuln, version := range s.db.Unfixed(pkg) {
+		fixedIn, err := parseVersion(version)
+		if err != nil || compareVersions(newest, fixedIn) == less {
+			continue
+		}
+		out = append(out, fmt.Sprintf("%s (fixed in %s)", vuln, version))
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Evaluate implements Policy.
+func (s *secFixesPolicy) Evaluate(pkg *RepositoryPackage) *PolicyViolation {
+	vulns := s.fixable(pkg.Package)
+	if len(vulns) == 0 {
+		return nil
+	}
+	return &PolicyViolation{
+		Package: pkg,
+		Rule:    PolicyRuleSecurity,
+		Reason:  "vulnerable to " + strings.Join(vulns, ", "),
+	}
+}
+
+// warnSecFixes logs the resolved packages that are vulnerable to something a version in
+// indexes fixes, with SecFixesWarn.
+func (a *APK) warnSecFixes(ctx context.Context, indexes []NamedIndex, pkgs []*RepositoryPackage) {
+	if a.secDB == nil || a.secFixes != SecFixesWarn {
+		return
+	}
+	log := a.log(ctx)
+	s := NewSecFixesPolicy(a.secDB, indexes).(*secFixesPolicy)
+	for _, pkg := range pkgs {
+		if vulns := s.fixable(pkg.Package); len(vulns) != 0 {
+			log.Warnf("%s is vulnerable to %s", pkg.Filename(), strings.Join(vulns, ", "))
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testSecDB = `{
+  "distroversion": "v3.18",
+  "reponame": "main",
+  "packages": [
+    {"pkg": {"name": "openssl", "secfixes": {
+      "0": ["CVE-2020-0000"],
+      "3.1.2-r0": ["CVE-2023-3817"],
+      "3.1.4-r0": ["CVE-2023-5363", "CVE-2023-5678"]
+    }}},
+    {"pkg": {"name": "curl", "secfixes": {"8.4.0-r0": ["CVE-2023-38545"]}}}
+  ]
+}`
+
+func TestSecDB(t *testing.T) {
+	db, err := ParseSecDB(strings.NewReader(testSecDB))
+	require.NoError(t, err)
+
+	// subpackages are looked up by origin
+	require.Equal(t, map[string]string{
+		"CVE-2023-5363": "3.1.4-r0",
+		"CVE-2023-5678": "3.1.4-r0",
+	}, db.Unfixed(&Package{Name: "libcrypto3", Origin: "openssl", Version: "3.1.3-r0"}))
+	require.Len(t, db.Unfixed(&Package{Name: "openssl", Version: "3.1.1-r0"}), 3)
+	require.Empty(t, db.Unfixed(&Package{Name: "openssl", Version: "3.1.4-r0"}))
+	require.Empty(t, db.Unfixed(&Package{Name: "zlib", Version: "1.0-r0"}))
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.json")
+	require.NoError(t, os.WriteFile(path, []byte(testSecDB), 0o644))
+	a, err := New()
+	require.NoError(t, err)
+	fetched, err := a.FetchSecDB(context.Background(), path)
+	require.NoError(t, err)
+	require.Equal(t, db, fetched)
+
+	// file:// URLs are read from their path
+	spaced := filepath.Join(dir, "sec db.json")
+	require.NoError(t, os.WriteFile(spaced, []byte(testSecDB), 0o644))
+	fetched, err = a.FetchSecDB(context.Background(), (&url.URL{Scheme: "file", Path: spaced}).String())
+	require.NoError(t, err)
+	require.Equal(t, db, fetched)
+	_, err = a.FetchSecDB(context.Background(), "file://example.com"+path)
+	require.Error(t, err)
+}
+
+func TestSecFixesPolicy(t *testing.T) {
+	ctx := context.Background()
+	db, err := ParseSecDB(strings.NewReader(testSecDB))
+	require.NoError(t, err)
+
+	main := &RepositoryWithIndex{Repository: &Repository{URI: "main"}, index: &APKIndex{Packages: []*Package{
+		{Name: "openssl", Version: "3.1.3-r0"},
+		{Name: "curl", Version: "8.3.0-r0"},
+	}}}
+	updates := &RepositoryWithIndex{Repository: &Repository{URI: "updates"}, index: &APKIndex{Packages: []*Package{
+		{Name: "openssl", Version: "3.1.4-r0"},
+	}}}
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{main, updates})
+	resolver := NewPkgResolver(ctx, indexes, WithResolverPolicy(NewSecFixesPolicy(db, indexes)))
+
+	// the fixed version is resolved
+	pkgs, _, err := resolver.GetPackagesWithDependencies(ctx, []string{"openssl"})
+	require.NoError(t, err)
+	require.Equal(t, "3.1.4-r0", pkgs[0].Version)
+
+	// no version fixes curl, so it is resolved anyway
+	_, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"curl"})
+	require.NoError(t, err)
+
+	_, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"openssl=3.1.3-r0"})
+	var violation *PolicyViolation
+	require.True(t, errors.As(err, &violation), "error %v is not a policy violation", err)
+	require.Equal(t, PolicyRuleSecurity, violation.Rule)
+	require.Equal(t, "vulnerable to CVE-2023-5363 (fixed in 3.1.4-r0), CVE-2023-5678 (fixed in 3.1.4-r0)", violation.Reason)
+
+	_, err = New(WithSecFixes(nil, SecFixesFail))
+	require.Error(t, err)
+}
@@ -0,0 +1,290 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// Index shards are an optional sidecar of the APKINDEX.tar.gz of large repositories: its
+// packages split by the first letter of their names into indexes of their own, and a
+// manifest of the shards that have each name, in an archive of its own, all signed like it.
+// With WithIndexShards, GetRepositoryIndexes only fetches the shards that some packages and
+// their dependencies need, instead of the whole index.
+const (
+	indexShardsDir      = "APKINDEX.shards"
+	indexShardsManifest = "manifest.tar.gz"
+	// indexShardsManifestEntry is the manifest in its archive.
+	indexShardsManifestEntry = "manifest.json"
+)
+
+// indexShardManifest is the manifest of the shards of an index.
+type indexShardManifest struct {
+	// Names maps the names of packages, and the names they provide, to the shards with them.
+	Names map[string][]string `json:"names"`
+	// InstallIf are the shards with packages that have install_if rules. They are always
+	// fetched, as nothing depends on those packages by name.
+	InstallIf []string `json:"installIf,omitempty"`
+}
+
+// indexShard returns the shard of the packages named name.
+func indexShard(name string) string {
+	if name == "" {
+		return "_"
+	}
+	c := name[0]
+	if 'A' <= c && c <= 'Z' {
+		c += 'a' - 'A'
+	}
+	if ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') {
+		return string(c)
+	}
+	return "_"
+}
+
+// WriteIndexShards writes the packages of index as unsigned index shards with description,
+// and their manifest, to dir, the directory of the APKINDEX.tar.gz of the index. Sign every
+// shard, dir/APKINDEX.shards/<shard>.tar.gz, and the manifest,
+// dir/APKINDEX.shards/manifest.tar.gz, with signature.SignIndex, as the index itself.
+func WriteIndexShards(dir string, index NamedIndex, description string) error {
+	shards := map[string]*APKIndex{}
+	manifest := indexShardManifest{Names: map[string][]string{}}
+	add := func(name, shard string) {
+		if !slices.Contains(manifest.Names[name], shard) {
+			manifest.Names[name] = append(manifest.Names[name], shard)
+		}
+	}
+	for _, pkg := range index.Packages() {
+		shard := indexShard(pkg.Name)
+		apkindex, ok := shards[shard]
+		if !ok {
+			apkindex = &APKIndex{Description: description}
+			shards[shard] = apkindex
+		}
+		apkindex.Packages = append(apkindex.Packages, pkg.Package)
+
+		add(pkg.Name, shard)
+		for _, provide := range pkg.Provides {
+			add(resolvePackageNameVersionPin(provide).name, shard)
+		}
+		if len(pkg.InstallIf) != 0 && !slices.Contains(manifest.InstallIf, shard) {
+			manifest.InstallIf = append(manifest.InstallIf, shard)
+		}
+	}
+	for _, s := range manifest.Names {
+		sort.Strings(s)
+	}
+	sort.Strings(manifest.InstallIf)
+
+	shardsDir := filepath.Join(dir, indexShardsDir)
+	if err := os.MkdirAll(shardsDir, 0o755); err != nil {
+		return fmt.Errorf("creating %s: %w", shardsDir, err)
+	}
+	for shard, apkindex := range shards {
+		if err := writeIndexShard(filepath.Join(shardsDir, shard+".tar.gz"), apkindex); err != nil {
+			return err
+		}
+	}
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeIndexShardsManifest(filepath.Join(shardsDir, indexShardsManifest), append(b, '\n'))
+}
+
+// writeIndexShardsManifest writes the manifest b in an archive to path, to be signed.
+func writeIndexShardsManifest(path string, b []byte) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: indexShardsManifestEntry, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(b))}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+// readIndexShardsManifest returns the manifest in b, its archive, verified with keys unless
+// signatures are ignored.
+func readIndexShardsManifest(b []byte, keys map[string][]byte, opts *indexOpts) (*indexShardManifest, error) {
+	if !opts.ignoreSignatures {
+		if _, err := verifyIndexSignature(b, keys); err != nil {
+			return nil, err
+		}
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("no %s in the archive", indexShardsManifestEntry)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name != indexShardsManifestEntry {
+			continue
+		}
+		var manifest indexShardManifest
+		if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+			return nil, err
+		}
+		return &manifest, nil
+	}
+}
+
+func writeIndexShard(path string, apkindex *APKIndex) error {
+	archive, err := ArchiveFromIndex(apkindex)
+	if err != nil {
+		return fmt.Errorf("writing index shard %s: %w", path, err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, archive); err != nil {
+		f.Close()
+		return fmt.Errorf("writing index shard %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// WithIndexShards has GetRepositoryIndexes fetch only the index shards, see WriteIndexShards,
+// with the packages that provide names, their dependencies, and the packages with install_if
+// rules, from the repositories that have shards. The indexes of the other repositories are
+// fetched whole.
+func WithIndexShards(names ...string) IndexOption {
+	return func(o *indexOpts) {
+		o.shardNames = names
+	}
+}
+
+// getShardedIndex returns the packages of the shards of the repository at repoBase that
+// opts.shardNames need, or nil if the repository has no shards.
+func getShardedIndex(ctx context.Context, repoBase string, keys map[string][]byte, arch string, opts *indexOpts) (*APKIndex, error) {
+	shardsBase := fmt.Sprintf("%s/%s", repoBase, indexShardsDir)
+	b, err := readRepositoryFile(ctx, fmt.Sprintf("%s/%s", shardsBase, indexShardsManifest), opts)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	manifest, err := readIndexShardsManifest(b, keys, opts)
+	if err != nil {
+		return nil, fmt.Errorf("reading index shards manifest of %s: %w", repoBase, err)
+	}
+
+	var (
+		index   = &APKIndex{}
+		fetched = map[string]bool{}
+		// the packages of the fetched shards by their names and the names they provide
+		byName = map[string][]*Package{}
+		seen   = map[string]bool{}
+		queue  []string
+	)
+	need := func(deps []string) {
+		for _, dep := range deps {
+			if strings.HasPrefix(dep, "!") {
+				continue
+			}
+			name := resolvePackageNameVersionPin(dep).name
+			if !seen[name] {
+				seen[name] = true
+				queue = append(queue, name)
+			}
+		}
+	}
+	fetch := func(shard string) error {
+		if fetched[shard] {
+			return nil
+		}
+		fetched[shard] = true
+		u := fmt.Sprintf("%s/%s.tar.gz", shardsBase, shard)
+		shardIndex, err := globalIndexCache.get(ctx, u, keys, arch, opts)
+		if err != nil {
+			return err
+		}
+		if shardIndex == nil {
+			return fmt.Errorf("index shard %s is in the manifest but not found", u)
+		}
+		if len(fetched) == 1 {
+			// the shards are built and signed together
+			index.Description = shardIndex.Description
+			index.Timestamp = shardIndex.Timestamp
+			index.Verification = shardIndex.Verification
+		}
+		index.Packages = append(index.Packages, shardIndex.Packages...)
+		for _, pkg := range shardIndex.Packages {
+			byName[pkg.Name] = append(byName[pkg.Name], pkg)
+			for _, provide := range pkg.Provides {
+				name := resolvePackageNameVersionPin(provide).name
+				byName[name] = append(byName[name], pkg)
+			}
+		}
+		return nil
+	}
+
+	for _, shard := range manifest.InstallIf {
+		if err := fetch(shard); err != nil {
+			return nil, err
+		}
+	}
+	for _, pkg := range index.Packages {
+		if len(pkg.InstallIf) != 0 {
+			need(pkg.Dependencies)
+		}
+	}
+	need(opts.shardNames)
+	for len(queue) != 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, shard := range manifest.Names[name] {
+			if err := fetch(shard); err != nil {
+				return nil, err
+			}
+		}
+		for _, pkg := range byName[name] {
+			need(pkg.Dependencies)
+		}
+	}
+	return index, nil
+}
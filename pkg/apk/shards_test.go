@@ -0,0 +1,112 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+func TestIndexShards(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, testArch)
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+
+	repo := Repository{URI: dir}
+	index := NewNamedRepositoryWithIndex("", repo.WithIndex(&APKIndex{Packages: []*Package{
+		{Name: "app", Version: "1.0-r0", Dependencies: []string{"so:libfoo.so.1", "config>=2", "!conflict"}},
+		{Name: "libfoo", Version: "1.0-r0", Provides: []string{"so:libfoo.so.1=1"}},
+		{Name: "config", Version: "2.0-r0"},
+		{Name: "conflict", Version: "1.0-r0"},
+		{Name: "app-doc", Version: "1.0-r0", InstallIf: []string{"app", "docs"}},
+		{Name: "zlib", Version: "1.3-r0"},
+	}}))
+	require.NoError(t, WriteIndexShards(dir, index, "sharded"))
+	f, err := os.Create(filepath.Join(dir, indexFilename))
+	require.NoError(t, err)
+	require.NoError(t, WriteIndex(f, index, "whole"))
+	require.NoError(t, f.Close())
+
+	names := func(t *testing.T, options ...IndexOption) []string {
+		globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+		indexes, err := GetRepositoryIndexes(context.Background(), []string{root}, nil, testArch, append(options, WithIgnoreSignatures(true))...)
+		require.NoError(t, err)
+		require.Len(t, indexes, 1)
+		var got []string
+		for _, pkg := range indexes[0].Packages() {
+			got = append(got, pkg.Name)
+		}
+		sort.Strings(got)
+		return got
+	}
+
+	t.Run("sharded", func(t *testing.T) {
+		require.Equal(t, []string{"app", "app-doc", "config", "conflict", "libfoo"}, names(t, WithIndexShards("app")))
+		require.Equal(t, []string{"app", "app-doc", "zlib"}, names(t, WithIndexShards("zlib")))
+	})
+
+	t.Run("signed", func(t *testing.T) {
+		ctx := context.Background()
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		signingKey := filepath.Join(t.TempDir(), "test.rsa")
+		require.NoError(t, os.WriteFile(signingKey, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600))
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		require.NoError(t, err)
+		keys := map[string][]byte{"test.rsa.pub": pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})}
+
+		signed := t.TempDir()
+		signedDir := filepath.Join(signed, testArch)
+		require.NoError(t, WriteIndexShards(signedDir, index, "sharded"))
+		shards, err := filepath.Glob(filepath.Join(signedDir, indexShardsDir, "*.tar.gz"))
+		require.NoError(t, err)
+		for _, shard := range shards {
+			require.NoError(t, sign.SignIndex(ctx, signingKey, shard))
+		}
+
+		fetch := func() ([]NamedIndex, error) {
+			globalIndexCache = &indexCache{modtimes: map[string]time.Time{}}
+			return GetRepositoryIndexes(ctx, []string{signed}, keys, testArch, WithIndexShards("zlib"))
+		}
+		indexes, err := fetch()
+		require.NoError(t, err)
+		require.Len(t, indexes, 1)
+		require.Equal(t, 3, indexes[0].Count())
+
+		// an unsigned manifest, e.g. one that was tampered with, is not used
+		manifest := filepath.Join(signedDir, indexShardsDir, indexShardsManifest)
+		require.NoError(t, writeIndexShardsManifest(manifest, []byte(`{"names": {"zlib": ["a"]}}`)))
+		_, err = fetch()
+		require.ErrorContains(t, err, "index shards manifest")
+	})
+
+	t.Run("whole", func(t *testing.T) {
+		require.Len(t, names(t), 6)
+		require.NoError(t, os.RemoveAll(filepath.Join(dir, indexShardsDir)))
+		require.Len(t, names(t, WithIndexShards("app")), 6)
+	})
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/gzip"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+// verifyPackageSignature checks the signature section of an expanded v2 package against
+// its control section. The signature may use any algorithm supported by sign.Verify.
+func verifyPackageSignature(ctx context.Context, pkg InstallablePackage, exp *expandapk.APKExpanded, keys map[string][]byte) error {
+	_, span := otel.Tracer("go-apk").Start(ctx, "verifyPackageSignature", trace.WithAttributes(attribute.String("package", pkg.PackageName())))
+	defer span.End()
+
+	if exp.SignatureFile == "" {
+		return fmt.Errorf("package %s is not signed", pkg.PackageName())
+	}
+
+	sf, err := os.Open(exp.SignatureFile)
+	if err != nil {
+		return fmt.Errorf("opening signature file %q: %w", exp.SignatureFile, err)
+	}
+	defer sf.Close()
+
+	gz, err := gzip.NewReader(sf)
+	if err != nil {
+		return fmt.Errorf("unable to gunzip signature of %s: %w", pkg.PackageName(), err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("reading signature of %s: %w", pkg.PackageName(), err)
+	}
+	alg, keyName, ok := sign.ParseSignatureName(hdr.Name)
+	if !ok {
+		return fmt.Errorf("failed to find key name in signature file name: %s", hdr.Name)
+	}
+	signature, err := io.ReadAll(tr)
+	if err != nil {
+		return fmt.Errorf("reading signature of %s: %w", pkg.PackageName(), err)
+	}
+
+	// The signature covers the control section exactly as it appears in the package,
+	// i.e. the raw gzip stream.
+	control, err := os.ReadFile(exp.ControlFile)
+	if err != nil {
+		return fmt.Errorf("reading control file %q: %w", exp.ControlFile, err)
+	}
+
+	if err := sign.VerifyWithKeys(alg, keyName, control, signature, keys); err != nil {
+		return fmt.Errorf("verifying signature of %s: %w", pkg.PackageName(), err)
+	}
+
+	return nil
+}
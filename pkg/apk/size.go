@@ -0,0 +1,185 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// PackageSize is the installed size of a package, or of the closure of a requested package,
+// in a SizeReport.
+type PackageSize struct {
+	Name          string
+	InstalledSize uint64
+	// Chain is why the package is installed: the requested package that first needs it, then
+	// the dependencies down to the package. It is just the package for requested packages
+	// and packages added by install_if.
+	Chain []string
+}
+
+// SizeReport is the installed size of the packages of a resolution, see NewSizeReport.
+type SizeReport struct {
+	// Total is the installed size of all the packages.
+	Total uint64
+	// Packages are the packages, largest first.
+	Packages []PackageSize
+	// Requested are the closures of the requested packages: each one with all of its
+	// dependencies, largest first. Dependencies shared by several are counted in each.
+	Requested []PackageSize
+}
+
+func (r *SizeReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "total installed size %d bytes", r.Total)
+	for _, pkg := range r.Requested {
+		fmt.Fprintf(&sb, "\n  %s and its dependencies: %d bytes", pkg.Name, pkg.InstalledSize)
+	}
+	for _, pkg := range r.Packages {
+		fmt.Fprintf(&sb, "\n  %s: %d bytes (%s)", pkg.Name, pkg.InstalledSize, strings.Join(pkg.Chain, " -> "))
+	}
+	return sb.String()
+}
+
+// NewSizeReport returns the installed size of pkgs, as resolved for the requested packages,
+// e.g. by PkgResolver.GetPackagesWithDependencies for the world.
+func NewSizeReport(requested []string, pkgs []*RepositoryPackage) *SizeReport {
+	// the packages by their names and what they provide
+	providers := make(map[string]*RepositoryPackage, len(pkgs))
+	for _, pkg := range pkgs {
+		for _, provide := range pkg.Provides {
+			if name := resolvePackageNameVersionPin(provide).name; providers[name] == nil {
+				providers[name] = pkg
+			}
+		}
+	}
+	for _, pkg := range pkgs {
+		providers[pkg.Name] = pkg
+	}
+	dependencies := func(pkg *RepositoryPackage) []*RepositoryPackage {
+		var deps []*RepositoryPackage
+		for _, dep := range pkg.Dependencies {
+			if dep := providers[resolvePackageNameVersionPin(dep).name]; dep != nil && dep != pkg {
+				deps = append(deps, dep)
+			}
+		}
+		return deps
+	}
+
+	report := &SizeReport{}
+	chains := make(map[*RepositoryPackage][]string, len(pkgs))
+	for _, name := range requested {
+		root := providers[resolvePackageNameVersionPin(name).name]
+		if root == nil {
+			continue
+		}
+		// breadth first, so that chains are the shortest
+		closure := PackageSize{Name: root.Name}
+		seen := map[*RepositoryPackage]bool{root: true}
+		queue := []*RepositoryPackage{root}
+		if _, ok := chains[root]; !ok {
+			chains[root] = []string{root.Name}
+		}
+		for len(queue) != 0 {
+			pkg := queue[0]
+			queue = queue[1:]
+			closure.InstalledSize += pkg.InstalledSize
+			for _, dep := range dependencies(pkg) {
+				if seen[dep] {
+					continue
+				}
+				seen[dep] = true
+				queue = append(queue, dep)
+				if _, ok := chains[dep]; !ok {
+					chains[dep] = append(slices.Clone(chains[pkg]), dep.Name)
+				}
+			}
+		}
+		report.Requested = append(report.Requested, closure)
+	}
+
+	for _, pkg := range pkgs {
+		chain, ok := chains[pkg]
+		if !ok {
+			chain = []string{pkg.Name}
+		}
+		report.Total += pkg.InstalledSize
+		report.Packages = append(report.Packages, PackageSize{Name: pkg.Name, InstalledSize: pkg.InstalledSize, Chain: chain})
+	}
+	bySize := func(a, b PackageSize) int {
+		if c := cmp.Compare(b.InstalledSize, a.InstalledSize); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Name, b.Name)
+	}
+	slices.SortStableFunc(report.Packages, bySize)
+	slices.SortStableFunc(report.Requested, bySize)
+	return report
+}
+
+// SizeBudgetError is returned when the installed size of a resolution exceeds the budget
+// set with WithResolverSizeBudget or WithSizeBudget.
+type SizeBudgetError struct {
+	Budget uint64
+	Report *SizeReport
+}
+
+func (e *SizeBudgetError) Error() string {
+	return fmt.Sprintf("installed size %d bytes exceeds the budget of %d bytes: %s", e.Report.Total, e.Budget, e.Report)
+}
+
+// WithResolverSizeBudget fails GetPackagesWithDependencies with a *SizeBudgetError, along
+// with the resolved packages, when their total installed size exceeds budget bytes.
+// Default is no budget.
+func WithResolverSizeBudget(budget uint64) ResolverOption {
+	return func(p *PkgResolver) {
+		p.sizeBudget = budget
+	}
+}
+
+// checkSizeBudget returns a *SizeBudgetError if pkgs, resolved for requested, exceed the
+// size budget of the resolver.
+func (p *PkgResolver) checkSizeBudget(requested []string, pkgs []*RepositoryPackage) error {
+	if p.sizeBudget == 0 {
+		return nil
+	}
+	if report := NewSizeReport(requested, pkgs); report.Total > p.sizeBudget {
+		return &SizeBudgetError{Budget: p.sizeBudget, Report: report}
+	}
+	return nil
+}
+
+// SizeReport resolves the world, see ResolveWorld, and returns the installed size of the
+// resolution, whether or not it exceeds the budget set with WithSizeBudget.
+func (a *APK) SizeReport(ctx context.Context) (*SizeReport, error) {
+	toInstall, _, err := a.ResolveWorld(ctx)
+	var budgetErr *SizeBudgetError
+	if errors.As(err, &budgetErr) {
+		return budgetErr.Report, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	world, err := a.GetWorld()
+	if err != nil {
+		return nil, fmt.Errorf("error getting world packages: %w", err)
+	}
+	return NewSizeReport(world, toInstall), nil
+}
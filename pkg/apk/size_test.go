@@ -0,0 +1,106 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSizeBudget(t *testing.T) {
+	ctx := context.Background()
+	repo := Repository{URI: "repo"}
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{
+		repo.WithIndex(&APKIndex{Packages: []*Package{
+			{Name: "app", Version: "1.0-r0", InstalledSize: 100, Dependencies: []string{"so:libfoo.so.1"}},
+			{Name: "libfoo", Version: "1.0-r0", InstalledSize: 1000, Provides: []string{"so:libfoo.so.1=1"}, Dependencies: []string{"libc"}},
+			{Name: "libc", Version: "1.0-r0", InstalledSize: 500},
+			{Name: "tool", Version: "1.0-r0", InstalledSize: 10, Dependencies: []string{"libc"}},
+		}}),
+	})
+
+	resolver := NewPkgResolver(ctx, indexes)
+	pkgs, _, err := resolver.GetPackagesWithDependencies(ctx, []string{"app", "tool"})
+	require.NoError(t, err)
+
+	report := NewSizeReport([]string{"app", "tool"}, pkgs)
+	require.Equal(t, uint64(1610), report.Total)
+	require.Equal(t, []PackageSize{
+		{Name: "libfoo", InstalledSize: 1000, Chain: []string{"app", "libfoo"}},
+		{Name: "libc", InstalledSize: 500, Chain: []string{"app", "libfoo", "libc"}},
+		{Name: "app", InstalledSize: 100, Chain: []string{"app"}},
+		{Name: "tool", InstalledSize: 10, Chain: []string{"tool"}},
+	}, report.Packages)
+	require.Equal(t, []PackageSize{
+		{Name: "app", InstalledSize: 1600},
+		{Name: "tool", InstalledSize: 510},
+	}, report.Requested)
+
+	// within the budget
+	resolver = NewPkgResolver(ctx, indexes, WithResolverSizeBudget(1610))
+	_, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"app", "tool"})
+	require.NoError(t, err)
+
+	resolver = NewPkgResolver(ctx, indexes, WithResolverSizeBudget(1000))
+	got, _, err := resolver.GetPackagesWithDependencies(ctx, []string{"app", "tool"})
+	var budgetErr *SizeBudgetError
+	require.True(t, errors.As(err, &budgetErr), "expected a SizeBudgetError, got %v", err)
+	require.Equal(t, uint64(1000), budgetErr.Budget)
+	require.Equal(t, report, budgetErr.Report)
+	require.Equal(t, pkgs, got)
+}
+
+func TestProviderStrategySmallestClosure(t *testing.T) {
+	ctx := context.Background()
+	repo := Repository{URI: "repo"}
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{
+		repo.WithIndex(&APKIndex{Packages: []*Package{
+			{Name: "app", Version: "1.0-r0", InstalledSize: 100, Dependencies: []string{"cmd:sh"}},
+			{Name: "bash", Version: "5.2-r0", InstalledSize: 10, ProviderPriority: 200, Provides: []string{"cmd:sh=5.2-r0"}, Dependencies: []string{"readline"}},
+			{Name: "readline", Version: "8.2-r0", InstalledSize: 5000},
+			{Name: "busybox", Version: "1.36-r0", InstalledSize: 800, ProviderPriority: 100, Provides: []string{"cmd:sh=1.36-r0"}},
+			{Name: "dash", Version: "0.5-r0", InstalledSize: 400, Provides: []string{"cmd:sh=0.5-r0"}, Dependencies: []string{"libedit", "libtiny"}},
+			{Name: "libedit", Version: "1.0-r0", InstalledSize: 200},
+			{Name: "libtiny", Version: "1.0-r0", InstalledSize: 200},
+			{Name: "mksh", Version: "59-r0", InstalledSize: 800, Provides: []string{"cmd:sh=59-r0"}, Dependencies: []string{"libtiny"}},
+		}}),
+	})
+
+	names := func(pkgs []*RepositoryPackage) []string {
+		var names []string
+		for _, pkg := range pkgs {
+			names = append(names, pkg.Name)
+		}
+		return names
+	}
+
+	pkgs, _, err := NewPkgResolver(ctx, indexes).GetPackagesWithDependencies(ctx, []string{"app"})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"app", "bash", "readline"}, names(pkgs))
+
+	// busybox and dash add 800 bytes, but busybox adds fewer packages
+	resolver := NewPkgResolver(ctx, indexes, WithResolverProviderStrategy(ProviderStrategySmallestClosure))
+	pkgs, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"app"})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"app", "busybox"}, names(pkgs))
+
+	// with libtiny installed anyway, dash adds the fewest bytes
+	pkgs, _, err = resolver.GetPackagesWithDependencies(ctx, []string{"libtiny", "app"})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"app", "dash", "libedit", "libtiny"}, names(pkgs))
+}
@@ -0,0 +1,254 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+
+	"go.opentelemetry.io/otel"
+)
+
+// snapshotDirs are the directories with the state of an APK: the world, repositories, keys
+// and arch in etc/apk, and the installed database, triggers, scripts and ownership in
+// lib/apk/db.
+var snapshotDirs = []string{"etc/apk", "lib/apk/db"}
+
+// snapshotSkip are the files in snapshotDirs that are not state.
+var snapshotSkip = map[string]bool{"lib/apk/db/lock": true}
+
+// Snapshot is the state of an APK captured by APK.Snapshot, to be restored with
+// APK.Restore. It is immutable and may be restored any number of times, into any APK.
+type Snapshot struct {
+	// entries are the directories, files and symlinks in snapshotDirs, parents first.
+	entries []snapshotEntry
+	// installedFiles is the owning package of every installed file, for file conflicts.
+	installedFiles map[string]*Package
+	// owners are the owners recorded with WithIDMap that are not yet written.
+	owners map[string]owner
+	// cache is the cache of the APK, whose downloaded packages and indexes are reused.
+	cache *Cache
+}
+
+type snapshotEntry struct {
+	path   string
+	mode   fs.FileMode
+	data   []byte
+	target string
+}
+
+// Snapshot captures the state of the APK: the installed database, world, repositories,
+// keys and a reference to its cache. A builder can install a common base once, take a
+// snapshot, and restore it to run several divergent installs from the base.
+//
+// The files installed by packages are not part of the snapshot, so it must be restored
+// into a filesystem that has them, like a copy of the base or an fs.NewOverlayFS over it.
+func (a *APK) Snapshot(ctx context.Context) (*Snapshot, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "Snapshot")
+	defer span.End()
+
+	s := &Snapshot{
+		installedFiles: make(map[string]*Package, len(a.installedFiles)),
+		owners:         make(map[string]owner, len(a.owners)),
+		cache:          a.cache,
+	}
+	for name, pkg := range a.installedFiles {
+		s.installedFiles[name] = pkg
+	}
+	for name, o := range a.owners {
+		s.owners[name] = o
+	}
+
+	for _, dir := range snapshotDirs {
+		err := fs.WalkDir(a.fs, dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if snapshotSkip[p] {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			entry, err := a.captureEntry(p, info)
+			if err != nil {
+				return err
+			}
+			s.entries = append(s.entries, entry)
+			return nil
+		})
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("capturing %s: %w", dir, err)
+		}
+	}
+
+	a.log(ctx).Debugf("captured snapshot of %d files", len(s.entries))
+	return s, nil
+}
+
+// Restore replaces the state of the APK with the one captured by Snapshot: files in
+// etc/apk and lib/apk/db that are not in the snapshot are removed, and the others are
+// written back. If the APK has no cache, it uses the one of the snapshot.
+func (a *APK) Restore(ctx context.Context, s *Snapshot) error {
+	_, span := otel.Tracer("go-apk").Start(ctx, "Restore")
+	defer span.End()
+
+	keep := make(map[string]bool, len(s.entries))
+	for _, entry := range s.entries {
+		keep[entry.path] = true
+	}
+	for _, dir := range snapshotDirs {
+		var remove []string
+		err := fs.WalkDir(a.fs, dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !keep[p] && !snapshotSkip[p] {
+				remove = append(remove, p)
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+			}
+			return nil
+		})
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", dir, err)
+		}
+		for _, p := range remove {
+			if err := a.removeAll(p); err != nil {
+				return fmt.Errorf("removing %s: %w", p, err)
+			}
+		}
+	}
+
+	for _, entry := range s.entries {
+		if err := a.restoreEntry(entry); err != nil {
+			return fmt.Errorf("restoring %s: %w", entry.path, err)
+		}
+	}
+
+	a.installedFiles = make(map[string]*Package, len(s.installedFiles))
+	for name, pkg := range s.installedFiles {
+		a.installedFiles[name] = pkg
+	}
+	a.owners = nil
+	if len(s.owners) != 0 {
+		a.owners = make(map[string]owner, len(s.owners))
+		for name, o := range s.owners {
+			a.owners[name] = o
+		}
+	}
+	if a.cache == nil && s.cache != nil {
+		a.cache = &Cache{
+			dir:          s.cache.dir,
+			offline:      s.cache.offline,
+			maxSize:      s.cache.maxSize,
+			maxAge:       s.cache.maxAge,
+			indexTTL:     s.cache.indexTTL,
+			forceRefresh: s.cache.forceRefresh,
+			layout:       s.cache.layout,
+			apk:          a,
+		}
+	}
+
+	a.log(ctx).Debugf("restored snapshot of %d files", len(s.entries))
+	return nil
+}
+
+// captureEntry returns the snapshotEntry of the directory, file or symlink p, with info.
+func (a *APK) captureEntry(p string, info fs.FileInfo) (snapshotEntry, error) {
+	entry := snapshotEntry{path: p, mode: info.Mode()}
+	var err error
+	switch {
+	case info.IsDir():
+	case info.Mode()&fs.ModeSymlink != 0:
+		if entry.target, err = a.fs.Readlink(p); err != nil {
+			return entry, err
+		}
+	case info.Mode().IsRegular():
+		if entry.data, err = a.fs.ReadFile(p); err != nil {
+			return entry, err
+		}
+	default:
+		return entry, fmt.Errorf("unsupported file type %s", info.Mode().Type())
+	}
+	return entry, nil
+}
+
+func (a *APK) restoreEntry(entry snapshotEntry) error {
+	existing, err := a.fs.Lstat(entry.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if existing != nil && existing.Mode().Type() != entry.mode.Type() {
+		if err := a.removeAll(entry.path); err != nil {
+			return err
+		}
+		existing = nil
+	}
+
+	switch {
+	case entry.mode.IsDir():
+		if existing == nil {
+			if err := a.fs.MkdirAll(entry.path, entry.mode.Perm()); err != nil {
+				return err
+			}
+		}
+	case entry.mode&fs.ModeSymlink != 0:
+		if existing != nil {
+			if err := a.fs.Remove(entry.path); err != nil {
+				return err
+			}
+		}
+		return a.fs.Symlink(entry.target, entry.path)
+	default:
+		if err := a.fs.WriteFile(entry.path, entry.data, entry.mode.Perm()); err != nil {
+			return err
+		}
+	}
+	return a.fs.Chmod(entry.path, entry.mode.Perm())
+}
+
+// removeAll removes p and, if it is a directory, everything in it.
+func (a *APK) removeAll(p string) error {
+	var paths []string
+	if err := fs.WalkDir(a.fs, p, func(p string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, p)
+		return nil
+	}); err != nil {
+		return err
+	}
+	// children before their parents
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	for _, p := range paths {
+		if err := a.fs.Remove(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	a, src, err := testGetTestAPK()
+	require.NoError(t, err)
+	a.installedFiles["bin/busybox"] = &Package{Name: "busybox"}
+	a.cache = &Cache{dir: t.TempDir(), layout: CacheLayoutExploded}
+
+	installed, err := src.ReadFile(installedFilePath)
+	require.NoError(t, err)
+	require.NoError(t, src.MkdirAll("etc/apk/keys", 0o755))
+	require.NoError(t, src.WriteFile(worldFilePath, []byte("busybox\n"), 0o644))
+
+	snapshot, err := a.Snapshot(ctx)
+	require.NoError(t, err)
+
+	// diverge from the snapshot
+	require.NoError(t, src.WriteFile(worldFilePath, []byte("busybox\ncurl\n"), 0o600))
+	require.NoError(t, src.WriteFile(installedFilePath, []byte("P:curl\n\n"), 0o644))
+	require.NoError(t, src.MkdirAll("etc/apk/protected_paths.d", 0o755))
+	require.NoError(t, src.WriteFile("etc/apk/protected_paths.d/curl.list", []byte("-etc\n"), 0o644))
+	a.installedFiles["usr/bin/curl"] = &Package{Name: "curl"}
+
+	require.NoError(t, a.Restore(ctx, snapshot))
+	world, err := src.ReadFile(worldFilePath)
+	require.NoError(t, err)
+	require.Equal(t, "busybox\n", string(world))
+	info, err := src.Stat(worldFilePath)
+	require.NoError(t, err)
+	require.Equal(t, fs.FileMode(0o644), info.Mode().Perm())
+	b, err := src.ReadFile(installedFilePath)
+	require.NoError(t, err)
+	require.Equal(t, installed, b)
+	_, err = src.Stat("etc/apk/protected_paths.d")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.Equal(t, map[string]*Package{"bin/busybox": {Name: "busybox"}}, a.installedFiles)
+
+	// restore into another APK, which gets the cache of the snapshot
+	other, err := New(WithFS(apkfs.NewMemFS()))
+	require.NoError(t, err)
+	require.NoError(t, other.Restore(ctx, snapshot))
+	require.Equal(t, a.cache.dir, other.cache.dir)
+	require.Equal(t, CacheLayoutExploded, other.cache.layout)
+	world, err = other.fs.ReadFile(worldFilePath)
+	require.NoError(t, err)
+	require.Equal(t, "busybox\n", string(world))
+	db, err := other.InstalledDB()
+	require.NoError(t, err)
+	require.Len(t, db.Packages(), len(testInstalledPackages))
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"crypto/sha1" //nolint:gosec // apk-tools identifies packages by the sha1 of their control section
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Expanded packages are stored by the checksum of their control section, which is what
+// the APKINDEX identifies them by, rather than by the URL they were fetched from:
+//
+//	<root>/packages/sha1/<2 hex digits>/<40 hex digits>/
+//
+// so the same package fetched from different mirrors is only stored once. Every file in an
+// entry is named by its own hash, so verifying an entry is re-hashing its files.
+const packageStoreDir = "packages/sha1"
+
+// packageStoreDirForPackage returns the directory of the package in the store, or false if
+// the package has no checksum to key it by.
+func packageStoreDirForPackage(root string, pkg InstallablePackage) (string, bool) {
+	chk := pkg.ChecksumString()
+	if !strings.HasPrefix(chk, "Q1") || chk == "Q1" {
+		return "", false
+	}
+	checksum, err := base64.StdEncoding.DecodeString(chk[2:])
+	if err != nil || len(checksum) != sha1.Size {
+		return "", false
+	}
+	return packageStoreDirForChecksum(root, hex.EncodeToString(checksum)), true
+}
+
+func packageStoreDirForChecksum(root, hexsum string) string {
+	return filepath.Join(root, packageStoreDir, hexsum[:2], hexsum)
+}
+
+// packageCacheDir returns the directory the expanded package is cached in: its entry in
+// the store if it has a checksum, else a directory keyed by its URL.
+func (c *Cache) packageCacheDir(pkg InstallablePackage) (string, error) {
+	if dir, ok := packageStoreDirForPackage(c.dir, pkg); ok {
+		return dir, nil
+	}
+	return cacheDirForPackage(c.dir, pkg)
+}
+
+// verifyPackageStoreEntry checks that the control section in dir hashes to ctlHex and
+// that every data section hashes to the name it is stored under. An empty ctlHex, for
+// entries keyed by URL, checks the control section against its name instead.
+func verifyPackageStoreEntry(dir, ctlHex string) (bool, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, de := range des {
+		name := de.Name()
+		var (
+			want string
+			h    hash.Hash
+		)
+		switch {
+		case strings.HasSuffix(name, ".ctl.tar.gz"):
+			want, h = strings.TrimSuffix(name, ".ctl.tar.gz"), sha1.New() //nolint:gosec
+			if ctlHex != "" && want != ctlHex {
+				return false, nil
+			}
+		case strings.HasSuffix(name, ".dat.tar.gz"):
+			want, h = strings.TrimSuffix(name, ".dat.tar.gz"), sha256.New()
+		default:
+			continue
+		}
+
+		got, err := hashFile(filepath.Join(dir, name), h)
+		if err != nil {
+			return false, err
+		}
+		wantSum, err := hex.DecodeString(want)
+		if err != nil || !bytes.Equal(wantSum, got) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func hashFile(path string, h hash.Hash) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+func TestPackageStore(t *testing.T) {
+	ctx := context.Background()
+
+	f, err := os.Open("testdata/hello-0.1.0-r0.apk")
+	require.NoError(t, err)
+	exp, err := expandapk.ExpandApk(ctx, f, "")
+	require.NoError(t, err)
+	f.Close()
+	checksum := exp.ControlHash
+	exp.Close()
+
+	cacheDir := t.TempDir()
+	a, err := New(WithCache(cacheDir, false))
+	require.NoError(t, err)
+	transport := &testCountingTransport{wrapped: &testLocalTransport{root: "testdata", basenameOnly: true}}
+	a.SetClient(&http.Client{Transport: transport})
+
+	// The same package from two mirrors is downloaded and stored once.
+	var dirs []string
+	for _, mirror := range []string{"https://mirror-a.example.com/repo/x86_64", "https://mirror-b.example.com/repo/x86_64"} {
+		repo := &RepositoryWithIndex{Repository: &Repository{URI: mirror}}
+		pkg := NewRepositoryPackage(&Package{Name: "hello", Version: "0.1.0-r0", Checksum: checksum}, repo)
+		exp, err := expandPackage(ctx, a, pkg)
+		require.NoError(t, err)
+		dirs = append(dirs, exp.ControlFile)
+
+		dir, ok := packageStoreDirForPackage(cacheDir, pkg)
+		require.True(t, ok)
+		require.DirExists(t, dir)
+	}
+	require.Equal(t, int64(1), transport.requests.Load())
+	require.Equal(t, dirs[0], dirs[1])
+
+	corrupt, err := a.Cache().Verify(ctx, true)
+	require.NoError(t, err)
+	require.Empty(t, corrupt)
+
+	// Tampering with the data section is detected and the entry removed.
+	repo := &RepositoryWithIndex{Repository: &Repository{URI: "https://mirror-a.example.com/repo/x86_64"}}
+	pkg := NewRepositoryPackage(&Package{Name: "hello", Version: "0.1.0-r0", Checksum: checksum}, repo)
+	dir, _ := packageStoreDirForPackage(cacheDir, pkg)
+	exp, err = a.cachedPackage(ctx, pkg, dir)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(exp.PackageFile, []byte("garbage"), 0o644))
+
+	corrupt, err = a.Cache().Verify(ctx, false)
+	require.NoError(t, err)
+	require.Len(t, corrupt, 1)
+	require.Equal(t, dir, corrupt[0].Path)
+	require.False(t, corrupt[0].Removed)
+	require.DirExists(t, dir)
+
+	corrupt, err = a.Cache().Verify(ctx, true)
+	require.NoError(t, err)
+	require.Len(t, corrupt, 1)
+	require.True(t, corrupt[0].Removed)
+	require.NoDirExists(t, dir)
+}
@@ -0,0 +1,274 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+
+	"github.com/klauspost/compress/gzip"
+	"golang.org/x/sys/unix"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// StreamFS is a filesystem to install into, see WithFS, that writes the files of packages
+// straight to a tar stream as they are installed, rather than keeping them to be tarred
+// later. Everything else, such as the apk database, is kept in memory and appended to the
+// stream by Close.
+//
+// The directories and symlinks of packages can be read back, but not their files, so
+// package scripts cannot be run.
+type StreamFS struct {
+	apkfs.FullFS
+
+	tw *tar.Writer
+	gz *gzip.Writer
+
+	// path to the package that streamed it and its checksum
+	written map[string]streamedFile
+
+	diffID hash.Hash
+	digest hash.Hash
+	size   countWriter
+}
+
+type streamedFile struct {
+	pkg      *Package
+	checksum []byte
+}
+
+// LayerInfo describes the OCI layer written by a StreamFS from NewLayerStreamFS.
+type LayerInfo struct {
+	// DiffID is the digest of the uncompressed tar, as sha256:<hex>.
+	DiffID string
+	// Digest is the digest of the compressed layer, as sha256:<hex>.
+	Digest string
+	// Size is the size of the compressed layer in bytes.
+	Size int64
+}
+
+// NewStreamFS returns a StreamFS that writes a tar to w.
+func NewStreamFS(w io.Writer) *StreamFS {
+	return &StreamFS{
+		FullFS:  apkfs.NewMemFS(),
+		tw:      tar.NewWriter(w),
+		written: map[string]streamedFile{},
+	}
+}
+
+// NewLayerStreamFS returns a StreamFS that writes a gzipped tar to w, to be used as an OCI
+// image layer, see Layer.
+func NewLayerStreamFS(w io.Writer) *StreamFS {
+	s := &StreamFS{
+		FullFS:  apkfs.NewMemFS(),
+		written: map[string]streamedFile{},
+		diffID:  sha256.New(),
+		digest:  sha256.New(),
+	}
+	s.gz = gzip.NewWriter(io.MultiWriter(w, s.digest, &s.size))
+	s.tw = tar.NewWriter(io.MultiWriter(s.gz, s.diffID))
+	return s
+}
+
+// WriteHeader streams a file of pkg, with its contents from tfs, see WriteEntry.
+func (s *StreamFS) WriteHeader(hdr tar.Header, tfs fs.FS, pkg *Package) (bool, error) {
+	var r io.Reader = eofReader{}
+	if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+		f, err := tfs.Open(hdr.Name)
+		if err != nil {
+			return false, fmt.Errorf("opening %s: %w", hdr.Name, err)
+		}
+		defer f.Close()
+		r = f
+	}
+	return s.WriteEntry(&hdr, r, pkg)
+}
+
+// WriteEntry streams a file of pkg, with its contents from r, making StreamFS an
+// ExtractTarget. It reports whether the file was written, which it is not if an earlier
+// package already wrote the same contents or replaces pkg.
+func (s *StreamFS) WriteEntry(header *tar.Header, r io.Reader, pkg *Package) (bool, error) {
+	hdr := *header
+	name := cleanInstalledPath(hdr.Name)
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if _, ok := s.written[name]; ok {
+			return true, nil
+		}
+		// a symlink to a directory is accepted as is, see installAPKFiles
+		if fi, err := s.FullFS.Stat(name); err == nil && fi.IsDir() {
+			if lfi, err := s.FullFS.Lstat(name); err == nil && lfi.Mode()&fs.ModeSymlink != 0 {
+				return true, nil
+			}
+		}
+		if err := s.FullFS.MkdirAll(name, hdr.FileInfo().Mode().Perm()); err != nil {
+			return false, fmt.Errorf("error creating directory %s: %w", name, err)
+		}
+	case tar.TypeSymlink:
+		if target, err := s.FullFS.Readlink(name); err == nil && target == hdr.Linkname {
+			return true, nil
+		}
+		if err := s.FullFS.Symlink(hdr.Linkname, name); err != nil {
+			return false, fmt.Errorf("unable to install symlink from %s -> %s: %w", name, hdr.Linkname, err)
+		}
+	case tar.TypeReg:
+		checksum, err := checksumFromHeader(&hdr)
+		if err != nil {
+			return false, err
+		}
+		if prev, ok := s.written[name]; ok {
+			switch {
+			case checksum != nil && bytes.Equal(checksum, prev.checksum):
+				return false, nil
+			case replacesFile(prev.pkg, pkg) == replaceKeep:
+				return false, nil
+			case prev.pkg.Origin != pkg.Origin && replacesFile(prev.pkg, pkg) == replaceConflict:
+				return false, fmt.Errorf("unable to install file over existing one, different contents: %s", name)
+			}
+			// a later entry in a tar replaces an earlier one when extracted
+		}
+		s.written[name] = streamedFile{pkg: pkg, checksum: checksum}
+	case tar.TypeLink:
+	default:
+		return false, fmt.Errorf("unsupported file type %s %v", name, hdr.Typeflag)
+	}
+
+	if hdr.Typeflag != tar.TypeReg {
+		s.written[name] = streamedFile{pkg: pkg}
+	}
+	hdr.Name = name
+	if err := s.tw.WriteHeader(&hdr); err != nil {
+		return false, fmt.Errorf("writing header for %s: %w", name, err)
+	}
+	if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+		if _, err := io.CopyN(s.tw, r, hdr.Size); err != nil {
+			return false, fmt.Errorf("writing content for %s: %w", name, err)
+		}
+	}
+	return true, nil
+}
+
+// eofReader is the content of entries other than regular files.
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+// Close appends everything that was not streamed, such as the apk database, to the stream
+// and finishes it. Nothing can be installed after.
+func (s *StreamFS) Close() error {
+	if err := fs.WalkDir(s.FullFS, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == "." {
+			return nil
+		}
+		if _, ok := s.written[p]; ok {
+			return nil
+		}
+		return s.writeFromMemory(p, d)
+	}); err != nil {
+		return err
+	}
+
+	if err := s.tw.Close(); err != nil {
+		return err
+	}
+	if s.gz != nil {
+		return s.gz.Close()
+	}
+	return nil
+}
+
+// Layer returns the description of the layer written by a StreamFS from NewLayerStreamFS,
+// once it is closed.
+func (s *StreamFS) Layer() LayerInfo {
+	if s.gz == nil {
+		return LayerInfo{}
+	}
+	return LayerInfo{
+		DiffID: "sha256:" + hex.EncodeToString(s.diffID.Sum(nil)),
+		Digest: "sha256:" + hex.EncodeToString(s.digest.Sum(nil)),
+		Size:   int64(s.size),
+	}
+}
+
+func (s *StreamFS) writeFromMemory(p string, d fs.DirEntry) error {
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+	var link string
+	if info.Mode()&fs.ModeSymlink != 0 {
+		if link, err = s.FullFS.Readlink(p); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = p
+	if info.Mode()&fs.ModeCharDevice != 0 {
+		dev, err := s.FullFS.Readnod(p)
+		if err != nil {
+			return err
+		}
+		hdr.Devmajor = int64(unix.Major(uint64(dev)))
+		hdr.Devminor = int64(unix.Minor(uint64(dev)))
+	}
+	if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeDir {
+		if xattrs, err := s.FullFS.ListXattrs(p); err == nil {
+			for k, v := range xattrs {
+				if hdr.PAXRecords == nil {
+					hdr.PAXRecords = map[string]string{}
+				}
+				hdr.PAXRecords[xattrTarPAXRecordsPrefix+k] = string(v)
+			}
+		}
+	}
+	if err := s.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("writing header for %s: %w", p, err)
+	}
+	if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+		f, err := s.FullFS.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.Copy(s.tw, f); err != nil {
+			return fmt.Errorf("writing content for %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// countWriter counts the bytes written to it.
+type countWriter int64
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	*c += countWriter(len(p))
+	return len(p), nil
+}
+
+var _ WriteHeaderer = (*StreamFS)(nil)
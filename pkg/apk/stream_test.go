@@ -0,0 +1,100 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamFS(t *testing.T) {
+	install := func(t *testing.T, s *StreamFS) {
+		a, err := New(WithFS(s), WithIgnoreMknodErrors(true))
+		require.NoError(t, err)
+		require.NoError(t, a.InitDB(context.Background()))
+
+		first := fakePackage(t, &Package{Name: "first", Version: "1.0-r0"}, []testDirEntry{
+			{"etc", 0o755, true, nil, nil},
+			{"etc/a", 0o644, false, []byte("a"), nil},
+		})
+		second := fakePackage(t, &Package{Name: "second", Version: "1.0-r0"}, []testDirEntry{
+			{"etc", 0o755, true, nil, nil},
+			{"etc/b", 0o600, false, []byte("b"), nil},
+		})
+		require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{first, second}))
+		require.NoError(t, s.Close())
+	}
+
+	readTar := func(t *testing.T, r io.Reader) map[string]string {
+		entries := map[string]string{}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			_, dup := entries[hdr.Name]
+			require.False(t, dup, "duplicate entry %s", hdr.Name)
+			b, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			entries[hdr.Name] = string(b)
+		}
+		return entries
+	}
+
+	t.Run("tar", func(t *testing.T) {
+		var buf bytes.Buffer
+		install(t, NewStreamFS(&buf))
+
+		entries := readTar(t, &buf)
+		require.Equal(t, "a", entries["etc/a"])
+		require.Equal(t, "b", entries["etc/b"])
+		require.Contains(t, entries, "etc")
+		require.Contains(t, entries, "dev/null")
+		require.Contains(t, entries[installedFilePath], "P:first\n")
+		require.Contains(t, entries[installedFilePath], "P:second\n")
+	})
+
+	t.Run("layer", func(t *testing.T) {
+		var buf bytes.Buffer
+		s := NewLayerStreamFS(&buf)
+		install(t, s)
+
+		compressed := buf.Bytes()
+		digest := sha256.Sum256(compressed)
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		require.NoError(t, err)
+		uncompressed, err := io.ReadAll(zr)
+		require.NoError(t, err)
+		diffID := sha256.Sum256(uncompressed)
+
+		require.Equal(t, LayerInfo{
+			DiffID: "sha256:" + hex.EncodeToString(diffID[:]),
+			Digest: "sha256:" + hex.EncodeToString(digest[:]),
+			Size:   int64(len(compressed)),
+		}, s.Layer())
+		require.Equal(t, "a", readTar(t, bytes.NewReader(uncompressed))["etc/a"])
+	})
+}
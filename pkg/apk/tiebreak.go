@@ -0,0 +1,91 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"cmp"
+	"fmt"
+)
+
+// TieBreak is how the resolver chooses between candidates that are otherwise equal: the
+// same version of the same package in more than one repository.
+type TieBreak int
+
+const (
+	// TieBreakRepositoryOrder prefers the repository that comes first in the indexes of the
+	// resolver, which is the order of /etc/apk/repositories.
+	TieBreakRepositoryOrder TieBreak = iota
+	// TieBreakRepositoryPriority prefers the repository with the highest priority, see
+	// WithResolverRepositoryPriorities, then the repository order. Repositories without a
+	// priority have priority 0.
+	TieBreakRepositoryPriority
+	// TieBreakAlphabetical prefers the repository whose URI sorts first.
+	TieBreakAlphabetical
+)
+
+func (t TieBreak) String() string {
+	switch t {
+	case TieBreakRepositoryOrder:
+		return "repository-order"
+	case TieBreakRepositoryPriority:
+		return "repository-priority"
+	case TieBreakAlphabetical:
+		return "alphabetical"
+	default:
+		return fmt.Sprintf("TieBreak(%d)", int(t))
+	}
+}
+
+// WithResolverTieBreak sets how the resolver chooses between otherwise equal candidates.
+// Default is TieBreakRepositoryOrder.
+func WithResolverTieBreak(tieBreak TieBreak) ResolverOption {
+	return func(p *PkgResolver) {
+		p.tieBreak = tieBreak
+	}
+}
+
+// WithResolverRepositoryPriorities sets the priorities of repositories by URI, as in
+// /etc/apk/repositories without the tag, and breaks ties with TieBreakRepositoryPriority.
+func WithResolverRepositoryPriorities(priorities map[string]int) ResolverOption {
+	return func(p *PkgResolver) {
+		p.tieBreak = TieBreakRepositoryPriority
+		p.priorities = priorities
+	}
+}
+
+// breakTie compares candidates a and b that are otherwise equal, as comparePackages does.
+func (p *PkgResolver) breakTie(a, b *repositoryPackage) int {
+	if c := p.breakDuplicateTie(a, b); c != 0 {
+		return c
+	}
+	switch p.tieBreak {
+	case TieBreakRepositoryPriority:
+		if c := cmp.Compare(p.priorities[repositoryURI(b)], p.priorities[repositoryURI(a)]); c != 0 {
+			return c
+		}
+	case TieBreakAlphabetical:
+		if c := cmp.Compare(repositoryURI(a), repositoryURI(b)); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(a.order, b.order)
+}
+
+func repositoryURI(pkg *repositoryPackage) string {
+	if repo := pkg.Repository(); repo != nil && repo.Repository != nil {
+		return repo.URI
+	}
+	return ""
+}
@@ -0,0 +1,140 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// HostTLS is the TLS configuration of the requests to a host, e.g. a mirror that requires
+// mutual TLS or has a certificate from a private CA, see WithHostTLS.
+type HostTLS struct {
+	// CertFile and KeyFile are the PEM files of a client certificate and its key, for
+	// mutual TLS.
+	CertFile string `json:"cert,omitempty"`
+	KeyFile  string `json:"key,omitempty"`
+	// CAFile is a PEM bundle of the certificate authorities that are trusted for the host,
+	// in addition to those of the system.
+	CAFile string `json:"ca,omitempty"`
+	// InsecureSkipVerify does not verify the certificate of the host at all. Every request
+	// to the host logs a warning.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+}
+
+// config returns the tls.Config of h.
+func (h HostTLS) config() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: h.InsecureSkipVerify, //nolint:gosec // opt-in, and logged on every request
+	}
+	if h.CertFile != "" || h.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(h.CertFile, h.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if h.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		b, err := os.ReadFile(h.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates in CA bundle %s", h.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// tlsFile is the format of the file of WithHostTLSFile.
+type tlsFile struct {
+	Hosts map[string]HostTLS `json:"hosts"`
+}
+
+// loadTLSFile reads the TLS configuration of hosts from the JSON file at path. Relative
+// paths in it are relative to its directory, not to the working directory.
+func loadTLSFile(path string) (map[string]HostTLS, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading TLS configuration %s: %w", path, err)
+	}
+	var f tlsFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("parsing TLS configuration %s: %w", path, err)
+	}
+	dir := filepath.Dir(path)
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	for host, h := range f.Hosts {
+		h.CertFile, h.KeyFile, h.CAFile = resolve(h.CertFile), resolve(h.KeyFile), resolve(h.CAFile)
+		f.Hosts[host] = h
+	}
+	return f.Hosts, nil
+}
+
+// hostTLSTransport sends requests to hosts with a TLS configuration of their own with
+// transports of their own, and all others with wrapped.
+type hostTLSTransport struct {
+	wrapped http.RoundTripper
+	hosts   map[string]*http.Transport
+}
+
+// newHostTLSTransport returns base if configs is empty, else a hostTLSTransport with clones
+// of base for the hosts of configs.
+func newHostTLSTransport(base *http.Transport, configs map[string]*tls.Config) http.RoundTripper {
+	if len(configs) == 0 {
+		return base
+	}
+	t := &hostTLSTransport{wrapped: base, hosts: make(map[string]*http.Transport, len(configs))}
+	for host, cfg := range configs {
+		ht := base.Clone()
+		ht.TLSClientConfig = cfg
+		t.hosts[host] = ht
+	}
+	return t
+}
+
+func (t *hostTLSTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.URL == nil {
+		return t.wrapped.RoundTrip(request)
+	}
+	// as for credentials, host:port first, then the hostname alone
+	for _, host := range []string{request.URL.Host, request.URL.Hostname()} {
+		if ht, ok := t.hosts[host]; ok {
+			if ht.TLSClientConfig.InsecureSkipVerify && request.URL.Scheme == "https" {
+				clog.FromContext(request.Context()).Warnf("INSECURE: not verifying the TLS certificate of %s for %s", request.URL.Host, request.URL)
+			}
+			return ht.RoundTrip(request)
+		}
+	}
+	return t.wrapped.RoundTrip(request)
+}
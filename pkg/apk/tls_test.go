@@ -0,0 +1,145 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestClientCert writes a self-signed client certificate and its key to dir.
+func writeTestClientCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "apk-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile = filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func TestHostTLS(t *testing.T) {
+	dir := t.TempDir()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert, MinVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	defer srv.Close()
+	host := srv.Listener.Addr().String()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600))
+	certFile, keyFile := writeTestClientCert(t, dir)
+
+	maxRetries := 1
+	get := func(t *testing.T, options ...Option) (int, error) {
+		a, err := New(append(options, WithRetryPolicy(RetryPolicy{MaxRetries: &maxRetries, MinBackoff: time.Millisecond}))...)
+		require.NoError(t, err)
+		res, err := a.client.Get(srv.URL)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+
+	t.Run("untrusted", func(t *testing.T) {
+		_, err := get(t)
+		require.Error(t, err)
+	})
+
+	t.Run("ca", func(t *testing.T) {
+		status, err := get(t, WithHostTLS(host, HostTLS{CAFile: caFile}))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusUnauthorized, status)
+
+		// other hosts are not affected
+		_, err = get(t, WithHostTLS("other.example.com", HostTLS{CAFile: caFile}))
+		require.Error(t, err)
+	})
+
+	t.Run("client certificate", func(t *testing.T) {
+		status, err := get(t, WithHostTLS(host, HostTLS{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("insecure", func(t *testing.T) {
+		status, err := get(t, WithHostTLS("127.0.0.1", HostTLS{InsecureSkipVerify: true}))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusUnauthorized, status)
+	})
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(dir, "tls.json")
+		require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(`{"hosts": {%q: {"cert": %q, "key": %q, "ca": %q}}}`, host, certFile, keyFile, caFile)), 0o600))
+		status, err := get(t, WithHostTLSFile(path))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, status)
+
+		// relative paths are relative to the file, whatever the working directory
+		rel := func(p string) string {
+			r, err := filepath.Rel(dir, p)
+			require.NoError(t, err)
+			return r
+		}
+		require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(`{"hosts": {%q: {"cert": %q, "key": %q, "ca": %q}}}`, host, rel(certFile), rel(keyFile), rel(caFile))), 0o600))
+		wd, err := os.Getwd()
+		require.NoError(t, err)
+		require.NoError(t, os.Chdir(t.TempDir()))
+		t.Cleanup(func() { _ = os.Chdir(wd) })
+		status, err = get(t, WithHostTLSFile(path))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := New(WithHostTLS(host, HostTLS{CAFile: keyFile}))
+		require.Error(t, err)
+		_, err = New(WithHostTLS(host, HostTLS{CertFile: certFile}))
+		require.Error(t, err)
+	})
+}
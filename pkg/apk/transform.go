@@ -0,0 +1,167 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// FileTransform changes a file of a package as it is extracted, e.g. to strip a binary,
+// rewrite its path or drop its setuid bit, see WithFileTransform. It is given the header of
+// the file, which it may modify, and its content, which is empty but for regular files. It
+// returns the header and content to install, or skip to not install the file at all.
+//
+// When it returns a different reader, the content is read to its end and the size and
+// checksum of the file are those of the new content; otherwise the size must not change.
+type FileTransform func(hdr *tar.Header, r io.Reader) (newHdr *tar.Header, newReader io.Reader, skip bool, err error)
+
+// DropSetuid is a FileTransform that clears the setuid and setgid bits of files.
+func DropSetuid() FileTransform {
+	return func(hdr *tar.Header, r io.Reader) (*tar.Header, io.Reader, bool, error) {
+		hdr.Mode &^= 0o6000
+		return hdr, r, false, nil
+	}
+}
+
+// contentReader is the content of a file as given to the transforms, to tell whether they
+// replaced it.
+type contentReader struct {
+	io.Reader
+}
+
+// transformFile runs the transforms set with WithFileTransform on the entry header of a
+// package, with content r. It returns the header to install, the new content if a transform
+// changed it, or nil, and whether the file is skipped. New content is read into memory, and
+// the header gets its size and checksum.
+func (a *APK) transformFile(header *tar.Header, r io.Reader) (*tar.Header, *bytes.Reader, bool, error) {
+	if len(a.fileTransforms) == 0 {
+		return header, nil, false, nil
+	}
+	name := header.Name
+	hdr := *header
+	orig := &contentReader{Reader: r}
+	var (
+		out  io.Reader = orig
+		skip bool
+		err  error
+	)
+	for _, transform := range a.fileTransforms {
+		var next *tar.Header
+		if next, out, skip, err = transform(&hdr, out); err != nil {
+			return nil, nil, false, fmt.Errorf("transforming %s: %w", name, err)
+		}
+		if skip {
+			return header, nil, true, nil
+		}
+		if next == nil || out == nil {
+			return nil, nil, false, fmt.Errorf("transforming %s: no header or content", name)
+		}
+		hdr = *next
+	}
+	if cr, ok := out.(*contentReader); ok && cr == orig {
+		return &hdr, nil, false, nil
+	}
+
+	var buf bytes.Buffer
+	h := sha1.New() //nolint:gosec // this is what apk tools is using
+	if _, err := io.Copy(io.MultiWriter(&buf, h), out); err != nil {
+		return nil, nil, false, fmt.Errorf("transforming %s: %w", name, err)
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		hdr.Size = int64(buf.Len())
+		records := make(map[string]string, len(hdr.PAXRecords)+1)
+		for k, v := range hdr.PAXRecords {
+			records[k] = v
+		}
+		records[paxRecordsChecksumKey] = hex.EncodeToString(h.Sum(nil))
+		hdr.PAXRecords = records
+		if hdr.Format == tar.FormatUSTAR {
+			hdr.Format = tar.FormatPAX
+		}
+	}
+	return &hdr, bytes.NewReader(buf.Bytes()), false, nil
+}
+
+// transformFS serves the files of a package as changed by the transforms, see
+// lazilyInstallAPKFiles: under their new paths, with their new content.
+type transformFS struct {
+	fs.FS
+	// names are the paths the files had before they were transformed, by their new path
+	names map[string]string
+	// content is the new content of files, by their new path
+	content map[string]transformedFile
+}
+
+type transformedFile struct {
+	hdr  tar.Header
+	data []byte
+}
+
+func (t *transformFS) Open(name string) (fs.File, error) {
+	if f, ok := t.content[name]; ok {
+		return &transformedFileReader{Reader: bytes.NewReader(f.data), info: f.hdr.FileInfo()}, nil
+	}
+	if orig, ok := t.names[name]; ok {
+		name = orig
+	}
+	return t.FS.Open(name)
+}
+
+// transformLazily runs transformFile on the entry header of a package, whose content is in
+// t, and records what changed in t.
+func (a *APK) transformLazily(t *transformFS, header tar.Header) (tar.Header, bool, error) {
+	if len(a.fileTransforms) == 0 {
+		return header, false, nil
+	}
+	var r io.Reader = strings.NewReader("")
+	if header.Typeflag == tar.TypeReg {
+		f, err := t.FS.Open(header.Name)
+		if err != nil {
+			return header, false, fmt.Errorf("opening %s: %w", header.Name, err)
+		}
+		defer f.Close()
+		r = f
+	}
+	hdr, content, skip, err := a.transformFile(&header, r)
+	if err != nil || skip {
+		return header, skip, err
+	}
+	if hdr.Name != header.Name {
+		t.names[hdr.Name] = header.Name
+	}
+	if content != nil {
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return header, false, err
+		}
+		t.content[hdr.Name] = transformedFile{hdr: *hdr, data: data}
+	}
+	return *hdr, false, nil
+}
+
+type transformedFileReader struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f *transformedFileReader) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *transformedFileReader) Close() error               { return nil }
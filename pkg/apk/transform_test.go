@@ -0,0 +1,128 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileTransform(t *testing.T) {
+	ctx := context.Background()
+
+	newPackage := func() InstallablePackage {
+		return fakePackage(t, &Package{Name: "hello", Version: "1.0-r0"}, []testDirEntry{
+			{"usr", 0o755, true, nil, nil},
+			{"usr/bin", 0o755, true, nil, nil},
+			{"usr/bin/hello", 0o4755, false, []byte("hello with symbols"), nil},
+			{"usr/bin/hello.debug", 0o644, false, []byte("debug"), nil},
+			{"usr/bin/hello.sh", 0o755, false, []byte("#!/bin/sh"), nil},
+		})
+	}
+	transforms := []Option{
+		WithFileTransform(DropSetuid()),
+		// strips the symbols of hello
+		WithFileTransform(func(hdr *tar.Header, r io.Reader) (*tar.Header, io.Reader, bool, error) {
+			if hdr.Name != "usr/bin/hello" {
+				return hdr, r, false, nil
+			}
+			b, err := io.ReadAll(r)
+			if err != nil {
+				return nil, nil, false, err
+			}
+			return hdr, strings.NewReader(strings.TrimSuffix(string(b), " with symbols")), false, nil
+		}),
+		// drops debug files and renames scripts
+		WithFileTransform(func(hdr *tar.Header, r io.Reader) (*tar.Header, io.Reader, bool, error) {
+			if strings.HasSuffix(hdr.Name, ".debug") {
+				return nil, nil, true, nil
+			}
+			if name, ok := strings.CutSuffix(hdr.Name, ".sh"); ok {
+				hdr.Name = name + "-script"
+			}
+			return hdr, r, false, nil
+		}),
+	}
+
+	t.Run("files", func(t *testing.T) {
+		_, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		a, err := New(append(transforms, WithFS(src))...)
+		require.NoError(t, err)
+		require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{newPackage()}))
+
+		b, err := src.ReadFile("usr/bin/hello")
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(b))
+		fi, err := src.Stat("usr/bin/hello")
+		require.NoError(t, err)
+		require.Equal(t, fs.FileMode(0o755), fi.Mode().Perm())
+		require.Zero(t, fi.Mode()&fs.ModeSetuid)
+		b, err = src.ReadFile("usr/bin/hello-script")
+		require.NoError(t, err)
+		require.Equal(t, "#!/bin/sh", string(b))
+		for _, name := range []string{"usr/bin/hello.sh", "usr/bin/hello.debug"} {
+			_, err = src.Stat(name)
+			require.ErrorIs(t, err, fs.ErrNotExist, name)
+		}
+
+		db, err := a.InstalledDB()
+		require.NoError(t, err)
+		installed, ok := db.Package("hello")
+		require.True(t, ok)
+		require.Equal(t, []string{"usr/bin/hello.debug"}, installed.Omitted)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		var buf bytes.Buffer
+		s := NewStreamFS(&buf)
+		a, err := New(append(transforms, WithFS(s), WithIgnoreMknodErrors(true))...)
+		require.NoError(t, err)
+		require.NoError(t, a.InitDB(ctx))
+		require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{newPackage()}))
+		require.NoError(t, s.Close())
+
+		entries := map[string]string{}
+		modes := map[string]int64{}
+		tr := tar.NewReader(&buf)
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			b, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			entries[hdr.Name] = string(b)
+			modes[hdr.Name] = hdr.Mode
+		}
+		require.Equal(t, "hello", entries["usr/bin/hello"])
+		require.Equal(t, int64(0o755), modes["usr/bin/hello"])
+		require.Equal(t, "#!/bin/sh", entries["usr/bin/hello-script"])
+		require.NotContains(t, entries, "usr/bin/hello.debug")
+		require.NotContains(t, entries, "usr/bin/hello.sh")
+	})
+
+	_, err := New(WithFileTransform(nil))
+	require.Error(t, err)
+}
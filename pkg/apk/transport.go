@@ -16,12 +16,50 @@ package apk
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-retryablehttp"
 )
 
+// httpConfig is how the HTTP client of an APK fetches indexes, keys and packages.
+type httpConfig struct {
+	retryPolicy *RetryPolicy
+	hostTLS     map[string]*tls.Config
+	rateLimiter *rateLimiter
+	proxies     []proxyRule
+	metrics     *metrics
+	logger      *slog.Logger
+}
+
+// client returns an HTTP client that retries requests by the retry policy, or by the
+// defaults of retryablehttp if there is none, with the TLS configurations of hosts, see
+// WithHostTLS, the proxies of repositories, see WithProxy, limited by the rate limiter, if
+// any, see WithRateLimit, and counting what it downloads in the metrics, if any. It logs to
+// the logger, if any, see WithLogger, or else to hclog.Default.
+func (c httpConfig) client() *http.Client {
+	rhttp := retryablehttp.NewClient()
+	rhttp.Logger = hclog.Default()
+	if c.logger != nil {
+		rhttp.Logger = leveledLogger{logger: c.logger}
+	}
+	if t, ok := rhttp.HTTPClient.Transport.(*http.Transport); ok {
+		t.Proxy = proxyFunc(c.proxies)
+		rhttp.HTTPClient.Transport = newHostTLSTransport(t, c.hostTLS)
+	}
+	rhttp.HTTPClient.Transport = c.rateLimiter.transport(rhttp.HTTPClient.Transport)
+	rhttp.HTTPClient.Transport = c.metrics.transport(rhttp.HTTPClient.Transport)
+	if c.retryPolicy != nil {
+		c.retryPolicy.apply(rhttp)
+	}
+	return rhttp.StandardClient()
+}
+
 type rangeRetryTransport struct {
 	client *http.Client
 	ctx    context.Context
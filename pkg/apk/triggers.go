@@ -0,0 +1,127 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"path"
+	"sort"
+)
+
+const scriptTrigger = ".trigger"
+
+// Trigger is a trigger of an installed package fired by an install: Dirs are the
+// directories changed by the install that match the globs the package triggers on.
+type Trigger struct {
+	Package string
+	Version string
+	Dirs    []string
+}
+
+// FiredTriggers returns the triggers fired by the last InstallPackages. If scripts are
+// run, see WithRunScripts, their .trigger scripts ran with the Dirs as arguments; otherwise
+// they are pending.
+func (a *APK) FiredTriggers() []Trigger {
+	a.scriptResultsMu.Lock()
+	defer a.scriptResultsMu.Unlock()
+	return append([]Trigger(nil), a.firedTriggers...)
+}
+
+// changedDirs returns the directories, rooted and sorted, whose entries were changed by
+// installing files.
+func changedDirs(files [][]tar.Header) []string {
+	seen := map[string]bool{}
+	var dirs []string
+	for _, hdrs := range files {
+		for _, hdr := range hdrs {
+			dir := path.Dir("/" + cleanInstalledPath(hdr.Name))
+			if !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// matchTriggers returns the triggers of the packages in db fired by changes to dirs. Like
+// apk-tools, a trigger glob matches a directory as fnmatch with FNM_PATHNAME would.
+func matchTriggers(db *InstalledDB, dirs []string) []Trigger {
+	var fired []Trigger
+	for _, pkg := range db.Packages() {
+		globs := db.Triggers(pkg.Name)
+		if len(globs) == 0 {
+			continue
+		}
+		var matched []string
+		for _, dir := range dirs {
+			for _, glob := range globs {
+				if ok, _ := path.Match(glob, dir); ok {
+					matched = append(matched, dir)
+					break
+				}
+			}
+		}
+		if len(matched) != 0 {
+			fired = append(fired, Trigger{Package: pkg.Name, Version: pkg.Version, Dirs: matched})
+		}
+	}
+	return fired
+}
+
+// fireTriggers fires the triggers of the installed packages for the directories changed by
+// installing files, and runs them if scripts are run. Like a failed .post-install script, a
+// failed trigger is only logged.
+func (a *APK) fireTriggers(ctx context.Context, files [][]tar.Header) error {
+	log := a.log(ctx)
+
+	dirs := changedDirs(files)
+	if len(dirs) == 0 {
+		a.scriptResultsMu.Lock()
+		a.firedTriggers = nil
+		a.scriptResultsMu.Unlock()
+		return nil
+	}
+	db, err := a.InstalledDB()
+	if err != nil {
+		return err
+	}
+	fired := matchTriggers(db, dirs)
+
+	a.scriptResultsMu.Lock()
+	a.firedTriggers = fired
+	a.scriptResultsMu.Unlock()
+
+	if !a.runScripts {
+		for _, t := range fired {
+			log.Debugf("not running trigger of %s for %v", t.Package, t.Dirs)
+			a.emit(ctx, &ScriptSkipped{Package: t.Package, Script: scriptTrigger})
+		}
+		return nil
+	}
+	for _, t := range fired {
+		script, ok := db.Scripts(t.Package)[scriptTrigger]
+		if !ok {
+			log.Warnf("%s has triggers but no %s script", t.Package, scriptTrigger)
+			continue
+		}
+		if err := a.execScript(ctx, t.Package, t.Version, scriptTrigger, script, t.Dirs...); err != nil {
+			log.Warnf("%v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangedDirs(t *testing.T) {
+	require.Equal(t, []string{"/", "/usr/share/fonts", "/usr/share/fonts/a"}, changedDirs([][]tar.Header{
+		{{Name: "usr/share/fonts/a/a.ttf"}, {Name: "usr/share/fonts/a/b.ttf"}},
+		nil,
+		{{Name: "usr/share/fonts/a", Typeflag: tar.TypeDir}, {Name: "etc"}},
+	}))
+}
+
+func TestFireTriggers(t *testing.T) {
+	install := func(t *testing.T, run bool) (*APK, *testExecutor) {
+		_, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		e := &testExecutor{fs: src}
+		a, err := New(WithFS(src), WithRunScripts(run), WithExecutor(e))
+		require.NoError(t, err)
+
+		fontconfig := fakePackageWithScripts(t, &Package{Name: "fontconfig", Version: "1.0-r0"}, []testDirEntry{
+			{"usr", 0o755, true, nil, nil},
+			{"usr/share", 0o755, true, nil, nil},
+			{"usr/share/fonts", 0o755, true, nil, nil},
+		}, map[string][]byte{".trigger": []byte("fc-cache")}, []string{"/usr/share/fonts/*"})
+		font := fakePackage(t, &Package{Name: "font-a", Version: "2.0-r0"}, []testDirEntry{
+			{"usr/share/fonts/a", 0o755, true, nil, nil},
+			{"usr/share/fonts/a/a.ttf", 0o644, false, []byte("font"), nil},
+			{"usr/share/fonts/a/sub", 0o755, true, nil, nil},
+			{"usr/share/fonts/a/sub/b.ttf", 0o644, false, []byte("font"), nil},
+		})
+		require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{fontconfig, font}))
+		return a, e
+	}
+	want := []Trigger{{Package: "fontconfig", Version: "1.0-r0", Dirs: []string{"/usr/share/fonts/a"}}}
+
+	t.Run("run", func(t *testing.T) {
+		a, e := install(t, true)
+		require.Equal(t, want, a.FiredTriggers())
+		require.Equal(t, []string{"/lib/apk/exec/fontconfig-1.0-r0.trigger /usr/share/fonts/a: fc-cache"}, e.runs)
+		require.Equal(t, []ScriptResult{{Package: "fontconfig", Version: "1.0-r0", Script: ".trigger"}}, a.ScriptResults())
+	})
+
+	t.Run("pending", func(t *testing.T) {
+		a, e := install(t, false)
+		require.Equal(t, want, a.FiredTriggers())
+		require.Empty(t, e.runs)
+	})
+}
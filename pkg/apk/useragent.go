@@ -0,0 +1,65 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"net/http"
+	"runtime/debug"
+	"sync"
+)
+
+const modulePath = "github.com/chainguard-dev/go-apk"
+
+// libraryVersion returns the version of go-apk in the binary, or "devel" if it is not known,
+// e.g. in its own tests.
+var libraryVersion = sync.OnceValue(func() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	version := info.Main.Version
+	if info.Main.Path != modulePath {
+		version = ""
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				version = dep.Version
+				if dep.Replace != nil && dep.Replace.Version != "" {
+					version = dep.Replace.Version
+				}
+				break
+			}
+		}
+	}
+	if version == "" || version == "(devel)" {
+		return "devel"
+	}
+	return version
+})
+
+// DefaultUserAgent returns the User-Agent of the requests of an APK without WithUserAgent:
+// go-apk and its version.
+func DefaultUserAgent() string {
+	return "go-apk/" + libraryVersion()
+}
+
+// userAgentMiddleware sets the User-Agent of requests that have none to userAgent.
+func userAgentMiddleware(userAgent string) RequestMiddleware {
+	return func(req *http.Request) error {
+		if req.Header.Get("User-Agent") == "" {
+			req.Header.Set("User-Agent", userAgent)
+		}
+		return nil
+	}
+}
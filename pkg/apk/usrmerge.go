@@ -0,0 +1,142 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// usrMergeDirs are the top level directories that are moved under /usr by WithUsrMerge,
+// each replaced by a symlink to its /usr equivalent.
+var usrMergeDirs = []string{"bin", "sbin", "lib"}
+
+// usrMergePath returns name, an installed path, rewritten into /usr if it is in one of
+// usrMergeDirs, keeping it rooted if it was. Other paths are returned unchanged.
+func usrMergePath(name string) string {
+	clean := cleanInstalledPath(name)
+	for _, dir := range usrMergeDirs {
+		if clean == dir || strings.HasPrefix(clean, dir+"/") {
+			if strings.HasPrefix(name, "/") {
+				return "/usr/" + clean
+			}
+			return "usr/" + clean
+		}
+	}
+	return name
+}
+
+// usrMergeLinkname returns the target of a symlink at name, moved by usrMergePath to
+// newName, that still points at the same file. Absolute targets keep resolving through
+// the compat symlinks; relative ones are recomputed from the new location.
+func usrMergeLinkname(name, newName, linkname string) string {
+	if path.IsAbs(linkname) || name == newName {
+		return linkname
+	}
+	target := usrMergePath(cleanInstalledPath(path.Join(path.Dir(cleanInstalledPath(name)), linkname)))
+	from := strings.Split(path.Dir(newName), "/")
+	to := strings.Split(target, "/")
+	i := 0
+	for i < len(from) && i < len(to)-1 && from[i] == to[i] {
+		i++
+	}
+	return strings.Repeat("../", len(from)-i) + strings.Join(to[i:], "/")
+}
+
+// usrMergeHeader rewrites the paths of hdr in place with usrMergePath. It returns whether
+// anything changed.
+func usrMergeHeader(hdr *tar.Header) bool {
+	name := hdr.Name
+	hdr.Name = usrMergePath(name)
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		hdr.Linkname = usrMergeLinkname(name, hdr.Name, hdr.Linkname)
+	case tar.TypeLink:
+		hdr.Linkname = usrMergePath(hdr.Linkname)
+	}
+	return hdr.Name != name
+}
+
+// usrMergeParents returns files with a /usr directory prepended if usrMergeHeader moved
+// some of them there and the package does not have one itself, so that the installed
+// database lists them.
+func usrMergeParents(files []tar.Header) []tar.Header {
+	var moved bool
+	for _, f := range files {
+		switch name := cleanInstalledPath(f.Name); {
+		case name == "usr":
+			return files
+		case strings.HasPrefix(name, "usr/"):
+			moved = true
+		}
+	}
+	if !moved {
+		return files
+	}
+	return append([]tar.Header{{Name: "usr", Mode: 0o755, Typeflag: tar.TypeDir}}, files...)
+}
+
+// initUsrMerge creates the /usr equivalents of usrMergeDirs and the compat symlinks to them.
+func (a *APK) initUsrMerge() error {
+	if err := a.fs.MkdirAll("usr", 0o755); err != nil {
+		return fmt.Errorf("failed to create directory /usr: %w", err)
+	}
+	for _, dir := range usrMergeDirs {
+		if err := a.fs.MkdirAll("usr/"+dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create directory /usr/%s: %w", dir, err)
+		}
+		fi, err := a.fs.Lstat(dir)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			if err := a.fs.Symlink("usr/"+dir, dir); err != nil {
+				return fmt.Errorf("failed to create symlink /%s: %w", dir, err)
+			}
+		case err != nil:
+			return fmt.Errorf("error opening /%s: %w", dir, err)
+		case fi.Mode()&fs.ModeSymlink == 0:
+			return fmt.Errorf("/%s already exists and is not a symlink to /usr/%s", dir, dir)
+		}
+	}
+	return nil
+}
+
+// usrMergeInitFiles returns the headers of what initUsrMerge creates.
+func usrMergeInitFiles() []tar.Header {
+	headers := []tar.Header{{Name: "/usr", Mode: 0o755, Typeflag: tar.TypeDir}}
+	for _, dir := range usrMergeDirs {
+		headers = append(headers, tar.Header{Name: "/usr/" + dir, Mode: 0o755, Typeflag: tar.TypeDir})
+	}
+	for _, dir := range usrMergeDirs {
+		headers = append(headers, tar.Header{Name: "/" + dir, Linkname: "usr/" + dir, Mode: 0o777, Typeflag: tar.TypeSymlink})
+	}
+	return headers
+}
+
+// usrMergeFS serves the files of a package under their paths rewritten by usrMergePath.
+type usrMergeFS struct {
+	fs.FS
+	names map[string]string
+}
+
+func (u *usrMergeFS) Open(name string) (fs.File, error) {
+	if orig, ok := u.names[name]; ok {
+		name = orig
+	}
+	return u.FS.Open(name)
+}
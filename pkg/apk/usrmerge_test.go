@@ -0,0 +1,100 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestUsrMergeHeader(t *testing.T) {
+	tests := []struct {
+		in, want tar.Header
+	}{
+		{tar.Header{Name: "bin", Typeflag: tar.TypeDir}, tar.Header{Name: "usr/bin", Typeflag: tar.TypeDir}},
+		{tar.Header{Name: "sbin/apk", Typeflag: tar.TypeReg}, tar.Header{Name: "usr/sbin/apk", Typeflag: tar.TypeReg}},
+		{tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg}, tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg}},
+		{tar.Header{Name: "library/x", Typeflag: tar.TypeReg}, tar.Header{Name: "library/x", Typeflag: tar.TypeReg}},
+		{
+			tar.Header{Name: "bin/sh", Linkname: "/bin/busybox", Typeflag: tar.TypeSymlink},
+			tar.Header{Name: "usr/bin/sh", Linkname: "/bin/busybox", Typeflag: tar.TypeSymlink},
+		},
+		{
+			tar.Header{Name: "lib/libc.so", Linkname: "libc.so.1", Typeflag: tar.TypeSymlink},
+			tar.Header{Name: "usr/lib/libc.so", Linkname: "libc.so.1", Typeflag: tar.TypeSymlink},
+		},
+		{
+			tar.Header{Name: "sbin/ldconfig", Linkname: "../usr/bin/ldconfig", Typeflag: tar.TypeSymlink},
+			tar.Header{Name: "usr/sbin/ldconfig", Linkname: "../bin/ldconfig", Typeflag: tar.TypeSymlink},
+		},
+		{
+			tar.Header{Name: "usr/bin/ldd", Linkname: "../../lib/ld-musl.so.1", Typeflag: tar.TypeSymlink},
+			tar.Header{Name: "usr/bin/ldd", Linkname: "../../lib/ld-musl.so.1", Typeflag: tar.TypeSymlink},
+		},
+		{
+			tar.Header{Name: "bin/ln", Linkname: "bin/busybox", Typeflag: tar.TypeLink},
+			tar.Header{Name: "usr/bin/ln", Linkname: "usr/bin/busybox", Typeflag: tar.TypeLink},
+		},
+	}
+	for _, tt := range tests {
+		got := tt.in
+		usrMergeHeader(&got)
+		require.Equal(t, tt.want, got, "rewriting %s", tt.in.Name)
+	}
+}
+
+func TestUsrMerge(t *testing.T) {
+	src := apkfs.NewMemFS()
+	a, err := New(WithFS(src), WithIgnoreMknodErrors(true), WithUsrMerge(true))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(context.Background()))
+
+	for _, dir := range usrMergeDirs {
+		target, err := src.Readlink(dir)
+		require.NoError(t, err)
+		require.Equal(t, "usr/"+dir, target)
+	}
+
+	pkg := fakePackage(t, &Package{Name: "busybox", Version: "1.0-r0"}, []testDirEntry{
+		{"bin", 0o755, true, nil, nil},
+		{"bin/busybox", 0o755, false, []byte("busybox"), nil},
+		{"lib", 0o755, true, nil, nil},
+		{"lib/libc.so", 0o755, false, []byte("libc"), nil},
+		{"etc", 0o755, true, nil, nil},
+		{"etc/busybox.conf", 0o644, false, []byte("conf"), nil},
+	})
+	require.NoError(t, a.InstallPackages(context.Background(), nil, []InstallablePackage{pkg}))
+
+	b, err := src.ReadFile("usr/bin/busybox")
+	require.NoError(t, err)
+	require.Equal(t, "busybox", string(b))
+	b, err = src.ReadFile("bin/busybox")
+	require.NoError(t, err)
+	require.Equal(t, "busybox", string(b))
+
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Len(t, installed, 1)
+	var names []string
+	for _, f := range installed[0].Files {
+		names = append(names, f.Name)
+	}
+	require.ElementsMatch(t, []string{"usr", "usr/bin", "usr/bin/busybox", "usr/lib", "usr/lib/libc.so", "etc", "etc/busybox.conf"}, names)
+}
@@ -0,0 +1,177 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+
+	"github.com/chainguard-dev/go-apk/pkg/adb"
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+// CacheCorruption is a corrupt entry of the cache found by Cache.Verify.
+type CacheCorruption struct {
+	// Path is the directory of an expanded package or the file of an index.
+	Path string
+	// Reason is what is wrong with the entry.
+	Reason string
+	// Removed is whether Verify removed the entry.
+	Removed bool
+}
+
+func (c CacheCorruption) String() string {
+	return fmt.Sprintf("%s: %s", c.Path, c.Reason)
+}
+
+// Verify checks the whole cache for corruption: every expanded package is re-hashed
+// against the hashes its files are named by, and every index must be readable and, if it is
+// signed by a key installed in the APK the cache is configured on, match its signature.
+// Indexes signed by unknown keys, and the signatures of apk-tools v3 indexes, are not
+// checked.
+//
+// It returns the corrupt entries. With repair, they are removed, so that they are fetched
+// again the next time they are needed.
+func (c *Cache) Verify(ctx context.Context, repair bool) ([]CacheCorruption, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Verify")
+	defer span.End()
+
+	var keys map[string][]byte
+	if c.apk != nil {
+		keyring, err := c.apk.Keyring()
+		if err != nil {
+			return nil, fmt.Errorf("loading keyring: %w", err)
+		}
+		keys = keyring.Keys()
+	}
+
+	var corrupt []CacheCorruption
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			if filepath.Base(filepath.Dir(path)) != "APKINDEX" || !strings.HasSuffix(path, ".tar.gz") {
+				return nil
+			}
+			reason, err := verifyCachedIndex(path, keys)
+			if err != nil || reason == "" {
+				return err
+			}
+			entry := CacheCorruption{Path: path, Reason: reason}
+			if repair {
+				if err := os.Remove(path); err != nil {
+					return fmt.Errorf("removing %s: %w", path, err)
+				}
+				entry.Removed = true
+			}
+			corrupt = append(corrupt, entry)
+			return nil
+		}
+
+		ok, err := isPackageEntry(path)
+		if err != nil || !ok {
+			return err
+		}
+		// Entries in the store are keyed by the checksum of their control section.
+		var ctlHex string
+		if rel, err := filepath.Rel(filepath.Join(c.dir, packageStoreDir), path); err == nil && !strings.HasPrefix(rel, "..") {
+			ctlHex = filepath.Base(path)
+		}
+
+		unlock, err := lockCacheEntry(ctx, path)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		ok, err = verifyPackageStoreEntry(path, ctlHex)
+		if err != nil {
+			return fmt.Errorf("verifying %s: %w", path, err)
+		}
+		if !ok {
+			entry := CacheCorruption{Path: path, Reason: "package files do not match their hashes"}
+			if repair {
+				if err := os.RemoveAll(path); err != nil {
+					return fmt.Errorf("removing %s: %w", path, err)
+				}
+				entry.Removed = true
+			}
+			corrupt = append(corrupt, entry)
+		}
+		return fs.SkipDir
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walking cache %s: %w", c.dir, err)
+	}
+	return corrupt, nil
+}
+
+// isPackageEntry returns whether dir is the entry of an expanded package, which has a
+// control section.
+func isPackageEntry(dir string) (bool, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, de := range des {
+		if strings.HasSuffix(de.Name(), ".ctl.tar.gz") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// verifyCachedIndex returns why the cached index at path is corrupt, or "" if it is not.
+func verifyCachedIndex(path string, keys map[string][]byte) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := IndexFromArchive(io.NopCloser(bytes.NewReader(b))); err != nil {
+		return fmt.Sprintf("unreadable index: %v", err), nil
+	}
+	if len(keys) == 0 || adb.IsADB(b) {
+		return "", nil
+	}
+	alg, keyName, signature, data, err := splitIndexSignature(b)
+	if err != nil {
+		// unsigned
+		return "", nil
+	}
+	key, ok := keys[keyName]
+	if !ok {
+		return "", nil
+	}
+	if err := sign.Verify(alg, data, signature, key); err != nil {
+		return fmt.Sprintf("bad signature by %s: %v", keyName, err), nil
+	}
+	return "", nil
+}
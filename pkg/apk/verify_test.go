@@ -0,0 +1,65 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestCacheVerifyIndexes(t *testing.T) {
+	ctx := context.Background()
+
+	cacheDir := t.TempDir()
+	indexDir := filepath.Join(cacheDir, "https%3A%2F%2Fexample.com%2Frepo", "x86_64", "APKINDEX")
+	require.NoError(t, os.MkdirAll(indexDir, 0o755))
+	index, err := os.ReadFile(filepath.Join(testAlternatePkgDir, indexFilename))
+	require.NoError(t, err)
+	good := filepath.Join(indexDir, "good.tar.gz")
+	require.NoError(t, os.WriteFile(good, index, 0o644))
+	bad := filepath.Join(indexDir, "bad.tar.gz")
+	require.NoError(t, os.WriteFile(bad, []byte("garbage"), 0o644))
+
+	src := apkfs.NewMemFS()
+	a, err := New(WithFS(src), WithCache(cacheDir, false))
+	require.NoError(t, err)
+
+	corrupt, err := a.Cache().Verify(ctx, false)
+	require.NoError(t, err)
+	require.Len(t, corrupt, 1)
+	require.Equal(t, bad, corrupt[0].Path)
+	require.FileExists(t, bad)
+
+	// The index is signed by this key name, but it is the wrong key.
+	key, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, "alpine-devel@lists.alpinelinux.org-4a6a0840.rsa.pub"))
+	require.NoError(t, err)
+	require.NoError(t, src.MkdirAll(keysDirPath, 0o755))
+	require.NoError(t, src.WriteFile(filepath.Join(keysDirPath, "alpine-devel@lists.alpinelinux.org-616ae350.rsa.pub"), key, 0o644))
+
+	corrupt, err = a.Cache().Verify(ctx, true)
+	require.NoError(t, err)
+	require.Len(t, corrupt, 2)
+	require.Equal(t, bad, corrupt[0].Path)
+	require.Equal(t, good, corrupt[1].Path)
+	require.Contains(t, corrupt[1].Reason, "signature")
+	require.NoFileExists(t, bad)
+	require.NoFileExists(t, good)
+}
@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/stretchr/testify/require"
 )
 
@@ -29,52 +31,55 @@ func TestParseVersion(t *testing.T) {
 			expected packageVersion
 		}{
 			// various legitimate ones
-			{"1", packageVersion{numbers: []int{1}, preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1", packageVersion{numbers: []int{1, 1}, preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1.1", packageVersion{numbers: []int{1, 1, 1}, preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1a", packageVersion{numbers: []int{1}, letter: 'a', preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1a", packageVersion{numbers: []int{1, 1}, letter: 'a', preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1.1a", packageVersion{numbers: []int{1, 1, 1}, letter: 'a', preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1_alpha", packageVersion{numbers: []int{1}, preSuffix: packageVersionPreModifierAlpha, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1_beta", packageVersion{numbers: []int{1}, preSuffix: packageVersionPreModifierBeta, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1_alpha1", packageVersion{numbers: []int{1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 1, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1_alpha2", packageVersion{numbers: []int{1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 2, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1_alpha", packageVersion{numbers: []int{1, 1}, preSuffix: packageVersionPreModifierAlpha, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1.1_alpha", packageVersion{numbers: []int{1, 1, 1}, preSuffix: packageVersionPreModifierAlpha, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1_alpha1", packageVersion{numbers: []int{1, 1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 1, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1a_alpha1", packageVersion{numbers: []int{1}, letter: 'a', preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 1, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1a_alpha2", packageVersion{numbers: []int{1}, letter: 'a', preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 2, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1b_alpha", packageVersion{numbers: []int{1, 1}, letter: 'b', preSuffix: packageVersionPreModifierAlpha, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1.1c_alpha", packageVersion{numbers: []int{1, 1, 1}, letter: 'c', preSuffix: packageVersionPreModifierAlpha, postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1r_alpha1", packageVersion{numbers: []int{1, 1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 1, letter: 'r', postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1.1.1s_alpha2", packageVersion{numbers: []int{1, 1, 1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 2, letter: 's', postSuffix: packageVersionPostModifierNone, revision: 0}},
-			{"1-r2", packageVersion{numbers: []int{1}, preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1-r2", packageVersion{numbers: []int{1, 1}, preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1.1-r2", packageVersion{numbers: []int{1, 1, 1}, preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1a-r2", packageVersion{numbers: []int{1}, letter: 'a', preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1a-r2", packageVersion{numbers: []int{1, 1}, letter: 'a', preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1.1a-r2", packageVersion{numbers: []int{1, 1, 1}, letter: 'a', preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1_alpha-r2", packageVersion{numbers: []int{1}, preSuffix: packageVersionPreModifierAlpha, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1_beta-r2", packageVersion{numbers: []int{1}, preSuffix: packageVersionPreModifierBeta, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1_alpha1-r2", packageVersion{numbers: []int{1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 1, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1_alpha2-r2", packageVersion{numbers: []int{1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 2, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1_alpha-r2", packageVersion{numbers: []int{1, 1}, preSuffix: packageVersionPreModifierAlpha, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1.1_alpha-r2", packageVersion{numbers: []int{1, 1, 1}, preSuffix: packageVersionPreModifierAlpha, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1_alpha1-r2", packageVersion{numbers: []int{1, 1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 1, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1.1_alpha2-r2", packageVersion{numbers: []int{1, 1, 1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 2, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1a_alpha1-r2", packageVersion{numbers: []int{1}, letter: 'a', preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 1, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1a_alpha2-r2", packageVersion{numbers: []int{1}, letter: 'a', preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 2, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1b_alpha-r2", packageVersion{numbers: []int{1, 1}, letter: 'b', preSuffix: packageVersionPreModifierAlpha, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1.1c_alpha-r2", packageVersion{numbers: []int{1, 1, 1}, letter: 'c', preSuffix: packageVersionPreModifierAlpha, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1r_alpha1-r2", packageVersion{numbers: []int{1, 1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 1, letter: 'r', postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1.1s_alpha2-r2", packageVersion{numbers: []int{1, 1, 1}, preSuffix: packageVersionPreModifierAlpha, preSuffixNumber: 2, letter: 's', postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1.1-r2", packageVersion{numbers: []int{1, 1, 1}, preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 2}},
-			{"1.1.1-r29", packageVersion{numbers: []int{1, 1, 1}, preSuffix: packageVersionPreModifierNone, postSuffix: packageVersionPostModifierNone, revision: 29}},
+			{"1", packageVersion{Numbers: []int{1}, PreSuffix: packageVersionPreModifierNone, PostSuffix: packageVersionPostModifierNone, Revision: 0}},
+			{"1.1", packageVersion{Numbers: []int{1, 1}, PreSuffix: packageVersionPreModifierNone, PostSuffix: packageVersionPostModifierNone, Revision: 0}},
+			{"1.1.1", packageVersion{Numbers: []int{1, 1, 1}, PreSuffix: packageVersionPreModifierNone, PostSuffix: packageVersionPostModifierNone, Revision: 0}},
+			{"1a", packageVersion{Numbers: []int{1}, Letter: 'a', PreSuffix: packageVersionPreModifierNone, PostSuffix: packageVersionPostModifierNone, Revision: 0}},
+			{"1.1a", packageVersion{Numbers: []int{1, 1}, Letter: 'a', PreSuffix: packageVersionPreModifierNone, PostSuffix: packageVersionPostModifierNone, Revision: 0}},
+			{"1.1.1a", packageVersion{Numbers: []int{1, 1, 1}, Letter: 'a', PreSuffix: packageVersionPreModifierNone, PostSuffix: packageVersionPostModifierNone, Revision: 0}},
+			{"1_alpha", packageVersion{Numbers: []int{1}, PreSuffix: packageVersionPreModifierAlpha, PostSuffix: packageVersionPostModifierNone, Revision: 0}},
+			{"1_beta", packageVersion{Numbers: []int{1}, PreSuffix: packageVersionPreModifierBeta, PostSuffix: packageVersionPostModifierNone, Revision: 0}},
+			{"1_alpha1", packageVersion{Numbers: []int{1}, PreSuffix: packageVersionPreModifierAlpha, PreSuffixNumber: 1, PostSuffix: packageVersionPostModifierNone, Revision: 0}},
+			{"1_alpha2", packageVersion{Numbers: []int{1}, PreSuffix: packageVersionPreModifierAlpha, PreSuffixNumber: 2, PostSuffix: packageVersionPostModifierNone, Revision: 0}},
+			{"1.1_alpha", packageVersion{Numbers: []int{1, 1}, PreSuffix: packageVersionPreModifierAlpha, PostSuffix: packageVersionPostModifierNone, Revision: 0}},
+			{"1.1.1_alpha", packageVersion{Numbers: []int{1, 1, 1}, PreSuffix: packageVersionPreModifierAlpha, PostSuffix: packageVersionPostModifierNone, Revision: 0}},
+			{"1.1_alpha1", packageVersion{Numbers: []int{1, 1}, PreSuffix: packageVersionPreModifierAlpha, PreSuffixNumber: 1, PostSuffix: packageVersionPostModifierNone, Revision: 0}},
+			{"1a_alpha1", packageVersion{Numbers: []int{1}, Letter: 'a', PreSuffix: packageVersionPreModifierAlpha, PreSuffixNumber: 1, PostSuffix: packageVersionPostModifierNone, Revision: 0}},
+			{"1a_alpha2", packageVersion{Numbers: []int{1}, Letter: 'a', PreSuffix: packageVersionPreModifierAlpha, PreSuffixNumber: 2, PostSuffix: packageVersionPostModifierNone, Revision: 0}},
+			{"1.1b_alpha", packageVersion{Numbers: []int{1, 1}, Letter: 'b', PreSuffix: packageVersionPreModifierAlpha, PostSuffix: packageVersionPostModifierNone, Revision: 0}},
+			{"1.1.1c_alpha", packageVersion{Numbers: []int{1, 1, 1}, Letter: 'c', PreSuffix: packageVersionPreModifierAlpha, PostSuffix: packageVersionPostModifierNone, Revision: 0}},
+			{"1.1r_alpha1", packageVersion{Numbers: []int{1, 1}, PreSuffix: packageVersionPreModifierAlpha, PreSuffixNumber: 1, Letter: 'r', PostSuffix: packageVersionPostModifierNone, Revision: 0}},
+			{"1.1.1s_alpha2", packageVersion{Numbers: []int{1, 1, 1}, PreSuffix: packageVersionPreModifierAlpha, PreSuffixNumber: 2, Letter: 's', PostSuffix: packageVersionPostModifierNone, Revision: 0}},
+			{"1-r2", packageVersion{Numbers: []int{1}, PreSuffix: packageVersionPreModifierNone, PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1.1-r2", packageVersion{Numbers: []int{1, 1}, PreSuffix: packageVersionPreModifierNone, PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1.1.1-r2", packageVersion{Numbers: []int{1, 1, 1}, PreSuffix: packageVersionPreModifierNone, PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1a-r2", packageVersion{Numbers: []int{1}, Letter: 'a', PreSuffix: packageVersionPreModifierNone, PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1.1a-r2", packageVersion{Numbers: []int{1, 1}, Letter: 'a', PreSuffix: packageVersionPreModifierNone, PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1.1.1a-r2", packageVersion{Numbers: []int{1, 1, 1}, Letter: 'a', PreSuffix: packageVersionPreModifierNone, PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1_alpha-r2", packageVersion{Numbers: []int{1}, PreSuffix: packageVersionPreModifierAlpha, PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1_beta-r2", packageVersion{Numbers: []int{1}, PreSuffix: packageVersionPreModifierBeta, PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1_alpha1-r2", packageVersion{Numbers: []int{1}, PreSuffix: packageVersionPreModifierAlpha, PreSuffixNumber: 1, PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1_alpha2-r2", packageVersion{Numbers: []int{1}, PreSuffix: packageVersionPreModifierAlpha, PreSuffixNumber: 2, PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1.1_alpha-r2", packageVersion{Numbers: []int{1, 1}, PreSuffix: packageVersionPreModifierAlpha, PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1.1.1_alpha-r2", packageVersion{Numbers: []int{1, 1, 1}, PreSuffix: packageVersionPreModifierAlpha, PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1.1_alpha1-r2", packageVersion{Numbers: []int{1, 1}, PreSuffix: packageVersionPreModifierAlpha, PreSuffixNumber: 1, PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1.1.1_alpha2-r2", packageVersion{Numbers: []int{1, 1, 1}, PreSuffix: packageVersionPreModifierAlpha, PreSuffixNumber: 2, PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1a_alpha1-r2", packageVersion{Numbers: []int{1}, Letter: 'a', PreSuffix: packageVersionPreModifierAlpha, PreSuffixNumber: 1, PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1a_alpha2-r2", packageVersion{Numbers: []int{1}, Letter: 'a', PreSuffix: packageVersionPreModifierAlpha, PreSuffixNumber: 2, PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1.1b_alpha-r2", packageVersion{Numbers: []int{1, 1}, Letter: 'b', PreSuffix: packageVersionPreModifierAlpha, PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1.1.1c_alpha-r2", packageVersion{Numbers: []int{1, 1, 1}, Letter: 'c', PreSuffix: packageVersionPreModifierAlpha, PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1.1r_alpha1-r2", packageVersion{Numbers: []int{1, 1}, PreSuffix: packageVersionPreModifierAlpha, PreSuffixNumber: 1, Letter: 'r', PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1.1.1s_alpha2-r2", packageVersion{Numbers: []int{1, 1, 1}, PreSuffix: packageVersionPreModifierAlpha, PreSuffixNumber: 2, Letter: 's', PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1.1.1-r2", packageVersion{Numbers: []int{1, 1, 1}, PreSuffix: packageVersionPreModifierNone, PostSuffix: packageVersionPostModifierNone, Revision: 2}},
+			{"1.1.1-r29", packageVersion{Numbers: []int{1, 1, 1}, PreSuffix: packageVersionPreModifierNone, PostSuffix: packageVersionPostModifierNone, Revision: 29}},
 		}
 		for _, tt := range tests {
 			actual, err := parseVersion(tt.version)
 			require.NoError(t, err, "%q unexpected error", tt.version)
-			require.Equal(t, tt.expected, actual, "%q expected %v, got %v", tt.version, tt.expected, actual)
+			// the tokens that versions compare by are checked by TestCompareVersion
+			if d := cmp.Diff(tt.expected, actual, cmpopts.IgnoreUnexported(packageVersion{})); d != "" {
+				t.Errorf("%q (-want, +got): %s", tt.version, d)
+			}
 		}
 	})
 	t.Run("invalid", func(t *testing.T) {
@@ -646,8 +651,7 @@ func TestCompareVersion(t *testing.T) {
 		{"1.7", less, "1.7b"},
 		{"1.7b", less, "1.8.4-r3"},
 		{"1.8.4-r3", less, "1.8.5"},
-		// FIXME(kaniini): _p2 is different than _pre2.
-		// {"1.8.5", less, "1.8.5_p2"},
+		{"1.8.5", less, "1.8.5_p2"},
 		{"1.8.5_p2", greater, "1.1.3"},
 		{"1.1.3", less, "3.0.22-r3"},
 		{"3.0.22-r3", less, "3.0.24"},
@@ -698,8 +702,7 @@ func TestCompareVersion(t *testing.T) {
 		{"1.39", greater, "0.9"},
 		{"0.9", less, "2.61-r2"},
 		{"2.61-r2", less, "4.5.14"},
-		// TODO(kaniini): Fix 4.5.14 > 4.09
-		// {"4.5.14", greater, "4.09-r1"},
+		{"4.5.14", greater, "4.09-r1"},
 		{"4.09-r1", greater, "1.3.1"},
 		{"1.3.1", less, "1.3.2-r3"},
 		{"1.3.2-r3", less, "1.6.8_p12-r1"},
@@ -826,8 +829,7 @@ func TestCompareVersion(t *testing.T) {
 		{"1.3-r0", less, "1.3.1-r0"},
 		{"1.3_pre1-r1", less, "1.3.2"},
 		{"1.0_p10-r0", greater, "1.0_p9-r0"},
-		// FIXME(kaniini): Clarify whether this version test must actually pass.
-		// {"0.1.0_alpha_pre2", less, "0.1.0_alpha"},
+		{"0.1.0_alpha_pre2", less, "0.1.0_alpha"},
 		{"1.0.0_pre20191002222144-r0", less, "1.0.0_pre20210530193627-r0"},
 		{"1.2.3-r0", equal, "1.2.3-r0"},
 		{"0.0_git20230331", less, "0.0_git20230508"},
@@ -923,7 +925,10 @@ func TestResolverPackageNameVersionPin(t *testing.T) {
 		{"name<1.2.3", "name", "1.2.3", versionLess, ""},
 		{"name>=1.2.3", "name", "1.2.3", versionGreaterEqual, ""},
 		{"name<=1.2.3", "name", "1.2.3", versionLessEqual, ""},
+		{"name~1.2", "name", "1.2", versionTilde, ""},
+		{"name~=1.2", "name", "1.2", versionTilde, ""},
 		{"name@edge=1.2.3", "name@edge=1.2.3", "", versionAny, ""}, // wrong order, so just returns the whole thing
+		{"name=>1.2.3", "name", "1.2.3", versionAny, ""},           // invalid operator, so any version
 		{"name=1.2.3@community", "name", "1.2.3", versionEqual, "community"},
 	}
 
@@ -0,0 +1,90 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"sync"
+)
+
+// VersionCache interns parsed versions and dependency constraints. Resolvers parse the same
+// version strings over and over; resolvers that share a cache, see WithResolverVersionCache,
+// parse each only once. It is safe for concurrent use.
+type VersionCache struct {
+	mu          sync.RWMutex
+	versions    map[string]packageVersion
+	constraints map[string]parsedConstraint
+}
+
+// NewVersionCache returns an empty VersionCache.
+func NewVersionCache() *VersionCache {
+	return &VersionCache{
+		versions:    map[string]packageVersion{},
+		constraints: map[string]parsedConstraint{},
+	}
+}
+
+// Len returns the number of versions and constraints in the cache.
+func (c *VersionCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.versions) + len(c.constraints)
+}
+
+// parseVersion is parseVersion, cached. Invalid versions are not cached.
+func (c *VersionCache) parseVersion(version string) (packageVersion, error) {
+	c.mu.RLock()
+	parsed, ok := c.versions[version]
+	c.mu.RUnlock()
+	if ok {
+		return parsed, nil
+	}
+
+	parsed, err := parseVersion(version)
+	if err != nil {
+		return parsed, err
+	}
+
+	c.mu.Lock()
+	c.versions[version] = parsed
+	c.mu.Unlock()
+	return parsed, nil
+}
+
+// resolvePackageNameVersionPin is resolvePackageNameVersionPin, cached.
+func (c *VersionCache) resolvePackageNameVersionPin(pkgName string) parsedConstraint {
+	c.mu.RLock()
+	parsed, ok := c.constraints[pkgName]
+	c.mu.RUnlock()
+	if ok {
+		return parsed
+	}
+
+	parsed = resolvePackageNameVersionPin(pkgName)
+
+	c.mu.Lock()
+	c.constraints[pkgName] = parsed
+	c.mu.Unlock()
+	return parsed
+}
+
+// WithResolverVersionCache makes the resolver use cache for parsed versions and constraints,
+// instead of a cache of its own.
+func WithResolverVersionCache(cache *VersionCache) ResolverOption {
+	return func(p *PkgResolver) {
+		if cache != nil {
+			p.versions = cache
+		}
+	}
+}
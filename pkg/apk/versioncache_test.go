@@ -0,0 +1,60 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionCache(t *testing.T) {
+	cache := NewVersionCache()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := cache.parseVersion("1.2.3-r4")
+			require.NoError(t, err)
+			require.Equal(t, 4, v.Revision)
+			require.Equal(t, "foo", cache.resolvePackageNameVersionPin("foo>=1.2").name)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 2, cache.Len())
+
+	// invalid versions are not cached
+	_, err := cache.parseVersion("not a version")
+	require.Error(t, err)
+	require.Equal(t, 2, cache.Len())
+
+	// resolvers that share the cache fill it once
+	_, indexes := testGetPackagesAndIndex()
+	named := testNamedRepositoryFromIndexes(indexes)
+	resolve := func() {
+		resolver := NewPkgResolver(context.Background(), named, WithResolverVersionCache(cache))
+		_, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"package1"})
+		require.NoError(t, err)
+	}
+	resolve()
+	filled := cache.Len()
+	require.Greater(t, filled, 2)
+	resolve()
+	require.Equal(t, filled, cache.Len())
+}
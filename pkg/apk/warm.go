@@ -0,0 +1,82 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"golang.org/x/sync/errgroup"
+)
+
+// Warm resolves packages, and all of their dependencies, against indexes and downloads
+// every package that would be installed into the cache, without installing anything. If
+// indexes is nil, the indexes of the configured repositories are fetched into the cache
+// first. A cache warmed this way can then be used with WithOffline, so that fetching and
+// building can run as separate steps, the latter without network access.
+//
+// It returns the packages that were resolved.
+func (c *Cache) Warm(ctx context.Context, indexes []NamedIndex, packages []string) ([]*RepositoryPackage, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Warm")
+	defer span.End()
+
+	a := c.apk
+	if a == nil {
+		return nil, fmt.Errorf("cache is not attached to an APK, see WithCache")
+	}
+	ctx = a.logContext(ctx)
+	log := a.log(ctx)
+
+	if indexes == nil {
+		var err error
+		indexes, err = a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
+		if err != nil {
+			return nil, fmt.Errorf("error getting repository indexes: %w", err)
+		}
+	}
+
+	if err := a.checkIndexAge(ctx, indexes); err != nil {
+		return nil, err
+	}
+	resolverOptions, err := a.resolverOptions(indexes)
+	if err != nil {
+		return nil, err
+	}
+	resolver := NewPkgResolver(ctx, indexes, resolverOptions...)
+	toInstall, _, err := resolver.GetPackagesWithDependencies(ctx, packages)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("warming cache with %d packages:\n%s", len(toInstall), strings.Join(packageRefs(toInstall), "\n"))
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(runtime.GOMAXPROCS(0))
+	for _, pkg := range toInstall {
+		pkg := pkg
+		g.Go(func() error {
+			if _, err := a.expandPackage(gctx, pkg); err != nil {
+				return fmt.Errorf("fetching %s: %w", pkg.Name, err)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return toInstall, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+func TestCacheWarm(t *testing.T) {
+	ctx := context.Background()
+
+	f, err := os.Open("testdata/hello-0.1.0-r0.apk")
+	require.NoError(t, err)
+	exp, err := expandapk.ExpandApk(ctx, f, "")
+	require.NoError(t, err)
+	f.Close()
+	checksum := exp.ControlHash
+	exp.Close()
+
+	repo := Repository{URI: "https://example.com/warm/x86_64"}
+	index := repo.WithIndex(&APKIndex{Packages: []*Package{{
+		Name:     "hello",
+		Version:  "0.1.0-r0",
+		Checksum: checksum,
+	}}})
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{index})
+
+	cacheDir := t.TempDir()
+	transport := &testCountingTransport{wrapped: &testLocalTransport{root: "testdata", basenameOnly: true}}
+	a, err := New(WithCache(cacheDir, false))
+	require.NoError(t, err)
+	a.SetClient(&http.Client{Transport: transport})
+
+	_, err = a.Cache().Warm(ctx, indexes, []string{"missing"})
+	require.Error(t, err)
+
+	pkgs, err := a.Cache().Warm(ctx, indexes, []string{"hello"})
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+	require.Equal(t, "hello", pkgs[0].Name)
+	require.Equal(t, int64(1), transport.requests.Load())
+
+	// The warmed cache is enough to fetch the package without network.
+	offline, err := New(WithCache(cacheDir, false), WithOffline(true))
+	require.NoError(t, err)
+	installable := []InstallablePackage{pkgs[0]}
+	require.NoError(t, offline.checkOfflinePackages(ctx, installable))
+	_, err = expandPackage(ctx, offline, pkgs[0])
+	require.NoError(t, err)
+}
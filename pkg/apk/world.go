@@ -22,7 +22,7 @@ import (
 	"sort"
 	"strings"
 
-	"github.com/chainguard-dev/clog"
+	"golang.org/x/exp/slices"
 )
 
 // GetWorld -  get list of packages that should be installed, according to /etc/apk/world
@@ -42,13 +42,14 @@ func (a *APK) GetWorld() ([]string, error) {
 // SetWorld sets the list of world packages intended to be installed.
 // The base directory of /etc/apk must already exist, i.e. this only works on an initialized APK database.
 func (a *APK) SetWorld(ctx context.Context, packages []string) error {
-	log := clog.FromContext(ctx)
+	log := a.log(ctx)
 	log.Debug("setting apk world")
 
-	// sort them before writing
+	// sort and deduplicate them before writing, so that the file is reproducible
 	copied := make([]string, len(packages))
 	copy(copied, packages)
 	sort.Strings(copied)
+	copied = slices.Compact(copied)
 
 	data := strings.Join(copied, "\n") + "\n"
 
@@ -57,6 +58,11 @@ func (a *APK) SetWorld(ctx context.Context, packages []string) error {
 		[]byte(data), 0o644); err != nil {
 		return fmt.Errorf("failed to write apk world: %w", err)
 	}
+	if a.buildTime != nil {
+		if err := a.setMtimes(*a.buildTime, worldFilePath); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -0,0 +1,121 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apkversion
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// constraintRegex how to parse constraints.
+// for information on pinning, see https://wiki.alpinelinux.org/wiki/Alpine_Package_Keeper#Repository_pinning
+// To quote:
+//
+//   After which you can "pin" dependencies to these tags using:
+//
+//      apk add stableapp newapp@edge bleedingapp@testing
+//   Apk will now by default only use the untagged repositories, but adding a tag to specific package:
+//
+//   1. will prefer the repository with that tag for the named package, even if a later version of the package is available in another repository
+//
+//   2. allows pulling in dependencies for the tagged package from the tagged repository (though it prefers to use untagged repositories to satisfy dependencies if possible)
+
+var constraintRegex = regexp.MustCompile(`^([^@=><~]+)(([=><~]+)([^@]+))?(@([a-zA-Z0-9]+))?$`)
+
+func init() {
+	constraintRegex.Longest()
+}
+
+// Constraint is a dependency or a world entry, such as "so:libc.so.6", "foo>=1.2",
+// "bar=2.0-r1@testing" or "!baz": a package name, or a name that packages provide, with
+// an optional version constraint and repository pin, or a conflict with it if negated.
+type Constraint struct {
+	// Negated is for conflicts, "!name": nothing that satisfies the rest may be installed.
+	Negated  bool
+	Name     string
+	Operator Operator
+	// Version is the version the operator constrains to, empty for Any. It is not parsed.
+	Version string
+	// Pin is the tag of the repository the package should come from, empty for none.
+	Pin string
+	// RawOperator is the operator as parsed, if Operator writes it otherwise, i.e. ~= for
+	// Fuzzy, so that String returns what was parsed. It is empty otherwise.
+	RawOperator string
+}
+
+// ParseConstraint parses a constraint: [!]<name>[<operator><version>][@<pin>]. If only the
+// operator is invalid, e.g. name=>1.2, it returns the error along with the rest of the
+// constraint, with Any, for callers that allow any version then, as apk-tools does.
+func ParseConstraint(s string) (Constraint, error) {
+	var c Constraint
+	if rest, ok := strings.CutPrefix(s, "!"); ok {
+		c.Negated = true
+		s = rest
+	}
+	parts := constraintRegex.FindStringSubmatch(s)
+	if parts == nil {
+		return Constraint{}, fmt.Errorf("invalid constraint %q", s)
+	}
+	// layout: [full match, name, =version, =|>|<, version, @pin, pin]
+	c.Name, c.Version, c.Pin = parts[1], parts[4], parts[6]
+	op, err := ParseOperator(parts[3])
+	if err != nil {
+		return c, fmt.Errorf("invalid constraint %q: %w", s, err)
+	}
+	c.Operator = op
+	if op.String() != parts[3] {
+		c.RawOperator = parts[3]
+	}
+	return c, nil
+}
+
+// String returns the constraint as ParseConstraint parses it.
+func (c Constraint) String() string {
+	var b strings.Builder
+	if c.Negated {
+		b.WriteByte('!')
+	}
+	b.WriteString(c.Name)
+	if c.Operator != Any {
+		if c.RawOperator != "" {
+			b.WriteString(c.RawOperator)
+		} else {
+			b.WriteString(c.Operator.String())
+		}
+		b.WriteString(c.Version)
+	}
+	if c.Pin != "" {
+		b.WriteByte('@')
+		b.WriteString(c.Pin)
+	}
+	return b.String()
+}
+
+// Satisfies reports whether version satisfies the version constraint, whatever the name.
+func (c Constraint) Satisfies(version string) (bool, error) {
+	actual, err := Parse(version)
+	if err != nil {
+		return false, err
+	}
+	if c.Operator == Any {
+		return true, nil
+	}
+	required, err := Parse(c.Version)
+	if err != nil {
+		return false, err
+	}
+	return c.Operator.Satisfies(actual, required), nil
+}
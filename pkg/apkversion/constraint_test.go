@@ -0,0 +1,78 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apkversion
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConstraint(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Constraint
+	}{
+		{"agetty", Constraint{Name: "agetty"}},
+		{"so:libc.so.6", Constraint{Name: "so:libc.so.6"}},
+		{"name@edge", Constraint{Name: "name", Pin: "edge"}},
+		{"name=1.2.3", Constraint{Name: "name", Operator: Equal, Version: "1.2.3"}},
+		{"name>=1.2.3", Constraint{Name: "name", Operator: GreaterEqual, Version: "1.2.3"}},
+		{"name<1.2.3", Constraint{Name: "name", Operator: Less, Version: "1.2.3"}},
+		{"name~1.2", Constraint{Name: "name", Operator: Fuzzy, Version: "1.2"}},
+		{"name=1.2.3@community", Constraint{Name: "name", Operator: Equal, Version: "1.2.3", Pin: "community"}},
+		{"!name", Constraint{Negated: true, Name: "name"}},
+		{"!name<2", Constraint{Negated: true, Name: "name", Operator: Less, Version: "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseConstraint(tt.input)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+			require.Equal(t, tt.input, got.String())
+		})
+	}
+
+	// ~= is the same as ~, but written as parsed
+	c, err := ParseConstraint("name~=1.2")
+	require.NoError(t, err)
+	require.Equal(t, Fuzzy, c.Operator)
+	require.Equal(t, "~=", c.RawOperator)
+	require.Equal(t, "name~=1.2", c.String())
+	require.Equal(t, "name~=1.2", Constraint{Name: "name", Operator: Fuzzy, Version: "1.2", RawOperator: "~="}.String())
+
+	for _, invalid := range []string{"", "name@edge=1.2.3", "name=>1.2", "=1.2"} {
+		_, err := ParseConstraint(invalid)
+		require.Error(t, err, invalid)
+	}
+
+	// with an invalid operator, the rest of the constraint is still parsed
+	c, err = ParseConstraint("name=>1.2@edge")
+	require.Error(t, err)
+	require.Equal(t, Constraint{Name: "name", Version: "1.2", Pin: "edge"}, c)
+}
+
+func TestConstraintSatisfies(t *testing.T) {
+	c, err := ParseConstraint("openssl>=3.1")
+	require.NoError(t, err)
+	ok, err := c.Satisfies("3.1.4-r0")
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = c.Satisfies("3.0.12-r0")
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, err = c.Satisfies("three")
+	require.Error(t, err)
+}
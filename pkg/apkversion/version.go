@@ -0,0 +1,439 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package apkversion parses and compares apk package versions, such as 1.2.3_rc1-r4, the way
+// apk-tools does, see
+// https://github.com/alpinelinux/apk-tools/blob/50ab589e9a5a84592ee4c0ac5a49506bb6c552fc/src/version.c
+package apkversion
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PreSuffix is a suffix of a version that makes it a pre-release, sorting before the
+// version without it.
+type PreSuffix int
+
+// PostSuffix is a suffix of a version that sorts after the version without it.
+type PostSuffix int
+
+// the order of these matters!
+const (
+	PreSuffixNone  PreSuffix = 0
+	PreSuffixAlpha PreSuffix = 1 // _alpha
+	PreSuffixBeta  PreSuffix = 2 // _beta
+	PreSuffixPre   PreSuffix = 3 // _pre
+	PreSuffixRC    PreSuffix = 4 // _rc
+)
+const (
+	PostSuffixNone PostSuffix = 0
+	PostSuffixCVS  PostSuffix = 1 // _cvs
+	PostSuffixSVN  PostSuffix = 2 // _svn
+	PostSuffixGit  PostSuffix = 3 // _git
+	PostSuffixHG   PostSuffix = 4 // _hg
+	PostSuffixP    PostSuffix = 5 // _p
+)
+
+// preSuffixes and postSuffixes are in the order of PreSuffix and PostSuffix, and of their
+// tokens: apk-tools matches them as prefixes, in this order, so _pre is not _p followed by re.
+var (
+	preSuffixes  = []string{"alpha", "beta", "pre", "rc"}
+	postSuffixes = []string{"cvs", "svn", "git", "hg", "p"}
+)
+
+// Version is a parsed apk package version:
+// <number>[.<number>]...[<letter>][_<suffix>[<number>]]...[-r<revision>].
+//
+// The fields describe the version; where it has several suffixes, such as 1.0_p1_p2, they
+// have the first pre-suffix and the first post-suffix. Versions compare by all of them, in
+// order, as apk-tools does.
+type Version struct {
+	Numbers          []int
+	Letter           rune
+	PreSuffix        PreSuffix
+	PreSuffixNumber  int
+	PostSuffix       PostSuffix
+	PostSuffixNumber int
+	Revision         int
+
+	// tokens are what Compare compares, as parsed; they are nil for a Version that was not
+	// parsed, see tokenized.
+	tokens []token
+}
+
+// tokenType is the type of a token of a version, as in apk-tools: the order matters, as
+// where two versions differ in the type of a token, the lesser type is newer, but for a
+// pre-release suffix.
+type tokenType int
+
+const (
+	tokenDigitOrZero tokenType = iota // a number after a dot, or the leading zeros of one
+	tokenDigit                        // the first number, or the digits after leading zeros
+	tokenLetter
+	tokenSuffix
+	tokenSuffixNumber
+	tokenRevision
+	tokenEnd
+)
+
+// token is a token of a version. The value of a suffix is negative for pre-release suffixes,
+// and the value of the leading zeros of a number after a dot is their count but one, negated,
+// so that 1.01 is older than 1.1, and 1.001 older than 1.01.
+type token struct {
+	typ   tokenType
+	value int
+}
+
+// Parse parses version, the way apk-tools does, but for requiring a version to start with a
+// number and to have digits after dots and after -r, and nothing after the revision.
+func Parse(version string) (Version, error) {
+	var v Version
+	rest := version
+	// number reads the digits at the start of rest.
+	number := func() (int, error) {
+		i := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+		if i < 0 {
+			i = len(rest)
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("invalid version %s, expected a number at %q", version, rest)
+		}
+		n, err := strconv.Atoi(rest[:i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid version %s, %q is not a number: %w", version, rest[:i], err)
+		}
+		rest = rest[i:]
+		return n, nil
+	}
+	add := func(typ tokenType, value int) {
+		v.tokens = append(v.tokens, token{typ: typ, value: value})
+	}
+
+	// the first number, which is not special for leading zeros
+	n, err := number()
+	if err != nil {
+		return Version{}, err
+	}
+	add(tokenDigit, n)
+	v.Numbers = append(v.Numbers, n)
+
+	for strings.HasPrefix(rest, ".") {
+		rest = rest[1:]
+		if zeros := len(rest) - len(strings.TrimLeft(rest, "0")); zeros > 0 {
+			// The zeros but the last are a token of their own, and the last starts the
+			// number, see token.
+			add(tokenDigitOrZero, -(zeros - 1))
+			rest = rest[zeros-1:]
+			if n, err = number(); err != nil {
+				return Version{}, err
+			}
+			add(tokenDigit, n)
+		} else {
+			if n, err = number(); err != nil {
+				return Version{}, err
+			}
+			add(tokenDigitOrZero, n)
+		}
+		v.Numbers = append(v.Numbers, n)
+	}
+
+	if len(rest) > 0 && rest[0] >= 'a' && rest[0] <= 'z' {
+		v.Letter = rune(rest[0])
+		add(tokenLetter, int(rest[0]))
+		rest = rest[1:]
+	}
+
+	for strings.HasPrefix(rest, "_") {
+		rest = rest[1:]
+		suffix, pre, post := 0, PreSuffixNone, PostSuffixNone
+		for i, s := range preSuffixes {
+			if strings.HasPrefix(rest, s) {
+				rest = rest[len(s):]
+				suffix, pre = i-len(preSuffixes), PreSuffix(i+1)
+				break
+			}
+		}
+		if pre == PreSuffixNone {
+			for i, s := range postSuffixes {
+				if strings.HasPrefix(rest, s) {
+					rest = rest[len(s):]
+					suffix, post = i, PostSuffix(i+1)
+					break
+				}
+			}
+			if post == PostSuffixNone {
+				return Version{}, fmt.Errorf("invalid version %s, suffix at %q is not valid", version, rest)
+			}
+		}
+		add(tokenSuffix, suffix)
+
+		var n int
+		if len(rest) > 0 && rest[0] >= '0' && rest[0] <= '9' {
+			if n, err = number(); err != nil {
+				return Version{}, err
+			}
+			add(tokenSuffixNumber, n)
+		}
+		switch {
+		case pre != PreSuffixNone && v.PreSuffix == PreSuffixNone:
+			v.PreSuffix, v.PreSuffixNumber = pre, n
+		case post != PostSuffixNone && v.PostSuffix == PostSuffixNone:
+			v.PostSuffix, v.PostSuffixNumber = post, n
+		}
+	}
+
+	if strings.HasPrefix(rest, "-r") {
+		rest = rest[2:]
+		if v.Revision, err = number(); err != nil {
+			return Version{}, err
+		}
+		add(tokenRevision, v.Revision)
+	}
+
+	if rest != "" {
+		return Version{}, fmt.Errorf("invalid version %s, unexpected %q", version, rest)
+	}
+	return v, nil
+}
+
+// tokenized returns the tokens of v. A Version that was not parsed gets the tokens of the
+// fields, which cannot tell leading zeros, further suffixes, or a suffix number or revision
+// of 0 from none.
+func (v Version) tokenized() []token {
+	if v.tokens != nil {
+		return v.tokens
+	}
+	var tokens []token
+	for i, n := range v.Numbers {
+		switch {
+		case i == 0:
+			tokens = append(tokens, token{tokenDigit, n})
+		case n == 0:
+			tokens = append(tokens, token{tokenDigitOrZero, 0}, token{tokenDigit, 0})
+		default:
+			tokens = append(tokens, token{tokenDigitOrZero, n})
+		}
+	}
+	if v.Letter != 0 {
+		tokens = append(tokens, token{tokenLetter, int(v.Letter)})
+	}
+	if v.PreSuffix != PreSuffixNone {
+		tokens = append(tokens, token{tokenSuffix, int(v.PreSuffix) - 1 - len(preSuffixes)})
+		if v.PreSuffixNumber != 0 {
+			tokens = append(tokens, token{tokenSuffixNumber, v.PreSuffixNumber})
+		}
+	}
+	if v.PostSuffix != PostSuffixNone {
+		tokens = append(tokens, token{tokenSuffix, int(v.PostSuffix) - 1})
+		if v.PostSuffixNumber != 0 {
+			tokens = append(tokens, token{tokenSuffixNumber, v.PostSuffixNumber})
+		}
+	}
+	if v.Revision != 0 {
+		tokens = append(tokens, token{tokenRevision, v.Revision})
+	}
+	return tokens
+}
+
+// Compare parses and compares versions a and b. It returns -1 if a is older than b, 0 if they
+// are the same and +1 if a is newer.
+func Compare(a, b string) (int, error) {
+	va, err := Parse(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := Parse(b)
+	if err != nil {
+		return 0, err
+	}
+	return va.Compare(vb), nil
+}
+
+// Compare returns -1 if v is older than other, 0 if they are the same and +1 if v is newer.
+// It is a port of apk_version_compare_blob of apk-tools: the tokens of the versions compare
+// one by one, by value, until they differ in type; then the version that goes on is newer,
+// unless it goes on with a pre-release suffix. So 1.0 is older than 1.0-r0 and 1.0.1, and
+// newer than 1.0_rc1; and 1.01 is older than 1.1, see token.
+func (v Version) Compare(other Version) int {
+	c, _ := compareTokens(v.tokenized(), other.tokenized())
+	return c
+}
+
+// compareTokens compares the tokens of versions a and b like Version.Compare, and also
+// reports whether b is a prefix of a, for Version.Includes.
+func compareTokens(a, b []token) (int, bool) {
+	at := func(tokens []token, i int) token {
+		if i < len(tokens) {
+			return tokens[i]
+		}
+		return token{typ: tokenEnd}
+	}
+	for i := 0; ; i++ {
+		ta, tb := at(a, i), at(b, i)
+		if ta.typ != tb.typ {
+			return cmpTokenTypes(ta, tb), tb.typ == tokenEnd
+		}
+		if ta.typ == tokenEnd {
+			return 0, true
+		}
+		if c := cmpInt(ta.value, tb.value); c != 0 {
+			return c, false
+		}
+	}
+}
+
+// cmpTokenTypes compares versions that are the same up to tokens a and b, which differ in
+// type: the version that goes on with a pre-release suffix is older, and otherwise the one
+// with the lesser type.
+func cmpTokenTypes(a, b token) int {
+	switch {
+	case a.typ == tokenSuffix && a.value < 0:
+		return -1
+	case b.typ == tokenSuffix && b.value < 0:
+		return 1
+	case a.typ > b.typ:
+		return -1
+	default:
+		return 1
+	}
+}
+
+func cmpInt(a, b int) int {
+	switch {
+	case a > b:
+		return 1
+	case a < b:
+		return -1
+	default:
+		return 0
+	}
+}
+
+// Includes reports whether v is within version prefix, as with the fuzzy operator: the tokens
+// of v start with those of prefix, so that 1.2.3 and 1.2_rc1 are within 1.2, but 1.20 is not.
+func (v Version) Includes(prefix Version) bool {
+	_, includes := compareTokens(v.tokenized(), prefix.tokenized())
+	return includes
+}
+
+// Operator is how a dependency constrains the versions of what it depends on.
+type Operator int
+
+const (
+	Any          Operator = iota // no version
+	Equal                        // =
+	Greater                      // >
+	Less                         // <
+	GreaterEqual                 // >=
+	LessEqual                    // <=
+	Fuzzy                        // ~ or ~=, see Version.Includes
+)
+
+// ParseOperator parses an operator, one of =, >, <, >=, <=, ~ and ~=.
+func ParseOperator(s string) (Operator, error) {
+	switch s {
+	case "":
+		return Any, nil
+	case "=":
+		return Equal, nil
+	case ">":
+		return Greater, nil
+	case "<":
+		return Less, nil
+	case ">=":
+		return GreaterEqual, nil
+	case "<=":
+		return LessEqual, nil
+	case "~", "~=":
+		return Fuzzy, nil
+	default:
+		return Any, fmt.Errorf("invalid version operator %q", s)
+	}
+}
+
+func (o Operator) String() string {
+	switch o {
+	case Equal:
+		return "="
+	case Greater:
+		return ">"
+	case Less:
+		return "<"
+	case GreaterEqual:
+		return ">="
+	case LessEqual:
+		return "<="
+	case Fuzzy:
+		return "~"
+	default:
+		return ""
+	}
+}
+
+// Satisfies reports whether version actual satisfies the operator with version required,
+// e.g. whether 1.2.3-r0 satisfies >= 1.2.
+func (o Operator) Satisfies(actual, required Version) bool {
+	if o == Fuzzy {
+		return actual.Includes(required)
+	}
+	c := actual.Compare(required)
+	switch o {
+	case Any:
+		return true
+	case Equal:
+		return c == 0
+	case Greater:
+		return c > 0
+	case Less:
+		return c < 0
+	case GreaterEqual:
+		return c >= 0
+	case LessEqual:
+		return c <= 0
+	default:
+		return false
+	}
+}
+
+// Satisfies reports whether version satisfies constraint, an operator and a version such as
+// ">=1.2" or "~1.2", or "" for any version.
+func Satisfies(version, constraint string) (bool, error) {
+	i := strings.IndexFunc(constraint, func(r rune) bool {
+		return !strings.ContainsRune("=<>~", r)
+	})
+	if i < 0 {
+		i = len(constraint)
+	}
+	op, err := ParseOperator(constraint[:i])
+	if err != nil {
+		return false, err
+	}
+	actual, err := Parse(version)
+	if err != nil {
+		return false, err
+	}
+	if op == Any {
+		if i != len(constraint) {
+			return false, fmt.Errorf("invalid version constraint %q, no operator", constraint)
+		}
+		return true, nil
+	}
+	required, err := Parse(constraint[i:])
+	if err != nil {
+		return false, err
+	}
+	return op.Satisfies(actual, required), nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apkversion
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	v, err := Parse("1.2.3b_rc4_p5-r6")
+	require.NoError(t, err)
+	// the tokens are checked by TestCompare
+	v.tokens = nil
+	require.Equal(t, Version{
+		Numbers:          []int{1, 2, 3},
+		Letter:           'b',
+		PreSuffix:        PreSuffixRC,
+		PreSuffixNumber:  4,
+		PostSuffix:       PostSuffixP,
+		PostSuffixNumber: 5,
+		Revision:         6,
+	}, v)
+
+	// further suffixes compare, but are not in the fields
+	v, err = Parse("1.02_p1_rc2_p3")
+	require.NoError(t, err)
+	v.tokens = nil
+	require.Equal(t, Version{
+		Numbers:          []int{1, 2},
+		PreSuffix:        PreSuffixRC,
+		PreSuffixNumber:  2,
+		PostSuffix:       PostSuffixP,
+		PostSuffixNumber: 1,
+	}, v)
+
+	for _, invalid := range []string{"", "a1", "1.", "1.a", "1ab", "1_foo", "1_alphabet", "1-r", "1-rc", "1.2-r1-r2", "1.2-r1_p1"} {
+		_, err := Parse(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	// each is older than the next
+	ordered := []string{
+		"1.0_alpha",
+		"1.0_alpha2",
+		"1.0_beta",
+		"1.0_pre",
+		"1.0_rc1",
+		"1.0",
+		"1.0-r1",
+		"1.0_cvs",
+		"1.0_git",
+		"1.0_p1",
+		"1.0_p2",
+		"1.0a",
+		"1.0b",
+		"1.0.1",
+		"1.1",
+		"1.10",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			got, err := Compare(ordered[i], ordered[j])
+			require.NoError(t, err)
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			require.Equal(t, want, got, "%s vs %s", ordered[i], ordered[j])
+		}
+	}
+
+	_, err := Compare("1.0", "one")
+	require.Error(t, err)
+}
+
+func TestCompareTokens(t *testing.T) {
+	// where apk-tools compares the tokens of versions rather than their numbers and suffixes
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		// leading zeros of a number after a dot compare first, fewer is newer
+		{"1.01", "1.1", -1},
+		{"1.001", "1.01", -1},
+		{"1.01", "1.0", 1},
+		{"1.00", "1.0", -1},
+		{"1.010", "1.01", 1},
+		{"4.09-r1", "4.5.14", -1},
+		// but not of the first number
+		{"01", "1", 0},
+		{"1.06-r6", "006", -1},
+		// every suffix compares, in order
+		{"1.0_p1_p2", "1.0_p1", 1},
+		{"1.0_p1_p2", "1.0_p2", -1},
+		{"1.0_p1_rc1", "1.0_p1", -1},
+		{"0.1.0_alpha_pre2", "0.1.0_alpha", -1},
+		{"1.8.5", "1.8.5_p2", -1},
+		// a suffix number or a revision of 0 is not none
+		{"1.0_alpha", "1.0_alpha0", -1},
+		{"1.0", "1.0-r0", -1},
+	}
+	for _, tt := range tests {
+		got, err := Compare(tt.a, tt.b)
+		require.NoError(t, err)
+		require.Equal(t, tt.want, got, "%s vs %s", tt.a, tt.b)
+		got, err = Compare(tt.b, tt.a)
+		require.NoError(t, err)
+		require.Equal(t, -tt.want, got, "%s vs %s", tt.b, tt.a)
+	}
+
+	// Versions that were not parsed compare by their fields.
+	v, err := Parse("1.0.2_rc1-r3")
+	require.NoError(t, err)
+	literal := Version{Numbers: []int{1, 0, 2}, PreSuffix: PreSuffixRC, PreSuffixNumber: 1, Revision: 3}
+	require.Equal(t, 0, v.Compare(literal))
+	require.True(t, v.Includes(Version{Numbers: []int{1, 0}}))
+}
+
+func TestSatisfies(t *testing.T) {
+	tests := []struct {
+		version    string
+		constraint string
+		want       bool
+	}{
+		{"1.2.3-r0", "", true},
+		{"1.2.3-r0", "=1.2.3-r0", true},
+		{"1.2.3-r1", "=1.2.3-r0", false},
+		{"1.2.3-r0", ">1.2", true},
+		{"1.2.3-r0", "<1.2", false},
+		{"1.2.3-r0", ">=1.2.3", true},
+		{"1.2.3-r0", "<=1.2.3_rc1", false},
+		{"1.2.3-r0", "~1.2", true},
+		{"1.2.3-r0", "~=1.2", true},
+		{"1.3.0-r0", "~1.2", false},
+		{"1.2a", "~1.2a", true},
+		{"1.2b", "~1.2a", false},
+		{"1.2_rc1", "~1.2", true},
+		{"1.20", "~1.2", false},
+		{"1.2", "~1.2.0", false},
+	}
+	for _, tt := range tests {
+		got, err := Satisfies(tt.version, tt.constraint)
+		require.NoError(t, err)
+		require.Equal(t, tt.want, got, "%s %s", tt.version, tt.constraint)
+	}
+
+	for _, invalid := range []string{"1.2", "=>1.2", ">=x"} {
+		_, err := Satisfies("1.2", invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestOperator(t *testing.T) {
+	for _, s := range []string{"", "=", ">", "<", ">=", "<=", "~"} {
+		op, err := ParseOperator(s)
+		require.NoError(t, err)
+		require.Equal(t, s, op.String())
+	}
+	op, err := ParseOperator("~=")
+	require.NoError(t, err)
+	require.Equal(t, Fuzzy, op)
+}
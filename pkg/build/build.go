@@ -0,0 +1,248 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package build creates apk packages.
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // apk-tools signs the sha1 of the control section
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"go.opentelemetry.io/otel"
+
+	"github.com/chainguard-dev/go-apk/pkg/pkginfo"
+	"github.com/chainguard-dev/go-apk/pkg/signature"
+	"github.com/chainguard-dev/go-apk/pkg/tarball"
+)
+
+// Scripts that can be added to the control section with WithScript.
+const (
+	ScriptPreInstall    = ".pre-install"
+	ScriptPostInstall   = ".post-install"
+	ScriptPreDeinstall  = ".pre-deinstall"
+	ScriptPostDeinstall = ".post-deinstall"
+	ScriptPreUpgrade    = ".pre-upgrade"
+	ScriptPostUpgrade   = ".post-upgrade"
+	ScriptTrigger       = ".trigger"
+)
+
+var validScripts = map[string]bool{
+	ScriptPreInstall:    true,
+	ScriptPostInstall:   true,
+	ScriptPreDeinstall:  true,
+	ScriptPostDeinstall: true,
+	ScriptPreUpgrade:    true,
+	ScriptPostUpgrade:   true,
+	ScriptTrigger:       true,
+}
+
+type opts struct {
+	keyFile         string
+	passphrase      string
+	scripts         map[string][]byte
+	sourceDateEpoch time.Time
+}
+
+// Option configures Build.
+type Option func(*opts) error
+
+// WithSigningKey signs the package with the RSA private key in keyFile, which must be PEM
+// encoded. The signature names the public key after the key file, with a .pub suffix,
+// like abuild. Without it, the package is not signed.
+func WithSigningKey(keyFile, passphrase string) Option {
+	return func(o *opts) error {
+		o.keyFile = keyFile
+		o.passphrase = passphrase
+		return nil
+	}
+}
+
+// WithScript adds a script to the control section. name is one of the Script constants.
+// A ScriptTrigger is only run if the package info lists triggers.
+func WithScript(name string, script []byte) Option {
+	return func(o *opts) error {
+		if !validScripts[name] {
+			return fmt.Errorf("invalid script name %q", name)
+		}
+		o.scripts[name] = script
+		return nil
+	}
+}
+
+// WithSourceDateEpoch sets the modification time of every file in the package, and the
+// build date if the package info has none. Default is the Unix epoch.
+func WithSourceDateEpoch(t time.Time) Option {
+	return func(o *opts) error {
+		o.sourceDateEpoch = t
+		return nil
+	}
+}
+
+// Build writes an apk package to w: the signature, control and data sections, each a gzip
+// stream. The data section holds the files in fsys, owned by root. The control section
+// holds the .PKGINFO described by info, and the scripts. Build sets info.Size to the
+// installed size and info.DataHash to the hash of the data section, which apk-tools checks.
+func Build(ctx context.Context, w io.Writer, info *pkginfo.PkgInfo, fsys fs.FS, options ...Option) error {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Build")
+	defer span.End()
+
+	o := &opts{scripts: map[string][]byte{}, sourceDateEpoch: time.Unix(0, 0)}
+	for _, opt := range options {
+		if err := opt(o); err != nil {
+			return err
+		}
+	}
+	if info.Name == "" || info.Version == "" {
+		return fmt.Errorf("package name and version are required")
+	}
+	if _, ok := o.scripts[ScriptTrigger]; ok != (len(info.Triggers) != 0) {
+		return fmt.Errorf("a trigger script requires triggers, and triggers require a trigger script")
+	}
+
+	size, err := installedSize(fsys)
+	if err != nil {
+		return fmt.Errorf("computing installed size: %w", err)
+	}
+	info.Size = size
+	if info.BuildDate == 0 {
+		info.BuildDate = o.sourceDateEpoch.Unix()
+	}
+
+	// data.tar.gz
+	dataTar, err := tarball.NewContext(
+		tarball.WithSourceDateEpoch(o.sourceDateEpoch),
+		tarball.WithOverrideUIDGID(0, 0),
+		tarball.WithOverrideUname("root"),
+		tarball.WithOverrideGname("root"),
+		tarball.WithUseChecksums(true),
+	)
+	if err != nil {
+		return err
+	}
+	var data bytes.Buffer
+	if err := dataTar.WriteTargz(ctx, &data, fsys, fsys); err != nil {
+		return fmt.Errorf("writing data section: %w", err)
+	}
+	dataHash := sha256.Sum256(data.Bytes())
+	info.DataHash = hex.EncodeToString(dataHash[:])
+
+	// control.tar.gz
+	var pkgInfo bytes.Buffer
+	if err := info.Write(&pkgInfo); err != nil {
+		return fmt.Errorf("writing .PKGINFO: %w", err)
+	}
+	entries := []controlEntry{{".PKGINFO", 0o644, pkgInfo.Bytes()}}
+	names := make([]string, 0, len(o.scripts))
+	for name := range o.scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entries = append(entries, controlEntry{name, 0o755, o.scripts[name]})
+	}
+	control, err := writeControlSection(entries, o.sourceDateEpoch)
+	if err != nil {
+		return fmt.Errorf("writing control section: %w", err)
+	}
+
+	// signature.tar.gz
+	var sig []byte
+	if o.keyFile != "" {
+		digest := sha1.Sum(control) //nolint:gosec
+		signed, err := signature.RSASignSHA1Digest(digest[:], o.keyFile, o.passphrase)
+		if err != nil {
+			return fmt.Errorf("signing package: %w", err)
+		}
+		name := fmt.Sprintf(".SIGN.RSA.%s.pub", filepath.Base(o.keyFile))
+		if sig, err = writeControlSection([]controlEntry{{name, 0o644, signed}}, o.sourceDateEpoch); err != nil {
+			return fmt.Errorf("writing signature section: %w", err)
+		}
+	}
+
+	for _, section := range [][]byte{sig, control, data.Bytes()} {
+		if _, err := w.Write(section); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type controlEntry struct {
+	name     string
+	mode     int64
+	contents []byte
+}
+
+// writeControlSection returns a gzipped tar of entries, without the end of archive marker,
+// so that apk-tools reads the sections that follow as part of the same archive.
+func writeControlSection(entries []controlEntry, mtime time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     e.name,
+			Mode:     e.mode,
+			Size:     int64(len(e.contents)),
+			ModTime:  mtime,
+			Uname:    "root",
+			Gname:    "root",
+			Format:   tar.FormatPAX,
+		}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(e.contents); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return nil, err
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// installedSize returns the total size of the regular files in fsys.
+func installedSize(fsys fs.FS) (uint64, error) {
+	var size uint64
+	err := fs.WalkDir(fsys, ".", func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += uint64(fi.Size())
+		return nil
+	})
+	return size, err
+}
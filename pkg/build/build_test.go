@@ -0,0 +1,149 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	"github.com/chainguard-dev/go-apk/pkg/pkginfo"
+	"github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+func testSigningKey(t *testing.T) (string, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "test@example.com.rsa")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0o600))
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	return keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+}
+
+func TestBuild(t *testing.T) {
+	ctx := context.Background()
+	keyFile, pubKey := testSigningKey(t)
+	fsys := fstest.MapFS{
+		"usr":                 {Mode: 0o755 | os.ModeDir},
+		"usr/bin":             {Mode: 0o755 | os.ModeDir},
+		"usr/bin/hello":       {Mode: 0o755, Data: []byte("#!/bin/sh\necho hello\n")},
+		"etc":                 {Mode: 0o755 | os.ModeDir},
+		"etc/hello.conf":      {Mode: 0o644, Data: []byte("greeting=hello\n")},
+		"usr/share":           {Mode: 0o755 | os.ModeDir},
+		"usr/share/hello.txt": {Mode: 0o644, Data: []byte("hi")},
+	}
+	info := &pkginfo.PkgInfo{
+		Name:    "hello",
+		Version: "1.0-r0",
+		Arch:    "x86_64",
+		Depends: []string{"so:libc.musl-x86_64.so.1"},
+	}
+	epoch := time.Unix(1700000000, 0)
+
+	var buf bytes.Buffer
+	require.NoError(t, Build(ctx, &buf, info, fsys,
+		WithSigningKey(keyFile, ""),
+		WithScript(ScriptPostInstall, []byte("#!/bin/sh\nexit 0\n")),
+		WithSourceDateEpoch(epoch),
+	))
+	require.Equal(t, uint64(38), info.Size)
+	require.Equal(t, epoch.Unix(), info.BuildDate)
+
+	exp, err := expandapk.ExpandApk(ctx, &buf, t.TempDir())
+	require.NoError(t, err)
+	defer exp.Close()
+
+	// The signature is over the control section.
+	sig, err := os.ReadFile(exp.SignatureFile)
+	require.NoError(t, err)
+	gzr, err := gzip.NewReader(bytes.NewReader(sig))
+	require.NoError(t, err)
+	tr := tar.NewReader(gzr)
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	require.Equal(t, ".SIGN.RSA.test@example.com.rsa.pub", hdr.Name)
+	signed, err := io.ReadAll(tr)
+	require.NoError(t, err)
+	require.NoError(t, signature.RSAVerifySHA1Digest(exp.ControlHash, signed, pubKey))
+
+	// The datahash matches the data section.
+	data, err := os.ReadFile(exp.PackageFile)
+	require.NoError(t, err)
+	dataHash := sha256.Sum256(data)
+	require.Equal(t, hex.EncodeToString(dataHash[:]), info.DataHash)
+
+	pkgInfo, err := fs.ReadFile(exp.ControlFS, ".PKGINFO")
+	require.NoError(t, err)
+	var want bytes.Buffer
+	require.NoError(t, info.Write(&want))
+	require.Equal(t, want.String(), string(pkgInfo))
+	require.Contains(t, string(pkgInfo), "datahash = "+info.DataHash+"\n")
+
+	script, err := exp.ControlFS.Stat(".post-install")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o755), script.Mode().Perm())
+
+	hello, err := fs.ReadFile(exp.TarFS, "usr/bin/hello")
+	require.NoError(t, err)
+	require.Equal(t, "#!/bin/sh\necho hello\n", string(hello))
+	fi, err := exp.TarFS.Stat("usr/bin/hello")
+	require.NoError(t, err)
+	require.True(t, fi.ModTime().Equal(epoch))
+}
+
+func TestBuildUnsigned(t *testing.T) {
+	ctx := context.Background()
+	fsys := fstest.MapFS{"hello.txt": {Mode: 0o644, Data: []byte("hi")}}
+
+	var buf bytes.Buffer
+	require.NoError(t, Build(ctx, &buf, &pkginfo.PkgInfo{Name: "hello", Version: "1.0-r0"}, fsys))
+
+	exp, err := expandapk.ExpandApk(ctx, &buf, t.TempDir())
+	require.NoError(t, err)
+	defer exp.Close()
+	require.Empty(t, exp.SignatureFile)
+}
+
+func TestBuildErrors(t *testing.T) {
+	ctx := context.Background()
+	fsys := fstest.MapFS{}
+	info := &pkginfo.PkgInfo{Name: "hello", Version: "1.0-r0"}
+
+	require.Error(t, Build(ctx, io.Discard, &pkginfo.PkgInfo{Name: "hello"}, fsys))
+	require.Error(t, Build(ctx, io.Discard, info, fsys, WithScript(".install", nil)))
+	require.Error(t, Build(ctx, io.Discard, info, fsys, WithScript(ScriptTrigger, nil)))
+	require.Error(t, Build(ctx, io.Discard, info, fsys, WithSigningKey(filepath.Join(t.TempDir(), "missing.rsa"), "")))
+}
@@ -0,0 +1,118 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expandapk_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chainguard-dev/go-apk/pkg/build"
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	"github.com/chainguard-dev/go-apk/pkg/pkginfo"
+)
+
+// largeApk builds an unsigned package of files files of size bytes each, like a toolchain.
+func largeApk(b *testing.B, files, size int) []byte {
+	rnd := rand.New(rand.NewSource(1)) //nolint:gosec // only test data
+	fsys := fstest.MapFS{
+		"usr":     {Mode: 0o755 | fs.ModeDir},
+		"usr/lib": {Mode: 0o755 | fs.ModeDir},
+	}
+	for i := 0; i < files; i++ {
+		data := make([]byte, size)
+		// half random, half zeros, so it compresses somewhat like a binary
+		rnd.Read(data[:size/2])
+		fsys[fmt.Sprintf("usr/lib/lib%d.so", i)] = &fstest.MapFile{Mode: 0o755, Data: data}
+	}
+	var buf bytes.Buffer
+	require.NoError(b, build.Build(context.Background(), &buf, &pkginfo.PkgInfo{Name: "toolchain", Version: "1.0-r0"}, fsys))
+	return buf.Bytes()
+}
+
+// peakHeap runs fn and returns the most heap it had in use over what was in use before,
+// sampled every millisecond.
+func peakHeap(fn func()) uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	base, peak := m.HeapInuse, m.HeapInuse
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	sample := func() {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		if m.HeapInuse > peak {
+			peak = m.HeapInuse
+		}
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(time.Millisecond)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				sample()
+			}
+		}
+	}()
+	fn()
+	close(done)
+	wg.Wait()
+	sample()
+	return peak - base
+}
+
+// BenchmarkExpandApk reports the peak heap of expanding packages of growing size, which
+// should not grow with them, as the data section is streamed to disk. It is the Go heap in
+// use, not the RSS of the process. There is no recorded baseline: compare runs before and
+// after a change, e.g. with benchstat.
+func BenchmarkExpandApk(b *testing.B) {
+	for _, size := range []int{1 << 20, 16 << 20} {
+		b.Run(fmt.Sprintf("%dMiB", 4*size>>20), func(b *testing.B) {
+			apk := largeApk(b, 4, size)
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.SetBytes(int64(len(apk)))
+			b.ResetTimer()
+
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				if p := peakHeap(func() {
+					exp, err := expandapk.ExpandApk(ctx, bytes.NewReader(apk), b.TempDir())
+					require.NoError(b, err)
+					require.NoError(b, exp.Close())
+				}); p > peak {
+					peak = p
+				}
+			}
+			b.ReportMetric(float64(peak), "peak-heap-B")
+		})
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"sync"
 
 	"github.com/chainguard-dev/go-apk/internal/tarfs"
+	"github.com/chainguard-dev/go-apk/pkg/adb"
 	"github.com/klauspost/compress/gzip"
 
 	"go.opentelemetry.io/otel"
@@ -59,6 +60,10 @@ type APKExpanded struct {
 	// Exposes TarFile as an indexed FS implementation.
 	TarFS *tarfs.FS
 
+	// TreeFile, if set, is the manifest of the package data extracted into a file each,
+	// e.g. in a cache, which TarFS serves instead of TarFile.
+	TreeFile string
+
 	ControlHash []byte
 	PackageHash []byte
 
@@ -225,6 +230,10 @@ var _ io.Writer = (*expandApkWriter)(nil)
 
 var errExpandApkWriterMaxStreams = errors.New("expandApkWriter max streams reached")
 
+// ErrADBPackage is returned by ExpandApk for apk-tools v3 packages, which are not made of
+// gzip streams. They can be read with adb.NewPackageReader.
+var ErrADBPackage = errors.New("apk-tools v3 (ADB) packages cannot be expanded")
+
 func (w *expandApkWriter) Next() error {
 	if w.f != nil {
 		if err := w.CloseFile(); err != nil {
@@ -303,12 +312,14 @@ func (r *expandApkReader) Read(b []byte) (int, error) {
 	if r.fast {
 		return r.Reader.Read(b)
 	}
-	buf := make([]byte, 1)
-	n, err := r.Reader.Read(buf)
+	if len(b) == 0 {
+		return 0, nil
+	}
+	// Until the data section, read a byte at a time so that no byte of the next gzip
+	// stream is consumed by the current one, but into b rather than a new buffer.
+	n, err := r.Reader.Read(b[:1])
 	if err != nil && err != io.EOF {
 		err = fmt.Errorf("expandApkReader.Read: %w", err)
-	} else {
-		b[0] = buf[0]
 	}
 	return n, err
 }
@@ -334,6 +345,12 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "ExpandApk")
 	defer span.End()
 
+	br := bufio.NewReader(source)
+	if magic, _ := br.Peek(4); adb.IsADB(magic) {
+		return nil, ErrADBPackage
+	}
+	source = br
+
 	dir, err := os.MkdirTemp(cacheDir, "expand-apk")
 	if err != nil {
 		return nil, err
@@ -348,6 +365,10 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 	var gzi *gzip.Reader
 	gzipStreams := []string{}
 	hashes := [][]byte{}
+	var (
+		expanded APKExpanded
+		tarFS    *tarfs.FS
+	)
 	maxStreamsReached := false
 	for {
 		// Control section uses sha1.
@@ -389,7 +410,8 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 			hashes = append(hashes, h.Sum(nil))
 			gzipStreams = append(gzipStreams, sw.CurrentName())
 		} else {
-			// While we verify checksums, also tee the tar to a separate file.
+			// While we verify checksums and index the tar, also tee it to a separate file,
+			// so that the data section is decompressed and read only once, a buffer at a time.
 			tarfilename := strings.TrimSuffix(sw.CurrentName(), ".gz")
 			tarfile, err := os.Create(tarfilename)
 			if err != nil {
@@ -398,7 +420,16 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 			bw := bufio.NewWriterSize(tarfile, 1<<20)
 			tr := io.TeeReader(gzi, bw)
 
-			if err := checkSums(ctx, tr); err != nil {
+			// Through expanded, as the tar moves with it, e.g. into a cache.
+			open := func() (io.ReadSeekCloser, error) {
+				return expanded.PackageData()
+			}
+			_, span := otel.Tracer("go-apk").Start(ctx, "checkSums")
+			tarFS, err = tarfs.Index(open, tr, func(header *tar.Header, r io.Reader) error {
+				return checkSum(header, r, false)
+			})
+			span.End()
+			if err != nil {
 				return nil, fmt.Errorf("checking sums: %w", err)
 			}
 			if _, err := io.Copy(io.Discard, tr); err != nil {
@@ -449,7 +480,7 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 		return nil, fmt.Errorf("invalid number of tar streams: %d", numGzipStreams)
 	}
 
-	expanded := APKExpanded{
+	expanded = APKExpanded{
 		tempDir:     dir,
 		Signed:      signed,
 		Size:        totalSize,
@@ -468,17 +499,19 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 	}
 
 	expanded.TarFile = strings.TrimSuffix(expanded.PackageFile, ".gz")
-
-	// TODO: We could overlap this with checkSums.
-	expanded.TarFS, err = tarfs.New(expanded.PackageData)
-	if err != nil {
-		return nil, fmt.Errorf("indexing %q: %w", expanded.TarFile, err)
-	}
+	expanded.TarFS = tarFS
 
 	return &expanded, nil
 }
 
-func checkSums(ctx context.Context, r io.Reader) error {
+// VerifyChecksums reads the package data tar stream from r and checks the content of every
+// regular file against the checksum in its PAX headers. If requireAll is true, a regular file
+// without a checksum is an error; otherwise it is skipped.
+func VerifyChecksums(ctx context.Context, r io.Reader, requireAll bool) error {
+	return checkSums(ctx, r, requireAll)
+}
+
+func checkSums(ctx context.Context, r io.Reader, requireAll bool) error {
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "checkSums")
 	defer span.End()
 
@@ -493,30 +526,42 @@ func checkSums(ctx context.Context, r io.Reader) error {
 			return err
 		}
 
-		if header.Typeflag != tar.TypeReg {
-			continue
-		}
-
-		checksum, err := checksumFromHeader(header)
-		if err != nil {
+		if err := checkSum(header, tr, requireAll); err != nil {
 			return err
 		}
+	}
 
-		// If for some reason this is missing, ignore it. We will calculate it later.
-		if checksum == nil {
-			continue
-		}
+	return nil
+}
 
-		w := sha1.New() //nolint:gosec // this is what apk tools is using
+// checkSum checks the content r of the entry header of a package data tar against the
+// checksum in its PAX headers, see checkSums.
+func checkSum(header *tar.Header, r io.Reader, requireAll bool) error {
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
 
-		if _, err := io.Copy(w, tr); err != nil {
-			return fmt.Errorf("hashing %s: %w", header.Name, err)
-		}
+	checksum, err := checksumFromHeader(header)
+	if err != nil {
+		return err
+	}
 
-		if want, got := checksum, w.Sum(nil); !bytes.Equal(want, got) {
-			return fmt.Errorf("checksum mismatch: %s header was %x, computed %x", header.Name, want, got)
+	// If for some reason this is missing, ignore it. We will calculate it later.
+	if checksum == nil {
+		if requireAll {
+			return fmt.Errorf("missing checksum: %s has no %s header", header.Name, paxRecordsChecksumKey)
 		}
+		return nil
 	}
 
+	w := sha1.New() //nolint:gosec // this is what apk tools is using
+
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("hashing %s: %w", header.Name, err)
+	}
+
+	if want, got := checksum, w.Sum(nil); !bytes.Equal(want, got) {
+		return fmt.Errorf("checksum mismatch: %s header was %x, computed %x", header.Name, want, got)
+	}
 	return nil
 }
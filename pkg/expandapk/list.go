@@ -0,0 +1,145 @@
+package expandapk
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"go.opentelemetry.io/otel"
+
+	"github.com/chainguard-dev/go-apk/pkg/adb"
+)
+
+// Entry is a file in the data section of an apk.
+type Entry struct {
+	*tar.Header
+
+	// Checksum is the SHA1 of the file content recorded in its PAX headers, or nil.
+	Checksum []byte
+}
+
+// DataReader streams the data section of an apk, without writing anything to disk. Like
+// tar.Reader, Next advances to the next entry and Read reads its content.
+type DataReader struct {
+	gz *gzip.Reader
+	tr *tar.Reader
+}
+
+// NewDataReader skips the signature and control sections of the apk read from r, and
+// returns a DataReader positioned before the first entry of the data section.
+func NewDataReader(r io.Reader) (*DataReader, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(4); adb.IsADB(magic) {
+		return nil, ErrADBPackage
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("reading first section: %w", err)
+	}
+	gz.Multistream(false)
+	hdr, err := tar.NewReader(gz).Next()
+	if err != nil {
+		return nil, fmt.Errorf("reading first section: %w", err)
+	}
+	skip := 1
+	if strings.HasPrefix(hdr.Name, ".SIGN.") {
+		skip = 2
+	}
+	for i := 0; i < skip; i++ {
+		if i > 0 {
+			if err := gz.Reset(br); err != nil {
+				return nil, fmt.Errorf("reading control section: %w", err)
+			}
+			gz.Multistream(false)
+		}
+		if _, err := io.Copy(io.Discard, gz); err != nil {
+			return nil, fmt.Errorf("skipping section: %w", err)
+		}
+	}
+	if err := gz.Reset(br); err != nil {
+		return nil, fmt.Errorf("reading data section: %w", err)
+	}
+
+	return &DataReader{gz: gz, tr: tar.NewReader(gz)}, nil
+}
+
+// Next advances to the next entry of the data section. It returns io.EOF at the end.
+func (r *DataReader) Next() (*Entry, error) {
+	hdr, err := r.tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := checksumFromHeader(hdr)
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{Header: hdr, Checksum: checksum}, nil
+}
+
+// Read reads the content of the current entry.
+func (r *DataReader) Read(p []byte) (int, error) {
+	return r.tr.Read(p)
+}
+
+// ListApk returns the entries of the data section of the apk read from r.
+func ListApk(ctx context.Context, r io.Reader) ([]*Entry, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "ListApk")
+	defer span.End()
+
+	dr, err := NewDataReader(r)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*Entry
+	for {
+		e, err := dr.Next()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+}
+
+// ExtractFile copies the content of the regular file at name in the data section of the
+// apk read from r to w, and returns its entry. It stops reading r after the file. If there
+// is no such file, the error wraps fs.ErrNotExist.
+func ExtractFile(ctx context.Context, r io.Reader, name string, w io.Writer) (*Entry, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "ExtractFile")
+	defer span.End()
+
+	name = path.Clean(strings.TrimPrefix(name, "/"))
+	dr, err := NewDataReader(r)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		e, err := dr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("extracting %s: %w", name, fs.ErrNotExist)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if path.Clean(e.Name) != name {
+			continue
+		}
+		if e.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("extracting %s: not a regular file", name)
+		}
+		if _, err := io.Copy(w, dr); err != nil {
+			return nil, fmt.Errorf("extracting %s: %w", name, err)
+		}
+		return e, nil
+	}
+}
@@ -0,0 +1,83 @@
+package expandapk_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chainguard-dev/go-apk/pkg/build"
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	"github.com/chainguard-dev/go-apk/pkg/pkginfo"
+)
+
+func testApk(t *testing.T, signed bool) []byte {
+	var opts []build.Option
+	if signed {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		keyFile := filepath.Join(t.TempDir(), "test.rsa")
+		require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		}), 0o600))
+		opts = append(opts, build.WithSigningKey(keyFile, ""))
+	}
+	fsys := fstest.MapFS{
+		"usr":           {Mode: 0o755 | fs.ModeDir},
+		"usr/bin":       {Mode: 0o755 | fs.ModeDir},
+		"usr/bin/hello": {Mode: 0o755, Data: []byte("#!/bin/sh\necho hello\n")},
+		"etc":           {Mode: 0o755 | fs.ModeDir},
+		"etc/hello":     {Mode: 0o644, Data: []byte("hi")},
+	}
+	var buf bytes.Buffer
+	require.NoError(t, build.Build(context.Background(), &buf, &pkginfo.PkgInfo{Name: "hello", Version: "1.0-r0"}, fsys, opts...))
+	return buf.Bytes()
+}
+
+func TestListApk(t *testing.T) {
+	for _, signed := range []bool{true, false} {
+		apk := testApk(t, signed)
+		entries, err := expandapk.ListApk(context.Background(), bytes.NewReader(apk))
+		require.NoError(t, err)
+
+		byName := map[string]*expandapk.Entry{}
+		for _, e := range entries {
+			byName[e.Name] = e
+		}
+		require.Len(t, byName, 5)
+		hello := byName["usr/bin/hello"]
+		require.NotNil(t, hello)
+		require.Equal(t, int64(21), hello.Size)
+		require.Equal(t, int64(0o755), hello.Mode&0o777)
+		require.Len(t, hello.Checksum, 20)
+		require.True(t, byName["usr/bin"].FileInfo().IsDir())
+	}
+}
+
+func TestExtractFile(t *testing.T) {
+	ctx := context.Background()
+	apk := testApk(t, true)
+
+	var buf bytes.Buffer
+	e, err := expandapk.ExtractFile(ctx, bytes.NewReader(apk), "/usr/bin/hello", &buf)
+	require.NoError(t, err)
+	require.Equal(t, "usr/bin/hello", e.Name)
+	require.Equal(t, "#!/bin/sh\necho hello\n", buf.String())
+
+	_, err = expandapk.ExtractFile(ctx, bytes.NewReader(apk), "usr/bin/missing", io.Discard)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = expandapk.ExtractFile(ctx, bytes.NewReader(apk), "usr/bin", io.Discard)
+	require.Error(t, err)
+}
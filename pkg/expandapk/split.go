@@ -0,0 +1,103 @@
+package expandapk
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+
+	"github.com/chainguard-dev/go-apk/pkg/adb"
+)
+
+// Section is one of the gzip streams an apk is made of.
+type Section struct {
+	// Offset and Size are the byte range of the section in the apk.
+	Offset int64
+	Size   int64
+
+	data []byte
+}
+
+// Reader returns the gzip stream of the section.
+func (s *Section) Reader() io.Reader {
+	return bytes.NewReader(s.data)
+}
+
+// Bytes returns the gzip stream of the section.
+func (s *Section) Bytes() []byte {
+	return s.data
+}
+
+// Sections are the gzip streams of an apk, in order.
+type Sections struct {
+	// Signature is nil if the apk is not signed.
+	Signature *Section
+	Control   *Section
+	Data      *Section
+}
+
+// SplitApk reads the apk from r into memory and splits it into its signature, control and
+// data sections. The control section is the stream signed by the signature, and the
+// sha1 of its bytes is the checksum in the index; the datahash in .PKGINFO is the sha256
+// of the data section.
+func SplitApk(r io.Reader) (*Sections, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if adb.IsADB(b) {
+		return nil, ErrADBPackage
+	}
+
+	br := bytes.NewReader(b)
+	pos := func() int64 { return br.Size() - int64(br.Len()) }
+	var gz *gzip.Reader
+	// next returns the section starting at the current position, and the name of its
+	// first file.
+	next := func() (*Section, string, error) {
+		start := pos()
+		if gz == nil {
+			gz, err = gzip.NewReader(br)
+		} else {
+			err = gz.Reset(br)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		// Sections other than the last are tar streams without an end of archive marker.
+		gz.Multistream(false)
+		hdr, err := tar.NewReader(gz).Next()
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := io.Copy(io.Discard, gz); err != nil {
+			return nil, "", err
+		}
+		return &Section{Offset: start, Size: pos() - start, data: b[start:pos()]}, hdr.Name, nil
+	}
+
+	s := &Sections{}
+	first, name, err := next()
+	if err != nil {
+		return nil, fmt.Errorf("reading first section: %w", err)
+	}
+	if strings.HasPrefix(name, ".SIGN.") {
+		s.Signature = first
+		if s.Control, _, err = next(); err != nil {
+			return nil, fmt.Errorf("reading control section: %w", err)
+		}
+	} else {
+		s.Control = first
+	}
+
+	start := pos()
+	if start == br.Size() {
+		return nil, errors.New("missing data section")
+	}
+	s.Data = &Section{Offset: start, Size: br.Size() - start, data: b[start:]}
+	return s, nil
+}
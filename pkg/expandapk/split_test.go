@@ -0,0 +1,50 @@
+package expandapk_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+func TestSplitApk(t *testing.T) {
+	for _, signed := range []bool{true, false} {
+		apk := testApk(t, signed)
+		s, err := expandapk.SplitApk(bytes.NewReader(apk))
+		require.NoError(t, err)
+
+		exp, err := expandapk.ExpandApk(context.Background(), bytes.NewReader(apk), t.TempDir())
+		require.NoError(t, err)
+		defer exp.Close()
+
+		var joined []byte
+		if signed {
+			require.NotNil(t, s.Signature)
+			require.Equal(t, int64(0), s.Signature.Offset)
+			require.Equal(t, s.Signature.Size, s.Control.Offset)
+			joined = append(joined, s.Signature.Bytes()...)
+		} else {
+			require.Nil(t, s.Signature)
+			require.Equal(t, int64(0), s.Control.Offset)
+		}
+		require.Equal(t, s.Control.Offset+s.Control.Size, s.Data.Offset)
+		require.Equal(t, int64(len(apk)), s.Data.Offset+s.Data.Size)
+		joined = append(joined, s.Control.Bytes()...)
+		joined = append(joined, s.Data.Bytes()...)
+		require.Equal(t, apk, joined)
+
+		// The control section is the one apk-tools hashes.
+		controlHash := sha1.Sum(s.Control.Bytes()) //nolint:gosec
+		require.Equal(t, exp.ControlHash, controlHash[:])
+		dataHash := sha256.Sum256(s.Data.Bytes())
+		require.Equal(t, exp.PackageHash, dataHash[:])
+	}
+
+	_, err := expandapk.SplitApk(bytes.NewReader([]byte("not an apk")))
+	require.Error(t, err)
+}
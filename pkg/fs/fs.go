@@ -16,6 +16,7 @@ package fs
 import (
 	"io"
 	"io/fs"
+	"time"
 )
 
 // FullFS is a filesystem that supports all filesystem operations.
@@ -87,3 +88,41 @@ type XattrFS interface {
 	RemoveXattr(path string, attr string) error
 	ListXattrs(path string) (map[string][]byte, error)
 }
+
+// Feature is a filesystem operation of FullFS that not every backend can carry out faithfully.
+type Feature int
+
+const (
+	// FeatureOwnership is setting the owner of files with Chown.
+	FeatureOwnership Feature = iota
+	// FeatureXattrs is setting extended attributes, such as security.capability, with SetXattr.
+	FeatureXattrs
+	// FeatureHardlinks is creating hardlinks with Link.
+	FeatureHardlinks
+)
+
+// FeatureFS is a FullFS that reports which Features it supports. A FullFS that does not
+// implement it is expected to support all of them.
+type FeatureFS interface {
+	FullFS
+	Supports(feature Feature) bool
+}
+
+// ChtimesFS is a FullFS that can change the access and modification times of files.
+type ChtimesFS interface {
+	FullFS
+	Chtimes(path string, atime, mtime time.Time) error
+}
+
+// CloneFS is a FullFS on disk that can create files that share the data of files on disk
+// outside of it, e.g. in a cache, rather than copying it.
+type CloneFS interface {
+	FullFS
+	// CloneFile creates name with perm as a reflink of the file src on disk: a copy that
+	// shares its data until either of them changes. It fails if the filesystem cannot
+	// reflink, or src is on another filesystem.
+	CloneFile(src, name string, perm fs.FileMode) error
+	// LinkFile creates name as a hardlink to the file src on disk, which it shares its
+	// content, mode and owner with. It fails if src is on another filesystem.
+	LinkFile(src, name string) error
+}
@@ -156,11 +156,21 @@ func (m *memFS) Stat(path string) (fs.FileInfo, error) {
 }
 
 func (m *memFS) Lstat(path string) (fs.FileInfo, error) {
-	node, err := m.getNode(path)
+	// like os.Lstat, do not follow the last element if it is a symlink
+	parentNode, err := m.getNode(filepath.Dir(path))
 	if err != nil {
 		return nil, err
 	}
-	return node.fileInfo(path), nil
+	if path == "/" || path == "." {
+		return parentNode.fileInfo(path), nil
+	}
+	parentNode.mu.Lock()
+	anode, ok := parentNode.children[filepath.Base(path)]
+	parentNode.mu.Unlock()
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return anode.fileInfo(path), nil
 }
 
 func (m *memFS) MkdirAll(path string, perm fs.FileMode) error {
@@ -382,6 +392,22 @@ func (m *memFS) Chown(path string, uid, gid int) error {
 	return nil
 }
 
+func (m *memFS) Chtimes(path string, atime, mtime time.Time) error {
+	anode, err := m.getNode(path)
+	if err != nil {
+		return err
+	}
+	anode.mu.Lock()
+	defer anode.mu.Unlock()
+	anode.modTime = mtime
+	return nil
+}
+
+// Supports reports whether the memFS supports a Feature, which it always does.
+func (m *memFS) Supports(feature Feature) bool {
+	return true
+}
+
 func (m *memFS) Create(name string) (File, error) {
 	return m.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o666)
 }
@@ -656,6 +682,8 @@ func (m *memFileInfo) Mode() fs.FileMode {
 	return m.mode
 }
 func (m *memFileInfo) ModTime() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.modTime
 }
 func (m *memFileInfo) IsDir() bool {
@@ -4,7 +4,9 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -394,6 +396,68 @@ func TestMemFSSymlinkCycle(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestMemFSLstat(t *testing.T) {
+	var (
+		m   = NewMemFS()
+		err error
+	)
+	err = m.MkdirAll("/a", 0o755)
+	require.NoError(t, err)
+	err = m.WriteFile("/a/file", []byte("hello"), 0o644)
+	require.NoError(t, err)
+	err = m.Symlink("file", "/a/link")
+	require.NoError(t, err)
+	err = m.Symlink("missing", "/a/dangling")
+	require.NoError(t, err)
+
+	// like os.Lstat, the last element is not followed
+	fi, err := m.Lstat("/a/link")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeSymlink, fi.Mode().Type(), "%s should be a symlink", "/a/link")
+	fi, err = m.Stat("/a/link")
+	require.NoError(t, err)
+	require.True(t, fi.Mode().IsRegular(), "%s should follow to a regular file", "/a/link")
+
+	// a dangling symlink exists itself
+	fi, err = m.Lstat("/a/dangling")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+
+	fi, err = m.Lstat("/a")
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+
+	_, err = m.Lstat("/a/missing")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestMemFSChtimes(t *testing.T) {
+	var (
+		m     = NewMemFS()
+		mtime = time.Unix(1700000000, 0)
+	)
+	err := m.WriteFile("/file", []byte("hello"), 0o644)
+	require.NoError(t, err)
+
+	// concurrently with each other and with readers, which the race detector checks
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, m.(ChtimesFS).Chtimes("/file", mtime, mtime))
+			fi, err := m.Stat("/file")
+			require.NoError(t, err)
+			_ = fi.ModTime()
+		}()
+	}
+	wg.Wait()
+
+	fi, err := m.Stat("/file")
+	require.NoError(t, err)
+	require.True(t, fi.ModTime().Equal(mtime), "mtime of %s is %s", "/file", fi.ModTime())
+}
+
 func TestMemFSConsistentOrdering(t *testing.T) {
 	var (
 		m = NewMemFS()
@@ -0,0 +1,710 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// as in OCI image layers
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+
+	maxSymlinks = 40
+)
+
+// OverlayFS is a FullFS that keeps the changes to a base filesystem, which it does not
+// write to, e.g. the root of an existing image, in memory, so that they can be written as
+// a layer on top of the base with WriteDelta. Like overlayfs, a file of the base is copied
+// up when it is changed, and hidden when it is removed.
+type OverlayFS struct {
+	base  FullFS
+	upper FullFS
+
+	mu sync.Mutex
+	// whiteouts are the files of the base that were removed
+	whiteouts map[string]bool
+	// opaque are the directories that were removed and created again, whose files in the
+	// base are hidden
+	opaque map[string]bool
+}
+
+// NewOverlayFS returns an OverlayFS over base.
+func NewOverlayFS(base FullFS) *OverlayFS {
+	return &OverlayFS{
+		base:      base,
+		upper:     NewMemFS(),
+		whiteouts: map[string]bool{},
+		opaque:    map[string]bool{},
+	}
+}
+
+func cleanPath(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// hidden reports whether name is hidden in the base, by a whiteout of it or of a directory
+// it is in, or by an opaque directory that it is in.
+func (o *OverlayFS) hidden(name string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.whiteouts[name] {
+		return true
+	}
+	for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if o.whiteouts[dir] || o.opaque[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// unhide removes the whiteout of name, which is being created again, and returns whether
+// there was one.
+func (o *OverlayFS) unhide(name string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.whiteouts[name] {
+		return false
+	}
+	delete(o.whiteouts, name)
+	return true
+}
+
+// layer returns the filesystem that has name, which must be resolved.
+func (o *OverlayFS) layer(name string) (FullFS, error) {
+	if _, err := o.upper.Lstat(name); err == nil {
+		return o.upper, nil
+	}
+	if o.hidden(name) {
+		return nil, os.ErrNotExist
+	}
+	if _, err := o.base.Lstat(name); err != nil {
+		return nil, err
+	}
+	return o.base, nil
+}
+
+// resolve returns name with the symlinks in the directories it is in followed, as the base
+// and the upper filesystem may each have only part of them.
+func (o *OverlayFS) resolve(name string) (string, error) {
+	name = cleanPath(name)
+	for links := 0; ; {
+		parts := strings.Split(name, "/")
+		dir, followed := ".", false
+		for i, part := range parts[:len(parts)-1] {
+			p := path.Join(dir, part)
+			l, err := o.layer(p)
+			if err != nil {
+				// it is for the operation to report that it does not exist
+				return name, nil
+			}
+			fi, err := l.Lstat(p)
+			if err != nil {
+				return "", err
+			}
+			if fi.Mode()&fs.ModeSymlink == 0 {
+				dir = p
+				continue
+			}
+			if links++; links > maxSymlinks {
+				return "", fmt.Errorf("too many levels of symbolic links: %s", name)
+			}
+			target, err := l.Readlink(p)
+			if err != nil {
+				return "", err
+			}
+			if !path.IsAbs(target) {
+				target = path.Join(dir, target)
+			}
+			name = cleanPath(path.Join(append([]string{target}, parts[i+1:]...)...))
+			followed = true
+			break
+		}
+		if !followed {
+			return name, nil
+		}
+	}
+}
+
+// follow resolves name and follows it while it is a symlink. It returns the name of what
+// it is, or would be if it does not exist.
+func (o *OverlayFS) follow(name string) (string, error) {
+	for links := 0; ; links++ {
+		resolved, err := o.resolve(name)
+		if err != nil {
+			return "", err
+		}
+		l, err := o.layer(resolved)
+		if err != nil {
+			return resolved, nil
+		}
+		fi, err := l.Lstat(resolved)
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			return resolved, nil
+		}
+		if links >= maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links: %s", name)
+		}
+		target, err := l.Readlink(resolved)
+		if err != nil {
+			return "", err
+		}
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(resolved), target)
+		}
+		name = target
+	}
+}
+
+// lookup returns the filesystem with name, and name resolved, following it if it is a
+// symlink if follow is true.
+func (o *OverlayFS) lookup(name string, follow bool) (string, FullFS, error) {
+	var err error
+	if follow {
+		name, err = o.follow(name)
+	} else {
+		name, err = o.resolve(name)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	l, err := o.layer(name)
+	if err != nil {
+		return "", nil, err
+	}
+	return name, l, nil
+}
+
+// copyUp copies name, which must be resolved, and the directories it is in, from the base
+// to the upper filesystem, unless it is there already.
+func (o *OverlayFS) copyUp(name string) error {
+	if name == "." {
+		return nil
+	}
+	if _, err := o.upper.Lstat(name); err == nil {
+		return nil
+	}
+	if o.hidden(name) {
+		return os.ErrNotExist
+	}
+	fi, err := o.base.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if err := o.copyUp(path.Dir(name)); err != nil {
+		return err
+	}
+
+	switch {
+	case fi.IsDir():
+		err = o.upper.Mkdir(name, fi.Mode().Perm())
+	case fi.Mode()&fs.ModeSymlink != 0:
+		var target string
+		if target, err = o.base.Readlink(name); err == nil {
+			err = o.upper.Symlink(target, name)
+		}
+	case fi.Mode()&fs.ModeCharDevice != 0:
+		var dev int
+		if dev, err = o.base.Readnod(name); err == nil {
+			err = o.upper.Mknod(name, uint32(unix.S_IFCHR|fi.Mode().Perm()), dev)
+		}
+	default:
+		var b []byte
+		if b, err = o.base.ReadFile(name); err == nil {
+			err = o.upper.WriteFile(name, b, fi.Mode().Perm())
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("copying up %s: %w", name, err)
+	}
+
+	if hdr, ok := fi.Sys().(*tar.Header); ok && (hdr.Uid != 0 || hdr.Gid != 0) {
+		if err := o.upper.Chown(name, hdr.Uid, hdr.Gid); err != nil {
+			return fmt.Errorf("copying up %s: %w", name, err)
+		}
+	}
+	if xattrs, err := o.base.ListXattrs(name); err == nil {
+		for attr, data := range xattrs {
+			if err := o.upper.SetXattr(name, attr, data); err != nil {
+				return fmt.Errorf("copying up %s: %w", name, err)
+			}
+		}
+	}
+	if c, ok := o.upper.(ChtimesFS); ok {
+		if err := c.Chtimes(name, fi.ModTime(), fi.ModTime()); err != nil {
+			return fmt.Errorf("copying up %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// writable returns name, resolved and followed if follow is true, having copied it up if it
+// exists, or else the directory it is in.
+func (o *OverlayFS) writable(name string, follow bool) (string, error) {
+	if resolved, l, err := o.lookup(name, follow); err == nil {
+		if l == o.base {
+			err = o.copyUp(resolved)
+		}
+		return resolved, err
+	}
+	var err error
+	if follow {
+		name, err = o.follow(name)
+	} else {
+		name, err = o.resolve(name)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := o.copyUp(path.Dir(name)); err != nil {
+		return "", err
+	}
+	o.unhide(name)
+	return name, nil
+}
+
+// creatable returns name resolved, which must not exist, having copied up the directory it
+// is in, and whether it hid a removed file of the base.
+func (o *OverlayFS) creatable(name string) (string, bool, error) {
+	name, err := o.resolve(name)
+	if err != nil {
+		return "", false, err
+	}
+	if _, err := o.layer(name); err == nil {
+		return "", false, os.ErrExist
+	}
+	if err := o.copyUp(path.Dir(name)); err != nil {
+		return "", false, err
+	}
+	return name, o.unhide(name), nil
+}
+
+func (o *OverlayFS) Mkdir(name string, perm fs.FileMode) error {
+	name, replaced, err := o.creatable(name)
+	if err != nil {
+		return err
+	}
+	if replaced {
+		o.mu.Lock()
+		o.opaque[name] = true
+		o.mu.Unlock()
+	}
+	return o.upper.Mkdir(name, perm)
+}
+
+func (o *OverlayFS) MkdirAll(name string, perm fs.FileMode) error {
+	name, err := o.resolve(name)
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		return nil
+	}
+	if fi, err := o.Stat(name); err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("path is not a directory")
+		}
+		return nil
+	}
+	if err := o.MkdirAll(path.Dir(name), perm); err != nil {
+		return err
+	}
+	return o.Mkdir(name, perm)
+}
+
+func (o *OverlayFS) Open(name string) (fs.File, error) {
+	return o.OpenFile(name, os.O_RDONLY, 0o644)
+}
+
+func (o *OverlayFS) OpenReaderAt(name string) (File, error) {
+	return o.OpenFile(name, os.O_RDONLY, 0o644)
+}
+
+func (o *OverlayFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		name, l, err := o.lookup(name, true)
+		if err != nil {
+			return nil, err
+		}
+		return l.OpenFile(name, flag, perm)
+	}
+	name, err := o.writable(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return o.upper.OpenFile(name, flag, perm)
+}
+
+func (o *OverlayFS) Create(name string) (File, error) {
+	return o.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o666)
+}
+
+func (o *OverlayFS) ReadFile(name string) ([]byte, error) {
+	name, l, err := o.lookup(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return l.ReadFile(name)
+}
+
+func (o *OverlayFS) WriteFile(name string, b []byte, mode fs.FileMode) error {
+	name, err := o.writable(name, true)
+	if err != nil {
+		return err
+	}
+	return o.upper.WriteFile(name, b, mode)
+}
+
+func (o *OverlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	name, err := o.follow(name)
+	if err != nil {
+		return nil, err
+	}
+	entries := map[string]fs.DirEntry{}
+	found := false
+	if !o.hidden(name) {
+		if base, err := o.base.ReadDir(name); err == nil {
+			found = true
+			for _, e := range base {
+				if !o.hidden(path.Join(name, e.Name())) {
+					entries[e.Name()] = e
+				}
+			}
+		}
+	}
+	if upper, err := o.upper.ReadDir(name); err == nil {
+		found = true
+		for _, e := range upper {
+			entries[e.Name()] = e
+		}
+	}
+	if !found {
+		return nil, os.ErrNotExist
+	}
+
+	de := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		de = append(de, e)
+	}
+	sort.Slice(de, func(i, j int) bool {
+		return de[i].Name() < de[j].Name()
+	})
+	return de, nil
+}
+
+func (o *OverlayFS) Stat(name string) (fs.FileInfo, error) {
+	name, l, err := o.lookup(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return l.Lstat(name)
+}
+
+func (o *OverlayFS) Lstat(name string) (fs.FileInfo, error) {
+	name, l, err := o.lookup(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return l.Lstat(name)
+}
+
+func (o *OverlayFS) Mknod(name string, mode uint32, dev int) error {
+	name, _, err := o.creatable(name)
+	if err != nil {
+		return err
+	}
+	return o.upper.Mknod(name, mode, dev)
+}
+
+func (o *OverlayFS) Readnod(name string) (int, error) {
+	name, l, err := o.lookup(name, true)
+	if err != nil {
+		return 0, err
+	}
+	return l.Readnod(name)
+}
+
+func (o *OverlayFS) Symlink(oldname, newname string) error {
+	newname, _, err := o.creatable(newname)
+	if err != nil {
+		return err
+	}
+	return o.upper.Symlink(oldname, newname)
+}
+
+func (o *OverlayFS) Link(oldname, newname string) error {
+	oldname, err := o.writable(oldname, false)
+	if err != nil {
+		return err
+	}
+	newname, _, err = o.creatable(newname)
+	if err != nil {
+		return err
+	}
+	return o.upper.Link(oldname, newname)
+}
+
+func (o *OverlayFS) Readlink(name string) (string, error) {
+	name, l, err := o.lookup(name, false)
+	if err != nil {
+		return "", err
+	}
+	return l.Readlink(name)
+}
+
+func (o *OverlayFS) Remove(name string) error {
+	name, err := o.resolve(name)
+	if err != nil {
+		return err
+	}
+	_, err = o.upper.Lstat(name)
+	inUpper := err == nil
+	inBase := !o.hidden(name)
+	if inBase {
+		_, err := o.base.Lstat(name)
+		inBase = err == nil
+	}
+	if !inUpper && !inBase {
+		return os.ErrNotExist
+	}
+	// like os.Remove, only a directory that is empty, in both layers, is removed
+	if fi, err := o.Lstat(name); err == nil && fi.IsDir() {
+		entries, err := o.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		if len(entries) != 0 {
+			return &fs.PathError{Op: "remove", Path: name, Err: unix.ENOTEMPTY}
+		}
+	}
+	if inUpper {
+		if err := o.upper.Remove(name); err != nil {
+			return err
+		}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	// a directory that replaced a removed one hides that one again
+	if inBase || o.opaque[name] {
+		o.whiteouts[name] = true
+	}
+	delete(o.opaque, name)
+	// the whiteouts of the files of a removed directory are hidden with it
+	for removed := range o.whiteouts {
+		if strings.HasPrefix(removed, name+"/") {
+			delete(o.whiteouts, removed)
+		}
+	}
+	return nil
+}
+
+func (o *OverlayFS) Chmod(name string, perm fs.FileMode) error {
+	name, err := o.writable(name, true)
+	if err != nil {
+		return err
+	}
+	return o.upper.Chmod(name, perm)
+}
+
+func (o *OverlayFS) Chown(name string, uid, gid int) error {
+	name, err := o.writable(name, true)
+	if err != nil {
+		return err
+	}
+	return o.upper.Chown(name, uid, gid)
+}
+
+func (o *OverlayFS) Chtimes(name string, atime, mtime time.Time) error {
+	name, err := o.writable(name, true)
+	if err != nil {
+		return err
+	}
+	if c, ok := o.upper.(ChtimesFS); ok {
+		return c.Chtimes(name, atime, mtime)
+	}
+	return nil
+}
+
+func (o *OverlayFS) SetXattr(name string, attr string, data []byte) error {
+	name, err := o.writable(name, true)
+	if err != nil {
+		return err
+	}
+	return o.upper.SetXattr(name, attr, data)
+}
+
+func (o *OverlayFS) GetXattr(name string, attr string) ([]byte, error) {
+	name, l, err := o.lookup(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return l.GetXattr(name, attr)
+}
+
+func (o *OverlayFS) RemoveXattr(name string, attr string) error {
+	name, err := o.writable(name, true)
+	if err != nil {
+		return err
+	}
+	return o.upper.RemoveXattr(name, attr)
+}
+
+func (o *OverlayFS) ListXattrs(name string) (map[string][]byte, error) {
+	name, l, err := o.lookup(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return l.ListXattrs(name)
+}
+
+// Supports reports whether the OverlayFS supports a Feature, which it always does, as it
+// keeps the changes in memory.
+func (o *OverlayFS) Supports(Feature) bool {
+	return true
+}
+
+// WriteDelta writes the changes to the base as a tar to w, like an OCI image layer: the
+// files that were created or changed, with the directories that they are in, and whiteouts
+// for those that were removed. Files that are hardlinks to each other are written once,
+// and then as hardlinks to the first of their names.
+func (o *OverlayFS) WriteDelta(w io.Writer) error {
+	type entry struct {
+		name     string
+		whiteout bool
+	}
+	var entries []entry
+	if err := fs.WalkDir(o.upper, ".", func(name string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name != "." {
+			entries = append(entries, entry{name: name})
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	for name := range o.whiteouts {
+		entries = append(entries, entry{name: path.Join(path.Dir(name), whiteoutPrefix+path.Base(name)), whiteout: true})
+	}
+	for name := range o.opaque {
+		entries = append(entries, entry{name: path.Join(name, opaqueWhiteout), whiteout: true})
+	}
+	o.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+
+	tw := tar.NewWriter(w)
+	// the first name of each file of the upper filesystem written, for its hardlinks
+	written := map[*node]string{}
+	for _, e := range entries {
+		if e.whiteout {
+			if err := tw.WriteHeader(&tar.Header{Name: e.name, Typeflag: tar.TypeReg}); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := o.writeUpperFile(tw, e.name, written); err != nil {
+			return fmt.Errorf("writing %s: %w", e.name, err)
+		}
+	}
+	return tw.Close()
+}
+
+// writeUpperFile writes name from the upper filesystem to tw, or a hardlink to the name in
+// written of the same file, if it was written already.
+func (o *OverlayFS) writeUpperFile(tw *tar.Writer, name string, written map[*node]string) error {
+	fi, err := o.upper.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if mfi, ok := fi.(*memFileInfo); ok && fi.Mode().IsRegular() {
+		if first, ok := written[mfi.node]; ok {
+			return tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeLink, Linkname: first})
+		}
+		written[mfi.node] = name
+	}
+	var link string
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		if link, err = o.upper.Readlink(name); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	if sys, ok := fi.Sys().(*tar.Header); ok {
+		hdr.Uid, hdr.Gid = sys.Uid, sys.Gid
+	}
+	if fi.Mode()&fs.ModeCharDevice != 0 {
+		dev, err := o.upper.Readnod(name)
+		if err != nil {
+			return err
+		}
+		hdr.Devmajor = int64(unix.Major(uint64(dev)))
+		hdr.Devminor = int64(unix.Minor(uint64(dev)))
+	}
+	xattrs, err := o.upper.ListXattrs(name)
+	if err != nil {
+		return err
+	}
+	for attr, data := range xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords["SCHILY.xattr."+attr] = string(data)
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	f, err := o.upper.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestOverlayFS(t *testing.T) {
+	base := NewMemFS()
+	for _, dir := range []string{"etc", "usr", "usr/lib", "var", "var/cache"} {
+		require.NoError(t, base.Mkdir(dir, 0o755))
+	}
+	for name, content := range map[string]string{
+		"etc/a":         "a",
+		"etc/b":         "b",
+		"usr/lib/x":     "x",
+		"var/cache/old": "old",
+	} {
+		require.NoError(t, base.WriteFile(name, []byte(content), 0o644))
+	}
+	require.NoError(t, base.Symlink("usr/lib", "lib"))
+	require.NoError(t, base.Chown("etc/a", 10, 20))
+
+	o := NewOverlayFS(base)
+	names := func(dir string) []string {
+		entries, err := o.ReadDir(dir)
+		require.NoError(t, err)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+
+	// changing a file copies it up
+	require.NoError(t, o.WriteFile("etc/a", []byte("changed"), 0o644))
+	b, err := o.ReadFile("etc/a")
+	require.NoError(t, err)
+	require.Equal(t, "changed", string(b))
+	fi, err := o.Stat("etc/a")
+	require.NoError(t, err)
+	require.Equal(t, 10, fi.Sys().(*tar.Header).Uid)
+
+	// removing one hides it
+	require.NoError(t, o.Remove("etc/b"))
+	_, err = o.Stat("etc/b")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.Equal(t, []string{"a"}, names("etc"))
+
+	// through a symlink of the base
+	require.NoError(t, o.WriteFile("lib/y", []byte("y"), 0o644))
+	b, err = o.ReadFile("usr/lib/y")
+	require.NoError(t, err)
+	require.Equal(t, "y", string(b))
+	require.Equal(t, []string{"x", "y"}, names("lib"))
+
+	// only a directory that is empty is removed
+	var errno unix.Errno
+	require.ErrorAs(t, o.Remove("var/cache"), &errno)
+	require.Equal(t, unix.ENOTEMPTY, errno)
+	require.NoError(t, o.WriteFile("var/cache/more", []byte("more"), 0o644))
+	require.NoError(t, o.Remove("var/cache/old"))
+	require.Error(t, o.Remove("var/cache"))
+	require.NoError(t, o.Remove("var/cache/more"))
+
+	// a directory created again does not have the files it had
+	require.NoError(t, o.Remove("var/cache"))
+	require.NoError(t, o.MkdirAll("var/cache", 0o755))
+	require.NoError(t, o.WriteFile("var/cache/new", []byte("new"), 0o644))
+	require.Equal(t, []string{"new"}, names("var/cache"))
+
+	// hardlinks, to a file of the base, which is copied up
+	require.NoError(t, o.Link("usr/lib/x", "usr/lib/x2"))
+	require.NoError(t, o.Link("usr/lib/x", "usr/lib/x3"))
+
+	// the base is as it was
+	b, err = base.ReadFile("etc/a")
+	require.NoError(t, err)
+	require.Equal(t, "a", string(b))
+	_, err = base.Stat("etc/b")
+	require.NoError(t, err)
+	_, err = base.Stat("usr/lib/y")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	var buf bytes.Buffer
+	require.NoError(t, o.WriteDelta(&buf))
+	var delta []string
+	links := 0
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		delta = append(delta, hdr.Name)
+		if hdr.Typeflag == tar.TypeLink {
+			require.Equal(t, "usr/lib/x", hdr.Linkname, hdr.Name)
+			links++
+		}
+		if hdr.Name == "etc/a" {
+			require.Equal(t, 10, hdr.Uid)
+			b, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			require.Equal(t, "changed", string(b))
+		}
+	}
+	require.Equal(t, []string{
+		"etc/",
+		"etc/.wh.b",
+		"etc/a",
+		"usr/",
+		"usr/lib/",
+		"usr/lib/x",
+		"usr/lib/x2",
+		"usr/lib/x3",
+		"usr/lib/y",
+		"var/",
+		"var/cache/",
+		"var/cache/.wh..wh..opq",
+		"var/cache/new",
+	}, delta)
+	require.Equal(t, 2, links)
+}
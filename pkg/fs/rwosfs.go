@@ -195,6 +195,10 @@ type dirFS struct {
 	// can exist on disk. Maps the case-sensitive to the case-insensitive variant
 	caseMap      map[string]string
 	caseMapMutex sync.Mutex
+	// hardlinks is whether the filesystem on disk can create hardlinks, probed once by
+	// hardlinksOnce.
+	hardlinks     bool
+	hardlinksOnce sync.Once
 }
 
 func (f *dirFS) Readlink(name string) (string, error) {
@@ -454,6 +458,41 @@ func (f *dirFS) Link(oldname, newname string) error {
 	return f.overrides.Link(oldname, newname)
 }
 
+// CloneFile creates name as a reflink of the file src on disk, see CloneFS.
+func (f *dirFS) CloneFile(src, name string, perm fs.FileMode) error {
+	if !f.createOnDisk(name) {
+		return fmt.Errorf("cannot clone %s to %s: only a variant in memory is possible", src, name)
+	}
+	if err := reflink(src, filepath.Join(f.base, name), perm); err != nil {
+		return err
+	}
+	return f.createOverride(name, perm)
+}
+
+// LinkFile creates name as a hardlink to the file src on disk, see CloneFS.
+func (f *dirFS) LinkFile(src, name string) error {
+	if !f.createOnDisk(name) {
+		return fmt.Errorf("cannot link %s to %s: only a variant in memory is possible", src, name)
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if err := os.Link(src, filepath.Join(f.base, name)); err != nil {
+		return err
+	}
+	return f.createOverride(name, fi.Mode())
+}
+
+// createOverride records in memory a file that was created on disk.
+func (f *dirFS) createOverride(name string, perm fs.FileMode) error {
+	file, err := f.overrides.OpenFile(name, os.O_CREATE, perm)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
 func (f *dirFS) Symlink(oldname, newname string) error {
 	// For symlink, take target as is.
 	// If it is outside of the base, it will be resolved by Readlink.
@@ -503,6 +542,48 @@ func (f *dirFS) Chown(path string, uid, gid int) error {
 	return f.overrides.Chown(path, uid, gid)
 }
 
+func (f *dirFS) Chtimes(path string, atime, mtime time.Time) error {
+	if f.caseSensitiveOnDisk(path) {
+		if err := os.Chtimes(filepath.Join(f.base, path), atime, mtime); err != nil {
+			return err
+		}
+	}
+	if c, ok := f.overrides.(ChtimesFS); ok {
+		return c.Chtimes(path, atime, mtime)
+	}
+	return nil
+}
+
+// Supports reports whether the dirFS supports a Feature. What the filesystem on disk cannot
+// do with ownership and xattrs is kept in memory, but hardlinks must be created on disk, so
+// whether it can is probed on first use.
+func (f *dirFS) Supports(feature Feature) bool {
+	if feature != FeatureHardlinks {
+		return true
+	}
+	f.hardlinksOnce.Do(func() {
+		f.hardlinks = probeHardlinks(f.base)
+	})
+	return f.hardlinks
+}
+
+// probeHardlinks returns whether hardlinks can be created in the directory dir, by creating
+// one to a temporary file, and removing both.
+func probeHardlinks(dir string) bool {
+	file, err := os.CreateTemp(dir, ".hardlink-probe-*")
+	if err != nil {
+		return false
+	}
+	name := file.Name()
+	file.Close()
+	defer os.Remove(name)
+	if err := os.Link(name, name+".link"); err != nil {
+		return false
+	}
+	os.Remove(name + ".link")
+	return true
+}
+
 func (f *dirFS) Mknod(name string, mode uint32, dev int) error {
 	if f.caseSensitiveOnDisk(name) {
 		err := unix.Mknod(filepath.Join(f.base, name), mode, dev)
@@ -195,3 +195,51 @@ func TestDirFSConsistentOrdering(t *testing.T) {
 	}
 	// all results should be the same
 }
+
+func TestDirFSLinkFile(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "hello")
+	require.NoError(t, os.WriteFile(src, []byte("hello"), 0o755))
+
+	dir := t.TempDir()
+	fsys := DirFS(dir).(CloneFS)
+	require.NoError(t, fsys.LinkFile(src, "hello"))
+	b, err := fsys.ReadFile("hello")
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(b))
+	fi, err := fsys.Stat("hello")
+	require.NoError(t, err)
+	require.Equal(t, fs.FileMode(0o755), fi.Mode().Perm())
+	srcInfo, err := os.Stat(src)
+	require.NoError(t, err)
+	diskInfo, err := os.Stat(filepath.Join(dir, "hello"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(srcInfo, diskInfo))
+
+	// reflinks depend on the filesystem; when it cannot, nothing is created
+	if err := fsys.CloneFile(src, "clone", 0o644); err != nil {
+		_, err := os.Stat(filepath.Join(dir, "clone"))
+		require.ErrorIs(t, err, fs.ErrNotExist)
+		return
+	}
+	b, err = fsys.ReadFile("clone")
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(b))
+}
+
+func TestDirFSSupportsHardlinks(t *testing.T) {
+	dir := t.TempDir()
+	fsys := DirFS(dir).(FeatureFS)
+	require.True(t, fsys.Supports(FeatureHardlinks))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries, "the probe leaves nothing behind")
+
+	// a directory that cannot be written to cannot have hardlinks either
+	if os.Getuid() == 0 {
+		t.Skip("root can write to any directory")
+	}
+	readonly := t.TempDir()
+	require.NoError(t, os.Chmod(readonly, 0o555))
+	t.Cleanup(func() { _ = os.Chmod(readonly, 0o755) })
+	require.False(t, DirFS(readonly).(FeatureFS).Supports(FeatureHardlinks))
+}
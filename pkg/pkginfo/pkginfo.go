@@ -0,0 +1,250 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pkginfo reads and writes .PKGINFO, the metadata file in the control section of
+// an apk package.
+package pkginfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// PkgInfo is the content of a .PKGINFO file.
+type PkgInfo struct {
+	Name        string
+	Version     string
+	Description string
+	URL         string
+	BuildDate   int64
+	Packager    string
+	// Size is the installed size of the package, in bytes.
+	Size             uint64
+	Arch             string
+	Origin           string
+	Commit           string
+	Maintainer       string
+	License          string
+	Replaces         []string
+	ReplacesPriority uint64
+	ProviderPriority uint64
+	InstallIf        []string
+	Triggers         []string
+	Depends          []string
+	Provides         []string
+	// DataHash is the hex encoded SHA256 of the data section of the package.
+	DataHash string
+
+	// layout is the lines of the parsed file, so that Write reproduces it.
+	layout []line
+}
+
+// line is a line of a parsed .PKGINFO. Comments, blank lines and unknown keys have no key
+// and are written as they were.
+type line struct {
+	raw   string
+	key   string
+	value string
+}
+
+type field struct {
+	key string
+	num bool
+	// get returns the values of the field, one per line.
+	get func(p *PkgInfo) []string
+	// set sets the field from the value of one line.
+	set func(p *PkgInfo, value string) error
+}
+
+func stringField(key string, f func(p *PkgInfo) *string) field {
+	return field{
+		key: key,
+		get: func(p *PkgInfo) []string { return []string{*f(p)} },
+		set: func(p *PkgInfo, v string) error { *f(p) = v; return nil },
+	}
+}
+
+func uintField(key string, f func(p *PkgInfo) *uint64) field {
+	return field{
+		key: key,
+		num: true,
+		get: func(p *PkgInfo) []string { return []string{strconv.FormatUint(*f(p), 10)} },
+		set: func(p *PkgInfo, v string) (err error) {
+			*f(p), err = strconv.ParseUint(v, 10, 64)
+			return err
+		},
+	}
+}
+
+// listField is a field with one line per value.
+func listField(key string, f func(p *PkgInfo) *[]string) field {
+	return field{
+		key: key,
+		get: func(p *PkgInfo) []string { return *f(p) },
+		set: func(p *PkgInfo, v string) error { *f(p) = append(*f(p), v); return nil },
+	}
+}
+
+// wordsField is a field with all the values on one line, separated by spaces.
+func wordsField(key string, f func(p *PkgInfo) *[]string) field {
+	return field{
+		key: key,
+		get: func(p *PkgInfo) []string {
+			if len(*f(p)) == 0 {
+				return nil
+			}
+			return []string{strings.Join(*f(p), " ")}
+		},
+		set: func(p *PkgInfo, v string) error { *f(p) = append(*f(p), strings.Fields(v)...); return nil },
+	}
+}
+
+// fields are in the order abuild writes them.
+var fields = []field{
+	stringField("pkgname", func(p *PkgInfo) *string { return &p.Name }),
+	stringField("pkgver", func(p *PkgInfo) *string { return &p.Version }),
+	stringField("pkgdesc", func(p *PkgInfo) *string { return &p.Description }),
+	stringField("url", func(p *PkgInfo) *string { return &p.URL }),
+	{
+		key: "builddate",
+		num: true,
+		get: func(p *PkgInfo) []string { return []string{strconv.FormatInt(p.BuildDate, 10)} },
+		set: func(p *PkgInfo, v string) (err error) {
+			p.BuildDate, err = strconv.ParseInt(v, 10, 64)
+			return err
+		},
+	},
+	stringField("packager", func(p *PkgInfo) *string { return &p.Packager }),
+	uintField("size", func(p *PkgInfo) *uint64 { return &p.Size }),
+	stringField("arch", func(p *PkgInfo) *string { return &p.Arch }),
+	stringField("origin", func(p *PkgInfo) *string { return &p.Origin }),
+	stringField("commit", func(p *PkgInfo) *string { return &p.Commit }),
+	stringField("maintainer", func(p *PkgInfo) *string { return &p.Maintainer }),
+	stringField("license", func(p *PkgInfo) *string { return &p.License }),
+	listField("replaces", func(p *PkgInfo) *[]string { return &p.Replaces }),
+	uintField("replaces_priority", func(p *PkgInfo) *uint64 { return &p.ReplacesPriority }),
+	uintField("provider_priority", func(p *PkgInfo) *uint64 { return &p.ProviderPriority }),
+	wordsField("install_if", func(p *PkgInfo) *[]string { return &p.InstallIf }),
+	wordsField("triggers", func(p *PkgInfo) *[]string { return &p.Triggers }),
+	listField("depend", func(p *PkgInfo) *[]string { return &p.Depends }),
+	listField("provides", func(p *PkgInfo) *[]string { return &p.Provides }),
+	stringField("datahash", func(p *PkgInfo) *string { return &p.DataHash }),
+}
+
+func fieldByKey(key string) (field, bool) {
+	for _, f := range fields {
+		if f.key == key {
+			return f, true
+		}
+	}
+	return field{}, false
+}
+
+// Parse parses a .PKGINFO: "key = value" lines, where list keys like depend may repeat,
+// and lines starting with # are comments. Unknown keys are ignored, but kept by Write.
+func Parse(r io.Reader) (*PkgInfo, error) {
+	p := &PkgInfo{}
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		raw, err := br.ReadString('\n')
+		if raw == "" && err == io.EOF {
+			return p, nil
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		text := strings.TrimSpace(raw)
+		if text == "" || strings.HasPrefix(text, "#") {
+			p.layout = append(p.layout, line{raw: raw})
+			continue
+		}
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		f, ok := fieldByKey(key)
+		if !ok {
+			p.layout = append(p.layout, line{raw: raw})
+			continue
+		}
+		if err := f.set(p, value); err != nil {
+			return nil, fmt.Errorf("line %d: parsing %s: %w", n, key, err)
+		}
+		p.layout = append(p.layout, line{raw: raw, key: key, value: value})
+	}
+}
+
+// Write writes p as "key = value" lines. A PkgInfo returned by Parse is written as it was
+// read, byte for byte, except for the lines of changed fields; new fields are added at
+// the end. Otherwise fields are written in the order of abuild, and empty fields are
+// omitted, except pkgname and pkgver.
+func (p *PkgInfo) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	write := func(key, value string) {
+		fmt.Fprintf(bw, "%s = %s\n", key, value)
+	}
+
+	// The number of lines written, and to write, for each key in the layout.
+	written, remaining := map[string]int{}, map[string]int{}
+	for _, l := range p.layout {
+		if l.key != "" {
+			remaining[l.key]++
+		}
+	}
+	for _, l := range p.layout {
+		if l.key == "" {
+			bw.WriteString(l.raw)
+			continue
+		}
+		f, _ := fieldByKey(l.key)
+		values := f.get(p)
+		i := written[l.key]
+		remaining[l.key]--
+		if i < len(values) {
+			if values[i] == l.value {
+				bw.WriteString(l.raw)
+			} else {
+				write(l.key, values[i])
+			}
+			i++
+		}
+		if remaining[l.key] == 0 {
+			// This was the last line of the key: write the values that were added.
+			for ; i < len(values); i++ {
+				write(l.key, values[i])
+			}
+		}
+		written[l.key] = i
+	}
+
+	for _, f := range fields {
+		if _, ok := written[f.key]; ok {
+			continue
+		}
+		for _, v := range f.get(p) {
+			required := f.key == "pkgname" || f.key == "pkgver"
+			if !required && (v == "" || f.num && v == "0") {
+				continue
+			}
+			write(f.key, v)
+		}
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkginfo
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	p := &PkgInfo{
+		Name:             "hello",
+		Version:          "1.0-r0",
+		Description:      "hello world",
+		BuildDate:        1700000000,
+		Size:             4096,
+		Arch:             "x86_64",
+		Origin:           "hello",
+		License:          "MIT",
+		Replaces:         []string{"hello-old"},
+		ProviderPriority: 10,
+		InstallIf:        []string{"hello-base", "busybox"},
+		Triggers:         []string{"/usr/share/hello/*"},
+		Depends:          []string{"busybox", "so:libc.musl-x86_64.so.1"},
+		Provides:         []string{"cmd:hello=1.0-r0"},
+		DataHash:         "abcd",
+	}
+	var buf bytes.Buffer
+	require.NoError(t, p.Write(&buf))
+	require.Equal(t, `pkgname = hello
+pkgver = 1.0-r0
+pkgdesc = hello world
+builddate = 1700000000
+size = 4096
+arch = x86_64
+origin = hello
+license = MIT
+replaces = hello-old
+provider_priority = 10
+install_if = hello-base busybox
+triggers = /usr/share/hello/*
+depend = busybox
+depend = so:libc.musl-x86_64.so.1
+provides = cmd:hello=1.0-r0
+datahash = abcd
+`, buf.String())
+
+	buf.Reset()
+	require.NoError(t, (&PkgInfo{Name: "empty"}).Write(&buf))
+	require.Equal(t, "pkgname = empty\npkgver = \n", buf.String())
+}
+
+func TestParse(t *testing.T) {
+	b, err := os.ReadFile("testdata/abuild.PKGINFO")
+	require.NoError(t, err)
+	p, err := Parse(bytes.NewReader(b))
+	require.NoError(t, err)
+	require.Equal(t, "alpine-baselayout", p.Name)
+	require.Equal(t, "3.2.0-r23", p.Version)
+	require.Equal(t, int64(1662926906), p.BuildDate)
+	require.Equal(t, uint64(339968), p.Size)
+	require.Equal(t, "aarch64", p.Arch)
+	require.Equal(t, []string{"alpine-baselayout-data=3.2.0-r23", "/bin/sh", "so:libc.musl-aarch64.so.1"}, p.Depends)
+	require.Equal(t, []string{"cmd:mkmntdirs=3.2.0-r23"}, p.Provides)
+	require.Equal(t, "1a3a8e47d2287da6d505d973412cee1ad64bcc17bc5995069e4e932055ecb0c4", p.DataHash)
+
+	_, err = Parse(strings.NewReader("pkgname = foo\nsize = big\n"))
+	require.ErrorContains(t, err, "line 2")
+	_, err = Parse(strings.NewReader("pkgname\n"))
+	require.Error(t, err)
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, name := range []string{"abuild.PKGINFO", "melange.PKGINFO"} {
+		t.Run(name, func(t *testing.T) {
+			b, err := os.ReadFile(filepath.Join("testdata", name))
+			require.NoError(t, err)
+			p, err := Parse(bytes.NewReader(b))
+			require.NoError(t, err)
+
+			var buf bytes.Buffer
+			require.NoError(t, p.Write(&buf))
+			require.Equal(t, string(b), buf.String())
+		})
+	}
+}
+
+func TestWriteChanged(t *testing.T) {
+	p, err := Parse(strings.NewReader(`# comment
+pkgname = foo
+pkgver = 1.0-r0
+depend = a
+unknown = kept
+depend = b
+`))
+	require.NoError(t, err)
+	p.Version = "1.0-r1"
+	p.Depends = append(p.Depends, "c")
+	p.DataHash = "abcd"
+
+	var buf bytes.Buffer
+	require.NoError(t, p.Write(&buf))
+	require.Equal(t, `# comment
+pkgname = foo
+pkgver = 1.0-r1
+depend = a
+unknown = kept
+depend = b
+depend = c
+datahash = abcd
+`, buf.String())
+}
@@ -0,0 +1,143 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signature
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// apk-tools v3 (ADB) signatures live in their own SIG block after the ADB block they sign.
+// See https://gitlab.alpinelinux.org/alpine/apk-tools/-/blob/master/src/adb.h
+//
+//	struct adb_sign_hdr { uint8_t sign_ver, hash_alg; };
+//	struct adb_sign_v0 { struct adb_sign_hdr hdr; uint8_t id[16]; uint8_t sig[]; };
+//
+// The signed message is the 8 byte ADB file header, followed by the 18 byte adb_sign_v0
+// header, followed by the hash_alg digest of the ADB block payload. RSA keys sign it with
+// SHA512, ed25519 keys sign it directly.
+const (
+	adbSignHeaderSize = 2 + adbKeyIDSize
+	adbKeyIDSize      = 16
+)
+
+// ADB digest algorithms, as numbered by apk-tools.
+const (
+	adbDigestSHA1   = 2
+	adbDigestSHA256 = 3
+	adbDigestSHA512 = 4
+)
+
+// ADBKeyID returns the 16 byte identifier apk-tools v3 uses to refer to a PEM encoded
+// public key in signatures: the first 16 bytes of the SHA512 of the DER encoded key.
+func ADBKeyID(publicKey []byte) ([]byte, error) {
+	pub, err := parsePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var der []byte
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		der = x509.MarshalPKCS1PublicKey(k)
+	case ed25519.PublicKey:
+		der = k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", pub)
+	}
+
+	sum := sha512.Sum512(der)
+	return sum[:adbKeyIDSize], nil
+}
+
+// VerifyADBSignature verifies the payload of an apk-tools v3 SIG block against the payload
+// of the ADB block it signs. fileHeader is the 8 byte header at the start of the ADB file.
+// Every key whose ADBKeyID matches the id in the signature is tried.
+func VerifyADBSignature(fileHeader, adb, sig []byte, keys map[string][]byte) error {
+	_, _, err := ADBVerifyingKey(fileHeader, adb, sig, keys)
+	return err
+}
+
+// ADBVerifyingKey is like VerifyADBSignature, and returns the name of the key that verified
+// the signature and the algorithm of the signature: AlgorithmRSA512 for RSA keys, which
+// sign a SHA512 digest, or AlgorithmEd25519.
+func ADBVerifyingKey(fileHeader, adb, sig []byte, keys map[string][]byte) (string, Algorithm, error) {
+	if len(fileHeader) != 8 {
+		return "", "", fmt.Errorf("invalid ADB file header length %d", len(fileHeader))
+	}
+	if len(sig) <= adbSignHeaderSize {
+		return "", "", fmt.Errorf("ADB signature too short: %d bytes", len(sig))
+	}
+	if version := sig[0]; version != 0 {
+		return "", "", fmt.Errorf("unsupported ADB signature version %d", version)
+	}
+
+	var h hash.Hash
+	switch alg := sig[1]; alg {
+	case adbDigestSHA1:
+		h = sha1.New() //nolint:gosec
+	case adbDigestSHA256:
+		h = sha256.New()
+	case adbDigestSHA512:
+		h = sha512.New()
+	default:
+		return "", "", fmt.Errorf("unsupported ADB signature digest %d", alg)
+	}
+	h.Write(adb)
+
+	var msg bytes.Buffer
+	msg.Write(fileHeader)
+	msg.Write(sig[:adbSignHeaderSize])
+	msg.Write(h.Sum(nil))
+
+	id, signature := sig[2:adbSignHeaderSize], sig[adbSignHeaderSize:]
+	var tried bool
+	for name, key := range keys {
+		keyID, err := ADBKeyID(key)
+		if err != nil || !bytes.Equal(keyID, id) {
+			continue
+		}
+		tried = true
+
+		pub, err := parsePublicKey(key)
+		if err != nil {
+			continue
+		}
+		switch k := pub.(type) {
+		case *rsa.PublicKey:
+			digest := sha512.Sum512(msg.Bytes())
+			if rsa.VerifyPKCS1v15(k, crypto.SHA512, digest[:], signature) == nil {
+				return name, AlgorithmRSA512, nil
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(k, msg.Bytes(), signature) {
+				return name, AlgorithmEd25519, nil
+			}
+		}
+	}
+	if !tried {
+		return "", "", fmt.Errorf("no key found with ADB key id %x", id)
+	}
+	return "", "", errors.New("ADB signature did not verify with any matching key")
+}
@@ -0,0 +1,172 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signature
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errNoEd25519Key = errors.New("key is not an ed25519 key")
+
+// Algorithm is a signature scheme, as named in the .SIGN.<algorithm>.<key name> files
+// that hold signatures in the v2 package and index formats.
+type Algorithm string
+
+const (
+	// AlgorithmRSA is RSA PKCS#1 v1.5 over a SHA1 digest; the classic apk-tools 2.x scheme.
+	AlgorithmRSA Algorithm = "RSA"
+	// AlgorithmRSA256 is RSA PKCS#1 v1.5 over a SHA256 digest.
+	AlgorithmRSA256 Algorithm = "RSA256"
+	// AlgorithmRSA512 is RSA PKCS#1 v1.5 over a SHA512 digest.
+	AlgorithmRSA512 Algorithm = "RSA512"
+	// AlgorithmEd25519 is pure Ed25519 over the signed data.
+	AlgorithmEd25519 Algorithm = "ED25519"
+)
+
+// ParseSignatureName splits the name of a signature file, e.g. ".SIGN.RSA.key.rsa.pub",
+// into its algorithm and key name. It returns false if the name is not a signature file
+// of a known algorithm.
+func ParseSignatureName(name string) (Algorithm, string, bool) {
+	rest, ok := strings.CutPrefix(name, ".SIGN.")
+	if !ok {
+		return "", "", false
+	}
+	alg, keyName, ok := strings.Cut(rest, ".")
+	if !ok || keyName == "" {
+		return "", "", false
+	}
+	switch a := Algorithm(alg); a {
+	case AlgorithmRSA, AlgorithmRSA256, AlgorithmRSA512, AlgorithmEd25519:
+		return a, keyName, true
+	default:
+		return "", "", false
+	}
+}
+
+// Verify verifies a signature over data with the algorithm and PEM encoded public key.
+func Verify(alg Algorithm, data, signature, publicKey []byte) error {
+	switch alg {
+	case AlgorithmRSA:
+		digest := sha1.Sum(data) //nolint:gosec
+		return RSAVerifyDigest(crypto.SHA1, digest[:], signature, publicKey)
+	case AlgorithmRSA256:
+		digest := sha256.Sum256(data)
+		return RSAVerifyDigest(crypto.SHA256, digest[:], signature, publicKey)
+	case AlgorithmRSA512:
+		digest := sha512.Sum512(data)
+		return RSAVerifyDigest(crypto.SHA512, digest[:], signature, publicKey)
+	case AlgorithmEd25519:
+		return Ed25519Verify(data, signature, publicKey)
+	default:
+		return fmt.Errorf("unsupported signature algorithm %q", alg)
+	}
+}
+
+// VerifyWithKeys verifies a signature over data against a set of PEM encoded public keys.
+// The key named keyName is tried first; if it is missing or does not verify, all other keys
+// are tried as well.
+func VerifyWithKeys(alg Algorithm, keyName string, data, signature []byte, keys map[string][]byte) error {
+	_, err := VerifyingKey(alg, keyName, data, signature, keys)
+	return err
+}
+
+// VerifyingKey is like VerifyWithKeys, and returns the name of the key that verified the
+// signature.
+func VerifyingKey(alg Algorithm, keyName string, data, signature []byte, keys map[string][]byte) (string, error) {
+	if len(keys) == 0 {
+		return "", errors.New("no keys provided to verify signature")
+	}
+	if key, ok := keys[keyName]; ok {
+		if err := Verify(alg, data, signature, key); err == nil {
+			return keyName, nil
+		}
+	}
+	for name, key := range keys {
+		if name == keyName {
+			continue
+		}
+		if err := Verify(alg, data, signature, key); err == nil {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no key found to verify %s signature for keyfile %s; tried all other keys as well", alg, keyName)
+}
+
+// RSAVerifyDigest verifies an RSA PKCS#1 v1.5 signature over a digest made with hash.
+// The key must be in the PEM format.
+func RSAVerifyDigest(hash crypto.Hash, digest, signature, publicKey []byte) error {
+	if len(digest) != hash.Size() {
+		return fmt.Errorf("digest is not a %s hash", hash)
+	}
+
+	pub, err := parsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return errNoRSAKey
+	}
+
+	if err := rsa.VerifyPKCS1v15(rsaPub, hash, digest, signature); err != nil {
+		return fmt.Errorf("verify PKCS1v15 signature: %w", err)
+	}
+
+	return nil
+}
+
+// Ed25519Verify verifies an Ed25519 signature over data. The key must be in the PEM format.
+func Ed25519Verify(data, signature, publicKey []byte) error {
+	pub, err := parsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	edPub, ok := pub.(ed25519.PublicKey)
+	if !ok {
+		return errNoEd25519Key
+	}
+
+	if !ed25519.Verify(edPub, data, signature) {
+		return errors.New("verify ed25519 signature: invalid signature")
+	}
+
+	return nil
+}
+
+func parsePublicKey(publicKey []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(publicKey)
+	if block == nil {
+		return nil, errNoPemBlock
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse PKIX public key: %w", err)
+	}
+
+	return pub, nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signature
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testPublicKeyPEM(t *testing.T, pub crypto.PublicKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestParseSignatureName(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		alg     Algorithm
+		keyName string
+		ok      bool
+	}{
+		{".SIGN.RSA.alpine-devel@lists.alpinelinux.org-4a6a0840.rsa.pub", AlgorithmRSA, "alpine-devel@lists.alpinelinux.org-4a6a0840.rsa.pub", true},
+		{".SIGN.RSA256.key.rsa.pub", AlgorithmRSA256, "key.rsa.pub", true},
+		{".SIGN.ED25519.key.pub", AlgorithmEd25519, "key.pub", true},
+		{".SIGN.DSA.key.pub", "", "", false},
+		{".SIGN.RSA.", "", "", false},
+		{".PKGINFO", "", "", false},
+	} {
+		alg, keyName, ok := ParseSignatureName(tt.name)
+		require.Equal(t, tt.ok, ok, tt.name)
+		require.Equal(t, tt.alg, alg, tt.name)
+		require.Equal(t, tt.keyName, keyName, tt.name)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	data := []byte("some signed data")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaPub := testPublicKeyPEM(t, &rsaKey.PublicKey)
+
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edPubPEM := testPublicKeyPEM(t, edPub)
+
+	digest := sha256.Sum256(data)
+	rsaSig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	edSig := ed25519.Sign(edKey, data)
+
+	require.NoError(t, Verify(AlgorithmRSA256, data, rsaSig, rsaPub))
+	require.Error(t, Verify(AlgorithmRSA, data, rsaSig, rsaPub))
+	require.Error(t, Verify(AlgorithmRSA256, []byte("other data"), rsaSig, rsaPub))
+	require.ErrorIs(t, Verify(AlgorithmRSA256, data, rsaSig, edPubPEM), errNoRSAKey)
+
+	require.NoError(t, Verify(AlgorithmEd25519, data, edSig, edPubPEM))
+	require.Error(t, Verify(AlgorithmEd25519, []byte("other data"), edSig, edPubPEM))
+	require.ErrorIs(t, Verify(AlgorithmEd25519, data, edSig, rsaPub), errNoEd25519Key)
+
+	keys := map[string][]byte{"rsa.pub": rsaPub, "ed.pub": edPubPEM}
+	require.NoError(t, VerifyWithKeys(AlgorithmEd25519, "ed.pub", data, edSig, keys))
+	// A wrong key name still verifies with the other keys.
+	require.NoError(t, VerifyWithKeys(AlgorithmEd25519, "missing.pub", data, edSig, keys))
+	name, err := VerifyingKey(AlgorithmEd25519, "missing.pub", data, edSig, keys)
+	require.NoError(t, err)
+	require.Equal(t, "ed.pub", name)
+	require.Error(t, VerifyWithKeys(AlgorithmEd25519, "ed.pub", data, edSig, map[string][]byte{"rsa.pub": rsaPub}))
+}
+
+func TestVerifyADBSignature(t *testing.T) {
+	fileHeader := []byte("ADBd\x00\x00\x00\x00")
+	adb := []byte("adb block payload")
+
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edPubPEM := testPublicKeyPEM(t, edPub)
+	id, err := ADBKeyID(edPubPEM)
+	require.NoError(t, err)
+	require.Len(t, id, adbKeyIDSize)
+
+	hdr := append([]byte{0, adbDigestSHA512}, id...)
+	digest := sha512.Sum512(adb)
+	msg := append(append(append([]byte{}, fileHeader...), hdr...), digest[:]...)
+	sig := append(hdr, ed25519.Sign(edKey, msg)...)
+
+	keys := map[string][]byte{"ed.pub": edPubPEM}
+	require.NoError(t, VerifyADBSignature(fileHeader, adb, sig, keys))
+	name, alg, err := ADBVerifyingKey(fileHeader, adb, sig, keys)
+	require.NoError(t, err)
+	require.Equal(t, "ed.pub", name)
+	require.Equal(t, AlgorithmEd25519, alg)
+	require.Error(t, VerifyADBSignature(fileHeader, []byte("tampered"), sig, keys))
+
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	require.ErrorContains(t, VerifyADBSignature(fileHeader, adb, sig, map[string][]byte{"other.pub": testPublicKeyPEM(t, otherPub)}), "no key found")
+}